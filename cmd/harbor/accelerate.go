@@ -0,0 +1,642 @@
+// Copyright 2021 vjranagit
+//
+// Image acceleration commands
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/spf13/cobra"
+	"github.com/vjranagit/harbor/pkg/accelerator"
+	"github.com/vjranagit/harbor/pkg/accelerator/cache"
+	"github.com/vjranagit/harbor/pkg/accelerator/drivers"
+	"github.com/vjranagit/harbor/pkg/accelerator/queue"
+	"github.com/vjranagit/harbor/pkg/distribution"
+	"github.com/vjranagit/harbor/pkg/events"
+	"github.com/vjranagit/harbor/pkg/server"
+)
+
+func newAccelerateCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "accelerate",
+		Short: "Image acceleration (nydus, estargz)",
+		Long: `Convert images into lazily pulled formats and manage the converted layer cache.
+
+Conversions go through the durable job queue shared with harbor server:
+convert and batch enqueue jobs, status and ls inspect them. With --wait the
+queue is worked in this process until the jobs finish; otherwise a running
+harbor server picks them up. The queue database can only be opened by one
+process at a time.`,
+	}
+	cmd.PersistentFlags().String("cache-dir", defaultLayerCacheDir(), "Converted layer cache directory")
+	cmd.PersistentFlags().String("queue", defaultQueuePath(), "Conversion queue database")
+	cmd.PersistentFlags().String("registry", os.Getenv("HARBOR_REGISTRY"), "Registry address (env HARBOR_REGISTRY)")
+	cmd.PersistentFlags().String("username", os.Getenv("HARBOR_USERNAME"), "Registry username (env HARBOR_USERNAME)")
+	cmd.PersistentFlags().String("password", os.Getenv("HARBOR_PASSWORD"), "Registry password (env HARBOR_PASSWORD)")
+
+	cmd.AddCommand(
+		newConvertCmd(),
+		newBatchConvertCmd(),
+		newJobStatusCmd(),
+		newJobListCmd(),
+		newLayerCacheCmd(),
+	)
+
+	return cmd
+}
+
+func newConvertCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "convert <ref>",
+		Short: "Queue the conversion of one image",
+		Long: `Queue the conversion of one image. The converted image is pushed to the
+same repository under a derived tag, e.g. v1-nydus or v1-esgz.
+
+The reference may name the registry, in which case --registry can be omitted.
+Converting an image that is already queued or converted with the same driver
+returns the existing job.`,
+		Example: `  # Convert and follow progress
+  harbor accelerate convert harbor.example.com/library/nginx:1.25 --driver nydus --wait
+
+  # Queue for a running harbor server
+  harbor accelerate convert library/nginx:1.25 --registry harbor.example.com --driver estargz`,
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			driver, _ := cmd.Flags().GetString("driver")
+			priority, _ := cmd.Flags().GetInt("priority")
+
+			ref, err := distribution.ParseReference(args[0])
+			if err != nil {
+				return err
+			}
+			if err := useReferenceRegistry(cmd, ref); err != nil {
+				return err
+			}
+
+			client, converter, closeCache, err := newAccelerateConverter(cmd)
+			if err != nil {
+				return err
+			}
+			defer closeCache()
+			if err := checkDriver(converter, driver); err != nil {
+				return err
+			}
+			ref.Registry = client.Registry()
+
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			desc, err := client.HeadManifest(ctx, ref.Repository, ref.Identifier())
+			if err != nil {
+				return fmt.Errorf("failed to resolve %s: %w", ref, err)
+			}
+
+			q, err := openQueue(cmd)
+			if err != nil {
+				return err
+			}
+			defer q.Close()
+
+			job, err := enqueueConversion(q, ref, desc.Digest, driver, priority)
+			if err != nil {
+				return err
+			}
+			return waitJobs(ctx, cmd, q, converter, []string{job.ID})
+		},
+	}
+	cmd.Flags().String("driver", "nydus", "Conversion driver (nydus, estargz)")
+	cmd.Flags().Int("priority", 0, "Job priority; higher runs first")
+	addWaitFlags(cmd)
+
+	return cmd
+}
+
+func newBatchConvertCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "batch",
+		Short: "Queue the conversion of every image matching a pattern",
+		Long: `Select images from the registry catalog and queue a conversion for each.
+
+--repo-pattern and --tag-pattern are shell patterns where * does not cross a
+/ (e.g. "library/*"). Tags that are themselves conversions, such as v1-nydus,
+are skipped.`,
+		Example: `  # Convert the v* tags of every library repository and wait
+  harbor accelerate batch --registry harbor.example.com \
+    --repo-pattern 'library/*' --tag-pattern 'v*' --driver estargz --wait`,
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			repoPattern, _ := cmd.Flags().GetString("repo-pattern")
+			tagPattern, _ := cmd.Flags().GetString("tag-pattern")
+			driver, _ := cmd.Flags().GetString("driver")
+			priority, _ := cmd.Flags().GetInt("priority")
+
+			if repoPattern == "" {
+				return fmt.Errorf("--repo-pattern required")
+			}
+
+			_, converter, closeCache, err := newAccelerateConverter(cmd)
+			if err != nil {
+				return err
+			}
+			defer closeCache()
+			if err := checkDriver(converter, driver); err != nil {
+				return err
+			}
+
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			candidates, err := converter.Select(ctx, accelerator.Selection{
+				Repositories: repoPattern,
+				Tags:         tagPattern,
+			})
+			if err != nil {
+				return err
+			}
+			if len(candidates) == 0 {
+				fmt.Println("No images match")
+				return nil
+			}
+
+			q, err := openQueue(cmd)
+			if err != nil {
+				return err
+			}
+			defer q.Close()
+
+			ids := make([]string, 0, len(candidates))
+			for _, c := range candidates {
+				job, err := enqueueConversion(q, c.Reference, c.Digest, driver, priority)
+				if err != nil {
+					return err
+				}
+				ids = append(ids, job.ID)
+			}
+			fmt.Printf("  Images: %d\n", len(candidates))
+			return waitJobs(ctx, cmd, q, converter, ids)
+		},
+	}
+	cmd.Flags().String("repo-pattern", "", "Repositories to convert (required)")
+	cmd.Flags().String("tag-pattern", "", "Tags to convert (default every tag)")
+	cmd.Flags().String("driver", "nydus", "Conversion driver (nydus, estargz)")
+	cmd.Flags().Int("priority", 0, "Job priority; higher runs first")
+	addWaitFlags(cmd)
+
+	return cmd
+}
+
+func newJobStatusCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "status <job>",
+		Short: "Show a conversion job",
+		Example: `  # Follow a queued job until it finishes
+  harbor accelerate status job-3 --wait`,
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			wait, _ := cmd.Flags().GetBool("wait")
+
+			q, err := openQueue(cmd)
+			if err != nil {
+				return err
+			}
+			defer q.Close()
+
+			job, err := q.Get(args[0])
+			if err != nil {
+				return err
+			}
+			printJob(job)
+
+			if !wait || jobFinished(job) {
+				return nil
+			}
+
+			ref, err := distribution.ParseReference(job.Source)
+			if err != nil {
+				return err
+			}
+			if err := useReferenceRegistry(cmd, ref); err != nil {
+				return err
+			}
+			_, converter, closeCache, err := newAccelerateConverter(cmd)
+			if err != nil {
+				return err
+			}
+			defer closeCache()
+
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			return waitJobs(ctx, cmd, q, converter, []string{job.ID})
+		},
+	}
+	addWaitFlags(cmd)
+
+	return cmd
+}
+
+func newJobListCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:          "ls",
+		Short:        "List conversion jobs, oldest first",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			state, _ := cmd.Flags().GetString("state")
+
+			var states []queue.State
+			if state != "" {
+				if !slices.Contains(jobStates, queue.State(state)) {
+					return fmt.Errorf("invalid --state %q (one of %s)", state, joinStates(jobStates))
+				}
+				states = append(states, queue.State(state))
+			}
+
+			q, err := openQueue(cmd)
+			if err != nil {
+				return err
+			}
+			defer q.Close()
+
+			jobs, err := q.List(states...)
+			if err != nil {
+				return err
+			}
+			if len(jobs) == 0 {
+				fmt.Println("No conversion jobs")
+				return nil
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "ID\tSOURCE\tDRIVER\tSTATE\tATTEMPTS\tUPDATED")
+			for _, job := range jobs {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d/%d\t%s\n",
+					job.ID, job.Source, job.Driver, job.State, job.Attempts, job.MaxAttempts,
+					job.UpdatedAt.Format(time.RFC3339))
+			}
+			return w.Flush()
+		},
+	}
+	cmd.Flags().String("state", "", "Only list jobs in this state (pending, running, succeeded, dead)")
+
+	return cmd
+}
+
+func newLayerCacheCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "cache",
+		Short: "Inspect the converted layer cache",
+	}
+
+	stats := &cobra.Command{
+		Use:   "stats",
+		Short: "Show cache usage and hit/miss counters",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := openLayerCache(cmd)
+			if err != nil {
+				return err
+			}
+
+			s := c.Stats()
+			fmt.Printf("Cache: %s\n", c.Root())
+			fmt.Printf("  Entries:   %d\n", s.Entries)
+			fmt.Printf("  Size:      %s / %s\n", formatBytes(s.Size), formatBytes(s.MaxSize))
+			fmt.Printf("  Hits:      %d\n", s.Hits)
+			fmt.Printf("  Misses:    %d\n", s.Misses)
+			fmt.Printf("  Hit ratio: %.1f%%\n", s.HitRatio()*100)
+			fmt.Printf("  Evictions: %d\n", s.Evictions)
+			fmt.Printf("  Corrupted: %d\n", s.Corrupted)
+			return nil
+		},
+	}
+
+	list := &cobra.Command{
+		Use:   "ls",
+		Short: "List cached layers, most recently used first",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := openLayerCache(cmd)
+			if err != nil {
+				return err
+			}
+
+			entries := c.Entries()
+			if len(entries) == 0 {
+				fmt.Println("Cache is empty")
+				return nil
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "SOURCE\tDRIVER\tCONVERTED\tSIZE\tLAST USED")
+			for _, e := range entries {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+					shortDigest(e.Source.String()), e.Driver, shortDigest(e.Blob.Digest.String()),
+					formatBytes(e.Blob.Size), e.LastUsed.Format(time.RFC3339))
+			}
+			return w.Flush()
+		},
+	}
+
+	clearCache := &cobra.Command{
+		Use:   "clear",
+		Short: "Remove every cached layer and reset the counters",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := openLayerCache(cmd)
+			if err != nil {
+				return err
+			}
+
+			n := len(c.Entries())
+			if err := c.Clear(); err != nil {
+				return err
+			}
+			fmt.Printf("✓ Removed %d cached layers\n", n)
+			return nil
+		},
+	}
+
+	cmd.AddCommand(stats, list, clearCache)
+	return cmd
+}
+
+func defaultLayerCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = "."
+	}
+	return filepath.Join(dir, "harbor", "layers")
+}
+
+// newImageConverter builds a converter for client's registry with every
+// driver, sharing the layer cache c
+func newImageConverter(client *distribution.Client, c *cache.Cache, bus *events.Bus) *accelerator.Converter {
+	return accelerator.NewConverter(client,
+		accelerator.WithDriver(drivers.NewEStargz(drivers.WithLayerCache(c))),
+		accelerator.WithDriver(drivers.NewNydus(drivers.WithNydusLayerCache(c))),
+		accelerator.WithEvents(bus),
+	)
+}
+
+// newAccelerateConverter builds a registry client from the registry flags
+// and a converter for it using the cache at --cache-dir, and a function
+// closing the cache
+func newAccelerateConverter(cmd *cobra.Command) (*distribution.Client, *accelerator.Converter, func(), error) {
+	client, err := newRegistryClient(cmd)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	c, err := openLayerCache(cmd)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	closeCache := func() {
+		if err := c.Close(); err != nil {
+			slog.Warn("failed to save layer cache index", "error", err)
+		}
+	}
+	return client, newImageConverter(client, c, nil), closeCache, nil
+}
+
+// checkDriver rejects drivers the converter does not have
+func checkDriver(converter *accelerator.Converter, driver string) error {
+	if available := converter.Drivers(); !slices.Contains(available, driver) {
+		return fmt.Errorf("unknown driver %q (available: %s)", driver, strings.Join(available, ", "))
+	}
+	return nil
+}
+
+// useReferenceRegistry defaults --registry to the registry named by ref
+func useReferenceRegistry(cmd *cobra.Command, ref distribution.Reference) error {
+	if addr, _ := cmd.Flags().GetString("registry"); addr != "" || ref.Registry == "" {
+		return nil
+	}
+	return cmd.Flags().Set("registry", ref.Registry)
+}
+
+// openQueue opens the conversion queue at --queue
+func openQueue(cmd *cobra.Command) (*queue.Queue, error) {
+	path, _ := cmd.Flags().GetString("queue")
+	q, err := queue.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w (is harbor server using it?)", err)
+	}
+	return q, nil
+}
+
+// enqueueConversion queues ref for conversion, or finds the job already
+// converting the same manifest with driver
+func enqueueConversion(q *queue.Queue, ref distribution.Reference, dgst digest.Digest, driver string, priority int) (*queue.Job, error) {
+	job, created, err := q.Enqueue(queue.Job{
+		Source:       ref.String(),
+		Driver:       driver,
+		SourceDigest: dgst,
+		Priority:     priority,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to enqueue %s: %w", ref, err)
+	}
+
+	if created {
+		fmt.Printf("✓ Queued %s: %s (%s)\n", job.ID, job.Source, job.Driver)
+	} else {
+		fmt.Printf("  %s already %s: %s (%s)\n", job.ID, job.State, job.Source, job.Driver)
+	}
+	return job, nil
+}
+
+func addWaitFlags(cmd *cobra.Command) {
+	cmd.Flags().Bool("wait", false, "Run the queue in this process until the jobs finish, reporting progress")
+	cmd.Flags().Int("workers", server.DefaultQueueWorkers, "Concurrent conversion jobs while waiting")
+}
+
+// waitPoll is how often --wait checks the jobs it follows
+const waitPoll = 500 * time.Millisecond
+
+// waitJobs returns unless --wait is set; then it works the queue with
+// converter until every job in ids succeeded or was dead-lettered. Other
+// ready jobs of the queue are worked as well
+func waitJobs(ctx context.Context, cmd *cobra.Command, q *queue.Queue, converter *accelerator.Converter, ids []string) error {
+	wait, _ := cmd.Flags().GetBool("wait")
+	workers, _ := cmd.Flags().GetInt("workers")
+
+	if !wait {
+		fmt.Printf("  Follow with: harbor accelerate status %s --wait\n", ids[0])
+		return nil
+	}
+
+	// Equivalent sources share a job
+	var unique []string
+	for _, id := range ids {
+		if !slices.Contains(unique, id) {
+			unique = append(unique, id)
+		}
+	}
+
+	pending := false
+	for _, id := range unique {
+		job, err := q.Get(id)
+		if err != nil {
+			return err
+		}
+		pending = pending || !jobFinished(job)
+	}
+	if !pending {
+		return watchJobs(ctx, q, unique)
+	}
+
+	workCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		q.Process(workCtx, workers, waitPoll, func(ctx context.Context, job *queue.Job) (string, error) {
+			return converter.ConvertImage(ctx, job.Source, job.Driver)
+		})
+	}()
+
+	err := watchJobs(ctx, q, unique)
+	cancel()
+	<-done
+	return err
+}
+
+// watchJobs prints the progress of the jobs in ids until they finish
+func watchJobs(ctx context.Context, q *queue.Queue, ids []string) error {
+	type progress struct {
+		state    queue.State
+		attempts int
+	}
+	seen := make(map[string]progress)
+	finished, failed := 0, 0
+
+	ticker := time.NewTicker(waitPoll)
+	defer ticker.Stop()
+	for finished < len(ids) {
+		for _, id := range ids {
+			job, err := q.Get(id)
+			if err != nil {
+				return err
+			}
+			p := progress{job.State, job.Attempts}
+			if seen[id] == p {
+				continue
+			}
+			seen[id] = p
+
+			switch job.State {
+			case queue.StateRunning:
+				fmt.Printf("  … %s %s: attempt %d/%d\n", job.ID, job.Source, job.Attempts, job.MaxAttempts)
+			case queue.StatePending:
+				if job.LastError != "" {
+					fmt.Printf("  ↻ %s %s: retry at %s: %s\n", job.ID, job.Source, job.NotBefore.Format(time.TimeOnly), job.LastError)
+				}
+			case queue.StateSucceeded:
+				finished++
+				fmt.Printf("  [%d/%d] ✓ %s %s → %s\n", finished, len(ids), job.ID, job.Source, job.Result)
+			case queue.StateDead:
+				finished++
+				failed++
+				fmt.Printf("  [%d/%d] ✗ %s %s: %s\n", finished, len(ids), job.ID, job.Source, job.LastError)
+			}
+		}
+		if finished == len(ids) {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("stopped waiting: %w", ctx.Err())
+		case <-ticker.C:
+		}
+	}
+
+	fmt.Printf("  Converted: %d, failed: %d\n", finished-failed, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d conversions failed", failed, len(ids))
+	}
+	return nil
+}
+
+// jobFinished reports whether a job reached a final state
+func jobFinished(job *queue.Job) bool {
+	return job.State == queue.StateSucceeded || job.State == queue.StateDead
+}
+
+// printJob prints every field of a job that is set
+func printJob(job *queue.Job) {
+	fmt.Printf("Job: %s\n", job.ID)
+	fmt.Printf("  Source:   %s\n", job.Source)
+	if job.SourceDigest != "" {
+		fmt.Printf("  Digest:   %s\n", job.SourceDigest)
+	}
+	fmt.Printf("  Driver:   %s\n", job.Driver)
+	fmt.Printf("  State:    %s\n", job.State)
+	fmt.Printf("  Attempts: %d/%d\n", job.Attempts, job.MaxAttempts)
+	fmt.Printf("  Priority: %d\n", job.Priority)
+	fmt.Printf("  Enqueued: %s\n", job.EnqueuedAt.Format(time.RFC3339))
+	fmt.Printf("  Updated:  %s\n", job.UpdatedAt.Format(time.RFC3339))
+	if job.State == queue.StatePending && job.NotBefore.After(time.Now()) {
+		fmt.Printf("  Retry at: %s\n", job.NotBefore.Format(time.RFC3339))
+	}
+	if job.Result != "" {
+		fmt.Printf("  Result:   %s\n", job.Result)
+	}
+	if job.LastError != "" {
+		fmt.Printf("  Error:    %s\n", job.LastError)
+	}
+}
+
+// jobStates are the states ls can filter on
+var jobStates = []queue.State{queue.StatePending, queue.StateRunning, queue.StateSucceeded, queue.StateDead}
+
+func joinStates(states []queue.State) string {
+	names := make([]string, len(states))
+	for i, s := range states {
+		names[i] = string(s)
+	}
+	return strings.Join(names, ", ")
+}
+
+// openLayerCache opens the cache at --cache-dir
+func openLayerCache(cmd *cobra.Command) (*cache.Cache, error) {
+	dir, _ := cmd.Flags().GetString("cache-dir")
+	c, err := cache.Open(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open layer cache: %w", err)
+	}
+	return c, nil
+}
+
+// shortDigest trims a digest for display
+func shortDigest(dgst string) string {
+	if len(dgst) > 19 {
+		return dgst[:19]
+	}
+	return dgst
+}
+
+// formatBytes renders a size with a binary unit
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,239 @@
+// Copyright 2021 vjranagit
+//
+// Configuration file loading and flag defaults
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/vjranagit/harbor/pkg/config"
+	"github.com/vjranagit/harbor/pkg/registry"
+)
+
+// loadedConfig is the configuration file, nil when none was loaded
+var loadedConfig *config.Config
+
+// activeRegistry is the registry block selected by --profile, nil when no
+// configuration was loaded
+var activeRegistry *config.RegistryConfig
+
+// configFlags are the flags loadConfig set from the configuration file
+var configFlags = map[string]bool{}
+
+// envFlags are flags whose environment variable takes precedence over the
+// configuration file
+var envFlags = map[string]string{
+	"registry": "HARBOR_REGISTRY",
+	"username": "HARBOR_USERNAME",
+	"password": "HARBOR_PASSWORD",
+}
+
+// flagDefaults are the flag values a command tree takes from the config
+type flagDefaults struct {
+	command string
+	values  map[string]string
+}
+
+func registryFlagDefaults(reg *config.RegistryConfig) []flagDefaults {
+	return []flagDefaults{
+		{
+			command: "harbor registry batch",
+			values: map[string]string{
+				"registry":    reg.Address,
+				"username":    reg.Username,
+				"password":    reg.Password,
+				"workers":     strconv.Itoa(reg.Batch.Workers),
+				"timeout":     durationFlag(reg.Batch.Timeout),
+				"attempts":    strconv.Itoa(reg.Batch.Attempts),
+				"backoff":     durationFlag(reg.Batch.Backoff),
+				"max-backoff": zeroDurationFlag(reg.Batch.MaxBackoff),
+				"store":       reg.Protection.Store,
+			},
+		},
+		{
+			command: "harbor accelerate",
+			values: map[string]string{
+				"registry": reg.Address,
+				"username": reg.Username,
+				"password": reg.Password,
+			},
+		},
+		{
+			command: "harbor registry protect",
+			values: map[string]string{
+				"store": reg.Protection.Store,
+			},
+		},
+		{
+			command: "harbor server",
+			values: map[string]string{
+				"registry":       reg.Address,
+				"username":       reg.Username,
+				"password":       reg.Password,
+				"workers":        strconv.Itoa(reg.Batch.Workers),
+				"store":          reg.Protection.Store,
+				"endpoint":       strings.Join(reg.Health.Endpoints, ","),
+				"threshold":      strconv.Itoa(reg.Health.Threshold),
+				"retry-delay":    durationFlag(reg.Health.RetryDelay),
+				"health-timeout": durationFlag(reg.Health.Timeout),
+				"interval":       durationFlag(reg.Health.Interval),
+
+				"max-retry-delay":   zeroDurationFlag(reg.Health.MaxRetryDelay),
+				"success-threshold": strconv.Itoa(reg.Health.SuccessThreshold),
+				"slow-threshold":    durationFlag(reg.Health.SlowThreshold),
+			},
+		},
+		{
+			command: "harbor registry health",
+			values: map[string]string{
+				"threshold":   strconv.Itoa(reg.Health.Threshold),
+				"retry-delay": durationFlag(reg.Health.RetryDelay),
+				"timeout":     durationFlag(reg.Health.Timeout),
+				"interval":    durationFlag(reg.Health.Interval),
+
+				"max-retry-delay":   zeroDurationFlag(reg.Health.MaxRetryDelay),
+				"success-threshold": strconv.Itoa(reg.Health.SuccessThreshold),
+				"slow-threshold":    durationFlag(reg.Health.SlowThreshold),
+			},
+		},
+	}
+}
+
+// defaultConfigPath returns $HARBOR_CONFIG or the per-user config file
+func defaultConfigPath() string {
+	if path := os.Getenv("HARBOR_CONFIG"); path != "" {
+		return path
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "harbor", "config.hcl")
+}
+
+// loadConfig reads --config, or the default file when it exists, and uses
+// the selected registry block as defaults for flags of cmd that were not
+// given on the command line. Precedence is flag, environment, config file,
+// built-in default
+func loadConfig(cmd *cobra.Command) error {
+	path := cfgFile
+	if path == "" {
+		path = defaultConfigPath()
+		if _, err := os.Stat(path); path == "" || err != nil {
+			return nil
+		}
+	}
+
+	cfg, err := config.Load(path)
+	if err != nil {
+		return err
+	}
+	loadedConfig = cfg
+
+	// Deploy commands use --profile to select a harbor block instead
+	commandPath := cmd.CommandPath() + " "
+	if strings.HasPrefix(commandPath, "harbor deploy ") {
+		return nil
+	}
+
+	reg, err := cfg.Registry(profile)
+	if err != nil {
+		return err
+	}
+	if reg == nil {
+		return nil
+	}
+	activeRegistry = reg
+
+	for _, defaults := range registryFlagDefaults(reg) {
+		if !strings.HasPrefix(commandPath, defaults.command+" ") {
+			continue
+		}
+		for name, value := range defaults.values {
+			if err := setFlagDefault(cmd, name, value); err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+		}
+	}
+	return nil
+}
+
+// setFlagDefault sets a flag from the config unless it was given explicitly
+// or through its environment variable
+func setFlagDefault(cmd *cobra.Command, name, value string) error {
+	f := cmd.Flags().Lookup(name)
+	if f == nil || f.Changed || value == "" {
+		return nil
+	}
+	if env, ok := envFlags[name]; ok && os.Getenv(env) != "" {
+		return nil
+	}
+	if err := cmd.Flags().Set(name, value); err != nil {
+		return fmt.Errorf("invalid value %q for --%s: %w", value, name, err)
+	}
+	configFlags[name] = true
+	return nil
+}
+
+// explicitFlag reports whether a flag was given on the command line
+// rather than taken from the configuration file
+func explicitFlag(cmd *cobra.Command, name string) bool {
+	return cmd.Flags().Changed(name) && !configFlags[name]
+}
+
+// durationFlag formats a duration for a flag, leaving zero unset
+func durationFlag(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return d.String()
+}
+
+// zeroDurationFlag formats a duration the config decoder always sets, so
+// zero is an explicit value, such as a max_backoff of "0s"
+func zeroDurationFlag(d time.Duration) string {
+	return d.String()
+}
+
+// activeHarborConfig returns the harbor block selected by --profile
+func activeHarborConfig() (*config.HarborConfig, error) {
+	if loadedConfig == nil {
+		return nil, fmt.Errorf("no config file found; pass --config with a harbor block")
+	}
+	h, err := loadedConfig.Harbor(profile)
+	if err != nil {
+		return nil, err
+	}
+	if h == nil {
+		return nil, fmt.Errorf("%s: no harbor block defined", loadedConfig.Path)
+	}
+	return h, nil
+}
+
+// configPolicies converts the protection policies of the active registry
+// block
+func configPolicies() []*registry.ProtectionPolicy {
+	if activeRegistry == nil {
+		return nil
+	}
+
+	policies := make([]*registry.ProtectionPolicy, 0, len(activeRegistry.Protection.Policies))
+	for _, p := range activeRegistry.Protection.Policies {
+		policies = append(policies, &registry.ProtectionPolicy{
+			Name:        p.Name,
+			Pattern:     p.Pattern,
+			Immutable:   p.Immutable,
+			MaxAge:      p.MaxAge,
+			AllowDelete: p.AllowDelete,
+			Priority:    p.Priority,
+		})
+	}
+	return policies
+}
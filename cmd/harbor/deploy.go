@@ -0,0 +1,194 @@
+// Copyright 2021 vjranagit
+//
+// Harbor deployment commands
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	"github.com/vjranagit/harbor/pkg/config"
+	"github.com/vjranagit/harbor/pkg/deploy"
+	"github.com/vjranagit/harbor/pkg/deploy/compose"
+	"github.com/vjranagit/harbor/pkg/deploy/k8s"
+)
+
+// renderFunc renders an install of a harbor block
+type renderFunc func(h *config.HarborConfig, secrets *deploy.Secrets) (*deploy.Bundle, error)
+
+func newDeployCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "deploy",
+		Short: "Render and apply Harbor installations",
+		Long: `Render a Harbor installation from a harbor block of the config file.
+
+Secrets shared by the components are generated on the first apply and kept
+under secret/ in the install directory; keep that directory to re-render the
+same install. --profile selects the harbor block when the file has several.`,
+	}
+
+	cmd.AddCommand(newComposeCmd(), newK8sCmd())
+
+	return cmd
+}
+
+func newComposeCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "compose",
+		Short: "Docker Compose installation",
+		Long: `Render docker-compose.yml and the configuration of core, registry,
+registryctl, jobservice, nginx, the database and Redis.`,
+	}
+	cmd.PersistentFlags().String("dir", ".", "Install directory the files are rendered into")
+
+	cmd.AddCommand(
+		newPlanCmd("compose", compose.Render),
+		newApplyCmd("compose", compose.Render, func(dir string) string {
+			return "docker compose -f " + filepath.Join(dir, compose.ComposeFile) + " up -d"
+		}),
+	)
+
+	return cmd
+}
+
+func newK8sCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "k8s",
+		Short: "Kubernetes installation",
+		Long: `Render Kubernetes manifests: a Deployment per stateless component,
+StatefulSets for the bundled database and Redis, their Services, Secrets,
+ConfigMaps and PersistentVolumeClaims, and an Ingress for the hostname.
+
+The kubernetes block of the harbor block sets the namespace, ingress class,
+TLS secret, storage class and per-component replicas, resources and volume
+sizes. External PostgreSQL and Redis replace the bundled StatefulSets.`,
+	}
+	cmd.PersistentFlags().String("dir", ".", "Install directory the manifests are rendered into")
+
+	cmd.AddCommand(
+		newPlanCmd("k8s", k8s.Render),
+		newApplyCmd("k8s", k8s.Render, func(dir string) string {
+			return "kubectl apply -f " + dir
+		}),
+	)
+
+	return cmd
+}
+
+// newPlanCmd previews an install; method is the deploy subcommand
+func newPlanCmd(method string, render renderFunc) *cobra.Command {
+	return &cobra.Command{
+		Use:   "plan",
+		Short: "Show how the install directory would change",
+		Example: `  # Review changes before applying them
+  harbor --config harbor.hcl deploy ` + method + ` plan --dir /opt/harbor`,
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dir, _ := cmd.Flags().GetString("dir")
+
+			bundle, generated, err := renderInstall(dir, render)
+			if err != nil {
+				return err
+			}
+			changes, err := deploy.Plan(dir, bundle)
+			if err != nil {
+				return err
+			}
+
+			if generated {
+				fmt.Println("Secrets will be generated on apply")
+			}
+			printChanges(changes, true)
+			return nil
+		},
+	}
+}
+
+// newApplyCmd writes the install; next tells how to start it
+func newApplyCmd(method string, render renderFunc, next func(dir string) string) *cobra.Command {
+	return &cobra.Command{
+		Use:   "apply",
+		Short: "Write the install directory",
+		Example: `  # Render the install and start it
+  harbor --config harbor.hcl deploy ` + method + ` apply --dir /opt/harbor`,
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dir, _ := cmd.Flags().GetString("dir")
+
+			bundle, _, err := renderInstall(dir, render)
+			if err != nil {
+				return err
+			}
+			changes, err := deploy.Apply(dir, bundle)
+			if err != nil {
+				return err
+			}
+
+			printChanges(changes, false)
+			fmt.Printf("✓ Install rendered in %s\n", dir)
+			fmt.Printf("  Next: %s\n", next(dir))
+			return nil
+		},
+	}
+}
+
+// renderInstall renders the selected harbor block with the secrets kept in
+// dir, generating them when there are none yet
+func renderInstall(dir string, render renderFunc) (*deploy.Bundle, bool, error) {
+	h, err := activeHarborConfig()
+	if err != nil {
+		return nil, false, err
+	}
+
+	generated := false
+	secrets, err := deploy.LoadSecrets(dir)
+	if errors.Is(err, deploy.ErrNoSecrets) {
+		secrets, err = deploy.GenerateSecrets()
+		generated = true
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	bundle, err := render(h, secrets)
+	if err != nil {
+		return nil, false, err
+	}
+	return bundle, generated, nil
+}
+
+// printChanges lists changed files, with their diffs when showDiff is set
+func printChanges(changes []deploy.Change, showDiff bool) {
+	counts := make(map[deploy.Action]int)
+	for _, c := range changes {
+		counts[c.Action]++
+		if c.Action == deploy.ActionUnchanged {
+			continue
+		}
+
+		symbol := "~"
+		if c.Action == deploy.ActionCreate {
+			symbol = "+"
+		}
+		fmt.Printf("%s %s\n", symbol, c.Path)
+		if !showDiff {
+			continue
+		}
+		switch {
+		case c.Sensitive:
+			fmt.Println("  (sensitive content not shown)")
+		case c.Diff != "":
+			fmt.Print(c.Diff)
+		case c.Action == deploy.ActionUpdate:
+			fmt.Println("  (only secret values changed)")
+		}
+	}
+
+	fmt.Printf("%d to create, %d to update, %d unchanged\n",
+		counts[deploy.ActionCreate], counts[deploy.ActionUpdate], counts[deploy.ActionUnchanged])
+}
@@ -0,0 +1,247 @@
+// Copyright 2021 vjranagit
+//
+// Health check history and report commands
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/vjranagit/harbor/pkg/registry"
+)
+
+func newHealthReportCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "report",
+		Short: "Report availability, latency and SLO burn rates of monitored endpoints",
+		Long: `Summarize the health checks recorded by harbor server and
+harbor registry health monitor in the --health-history database.
+
+Availability is the share of the monitored time an endpoint answered; a
+check counts until the next one, or for at most --max-gap, so time nothing
+was monitoring is left out. Latency percentiles cover successful checks.
+
+With an --slo, the report adds the error budget the objective allows over
+the period and evaluates multiwindow burn rate alerts: page when the budget
+burns 14.4x too fast over 1h and 5m, or 6x over 6h and 30m; ticket at 1x
+over 3d and 6h.
+
+A running monitor keeps the database locked; ask the server with --server
+instead.`,
+		Example: `  # Availability of every endpoint over the last week
+  harbor registry health report --since 7d
+
+  # Markdown for an incident review, against a 99.5% objective
+  harbor registry health report --since 30d --slo 99.5 --format markdown -o report.md
+
+  # Ask a running harbor server
+  harbor registry health report --server http://localhost:8080 --endpoint https://registry2.example.com`,
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			endpoint, _ := cmd.Flags().GetString("endpoint")
+			since, _ := cmd.Flags().GetString("since")
+			until, _ := cmd.Flags().GetString("until")
+			slo, _ := cmd.Flags().GetFloat64("slo")
+			maxGap, _ := cmd.Flags().GetDuration("max-gap")
+			format, _ := cmd.Flags().GetString("format")
+			output, _ := cmd.Flags().GetString("output")
+			serverURL, _ := cmd.Flags().GetString("server")
+
+			if format != "table" && format != string(registry.HealthReportFormatJSON) && format != string(registry.HealthReportFormatMarkdown) {
+				return fmt.Errorf("unsupported format %q (want table, json or markdown)", format)
+			}
+			if slo < 0 || slo >= 100 {
+				return fmt.Errorf("--slo must be a percentage below 100, e.g. 99.9")
+			}
+			if maxGap <= 0 {
+				return fmt.Errorf("--max-gap must be positive")
+			}
+
+			opts := registry.HealthReportOptions{Endpoint: endpoint, Objective: slo, MaxGap: maxGap}
+			var err error
+			if opts.Since, err = parseHistoryTime("--since", since); err != nil {
+				return err
+			}
+			if opts.Until, err = parseHistoryTime("--until", until); err != nil {
+				return err
+			}
+
+			var report registry.HealthReport
+			if serverURL != "" {
+				report, err = serverHealthReport(cmd, serverURL, endpoint, since, until, slo, maxGap)
+			} else {
+				report, err = localHealthReport(cmd, opts)
+			}
+			if err != nil {
+				return err
+			}
+
+			if output == "" || output == "-" {
+				return printHealthReport(os.Stdout, format, report)
+			}
+
+			f, err := os.Create(output)
+			if err != nil {
+				return err
+			}
+			if err := printHealthReport(f, format, report); err != nil {
+				f.Close()
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+
+			fmt.Printf("✓ Wrote report on %d endpoints to %s\n", len(report.Endpoints), output)
+			return nil
+		},
+	}
+	cmd.Flags().String("endpoint", "", "Only this endpoint")
+	cmd.Flags().String("since", "7d", "Start of the period, an RFC 3339 time or age")
+	cmd.Flags().String("until", "", "End of the period, an RFC 3339 time or age (default now)")
+	cmd.Flags().Float64("slo", 99.9, "Availability objective in percent (0 leaves out budget and burn rates)")
+	cmd.Flags().Duration("max-gap", registry.DefaultMaxCheckGap, "Longest time one check counts for")
+	cmd.Flags().String("format", "table", "Output format (table, json or markdown)")
+	cmd.Flags().StringP("output", "o", "", "Output file (default stdout)")
+	cmd.Flags().String("health-history", defaultHealthHistoryPath(), "Health check history database")
+	cmd.Flags().String("server", "", "Ask this harbor server instead of reading the database")
+	return cmd
+}
+
+// localHealthReport builds a report from the --health-history database
+func localHealthReport(cmd *cobra.Command, opts registry.HealthReportOptions) (registry.HealthReport, error) {
+	path, _ := cmd.Flags().GetString("health-history")
+	if _, err := os.Stat(path); err != nil {
+		return registry.HealthReport{}, fmt.Errorf("no health history at %s: %w", path, err)
+	}
+
+	store, err := registry.OpenBoltCheckHistory(path)
+	if err != nil {
+		return registry.HealthReport{}, err
+	}
+	defer store.Close()
+	return registry.NewHealthReport(store, opts)
+}
+
+// serverHealthReport asks a harbor server for a report
+func serverHealthReport(cmd *cobra.Command, serverURL, endpoint, since, until string, slo float64, maxGap time.Duration) (registry.HealthReport, error) {
+	params := url.Values{}
+	for name, value := range map[string]string{"endpoint": endpoint, "since": since, "until": until} {
+		if value != "" {
+			params.Set(name, value)
+		}
+	}
+	if slo > 0 {
+		params.Set("objective", strconv.FormatFloat(slo, 'f', -1, 64))
+	}
+	params.Set("max_gap", maxGap.String())
+
+	var raw json.RawMessage
+	if err := serverRequest(cmd.Context(), serverURL, http.MethodGet, "/health/report?"+params.Encode(), &raw); err != nil {
+		return registry.HealthReport{}, err
+	}
+	return registry.DecodeHealthReport(bytes.NewReader(raw))
+}
+
+// printHealthReport writes report as tables or exports it as JSON or
+// Markdown
+func printHealthReport(w io.Writer, format string, report registry.HealthReport) error {
+	if format != "table" {
+		return registry.EncodeHealthReport(w, registry.HealthReportFormat(format), report)
+	}
+
+	if len(report.Endpoints) == 0 {
+		fmt.Fprintf(w, "No health checks recorded since %s\n", report.Since.Format(time.RFC3339))
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprint(tw, "ENDPOINT\tAVAILABILITY\tDOWNTIME\tINCIDENTS\tCHECKS\tP50\tP95\tP99")
+	if report.Objective > 0 {
+		fmt.Fprint(tw, "\tBUDGET USED")
+	}
+	fmt.Fprintln(tw)
+	for _, er := range report.Endpoints {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%s\t%s\t%s",
+			er.Endpoint, registry.FormatPercent(er.Availability), er.Downtime.Round(time.Second), er.Incidents, er.Checks,
+			registry.RoundLatency(er.Latency.P50), registry.RoundLatency(er.Latency.P95), registry.RoundLatency(er.Latency.P99))
+		if budget := er.Budget; budget != nil {
+			fmt.Fprintf(tw, "\t%.1f%%", budget.Consumed)
+		}
+		fmt.Fprintln(tw)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if report.Objective == 0 {
+		return nil
+	}
+
+	fmt.Fprintf(w, "\nBurn rates against %s:\n", registry.FormatPercent(report.Objective))
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ENDPOINT\tALERT\tWINDOWS\tBURN RATE\tTHRESHOLD\tFIRING")
+	for _, er := range report.Endpoints {
+		for _, br := range er.BurnRates {
+			firing := "no"
+			if br.Firing {
+				firing = "YES"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s/%s\t%.2f/%.2f\t%g\t%s\n",
+				er.Endpoint, br.Name, registry.FormatWindow(br.Long), registry.FormatWindow(br.Short),
+				br.LongRate, br.ShortRate, br.Threshold, firing)
+		}
+	}
+	return tw.Flush()
+}
+
+// addHealthHistoryFlags adds the flags recording health checks
+func addHealthHistoryFlags(cmd *cobra.Command) {
+	cmd.Flags().String("health-history", defaultHealthHistoryPath(), "Database health checks are recorded in (empty disables recording)")
+	cmd.Flags().String("health-history-max-age", "30d", "Prune recorded health checks older than this (0 keeps any age)")
+}
+
+// healthHistoryOptions opens the --health-history database and returns the
+// monitor options recording into it, and a function closing it
+func healthHistoryOptions(cmd *cobra.Command) ([]registry.HealthOption, func(), error) {
+	path, _ := cmd.Flags().GetString("health-history")
+	maxAge, _ := cmd.Flags().GetString("health-history-max-age")
+	if path == "" {
+		return nil, func() {}, nil
+	}
+
+	age, err := registry.ParseAge(maxAge)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid --health-history-max-age: %w", err)
+	}
+	store, err := registry.OpenBoltCheckHistory(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	opts := []registry.HealthOption{
+		registry.WithCheckHistory(store),
+		registry.WithCheckHistoryRetention(age),
+	}
+	return opts, func() { store.Close() }, nil
+}
+
+// defaultHealthHistoryPath returns the per-user health check history
+// location
+func defaultHealthHistoryPath() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = "."
+	}
+	return filepath.Join(dir, "harbor", "health.db")
+}
@@ -0,0 +1,237 @@
+// Copyright 2021 vjranagit
+//
+// Batch operation history commands
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/vjranagit/harbor/pkg/registry"
+)
+
+func newBatchHistoryCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "history",
+		Short: "Show or export finished batch operations",
+		Long: `List batch operations recorded in the history database, oldest first.
+
+Every delete, copy and retag run by the batch commands is recorded with its
+per-target results. The history is pruned to --history-max-count operations
+and, when set, --history-max-age after each operation. A harbor server keeps
+the database locked while it runs; give it its own with harbor server --history.`,
+		Example: `  # Failed deletes of the last week
+  harbor registry batch history --type delete --status failed --since 7d
+
+  # Export every result of the last 30 days for a spreadsheet
+  harbor registry batch history --since 30d --limit 0 --format csv --output batch.csv`,
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			opType, _ := cmd.Flags().GetString("type")
+			status, _ := cmd.Flags().GetString("status")
+			since, _ := cmd.Flags().GetString("since")
+			until, _ := cmd.Flags().GetString("until")
+			limit, _ := cmd.Flags().GetInt("limit")
+			format, _ := cmd.Flags().GetString("format")
+			output, _ := cmd.Flags().GetString("output")
+
+			q := registry.HistoryQuery{
+				Type:   registry.BatchOpType(opType),
+				Status: registry.BatchOpStatus(status),
+				Limit:  limit,
+			}
+			var err error
+			if q.Since, err = parseHistoryTime("--since", since); err != nil {
+				return err
+			}
+			if q.Until, err = parseHistoryTime("--until", until); err != nil {
+				return err
+			}
+			if format != "table" && format != string(registry.HistoryFormatJSON) && format != string(registry.HistoryFormatCSV) {
+				return fmt.Errorf("unsupported format %q (want table, json or csv)", format)
+			}
+
+			store, err := openHistory(cmd)
+			if err != nil {
+				return err
+			}
+			ops, err := store.Query(q)
+			store.Close()
+			if err != nil {
+				return err
+			}
+
+			if output == "" || output == "-" {
+				return printHistory(os.Stdout, format, ops)
+			}
+
+			f, err := os.Create(output)
+			if err != nil {
+				return err
+			}
+			if err := printHistory(f, format, ops); err != nil {
+				f.Close()
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+
+			fmt.Printf("✓ Exported %d operations to %s\n", len(ops), output)
+			return nil
+		},
+	}
+	cmd.Flags().String("type", "", "Only operations of this type (delete, copy, tag or convert)")
+	cmd.Flags().String("status", "", "Only operations with this status (completed, failed or cancelled)")
+	cmd.Flags().String("since", "", "Only operations created after this RFC 3339 time or age, e.g. 7d")
+	cmd.Flags().String("until", "", "Only operations created before this RFC 3339 time or age")
+	cmd.Flags().Int("limit", 20, "Only the newest operations, at most this many (0 for all)")
+	cmd.Flags().String("format", "table", "Output format (table, json or csv)")
+	cmd.Flags().StringP("output", "o", "", "Output file (default stdout)")
+
+	// Prune history
+	pruneCmd := &cobra.Command{
+		Use:   "prune",
+		Short: "Remove operations beyond the history retention",
+		Example: `  # Keep only the last 90 days
+  harbor registry batch history prune --history-max-age 90d`,
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			retention, err := historyRetention(cmd)
+			if err != nil {
+				return err
+			}
+
+			store, err := openHistory(cmd)
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+
+			pruned, err := store.Prune(retention)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("✓ Pruned %d operations\n", pruned)
+			return nil
+		},
+	}
+
+	cmd.AddCommand(pruneCmd)
+	return cmd
+}
+
+// printHistory writes ops as a table or exports them as JSON or CSV
+func printHistory(w io.Writer, format string, ops []registry.BatchOperation) error {
+	if format != "table" {
+		return registry.EncodeHistory(w, registry.HistoryFormat(format), ops)
+	}
+
+	if len(ops) == 0 {
+		fmt.Fprintln(w, "No batch operations recorded")
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tTYPE\tSTATUS\tTARGETS\tOK/FAILED/SKIPPED\tCREATED\tDURATION")
+	for _, op := range ops {
+		ok, failed, skipped := 0, 0, 0
+		for _, result := range op.Results {
+			switch {
+			case result.Skipped:
+				skipped++
+			case result.Success:
+				ok++
+			default:
+				failed++
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d/%d/%d\t%s\t%s\n",
+			op.ID, op.Type, op.Status, len(op.Targets), ok, failed, skipped,
+			op.CreatedAt.Format(time.RFC3339), op.EndedAt.Sub(op.StartedAt).Round(time.Millisecond))
+	}
+	return tw.Flush()
+}
+
+// parseHistoryTime parses an RFC 3339 time or an age counted back from now
+func parseHistoryTime(flag, value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	age, err := registry.ParseAge(value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s %q (want an RFC 3339 time or an age such as 7d)", flag, value)
+	}
+	return time.Now().Add(-age), nil
+}
+
+// openHistory opens the --history database
+func openHistory(cmd *cobra.Command) (*registry.BoltHistoryStore, error) {
+	path, _ := cmd.Flags().GetString("history")
+	return registry.OpenBoltHistoryStore(path)
+}
+
+// historyRetention returns the retention of the --history-max-age and
+// --history-max-count flags
+func historyRetention(cmd *cobra.Command) (registry.HistoryRetention, error) {
+	maxAge, _ := cmd.Flags().GetString("history-max-age")
+	maxCount, _ := cmd.Flags().GetInt("history-max-count")
+
+	r := registry.HistoryRetention{MaxCount: maxCount}
+	if maxCount < 0 {
+		return r, fmt.Errorf("--history-max-count must not be negative")
+	}
+	if maxAge != "" {
+		var err error
+		if r.MaxAge, err = registry.ParseAge(maxAge); err != nil {
+			return r, fmt.Errorf("invalid --history-max-age: %w", err)
+		}
+	}
+	return r, nil
+}
+
+// recordBatch saves a finished operation to the history database and
+// prunes it. The database is only held open while recording, so a failure
+// is reported without failing the operation
+func recordBatch(cmd *cobra.Command, op registry.BatchOperation) {
+	err := func() error {
+		retention, err := historyRetention(cmd)
+		if err != nil {
+			return err
+		}
+		store, err := openHistory(cmd)
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		if err := store.Save(op); err != nil {
+			return err
+		}
+		_, err = store.Prune(retention)
+		return err
+	}()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: operation not recorded in history: %v\n", err)
+	}
+}
+
+// defaultHistoryPath returns the per-user batch history location
+func defaultHistoryPath() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = "."
+	}
+	return filepath.Join(dir, "harbor", "history.db")
+}
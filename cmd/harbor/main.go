@@ -18,6 +18,7 @@ var (
 	buildDate = "unknown"
 
 	cfgFile string
+	profile string
 	verbose bool
 )
 
@@ -36,10 +37,11 @@ Reimplemented from harbor-operator and acceleration-service with modern Go patte
 	}
 
 	// Global flags
-	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file path")
+	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file path (default $HARBOR_CONFIG or ~/.config/harbor/config.hcl)")
+	rootCmd.PersistentFlags().StringVar(&profile, "profile", os.Getenv("HARBOR_PROFILE"), "registry or harbor block to use from the config file (env HARBOR_PROFILE)")
 	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "enable verbose logging")
 
-	rootCmd.PersistentPreRun = func(cmd *cobra.Command, args []string) {
+	rootCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
 		// Setup logging
 		level := slog.LevelInfo
 		if verbose {
@@ -50,6 +52,9 @@ Reimplemented from harbor-operator and acceleration-service with modern Go patte
 			Level: level,
 		}))
 		slog.SetDefault(logger)
+
+		// Load configuration defaults
+		return loadConfig(cmd)
 	}
 
 	// Add subcommands
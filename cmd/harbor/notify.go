@@ -0,0 +1,114 @@
+// Copyright 2021 vjranagit
+//
+// Health alert notifications
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/vjranagit/harbor/pkg/config"
+	"github.com/vjranagit/harbor/pkg/events"
+	"github.com/vjranagit/harbor/pkg/notify"
+)
+
+func newHealthNotifyCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "notify [endpoint]",
+		Short: "Send a test notification to the configured sinks",
+		Long: `Send a sample notification through every sink of the notify block of the
+selected registry's health block, reporting which ones delivered it.`,
+		Example:      `  harbor --config harbor.hcl registry health notify https://harbor.example.com`,
+		Args:         cobra.MaximumNArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg := notifyConfig()
+			if cfg == nil {
+				return fmt.Errorf("no notify block configured in the registry's health block")
+			}
+
+			endpoint := "https://harbor.example.com"
+			if len(args) == 1 {
+				endpoint = args[0]
+			}
+			now := time.Now()
+			n := notify.Notification{
+				Endpoint: endpoint,
+				Kind:     notify.KindOpened,
+				From:     "closed",
+				Circuit:  "open",
+				Error:    "test notification from harbor registry health notify",
+				Time:     now,
+				Since:    &now,
+			}
+
+			sinks := notifySinks(cfg)
+			failed := 0
+			for _, sink := range sinks {
+				ctx, cancel := context.WithTimeout(cmd.Context(), notify.DefaultSendTimeout)
+				err := sink.Send(ctx, n)
+				cancel()
+				if err != nil {
+					fmt.Printf("  ✗ %s: %v\n", sink.Name(), err)
+					failed++
+					continue
+				}
+				fmt.Printf("  ✓ %s\n", sink.Name())
+			}
+			if failed > 0 {
+				return fmt.Errorf("%d of %d sinks failed", failed, len(sinks))
+			}
+			return nil
+		},
+	}
+}
+
+// notifyConfig returns the notify block of the active registry, nil when
+// there is none
+func notifyConfig() *config.NotifyConfig {
+	if activeRegistry == nil {
+		return nil
+	}
+	return activeRegistry.Health.Notify
+}
+
+// notifySinks creates the sinks of a notify block
+func notifySinks(cfg *config.NotifyConfig) []notify.Sink {
+	var sinks []notify.Sink
+	for _, w := range cfg.Webhooks {
+		sinks = append(sinks, notify.NewWebhook(w.Name, w.URL, w.Headers))
+	}
+	for _, s := range cfg.Slack {
+		sinks = append(sinks, notify.NewSlack(s.Name, s.URL))
+	}
+	for _, e := range cfg.Email {
+		sinks = append(sinks, notify.NewEmail(e.Name, e.SMTP, e.From, e.To, e.Username, e.Password))
+	}
+	for _, x := range cfg.Exec {
+		sinks = append(sinks, notify.NewExec(x.Name, x.Command))
+	}
+	return sinks
+}
+
+// startNotifier sends health alerts published on bus to the configured
+// sinks. The returned function stops it; without a notify block it does
+// nothing
+func startNotifier(bus *events.Bus) func() {
+	cfg := notifyConfig()
+	if cfg == nil {
+		return func() {}
+	}
+
+	n := notify.New(notifySinks(cfg),
+		notify.WithRenotifyInterval(cfg.RenotifyInterval),
+		notify.WithFlapDetection(cfg.FlapWindow, cfg.FlapThreshold),
+	)
+	sub := n.Subscribe(bus)
+	return func() {
+		sub.Unsubscribe()
+		n.Close()
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright 2021 vjranagit
+//
+// Live progress display for batch operations
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/vjranagit/harbor/pkg/registry"
+)
+
+// progressBarWidth is the number of cells in the progress bar
+const progressBarWidth = 30
+
+// progressPrinter prints batch results as targets finish, under a live
+// progress bar when the output is a terminal
+type progressPrinter struct {
+	out io.Writer
+	// bar is set when the output can redraw a line
+	bar   bool
+	drawn bool
+}
+
+func newProgressPrinter(out *os.File) *progressPrinter {
+	fi, err := out.Stat()
+	return &progressPrinter{
+		out: out,
+		bar: err == nil && fi.Mode()&os.ModeCharDevice != 0,
+	}
+}
+
+// update prints the result p carries, if any, and redraws the bar
+func (pp *progressPrinter) update(p registry.BatchProgress) {
+	pp.clear()
+	if p.Result != nil {
+		printResult(pp.out, *p.Result)
+	}
+	if pp.bar && !p.Status.Finished() {
+		fmt.Fprint(pp.out, progressLine(p))
+		pp.drawn = true
+	}
+}
+
+// clear erases the bar so the next line starts clean
+func (pp *progressPrinter) clear() {
+	if pp.drawn {
+		fmt.Fprint(pp.out, "\r\033[K")
+		pp.drawn = false
+	}
+}
+
+// progressLine renders e.g. "  [██████░░░░] 6/10  ✓5 ✗1 ⊘0  3s  ETA 2s"
+func progressLine(p registry.BatchProgress) string {
+	filled := 0
+	if p.Total > 0 {
+		filled = progressBarWidth * p.Done() / p.Total
+	}
+	line := fmt.Sprintf("  [%s%s] %d/%d  ✓%d ✗%d ⊘%d  %s",
+		strings.Repeat("█", filled), strings.Repeat("░", progressBarWidth-filled),
+		p.Done(), p.Total, p.Succeeded, p.Failed, p.Skipped, p.Elapsed.Round(time.Second))
+	if eta := p.ETA.Round(time.Second); eta > 0 {
+		line += "  ETA " + eta.String()
+	}
+	return line
+}
+
+// printResult prints the outcome of one target
+func printResult(w io.Writer, result registry.BatchOpResult) {
+	if result.Skipped {
+		fmt.Fprintf(w, "  ⊘ %s skipped: %s\n", result.Target, result.Reason)
+		return
+	}
+
+	detail := result.Elapsed.Round(time.Millisecond).String()
+	if result.Reason != "" {
+		detail += ", forced past " + result.Reason
+	}
+	if result.Attempts > 1 {
+		detail += fmt.Sprintf(", %d attempts", result.Attempts)
+	}
+	switch {
+	case result.Success && result.Output != "":
+		fmt.Fprintf(w, "  ✓ %s → %s (%s)\n", result.Target, result.Output, detail)
+	case result.Success:
+		fmt.Fprintf(w, "  ✓ %s (%s)\n", result.Target, detail)
+	case result.Attempts > 1:
+		fmt.Fprintf(w, "  ✗ %s: %s (%d attempts)\n", result.Target, result.Error, result.Attempts)
+	default:
+		fmt.Fprintf(w, "  ✗ %s: %s\n", result.Target, result.Error)
+	}
+}
+
+// printSummary prints the final status of an operation and returns an
+// error when it did not complete
+func printSummary(id string, status registry.BatchOpStatus, skipped int) error {
+	fmt.Printf("  Status: %s\n", status)
+	if skipped > 0 {
+		fmt.Printf("  %d targets skipped by tag protection; --force acts on them anyway\n", skipped)
+	}
+	switch status {
+	case registry.BatchOpFailed:
+		return fmt.Errorf("batch operation %s failed", id)
+	case registry.BatchOpCancelled:
+		return fmt.Errorf("batch operation %s cancelled", id)
+	}
+	return nil
+}
+
+// progressEvent is a progress event streamed by a harbor server
+type progressEvent struct {
+	ID        string `json:"id"`
+	Status    string `json:"status"`
+	Total     int    `json:"total"`
+	Succeeded int    `json:"succeeded"`
+	Failed    int    `json:"failed"`
+	Skipped   int    `json:"skipped"`
+	Pending   int    `json:"pending"`
+	Elapsed   string `json:"elapsed"`
+	ETA       string `json:"eta"`
+	Result    *struct {
+		Target   string `json:"target"`
+		Output   string `json:"output"`
+		Success  bool   `json:"success"`
+		Error    string `json:"error"`
+		Skipped  bool   `json:"skipped"`
+		Reason   string `json:"reason"`
+		Attempts int    `json:"attempts"`
+		Elapsed  string `json:"elapsed"`
+	} `json:"result"`
+}
+
+// decodeProgress decodes the data of a server progress event
+func decodeProgress(data []byte) (registry.BatchProgress, error) {
+	var e progressEvent
+	if err := json.Unmarshal(data, &e); err != nil {
+		return registry.BatchProgress{}, fmt.Errorf("invalid progress event: %w", err)
+	}
+
+	// Durations are informational; unparsable ones are left at zero
+	p := registry.BatchProgress{
+		ID:        e.ID,
+		Status:    registry.BatchOpStatus(e.Status),
+		Total:     e.Total,
+		Succeeded: e.Succeeded,
+		Failed:    e.Failed,
+		Skipped:   e.Skipped,
+		Pending:   e.Pending,
+	}
+	p.Elapsed, _ = time.ParseDuration(e.Elapsed)
+	p.ETA, _ = time.ParseDuration(e.ETA)
+	if r := e.Result; r != nil {
+		elapsed, _ := time.ParseDuration(r.Elapsed)
+		p.Result = &registry.BatchOpResult{
+			Target:   r.Target,
+			Output:   r.Output,
+			Success:  r.Success,
+			Error:    r.Error,
+			Skipped:  r.Skipped,
+			Reason:   r.Reason,
+			Attempts: r.Attempts,
+			Elapsed:  elapsed,
+		}
+	}
+	return p, nil
+}
@@ -0,0 +1,305 @@
+// Copyright 2021 vjranagit
+//
+// Tag protection policy commands
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/vjranagit/harbor/pkg/registry"
+)
+
+func newTagProtectionCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "protect",
+		Short: "Manage tag protection policies",
+	}
+	cmd.PersistentFlags().String("store", defaultPolicyStorePath(), "Policy store path (.json, .hcl, .db or .bolt)")
+
+	// Add policy
+	addPolicy := &cobra.Command{
+		Use:   "add",
+		Short: "Add a tag protection policy",
+		Example: `  # Protect production tags from modification
+  harbor registry protect add --name prod-immutable --pattern '.*:v\d+\.\d+\.\d+$' --immutable
+
+  # Protect tags for 7 days
+  harbor registry protect add --name recent --pattern '.*:.*' --max-age 168h`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			name, _ := cmd.Flags().GetString("name")
+			pattern, _ := cmd.Flags().GetString("pattern")
+			immutable, _ := cmd.Flags().GetBool("immutable")
+			maxAge, _ := cmd.Flags().GetDuration("max-age")
+			allowDelete, _ := cmd.Flags().GetBool("allow-delete")
+			priority, _ := cmd.Flags().GetInt("priority")
+
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return fmt.Errorf("invalid pattern: %w", err)
+			}
+
+			tp, closeStore, err := openTagProtection(cmd)
+			if err != nil {
+				return err
+			}
+			defer closeStore()
+
+			policy := &registry.ProtectionPolicy{
+				Name:        name,
+				Pattern:     re,
+				Immutable:   immutable,
+				MaxAge:      maxAge,
+				AllowDelete: allowDelete,
+				Priority:    priority,
+			}
+
+			if err := tp.AddPolicy(policy); err != nil {
+				return fmt.Errorf("failed to add policy: %w", err)
+			}
+
+			fmt.Printf("✓ Policy '%s' added successfully\n", name)
+			return nil
+		},
+	}
+	addPolicy.Flags().String("name", "", "Policy name (required)")
+	addPolicy.Flags().String("pattern", "", "Tag pattern regex (required)")
+	addPolicy.Flags().Bool("immutable", false, "Make tags immutable")
+	addPolicy.Flags().Duration("max-age", 0, "Protection duration (e.g., 168h for 7 days)")
+	addPolicy.Flags().Bool("allow-delete", false, "Allow deletion of matching tags")
+	addPolicy.Flags().Int("priority", 10, "Priority when policies overlap (higher wins)")
+	addPolicy.MarkFlagRequired("name")
+	addPolicy.MarkFlagRequired("pattern")
+
+	// List policies
+	listPolicies := &cobra.Command{
+		Use:   "list",
+		Short: "List tag protection policies",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			tp, closeStore, err := openTagProtection(cmd)
+			if err != nil {
+				return err
+			}
+			defer closeStore()
+
+			policies := tp.ListPolicies()
+			if len(policies) == 0 {
+				fmt.Println("No policies configured")
+				return nil
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "NAME\tPATTERN\tIMMUTABLE\tMAX AGE\tALLOW DELETE\tPRIORITY")
+			for _, p := range policies {
+				maxAge := "-"
+				if p.MaxAge > 0 {
+					maxAge = p.MaxAge.String()
+				}
+				fmt.Fprintf(w, "%s\t%s\t%t\t%s\t%t\t%d\n",
+					p.Name, p.Pattern, p.Immutable, maxAge, p.AllowDelete, p.Priority)
+			}
+			return w.Flush()
+		},
+	}
+
+	// Remove policy
+	removePolicy := &cobra.Command{
+		Use:   "remove <name>",
+		Short: "Remove a tag protection policy",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			tp, closeStore, err := openTagProtection(cmd)
+			if err != nil {
+				return err
+			}
+			defer closeStore()
+
+			if err := tp.RemovePolicy(args[0]); err != nil {
+				return err
+			}
+
+			fmt.Printf("✓ Policy '%s' removed\n", args[0])
+			return nil
+		},
+	}
+
+	// Check a tag
+	checkTag := &cobra.Command{
+		Use:   "check <repository:tag>",
+		Short: "Check whether policies allow modifying or deleting a tag",
+		Example: `  # Can a 2 day old release tag be overwritten?
+  harbor registry protect check library/nginx:v1.2.3 --age 48h
+
+  # Can it be deleted?
+  harbor registry protect check library/nginx:v1.2.3 --action delete`,
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			action, _ := cmd.Flags().GetString("action")
+			age, _ := cmd.Flags().GetDuration("age")
+
+			i := strings.LastIndex(args[0], ":")
+			if i < 0 || i < strings.LastIndex(args[0], "/") {
+				return fmt.Errorf("expected repository:tag, got %q", args[0])
+			}
+			repository, tag := args[0][:i], args[0][i+1:]
+
+			tp, closeStore, err := openTagProtection(cmd)
+			if err != nil {
+				return err
+			}
+			defer closeStore()
+
+			var allowed bool
+			var reason string
+			switch action {
+			case "modify":
+				allowed, reason = tp.CanModify(context.Background(), repository, tag, age)
+			case "delete":
+				allowed, reason = tp.CanDelete(context.Background(), repository, tag)
+			default:
+				return fmt.Errorf("unknown action %q (want modify or delete)", action)
+			}
+
+			if !allowed {
+				fmt.Printf("✗ %s blocked: %s\n", action, reason)
+				return fmt.Errorf("%s of %s not allowed", action, args[0])
+			}
+			fmt.Printf("✓ %s allowed\n", action)
+			return nil
+		},
+	}
+	checkTag.Flags().String("action", "modify", "Action to check (modify or delete)")
+	checkTag.Flags().Duration("age", 0, "Current age of the tag")
+
+	// Export policies
+	exportPolicies := &cobra.Command{
+		Use:   "export",
+		Short: "Export policies as JSON or HCL",
+		Example: `  # Back up policies to a file
+  harbor registry protect export --format hcl --output policies.hcl`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			format, _ := cmd.Flags().GetString("format")
+			output, _ := cmd.Flags().GetString("output")
+
+			tp, closeStore, err := openTagProtection(cmd)
+			if err != nil {
+				return err
+			}
+			defer closeStore()
+
+			if output == "" || output == "-" {
+				return registry.EncodePolicies(os.Stdout, registry.PolicyFormat(format), tp.ListPolicies())
+			}
+
+			f, err := os.Create(output)
+			if err != nil {
+				return err
+			}
+			if err := registry.EncodePolicies(f, registry.PolicyFormat(format), tp.ListPolicies()); err != nil {
+				f.Close()
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+
+			fmt.Printf("✓ Exported %d policies to %s\n", len(tp.ListPolicies()), output)
+			return nil
+		},
+	}
+	exportPolicies.Flags().String("format", "json", "Output format (json or hcl)")
+	exportPolicies.Flags().StringP("output", "o", "", "Output file (default stdout)")
+
+	// Import policies
+	importPolicies := &cobra.Command{
+		Use:   "import <file>",
+		Short: "Import policies from a JSON or HCL file",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			replace, _ := cmd.Flags().GetBool("replace")
+
+			format, err := registry.PolicyFormatFromPath(args[0])
+			if err != nil {
+				return err
+			}
+			f, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			policies, err := registry.DecodePolicies(f, args[0], format)
+			f.Close()
+			if err != nil {
+				return err
+			}
+
+			tp, closeStore, err := openTagProtection(cmd)
+			if err != nil {
+				return err
+			}
+			defer closeStore()
+
+			existing := make(map[string]bool)
+			for _, p := range tp.ListPolicies() {
+				existing[p.Name] = true
+			}
+
+			for _, p := range policies {
+				if existing[p.Name] {
+					if !replace {
+						return fmt.Errorf("policy %q already exists (use --replace to overwrite)", p.Name)
+					}
+					if err := tp.RemovePolicy(p.Name); err != nil {
+						return err
+					}
+				}
+				if err := tp.AddPolicy(p); err != nil {
+					return err
+				}
+			}
+
+			fmt.Printf("✓ Imported %d policies from %s\n", len(policies), args[0])
+			return nil
+		},
+	}
+	importPolicies.Flags().Bool("replace", false, "Replace existing policies with the same name")
+
+	cmd.AddCommand(addPolicy, listPolicies, removePolicy, checkTag, exportPolicies, importPolicies)
+	return cmd
+}
+
+// defaultPolicyStorePath returns the per-user policy store location
+func defaultPolicyStorePath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = "."
+	}
+	return filepath.Join(dir, "harbor", "policies.json")
+}
+
+// openTagProtection loads the tag protection policies from --store, with
+// the policies of the config file layered on top as read-only
+func openTagProtection(cmd *cobra.Command, opts ...registry.ProtectionOption) (*registry.TagProtection, func(), error) {
+	path, _ := cmd.Flags().GetString("store")
+
+	base, err := registry.OpenPolicyStore(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	store := registry.NewLayeredPolicyStore(base, configPolicies())
+
+	tp, err := registry.LoadTagProtection(store, opts...)
+	if err != nil {
+		store.Close()
+		return nil, nil, err
+	}
+
+	return tp, func() { store.Close() }, nil
+}
@@ -7,11 +7,22 @@ package main
 import (
 	"context"
 	"fmt"
-	"regexp"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"github.com/spf13/cobra"
+	"github.com/vjranagit/harbor/pkg/circuit"
+	"github.com/vjranagit/harbor/pkg/distribution"
+	"github.com/vjranagit/harbor/pkg/events"
+	"github.com/vjranagit/harbor/pkg/metrics"
 	"github.com/vjranagit/harbor/pkg/registry"
+	"github.com/vjranagit/harbor/pkg/server"
 )
 
 func newRegistryCmd() *cobra.Command {
@@ -30,114 +41,111 @@ func newRegistryCmd() *cobra.Command {
 	return cmd
 }
 
-func newTagProtectionCmd() *cobra.Command {
-	cmd := &cobra.Command{
-		Use:   "protect",
-		Short: "Manage tag protection policies",
-	}
-
-	// Add policy
-	addPolicy := &cobra.Command{
-		Use:   "add",
-		Short: "Add a tag protection policy",
-		Example: `  # Protect production tags from modification
-  harbor registry protect add --name prod-immutable --pattern '.*:v\d+\.\d+\.\d+$' --immutable
-
-  # Protect tags for 7 days
-  harbor registry protect add --name recent --pattern '.*:.*' --max-age 168h`,
-		RunE: func(cmd *cobra.Command, args []string) error {
-			name, _ := cmd.Flags().GetString("name")
-			pattern, _ := cmd.Flags().GetString("pattern")
-			immutable, _ := cmd.Flags().GetBool("immutable")
-			maxAge, _ := cmd.Flags().GetDuration("max-age")
-
-			tp := registry.NewTagProtection()
-			policy := &registry.ProtectionPolicy{
-				Name:      name,
-				Pattern:   regexp.MustCompile(pattern),
-				Immutable: immutable,
-				MaxAge:    maxAge,
-				Priority:  10,
-			}
-
-			if err := tp.AddPolicy(policy); err != nil {
-				return fmt.Errorf("failed to add policy: %w", err)
-			}
-
-			fmt.Printf("✓ Policy '%s' added successfully\n", name)
-			return nil
-		},
-	}
-	addPolicy.Flags().String("name", "", "Policy name (required)")
-	addPolicy.Flags().String("pattern", "", "Tag pattern regex (required)")
-	addPolicy.Flags().Bool("immutable", false, "Make tags immutable")
-	addPolicy.Flags().Duration("max-age", 0, "Protection duration (e.g., 168h for 7 days)")
-	addPolicy.MarkFlagRequired("name")
-	addPolicy.MarkFlagRequired("pattern")
-
-	cmd.AddCommand(addPolicy)
-	return cmd
-}
-
 func newBatchOpsCmd() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "batch",
 		Short: "Batch operations on tags",
 	}
+	cmd.PersistentFlags().String("registry", os.Getenv("HARBOR_REGISTRY"), "Registry address (env HARBOR_REGISTRY)")
+	cmd.PersistentFlags().String("username", os.Getenv("HARBOR_USERNAME"), "Registry username (env HARBOR_USERNAME)")
+	cmd.PersistentFlags().String("password", os.Getenv("HARBOR_PASSWORD"), "Registry password (env HARBOR_PASSWORD)")
+	cmd.PersistentFlags().Int("workers", 5, "Number of concurrent workers")
+	cmd.PersistentFlags().Duration("timeout", 0, "Timeout for the whole batch (0 for none)")
+	cmd.PersistentFlags().Int("attempts", registry.DefaultMaxAttempts, "Attempts per target; transient registry errors are retried")
+	cmd.PersistentFlags().Duration("backoff", registry.DefaultBackoff, "Delay before the first retry, doubled for each further one")
+	cmd.PersistentFlags().Duration("max-backoff", registry.DefaultMaxBackoff, "Longest delay between retries, also capping Retry-After (0 doubles delays up to a day)")
+	cmd.PersistentFlags().String("store", defaultPolicyStorePath(), "Tag protection policy store checked before acting")
+	cmd.PersistentFlags().Bool("force", false, "Act on tags protection policies block; every override is logged")
+	cmd.PersistentFlags().String("history", defaultHistoryPath(), "Database finished operations are recorded in")
+	cmd.PersistentFlags().String("history-max-age", "", "Prune recorded operations older than this, e.g. 90d (empty keeps any age)")
+	cmd.PersistentFlags().Int("history-max-count", registry.DefaultHistoryCount, "Recorded operations to keep (0 for no limit)")
 
 	// Delete tags
 	deleteCmd := &cobra.Command{
-		Use:   "delete",
+		Use:   "delete [repo:tag...]",
 		Short: "Delete multiple tags in batch",
+		Long: `Delete tags given as arguments, or chosen with --select. A selector is a
+list of clauses separated by semicolons, all of which must match:
+
+  repo=<glob>         repositories from the catalog, e.g. library/* (required)
+  tag=<regex>         tag names
+  semver=<range>      tags that are versions, e.g. ">=1.2 <2" or ^1.4
+  older-than=<age>    images created longer ago, e.g. 30d or 12h
+  keep-last=<n>       spare the n newest images per repository
+  label=<key>[=<v>]   image config labels, repeatable
+  untagged            manifests no tag points at (Harbor only)`,
 		Example: `  # Delete old tags
-  harbor registry batch delete library/nginx:old-1 library/nginx:old-2 library/redis:deprecated`,
+  harbor registry batch delete --registry harbor.example.com library/nginx:old-1 library/nginx:old-2 library/redis:deprecated
+
+  # Preview deleting nightly builds older than 30 days, keeping the last 5
+  harbor registry batch delete --registry harbor.example.com --dry-run \
+    --select 'repo=library/*; tag=^nightly-; older-than=30d; keep-last=5'`,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			if len(args) == 0 {
-				return fmt.Errorf("no tags specified")
+			bo, err := newBatchOperator(cmd)
+			if err != nil {
+				return err
 			}
+			ctx, cancel := batchContext(cmd)
+			defer cancel()
 
-			bo := registry.NewBatchOperator(5)
-			op, err := bo.DeleteTags(context.Background(), args)
+			targets, err := batchTargets(ctx, cmd, bo, args)
+			if err != nil || targets == nil {
+				return err
+			}
+
+			op, err := bo.DeleteTags(ctx, targets, operationOptions(cmd)...)
 			if err != nil {
 				return fmt.Errorf("batch delete failed: %w", err)
 			}
 
 			fmt.Printf("✓ Batch delete initiated (ID: %s)\n", op.ID)
-			fmt.Printf("  Tags: %d\n", len(args))
-			fmt.Printf("  Status: %s\n", op.Status)
-			return nil
+			fmt.Printf("  Tags: %d\n", len(targets))
+			return waitBatch(cmd, bo, op.ID)
 		},
 	}
+	addSelectFlags(deleteCmd)
 
 	// Copy tags
 	copyCmd := &cobra.Command{
-		Use:   "copy",
+		Use:   "copy [repo:tag...]",
 		Short: "Copy multiple tags in batch",
+		Long:  "Copy tags given as arguments, or chosen with --select (see harbor registry batch delete --help)",
 		Example: `  # Copy tags to backup repository
-  harbor registry batch copy --dest backup/ library/nginx:1.20 library/nginx:1.21`,
-		RunE: func(cmd *cobra.Command, args []string) error {
-			if len(args) == 0 {
-				return fmt.Errorf("no tags specified")
-			}
+  harbor registry batch copy --registry harbor.example.com --dest backup/ library/nginx:1.20 library/nginx:1.21
 
+  # Copy every 1.x release
+  harbor registry batch copy --registry harbor.example.com --dest backup/ --select 'repo=library/nginx; semver=1.x'`,
+		RunE: func(cmd *cobra.Command, args []string) error {
 			dest, _ := cmd.Flags().GetString("dest")
 			if dest == "" {
 				return fmt.Errorf("--dest required")
 			}
 
-			bo := registry.NewBatchOperator(5)
-			op, err := bo.CopyTags(context.Background(), args, dest)
+			bo, err := newBatchOperator(cmd)
+			if err != nil {
+				return err
+			}
+			ctx, cancel := batchContext(cmd)
+			defer cancel()
+
+			targets, err := batchTargets(ctx, cmd, bo, args)
+			if err != nil || targets == nil {
+				return err
+			}
+
+			op, err := bo.CopyTags(ctx, targets, dest, operationOptions(cmd)...)
 			if err != nil {
 				return fmt.Errorf("batch copy failed: %w", err)
 			}
 
 			fmt.Printf("✓ Batch copy initiated (ID: %s)\n", op.ID)
-			fmt.Printf("  Sources: %d\n", len(args))
+			fmt.Printf("  Sources: %d\n", len(targets))
 			fmt.Printf("  Destination: %s\n", dest)
-			return nil
+			return waitBatch(cmd, bo, op.ID)
 		},
 	}
 	copyCmd.Flags().String("dest", "", "Destination prefix (required)")
+	addSelectFlags(copyCmd)
 
 	// Retag
 	retagCmd := &cobra.Command{
@@ -151,23 +159,305 @@ func newBatchOpsCmd() *cobra.Command {
 				return fmt.Errorf("no mappings specified")
 			}
 
-			bo := registry.NewBatchOperator(5)
-			op, err := bo.RetagBatch(context.Background(), mappings)
+			bo, err := newBatchOperator(cmd)
+			if err != nil {
+				return err
+			}
+			ctx, cancel := batchContext(cmd)
+			defer cancel()
+
+			op, err := bo.RetagBatch(ctx, mappings, operationOptions(cmd)...)
 			if err != nil {
 				return fmt.Errorf("batch retag failed: %w", err)
 			}
 
 			fmt.Printf("✓ Batch retag initiated (ID: %s)\n", op.ID)
 			fmt.Printf("  Mappings: %d\n", len(mappings))
-			return nil
+			return waitBatch(cmd, bo, op.ID)
 		},
 	}
 	retagCmd.Flags().StringToString("mapping", nil, "Tag mappings (source=dest)")
 
-	cmd.AddCommand(deleteCmd, copyCmd, retagCmd)
+	// Cancel operations running on a server
+	cancelCmd := &cobra.Command{
+		Use:   "cancel [id]",
+		Short: "Cancel batch operations running on harbor server",
+		Long: `Cancel batch operations submitted to a harbor server. Targets already
+processed keep their results; the others are reported as not started.
+
+Operations run by the batch commands themselves stop on Ctrl-C or --timeout.`,
+		Example: `  # Cancel one operation
+  harbor registry batch cancel batch-1712345678 --server http://localhost:8080
+
+  # Cancel everything still running
+  harbor registry batch cancel --all`,
+		Args:         cobra.MaximumNArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			serverURL, _ := cmd.Flags().GetString("server")
+			all, _ := cmd.Flags().GetBool("all")
+
+			if all == (len(args) == 1) {
+				return fmt.Errorf("specify an operation ID or --all")
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+
+			if all {
+				var resp struct {
+					Cancelled []string `json:"cancelled"`
+				}
+				if err := serverRequest(ctx, serverURL, http.MethodDelete, "/batch", &resp); err != nil {
+					return err
+				}
+				fmt.Printf("✓ Cancelled %d operations\n", len(resp.Cancelled))
+				for _, id := range resp.Cancelled {
+					fmt.Printf("  %s\n", id)
+				}
+				return nil
+			}
+
+			var op struct {
+				ID     string `json:"id"`
+				Type   string `json:"type"`
+				Status string `json:"status"`
+			}
+			if err := serverRequest(ctx, serverURL, http.MethodDelete, "/batch/"+args[0], &op); err != nil {
+				return err
+			}
+			fmt.Printf("✓ Cancelling %s operation %s\n", op.Type, op.ID)
+			fmt.Printf("  Results: curl %s%s/batch/%s\n", strings.TrimSuffix(serverURL, "/"), server.APIPrefix, op.ID)
+			return nil
+		},
+	}
+	cancelCmd.Flags().String("server", defaultServerURL(), "harbor server URL (env HARBOR_SERVER)")
+	cancelCmd.Flags().Bool("all", false, "Cancel every pending or running operation")
+
+	// Follow an operation running on a server
+	watchCmd := &cobra.Command{
+		Use:   "watch <operation-id>",
+		Short: "Follow the progress of an operation running on a harbor server",
+		Long: `Follow an operation submitted to a harbor server through its event stream,
+printing results as targets finish under a live progress bar.`,
+		Example: `  # Submit a delete and follow it
+  id=$(curl -s -X POST localhost:8080/api/v1/batch \
+    -d '{"type": "delete", "targets": ["library/nginx:old-1"]}' | jq -r .id)
+  harbor registry batch watch $id`,
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			serverURL, _ := cmd.Flags().GetString("server")
+
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			pp := newProgressPrinter(os.Stdout)
+			var last registry.BatchProgress
+			err := serverEvents(ctx, serverURL, "/batch/"+args[0]+"/events", func(event string, data []byte) error {
+				p, err := decodeProgress(data)
+				if err != nil {
+					return err
+				}
+				pp.update(p)
+				last = p
+				return nil
+			})
+			pp.clear()
+			if err != nil {
+				return err
+			}
+			if !last.Status.Finished() {
+				return fmt.Errorf("event stream of %s ended before the operation finished", args[0])
+			}
+			return printSummary(args[0], last.Status, last.Skipped)
+		},
+	}
+	watchCmd.Flags().String("server", defaultServerURL(), "harbor server URL (env HARBOR_SERVER)")
+
+	cmd.AddCommand(deleteCmd, copyCmd, retagCmd, cancelCmd, watchCmd, newBatchHistoryCmd())
 	return cmd
 }
 
+// addSelectFlags adds the target selection flags of delete and copy
+func addSelectFlags(cmd *cobra.Command) {
+	cmd.Flags().String("select", "", "Choose targets with a selector instead of arguments")
+	cmd.Flags().Bool("dry-run", false, "Print the targets without acting on them")
+}
+
+// batchTargets returns the targets given as arguments or resolved from
+// --select. With --dry-run it prints them and returns nil
+func batchTargets(ctx context.Context, cmd *cobra.Command, bo *registry.BatchOperator, args []string) ([]string, error) {
+	expr, _ := cmd.Flags().GetString("select")
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+
+	if expr == "" {
+		if len(args) == 0 {
+			return nil, fmt.Errorf("no tags specified")
+		}
+		if dryRun {
+			fmt.Printf("Dry run: %d targets\n", len(args))
+			for _, target := range args {
+				fmt.Printf("  %s\n", target)
+			}
+			return nil, nil
+		}
+		return args, nil
+	}
+	if len(args) > 0 {
+		return nil, fmt.Errorf("specify targets or --select, not both")
+	}
+
+	sel, err := registry.ParseSelector(expr)
+	if err != nil {
+		return nil, err
+	}
+	selected, err := bo.Select(ctx, sel)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve selector: %w", err)
+	}
+	if len(selected) == 0 {
+		fmt.Println("No targets match the selector")
+		return nil, nil
+	}
+
+	if dryRun {
+		fmt.Printf("Dry run: %d targets match the selector\n", len(selected))
+	} else {
+		fmt.Printf("Selected %d targets\n", len(selected))
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "  TARGET\tDIGEST\tCREATED")
+	targets := make([]string, 0, len(selected))
+	for _, s := range selected {
+		created := "-"
+		if !s.Created.IsZero() {
+			created = s.Created.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "  %s\t%s\t%s\n", s.Target, shortDigest(s.Digest.String()), created)
+		targets = append(targets, s.Target)
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+
+	if dryRun {
+		return nil, nil
+	}
+	return targets, nil
+}
+
+// newBatchOperator builds a batch operator from the batch command flags
+func newBatchOperator(cmd *cobra.Command) (*registry.BatchOperator, error) {
+	workers, _ := cmd.Flags().GetInt("workers")
+	attempts, _ := cmd.Flags().GetInt("attempts")
+	backoff, _ := cmd.Flags().GetDuration("backoff")
+	maxBackoff, _ := cmd.Flags().GetDuration("max-backoff")
+
+	if workers < 1 {
+		return nil, fmt.Errorf("--workers must be at least 1")
+	}
+	if attempts < 1 {
+		return nil, fmt.Errorf("--attempts must be at least 1")
+	}
+
+	client, err := newRegistryClient(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	// Policies are read once; the store is not held open while the
+	// batch runs
+	tp, closeStore, err := openTagProtection(cmd)
+	if err != nil {
+		return nil, err
+	}
+	closeStore()
+
+	policy := registry.DefaultRetryPolicy()
+	policy.MaxAttempts = attempts
+	policy.Backoff = backoff
+	policy.MaxBackoff = maxBackoff
+
+	return registry.NewBatchOperator(workers,
+		registry.WithRegistryClient(client),
+		registry.WithRetryPolicy(policy),
+		registry.WithProtectionGuard(tp),
+	), nil
+}
+
+// operationOptions returns the per-operation options of the batch flags
+func operationOptions(cmd *cobra.Command) []registry.OperationOption {
+	var opts []registry.OperationOption
+	if force, _ := cmd.Flags().GetBool("force"); force {
+		opts = append(opts, registry.WithForce())
+	}
+	return opts
+}
+
+// newRegistryClient builds a registry client from the --registry,
+// --username and --password flags
+func newRegistryClient(cmd *cobra.Command, opts ...distribution.Option) (*distribution.Client, error) {
+	addr, _ := cmd.Flags().GetString("registry")
+	username, _ := cmd.Flags().GetString("username")
+	password, _ := cmd.Flags().GetString("password")
+
+	if addr == "" {
+		return nil, fmt.Errorf("--registry required")
+	}
+
+	return distribution.NewClient(addr, append([]distribution.Option{distribution.WithCredentials(distribution.Credentials{
+		Username: username,
+		Password: password,
+	})}, opts...)...)
+}
+
+// batchContext bounds a batch operation by --timeout and cancels it on
+// SIGINT or SIGTERM
+func batchContext(cmd *cobra.Command) (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+
+	timeout, _ := cmd.Flags().GetDuration("timeout")
+	if timeout <= 0 {
+		return ctx, stop
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	return ctx, func() {
+		cancel()
+		stop()
+	}
+}
+
+// waitBatch follows a batch operation, printing results as targets
+// finish, then records it in the history and prints its status
+func waitBatch(cmd *cobra.Command, bo *registry.BatchOperator, id string) error {
+	updates, unsubscribe, err := bo.Subscribe(id)
+	if err != nil {
+		return err
+	}
+	defer unsubscribe()
+
+	pp := newProgressPrinter(os.Stdout)
+	for p := range updates {
+		pp.update(p)
+	}
+	pp.clear()
+
+	op, err := bo.Wait(context.Background(), id)
+	if err != nil {
+		return err
+	}
+	recordBatch(cmd, *op)
+
+	skipped := 0
+	for _, result := range op.Results {
+		if result.Skipped {
+			skipped++
+		}
+	}
+	return printSummary(op.ID, op.Status, skipped)
+}
+
 func newHealthCmd() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "health",
@@ -179,7 +469,16 @@ func newHealthCmd() *cobra.Command {
 		Use:   "monitor",
 		Short: "Monitor registry endpoint health",
 		Example: `  # Monitor multiple registries
-  harbor registry health monitor https://registry1.example.com https://registry2.example.com`,
+  harbor registry health monitor https://registry1.example.com https://registry2.example.com
+
+  # Export check latency and circuit state to Prometheus until interrupted
+  harbor registry health monitor --metrics-listen :9090 https://registry1.example.com
+
+  # Close circuits only after 3 good retries and fail checks slower than 2s
+  harbor registry health monitor --success-threshold 3 --slow-threshold 2s https://registry1.example.com
+
+  # Report on the recorded checks afterwards
+  harbor registry health report --since 1d`,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			if len(args) == 0 {
 				return fmt.Errorf("no endpoints specified")
@@ -189,11 +488,43 @@ func newHealthCmd() *cobra.Command {
 			retryDelay, _ := cmd.Flags().GetDuration("retry-delay")
 			timeout, _ := cmd.Flags().GetDuration("timeout")
 			interval, _ := cmd.Flags().GetDuration("interval")
+			metricsAddr, _ := cmd.Flags().GetString("metrics-listen")
+
+			bus := events.NewBus()
+			defer bus.Close()
+			stopNotifier := startNotifier(bus)
+			defer stopNotifier()
+
+			healthOpts, closeHealthHistory, err := healthHistoryOptions(cmd)
+			if err != nil {
+				return err
+			}
+			defer closeHealthHistory()
 
-			hm := registry.NewHealthMonitor(threshold, retryDelay, timeout, interval)
+			hm := registry.NewHealthMonitor(threshold, retryDelay, timeout, interval,
+				append(healthOpts, registry.WithHealthEvents(bus), circuitDefaults(cmd))...)
 
 			for _, endpoint := range args {
-				hm.Register(endpoint)
+				if err := hm.Register(endpoint); err != nil {
+					return err
+				}
+			}
+
+			// With a metrics listener, monitor until interrupted
+			var metricsErr chan error
+			ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			if metricsAddr != "" {
+				l, err := net.Listen("tcp", metricsAddr)
+				if err != nil {
+					return fmt.Errorf("failed to listen on %s: %w", metricsAddr, err)
+				}
+				m := metrics.New(metrics.WithHealthSource(hm), metrics.WithProcessMetrics())
+				m.Subscribe(bus)
+				metricsErr = make(chan error, 1)
+				go func() {
+					metricsErr <- m.Serve(ctx, l)
+				}()
 			}
 
 			hm.Start()
@@ -201,27 +532,72 @@ func newHealthCmd() *cobra.Command {
 			fmt.Printf("✓ Monitoring %d endpoints\n", len(args))
 			fmt.Printf("  Threshold: %d consecutive failures\n", threshold)
 			fmt.Printf("  Check interval: %s\n", interval)
+			if metricsErr != nil {
+				fmt.Printf("  Metrics: http://%s%s\n", metricsAddr, server.MetricsPath)
+			}
 			fmt.Printf("\nPress Ctrl+C to stop...\n")
 
-			// Monitor for a bit and show status
-			time.Sleep(10 * time.Second)
+			var serveErr error
+			if metricsErr != nil {
+				select {
+				case serveErr = <-metricsErr:
+				case <-ctx.Done():
+					serveErr = <-metricsErr
+				}
+			} else {
+				// Monitor for a bit and show status
+				select {
+				case <-time.After(10 * time.Second):
+				case <-ctx.Done():
+				}
+			}
+
+			// Stop checking before reading the final state
+			hm.Stop()
 
-			statuses := hm.GetAllStatuses()
 			fmt.Printf("\n=== Health Status ===\n")
-			for endpoint, status := range statuses {
+			for _, status := range hm.Snapshot() {
 				fmt.Printf("%s: %s (circuit: %s, attempts: %d)\n",
-					endpoint, status.Status, status.Circuit, status.Attempts)
+					status.Endpoint, status.Status, status.Circuit, status.Attempts)
+				if status.Error != "" {
+					fmt.Printf("  error: %s\n", status.Error)
+				}
+				for _, component := range status.Components {
+					fmt.Printf("  %-12s %s\n", component.Name, component.Status)
+				}
 			}
-
-			hm.Stop()
-			return nil
+			return serveErr
 		},
 	}
+	monitorCmd.Flags().String("metrics-listen", "", "Serve Prometheus metrics on this address and monitor until interrupted")
 	monitorCmd.Flags().Int("threshold", 3, "Failure threshold before circuit opens")
 	monitorCmd.Flags().Duration("retry-delay", 30*time.Second, "Delay before retrying failed endpoint")
 	monitorCmd.Flags().Duration("timeout", 5*time.Second, "Health check timeout")
 	monitorCmd.Flags().Duration("interval", 10*time.Second, "Check interval")
+	addCircuitFlags(monitorCmd)
+	addHealthHistoryFlags(monitorCmd)
 
-	cmd.AddCommand(monitorCmd)
+	cmd.AddCommand(monitorCmd, newHealthReportCmd(), newHealthNotifyCmd())
 	return cmd
 }
+
+// addCircuitFlags adds the circuit breaker flags beyond --threshold and
+// --retry-delay
+func addCircuitFlags(cmd *cobra.Command) {
+	cmd.Flags().Duration("max-retry-delay", circuit.DefaultMaxRetryDelay, "Longest retry delay, which doubles with every failed retry")
+	cmd.Flags().Int("success-threshold", circuit.DefaultSuccessThreshold, "Successful retries in a row before the circuit closes")
+	cmd.Flags().Duration("slow-threshold", 0, "Fail checks slower than this (0 disables)")
+}
+
+// circuitDefaults applies the circuit breaker flags to every endpoint
+func circuitDefaults(cmd *cobra.Command) registry.HealthOption {
+	maxRetryDelay, _ := cmd.Flags().GetDuration("max-retry-delay")
+	successThreshold, _ := cmd.Flags().GetInt("success-threshold")
+	slowThreshold, _ := cmd.Flags().GetDuration("slow-threshold")
+
+	return registry.WithEndpointDefaults(
+		registry.WithMaxRetryDelay(maxRetryDelay),
+		registry.WithSuccessThreshold(successThreshold),
+		registry.WithSlowThreshold(slowThreshold),
+	)
+}
@@ -0,0 +1,414 @@
+// Copyright 2021 vjranagit
+//
+// Long-running API server
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/vjranagit/harbor/pkg/accelerator/queue"
+	"github.com/vjranagit/harbor/pkg/circuit"
+	"github.com/vjranagit/harbor/pkg/config"
+	"github.com/vjranagit/harbor/pkg/distribution"
+	"github.com/vjranagit/harbor/pkg/events"
+	"github.com/vjranagit/harbor/pkg/metrics"
+	"github.com/vjranagit/harbor/pkg/registry"
+	"github.com/vjranagit/harbor/pkg/server"
+)
+
+func newServerCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "server",
+		Short: "Run the toolkit as a daemon with a REST API",
+		Long: `Run a long-lived daemon hosting tag protection, batch operations, health
+monitoring and the conversion queue behind a versioned REST API under ` + server.APIPrefix + `.
+
+Batch operations and conversions need --registry; without it only policies
+and health are served. The OpenAPI document is served at ` + server.APIPrefix + `/openapi.json.
+
+Monitored endpoints can be added, changed and removed through the API while
+the server runs. When they come from the config file, SIGHUP re-reads it and
+applies the health block's endpoints and settings.
+
+A notify block in the health block sends alerts when circuits open, are
+retried and recover. Every check is recorded in --health-history, which
+` + server.APIPrefix + `/health/report and harbor registry health report summarize.
+
+A circuit opens after --threshold failed checks and admits one check after
+--retry-delay, doubling the delay up to --max-retry-delay while the endpoint
+stays down; --success-threshold good checks in a row close it. Calls to
+--registry go through a circuit breaker too, so batch operations and
+conversions fail fast while it is down.
+
+Prometheus metrics for health checks, batch operations, tag protection and
+the conversion queue and layer cache are served at ` + server.MetricsPath + `.`,
+		Example: `  # Serve on all interfaces, monitoring two registries
+  harbor server --listen :8080 --registry harbor.example.com \
+    --endpoint https://harbor.example.com --endpoint https://mirror.example.com
+
+  # Monitor another registry every 30s
+  curl -X POST localhost:8080/api/v1/health/endpoints \
+    -d '{"endpoint": "https://backup.example.com", "interval": "30s"}'
+
+  # Submit a batch delete
+  curl -X POST localhost:8080/api/v1/batch \
+    -d '{"type": "delete", "targets": ["library/nginx:old-1"]}'`,
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE:         runServer,
+	}
+
+	cmd.Flags().String("listen", "localhost:8080", "Address to serve the API on")
+	cmd.Flags().Duration("shutdown-timeout", server.DefaultShutdownTimeout, "How long shutdown waits for requests and running work")
+	cmd.Flags().Bool("metrics", true, "Serve Prometheus metrics at "+server.MetricsPath)
+
+	cmd.Flags().String("registry", os.Getenv("HARBOR_REGISTRY"), "Registry address (env HARBOR_REGISTRY)")
+	cmd.Flags().String("username", os.Getenv("HARBOR_USERNAME"), "Registry username (env HARBOR_USERNAME)")
+	cmd.Flags().String("password", os.Getenv("HARBOR_PASSWORD"), "Registry password (env HARBOR_PASSWORD)")
+	cmd.Flags().Int("workers", 5, "Concurrent workers per batch operation")
+
+	cmd.Flags().String("store", defaultPolicyStorePath(), "Policy store path (.json, .hcl, .db or .bolt)")
+
+	cmd.Flags().String("history", defaultHistoryPath(), "Batch operation history database")
+	cmd.Flags().String("history-max-age", "", "Prune recorded operations older than this, e.g. 90d (empty keeps any age)")
+	cmd.Flags().Int("history-max-count", registry.DefaultHistoryCount, "Recorded operations to keep (0 for no limit)")
+
+	cmd.Flags().String("queue", defaultQueuePath(), "Conversion queue database")
+	cmd.Flags().Int("queue-workers", server.DefaultQueueWorkers, "Concurrent conversion jobs")
+	cmd.Flags().String("cache-dir", defaultLayerCacheDir(), "Converted layer cache directory")
+
+	cmd.Flags().StringSlice("endpoint", nil, "Endpoint to health check (repeatable)")
+	cmd.Flags().Int("threshold", 3, "Failure threshold before circuit opens")
+	cmd.Flags().Duration("retry-delay", 30*time.Second, "Delay before retrying failed endpoint")
+	cmd.Flags().Duration("health-timeout", 5*time.Second, "Health check timeout")
+	cmd.Flags().Duration("interval", 10*time.Second, "Health check interval")
+	addCircuitFlags(cmd)
+	addHealthHistoryFlags(cmd)
+
+	return cmd
+}
+
+func runServer(cmd *cobra.Command, args []string) error {
+	listen, _ := cmd.Flags().GetString("listen")
+	shutdownTimeout, _ := cmd.Flags().GetDuration("shutdown-timeout")
+	addr, _ := cmd.Flags().GetString("registry")
+	workers, _ := cmd.Flags().GetInt("workers")
+	queuePath, _ := cmd.Flags().GetString("queue")
+	queueWorkers, _ := cmd.Flags().GetInt("queue-workers")
+	endpoints, _ := cmd.Flags().GetStringSlice("endpoint")
+	threshold, _ := cmd.Flags().GetInt("threshold")
+	retryDelay, _ := cmd.Flags().GetDuration("retry-delay")
+	healthTimeout, _ := cmd.Flags().GetDuration("health-timeout")
+	interval, _ := cmd.Flags().GetDuration("interval")
+
+	if workers < 1 {
+		return fmt.Errorf("--workers must be at least 1")
+	}
+	if queueWorkers < 1 {
+		return fmt.Errorf("--queue-workers must be at least 1")
+	}
+
+	bus := events.NewBus()
+	defer bus.Close()
+	if verbose {
+		bus.Subscribe(func(ctx context.Context, e events.Event) {
+			slog.DebugContext(ctx, "event", "topic", e.Topic, "payload", fmt.Sprintf("%+v", e.Payload))
+		})
+	}
+
+	stopNotifier := startNotifier(bus)
+	defer stopNotifier()
+
+	tp, closeStore, err := openTagProtection(cmd, registry.WithProtectionEvents(bus))
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+
+	healthOpts, closeHealthHistory, err := healthHistoryOptions(cmd)
+	if err != nil {
+		return err
+	}
+	defer closeHealthHistory()
+
+	hm := registry.NewHealthMonitor(threshold, retryDelay, healthTimeout, interval,
+		append(healthOpts, registry.WithHealthEvents(bus), circuitDefaults(cmd))...)
+	for _, endpoint := range endpoints {
+		if err := hm.Register(endpoint); err != nil {
+			return err
+		}
+	}
+
+	metricsOpts := []metrics.Option{metrics.WithHealthSource(hm), metrics.WithProcessMetrics()}
+	opts := []server.Option{
+		server.WithTagProtection(tp),
+		server.WithHealthMonitor(hm),
+		server.WithQueueWorkers(queueWorkers),
+		server.WithShutdownTimeout(shutdownTimeout),
+	}
+
+	if addr == "" {
+		slog.Warn("no --registry configured, batch operations and conversions are disabled")
+	} else {
+		// Fail batch operations and conversions fast while --registry is down
+		breaker := circuit.New(circuit.DefaultSettings(), circuit.WithStateChange(func(from, to circuit.State) {
+			slog.Warn("registry circuit changed", "component", "server", "registry", addr, "from", from, "to", to)
+		}))
+		client, err := newRegistryClient(cmd, distribution.WithCircuitBreaker(breaker))
+		if err != nil {
+			return err
+		}
+		layers, err := openLayerCache(cmd)
+		if err != nil {
+			return err
+		}
+		defer layers.Close()
+		converter := newImageConverter(client, layers, bus)
+
+		q, err := queue.Open(queuePath)
+		if err != nil {
+			return err
+		}
+		defer q.Close()
+
+		retention, err := historyRetention(cmd)
+		if err != nil {
+			return err
+		}
+		history, err := openHistory(cmd)
+		if err != nil {
+			return err
+		}
+		defer history.Close()
+
+		bo := registry.NewBatchOperator(workers,
+			registry.WithRegistryClient(client),
+			registry.WithImageConverter(converter),
+			registry.WithProtectionGuard(tp),
+			registry.WithHistory(history),
+			registry.WithHistoryRetention(retention),
+			registry.WithBatchEvents(bus),
+		)
+		metricsOpts = append(metricsOpts, metrics.WithQueueSource(q), metrics.WithCacheSource(layers))
+		opts = append(opts,
+			server.WithBatchOperator(bo),
+			server.WithConversionQueue(q),
+			server.WithConverter(converter),
+			server.WithRegistryClient(client),
+		)
+	}
+
+	if serveMetrics, _ := cmd.Flags().GetBool("metrics"); serveMetrics {
+		m := metrics.New(metricsOpts...)
+		m.Subscribe(bus)
+		opts = append(opts, server.WithMetrics(m.Handler()))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// SIGHUP brings the monitored endpoints in line with the config file
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go func() {
+		for {
+			select {
+			case <-hup:
+				if err := reloadHealthEndpoints(cmd, hm); err != nil {
+					slog.Error("health endpoints not reloaded", "error", err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	fmt.Printf("✓ Serving %s on http://%s\n", server.APIPrefix, listen)
+	return server.New(opts...).ListenAndServe(ctx, listen)
+}
+
+// reloadHealthEndpoints re-reads the config file, registering endpoints
+// added to its health block, unregistering removed ones and applying its
+// check settings to the rest. Settings given as flags are kept
+func reloadHealthEndpoints(cmd *cobra.Command, hm *registry.HealthMonitor) error {
+	if loadedConfig == nil {
+		return fmt.Errorf("no config file was loaded")
+	}
+	if explicitFlag(cmd, "endpoint") {
+		return fmt.Errorf("endpoints were given with --endpoint")
+	}
+
+	cfg, err := config.Load(loadedConfig.Path)
+	if err != nil {
+		return err
+	}
+	reg, err := cfg.Registry(profile)
+	if err != nil {
+		return err
+	}
+
+	want := make(map[string]bool)
+	var opts []registry.EndpointOption
+	if reg != nil {
+		for _, endpoint := range reg.Health.Endpoints {
+			want[endpoint] = true
+		}
+		if !explicitFlag(cmd, "threshold") {
+			opts = append(opts, registry.WithFailureThreshold(reg.Health.Threshold))
+		}
+		if !explicitFlag(cmd, "retry-delay") {
+			opts = append(opts, registry.WithCircuitRetryDelay(reg.Health.RetryDelay))
+		}
+		if !explicitFlag(cmd, "health-timeout") {
+			opts = append(opts, registry.WithCheckTimeout(reg.Health.Timeout))
+		}
+		if !explicitFlag(cmd, "interval") {
+			opts = append(opts, registry.WithCheckInterval(reg.Health.Interval))
+		}
+		if !explicitFlag(cmd, "max-retry-delay") {
+			opts = append(opts, registry.WithMaxRetryDelay(reg.Health.MaxRetryDelay))
+		}
+		if !explicitFlag(cmd, "success-threshold") {
+			opts = append(opts, registry.WithSuccessThreshold(reg.Health.SuccessThreshold))
+		}
+		if !explicitFlag(cmd, "slow-threshold") {
+			opts = append(opts, registry.WithSlowThreshold(reg.Health.SlowThreshold))
+		}
+	}
+
+	var added, removed, kept int
+	for _, check := range hm.Snapshot() {
+		if want[check.Endpoint] {
+			delete(want, check.Endpoint)
+			if _, err := hm.Reconfigure(check.Endpoint, opts...); err != nil {
+				return err
+			}
+			kept++
+			continue
+		}
+		if err := hm.Unregister(check.Endpoint); err != nil {
+			return err
+		}
+		removed++
+	}
+	for endpoint := range want {
+		if err := hm.Register(endpoint, opts...); err != nil {
+			return err
+		}
+		added++
+	}
+
+	slog.Info("health endpoints reloaded", "path", loadedConfig.Path, "added", added, "removed", removed, "kept", kept)
+	return nil
+}
+
+// defaultQueuePath returns the per-user conversion queue location
+func defaultQueuePath() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = "."
+	}
+	return filepath.Join(dir, "harbor", "queue.db")
+}
+
+// defaultServerURL returns $HARBOR_SERVER or the default listen address
+func defaultServerURL() string {
+	if url := os.Getenv("HARBOR_SERVER"); url != "" {
+		return url
+	}
+	return "http://localhost:8080"
+}
+
+// serverRequest calls the API of a harbor server and decodes the JSON
+// response into out
+func serverRequest(ctx context.Context, serverURL, method, path string, out any) error {
+	url := strings.TrimSuffix(serverURL, "/") + server.APIPrefix + path
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach harbor server: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&apiErr) == nil && apiErr.Error != "" {
+			return errors.New(apiErr.Error)
+		}
+		return fmt.Errorf("%s %s: %s", method, url, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
+
+// serverEvents follows a Server-Sent Events stream of a harbor server,
+// calling handle with the name and data of each event until the stream
+// ends or handle returns an error
+func serverEvents(ctx context.Context, serverURL, path string, handle func(event string, data []byte) error) error {
+	url := strings.TrimSuffix(serverURL, "/") + server.APIPrefix + path
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach harbor server: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&apiErr) == nil && apiErr.Error != "" {
+			return errors.New(apiErr.Error)
+		}
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+
+	var event string
+	var data []byte
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if event != "" || data != nil {
+				if err := handle(event, data); err != nil {
+					return err
+				}
+			}
+			event, data = "", nil
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimSpace(strings.TrimPrefix(line, "data:"))...)
+		}
+	}
+	return scanner.Err()
+}
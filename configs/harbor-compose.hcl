@@ -0,0 +1,33 @@
+# Docker Compose install of Harbor
+#
+#   harbor --config configs/harbor-compose.hcl deploy compose plan --dir /opt/harbor
+#   harbor --config configs/harbor-compose.hcl deploy compose apply --dir /opt/harbor
+
+harbor "default" {
+  hostname       = "harbor.example.com"
+  version        = "v2.11.1"
+  admin_password = env("HARBOR_ADMIN_PASSWORD")
+  data_dir       = "/data"
+
+  http {
+    port = 80
+  }
+
+  https {
+    port        = 443
+    certificate = "/etc/harbor/tls/tls.crt"
+    private_key = "/etc/harbor/tls/tls.key"
+  }
+
+  database {
+    password = env("HARBOR_DB_PASSWORD")
+  }
+
+  jobservice {
+    workers = 10
+  }
+
+  log {
+    level = "info"
+  }
+}
@@ -0,0 +1,83 @@
+# Highly available Kubernetes install of Harbor, with an external database
+# and Redis and images stored in S3
+#
+#   harbor --config configs/harbor-k8s.hcl deploy k8s plan --dir ./harbor-k8s
+#   harbor --config configs/harbor-k8s.hcl deploy k8s apply --dir ./harbor-k8s
+#   kubectl apply -f ./harbor-k8s
+
+harbor "default" {
+  hostname       = "harbor.example.com"
+  version        = "v2.11.1"
+  admin_password = env("HARBOR_ADMIN_PASSWORD")
+
+  database {
+    host     = "harbor-db.example.internal"
+    port     = 5432
+    username = "harbor"
+    name     = "registry"
+    ssl_mode = "require"
+    password = env("HARBOR_DB_PASSWORD")
+  }
+
+  redis {
+    address  = "harbor-redis.example.internal:6379"
+    password = env("HARBOR_REDIS_PASSWORD")
+  }
+
+  # Without keys the registry uses the credentials of its pods, e.g. an
+  # IAM role for service accounts
+  storage {
+    s3 {
+      bucket = "harbor-images"
+      region = "eu-west-1"
+    }
+  }
+
+  kubernetes {
+    namespace     = "harbor"
+    ingress_class = "nginx"
+    tls_secret    = "harbor-tls"
+    storage_class = "efs"
+
+    ingress_annotations = {
+      "nginx.ingress.kubernetes.io/proxy-body-size" = "0"
+    }
+
+    component "core" {
+      replicas = 3
+
+      requests {
+        cpu    = "250m"
+        memory = "512Mi"
+      }
+
+      limits {
+        memory = "1Gi"
+      }
+    }
+
+    component "portal" {
+      replicas = 2
+    }
+
+    component "registry" {
+      replicas = 3
+
+      requests {
+        cpu    = "250m"
+        memory = "512Mi"
+      }
+
+      limits {
+        memory = "2Gi"
+      }
+    }
+
+    # Replicas share the job log volume, so the storage class must
+    # support ReadWriteMany
+    component "jobservice" {
+      replicas    = 2
+      volume_size = "5Gi"
+    }
+  }
+}
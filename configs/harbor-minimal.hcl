@@ -0,0 +1,26 @@
+# Minimal harbor toolkit configuration
+#
+#   harbor --config configs/harbor-minimal.hcl registry batch delete library/app:old
+
+registry "default" {
+  address  = "harbor.example.com"
+  username = "admin"
+  password = env("HARBOR_PASSWORD")
+
+  protection {
+    store = "policies.json"
+
+    policy "releases" {
+      pattern   = ".*:v\\d+\\.\\d+\\.\\d+$"
+      immutable = true
+    }
+  }
+
+  batch {
+    workers = 5
+  }
+
+  health {
+    endpoints = ["https://harbor.example.com"]
+  }
+}
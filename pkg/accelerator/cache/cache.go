@@ -0,0 +1,443 @@
+// Copyright 2021 vjranagit
+//
+// Content-addressable cache of converted layers
+
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// DefaultMaxSize bounds the cache when no size is configured
+const DefaultMaxSize = 10 << 30
+
+// ErrMiss is returned when a key has no usable entry
+var ErrMiss = errors.New("cache miss")
+
+// Key identifies one conversion of a source layer
+type Key struct {
+	// Source is the digest of the source layer
+	Source digest.Digest
+	// Driver is the driver name, e.g. "nydus"
+	Driver string
+	// Options fingerprints the driver settings that affect the output, and
+	// tells apart several artifacts a driver produces per layer
+	Options string
+}
+
+// ID returns the stable identifier the key is stored under
+func (k Key) ID() string {
+	return digest.FromString(k.Source.String() + "\n" + k.Driver + "\n" + k.Options).Encoded()
+}
+
+// Entry is a cached conversion result
+type Entry struct {
+	ID      string        `json:"id"`
+	Source  digest.Digest `json:"source"`
+	Driver  string        `json:"driver"`
+	Options string        `json:"options,omitempty"`
+	// Blob describes the converted blob, including driver annotations
+	Blob ocispec.Descriptor `json:"blob"`
+	// DiffID is the digest of the uncompressed converted layer
+	DiffID   digest.Digest `json:"diff_id,omitempty"`
+	Created  time.Time     `json:"created"`
+	LastUsed time.Time     `json:"last_used"`
+}
+
+// Stats are cache counters, persisted across runs
+type Stats struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+	// Corrupted counts entries dropped because their blob failed
+	// verification
+	Corrupted int64 `json:"corrupted"`
+
+	Entries int   `json:"-"`
+	Size    int64 `json:"-"`
+	MaxSize int64 `json:"-"`
+}
+
+// HitRatio returns hits over lookups, zero without lookups
+func (s Stats) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// index is the persisted cache metadata
+type index struct {
+	Entries map[string]*Entry `json:"entries"`
+	Stats   Stats             `json:"stats"`
+}
+
+// Cache stores converted blobs on disk by digest, with an index mapping
+// keys to them. Writes go through a temporary file and a rename, reads
+// verify the blob digest, and least recently used entries are evicted once
+// the blobs exceed the size limit. The index is rewritten when entries
+// change; counters and use times are kept in memory until then or Close.
+// Concurrent processes sharing a directory may lose each other's updates
+type Cache struct {
+	root    string
+	maxSize int64
+	index   index
+	// dirty marks counters or use times not saved yet
+	dirty  bool
+	mu     sync.Mutex
+	logger *slog.Logger
+}
+
+// Option configures a Cache
+type Option func(*Cache)
+
+// WithMaxSize bounds the total size of cached blobs in bytes
+func WithMaxSize(size int64) Option {
+	return func(c *Cache) {
+		c.maxSize = size
+	}
+}
+
+// Open opens or creates a cache rooted at dir
+func Open(dir string, opts ...Option) (*Cache, error) {
+	for _, sub := range []string{filepath.Join("blobs", "sha256"), "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			return nil, err
+		}
+	}
+
+	c := &Cache{
+		root:    dir,
+		maxSize: DefaultMaxSize,
+		index:   index{Entries: make(map[string]*Entry)},
+		logger:  slog.Default().With("component", "layer-cache"),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	data, err := os.ReadFile(c.indexPath())
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(data, &c.index); err != nil {
+			return nil, fmt.Errorf("failed to read cache index %s: %w", c.indexPath(), err)
+		}
+		if c.index.Entries == nil {
+			c.index.Entries = make(map[string]*Entry)
+		}
+	}
+	return c, nil
+}
+
+// Root returns the cache directory
+func (c *Cache) Root() string {
+	return c.root
+}
+
+// Get returns the entry for key and its verified blob. Missing entries and
+// blobs that are gone or fail verification return ErrMiss; entries whose
+// blob is unusable are dropped
+func (c *Cache) Get(key Key) (*Entry, io.ReadCloser, error) {
+	id := key.ID()
+
+	c.mu.Lock()
+	entry, ok := c.index.Entries[id]
+	if !ok {
+		c.index.Stats.Misses++
+		c.dirty = true
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		return nil, nil, ErrMiss
+	}
+
+	f, err := c.verify(entry.Blob)
+	if err != nil {
+		return nil, nil, c.unusable(entry, err)
+	}
+
+	c.mu.Lock()
+	entry.LastUsed = time.Now()
+	c.index.Stats.Hits++
+	c.dirty = true
+	hit := *entry
+	c.mu.Unlock()
+	return &hit, f, nil
+}
+
+// Put stores the content of r as the converted blob for key. blob gives
+// the media type and annotations; when its digest is set the content must
+// match it
+func (c *Cache) Put(key Key, blob ocispec.Descriptor, diffID digest.Digest, r io.Reader) (*Entry, error) {
+	tmp, err := os.CreateTemp(filepath.Join(c.root, "tmp"), "blob-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+
+	digester := digest.Canonical.Digester()
+	size, err := io.Copy(io.MultiWriter(tmp, digester.Hash()), r)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	dgst := digester.Digest()
+	if blob.Digest != "" && blob.Digest != dgst {
+		return nil, fmt.Errorf("digest mismatch: expected %s, got %s", blob.Digest, dgst)
+	}
+	blob.Digest = dgst
+	blob.Size = size
+
+	if err := os.Rename(tmp.Name(), c.blobPath(dgst)); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	entry := &Entry{
+		ID:       key.ID(),
+		Source:   key.Source,
+		Driver:   key.Driver,
+		Options:  key.Options,
+		Blob:     blob,
+		DiffID:   diffID,
+		Created:  now,
+		LastUsed: now,
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// A replaced entry's blob goes unless the new one or another entry
+	// still uses it
+	if old, ok := c.index.Entries[entry.ID]; ok && old.Blob.Digest != dgst {
+		c.remove(entry.ID)
+	}
+	c.index.Entries[entry.ID] = entry
+	c.evict(entry.ID)
+	if err := c.save(); err != nil {
+		return nil, err
+	}
+
+	stored := *entry
+	return &stored, nil
+}
+
+// Entries returns the cached entries, most recently used first
+func (c *Cache) Entries() []*Entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries := make([]*Entry, 0, len(c.index.Entries))
+	for _, entry := range c.index.Entries {
+		e := *entry
+		entries = append(entries, &e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].LastUsed.After(entries[j].LastUsed) })
+	return entries
+}
+
+// Stats returns the counters and current usage
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.index.Stats
+	stats.Entries = len(c.index.Entries)
+	stats.Size = c.size()
+	stats.MaxSize = c.maxSize
+	return stats
+}
+
+// Clear removes every entry and resets the counters
+func (c *Cache) Clear() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for id := range c.index.Entries {
+		c.remove(id)
+	}
+	c.index.Stats = Stats{}
+	return c.save()
+}
+
+// unusable counts a miss on an entry whose blob failed to verify and
+// drops the entry, unless it was evicted or replaced since the lookup.
+// Only blobs that are there but do not match count as corrupted
+func (c *Cache) unusable(entry *Entry, cause error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.index.Stats.Misses++
+	c.dirty = true
+	if c.index.Entries[entry.ID] != entry {
+		return ErrMiss
+	}
+
+	c.logger.Warn("dropping unusable cache entry", "source", entry.Source, "driver", entry.Driver, "error", cause)
+	if !errors.Is(cause, os.ErrNotExist) {
+		c.index.Stats.Corrupted++
+	}
+	c.remove(entry.ID)
+	if err := c.save(); err != nil {
+		return err
+	}
+	return ErrMiss
+}
+
+// Flush saves counters and use times kept in memory
+func (c *Cache) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.dirty {
+		return nil
+	}
+	return c.save()
+}
+
+// Close saves the index; the cache must not be used afterwards
+func (c *Cache) Close() error {
+	return c.Flush()
+}
+
+// verify opens a blob and checks its size and digest
+func (c *Cache) verify(blob ocispec.Descriptor) (*os.File, error) {
+	if err := blob.Digest.Validate(); err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(c.blobPath(blob.Digest))
+	if err != nil {
+		return nil, err
+	}
+
+	verifier := blob.Digest.Verifier()
+	n, err := io.Copy(verifier, f)
+	if err == nil && (n != blob.Size || !verifier.Verified()) {
+		err = fmt.Errorf("blob %s failed verification", blob.Digest)
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// evict drops least recently used entries, other than keep, until the
+// blobs fit the size limit. Callers hold c.mu
+func (c *Cache) evict(keep string) {
+	if c.maxSize <= 0 {
+		return
+	}
+
+	var candidates []*Entry
+	for id, entry := range c.index.Entries {
+		if id != keep {
+			candidates = append(candidates, entry)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].LastUsed.Before(candidates[j].LastUsed) })
+
+	size := c.size()
+	for _, entry := range candidates {
+		if size <= c.maxSize {
+			return
+		}
+		size -= c.remove(entry.ID)
+		c.index.Stats.Evictions++
+		c.logger.Debug("cache entry evicted", "source", entry.Source, "driver", entry.Driver, "size", entry.Blob.Size)
+	}
+}
+
+// remove drops an entry and its blob when no other entry shares it, and
+// returns the bytes freed. Callers hold c.mu
+func (c *Cache) remove(id string) int64 {
+	entry, ok := c.index.Entries[id]
+	if !ok {
+		return 0
+	}
+	delete(c.index.Entries, id)
+
+	for _, other := range c.index.Entries {
+		if other.Blob.Digest == entry.Blob.Digest {
+			return 0
+		}
+	}
+	if entry.Blob.Digest.Validate() == nil {
+		os.Remove(c.blobPath(entry.Blob.Digest))
+	}
+	return entry.Blob.Size
+}
+
+// size sums the distinct cached blobs. Callers hold c.mu
+func (c *Cache) size() int64 {
+	seen := make(map[digest.Digest]bool)
+	var total int64
+	for _, entry := range c.index.Entries {
+		if !seen[entry.Blob.Digest] {
+			seen[entry.Blob.Digest] = true
+			total += entry.Blob.Size
+		}
+	}
+	return total
+}
+
+// save atomically rewrites the index. Callers hold c.mu
+func (c *Cache) save() error {
+	data, err := json.MarshalIndent(c.index, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Join(c.root, "tmp"), "index-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), c.indexPath()); err != nil {
+		return err
+	}
+	c.dirty = false
+	return nil
+}
+
+func (c *Cache) indexPath() string {
+	return filepath.Join(c.root, "index.json")
+}
+
+func (c *Cache) blobPath(dgst digest.Digest) string {
+	return filepath.Join(c.root, "blobs", dgst.Algorithm().String(), dgst.Encoded())
+}
@@ -0,0 +1,341 @@
+// Copyright 2021 vjranagit
+//
+// Layer cache tests
+
+package cache
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func testKey(source string) Key {
+	return Key{Source: digest.FromString(source), Driver: "estargz", Options: "level=9"}
+}
+
+func mustPut(t *testing.T, c *Cache, key Key, content string) *Entry {
+	t.Helper()
+	entry, err := c.Put(key, ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayerGzip}, "", strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	return entry
+}
+
+func mustGet(t *testing.T, c *Cache, key Key) (*Entry, string) {
+	t.Helper()
+	entry, rc, err := c.Get(key)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	return entry, string(data)
+}
+
+func TestCache_PutGet(t *testing.T) {
+	dir := t.TempDir()
+	c, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	key := testKey("layer")
+	diffID := digest.FromString("uncompressed")
+	blob := ocispec.Descriptor{
+		MediaType:   ocispec.MediaTypeImageLayerGzip,
+		Digest:      digest.FromString("converted"),
+		Annotations: map[string]string{"containerd.io/snapshot/stargz/toc.digest": "sha256:abc"},
+	}
+	if _, err := c.Put(key, blob, diffID, strings.NewReader("converted")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	if _, _, err := c.Get(testKey("other")); !errors.Is(err, ErrMiss) {
+		t.Errorf("expected ErrMiss, got %v", err)
+	}
+
+	// Entries and counters survive a reopen after Close
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	c, err = Open(dir)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	entry, data := mustGet(t, c, key)
+	if data != "converted" {
+		t.Errorf("expected cached content, got %q", data)
+	}
+	if entry.DiffID != diffID || entry.Blob.Size != int64(len("converted")) {
+		t.Errorf("unexpected entry: %+v", entry)
+	}
+	if entry.Blob.Annotations["containerd.io/snapshot/stargz/toc.digest"] != "sha256:abc" {
+		t.Errorf("expected annotations to be kept, got %v", entry.Blob.Annotations)
+	}
+
+	stats := c.Stats()
+	if stats.Hits != 1 || stats.Misses != 1 || stats.Entries != 1 || stats.Size != int64(len("converted")) {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+	if stats.HitRatio() != 0.5 {
+		t.Errorf("expected hit ratio 0.5, got %v", stats.HitRatio())
+	}
+
+	tmp, _ := os.ReadDir(filepath.Join(dir, "tmp"))
+	if len(tmp) != 0 {
+		t.Errorf("expected no temporary files left, got %d", len(tmp))
+	}
+}
+
+func TestCache_Flush(t *testing.T) {
+	dir := t.TempDir()
+	c, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	mustPut(t, c, testKey("layer"), "converted")
+	saved, _ := os.ReadFile(c.indexPath())
+
+	// Lookups do not rewrite the index
+	mustGet(t, c, testKey("layer"))
+	c.Get(testKey("other"))
+	if data, _ := os.ReadFile(c.indexPath()); string(data) != string(saved) {
+		t.Error("expected lookups to leave the index alone")
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	c, err = Open(dir)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	if stats := c.Stats(); stats.Hits != 1 || stats.Misses != 1 {
+		t.Errorf("expected the counters saved on Close, got %+v", stats)
+	}
+}
+
+func TestCache_DigestMismatch(t *testing.T) {
+	c, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	blob := ocispec.Descriptor{Digest: digest.FromString("expected")}
+	if _, err := c.Put(testKey("layer"), blob, "", strings.NewReader("actual")); err == nil {
+		t.Fatal("expected digest mismatch error")
+	}
+	if stats := c.Stats(); stats.Entries != 0 {
+		t.Errorf("expected nothing cached, got %d entries", stats.Entries)
+	}
+}
+
+func TestCache_Corruption(t *testing.T) {
+	tests := []struct {
+		name      string
+		corrupt   func(path string) error
+		corrupted int64
+	}{
+		{"modified", func(path string) error { return os.WriteFile(path, []byte("tampered!"), 0o644) }, 1},
+		{"truncated", func(path string) error { return os.Truncate(path, 3) }, 1},
+		{"missing", os.Remove, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := Open(t.TempDir())
+			if err != nil {
+				t.Fatalf("Open failed: %v", err)
+			}
+
+			key := testKey("layer")
+			entry := mustPut(t, c, key, "converted")
+			if err := tt.corrupt(c.blobPath(entry.Blob.Digest)); err != nil {
+				t.Fatalf("corrupt failed: %v", err)
+			}
+
+			if _, _, err := c.Get(key); !errors.Is(err, ErrMiss) {
+				t.Fatalf("expected ErrMiss, got %v", err)
+			}
+			stats := c.Stats()
+			if stats.Corrupted != tt.corrupted || stats.Misses != 1 || stats.Entries != 0 {
+				t.Errorf("expected unusable entry to be dropped, got %+v", stats)
+			}
+
+			// A fresh conversion can be stored again
+			mustPut(t, c, key, "converted")
+			if _, data := mustGet(t, c, key); data != "converted" {
+				t.Errorf("expected restored content, got %q", data)
+			}
+		})
+	}
+}
+
+func TestCache_Eviction(t *testing.T) {
+	c, err := Open(t.TempDir(), WithMaxSize(20))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	first := mustPut(t, c, testKey("first"), "0123456789")
+	mustPut(t, c, testKey("second"), "abcdefghij")
+
+	// Using the first entry makes the second the least recently used
+	mustGet(t, c, testKey("first"))
+	mustPut(t, c, testKey("third"), "ABCDEFGHIJ")
+
+	if _, _, err := c.Get(testKey("second")); !errors.Is(err, ErrMiss) {
+		t.Errorf("expected least recently used entry to be evicted, got %v", err)
+	}
+	mustGet(t, c, testKey("first"))
+	mustGet(t, c, testKey("third"))
+
+	stats := c.Stats()
+	if stats.Evictions != 1 || stats.Size != 20 {
+		t.Errorf("unexpected stats after eviction: %+v", stats)
+	}
+	if _, err := os.Stat(c.blobPath(first.Blob.Digest)); err != nil {
+		t.Errorf("expected kept blob on disk: %v", err)
+	}
+}
+
+func TestCache_Replace(t *testing.T) {
+	c, err := Open(t.TempDir(), WithMaxSize(20))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	old := mustPut(t, c, testKey("layer"), "0123456789")
+	mustPut(t, c, testKey("layer"), "abcdefghij")
+	if _, err := os.Stat(c.blobPath(old.Blob.Digest)); !os.IsNotExist(err) {
+		t.Errorf("expected the replaced blob to be removed, got %v", err)
+	}
+
+	// Storing the same content again keeps the blob
+	same := mustPut(t, c, testKey("layer"), "abcdefghij")
+	if _, data := mustGet(t, c, testKey("layer")); data != "abcdefghij" {
+		t.Errorf("expected the blob to be kept, got %q", data)
+	}
+	mustPut(t, c, testKey("other"), "ABCDEFGHIJ")
+	if stats := c.Stats(); stats.Entries != 2 || stats.Size != 20 || stats.Evictions != 0 {
+		t.Errorf("expected both entries to fit, got %+v", stats)
+	}
+	if _, err := os.Stat(c.blobPath(same.Blob.Digest)); err != nil {
+		t.Errorf("expected kept blob on disk: %v", err)
+	}
+}
+
+func TestCache_EvictedDuringGet(t *testing.T) {
+	c, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	mustPut(t, c, testKey("layer"), "converted")
+
+	// Get looked up the entry, then eviction removed it and its blob
+	c.mu.Lock()
+	entry := c.index.Entries[testKey("layer").ID()]
+	c.remove(entry.ID)
+	c.mu.Unlock()
+
+	_, err = c.verify(entry.Blob)
+	if err := c.unusable(entry, err); !errors.Is(err, ErrMiss) {
+		t.Fatalf("expected ErrMiss, got %v", err)
+	}
+	if stats := c.Stats(); stats.Misses != 1 || stats.Corrupted != 0 {
+		t.Errorf("expected a plain miss, got %+v", stats)
+	}
+
+	// The entry was stored again in the meantime: it is kept
+	mustPut(t, c, testKey("layer"), "converted")
+	if err := c.unusable(entry, err); !errors.Is(err, ErrMiss) {
+		t.Fatalf("expected ErrMiss, got %v", err)
+	}
+	if _, data := mustGet(t, c, testKey("layer")); data != "converted" {
+		t.Errorf("expected the new entry to be kept, got %q", data)
+	}
+}
+
+func TestCache_SharedBlobs(t *testing.T) {
+	c, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	a := mustPut(t, c, testKey("a"), "same output")
+	mustPut(t, c, Key{Source: digest.FromString("b"), Driver: "nydus"}, "same output")
+
+	if stats := c.Stats(); stats.Size != int64(len("same output")) {
+		t.Errorf("expected shared blob to count once, got size %d", stats.Size)
+	}
+
+	c.mu.Lock()
+	c.remove(a.ID)
+	c.mu.Unlock()
+
+	if _, data := mustGet(t, c, Key{Source: digest.FromString("b"), Driver: "nydus"}); data != "same output" {
+		t.Errorf("expected shared blob to survive removal of one entry, got %q", data)
+	}
+}
+
+func TestCache_Clear(t *testing.T) {
+	dir := t.TempDir()
+	c, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	entry := mustPut(t, c, testKey("layer"), "converted")
+	mustGet(t, c, testKey("layer"))
+
+	if err := c.Clear(); err != nil {
+		t.Fatalf("Clear failed: %v", err)
+	}
+	if stats := c.Stats(); stats.Entries != 0 || stats.Hits != 0 {
+		t.Errorf("expected empty cache, got %+v", stats)
+	}
+	if _, err := os.Stat(c.blobPath(entry.Blob.Digest)); !os.IsNotExist(err) {
+		t.Errorf("expected blob to be removed, got %v", err)
+	}
+
+	c, err = Open(dir)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	if len(c.Entries()) != 0 {
+		t.Error("expected cleared index to be persisted")
+	}
+}
+
+func TestKey_ID(t *testing.T) {
+	base := testKey("layer")
+	tests := []struct {
+		name string
+		key  Key
+		same bool
+	}{
+		{"identical", testKey("layer"), true},
+		{"other source", testKey("other"), false},
+		{"other driver", Key{Source: base.Source, Driver: "nydus", Options: base.Options}, false},
+		{"other options", Key{Source: base.Source, Driver: base.Driver, Options: "level=1"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if same := tt.key.ID() == base.ID(); same != tt.same {
+				t.Errorf("expected same=%v, got %v", tt.same, same)
+			}
+		})
+	}
+}
@@ -0,0 +1,396 @@
+// Copyright 2021 vjranagit
+//
+// Conversion orchestrator: pull, convert with a driver, push
+
+package accelerator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/vjranagit/harbor/pkg/accelerator/drivers"
+	"github.com/vjranagit/harbor/pkg/accelerator/layout"
+	"github.com/vjranagit/harbor/pkg/distribution"
+	"github.com/vjranagit/harbor/pkg/events"
+)
+
+// annotationReferenceType marks attestation manifests in buildx indexes
+const annotationReferenceType = "vnd.docker.reference.type"
+
+// defaultTagSuffixes are appended to the source tag to name converted images
+var defaultTagSuffixes = map[string]string{
+	"nydus":   "-nydus",
+	"estargz": "-esgz",
+}
+
+// Converter pulls images through a registry client, converts them with a
+// driver in a scratch OCI layout and pushes the result under a derived tag
+// in the same repository
+type Converter struct {
+	client   *distribution.Client
+	drivers  map[string]drivers.Driver
+	suffixes map[string]string
+	workDir  string
+	events   *events.Bus
+	logger   *slog.Logger
+}
+
+// ConverterOption configures a Converter
+type ConverterOption func(*Converter)
+
+// WithDriver registers a conversion driver under its name
+func WithDriver(d drivers.Driver) ConverterOption {
+	return func(c *Converter) {
+		c.drivers[d.Name()] = d
+	}
+}
+
+// WithTagSuffix overrides the tag suffix used for a driver
+func WithTagSuffix(driver, suffix string) ConverterOption {
+	return func(c *Converter) {
+		c.suffixes[driver] = suffix
+	}
+}
+
+// WithWorkDir sets where scratch layouts are created
+func WithWorkDir(dir string) ConverterOption {
+	return func(c *Converter) {
+		c.workDir = dir
+	}
+}
+
+// WithEvents publishes a ConversionCompleted event for every conversion
+func WithEvents(bus *events.Bus) ConverterOption {
+	return func(c *Converter) {
+		c.events = bus
+	}
+}
+
+// NewConverter creates a converter for images on client's registry
+func NewConverter(client *distribution.Client, opts ...ConverterOption) *Converter {
+	c := &Converter{
+		client:   client,
+		drivers:  make(map[string]drivers.Driver),
+		suffixes: make(map[string]string),
+		logger:   slog.Default().With("component", "converter"),
+	}
+	for name, suffix := range defaultTagSuffixes {
+		c.suffixes[name] = suffix
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Drivers returns the registered driver names
+func (c *Converter) Drivers() []string {
+	names := make([]string, 0, len(c.drivers))
+	for name := range c.drivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Result describes one converted image
+type Result struct {
+	Source string
+	Target string
+	Driver string
+	// Digest is the pushed manifest, or index for multi-arch sources
+	Digest    digest.Digest
+	Platforms []PlatformResult
+	Elapsed   time.Duration
+}
+
+// PlatformResult describes the conversion of one platform manifest
+type PlatformResult struct {
+	Platform *ocispec.Platform
+	Source   digest.Digest
+	Manifest digest.Digest
+	Layers   []drivers.LayerResult
+	Pull     time.Duration
+	Convert  time.Duration
+	Push     time.Duration
+}
+
+// TargetTag derives the tag a converted image is pushed under, e.g.
+// "v1" becomes "v1-nydus"
+func (c *Converter) TargetTag(ref distribution.Reference, driver string) string {
+	suffix, ok := c.suffixes[driver]
+	if !ok {
+		suffix = "-" + driver
+	}
+
+	tag := ref.Tag
+	if ref.Digest != "" {
+		tag = ref.Digest.Algorithm().String() + "-" + ref.Digest.Encoded()[:12]
+	}
+	return tag + suffix
+}
+
+// Convert converts source with the named driver and pushes the result.
+// Image indexes are converted platform by platform and reassembled
+func (c *Converter) Convert(ctx context.Context, source, driver string) (*Result, error) {
+	start := time.Now()
+	result, err := c.convert(ctx, source, driver)
+
+	event := events.ConversionCompleted{Source: source, Driver: driver, Elapsed: time.Since(start)}
+	if err != nil {
+		event.Error = err.Error()
+	} else {
+		event.Target = result.Target
+		event.Digest = result.Digest.String()
+	}
+	c.events.Publish(ctx, event)
+
+	return result, err
+}
+
+func (c *Converter) convert(ctx context.Context, source, driver string) (*Result, error) {
+	start := time.Now()
+
+	d, ok := c.drivers[driver]
+	if !ok {
+		return nil, fmt.Errorf("unknown driver %q (available: %s)", driver, strings.Join(c.Drivers(), ", "))
+	}
+
+	ref, err := distribution.ParseReference(source)
+	if err != nil {
+		return nil, err
+	}
+	if ref.Registry != "" && ref.Registry != c.client.Registry() {
+		return nil, fmt.Errorf("source %s is not on registry %s", source, c.client.Registry())
+	}
+
+	dir, err := os.MkdirTemp(c.workDir, "harbor-convert-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := layout.New(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	target := ref
+	target.Digest = ""
+	target.Tag = c.TargetTag(ref, driver)
+
+	result := &Result{
+		Source: source,
+		Target: target.String(),
+		Driver: driver,
+	}
+
+	c.logger.InfoContext(ctx, "conversion started", "source", source, "driver", driver, "target", result.Target)
+
+	m, err := c.client.GetManifest(ctx, ref.Repository, ref.Identifier())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get manifest: %w", err)
+	}
+
+	if !m.IsIndex() {
+		platform, desc, err := c.convertManifest(ctx, store, d, ref.Repository, m)
+		if err != nil {
+			return nil, err
+		}
+		pushStart := time.Now()
+		if err := c.pushManifest(ctx, store, ref.Repository, target.Tag, desc); err != nil {
+			return nil, err
+		}
+		platform.Push = time.Since(pushStart)
+		result.Digest = desc.Digest
+		result.Platforms = []PlatformResult{*platform}
+	} else {
+		var index ocispec.Index
+		if err := json.Unmarshal(m.Payload, &index); err != nil {
+			return nil, fmt.Errorf("failed to decode index: %w", err)
+		}
+
+		converted := ocispec.Index{
+			Versioned:   specs.Versioned{SchemaVersion: 2},
+			MediaType:   ocispec.MediaTypeImageIndex,
+			Annotations: index.Annotations,
+		}
+		for _, child := range index.Manifests {
+			if child.Annotations[annotationReferenceType] != "" {
+				// Attestations describe the source image, not ours
+				continue
+			}
+
+			cm, err := c.client.GetManifest(ctx, ref.Repository, child.Digest.String())
+			if err != nil {
+				return nil, fmt.Errorf("failed to get manifest %s: %w", child.Digest, err)
+			}
+			platform, desc, err := c.convertManifest(ctx, store, d, ref.Repository, cm)
+			if err != nil {
+				return nil, fmt.Errorf("platform %s: %w", platformString(child.Platform), err)
+			}
+			pushStart := time.Now()
+			if err := c.pushManifest(ctx, store, ref.Repository, desc.Digest.String(), desc); err != nil {
+				return nil, err
+			}
+			platform.Push = time.Since(pushStart)
+
+			platform.Platform = child.Platform
+			desc.Platform = child.Platform
+			converted.Manifests = append(converted.Manifests, desc)
+			result.Platforms = append(result.Platforms, *platform)
+		}
+		if len(converted.Manifests) == 0 {
+			return nil, fmt.Errorf("index %s has no image manifests", m.Descriptor.Digest)
+		}
+
+		payload, err := json.Marshal(converted)
+		if err != nil {
+			return nil, err
+		}
+		desc, err := c.client.PutManifest(ctx, ref.Repository, target.Tag, ocispec.MediaTypeImageIndex, payload)
+		if err != nil {
+			return nil, fmt.Errorf("failed to push index: %w", err)
+		}
+		result.Digest = desc.Digest
+	}
+
+	result.Elapsed = time.Since(start)
+	c.logger.InfoContext(ctx, "conversion completed",
+		"source", source,
+		"target", result.Target,
+		"digest", result.Digest,
+		"platforms", len(result.Platforms),
+		"elapsed", result.Elapsed)
+
+	return result, nil
+}
+
+// ConvertImage converts source and returns the pushed reference; it lets
+// the converter back registry.BatchOpConvert operations
+func (c *Converter) ConvertImage(ctx context.Context, source, driver string) (string, error) {
+	result, err := c.Convert(ctx, source, driver)
+	if err != nil {
+		return "", err
+	}
+	return result.Target, nil
+}
+
+// convertManifest pulls one image manifest into store and converts it
+func (c *Converter) convertManifest(ctx context.Context, store *layout.Layout, d drivers.Driver, repo string, m *distribution.Manifest) (*PlatformResult, ocispec.Descriptor, error) {
+	platform := &PlatformResult{Source: m.Descriptor.Digest}
+
+	start := time.Now()
+	if err := c.pull(ctx, store, repo, m); err != nil {
+		return nil, ocispec.Descriptor{}, err
+	}
+	platform.Pull = time.Since(start)
+
+	converted, err := d.Convert(ctx, store, m.Descriptor)
+	if err != nil {
+		return nil, ocispec.Descriptor{}, fmt.Errorf("%s conversion failed: %w", d.Name(), err)
+	}
+	platform.Convert = converted.Elapsed
+	platform.Layers = converted.Layers
+	platform.Manifest = converted.Manifest.Digest
+
+	return platform, converted.Manifest, nil
+}
+
+// pull copies a manifest, its config and layers into store
+func (c *Converter) pull(ctx context.Context, store *layout.Layout, repo string, m *distribution.Manifest) error {
+	if _, err := storeBlob(ctx, store, m.Descriptor, bytes.NewReader(m.Payload)); err != nil {
+		return err
+	}
+
+	refs, err := m.References()
+	if err != nil {
+		return err
+	}
+	for _, desc := range refs {
+		if store.Exists(ctx, desc.Digest) {
+			continue
+		}
+
+		rc, err := c.client.GetBlob(ctx, repo, desc.Digest)
+		if err != nil {
+			return fmt.Errorf("failed to pull blob %s: %w", desc.Digest, err)
+		}
+		_, err = storeBlob(ctx, store, desc, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pushManifest uploads the blobs of a converted manifest and the manifest
+// itself under reference
+func (c *Converter) pushManifest(ctx context.Context, store *layout.Layout, repo, reference string, desc ocispec.Descriptor) error {
+	var manifest ocispec.Manifest
+	if err := layout.ReadJSON(ctx, store, desc, &manifest); err != nil {
+		return err
+	}
+
+	for _, blob := range append([]ocispec.Descriptor{manifest.Config}, manifest.Layers...) {
+		rc, err := store.Fetch(ctx, blob)
+		if err != nil {
+			return err
+		}
+		err = c.client.PushBlob(ctx, repo, blob, rc)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("failed to push blob %s: %w", blob.Digest, err)
+		}
+	}
+
+	rc, err := store.Fetch(ctx, desc)
+	if err != nil {
+		return err
+	}
+	payload, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return err
+	}
+
+	if _, err := c.client.PutManifest(ctx, repo, reference, desc.MediaType, payload); err != nil {
+		return fmt.Errorf("failed to push manifest: %w", err)
+	}
+	return nil
+}
+
+// storeBlob writes r to store and checks it matches desc
+func storeBlob(ctx context.Context, store *layout.Layout, desc ocispec.Descriptor, r io.Reader) (ocispec.Descriptor, error) {
+	got, err := store.Push(ctx, desc.MediaType, r)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if got.Digest != desc.Digest {
+		return ocispec.Descriptor{}, fmt.Errorf("digest mismatch for %s: got %s", desc.Digest, got.Digest)
+	}
+	return got, nil
+}
+
+func platformString(p *ocispec.Platform) string {
+	if p == nil {
+		return "unknown"
+	}
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
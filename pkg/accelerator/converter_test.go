@@ -0,0 +1,280 @@
+// Copyright 2021 vjranagit
+//
+// Conversion orchestrator tests
+
+package accelerator
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/vjranagit/harbor/pkg/accelerator/drivers"
+	"github.com/vjranagit/harbor/pkg/distribution"
+	"github.com/vjranagit/harbor/pkg/distribution/registrytest"
+	"github.com/vjranagit/harbor/pkg/events"
+	"github.com/vjranagit/harbor/pkg/registry"
+)
+
+// pushTestImage pushes a one-layer image whose config lists the right
+// diff ID and returns its manifest descriptor
+func pushTestImage(t *testing.T, reg *registrytest.Registry, repo, tag, arch string) ocispec.Descriptor {
+	t.Helper()
+
+	var raw bytes.Buffer
+	tw := tar.NewWriter(&raw)
+	content := "built for " + arch
+	tw.WriteHeader(&tar.Header{Name: "etc/arch", Mode: 0o644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+	tw.Write([]byte(content))
+	tw.Close()
+
+	var layer bytes.Buffer
+	zw := gzip.NewWriter(&layer)
+	zw.Write(raw.Bytes())
+	zw.Close()
+
+	config, err := json.Marshal(ocispec.Image{
+		Platform: ocispec.Platform{OS: "linux", Architecture: arch},
+		RootFS:   ocispec.RootFS{Type: "layers", DiffIDs: []digest.Digest{digest.FromBytes(raw.Bytes())}},
+	})
+	if err != nil {
+		t.Fatalf("marshal config failed: %v", err)
+	}
+	return reg.PushImage(repo, tag, config, layer.Bytes())
+}
+
+func newTestConverter(t *testing.T, reg *registrytest.Registry) *Converter {
+	t.Helper()
+
+	client, err := distribution.NewClient(reg.URL())
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	return NewConverter(client, WithDriver(drivers.NewEStargz()), WithWorkDir(t.TempDir()))
+}
+
+// pulledManifest reads a manifest back from the test registry
+func pulledManifest(t *testing.T, reg *registrytest.Registry, repo, ref string) ([]byte, string) {
+	t.Helper()
+
+	payload, mediaType, ok := reg.Manifest(repo, ref)
+	if !ok {
+		t.Fatalf("manifest %s:%s not found", repo, ref)
+	}
+	return payload, mediaType
+}
+
+func TestConverter_Convert(t *testing.T) {
+	reg := registrytest.New()
+	defer reg.Close()
+	source := pushTestImage(t, reg, "library/app", "v1", "amd64")
+
+	c := newTestConverter(t, reg)
+	result, err := c.Convert(context.Background(), "library/app:v1", "estargz")
+	if err != nil {
+		t.Fatalf("Convert failed: %v", err)
+	}
+
+	if result.Target != "library/app:v1-esgz" {
+		t.Errorf("expected target library/app:v1-esgz, got %s", result.Target)
+	}
+	if len(result.Platforms) != 1 || result.Platforms[0].Source != source.Digest {
+		t.Fatalf("unexpected platform results: %+v", result.Platforms)
+	}
+	if len(result.Platforms[0].Layers) != 1 {
+		t.Errorf("expected per-layer results, got %d", len(result.Platforms[0].Layers))
+	}
+
+	payload, mediaType := pulledManifest(t, reg, "library/app", "v1-esgz")
+	if mediaType != ocispec.MediaTypeImageManifest {
+		t.Errorf("expected OCI manifest, got %s", mediaType)
+	}
+	if digest.FromBytes(payload) != result.Digest {
+		t.Errorf("expected pushed digest %s, got %s", result.Digest, digest.FromBytes(payload))
+	}
+
+	var manifest ocispec.Manifest
+	json.Unmarshal(payload, &manifest)
+	for _, layer := range append(manifest.Layers, manifest.Config) {
+		if !reg.HasBlob("library/app", layer.Digest) {
+			t.Errorf("blob %s was not pushed", layer.Digest)
+		}
+	}
+	if manifest.Layers[0].Annotations[estargz.TOCJSONDigestAnnotation] == "" {
+		t.Error("expected eStargz TOC annotation on converted layer")
+	}
+
+	// The source tag is left alone
+	if _, _, ok := reg.Manifest("library/app", "v1"); !ok {
+		t.Error("expected source tag to remain")
+	}
+}
+
+func TestConverter_ConvertIndex(t *testing.T) {
+	reg := registrytest.New()
+	defer reg.Close()
+
+	amd64 := pushTestImage(t, reg, "library/app", "", "amd64")
+	arm64 := pushTestImage(t, reg, "library/app", "", "arm64")
+	amd64.Platform = &ocispec.Platform{OS: "linux", Architecture: "amd64"}
+	arm64.Platform = &ocispec.Platform{OS: "linux", Architecture: "arm64"}
+
+	attestationManifest, _ := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    reg.PutBlob("library/app", ocispec.MediaTypeImageConfig, []byte(`{}`)),
+	})
+	attestation := reg.PutManifest("library/app", "", ocispec.MediaTypeImageManifest, attestationManifest)
+	attestation.Annotations = map[string]string{annotationReferenceType: "attestation-manifest"}
+
+	index, _ := json.Marshal(ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{amd64, arm64, attestation},
+	})
+	reg.PutManifest("library/app", "v2", ocispec.MediaTypeImageIndex, index)
+
+	c := newTestConverter(t, reg)
+	result, err := c.Convert(context.Background(), "library/app:v2", "estargz")
+	if err != nil {
+		t.Fatalf("Convert failed: %v", err)
+	}
+	if len(result.Platforms) != 2 {
+		t.Fatalf("expected 2 converted platforms, got %d", len(result.Platforms))
+	}
+
+	payload, mediaType := pulledManifest(t, reg, "library/app", "v2-esgz")
+	if mediaType != ocispec.MediaTypeImageIndex {
+		t.Fatalf("expected index, got %s", mediaType)
+	}
+
+	var converted ocispec.Index
+	json.Unmarshal(payload, &converted)
+	if len(converted.Manifests) != 2 {
+		t.Fatalf("expected 2 manifests in converted index, got %d", len(converted.Manifests))
+	}
+	for i, want := range []string{"amd64", "arm64"} {
+		m := converted.Manifests[i]
+		if m.Platform == nil || m.Platform.Architecture != want {
+			t.Errorf("manifest %d: expected platform %s, got %+v", i, want, m.Platform)
+		}
+		if _, _, ok := reg.Manifest("library/app", m.Digest.String()); !ok {
+			t.Errorf("manifest %d: %s was not pushed", i, m.Digest)
+		}
+	}
+}
+
+func TestConverter_Errors(t *testing.T) {
+	reg := registrytest.New()
+	defer reg.Close()
+	pushTestImage(t, reg, "library/app", "v1", "amd64")
+
+	c := newTestConverter(t, reg)
+	tests := []struct {
+		name   string
+		source string
+		driver string
+	}{
+		{"unknown driver", "library/app:v1", "zstd-chunked"},
+		{"missing image", "library/app:v9", "estargz"},
+		{"other registry", "other.example.com/library/app:v1", "estargz"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := c.Convert(context.Background(), tt.source, tt.driver); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
+
+func TestConverter_Events(t *testing.T) {
+	reg := registrytest.New()
+	defer reg.Close()
+	pushTestImage(t, reg, "library/app", "v1", "amd64")
+
+	client, err := distribution.NewClient(reg.URL())
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	bus := events.NewBus()
+	c := NewConverter(client, WithDriver(drivers.NewEStargz()), WithWorkDir(t.TempDir()), WithEvents(bus))
+
+	var got []events.ConversionCompleted
+	events.SubscribeTo(bus, func(ctx context.Context, e events.ConversionCompleted) {
+		got = append(got, e)
+	}, events.Synchronous())
+
+	result, err := c.Convert(context.Background(), "library/app:v1", "estargz")
+	if err != nil {
+		t.Fatalf("Convert failed: %v", err)
+	}
+	c.Convert(context.Background(), "library/app:v9", "estargz")
+
+	if len(got) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(got))
+	}
+	if got[0].Target != "library/app:v1-esgz" || got[0].Digest != result.Digest.String() || got[0].Error != "" {
+		t.Errorf("unexpected success event: %+v", got[0])
+	}
+	if got[1].Source != "library/app:v9" || got[1].Error == "" {
+		t.Errorf("expected failure event, got %+v", got[1])
+	}
+}
+
+func TestConverter_TargetTag(t *testing.T) {
+	c := NewConverter(nil, WithTagSuffix("nydus", "-rafs"))
+
+	dgst := digest.FromString("image")
+	tests := []struct {
+		ref    distribution.Reference
+		driver string
+		want   string
+	}{
+		{distribution.Reference{Repository: "app", Tag: "v1"}, "estargz", "v1-esgz"},
+		{distribution.Reference{Repository: "app", Tag: "v1"}, "nydus", "v1-rafs"},
+		{distribution.Reference{Repository: "app", Tag: "v1"}, "zstd", "v1-zstd"},
+		{distribution.Reference{Repository: "app", Digest: dgst}, "estargz", fmt.Sprintf("sha256-%s-esgz", dgst.Encoded()[:12])},
+	}
+
+	for _, tt := range tests {
+		if got := c.TargetTag(tt.ref, tt.driver); got != tt.want {
+			t.Errorf("expected %s, got %s", tt.want, got)
+		}
+	}
+}
+
+func TestConverter_BatchConvert(t *testing.T) {
+	reg := registrytest.New()
+	defer reg.Close()
+	pushTestImage(t, reg, "library/app", "v1", "amd64")
+	pushTestImage(t, reg, "library/web", "v1", "amd64")
+
+	bo := registry.NewBatchOperator(2, registry.WithImageConverter(newTestConverter(t, reg)))
+	op, err := bo.ConvertImages(context.Background(), []string{"library/app:v1", "library/web:v1"}, "estargz")
+	if err != nil {
+		t.Fatalf("ConvertImages failed: %v", err)
+	}
+
+	op, err = bo.Wait(context.Background(), op.ID)
+	if err != nil {
+		t.Fatalf("Wait failed: %v", err)
+	}
+	if op.Status != registry.BatchOpCompleted {
+		t.Fatalf("expected completed batch, got %s: %+v", op.Status, op.Results)
+	}
+	for _, repo := range []string{"library/app", "library/web"} {
+		if _, _, ok := reg.Manifest(repo, "v1-esgz"); !ok {
+			t.Errorf("expected %s:v1-esgz to be pushed", repo)
+		}
+	}
+}
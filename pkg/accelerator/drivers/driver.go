@@ -0,0 +1,219 @@
+// Copyright 2021 vjranagit
+//
+// Acceleration driver interface
+
+package drivers
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/vjranagit/harbor/pkg/accelerator/cache"
+	"github.com/vjranagit/harbor/pkg/accelerator/layout"
+)
+
+// Docker media types accepted as conversion input
+const (
+	MediaTypeDockerManifest    = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerConfig      = "application/vnd.docker.container.image.v1+json"
+	MediaTypeDockerLayerGzip   = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	MediaTypeDockerForeignGzip = "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"
+)
+
+// ErrUnsupportedMediaType is returned for manifests or layers a driver
+// cannot convert
+var ErrUnsupportedMediaType = errors.New("unsupported media type")
+
+// Store holds the blobs a driver reads and writes; *layout.Layout
+// implements it
+type Store interface {
+	Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error)
+	Push(ctx context.Context, mediaType string, r io.Reader) (ocispec.Descriptor, error)
+}
+
+// Driver converts images into an accelerated format
+type Driver interface {
+	// Name identifies the driver, e.g. "estargz"
+	Name() string
+	// MediaTypes lists the layer media types the driver accepts
+	MediaTypes() []string
+	// Convert converts the single-platform image manifest described by
+	// manifest, whose blobs are in store, and writes the converted
+	// manifest, config and layers back to store
+	Convert(ctx context.Context, store Store, manifest ocispec.Descriptor) (*Result, error)
+}
+
+// Result describes a converted image
+type Result struct {
+	// Manifest is the converted image manifest
+	Manifest ocispec.Descriptor
+	Layers   []LayerResult
+	Elapsed  time.Duration
+}
+
+// LayerResult describes the conversion of one layer
+type LayerResult struct {
+	Source    ocispec.Descriptor
+	Converted ocispec.Descriptor
+	// Skipped is set when the layer was already in the target format
+	Skipped bool
+	// Cached is set when the layer came from the layer cache
+	Cached  bool
+	Elapsed time.Duration
+}
+
+// image is a decoded source manifest and its config
+type image struct {
+	manifest ocispec.Manifest
+	// config keeps unknown fields so they survive conversion
+	config map[string]json.RawMessage
+	rootfs ocispec.RootFS
+}
+
+// readImage loads a manifest and its config from store
+func readImage(ctx context.Context, store Store, desc ocispec.Descriptor) (*image, error) {
+	switch desc.MediaType {
+	case ocispec.MediaTypeImageManifest, MediaTypeDockerManifest:
+	default:
+		return nil, fmt.Errorf("%w: manifest %s", ErrUnsupportedMediaType, desc.MediaType)
+	}
+
+	img := &image{}
+	if err := layout.ReadJSON(ctx, store, desc, &img.manifest); err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	if err := layout.ReadJSON(ctx, store, img.manifest.Config, &img.config); err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	if raw, ok := img.config["rootfs"]; ok {
+		if err := json.Unmarshal(raw, &img.rootfs); err != nil {
+			return nil, fmt.Errorf("invalid rootfs in config: %w", err)
+		}
+	}
+	if len(img.rootfs.DiffIDs) != len(img.manifest.Layers) {
+		return nil, fmt.Errorf("config lists %d diff IDs for %d layers", len(img.rootfs.DiffIDs), len(img.manifest.Layers))
+	}
+	return img, nil
+}
+
+// writeImage stores the config and an OCI manifest referencing layers and
+// returns the manifest descriptor
+func writeImage(ctx context.Context, store Store, img *image, layers []ocispec.Descriptor, annotations map[string]string) (ocispec.Descriptor, error) {
+	rootfs, err := json.Marshal(img.rootfs)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	img.config["rootfs"] = rootfs
+
+	configDesc, err := pushJSON(ctx, store, ocispec.MediaTypeImageConfig, img.config)
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("failed to write config: %w", err)
+	}
+
+	manifest := img.manifest
+	manifest.MediaType = ocispec.MediaTypeImageManifest
+	manifest.Config = configDesc
+	manifest.Layers = layers
+	if len(annotations) > 0 {
+		merged := make(map[string]string, len(manifest.Annotations)+len(annotations))
+		for k, v := range manifest.Annotations {
+			merged[k] = v
+		}
+		for k, v := range annotations {
+			merged[k] = v
+		}
+		manifest.Annotations = merged
+	}
+
+	desc, err := pushJSON(ctx, store, ocispec.MediaTypeImageManifest, manifest)
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return desc, nil
+}
+
+// pushJSON encodes v and stores it
+func pushJSON(ctx context.Context, store Store, mediaType string, v interface{}) (ocispec.Descriptor, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	return store.Push(ctx, mediaType, bytes.NewReader(data))
+}
+
+// supports reports whether mediaType is one of the driver's input types
+func supports(d Driver, mediaType string) bool {
+	for _, mt := range d.MediaTypes() {
+		if mt == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// uncompressed rewinds a spooled layer and returns its tar content,
+// decompressing gzip when needed
+func uncompressed(f *os.File) (io.ReadCloser, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(f)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(br)
+	}
+	return io.NopCloser(br), nil
+}
+
+// restoreLayer copies a cached conversion of a layer into store. It
+// reports false on a miss or when the cached blob cannot be used
+func restoreLayer(ctx context.Context, c *cache.Cache, store Store, key cache.Key, logger *slog.Logger) (ocispec.Descriptor, digest.Digest, bool) {
+	if c == nil {
+		return ocispec.Descriptor{}, "", false
+	}
+
+	entry, blob, err := c.Get(key)
+	if err != nil {
+		if !errors.Is(err, cache.ErrMiss) {
+			logger.WarnContext(ctx, "layer cache lookup failed", "source", key.Source, "error", err)
+		}
+		return ocispec.Descriptor{}, "", false
+	}
+	defer blob.Close()
+
+	desc, err := store.Push(ctx, entry.Blob.MediaType, blob)
+	if err != nil {
+		logger.WarnContext(ctx, "failed to restore cached layer", "source", key.Source, "error", err)
+		return ocispec.Descriptor{}, "", false
+	}
+	desc.Annotations = entry.Blob.Annotations
+	return desc, entry.DiffID, true
+}
+
+// cacheLayer records a converted layer from store in the cache. Failures
+// are logged, since they only cost a later reconversion
+func cacheLayer(ctx context.Context, c *cache.Cache, store Store, key cache.Key, desc ocispec.Descriptor, diffID digest.Digest, logger *slog.Logger) {
+	if c == nil {
+		return
+	}
+
+	rc, err := store.Fetch(ctx, desc)
+	if err == nil {
+		_, err = c.Put(key, desc, diffID, rc)
+		rc.Close()
+	}
+	if err != nil {
+		logger.WarnContext(ctx, "failed to cache converted layer", "source", key.Source, "error", err)
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2021 vjranagit
+//
+// Shared driver test helpers
+
+package drivers
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"sort"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/vjranagit/harbor/pkg/accelerator/layout"
+)
+
+// buildTar creates an uncompressed tar archive of files
+func buildTar(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range names {
+		hdr := &tar.Header{Name: name, Mode: 0o644, Size: int64(len(files[name])), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("tar header failed: %v", err)
+		}
+		if _, err := tw.Write([]byte(files[name])); err != nil {
+			t.Fatalf("tar write failed: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("tar close failed: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// newTestImage stores a single-platform image with one gzip layer per file
+// set and returns its manifest descriptor
+func newTestImage(t *testing.T, store *layout.Layout, layers ...map[string]string) ocispec.Descriptor {
+	t.Helper()
+	ctx := context.Background()
+
+	var descs []ocispec.Descriptor
+	var diffIDs []digest.Digest
+	for _, files := range layers {
+		raw := buildTar(t, files)
+		diffIDs = append(diffIDs, digest.FromBytes(raw))
+
+		var gz bytes.Buffer
+		zw := gzip.NewWriter(&gz)
+		zw.Write(raw)
+		zw.Close()
+
+		desc, err := store.Push(ctx, ocispec.MediaTypeImageLayerGzip, &gz)
+		if err != nil {
+			t.Fatalf("push layer failed: %v", err)
+		}
+		descs = append(descs, desc)
+	}
+
+	config := ocispec.Image{
+		Platform: ocispec.Platform{OS: "linux", Architecture: "amd64"},
+		Config:   ocispec.ImageConfig{Entrypoint: []string{"/app"}},
+		RootFS:   ocispec.RootFS{Type: "layers", DiffIDs: diffIDs},
+	}
+	configDesc := pushTestJSON(t, store, ocispec.MediaTypeImageConfig, config)
+
+	manifest := ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    configDesc,
+		Layers:    descs,
+	}
+	return pushTestJSON(t, store, ocispec.MediaTypeImageManifest, manifest)
+}
+
+func pushTestJSON(t *testing.T, store *layout.Layout, mediaType string, v interface{}) ocispec.Descriptor {
+	t.Helper()
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("marshal failed: %v", err)
+	}
+	desc, err := store.Push(context.Background(), mediaType, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("push failed: %v", err)
+	}
+	return desc
+}
+
+// readTestBlob returns the content of a blob
+func readTestBlob(t *testing.T, store *layout.Layout, desc ocispec.Descriptor) []byte {
+	t.Helper()
+
+	rc, err := store.Fetch(context.Background(), desc)
+	if err != nil {
+		t.Fatalf("fetch %s failed: %v", desc.Digest, err)
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("read %s failed: %v", desc.Digest, err)
+	}
+	return data
+}
+
+// readTestImage decodes a converted manifest and its config
+func readTestImage(t *testing.T, store *layout.Layout, desc ocispec.Descriptor) (ocispec.Manifest, ocispec.Image) {
+	t.Helper()
+	ctx := context.Background()
+
+	var manifest ocispec.Manifest
+	if err := layout.ReadJSON(ctx, store, desc, &manifest); err != nil {
+		t.Fatalf("read manifest failed: %v", err)
+	}
+	var config ocispec.Image
+	if err := layout.ReadJSON(ctx, store, manifest.Config, &config); err != nil {
+		t.Fatalf("read config failed: %v", err)
+	}
+	return manifest, config
+}
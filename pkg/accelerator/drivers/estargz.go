@@ -0,0 +1,408 @@
+// Copyright 2021 vjranagit
+//
+// eStargz conversion driver
+
+package drivers
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/vjranagit/harbor/pkg/accelerator/cache"
+)
+
+// EStargz rewrites gzip or plain tar layers into seekable eStargz blobs
+// with a table of contents, so runtimes can lazily pull files. Files listed
+// as prioritized are placed before a prefetch landmark and fetched first
+type EStargz struct {
+	chunkSize        int
+	compressionLevel int
+	prioritized      []string
+	cache            *cache.Cache
+	logger           *slog.Logger
+}
+
+// EStargzOption configures the eStargz driver
+type EStargzOption func(*EStargz)
+
+// WithChunkSize sets the size files are split into for lazy fetching
+func WithChunkSize(size int) EStargzOption {
+	return func(d *EStargz) {
+		d.chunkSize = size
+	}
+}
+
+// WithCompressionLevel sets the gzip compression level
+func WithCompressionLevel(level int) EStargzOption {
+	return func(d *EStargz) {
+		d.compressionLevel = level
+	}
+}
+
+// WithPrioritizedFiles lists files, in access order, to place before the
+// prefetch landmark. Files missing from a layer are ignored
+func WithPrioritizedFiles(files []string) EStargzOption {
+	return func(d *EStargz) {
+		d.prioritized = files
+	}
+}
+
+// WithLayerCache reuses converted layers from c and stores new ones in it
+func WithLayerCache(c *cache.Cache) EStargzOption {
+	return func(d *EStargz) {
+		d.cache = c
+	}
+}
+
+// NewEStargz creates an eStargz driver
+func NewEStargz(opts ...EStargzOption) *EStargz {
+	d := &EStargz{
+		compressionLevel: gzip.BestCompression,
+		logger:           slog.Default().With("component", "estargz"),
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// Name returns "estargz"
+func (d *EStargz) Name() string {
+	return "estargz"
+}
+
+// MediaTypes returns the accepted layer media types
+func (d *EStargz) MediaTypes() []string {
+	return []string{
+		ocispec.MediaTypeImageLayerGzip,
+		ocispec.MediaTypeImageLayer,
+		MediaTypeDockerLayerGzip,
+	}
+}
+
+// Convert rewrites every layer of the manifest into eStargz. Layers that
+// already carry a TOC digest are kept, as are non-distributable layers
+func (d *EStargz) Convert(ctx context.Context, store Store, manifest ocispec.Descriptor) (*Result, error) {
+	start := time.Now()
+
+	img, err := readImage(ctx, store, manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{}
+	layers := make([]ocispec.Descriptor, len(img.manifest.Layers))
+	for i, layer := range img.manifest.Layers {
+		layerStart := time.Now()
+
+		if isForeign(layer.MediaType) || layer.Annotations[estargz.TOCJSONDigestAnnotation] != "" {
+			layers[i] = layer
+			result.Layers = append(result.Layers, LayerResult{
+				Source:    layer,
+				Converted: layer,
+				Skipped:   true,
+				Elapsed:   time.Since(layerStart),
+			})
+			continue
+		}
+		if !supports(d, layer.MediaType) {
+			return nil, fmt.Errorf("%w: layer %s is %s", ErrUnsupportedMediaType, layer.Digest, layer.MediaType)
+		}
+
+		key := cache.Key{Source: layer.Digest, Driver: d.Name(), Options: d.fingerprint()}
+		converted, diffID, cached := restoreLayer(ctx, d.cache, store, key, d.logger)
+		if !cached {
+			converted, diffID, err = d.convertLayer(ctx, store, layer)
+			if err != nil {
+				return nil, fmt.Errorf("failed to convert layer %s: %w", layer.Digest, err)
+			}
+			cacheLayer(ctx, d.cache, store, key, converted, diffID, d.logger)
+		}
+		layers[i] = converted
+		img.rootfs.DiffIDs[i] = diffID
+
+		elapsed := time.Since(layerStart)
+		d.logger.DebugContext(ctx, "layer converted",
+			"source", layer.Digest,
+			"converted", converted.Digest,
+			"size", converted.Size,
+			"cached", cached,
+			"elapsed", elapsed)
+
+		result.Layers = append(result.Layers, LayerResult{
+			Source:    layer,
+			Converted: converted,
+			Cached:    cached,
+			Elapsed:   elapsed,
+		})
+	}
+
+	result.Manifest, err = writeImage(ctx, store, img, layers, nil)
+	if err != nil {
+		return nil, err
+	}
+	result.Elapsed = time.Since(start)
+
+	d.logger.InfoContext(ctx, "image converted",
+		"source", manifest.Digest,
+		"converted", result.Manifest.Digest,
+		"layers", len(layers),
+		"elapsed", result.Elapsed)
+
+	return result, nil
+}
+
+// fingerprint identifies the settings that shape the converted layers
+func (d *EStargz) fingerprint() string {
+	prioritized := digest.FromString(strings.Join(d.prioritized, "\n")).Encoded()[:12]
+	return fmt.Sprintf("chunk=%d level=%d prioritized=%s", d.chunkSize, d.compressionLevel, prioritized)
+}
+
+// convertLayer builds one eStargz blob and returns its descriptor and the
+// digest of its uncompressed content
+func (d *EStargz) convertLayer(ctx context.Context, store Store, layer ocispec.Descriptor) (ocispec.Descriptor, digest.Digest, error) {
+	// estargz.Build needs random access, so spool the source to disk
+	src, err := spool(ctx, store, layer)
+	if err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+	defer os.Remove(src.Name())
+	defer src.Close()
+
+	info, err := src.Stat()
+	if err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+
+	opts := []estargz.Option{
+		estargz.WithContext(ctx),
+		estargz.WithCompression(newGzipCompression(d.compressionLevel)),
+		estargz.WithChunkSize(d.chunkSize),
+	}
+
+	// Only files present in this layer get a prefetch landmark; a layer
+	// without any is marked as not worth prefetching
+	if len(d.prioritized) > 0 {
+		prioritized, err := presentFiles(src, d.prioritized)
+		if err != nil {
+			return ocispec.Descriptor{}, "", err
+		}
+		if len(prioritized) > 0 {
+			// Tolerate parent directories without their own tar entry
+			var missed []string
+			opts = append(opts,
+				estargz.WithPrioritizedFiles(prioritized),
+				estargz.WithAllowPrioritizeNotFound(&missed))
+		}
+	}
+
+	blob, err := estargz.Build(io.NewSectionReader(src, 0, info.Size()), opts...)
+	if err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+	defer blob.Close()
+
+	// Count the uncompressed size while the blob is stored
+	counter := &uncompressedCounter{}
+	pr, pw := io.Pipe()
+	counted := make(chan error, 1)
+	go func() {
+		counted <- counter.consume(pr)
+	}()
+
+	desc, err := store.Push(ctx, ocispec.MediaTypeImageLayerGzip, io.TeeReader(blob, pw))
+	pw.CloseWithError(err)
+	if countErr := <-counted; err == nil {
+		err = countErr
+	}
+	if err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+	desc.Annotations = map[string]string{
+		estargz.TOCJSONDigestAnnotation:         blob.TOCDigest().String(),
+		estargz.StoreUncompressedSizeAnnotation: strconv.FormatInt(counter.size, 10),
+	}
+	return desc, blob.DiffID(), nil
+}
+
+// spool copies a blob into a temporary file
+func spool(ctx context.Context, store Store, desc ocispec.Descriptor) (*os.File, error) {
+	rc, err := store.Fetch(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	f, err := os.CreateTemp("", "harbor-layer-*")
+	if err != nil {
+		return nil, err
+	}
+
+	verifier := desc.Digest.Verifier()
+	if _, err := io.Copy(io.MultiWriter(f, verifier), rc); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	if !verifier.Verified() {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, fmt.Errorf("digest mismatch for %s", desc.Digest)
+	}
+	return f, nil
+}
+
+// presentFiles returns the names from files that exist in the tar or
+// gzipped tar layer f, keeping their order
+func presentFiles(f *os.File, files []string) ([]string, error) {
+	r, err := uncompressed(f)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	names := make(map[string]bool)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read layer: %w", err)
+		}
+		names[cleanName(hdr.Name)] = true
+	}
+
+	var present []string
+	for _, name := range files {
+		if names[cleanName(name)] {
+			present = append(present, name)
+		}
+	}
+	return present, nil
+}
+
+// cleanName normalizes a tar entry name the way estargz does
+func cleanName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// uncompressedCounter measures the decompressed size of a gzip stream
+type uncompressedCounter struct {
+	size int64
+}
+
+func (c *uncompressedCounter) consume(r io.Reader) error {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		io.Copy(io.Discard, r)
+		return err
+	}
+	c.size, err = io.Copy(io.Discard, zr)
+	// Keep draining so the writer side never blocks
+	io.Copy(io.Discard, r)
+	return err
+}
+
+// isForeign reports whether a layer must not be redistributed
+func isForeign(mediaType string) bool {
+	switch mediaType {
+	case MediaTypeDockerForeignGzip,
+		ocispec.MediaTypeImageLayerNonDistributable,
+		ocispec.MediaTypeImageLayerNonDistributableGzip:
+		return true
+	}
+	return false
+}
+
+// gzipCompression is the estargz gzip compression with the footer written
+// byte for byte. estargz builds its 51 byte footer by closing an empty
+// NoCompression gzip stream, which newer Go releases encode in fewer bytes
+type gzipCompression struct {
+	*estargz.GzipCompressor
+	*estargz.GzipDecompressor
+	level int
+}
+
+func newGzipCompression(level int) *gzipCompression {
+	return &gzipCompression{
+		GzipCompressor:   estargz.NewGzipCompressorWithLevel(level),
+		GzipDecompressor: &estargz.GzipDecompressor{},
+		level:            level,
+	}
+}
+
+// WriteTOCAndFooter writes the TOC as a gzip member holding a single tar
+// entry, followed by the footer
+func (c *gzipCompression) WriteTOCAndFooter(w io.Writer, off int64, toc *estargz.JTOC, diffHash hash.Hash) (digest.Digest, error) {
+	tocJSON, err := json.MarshalIndent(toc, "", "\t")
+	if err != nil {
+		return "", err
+	}
+
+	zw, err := gzip.NewWriterLevel(w, c.level)
+	if err != nil {
+		return "", err
+	}
+	gw := io.Writer(zw)
+	if diffHash != nil {
+		gw = io.MultiWriter(zw, diffHash)
+	}
+
+	tw := tar.NewWriter(gw)
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     estargz.TOCTarName,
+		Size:     int64(len(tocJSON)),
+	}); err != nil {
+		return "", err
+	}
+	if _, err := tw.Write(tocJSON); err != nil {
+		return "", err
+	}
+	if err := tw.Close(); err != nil {
+		return "", err
+	}
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+
+	if _, err := w.Write(gzipFooter(off)); err != nil {
+		return "", err
+	}
+	return digest.FromBytes(tocJSON), nil
+}
+
+// gzipFooter encodes the eStargz footer: an empty gzip member whose extra
+// field carries the TOC offset
+func gzipFooter(tocOffset int64) []byte {
+	subfield := fmt.Sprintf("%016xSTARGZ", tocOffset)
+
+	footer := make([]byte, 0, estargz.FooterSize)
+	// Header: magic, deflate, FEXTRA, no mtime, no extra flags, unknown OS
+	footer = append(footer, 0x1f, 0x8b, 8, 4, 0, 0, 0, 0, 0, 0xff)
+	footer = binary.LittleEndian.AppendUint16(footer, uint16(4+len(subfield)))
+	footer = append(footer, 'S', 'G')
+	footer = binary.LittleEndian.AppendUint16(footer, uint16(len(subfield)))
+	footer = append(footer, subfield...)
+	// Final empty stored block, then CRC-32 and size of no data
+	footer = append(footer, 1, 0, 0, 0xff, 0xff)
+	footer = append(footer, 0, 0, 0, 0, 0, 0, 0, 0)
+	return footer
+}
@@ -0,0 +1,207 @@
+// Copyright 2021 vjranagit
+//
+// eStargz driver tests
+
+package drivers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"strconv"
+	"testing"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/vjranagit/harbor/pkg/accelerator/cache"
+	"github.com/vjranagit/harbor/pkg/accelerator/layout"
+)
+
+func TestEStargz_Convert(t *testing.T) {
+	store, err := layout.New(t.TempDir())
+	if err != nil {
+		t.Fatalf("layout.New failed: %v", err)
+	}
+
+	source := newTestImage(t, store,
+		map[string]string{"etc/os-release": "ID=test\n", "bin/sh": "#!/bin/true\n"},
+		map[string]string{"app/main": "binary", "app/config.yaml": "debug: false\n"},
+	)
+
+	driver := NewEStargz(WithPrioritizedFiles([]string{"app/main"}))
+	result, err := driver.Convert(context.Background(), store, source)
+	if err != nil {
+		t.Fatalf("Convert failed: %v", err)
+	}
+
+	if len(result.Layers) != 2 {
+		t.Fatalf("expected 2 layer results, got %d", len(result.Layers))
+	}
+
+	manifest, config := readTestImage(t, store, result.Manifest)
+	if manifest.MediaType != ocispec.MediaTypeImageManifest {
+		t.Errorf("expected OCI manifest, got %s", manifest.MediaType)
+	}
+	if len(config.Config.Entrypoint) != 1 || config.Config.Entrypoint[0] != "/app" {
+		t.Errorf("expected config to be preserved, got %+v", config.Config)
+	}
+
+	for i, layer := range manifest.Layers {
+		data := readTestBlob(t, store, layer)
+
+		r, err := estargz.Open(io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))))
+		if err != nil {
+			t.Fatalf("layer %d is not eStargz: %v", i, err)
+		}
+		if got := r.TOCDigest().String(); got != layer.Annotations[estargz.TOCJSONDigestAnnotation] {
+			t.Errorf("layer %d: expected TOC digest annotation %s, got %s", i, got, layer.Annotations[estargz.TOCJSONDigestAnnotation])
+		}
+
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("gzip failed: %v", err)
+		}
+		raw, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatalf("gunzip failed: %v", err)
+		}
+		if got := digest.FromBytes(raw); got != config.RootFS.DiffIDs[i] {
+			t.Errorf("layer %d: expected diff ID %s, got %s", i, got, config.RootFS.DiffIDs[i])
+		}
+		if got := layer.Annotations[estargz.StoreUncompressedSizeAnnotation]; got != strconv.Itoa(len(raw)) {
+			t.Errorf("layer %d: expected uncompressed size %d, got %s", i, len(raw), got)
+		}
+	}
+
+	// The second layer holds the prioritized file and gets a prefetch landmark
+	data := readTestBlob(t, store, manifest.Layers[1])
+	r, err := estargz.Open(io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))))
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	if _, ok := r.Lookup(estargz.PrefetchLandmark); !ok {
+		t.Error("expected prefetch landmark in layer with prioritized files")
+	}
+	if _, ok := r.Lookup("app/config.yaml"); !ok {
+		t.Error("expected app/config.yaml in converted layer")
+	}
+
+	data = readTestBlob(t, store, manifest.Layers[0])
+	r, err = estargz.Open(io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))))
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	if _, ok := r.Lookup(estargz.NoPrefetchLandmark); !ok {
+		t.Error("expected no-prefetch landmark in layer without prioritized files")
+	}
+}
+
+func TestEStargz_SkipsConvertedLayers(t *testing.T) {
+	store, err := layout.New(t.TempDir())
+	if err != nil {
+		t.Fatalf("layout.New failed: %v", err)
+	}
+
+	source := newTestImage(t, store, map[string]string{"a": "a"})
+	driver := NewEStargz()
+
+	first, err := driver.Convert(context.Background(), store, source)
+	if err != nil {
+		t.Fatalf("Convert failed: %v", err)
+	}
+	second, err := driver.Convert(context.Background(), store, first.Manifest)
+	if err != nil {
+		t.Fatalf("second Convert failed: %v", err)
+	}
+
+	if !second.Layers[0].Skipped {
+		t.Error("expected already converted layer to be skipped")
+	}
+	if second.Manifest.Digest != first.Manifest.Digest {
+		t.Errorf("expected reconversion to be a no-op, got %s != %s", second.Manifest.Digest, first.Manifest.Digest)
+	}
+}
+
+func TestEStargz_LayerCache(t *testing.T) {
+	c, err := cache.Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("cache.Open failed: %v", err)
+	}
+
+	convert := func(driver *EStargz) *Result {
+		t.Helper()
+		store, err := layout.New(t.TempDir())
+		if err != nil {
+			t.Fatalf("layout.New failed: %v", err)
+		}
+		source := newTestImage(t, store, map[string]string{"app/main": "binary"})
+
+		result, err := driver.Convert(context.Background(), store, source)
+		if err != nil {
+			t.Fatalf("Convert failed: %v", err)
+		}
+		readTestImage(t, store, result.Manifest)
+		readTestBlob(t, store, result.Layers[0].Converted)
+		return result
+	}
+
+	driver := NewEStargz(WithLayerCache(c))
+	first := convert(driver)
+	second := convert(driver)
+
+	if first.Layers[0].Cached || !second.Layers[0].Cached {
+		t.Errorf("expected a miss then a hit, got %v and %v", first.Layers[0].Cached, second.Layers[0].Cached)
+	}
+	if first.Manifest.Digest != second.Manifest.Digest {
+		t.Errorf("expected identical images, got %s and %s", first.Manifest.Digest, second.Manifest.Digest)
+	}
+
+	// Different settings produce different blobs
+	if other := convert(NewEStargz(WithLayerCache(c), WithCompressionLevel(gzip.BestSpeed))); other.Layers[0].Cached {
+		t.Error("expected a miss for another compression level")
+	}
+
+	stats := c.Stats()
+	if stats.Hits != 1 || stats.Misses != 2 || stats.Entries != 2 {
+		t.Errorf("unexpected cache stats: %+v", stats)
+	}
+}
+
+func TestEStargz_UnsupportedManifest(t *testing.T) {
+	store, err := layout.New(t.TempDir())
+	if err != nil {
+		t.Fatalf("layout.New failed: %v", err)
+	}
+
+	index := pushTestJSON(t, store, ocispec.MediaTypeImageIndex, ocispec.Index{MediaType: ocispec.MediaTypeImageIndex})
+	_, err = NewEStargz().Convert(context.Background(), store, index)
+	if !errors.Is(err, ErrUnsupportedMediaType) {
+		t.Errorf("expected ErrUnsupportedMediaType, got %v", err)
+	}
+}
+
+func TestGzipFooter(t *testing.T) {
+	footer := gzipFooter(0x1234)
+	if len(footer) != estargz.FooterSize {
+		t.Fatalf("expected %d byte footer, got %d", estargz.FooterSize, len(footer))
+	}
+
+	_, offset, _, err := (&estargz.GzipDecompressor{}).ParseFooter(footer)
+	if err != nil {
+		t.Fatalf("ParseFooter failed: %v", err)
+	}
+	if offset != 0x1234 {
+		t.Errorf("expected TOC offset 0x1234, got %#x", offset)
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(footer))
+	if err != nil {
+		t.Fatalf("footer is not valid gzip: %v", err)
+	}
+	if data, err := io.ReadAll(zr); err != nil || len(data) != 0 {
+		t.Errorf("expected empty gzip member, got %d bytes, err %v", len(data), err)
+	}
+}
@@ -0,0 +1,413 @@
+// Copyright 2021 vjranagit
+//
+// Nydus RAFS conversion driver
+
+package drivers
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/vjranagit/harbor/pkg/accelerator/cache"
+)
+
+// Nydus media types and annotations understood by the nydus snapshotter
+const (
+	MediaTypeNydusBlob = "application/vnd.oci.image.layer.nydus.blob.v1"
+
+	AnnotationNydusBlob         = "containerd.io/snapshot/nydus-blob"
+	AnnotationNydusBootstrap    = "containerd.io/snapshot/nydus-bootstrap"
+	AnnotationNydusFsVersion    = "containerd.io/snapshot/nydus-fs-version"
+	AnnotationNydusSourceDigest = "containerd.io/snapshot/nydus-source-digest"
+
+	// nydusBootstrapPath is where the bootstrap lives inside its layer
+	nydusBootstrapPath = "image/image.boot"
+)
+
+// ErrBuilderNotFound is returned when the nydus-image binary is missing
+var ErrBuilderNotFound = errors.New("nydus-image binary not found")
+
+// Nydus converts layers into RAFS v6 blobs plus a merged bootstrap layer by
+// running a locally installed nydus-image builder
+type Nydus struct {
+	builder    string
+	compressor string
+	chunkSize  string
+	workDir    string
+	cache      *cache.Cache
+	logger     *slog.Logger
+}
+
+// NydusOption configures the Nydus driver
+type NydusOption func(*Nydus)
+
+// WithBuilderPath sets the nydus-image binary; by default it is looked up
+// in PATH
+func WithBuilderPath(path string) NydusOption {
+	return func(d *Nydus) {
+		d.builder = path
+	}
+}
+
+// WithNydusCompressor sets the blob compressor (none, lz4_block or zstd)
+func WithNydusCompressor(compressor string) NydusOption {
+	return func(d *Nydus) {
+		d.compressor = compressor
+	}
+}
+
+// WithNydusChunkSize sets the RAFS chunk size, e.g. "0x100000"
+func WithNydusChunkSize(size string) NydusOption {
+	return func(d *Nydus) {
+		d.chunkSize = size
+	}
+}
+
+// WithWorkDir sets where intermediate files are written
+func WithWorkDir(dir string) NydusOption {
+	return func(d *Nydus) {
+		d.workDir = dir
+	}
+}
+
+// WithNydusLayerCache reuses converted layers from c and stores new ones
+// in it
+func WithNydusLayerCache(c *cache.Cache) NydusOption {
+	return func(d *Nydus) {
+		d.cache = c
+	}
+}
+
+// NewNydus creates a Nydus driver
+func NewNydus(opts ...NydusOption) *Nydus {
+	d := &Nydus{
+		builder:    "nydus-image",
+		compressor: "zstd",
+		logger:     slog.Default().With("component", "nydus"),
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// Name returns "nydus"
+func (d *Nydus) Name() string {
+	return "nydus"
+}
+
+// MediaTypes returns the accepted layer media types
+func (d *Nydus) MediaTypes() []string {
+	return []string{
+		ocispec.MediaTypeImageLayerGzip,
+		ocispec.MediaTypeImageLayer,
+		MediaTypeDockerLayerGzip,
+	}
+}
+
+// Convert builds one RAFS v6 blob per layer, merges the per-layer
+// bootstraps and appends the result as the final layer. Images that are
+// already Nydus are returned unchanged
+func (d *Nydus) Convert(ctx context.Context, store Store, manifest ocispec.Descriptor) (*Result, error) {
+	start := time.Now()
+
+	img, err := readImage(ctx, store, manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	if isNydus(img.manifest) {
+		result := &Result{Manifest: manifest}
+		for _, layer := range img.manifest.Layers {
+			result.Layers = append(result.Layers, LayerResult{Source: layer, Converted: layer, Skipped: true})
+		}
+		return result, nil
+	}
+
+	builder, err := exec.LookPath(d.builder)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrBuilderNotFound, d.builder)
+	}
+
+	work, err := os.MkdirTemp(d.workDir, "harbor-nydus-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(work)
+
+	result := &Result{}
+	var layers []ocispec.Descriptor
+	var bootstraps []string
+	for i, layer := range img.manifest.Layers {
+		layerStart := time.Now()
+
+		if isForeign(layer.MediaType) || !supports(d, layer.MediaType) {
+			return nil, fmt.Errorf("%w: layer %s is %s", ErrUnsupportedMediaType, layer.Digest, layer.MediaType)
+		}
+
+		bootstrap := filepath.Join(work, fmt.Sprintf("layer-%d.boot", i))
+		key := cache.Key{Source: layer.Digest, Driver: d.Name(), Options: d.fingerprint()}
+		blob, cached := d.restoreLayer(ctx, store, key, bootstrap)
+		if !cached {
+			blob, err = d.buildLayer(ctx, builder, store, layer, work, i, bootstrap)
+			if err != nil {
+				return nil, fmt.Errorf("failed to convert layer %s: %w", layer.Digest, err)
+			}
+			d.cacheLayer(ctx, store, key, blob, bootstrap)
+		}
+		bootstraps = append(bootstraps, bootstrap)
+
+		// Nydus blobs are not compressed as a whole, so the diff ID is the
+		// blob digest itself
+		layers = append(layers, blob)
+		img.rootfs.DiffIDs[i] = blob.Digest
+
+		elapsed := time.Since(layerStart)
+		d.logger.DebugContext(ctx, "layer converted",
+			"source", layer.Digest,
+			"converted", blob.Digest,
+			"size", blob.Size,
+			"cached", cached,
+			"elapsed", elapsed)
+
+		result.Layers = append(result.Layers, LayerResult{
+			Source:    layer,
+			Converted: blob,
+			Cached:    cached,
+			Elapsed:   elapsed,
+		})
+	}
+
+	merged := filepath.Join(work, "image.boot")
+	args := append([]string{"merge", "--bootstrap", merged, "--log-level", "warn"}, bootstraps...)
+	if err := d.run(ctx, builder, args...); err != nil {
+		return nil, fmt.Errorf("failed to merge bootstraps: %w", err)
+	}
+
+	bootstrapLayer, diffID, err := pushBootstrap(ctx, store, merged)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store bootstrap: %w", err)
+	}
+	layers = append(layers, bootstrapLayer)
+	img.rootfs.DiffIDs = append(img.rootfs.DiffIDs, diffID)
+
+	result.Manifest, err = writeImage(ctx, store, img, layers, map[string]string{
+		AnnotationNydusSourceDigest: manifest.Digest.String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.Elapsed = time.Since(start)
+
+	d.logger.InfoContext(ctx, "image converted",
+		"source", manifest.Digest,
+		"converted", result.Manifest.Digest,
+		"layers", len(layers),
+		"elapsed", result.Elapsed)
+
+	return result, nil
+}
+
+// fingerprint identifies the settings that shape the converted layers
+func (d *Nydus) fingerprint() string {
+	return fmt.Sprintf("fs=6 compressor=%s chunk=%s", d.compressor, d.chunkSize)
+}
+
+// bootstrapKey is the cache key of a layer's own bootstrap, which the
+// merge step needs next to the blob
+func bootstrapKey(key cache.Key) cache.Key {
+	key.Options += " bootstrap"
+	return key
+}
+
+// restoreLayer restores a cached blob into store and its bootstrap to the
+// bootstrap path, reporting false unless both are cached
+func (d *Nydus) restoreLayer(ctx context.Context, store Store, key cache.Key, bootstrap string) (ocispec.Descriptor, bool) {
+	if d.cache == nil {
+		return ocispec.Descriptor{}, false
+	}
+
+	_, boot, err := d.cache.Get(bootstrapKey(key))
+	if err != nil {
+		return ocispec.Descriptor{}, false
+	}
+	err = writeFile(bootstrap, boot)
+	boot.Close()
+	if err != nil {
+		d.logger.WarnContext(ctx, "failed to restore cached bootstrap", "source", key.Source, "error", err)
+		return ocispec.Descriptor{}, false
+	}
+
+	blob, _, ok := restoreLayer(ctx, d.cache, store, key, d.logger)
+	return blob, ok
+}
+
+// cacheLayer records a converted blob and its bootstrap in the cache
+func (d *Nydus) cacheLayer(ctx context.Context, store Store, key cache.Key, blob ocispec.Descriptor, bootstrap string) {
+	if d.cache == nil {
+		return
+	}
+
+	f, err := os.Open(bootstrap)
+	if err == nil {
+		_, err = d.cache.Put(bootstrapKey(key), ocispec.Descriptor{}, "", f)
+		f.Close()
+	}
+	if err != nil {
+		d.logger.WarnContext(ctx, "failed to cache bootstrap", "source", key.Source, "error", err)
+		return
+	}
+	cacheLayer(ctx, d.cache, store, key, blob, blob.Digest, d.logger)
+}
+
+// buildLayer unpacks a layer to a plain tar and runs the RAFS builder on it
+func (d *Nydus) buildLayer(ctx context.Context, builder string, store Store, layer ocispec.Descriptor, work string, i int, bootstrap string) (ocispec.Descriptor, error) {
+	src, err := spool(ctx, store, layer)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	defer os.Remove(src.Name())
+	defer src.Close()
+
+	tarPath := filepath.Join(work, fmt.Sprintf("layer-%d.tar", i))
+	if err := decompressTo(src, tarPath); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	defer os.Remove(tarPath)
+
+	blobPath := filepath.Join(work, fmt.Sprintf("layer-%d.blob", i))
+	args := []string{
+		"create",
+		"--type", "tar-rafs",
+		"--fs-version", "6",
+		"--compressor", d.compressor,
+		"--bootstrap", bootstrap,
+		"--blob", blobPath,
+		"--log-level", "warn",
+	}
+	if d.chunkSize != "" {
+		args = append(args, "--chunk-size", d.chunkSize)
+	}
+	args = append(args, tarPath)
+
+	if err := d.run(ctx, builder, args...); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	f, err := os.Open(blobPath)
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("builder produced no blob: %w", err)
+	}
+	defer os.Remove(blobPath)
+	defer f.Close()
+
+	desc, err := store.Push(ctx, MediaTypeNydusBlob, f)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	desc.Annotations = map[string]string{
+		AnnotationNydusBlob: "true",
+	}
+	return desc, nil
+}
+
+// run executes the builder, returning its output on failure
+func (d *Nydus) run(ctx context.Context, builder string, args ...string) error {
+	cmd := exec.CommandContext(ctx, builder, args...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %w: %s", filepath.Base(builder), args[0], err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// pushBootstrap wraps the merged bootstrap in a gzip tar layer and returns
+// it with the digest of the uncompressed tar
+func pushBootstrap(ctx context.Context, store Store, path string) (ocispec.Descriptor, digest.Digest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+
+	var raw bytes.Buffer
+	tw := tar.NewWriter(&raw)
+	if err := tw.WriteHeader(&tar.Header{Name: "image/", Typeflag: tar.TypeDir, Mode: 0o755}); err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     nydusBootstrapPath,
+		Typeflag: tar.TypeReg,
+		Mode:     0o444,
+		Size:     int64(len(data)),
+	}); err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+	if err := tw.Close(); err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+	diffID := digest.FromBytes(raw.Bytes())
+
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	if _, err := zw.Write(raw.Bytes()); err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+	if err := zw.Close(); err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+
+	desc, err := store.Push(ctx, ocispec.MediaTypeImageLayerGzip, &compressed)
+	if err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+	desc.Annotations = map[string]string{
+		AnnotationNydusBootstrap: "true",
+		AnnotationNydusFsVersion: "6",
+	}
+	return desc, diffID, nil
+}
+
+// decompressTo writes the plain tar content of a possibly gzipped layer
+func decompressTo(src *os.File, dst string) error {
+	r, err := uncompressed(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return writeFile(dst, r)
+}
+
+// writeFile copies r into a new file at path
+func writeFile(path string, r io.Reader) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// isNydus reports whether a manifest already carries a Nydus bootstrap
+func isNydus(manifest ocispec.Manifest) bool {
+	n := len(manifest.Layers)
+	return n > 0 && manifest.Layers[n-1].Annotations[AnnotationNydusBootstrap] == "true"
+}
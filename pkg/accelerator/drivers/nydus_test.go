@@ -0,0 +1,282 @@
+// Copyright 2021 vjranagit
+//
+// Nydus driver tests
+
+package drivers
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/vjranagit/harbor/pkg/accelerator/cache"
+	"github.com/vjranagit/harbor/pkg/accelerator/layout"
+)
+
+// The test binary doubles as a fake nydus-image when this variable is set
+const fakeNydusEnv = "HARBOR_FAKE_NYDUS_IMAGE"
+
+func TestMain(m *testing.M) {
+	if mode := os.Getenv(fakeNydusEnv); mode != "" {
+		os.Exit(fakeNydusImage(mode, os.Args[1:]))
+	}
+	os.Exit(m.Run())
+}
+
+// fakeNydusImage mimics nydus-image create and merge: blobs hold the layer
+// tar and bootstraps list the files they cover
+func fakeNydusImage(mode string, args []string) int {
+	if mode == "fail" {
+		fmt.Fprintln(os.Stderr, "error: unsupported tar format")
+		return 1
+	}
+	if log := os.Getenv(fakeNydusEnv + "_LOG"); log != "" {
+		f, _ := os.OpenFile(log, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		fmt.Fprintln(f, strings.Join(args, " "))
+		f.Close()
+	}
+
+	flags := make(map[string]string)
+	var positional []string
+	for i := 1; i < len(args); i++ {
+		if strings.HasPrefix(args[i], "--") && i+1 < len(args) {
+			flags[args[i]] = args[i+1]
+			i++
+			continue
+		}
+		positional = append(positional, args[i])
+	}
+
+	switch args[0] {
+	case "create":
+		if flags["--fs-version"] != "6" || flags["--type"] != "tar-rafs" || len(positional) != 1 {
+			fmt.Fprintln(os.Stderr, "error: bad arguments")
+			return 2
+		}
+		data, err := os.ReadFile(positional[0])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+
+		var names []string
+		tr := tar.NewReader(bytes.NewReader(data))
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "error: not a tar:", err)
+				return 1
+			}
+			names = append(names, hdr.Name)
+		}
+
+		os.WriteFile(flags["--blob"], append([]byte("RAFS-BLOB\n"), data...), 0o644)
+		os.WriteFile(flags["--bootstrap"], []byte(strings.Join(names, "\n")+"\n"), 0o644)
+		return 0
+
+	case "merge":
+		var merged []byte
+		for _, b := range positional {
+			data, err := os.ReadFile(b)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+			merged = append(merged, data...)
+		}
+		os.WriteFile(flags["--bootstrap"], merged, 0o644)
+		return 0
+	}
+
+	fmt.Fprintln(os.Stderr, "error: unknown subcommand", args[0])
+	return 2
+}
+
+// newFakeNydus returns a driver running the fake builder
+func newFakeNydus(t *testing.T, mode string, opts ...NydusOption) (*Nydus, string) {
+	t.Helper()
+
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatalf("os.Executable failed: %v", err)
+	}
+	log := t.TempDir() + "/calls.log"
+	t.Setenv(fakeNydusEnv, mode)
+	t.Setenv(fakeNydusEnv+"_LOG", log)
+
+	opts = append([]NydusOption{WithBuilderPath(exe), WithWorkDir(t.TempDir())}, opts...)
+	return NewNydus(opts...), log
+}
+
+func TestNydus_Convert(t *testing.T) {
+	store, err := layout.New(t.TempDir())
+	if err != nil {
+		t.Fatalf("layout.New failed: %v", err)
+	}
+	source := newTestImage(t, store,
+		map[string]string{"etc/os-release": "ID=test\n"},
+		map[string]string{"app/main": "binary"},
+	)
+
+	driver, log := newFakeNydus(t, "ok")
+	result, err := driver.Convert(context.Background(), store, source)
+	if err != nil {
+		t.Fatalf("Convert failed: %v", err)
+	}
+
+	manifest, config := readTestImage(t, store, result.Manifest)
+	if len(manifest.Layers) != 3 {
+		t.Fatalf("expected 2 blobs and a bootstrap, got %d layers", len(manifest.Layers))
+	}
+	if len(config.RootFS.DiffIDs) != 3 {
+		t.Fatalf("expected 3 diff IDs, got %d", len(config.RootFS.DiffIDs))
+	}
+	if manifest.Annotations[AnnotationNydusSourceDigest] != source.Digest.String() {
+		t.Errorf("expected source digest annotation, got %v", manifest.Annotations)
+	}
+
+	for i, blob := range manifest.Layers[:2] {
+		if blob.MediaType != MediaTypeNydusBlob {
+			t.Errorf("layer %d: expected %s, got %s", i, MediaTypeNydusBlob, blob.MediaType)
+		}
+		if blob.Annotations[AnnotationNydusBlob] != "true" {
+			t.Errorf("layer %d: expected nydus blob annotation", i)
+		}
+		if config.RootFS.DiffIDs[i] != blob.Digest {
+			t.Errorf("layer %d: expected diff ID to be the blob digest", i)
+		}
+		if !bytes.HasPrefix(readTestBlob(t, store, blob), []byte("RAFS-BLOB\n")) {
+			t.Errorf("layer %d: expected builder output", i)
+		}
+	}
+
+	boot := manifest.Layers[2]
+	if boot.Annotations[AnnotationNydusBootstrap] != "true" || boot.Annotations[AnnotationNydusFsVersion] != "6" {
+		t.Errorf("unexpected bootstrap annotations: %v", boot.Annotations)
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(readTestBlob(t, store, boot)))
+	if err != nil {
+		t.Fatalf("bootstrap layer is not gzip: %v", err)
+	}
+	raw, _ := io.ReadAll(zr)
+	if got := digest.FromBytes(raw); got != config.RootFS.DiffIDs[2] {
+		t.Errorf("expected bootstrap diff ID %s, got %s", got, config.RootFS.DiffIDs[2])
+	}
+
+	var bootstrap string
+	tr := tar.NewReader(bytes.NewReader(raw))
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		if hdr.Name == nydusBootstrapPath {
+			data, _ := io.ReadAll(tr)
+			bootstrap = string(data)
+		}
+	}
+	if !strings.Contains(bootstrap, "etc/os-release") || !strings.Contains(bootstrap, "app/main") {
+		t.Errorf("expected merged bootstrap to cover both layers, got %q", bootstrap)
+	}
+
+	calls, _ := os.ReadFile(log)
+	if n := strings.Count(string(calls), "create "); n != 2 {
+		t.Errorf("expected 2 create calls, got %d", n)
+	}
+	if !strings.Contains(string(calls), "--compressor zstd") {
+		t.Errorf("expected default zstd compressor, got %s", calls)
+	}
+
+	// Converting again is a no-op
+	again, err := driver.Convert(context.Background(), store, result.Manifest)
+	if err != nil {
+		t.Fatalf("second Convert failed: %v", err)
+	}
+	if again.Manifest.Digest != result.Manifest.Digest {
+		t.Error("expected Nydus image to be returned unchanged")
+	}
+}
+
+func TestNydus_LayerCache(t *testing.T) {
+	c, err := cache.Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("cache.Open failed: %v", err)
+	}
+	driver, log := newFakeNydus(t, "ok", WithNydusLayerCache(c))
+
+	var results []*Result
+	for i := 0; i < 2; i++ {
+		store, err := layout.New(t.TempDir())
+		if err != nil {
+			t.Fatalf("layout.New failed: %v", err)
+		}
+		source := newTestImage(t, store,
+			map[string]string{"etc/os-release": "ID=test\n"},
+			map[string]string{"app/main": "binary"},
+		)
+
+		result, err := driver.Convert(context.Background(), store, source)
+		if err != nil {
+			t.Fatalf("Convert %d failed: %v", i, err)
+		}
+		readTestImage(t, store, result.Manifest)
+		results = append(results, result)
+	}
+
+	for i, layer := range results[1].Layers {
+		if results[0].Layers[i].Cached || !layer.Cached {
+			t.Errorf("layer %d: expected a miss then a hit", i)
+		}
+	}
+	if results[0].Manifest.Digest != results[1].Manifest.Digest {
+		t.Errorf("expected identical images, got %s and %s", results[0].Manifest.Digest, results[1].Manifest.Digest)
+	}
+
+	calls, _ := os.ReadFile(log)
+	if n := strings.Count(string(calls), "create "); n != 2 {
+		t.Errorf("expected cached layers not to be rebuilt, got %d create calls", n)
+	}
+	if n := strings.Count(string(calls), "merge "); n != 2 {
+		t.Errorf("expected a merge per conversion, got %d", n)
+	}
+}
+
+func TestNydus_BuilderFailure(t *testing.T) {
+	store, err := layout.New(t.TempDir())
+	if err != nil {
+		t.Fatalf("layout.New failed: %v", err)
+	}
+	source := newTestImage(t, store, map[string]string{"a": "a"})
+
+	driver, _ := newFakeNydus(t, "fail")
+	_, err = driver.Convert(context.Background(), store, source)
+	if err == nil || !strings.Contains(err.Error(), "unsupported tar format") {
+		t.Errorf("expected builder output in error, got %v", err)
+	}
+}
+
+func TestNydus_BuilderNotFound(t *testing.T) {
+	store, err := layout.New(t.TempDir())
+	if err != nil {
+		t.Fatalf("layout.New failed: %v", err)
+	}
+	source := newTestImage(t, store, map[string]string{"a": "a"})
+
+	driver := NewNydus(WithBuilderPath("nydus-image-does-not-exist"))
+	_, err = driver.Convert(context.Background(), store, source)
+	if !errors.Is(err, ErrBuilderNotFound) {
+		t.Errorf("expected ErrBuilderNotFound, got %v", err)
+	}
+}
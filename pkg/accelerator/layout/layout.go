@@ -0,0 +1,241 @@
+// Copyright 2021 vjranagit
+//
+// OCI image layout storage for offline conversion
+
+package layout
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ErrNotFound is returned for missing blobs and references
+var ErrNotFound = errors.New("not found")
+
+// Layout is an OCI image layout directory: an oci-layout marker, an
+// index.json and content-addressed blobs under blobs/<algorithm>/
+type Layout struct {
+	root string
+	mu   sync.Mutex
+}
+
+// New opens the layout at root, creating an empty one if needed
+func New(root string) (*Layout, error) {
+	if err := os.MkdirAll(filepath.Join(root, ocispec.ImageBlobsDir, string(digest.SHA256)), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create layout: %w", err)
+	}
+
+	l := &Layout{root: root}
+
+	marker := filepath.Join(root, ocispec.ImageLayoutFile)
+	if _, err := os.Stat(marker); os.IsNotExist(err) {
+		data, _ := json.Marshal(ocispec.ImageLayout{Version: ocispec.ImageLayoutVersion})
+		if err := os.WriteFile(marker, data, 0o644); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := os.Stat(l.indexPath()); os.IsNotExist(err) {
+		if err := l.writeIndex(&ocispec.Index{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: ocispec.MediaTypeImageIndex,
+			Manifests: []ocispec.Descriptor{},
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	return l, nil
+}
+
+// Root returns the layout directory
+func (l *Layout) Root() string {
+	return l.root
+}
+
+// Fetch opens a blob
+func (l *Layout) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	path, err := l.blobPath(desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("blob %s: %w", desc.Digest, ErrNotFound)
+	}
+	return f, err
+}
+
+// Exists reports whether a blob is present
+func (l *Layout) Exists(ctx context.Context, dgst digest.Digest) bool {
+	path, err := l.blobPath(dgst)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(path)
+	return err == nil
+}
+
+// Push stores the content of r and returns its descriptor. Blobs are
+// written to a temporary file and renamed into place once the digest is
+// known, so readers never see partial content
+func (l *Layout) Push(ctx context.Context, mediaType string, r io.Reader) (ocispec.Descriptor, error) {
+	dir := filepath.Join(l.root, ocispec.ImageBlobsDir)
+	tmp, err := os.CreateTemp(dir, ".upload-*")
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	defer os.Remove(tmp.Name())
+
+	digester := digest.Canonical.Digester()
+	size, err := io.Copy(io.MultiWriter(tmp, digester.Hash()), &contextReader{ctx: ctx, r: r})
+	if err != nil {
+		tmp.Close()
+		return ocispec.Descriptor{}, err
+	}
+	if err := tmp.Close(); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	desc := ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    digester.Digest(),
+		Size:      size,
+	}
+	path, _ := l.blobPath(desc.Digest)
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	return desc, nil
+}
+
+// Tag records desc in index.json under name, replacing any previous entry
+// with the same name
+func (l *Layout) Tag(ctx context.Context, name string, desc ocispec.Descriptor) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	index, err := l.readIndex()
+	if err != nil {
+		return err
+	}
+
+	manifests := index.Manifests[:0]
+	for _, m := range index.Manifests {
+		if m.Annotations[ocispec.AnnotationRefName] != name {
+			manifests = append(manifests, m)
+		}
+	}
+
+	annotations := make(map[string]string, len(desc.Annotations)+1)
+	for k, v := range desc.Annotations {
+		annotations[k] = v
+	}
+	annotations[ocispec.AnnotationRefName] = name
+	desc.Annotations = annotations
+
+	index.Manifests = append(manifests, desc)
+	return l.writeIndex(index)
+}
+
+// Resolve looks up the descriptor tagged name
+func (l *Layout) Resolve(ctx context.Context, name string) (ocispec.Descriptor, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	index, err := l.readIndex()
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	for _, m := range index.Manifests {
+		if m.Annotations[ocispec.AnnotationRefName] == name {
+			delete(m.Annotations, ocispec.AnnotationRefName)
+			return m, nil
+		}
+	}
+	return ocispec.Descriptor{}, fmt.Errorf("reference %q: %w", name, ErrNotFound)
+}
+
+func (l *Layout) blobPath(dgst digest.Digest) (string, error) {
+	if err := dgst.Validate(); err != nil {
+		return "", fmt.Errorf("invalid digest %q: %w", dgst, err)
+	}
+	return filepath.Join(l.root, ocispec.ImageBlobsDir, dgst.Algorithm().String(), dgst.Encoded()), nil
+}
+
+func (l *Layout) indexPath() string {
+	return filepath.Join(l.root, ocispec.ImageIndexFile)
+}
+
+func (l *Layout) readIndex() (*ocispec.Index, error) {
+	data, err := os.ReadFile(l.indexPath())
+	if err != nil {
+		return nil, err
+	}
+	var index ocispec.Index
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", ocispec.ImageIndexFile, err)
+	}
+	return &index, nil
+}
+
+func (l *Layout) writeIndex(index *ocispec.Index) error {
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := l.indexPath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.indexPath())
+}
+
+// Fetcher reads blobs by descriptor
+type Fetcher interface {
+	Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error)
+}
+
+// ReadJSON fetches a blob from f, verifies its digest and decodes it into v
+func ReadJSON(ctx context.Context, f Fetcher, desc ocispec.Descriptor, v interface{}) error {
+	rc, err := f.Fetch(ctx, desc)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return err
+	}
+	if got := digest.FromBytes(data); got != desc.Digest {
+		return fmt.Errorf("digest mismatch for %s: got %s", desc.Digest, got)
+	}
+	return json.Unmarshal(data, v)
+}
+
+// contextReader stops a copy once ctx is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr *contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
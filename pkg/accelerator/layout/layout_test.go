@@ -0,0 +1,122 @@
+// Copyright 2021 vjranagit
+//
+// OCI image layout tests
+
+package layout
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestLayout_PushFetch(t *testing.T) {
+	root := t.TempDir()
+	l, err := New(root)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	ctx := context.Background()
+
+	content := "hello layer"
+	desc, err := l.Push(ctx, ocispec.MediaTypeImageLayer, strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("Push failed: %v", err)
+	}
+	if desc.Digest != digest.FromString(content) || desc.Size != int64(len(content)) {
+		t.Errorf("unexpected descriptor: %+v", desc)
+	}
+	if !l.Exists(ctx, desc.Digest) {
+		t.Error("expected blob to exist")
+	}
+
+	if _, err := os.Stat(filepath.Join(root, "blobs", "sha256", desc.Digest.Encoded())); err != nil {
+		t.Errorf("expected blob at OCI layout path: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, ocispec.ImageLayoutFile)); err != nil {
+		t.Errorf("expected oci-layout marker: %v", err)
+	}
+
+	rc, err := l.Fetch(ctx, desc)
+	if err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	data, _ := io.ReadAll(rc)
+	rc.Close()
+	if string(data) != content {
+		t.Errorf("expected %q, got %q", content, data)
+	}
+
+	_, err = l.Fetch(ctx, ocispec.Descriptor{Digest: digest.FromString("missing")})
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+
+	_, err = l.Fetch(ctx, ocispec.Descriptor{Digest: "sha256:../../etc/passwd"})
+	if err == nil {
+		t.Error("expected invalid digest to be rejected")
+	}
+}
+
+func TestLayout_TagResolve(t *testing.T) {
+	root := t.TempDir()
+	l, err := New(root)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	ctx := context.Background()
+
+	first, _ := l.Push(ctx, ocispec.MediaTypeImageManifest, strings.NewReader(`{"schemaVersion":2}`))
+	second, _ := l.Push(ctx, ocispec.MediaTypeImageManifest, strings.NewReader(`{"schemaVersion":2,"layers":[]}`))
+
+	if err := l.Tag(ctx, "v1", first); err != nil {
+		t.Fatalf("Tag failed: %v", err)
+	}
+	if err := l.Tag(ctx, "v1", second); err != nil {
+		t.Fatalf("retag failed: %v", err)
+	}
+
+	// Reopen to make sure index.json was persisted
+	l, err = New(root)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	got, err := l.Resolve(ctx, "v1")
+	if err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	if got.Digest != second.Digest {
+		t.Errorf("expected %s, got %s", second.Digest, got.Digest)
+	}
+
+	if _, err := l.Resolve(ctx, "v2"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestReadJSON_DigestMismatch(t *testing.T) {
+	l, err := New(t.TempDir())
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	ctx := context.Background()
+
+	desc, _ := l.Push(ctx, ocispec.MediaTypeImageConfig, strings.NewReader(`{}`))
+	desc.Digest = digest.FromString(`{"tampered":true}`)
+
+	// Point the bogus digest at real content
+	src := filepath.Join(l.Root(), "blobs", "sha256", digest.FromString(`{}`).Encoded())
+	os.Link(src, filepath.Join(l.Root(), "blobs", "sha256", desc.Digest.Encoded()))
+
+	var v map[string]interface{}
+	if err := ReadJSON(ctx, l, desc, &v); err == nil {
+		t.Error("expected digest mismatch")
+	}
+}
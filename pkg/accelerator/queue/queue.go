@@ -0,0 +1,705 @@
+// Copyright 2021 vjranagit
+//
+// Durable conversion job queue
+
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/vjranagit/harbor/pkg/distribution"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// ErrJobNotFound is returned for unknown job IDs
+	ErrJobNotFound = errors.New("job not found")
+	// ErrNotLeased is returned when completing or failing a job that is not
+	// running, e.g. because its lease expired and another worker took it
+	ErrNotLeased = errors.New("job is not leased")
+)
+
+var (
+	jobsBucket  = []byte("jobs")
+	dedupBucket = []byte("dedup")
+	// activeBucket indexes pending and running jobs by ID, so polling
+	// does not read finished ones
+	activeBucket = []byte("active")
+)
+
+// DefaultRetention is how long finished jobs are kept unless configured
+const DefaultRetention = 7 * 24 * time.Hour
+
+// State is the lifecycle state of a job
+type State string
+
+const (
+	StatePending   State = "pending"
+	StateRunning   State = "running"
+	StateSucceeded State = "succeeded"
+	StateDead      State = "dead"
+)
+
+// Finished reports whether jobs in the state are done for good, unless
+// retried by hand
+func (s State) Finished() bool {
+	return s == StateSucceeded || s == StateDead
+}
+
+// Job is a queued image conversion
+type Job struct {
+	ID     string `json:"id"`
+	Source string `json:"source"`
+	Driver string `json:"driver"`
+	// SourceDigest identifies the source image; active jobs converting the
+	// same digest to the same target are deduplicated
+	SourceDigest digest.Digest `json:"source_digest,omitempty"`
+	// Registry limits concurrency; derived from Source when empty
+	Registry    string `json:"registry,omitempty"`
+	Priority    int    `json:"priority"`
+	State       State  `json:"state"`
+	Attempts    int    `json:"attempts"`
+	MaxAttempts int    `json:"max_attempts"`
+	LastError   string `json:"last_error,omitempty"`
+	// Result is the converted reference once the job succeeded
+	Result     string    `json:"result,omitempty"`
+	EnqueuedAt time.Time `json:"enqueued_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+	// NotBefore delays a retried job
+	NotBefore time.Time `json:"not_before,omitempty"`
+	// LeaseUntil is when a running job becomes visible to other workers
+	LeaseUntil time.Time `json:"lease_until,omitempty"`
+}
+
+// dedupKey is the deduplication key of a job. The target tag is derived
+// from the source repository and tag, so those are part of it
+func (j *Job) dedupKey() []byte {
+	if j.SourceDigest == "" {
+		return nil
+	}
+	target := j.Source
+	if ref, err := distribution.ParseReference(j.Source); err == nil {
+		target = ref.Repository + ":" + ref.Tag
+	}
+	return []byte(j.SourceDigest.String() + "|" + j.Driver + "|" + target)
+}
+
+// Queue is a persistent priority queue of conversion jobs backed by an
+// embedded bbolt database. Leased jobs that are not completed within the
+// visibility timeout become available again, so a crashed worker's jobs
+// are retried after a restart
+type Queue struct {
+	db            *bolt.DB
+	visibility    time.Duration
+	maxAttempts   int
+	backoffBase   time.Duration
+	backoffMax    time.Duration
+	registryLimit int
+	retention     time.Duration
+	now           func() time.Time
+	mu            sync.Mutex
+	logger        *slog.Logger
+}
+
+// Option configures a Queue
+type Option func(*Queue)
+
+// WithVisibilityTimeout sets how long a leased job stays invisible
+func WithVisibilityTimeout(d time.Duration) Option {
+	return func(q *Queue) {
+		q.visibility = d
+	}
+}
+
+// WithMaxAttempts sets the default attempts before a job is dead-lettered
+func WithMaxAttempts(n int) Option {
+	return func(q *Queue) {
+		q.maxAttempts = n
+	}
+}
+
+// WithBackoff sets the exponential retry delay bounds
+func WithBackoff(base, max time.Duration) Option {
+	return func(q *Queue) {
+		q.backoffBase = base
+		q.backoffMax = max
+	}
+}
+
+// WithRegistryLimit caps concurrently leased jobs per registry; zero
+// disables the limit
+func WithRegistryLimit(n int) Option {
+	return func(q *Queue) {
+		q.registryLimit = n
+	}
+}
+
+// WithRetention sets how long succeeded and dead-lettered jobs are kept
+// after their last update; zero keeps them forever
+func WithRetention(d time.Duration) Option {
+	return func(q *Queue) {
+		q.retention = d
+	}
+}
+
+// WithClock replaces the time source, for tests
+func WithClock(now func() time.Time) Option {
+	return func(q *Queue) {
+		q.now = now
+	}
+}
+
+// Open opens or creates the queue database at path
+func Open(path string, opts ...Option) (*Queue, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open queue %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{jobsBucket, dedupBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		if tx.Bucket(activeBucket) != nil {
+			return nil
+		}
+
+		// Queues created before the index get it built once
+		active, err := tx.CreateBucket(activeBucket)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(jobsBucket).ForEach(func(k, v []byte) error {
+			var job Job
+			if err := json.Unmarshal(v, &job); err != nil {
+				return fmt.Errorf("job %s: %w", k, err)
+			}
+			if job.State.Finished() {
+				return nil
+			}
+			return active.Put(k, []byte{})
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	q := &Queue{
+		db:            db,
+		visibility:    10 * time.Minute,
+		maxAttempts:   5,
+		backoffBase:   10 * time.Second,
+		backoffMax:    10 * time.Minute,
+		registryLimit: 2,
+		retention:     DefaultRetention,
+		now:           time.Now,
+		logger:        slog.Default().With("component", "queue"),
+	}
+	for _, opt := range opts {
+		opt(q)
+	}
+	if q.visibility <= 0 {
+		db.Close()
+		return nil, fmt.Errorf("visibility timeout must be positive, got %s", q.visibility)
+	}
+	return q, nil
+}
+
+// Close closes the database
+func (q *Queue) Close() error {
+	return q.db.Close()
+}
+
+// Enqueue adds a job. When a pending or running job exists for the same
+// source digest, driver and target, that job is returned instead and
+// created is false
+func (q *Queue) Enqueue(job Job) (_ *Job, created bool, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if job.Source == "" || job.Driver == "" {
+		return nil, false, fmt.Errorf("job needs a source and a driver")
+	}
+	if job.Registry == "" {
+		if ref, err := distribution.ParseReference(job.Source); err == nil {
+			job.Registry = ref.Registry
+		}
+	}
+	if job.MaxAttempts <= 0 {
+		job.MaxAttempts = q.maxAttempts
+	}
+
+	var result *Job
+	err = q.db.Update(func(tx *bolt.Tx) error {
+		jobs, dedup := tx.Bucket(jobsBucket), tx.Bucket(dedupBucket)
+
+		if key := job.dedupKey(); key != nil {
+			if id := dedup.Get(key); id != nil {
+				existing, err := getJob(jobs, string(id))
+				if err == nil && !existing.State.Finished() {
+					result = existing
+					return nil
+				}
+			}
+		}
+
+		seq, err := jobs.NextSequence()
+		if err != nil {
+			return err
+		}
+		now := q.now()
+		job.ID = fmt.Sprintf("job-%d", seq)
+		job.State = StatePending
+		job.Attempts = 0
+		job.EnqueuedAt = now
+		job.UpdatedAt = now
+
+		if key := job.dedupKey(); key != nil {
+			if err := dedup.Put(key, []byte(job.ID)); err != nil {
+				return err
+			}
+		}
+		result = &job
+		created = true
+		return putJob(tx, &job)
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	if created {
+		q.logger.Info("job enqueued", "id", result.ID, "source", result.Source, "driver", result.Driver, "priority", result.Priority)
+	}
+	return result, created, nil
+}
+
+// Dequeue leases the highest priority job that is ready and whose registry
+// is under its concurrency limit; ties go to the oldest job. It returns
+// nil when nothing is ready. Running jobs whose lease expired count as
+// ready, or are dead-lettered when out of attempts
+func (q *Queue) Dequeue() (*Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var leased *Job
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		jobs := tx.Bucket(jobsBucket)
+		now := q.now()
+
+		var ready, expired []*Job
+		running := make(map[string]int)
+		err := tx.Bucket(activeBucket).ForEach(func(k, _ []byte) error {
+			job, err := getJob(jobs, string(k))
+			if err != nil {
+				return err
+			}
+
+			switch job.State {
+			case StateRunning:
+				if now.Before(job.LeaseUntil) {
+					running[job.Registry]++
+					return nil
+				}
+				// Lease expired: the worker died or hung
+				if job.Attempts >= job.MaxAttempts {
+					expired = append(expired, job)
+					return nil
+				}
+				ready = append(ready, job)
+			case StatePending:
+				if !now.Before(job.NotBefore) {
+					ready = append(ready, job)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// Written once the scan is done: bbolt does not allow changing a
+		// bucket while iterating it
+		for _, job := range expired {
+			job.State = StateDead
+			job.LastError = "lease expired after final attempt"
+			job.LeaseUntil = time.Time{}
+			job.UpdatedAt = now
+			q.logger.Warn("job dead-lettered", "id", job.ID, "attempts", job.Attempts)
+			if err := putJob(tx, job); err != nil {
+				return err
+			}
+		}
+
+		sort.SliceStable(ready, func(i, j int) bool {
+			if ready[i].Priority != ready[j].Priority {
+				return ready[i].Priority > ready[j].Priority
+			}
+			return ready[i].EnqueuedAt.Before(ready[j].EnqueuedAt)
+		})
+
+		for _, job := range ready {
+			if q.registryLimit > 0 && running[job.Registry] >= q.registryLimit {
+				continue
+			}
+			job.State = StateRunning
+			job.Attempts++
+			job.LeaseUntil = now.Add(q.visibility)
+			job.UpdatedAt = now
+			leased = job
+			return putJob(tx, job)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return leased, nil
+}
+
+// Extend renews the lease of a running job
+func (q *Queue) Extend(id string) error {
+	return q.update(id, func(job *Job, now time.Time) error {
+		if job.State != StateRunning {
+			return fmt.Errorf("%w: %s is %s", ErrNotLeased, id, job.State)
+		}
+		job.LeaseUntil = now.Add(q.visibility)
+		return nil
+	})
+}
+
+// Complete marks a running job as succeeded
+func (q *Queue) Complete(id, result string) error {
+	err := q.update(id, func(job *Job, now time.Time) error {
+		if job.State != StateRunning {
+			return fmt.Errorf("%w: %s is %s", ErrNotLeased, id, job.State)
+		}
+		job.State = StateSucceeded
+		job.Result = result
+		job.LastError = ""
+		job.LeaseUntil = time.Time{}
+		return nil
+	})
+	if err == nil {
+		q.logger.Info("job succeeded", "id", id, "result", result)
+	}
+	return err
+}
+
+// Fail records a failed attempt. The job is retried after an exponential
+// backoff, or dead-lettered once it is out of attempts
+func (q *Queue) Fail(id string, cause error) error {
+	return q.update(id, func(job *Job, now time.Time) error {
+		if job.State != StateRunning {
+			return fmt.Errorf("%w: %s is %s", ErrNotLeased, id, job.State)
+		}
+		job.LastError = cause.Error()
+		job.LeaseUntil = time.Time{}
+
+		if job.Attempts >= job.MaxAttempts {
+			job.State = StateDead
+			q.logger.Warn("job dead-lettered", "id", id, "attempts", job.Attempts, "error", cause)
+			return nil
+		}
+
+		delay := q.backoff(job.Attempts)
+		job.State = StatePending
+		job.NotBefore = now.Add(delay)
+		q.logger.Info("job retry scheduled", "id", id, "attempt", job.Attempts, "delay", delay, "error", cause)
+		return nil
+	})
+}
+
+// Release returns a running job to pending without counting the attempt,
+// for workers that stop before running it to completion
+func (q *Queue) Release(id string) error {
+	return q.update(id, func(job *Job, now time.Time) error {
+		if job.State != StateRunning {
+			return fmt.Errorf("%w: %s is %s", ErrNotLeased, id, job.State)
+		}
+		job.State = StatePending
+		job.Attempts = max(job.Attempts-1, 0)
+		job.LeaseUntil = time.Time{}
+		return nil
+	})
+}
+
+// Retry moves a dead-lettered job back to pending with fresh attempts
+func (q *Queue) Retry(id string) error {
+	return q.update(id, func(job *Job, now time.Time) error {
+		if job.State != StateDead {
+			return fmt.Errorf("job %s is %s, not dead", id, job.State)
+		}
+		job.State = StatePending
+		job.Attempts = 0
+		job.NotBefore = time.Time{}
+		return nil
+	})
+}
+
+// Get returns a job by ID
+func (q *Queue) Get(id string) (*Job, error) {
+	var job *Job
+	err := q.db.View(func(tx *bolt.Tx) error {
+		var err error
+		job, err = getJob(tx.Bucket(jobsBucket), id)
+		return err
+	})
+	return job, err
+}
+
+// List returns jobs in the given states, or all jobs when none are given,
+// in enqueue order
+func (q *Queue) List(states ...State) ([]*Job, error) {
+	want := make(map[State]bool)
+	for _, s := range states {
+		want[s] = true
+	}
+
+	var jobs []*Job
+	err := q.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).ForEach(func(k, v []byte) error {
+			var job Job
+			if err := json.Unmarshal(v, &job); err != nil {
+				return fmt.Errorf("job %s: %w", k, err)
+			}
+			if len(want) == 0 || want[job.State] {
+				jobs = append(jobs, &job)
+			}
+			return nil
+		})
+	})
+
+	sort.SliceStable(jobs, func(i, j int) bool { return jobs[i].EnqueuedAt.Before(jobs[j].EnqueuedAt) })
+	return jobs, err
+}
+
+// DeadLetters returns jobs that ran out of attempts
+func (q *Queue) DeadLetters() ([]*Job, error) {
+	return q.List(StateDead)
+}
+
+// Stats counts jobs per state
+func (q *Queue) Stats() (map[State]int, error) {
+	jobs, err := q.List()
+	if err != nil {
+		return nil, err
+	}
+
+	stats := make(map[State]int)
+	for _, job := range jobs {
+		stats[job.State]++
+	}
+	return stats, nil
+}
+
+// Prune removes succeeded and dead-lettered jobs not updated within the
+// retention period and returns how many
+func (q *Queue) Prune() (int, error) {
+	if q.retention <= 0 {
+		return 0, nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var pruned int
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		jobs, dedup := tx.Bucket(jobsBucket), tx.Bucket(dedupBucket)
+		cutoff := q.now().Add(-q.retention)
+
+		var expired []*Job
+		err := jobs.ForEach(func(k, v []byte) error {
+			var job Job
+			if err := json.Unmarshal(v, &job); err != nil {
+				return fmt.Errorf("job %s: %w", k, err)
+			}
+			if job.State.Finished() && job.UpdatedAt.Before(cutoff) {
+				expired = append(expired, &job)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, job := range expired {
+			if key := job.dedupKey(); key != nil && string(dedup.Get(key)) == job.ID {
+				if err := dedup.Delete(key); err != nil {
+					return err
+				}
+			}
+			if err := jobs.Delete([]byte(job.ID)); err != nil {
+				return err
+			}
+		}
+		pruned = len(expired)
+		return nil
+	})
+	return pruned, err
+}
+
+// backoff returns the delay before the given retry attempt
+func (q *Queue) backoff(attempt int) time.Duration {
+	delay := q.backoffBase
+	for i := 1; i < attempt && delay < q.backoffMax; i++ {
+		delay *= 2
+	}
+	if delay > q.backoffMax {
+		delay = q.backoffMax
+	}
+	return delay
+}
+
+// update applies fn to a stored job and saves it
+func (q *Queue) update(id string, fn func(job *Job, now time.Time) error) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.db.Update(func(tx *bolt.Tx) error {
+		jobs := tx.Bucket(jobsBucket)
+		job, err := getJob(jobs, id)
+		if err != nil {
+			return err
+		}
+
+		now := q.now()
+		if err := fn(job, now); err != nil {
+			return err
+		}
+		job.UpdatedAt = now
+		return putJob(tx, job)
+	})
+}
+
+func getJob(b *bolt.Bucket, id string) (*Job, error) {
+	data := b.Get([]byte(id))
+	if data == nil {
+		return nil, fmt.Errorf("%w: %s", ErrJobNotFound, id)
+	}
+
+	var job Job
+	if err := json.Unmarshal(data, &job); err != nil {
+		return nil, fmt.Errorf("job %s: %w", id, err)
+	}
+	return &job, nil
+}
+
+// putJob saves job and keeps the index of active jobs up to date
+func putJob(tx *bolt.Tx, job *Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(jobsBucket).Put([]byte(job.ID), data); err != nil {
+		return err
+	}
+
+	active := tx.Bucket(activeBucket)
+	if job.State.Finished() {
+		return active.Delete([]byte(job.ID))
+	}
+	return active.Put([]byte(job.ID), []byte{})
+}
+
+// Handler runs one job and returns the converted reference
+type Handler func(ctx context.Context, job *Job) (string, error)
+
+// Process runs handler on leased jobs with the given number of workers,
+// polling for new work every poll interval, until ctx is done. Leases are
+// renewed while a handler runs; jobs interrupted by ctx are released
+// without counting the attempt
+func (q *Queue) Process(ctx context.Context, workers int, poll time.Duration, handler Handler) {
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				job, err := q.Dequeue()
+				if err != nil {
+					q.logger.Error("dequeue failed", "error", err)
+				}
+				if job == nil {
+					select {
+					case <-ctx.Done():
+						return
+					case <-time.After(poll):
+						continue
+					}
+				}
+				if ctx.Err() != nil {
+					q.release(job)
+					return
+				}
+				q.run(ctx, job, handler)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// run executes one job, renewing its lease until the handler returns
+func (q *Queue) run(ctx context.Context, job *Job, handler Handler) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(q.visibility / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := q.Extend(job.ID); err != nil {
+					q.logger.Warn("lease renewal failed", "id", job.ID, "error", err)
+				}
+			}
+		}
+	}()
+
+	result, err := handler(ctx, job)
+	close(done)
+
+	if ctx.Err() != nil {
+		// Shutting down: the job is picked up again after a restart
+		q.release(job)
+		return
+	}
+	if err != nil {
+		err = q.Fail(job.ID, err)
+	} else {
+		err = q.Complete(job.ID, result)
+	}
+	if err != nil {
+		q.logger.Error("failed to record job outcome", "id", job.ID, "error", err)
+	}
+
+	if pruned, err := q.Prune(); err != nil {
+		q.logger.Error("failed to prune jobs", "error", err)
+	} else if pruned > 0 {
+		q.logger.Debug("jobs pruned", "count", pruned)
+	}
+}
+
+// release returns an interrupted job to pending, logging failures
+func (q *Queue) release(job *Job) {
+	if err := q.Release(job.ID); err != nil {
+		q.logger.Error("failed to release job", "id", job.ID, "error", err)
+	}
+}
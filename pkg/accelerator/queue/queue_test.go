@@ -0,0 +1,571 @@
+// Copyright 2021 vjranagit
+//
+// Conversion job queue tests
+
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	bolt "go.etcd.io/bbolt"
+)
+
+// clock is a manually advanced time source
+type clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newClock() *clock {
+	return &clock{now: time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func openTestQueue(t *testing.T, path string, c *clock, opts ...Option) *Queue {
+	t.Helper()
+	opts = append([]Option{WithClock(c.Now), WithBackoff(time.Minute, 4*time.Minute)}, opts...)
+	q, err := Open(path, opts...)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	return q
+}
+
+func mustEnqueue(t *testing.T, q *Queue, job Job) *Job {
+	t.Helper()
+	queued, _, err := q.Enqueue(job)
+	if err != nil {
+		t.Fatalf("Enqueue failed: %v", err)
+	}
+	return queued
+}
+
+func mustDequeue(t *testing.T, q *Queue) *Job {
+	t.Helper()
+	job, err := q.Dequeue()
+	if err != nil {
+		t.Fatalf("Dequeue failed: %v", err)
+	}
+	return job
+}
+
+func TestQueue_Priority(t *testing.T) {
+	c := newClock()
+	q := openTestQueue(t, filepath.Join(t.TempDir(), "queue.db"), c, WithRegistryLimit(0))
+	defer q.Close()
+
+	low := mustEnqueue(t, q, Job{Source: "r.io/app:low", Driver: "nydus"})
+	c.Advance(time.Second)
+	high := mustEnqueue(t, q, Job{Source: "r.io/app:high", Driver: "nydus", Priority: 10})
+	c.Advance(time.Second)
+	older := mustEnqueue(t, q, Job{Source: "r.io/app:low2", Driver: "nydus"})
+
+	for _, want := range []string{high.ID, low.ID, older.ID} {
+		job := mustDequeue(t, q)
+		if job == nil || job.ID != want {
+			t.Fatalf("expected %s, got %+v", want, job)
+		}
+		if job.State != StateRunning || job.Attempts != 1 {
+			t.Errorf("expected running first attempt, got %s attempt %d", job.State, job.Attempts)
+		}
+	}
+
+	if job := mustDequeue(t, q); job != nil {
+		t.Errorf("expected empty queue, got %s", job.ID)
+	}
+}
+
+func TestQueue_Deduplication(t *testing.T) {
+	c := newClock()
+	q := openTestQueue(t, filepath.Join(t.TempDir(), "queue.db"), c, WithMaxAttempts(1))
+	defer q.Close()
+
+	dgst := digest.FromString("image")
+	first, created, err := q.Enqueue(Job{Source: "r.io/app:1", Driver: "nydus", SourceDigest: dgst})
+	if err != nil || !created {
+		t.Fatalf("expected new job, got created=%v err=%v", created, err)
+	}
+
+	dup, created, err := q.Enqueue(Job{Source: "r.io/app:1", Driver: "nydus", SourceDigest: dgst})
+	if err != nil {
+		t.Fatalf("Enqueue failed: %v", err)
+	}
+	if created || dup.ID != first.ID {
+		t.Errorf("expected duplicate of %s, got %s (created=%v)", first.ID, dup.ID, created)
+	}
+
+	// Another tag of the same image converts to another target tag
+	if _, created, _ := q.Enqueue(Job{Source: "r.io/app:latest", Driver: "nydus", SourceDigest: dgst}); !created {
+		t.Error("expected new job for another tag")
+	}
+
+	// Another driver is a different conversion
+	if _, created, _ := q.Enqueue(Job{Source: "r.io/app:1", Driver: "estargz", SourceDigest: dgst}); !created {
+		t.Error("expected new job for another driver")
+	}
+
+	// A dead-lettered job does not block a new attempt
+	job := mustDequeue(t, q)
+	if err := q.Fail(job.ID, errors.New("boom")); err != nil {
+		t.Fatalf("Fail failed: %v", err)
+	}
+	if _, created, _ := q.Enqueue(Job{Source: job.Source, Driver: job.Driver, SourceDigest: job.SourceDigest}); !created {
+		t.Error("expected new job after dead-lettering")
+	}
+
+	// Nor does a succeeded one, e.g. when the target tag was deleted since
+	job = mustDequeue(t, q)
+	if err := q.Complete(job.ID, job.Source+"-nydus"); err != nil {
+		t.Fatalf("Complete failed: %v", err)
+	}
+	if _, created, _ := q.Enqueue(Job{Source: job.Source, Driver: job.Driver, SourceDigest: job.SourceDigest}); !created {
+		t.Error("expected new job after success")
+	}
+}
+
+func TestQueue_VisibilityTimeout(t *testing.T) {
+	c := newClock()
+	q := openTestQueue(t, filepath.Join(t.TempDir(), "queue.db"), c, WithVisibilityTimeout(time.Minute))
+	defer q.Close()
+
+	queued := mustEnqueue(t, q, Job{Source: "r.io/app:1", Driver: "nydus"})
+	job := mustDequeue(t, q)
+
+	c.Advance(30 * time.Second)
+	if other := mustDequeue(t, q); other != nil {
+		t.Fatalf("expected leased job to be invisible, got %s", other.ID)
+	}
+	if err := q.Extend(job.ID); err != nil {
+		t.Fatalf("Extend failed: %v", err)
+	}
+
+	c.Advance(45 * time.Second)
+	if other := mustDequeue(t, q); other != nil {
+		t.Fatalf("expected extended lease to hold, got %s", other.ID)
+	}
+
+	c.Advance(time.Minute)
+	again := mustDequeue(t, q)
+	if again == nil || again.ID != queued.ID {
+		t.Fatalf("expected %s after lease expiry, got %+v", queued.ID, again)
+	}
+	if again.Attempts != 2 {
+		t.Errorf("expected attempt 2, got %d", again.Attempts)
+	}
+}
+
+func TestQueue_RetryAndDeadLetter(t *testing.T) {
+	c := newClock()
+	q := openTestQueue(t, filepath.Join(t.TempDir(), "queue.db"), c, WithMaxAttempts(3))
+	defer q.Close()
+
+	queued := mustEnqueue(t, q, Job{Source: "r.io/app:1", Driver: "nydus"})
+
+	// Backoff doubles from one minute
+	for _, delay := range []time.Duration{time.Minute, 2 * time.Minute} {
+		job := mustDequeue(t, q)
+		if job == nil {
+			t.Fatal("expected job")
+		}
+		if err := q.Fail(job.ID, errors.New("registry unavailable")); err != nil {
+			t.Fatalf("Fail failed: %v", err)
+		}
+
+		c.Advance(delay - time.Second)
+		if early := mustDequeue(t, q); early != nil {
+			t.Fatalf("expected backoff of %s, got job early", delay)
+		}
+		c.Advance(time.Second)
+	}
+
+	job := mustDequeue(t, q)
+	if err := q.Fail(job.ID, errors.New("registry unavailable")); err != nil {
+		t.Fatalf("Fail failed: %v", err)
+	}
+
+	dead, err := q.DeadLetters()
+	if err != nil {
+		t.Fatalf("DeadLetters failed: %v", err)
+	}
+	if len(dead) != 1 || dead[0].ID != queued.ID || dead[0].Attempts != 3 {
+		t.Fatalf("expected %s dead after 3 attempts, got %+v", queued.ID, dead)
+	}
+	if dead[0].LastError != "registry unavailable" {
+		t.Errorf("expected last error recorded, got %q", dead[0].LastError)
+	}
+
+	if err := q.Retry(queued.ID); err != nil {
+		t.Fatalf("Retry failed: %v", err)
+	}
+	if job := mustDequeue(t, q); job == nil || job.Attempts != 1 {
+		t.Errorf("expected retried job with fresh attempts, got %+v", job)
+	}
+}
+
+func TestQueue_RegistryLimit(t *testing.T) {
+	c := newClock()
+	q := openTestQueue(t, filepath.Join(t.TempDir(), "queue.db"), c, WithRegistryLimit(1))
+	defer q.Close()
+
+	mustEnqueue(t, q, Job{Source: "a.io/app:1", Driver: "nydus", Priority: 5})
+	mustEnqueue(t, q, Job{Source: "a.io/app:2", Driver: "nydus", Priority: 5})
+	mustEnqueue(t, q, Job{Source: "b.io/app:1", Driver: "nydus"})
+
+	first := mustDequeue(t, q)
+	second := mustDequeue(t, q)
+	if first.Registry != "a.io" || second.Registry != "b.io" {
+		t.Fatalf("expected a.io then b.io, got %s then %s", first.Registry, second.Registry)
+	}
+	if job := mustDequeue(t, q); job != nil {
+		t.Fatalf("expected a.io to be at its limit, got %s", job.Source)
+	}
+
+	if err := q.Complete(first.ID, "a.io/app:1-nydus"); err != nil {
+		t.Fatalf("Complete failed: %v", err)
+	}
+	if job := mustDequeue(t, q); job == nil || job.Source != "a.io/app:2" {
+		t.Errorf("expected a.io/app:2 after completion, got %+v", job)
+	}
+}
+
+func TestQueue_CrashRecovery(t *testing.T) {
+	c := newClock()
+	path := filepath.Join(t.TempDir(), "queue.db")
+
+	q := openTestQueue(t, path, c, WithVisibilityTimeout(time.Minute))
+	running := mustEnqueue(t, q, Job{Source: "r.io/app:1", Driver: "nydus", Priority: 1})
+	pending := mustEnqueue(t, q, Job{Source: "r.io/app:2", Driver: "nydus"})
+	done := mustEnqueue(t, q, Job{Source: "r.io/app:3", Driver: "nydus", Priority: 2})
+
+	if job := mustDequeue(t, q); job.ID != done.ID {
+		t.Fatalf("expected %s, got %s", done.ID, job.ID)
+	}
+	if err := q.Complete(done.ID, "r.io/app:3-nydus"); err != nil {
+		t.Fatalf("Complete failed: %v", err)
+	}
+	if job := mustDequeue(t, q); job.ID != running.ID {
+		t.Fatalf("expected %s, got %s", running.ID, job.ID)
+	}
+
+	// The worker dies without completing its job
+	if err := q.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	q = openTestQueue(t, path, c, WithVisibilityTimeout(time.Minute))
+	defer q.Close()
+
+	stats, err := q.Stats()
+	if err != nil {
+		t.Fatalf("Stats failed: %v", err)
+	}
+	if stats[StateRunning] != 1 || stats[StatePending] != 1 || stats[StateSucceeded] != 1 {
+		t.Errorf("unexpected stats after reopen: %v", stats)
+	}
+
+	finished, err := q.Get(done.ID)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if finished.Result != "r.io/app:3-nydus" {
+		t.Errorf("expected result to survive restart, got %q", finished.Result)
+	}
+
+	// Until the lease expires only the pending job is visible
+	if job := mustDequeue(t, q); job.ID != pending.ID {
+		t.Fatalf("expected %s, got %s", pending.ID, job.ID)
+	}
+
+	c.Advance(2 * time.Minute)
+	job := mustDequeue(t, q)
+	if job == nil || job.ID != running.ID || job.Attempts != 2 {
+		t.Fatalf("expected %s on its second attempt, got %+v", running.ID, job)
+	}
+
+	// IDs keep increasing across restarts
+	next := mustEnqueue(t, q, Job{Source: "r.io/app:4", Driver: "nydus"})
+	if next.ID != "job-4" {
+		t.Errorf("expected job-4, got %s", next.ID)
+	}
+}
+
+func TestQueue_ExpiredFinalAttempt(t *testing.T) {
+	c := newClock()
+	q := openTestQueue(t, filepath.Join(t.TempDir(), "queue.db"), c,
+		WithVisibilityTimeout(time.Minute), WithMaxAttempts(1))
+	defer q.Close()
+
+	queued := mustEnqueue(t, q, Job{Source: "r.io/app:1", Driver: "nydus"})
+	mustDequeue(t, q)
+
+	c.Advance(2 * time.Minute)
+	if job := mustDequeue(t, q); job != nil {
+		t.Fatalf("expected no job, got %s", job.ID)
+	}
+
+	job, err := q.Get(queued.ID)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if job.State != StateDead {
+		t.Errorf("expected dead job, got %s", job.State)
+	}
+	if err := q.Complete(job.ID, "late"); !errors.Is(err, ErrNotLeased) {
+		t.Errorf("expected ErrNotLeased, got %v", err)
+	}
+}
+
+func TestQueue_ExpiredFinalAttempts(t *testing.T) {
+	c := newClock()
+	q := openTestQueue(t, filepath.Join(t.TempDir(), "queue.db"), c,
+		WithVisibilityTimeout(time.Minute), WithMaxAttempts(1), WithRegistryLimit(0))
+	defer q.Close()
+
+	for i := 0; i < 20; i++ {
+		mustEnqueue(t, q, Job{Source: fmt.Sprintf("r.io/app:%d", i), Driver: "nydus"})
+		mustDequeue(t, q)
+	}
+	pending := mustEnqueue(t, q, Job{Source: "r.io/app:pending", Driver: "nydus"})
+
+	// Every expired job is dead-lettered in the same pass that leases
+	c.Advance(2 * time.Minute)
+	if job := mustDequeue(t, q); job == nil || job.ID != pending.ID {
+		t.Fatalf("expected %s, got %+v", pending.ID, job)
+	}
+	stats, err := q.Stats()
+	if err != nil {
+		t.Fatalf("Stats failed: %v", err)
+	}
+	if stats[StateDead] != 20 || stats[StateRunning] != 1 {
+		t.Errorf("expected 20 dead and 1 running, got %v", stats)
+	}
+}
+
+func TestQueue_Prune(t *testing.T) {
+	c := newClock()
+	q := openTestQueue(t, filepath.Join(t.TempDir(), "queue.db"), c,
+		WithMaxAttempts(1), WithRetention(24*time.Hour), WithRegistryLimit(0))
+	defer q.Close()
+
+	dgst := digest.FromString("image")
+	done := mustEnqueue(t, q, Job{Source: "r.io/app:1", Driver: "nydus", SourceDigest: dgst})
+	dead := mustEnqueue(t, q, Job{Source: "r.io/app:2", Driver: "nydus"})
+	pending := mustEnqueue(t, q, Job{Source: "r.io/app:3", Driver: "nydus", Priority: -1})
+
+	if job := mustDequeue(t, q); job.ID != done.ID || q.Complete(job.ID, "r.io/app:1-nydus") != nil {
+		t.Fatalf("failed to complete %s", done.ID)
+	}
+	if job := mustDequeue(t, q); job.ID != dead.ID || q.Fail(job.ID, errors.New("boom")) != nil {
+		t.Fatalf("failed to dead-letter %s", dead.ID)
+	}
+
+	if n, err := q.Prune(); err != nil || n != 0 {
+		t.Errorf("expected nothing pruned within the retention, got %d (%v)", n, err)
+	}
+
+	c.Advance(25 * time.Hour)
+	if n, err := q.Prune(); err != nil || n != 2 {
+		t.Fatalf("expected 2 jobs pruned, got %d (%v)", n, err)
+	}
+	if _, err := q.Get(done.ID); !errors.Is(err, ErrJobNotFound) {
+		t.Errorf("expected %s to be pruned, got %v", done.ID, err)
+	}
+	if job, err := q.Get(pending.ID); err != nil || job.State != StatePending {
+		t.Errorf("expected pending job to be kept, got %+v (%v)", job, err)
+	}
+
+	// The pruned job no longer answers for its digest
+	if _, created, _ := q.Enqueue(Job{Source: "r.io/app:1", Driver: "nydus", SourceDigest: dgst}); !created {
+		t.Error("expected new job after pruning")
+	}
+}
+
+func TestQueue_ActiveIndexRebuilt(t *testing.T) {
+	c := newClock()
+	path := filepath.Join(t.TempDir(), "queue.db")
+	q := openTestQueue(t, path, c)
+	done := mustEnqueue(t, q, Job{Source: "r.io/app:1", Driver: "nydus"})
+	pending := mustEnqueue(t, q, Job{Source: "r.io/app:2", Driver: "nydus"})
+	if job := mustDequeue(t, q); job.ID != done.ID || q.Complete(job.ID, "r.io/app:1-nydus") != nil {
+		t.Fatalf("failed to complete %s", done.ID)
+	}
+	q.Close()
+
+	// Drop the index, as in a queue written before it existed
+	db, err := bolt.Open(path, 0o600, nil)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error { return tx.DeleteBucket(activeBucket) }); err != nil {
+		t.Fatalf("failed to drop index: %v", err)
+	}
+	db.Close()
+
+	q = openTestQueue(t, path, c)
+	defer q.Close()
+	if job := mustDequeue(t, q); job == nil || job.ID != pending.ID {
+		t.Fatalf("expected %s, got %+v", pending.ID, job)
+	}
+	if job := mustDequeue(t, q); job != nil {
+		t.Errorf("expected no more jobs, got %s", job.ID)
+	}
+}
+
+func TestQueue_Errors(t *testing.T) {
+	c := newClock()
+	q := openTestQueue(t, filepath.Join(t.TempDir(), "queue.db"), c)
+	defer q.Close()
+
+	if _, _, err := q.Enqueue(Job{Source: "r.io/app:1"}); err == nil {
+		t.Error("expected error for job without driver")
+	}
+	if _, err := q.Get("job-42"); !errors.Is(err, ErrJobNotFound) {
+		t.Errorf("expected ErrJobNotFound, got %v", err)
+	}
+	if err := q.Fail("job-42", errors.New("boom")); !errors.Is(err, ErrJobNotFound) {
+		t.Errorf("expected ErrJobNotFound, got %v", err)
+	}
+}
+
+func TestQueue_Process(t *testing.T) {
+	q, err := Open(filepath.Join(t.TempDir(), "queue.db"), WithRegistryLimit(0), WithMaxAttempts(1))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer q.Close()
+
+	ok := mustEnqueue(t, q, Job{Source: "r.io/app:ok", Driver: "nydus"})
+	bad := mustEnqueue(t, q, Job{Source: "r.io/app:bad", Driver: "nydus"})
+
+	handler := func(ctx context.Context, job *Job) (string, error) {
+		if job.ID == bad.ID {
+			return "", errors.New("conversion failed")
+		}
+		return job.Source + "-nydus", nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	finished := make(chan struct{})
+	go func() {
+		q.Process(ctx, 2, 10*time.Millisecond, handler)
+		close(finished)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats, err := q.Stats()
+		if err != nil {
+			t.Fatalf("Stats failed: %v", err)
+		}
+		if stats[StateSucceeded]+stats[StateDead] == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("jobs did not finish: %v", stats)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Process did not return after cancellation")
+	}
+
+	if job, _ := q.Get(ok.ID); job.State != StateSucceeded || job.Result != "r.io/app:ok-nydus" {
+		t.Errorf("expected %s to succeed, got %s %q", ok.ID, job.State, job.Result)
+	}
+	if job, _ := q.Get(bad.ID); job.State != StateDead || job.LastError != "conversion failed" {
+		t.Errorf("expected %s dead-lettered, got %s %q", bad.ID, job.State, job.LastError)
+	}
+}
+
+func TestQueue_ProcessCancelled(t *testing.T) {
+	q, err := Open(filepath.Join(t.TempDir(), "queue.db"), WithRegistryLimit(0))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer q.Close()
+
+	var ids []string
+	for _, tag := range []string{"a", "b", "c", "d", "e"} {
+		ids = append(ids, mustEnqueue(t, q, Job{Source: "r.io/app:" + tag, Driver: "nydus"}).ID)
+	}
+
+	// The first job is interrupted while it runs, the others never start
+	started := make(chan struct{})
+	handler := func(ctx context.Context, job *Job) (string, error) {
+		close(started)
+		<-ctx.Done()
+		return "", ctx.Err()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	finished := make(chan struct{})
+	go func() {
+		q.Process(ctx, 1, 10*time.Millisecond, handler)
+		close(finished)
+	}()
+
+	<-started
+	cancel()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Process did not return after cancellation")
+	}
+
+	for _, id := range ids {
+		if job, _ := q.Get(id); job.State != StatePending || job.Attempts != 0 || !job.LeaseUntil.IsZero() {
+			t.Errorf("expected %s pending with no attempts, got %s with %d", id, job.State, job.Attempts)
+		}
+	}
+
+	// A cancelled context leases nothing
+	q.Process(ctx, 2, 10*time.Millisecond, handler)
+	if stats, _ := q.Stats(); stats[StatePending] != 5 {
+		t.Errorf("expected 5 pending jobs, got %v", stats)
+	}
+}
+
+func TestQueue_Release(t *testing.T) {
+	c := newClock()
+	q := openTestQueue(t, filepath.Join(t.TempDir(), "queue.db"), c)
+	defer q.Close()
+
+	queued := mustEnqueue(t, q, Job{Source: "r.io/app:1", Driver: "nydus"})
+	mustDequeue(t, q)
+	if err := q.Release(queued.ID); err != nil {
+		t.Fatalf("Release failed: %v", err)
+	}
+	if job := mustDequeue(t, q); job == nil || job.ID != queued.ID || job.Attempts != 1 {
+		t.Errorf("expected %s leased again on its first attempt, got %+v", queued.ID, job)
+	}
+
+	q.Complete(queued.ID, "done")
+	if err := q.Release(queued.ID); !errors.Is(err, ErrNotLeased) {
+		t.Errorf("expected ErrNotLeased, got %v", err)
+	}
+	if _, err := Open(filepath.Join(t.TempDir(), "other.db"), WithVisibilityTimeout(0)); err == nil {
+		t.Error("expected an error for a zero visibility timeout")
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2021 vjranagit
+//
+// Selection of the images a batch conversion enqueues
+
+package accelerator
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/vjranagit/harbor/pkg/distribution"
+)
+
+// Selection chooses images from the registry catalog
+type Selection struct {
+	// Repositories is a path.Match pattern over repository names, e.g.
+	// "library/*"; * does not cross a /
+	Repositories string
+	// Tags is a path.Match pattern over tags; empty matches every tag
+	Tags string
+}
+
+// Candidate is a selected image and the manifest its tag resolves to
+type Candidate struct {
+	Reference distribution.Reference
+	Digest    digest.Digest
+}
+
+// Select lists the images matching sel, skipping tags that are themselves
+// conversions (those ending in a driver tag suffix)
+func (c *Converter) Select(ctx context.Context, sel Selection) ([]Candidate, error) {
+	if sel.Repositories == "" {
+		return nil, fmt.Errorf("repository pattern is required")
+	}
+	for _, pattern := range []string{sel.Repositories, sel.Tags} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+
+	repos, err := c.client.Catalog(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list repositories: %w", err)
+	}
+
+	var candidates []Candidate
+	for _, repo := range repos {
+		if ok, _ := path.Match(sel.Repositories, repo); !ok {
+			continue
+		}
+
+		tags, err := c.client.ListTags(ctx, repo)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list tags of %s: %w", repo, err)
+		}
+		for _, tag := range tags {
+			if sel.Tags != "" {
+				if ok, _ := path.Match(sel.Tags, tag); !ok {
+					continue
+				}
+			}
+			if c.isConverted(tag) {
+				continue
+			}
+
+			desc, err := c.client.HeadManifest(ctx, repo, tag)
+			if err != nil {
+				return nil, fmt.Errorf("failed to resolve %s:%s: %w", repo, tag, err)
+			}
+			candidates = append(candidates, Candidate{
+				Reference: distribution.Reference{Registry: c.client.Registry(), Repository: repo, Tag: tag},
+				Digest:    desc.Digest,
+			})
+		}
+	}
+
+	c.logger.DebugContext(ctx, "images selected",
+		"repositories", sel.Repositories, "tags", sel.Tags, "candidates", len(candidates))
+	return candidates, nil
+}
+
+// isConverted reports whether tag names the output of a conversion
+func (c *Converter) isConverted(tag string) bool {
+	for _, suffix := range c.suffixes {
+		if suffix != "" && strings.HasSuffix(tag, suffix) {
+			return true
+		}
+	}
+	for name := range c.drivers {
+		if _, ok := c.suffixes[name]; !ok && strings.HasSuffix(tag, "-"+name) {
+			return true
+		}
+	}
+	return false
+}
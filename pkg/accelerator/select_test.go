@@ -0,0 +1,98 @@
+// Copyright 2021 vjranagit
+//
+// Batch selection tests
+
+package accelerator
+
+import (
+	"context"
+	"testing"
+
+	"github.com/vjranagit/harbor/pkg/distribution/registrytest"
+)
+
+func TestConverter_Select(t *testing.T) {
+	reg := registrytest.New(registrytest.WithPageSize(2))
+	defer reg.Close()
+
+	images := map[string][]string{
+		"library/app":   {"v1", "v2", "v1-esgz", "v1-nydus", "latest"},
+		"library/web":   {"v1"},
+		"team/api":      {"v1"},
+		"library/a/b/c": {"v1"},
+	}
+	digests := make(map[string]string)
+	for repo, tags := range images {
+		for _, tag := range tags {
+			digests[repo+":"+tag] = pushTestImage(t, reg, repo, tag, "amd64").Digest.String()
+		}
+	}
+
+	c := newTestConverter(t, reg)
+	tests := []struct {
+		name string
+		sel  Selection
+		want []string
+	}{
+		{
+			name: "every tag of matching repositories",
+			sel:  Selection{Repositories: "library/*"},
+			want: []string{"library/app:latest", "library/app:v1", "library/app:v2", "library/web:v1"},
+		},
+		{
+			name: "tag pattern",
+			sel:  Selection{Repositories: "library/*", Tags: "v*"},
+			want: []string{"library/app:v1", "library/app:v2", "library/web:v1"},
+		},
+		{
+			name: "exact repository",
+			sel:  Selection{Repositories: "team/api"},
+			want: []string{"team/api:v1"},
+		},
+		{
+			name: "no match",
+			sel:  Selection{Repositories: "other/*"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			candidates, err := c.Select(context.Background(), tt.sel)
+			if err != nil {
+				t.Fatalf("Select failed: %v", err)
+			}
+			if len(candidates) != len(tt.want) {
+				t.Fatalf("expected %d candidates, got %d: %v", len(tt.want), len(candidates), candidates)
+			}
+			for i, want := range tt.want {
+				got := candidates[i]
+				if got.Reference.Registry != reg.Host() {
+					t.Errorf("expected registry %s, got %s", reg.Host(), got.Reference.Registry)
+				}
+				name := got.Reference.Repository + ":" + got.Reference.Tag
+				if name != want {
+					t.Errorf("candidate %d: expected %s, got %s", i, want, name)
+				}
+				if got.Digest.String() != digests[name] {
+					t.Errorf("%s: expected digest %s, got %s", name, digests[name], got.Digest)
+				}
+			}
+		})
+	}
+}
+
+func TestConverter_SelectErrors(t *testing.T) {
+	reg := registrytest.New()
+	defer reg.Close()
+
+	c := newTestConverter(t, reg)
+	for _, sel := range []Selection{
+		{},
+		{Repositories: "library/["},
+		{Repositories: "library/*", Tags: "v[1"},
+	} {
+		if _, err := c.Select(context.Background(), sel); err == nil {
+			t.Errorf("expected error for %+v", sel)
+		}
+	}
+}
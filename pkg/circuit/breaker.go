@@ -0,0 +1,346 @@
+// Copyright 2021 vjranagit
+//
+// Circuit breaker with half-open probing and adaptive backoff
+
+package circuit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// State is the state of a circuit
+type State string
+
+const (
+	Closed   State = "closed"
+	HalfOpen State = "half_open"
+	Open     State = "open"
+)
+
+// Defaults used by DefaultSettings
+const (
+	DefaultFailureThreshold = 5
+	DefaultSuccessThreshold = 2
+	DefaultRetryDelay       = 30 * time.Second
+	DefaultMaxRetryDelay    = 5 * time.Minute
+)
+
+var (
+	// ErrOpen is returned for calls an open circuit rejects
+	ErrOpen = errors.New("circuit open")
+	// ErrSlow marks successful calls slower than the slow threshold, which
+	// the breaker counts as failures
+	ErrSlow = errors.New("slow response")
+)
+
+// Settings configures a Breaker
+type Settings struct {
+	// FailureThreshold is how many consecutive failures open the circuit
+	FailureThreshold int
+	// SuccessThreshold is how many consecutive successful probes close a
+	// half-open circuit
+	SuccessThreshold int
+	// RetryDelay is how long the circuit stays open before the first
+	// probe. It doubles every time a probe fails, up to MaxRetryDelay; a
+	// MaxRetryDelay below RetryDelay keeps it fixed
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+	// SlowThreshold counts successful calls slower than it as failures;
+	// zero disables it
+	SlowThreshold time.Duration
+}
+
+// DefaultSettings opens after 5 failures and closes after 2 successful
+// probes, waiting 30s to 5m in between
+func DefaultSettings() Settings {
+	return Settings{
+		FailureThreshold: DefaultFailureThreshold,
+		SuccessThreshold: DefaultSuccessThreshold,
+		RetryDelay:       DefaultRetryDelay,
+		MaxRetryDelay:    DefaultMaxRetryDelay,
+	}
+}
+
+// Validate reports settings a breaker cannot work with
+func (s Settings) Validate() error {
+	switch {
+	case s.FailureThreshold < 1:
+		return fmt.Errorf("failure threshold must be at least 1")
+	case s.SuccessThreshold < 1:
+		return fmt.Errorf("success threshold must be at least 1")
+	case s.RetryDelay < 0:
+		return fmt.Errorf("retry delay must not be negative")
+	case s.MaxRetryDelay < 0:
+		return fmt.Errorf("max retry delay must not be negative")
+	case s.SlowThreshold < 0:
+		return fmt.Errorf("slow threshold must not be negative")
+	}
+	return nil
+}
+
+// retryDelay returns the open interval after trips consecutive openings
+func (s Settings) retryDelay(trips int) time.Duration {
+	d := s.RetryDelay
+	for i := 1; i < trips && d < s.MaxRetryDelay; i++ {
+		d *= 2
+	}
+	if d > s.MaxRetryDelay && s.MaxRetryDelay >= s.RetryDelay {
+		d = s.MaxRetryDelay
+	}
+	return d
+}
+
+// Status is a breaker's state and counters at one point in time
+type Status struct {
+	State State
+	// Failures counts consecutive failures while closed, Successes
+	// consecutive successful probes while half-open
+	Failures  int
+	Successes int
+	// Trips counts the openings since the circuit last closed
+	Trips int
+	// RetryDelay is the current open interval and RetryAt when an open
+	// circuit admits the next probe, zero unless open
+	RetryDelay time.Duration
+	RetryAt    time.Time
+}
+
+// Breaker stops calls to a failing dependency. After FailureThreshold
+// consecutive failures it opens and rejects calls for the retry delay,
+// then turns half-open and admits one probe at a time. SuccessThreshold
+// successful probes in a row close it; a failed probe opens it again for
+// twice as long
+type Breaker struct {
+	mu       sync.Mutex
+	settings Settings
+	state    State
+	// generation changes with every transition, so results of calls
+	// admitted in an earlier state are ignored
+	generation uint64
+	failures   int
+	successes  int
+	trips      int
+	probing    bool
+	openedAt   time.Time
+
+	now      func() time.Time
+	onChange func(from, to State)
+}
+
+// Option configures a Breaker
+type Option func(*Breaker)
+
+// WithClock replaces the time source, for tests
+func WithClock(now func() time.Time) Option {
+	return func(b *Breaker) {
+		b.now = now
+	}
+}
+
+// WithStateChange calls fn after every transition, outside the breaker's
+// lock
+func WithStateChange(fn func(from, to State)) Option {
+	return func(b *Breaker) {
+		b.onChange = fn
+	}
+}
+
+// New creates a closed breaker. Thresholds below 1 are raised to 1
+func New(settings Settings, opts ...Option) *Breaker {
+	b := &Breaker{
+		settings: normalize(settings),
+		state:    Closed,
+		now:      time.Now,
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
+func normalize(s Settings) Settings {
+	s.FailureThreshold = max(s.FailureThreshold, 1)
+	s.SuccessThreshold = max(s.SuccessThreshold, 1)
+	return s
+}
+
+// Settings returns the breaker's settings
+func (b *Breaker) Settings() Settings {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.settings
+}
+
+// Configure replaces the settings, keeping state and counters. A new retry
+// delay applies to an open circuit right away
+func (b *Breaker) Configure(settings Settings) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.settings = normalize(settings)
+}
+
+// State returns the current state; an open circuit whose retry delay has
+// passed stays open until the next call is allowed
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Status returns the state and counters
+func (b *Breaker) Status() Status {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := Status{
+		State:     b.state,
+		Failures:  b.failures,
+		Successes: b.successes,
+		Trips:     b.trips,
+	}
+	if b.trips > 0 {
+		s.RetryDelay = b.settings.retryDelay(b.trips)
+	}
+	if b.state == Open {
+		s.RetryAt = b.openedAt.Add(s.RetryDelay)
+	}
+	return s
+}
+
+// Call is a call the breaker admitted; its outcome must be reported with
+// Done
+type Call struct {
+	b          *Breaker
+	generation uint64
+	probe      bool
+	start      time.Time
+}
+
+// Allow admits a call, turning an open circuit half-open once its retry
+// delay has passed. It returns an error wrapping ErrOpen while the circuit
+// is open or a half-open probe is in flight
+func (b *Breaker) Allow() (*Call, error) {
+	b.mu.Lock()
+
+	now := b.now()
+	switch b.state {
+	case Open:
+		retryAt := b.openedAt.Add(b.settings.retryDelay(b.trips))
+		if now.Before(retryAt) {
+			b.mu.Unlock()
+			return nil, fmt.Errorf("%w, retrying in %s", ErrOpen, retryAt.Sub(now).Round(time.Millisecond))
+		}
+		from := b.transition(HalfOpen)
+		b.probing = true
+		call := &Call{b: b, generation: b.generation, probe: true, start: now}
+		b.mu.Unlock()
+		b.notify(from, HalfOpen)
+		return call, nil
+
+	case HalfOpen:
+		if b.probing {
+			b.mu.Unlock()
+			return nil, fmt.Errorf("%w, probe in flight", ErrOpen)
+		}
+		b.probing = true
+		call := &Call{b: b, generation: b.generation, probe: true, start: now}
+		b.mu.Unlock()
+		return call, nil
+	}
+
+	call := &Call{b: b, generation: b.generation, start: now}
+	b.mu.Unlock()
+	return call, nil
+}
+
+// Done records the outcome of the call, timed from Allow. It returns err,
+// or an error wrapping ErrSlow when a successful call took longer than the
+// slow threshold. Cancelled calls only release their probe; results of
+// calls admitted before the last transition are ignored
+func (c *Call) Done(err error) error {
+	b := c.b
+	b.mu.Lock()
+
+	latency := b.now().Sub(c.start)
+	if err == nil && b.settings.SlowThreshold > 0 && latency > b.settings.SlowThreshold {
+		err = fmt.Errorf("%w: %s exceeds %s", ErrSlow, latency.Round(time.Millisecond), b.settings.SlowThreshold)
+	}
+
+	if c.generation != b.generation {
+		b.mu.Unlock()
+		return err
+	}
+	if c.probe {
+		b.probing = false
+	}
+	if errors.Is(err, context.Canceled) {
+		b.mu.Unlock()
+		return err
+	}
+
+	from, to := b.state, b.state
+	switch {
+	case err != nil && b.state == HalfOpen:
+		b.trips++
+		to = b.open()
+	case err != nil:
+		b.failures++
+		if b.failures >= b.settings.FailureThreshold {
+			b.trips = 1
+			to = b.open()
+		}
+	case b.state == HalfOpen:
+		b.successes++
+		if b.successes >= b.settings.SuccessThreshold {
+			b.trips = 0
+			b.transition(Closed)
+			to = Closed
+		}
+	default:
+		b.failures = 0
+	}
+	b.mu.Unlock()
+
+	if to != from {
+		b.notify(from, to)
+	}
+	return err
+}
+
+// Do runs fn if the circuit admits it and records its outcome
+func (b *Breaker) Do(fn func() error) error {
+	call, err := b.Allow()
+	if err != nil {
+		return err
+	}
+	return call.Done(fn())
+}
+
+// open opens the circuit; callers hold the lock and set trips first
+func (b *Breaker) open() State {
+	b.transition(Open)
+	b.openedAt = b.now()
+	return Open
+}
+
+// transition moves to state, resetting the counters, and returns the
+// previous state; callers hold the lock
+func (b *Breaker) transition(state State) State {
+	from := b.state
+	b.state = state
+	b.generation++
+	b.failures = 0
+	b.successes = 0
+	b.probing = false
+	return from
+}
+
+func (b *Breaker) notify(from, to State) {
+	if b.onChange != nil {
+		b.onChange(from, to)
+	}
+}
@@ -0,0 +1,251 @@
+// Copyright 2021 vjranagit
+//
+// Circuit breaker tests
+
+package circuit
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errDown = errors.New("connection refused")
+
+// clock is a manually advanced time source
+type clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newClock() *clock {
+	return &clock{now: time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// newTestBreaker opens after 2 failures, closes after 2 probes and waits
+// 1m to 4m in between
+func newTestBreaker(c *clock, opts ...Option) *Breaker {
+	settings := Settings{FailureThreshold: 2, SuccessThreshold: 2, RetryDelay: time.Minute, MaxRetryDelay: 4 * time.Minute}
+	return New(settings, append([]Option{WithClock(c.Now)}, opts...)...)
+}
+
+// call runs one call that fails with err, returning the Allow error
+func call(b *Breaker, err error) error {
+	return b.Do(func() error { return err })
+}
+
+func TestBreaker_Opens(t *testing.T) {
+	c := newClock()
+	b := newTestBreaker(c)
+
+	call(b, errDown)
+	call(b, nil) // a success resets the count
+	call(b, errDown)
+	if b.State() != Closed {
+		t.Fatalf("expected closed after non-consecutive failures, got %s", b.State())
+	}
+
+	call(b, errDown)
+	if b.State() != Open {
+		t.Fatalf("expected open after 2 consecutive failures, got %s", b.State())
+	}
+	if err := call(b, nil); !errors.Is(err, ErrOpen) {
+		t.Errorf("expected ErrOpen, got %v", err)
+	}
+
+	status := b.Status()
+	if status.Trips != 1 || status.RetryDelay != time.Minute || !status.RetryAt.Equal(c.Now().Add(time.Minute)) {
+		t.Errorf("expected a 1m retry, got %+v", status)
+	}
+}
+
+func TestBreaker_HalfOpenQuota(t *testing.T) {
+	c := newClock()
+	b := newTestBreaker(c)
+	call(b, errDown)
+	call(b, errDown)
+
+	c.Advance(time.Minute)
+	probe, err := b.Allow()
+	if err != nil || b.State() != HalfOpen {
+		t.Fatalf("expected a probe once the retry delay passed, got %s (%v)", b.State(), err)
+	}
+
+	// One probe at a time
+	if _, err := b.Allow(); !errors.Is(err, ErrOpen) {
+		t.Errorf("expected a second probe to be rejected, got %v", err)
+	}
+
+	probe.Done(nil)
+	if b.State() != HalfOpen {
+		t.Fatalf("expected half-open after 1 of 2 probes, got %s", b.State())
+	}
+	call(b, nil)
+	if status := b.Status(); status.State != Closed || status.Trips != 0 {
+		t.Errorf("expected closed with the trips reset, got %+v", status)
+	}
+}
+
+func TestBreaker_Backoff(t *testing.T) {
+	c := newClock()
+	b := newTestBreaker(c)
+	call(b, errDown)
+	call(b, errDown)
+
+	// Every failed probe doubles the delay, up to the maximum
+	for _, want := range []time.Duration{2 * time.Minute, 4 * time.Minute, 4 * time.Minute} {
+		c.Advance(b.Status().RetryDelay)
+		if err := call(b, errDown); err == nil || errors.Is(err, ErrOpen) {
+			t.Fatalf("expected the probe to run and fail, got %v", err)
+		}
+		if got := b.Status(); got.State != Open || got.RetryDelay != want {
+			t.Errorf("expected open for %s, got %+v", want, got)
+		}
+		c.Advance(want - time.Second)
+		if err := call(b, nil); !errors.Is(err, ErrOpen) {
+			t.Errorf("expected ErrOpen before %s passed, got %v", want, err)
+		}
+		c.Advance(time.Second)
+	}
+
+	// Closing resets the delay
+	call(b, nil)
+	call(b, nil)
+	call(b, errDown)
+	call(b, errDown)
+	if got := b.Status(); got.State != Open || got.RetryDelay != time.Minute {
+		t.Errorf("expected the delay reset to 1m, got %+v", got)
+	}
+}
+
+func TestSettings_RetryDelay(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings Settings
+		trips    int
+		want     time.Duration
+	}{
+		{"first", Settings{RetryDelay: time.Second, MaxRetryDelay: time.Minute}, 1, time.Second},
+		{"doubled", Settings{RetryDelay: time.Second, MaxRetryDelay: time.Minute}, 4, 8 * time.Second},
+		{"capped", Settings{RetryDelay: time.Second, MaxRetryDelay: 10 * time.Second}, 5, 10 * time.Second},
+		{"fixed", Settings{RetryDelay: time.Hour, MaxRetryDelay: time.Minute}, 5, time.Hour},
+		{"no maximum", Settings{RetryDelay: time.Second}, 5, time.Second},
+	}
+
+	for _, tt := range tests {
+		if got := tt.settings.retryDelay(tt.trips); got != tt.want {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestBreaker_SlowCalls(t *testing.T) {
+	c := newClock()
+	b := newTestBreaker(c)
+	b.Configure(Settings{FailureThreshold: 2, SuccessThreshold: 1, RetryDelay: time.Minute, SlowThreshold: time.Second})
+
+	slow := func() error {
+		c.Advance(2 * time.Second)
+		return nil
+	}
+	if err := b.Do(slow); !errors.Is(err, ErrSlow) {
+		t.Errorf("expected ErrSlow, got %v", err)
+	}
+	b.Do(slow)
+	if b.State() != Open {
+		t.Errorf("expected slow calls to open the circuit, got %s", b.State())
+	}
+
+	c.Advance(time.Minute)
+	if err := b.Do(func() error { c.Advance(time.Second); return nil }); err != nil || b.State() != Closed {
+		t.Errorf("expected a call at the threshold to close the circuit, got %s (%v)", b.State(), err)
+	}
+}
+
+func TestBreaker_IgnoredResults(t *testing.T) {
+	c := newClock()
+	b := newTestBreaker(c)
+
+	// A call admitted while closed finishes after the circuit opened
+	late, _ := b.Allow()
+	call(b, errDown)
+	call(b, errDown)
+	c.Advance(time.Minute)
+	probe, _ := b.Allow()
+	late.Done(nil)
+	if status := b.Status(); status.Successes != 0 {
+		t.Errorf("expected the late result ignored, got %+v", status)
+	}
+
+	// A cancelled probe frees the slot without counting
+	probe.Done(context.Canceled)
+	if status := b.Status(); status.State != HalfOpen || status.Trips != 1 {
+		t.Errorf("expected still half-open, got %+v", status)
+	}
+	if _, err := b.Allow(); err != nil {
+		t.Errorf("expected a new probe after cancellation, got %v", err)
+	}
+}
+
+func TestBreaker_StateChange(t *testing.T) {
+	c := newClock()
+	var got []State
+	b := newTestBreaker(c, WithStateChange(func(from, to State) {
+		got = append(got, from, to)
+	}))
+
+	call(b, errDown)
+	call(b, errDown)
+	c.Advance(time.Minute)
+	call(b, nil)
+	call(b, nil)
+
+	want := []State{Closed, Open, Open, HalfOpen, HalfOpen, Closed}
+	if len(got) != len(want) {
+		t.Fatalf("expected transitions %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("expected transitions %v, got %v", want, got)
+			break
+		}
+	}
+}
+
+func TestSettings_Validate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*Settings)
+	}{
+		{"failure threshold", func(s *Settings) { s.FailureThreshold = 0 }},
+		{"success threshold", func(s *Settings) { s.SuccessThreshold = 0 }},
+		{"retry delay", func(s *Settings) { s.RetryDelay = -time.Second }},
+		{"max retry delay", func(s *Settings) { s.MaxRetryDelay = -time.Second }},
+		{"slow threshold", func(s *Settings) { s.SlowThreshold = -time.Second }},
+	}
+
+	if err := DefaultSettings().Validate(); err != nil {
+		t.Fatalf("expected the defaults to be valid, got %v", err)
+	}
+	for _, tt := range tests {
+		s := DefaultSettings()
+		tt.modify(&s)
+		if err := s.Validate(); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,986 @@
+// Copyright 2021 vjranagit
+//
+// HCL configuration loader
+
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/hashicorp/hcl/v2/hclparse"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/function"
+)
+
+// Error reports every problem found in a configuration file, each with
+// its file:line,column position
+type Error struct {
+	Diagnostics hcl.Diagnostics
+}
+
+func (e *Error) Error() string {
+	var lines []string
+	for _, d := range e.Diagnostics {
+		if d.Severity != hcl.DiagError {
+			continue
+		}
+		if d.Subject != nil {
+			lines = append(lines, fmt.Sprintf("%s: %s; %s", d.Subject, d.Summary, d.Detail))
+		} else {
+			lines = append(lines, fmt.Sprintf("%s; %s", d.Summary, d.Detail))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Raw HCL shapes; attributes that need more than a type conversion are
+// kept as expressions so errors can point at them
+
+type fileHCL struct {
+	Registries []*registryHCL `hcl:"registry,block"`
+	Harbors    []*harborHCL   `hcl:"harbor,block"`
+}
+
+type registryHCL struct {
+	Name       string         `hcl:"name,label"`
+	Address    string         `hcl:"address,optional"`
+	Username   string         `hcl:"username,optional"`
+	Password   string         `hcl:"password,optional"`
+	Protection *protectionHCL `hcl:"protection,block"`
+	Batch      *batchHCL      `hcl:"batch,block"`
+	Health     *healthHCL     `hcl:"health,block"`
+	Body       hcl.Body       `hcl:",body"`
+}
+
+type protectionHCL struct {
+	Store    string       `hcl:"store,optional"`
+	Policies []*policyHCL `hcl:"policy,block"`
+}
+
+type policyHCL struct {
+	Name        string         `hcl:"name,label"`
+	Pattern     hcl.Expression `hcl:"pattern,optional"`
+	Immutable   bool           `hcl:"immutable,optional"`
+	MaxAge      hcl.Expression `hcl:"max_age,optional"`
+	AllowDelete bool           `hcl:"allow_delete,optional"`
+	Priority    hcl.Expression `hcl:"priority,optional"`
+	Body        hcl.Body       `hcl:",body"`
+}
+
+type batchHCL struct {
+	Workers    hcl.Expression `hcl:"workers,optional"`
+	Timeout    hcl.Expression `hcl:"timeout,optional"`
+	Attempts   hcl.Expression `hcl:"attempts,optional"`
+	Backoff    hcl.Expression `hcl:"backoff,optional"`
+	MaxBackoff hcl.Expression `hcl:"max_backoff,optional"`
+}
+
+type healthHCL struct {
+	Endpoints  []string       `hcl:"endpoints,optional"`
+	Threshold  hcl.Expression `hcl:"threshold,optional"`
+	RetryDelay hcl.Expression `hcl:"retry_delay,optional"`
+	Timeout    hcl.Expression `hcl:"timeout,optional"`
+	Interval   hcl.Expression `hcl:"interval,optional"`
+
+	MaxRetryDelay    hcl.Expression `hcl:"max_retry_delay,optional"`
+	SuccessThreshold hcl.Expression `hcl:"success_threshold,optional"`
+	SlowThreshold    hcl.Expression `hcl:"slow_threshold,optional"`
+
+	Notify *notifyHCL `hcl:"notify,block"`
+}
+
+type notifyHCL struct {
+	RenotifyInterval hcl.Expression `hcl:"renotify_interval,optional"`
+	FlapWindow       hcl.Expression `hcl:"flap_window,optional"`
+	FlapThreshold    hcl.Expression `hcl:"flap_threshold,optional"`
+	Webhooks         []*webhookHCL  `hcl:"webhook,block"`
+	Slack            []*slackHCL    `hcl:"slack,block"`
+	Email            []*emailHCL    `hcl:"email,block"`
+	Exec             []*execHCL     `hcl:"exec,block"`
+	Body             hcl.Body       `hcl:",body"`
+}
+
+type webhookHCL struct {
+	Name    string            `hcl:"name,label"`
+	URL     hcl.Expression    `hcl:"url"`
+	Headers map[string]string `hcl:"headers,optional"`
+}
+
+type slackHCL struct {
+	Name string         `hcl:"name,label"`
+	URL  hcl.Expression `hcl:"url"`
+}
+
+type emailHCL struct {
+	Name     string         `hcl:"name,label"`
+	SMTP     hcl.Expression `hcl:"smtp"`
+	From     string         `hcl:"from"`
+	To       []string       `hcl:"to"`
+	Username string         `hcl:"username,optional"`
+	Password string         `hcl:"password,optional"`
+	Body     hcl.Body       `hcl:",body"`
+}
+
+type execHCL struct {
+	Name    string   `hcl:"name,label"`
+	Command []string `hcl:"command"`
+	Body    hcl.Body `hcl:",body"`
+}
+
+type harborHCL struct {
+	Name          string         `hcl:"name,label"`
+	Hostname      string         `hcl:"hostname,optional"`
+	ExternalURL   string         `hcl:"external_url,optional"`
+	Version       string         `hcl:"version,optional"`
+	AdminPassword string         `hcl:"admin_password,optional"`
+	DataDir       string         `hcl:"data_dir,optional"`
+	HTTP          *httpHCL       `hcl:"http,block"`
+	HTTPS         *httpsHCL      `hcl:"https,block"`
+	Database      *databaseHCL   `hcl:"database,block"`
+	Redis         *redisHCL      `hcl:"redis,block"`
+	Storage       *storageHCL    `hcl:"storage,block"`
+	Jobservice    *jobserviceHCL `hcl:"jobservice,block"`
+	Log           *logHCL        `hcl:"log,block"`
+	Kubernetes    *kubernetesHCL `hcl:"kubernetes,block"`
+	Body          hcl.Body       `hcl:",body"`
+}
+
+type httpHCL struct {
+	Port hcl.Expression `hcl:"port,optional"`
+}
+
+type httpsHCL struct {
+	Port        hcl.Expression `hcl:"port,optional"`
+	Certificate string         `hcl:"certificate"`
+	PrivateKey  string         `hcl:"private_key"`
+}
+
+type databaseHCL struct {
+	Host         string         `hcl:"host,optional"`
+	Port         hcl.Expression `hcl:"port,optional"`
+	Username     string         `hcl:"username,optional"`
+	Name         string         `hcl:"name,optional"`
+	SSLMode      hcl.Expression `hcl:"ssl_mode,optional"`
+	Password     string         `hcl:"password,optional"`
+	MaxIdleConns hcl.Expression `hcl:"max_idle_conns,optional"`
+	MaxOpenConns hcl.Expression `hcl:"max_open_conns,optional"`
+	Body         hcl.Body       `hcl:",body"`
+}
+
+type redisHCL struct {
+	Address  hcl.Expression `hcl:"address,optional"`
+	Password string         `hcl:"password,optional"`
+}
+
+type storageHCL struct {
+	Filesystem *struct{} `hcl:"filesystem,block"`
+	S3         *s3HCL    `hcl:"s3,block"`
+	Azure      *azureHCL `hcl:"azure,block"`
+	Body       hcl.Body  `hcl:",body"`
+}
+
+type s3HCL struct {
+	Bucket        string `hcl:"bucket"`
+	Region        string `hcl:"region"`
+	Endpoint      string `hcl:"endpoint,optional"`
+	AccessKey     string `hcl:"access_key,optional"`
+	SecretKey     string `hcl:"secret_key,optional"`
+	RootDirectory string `hcl:"root_directory,optional"`
+}
+
+type azureHCL struct {
+	AccountName string `hcl:"account_name"`
+	AccountKey  string `hcl:"account_key"`
+	Container   string `hcl:"container"`
+}
+
+type kubernetesHCL struct {
+	Name               string            `hcl:"name,optional"`
+	Namespace          string            `hcl:"namespace,optional"`
+	IngressClass       string            `hcl:"ingress_class,optional"`
+	IngressAnnotations map[string]string `hcl:"ingress_annotations,optional"`
+	TLSSecret          string            `hcl:"tls_secret,optional"`
+	StorageClass       string            `hcl:"storage_class,optional"`
+	Components         []*componentHCL   `hcl:"component,block"`
+	Body               hcl.Body          `hcl:",body"`
+}
+
+type componentHCL struct {
+	Name       string         `hcl:"name,label"`
+	Replicas   hcl.Expression `hcl:"replicas,optional"`
+	Requests   *resourcesHCL  `hcl:"requests,block"`
+	Limits     *resourcesHCL  `hcl:"limits,block"`
+	VolumeSize hcl.Expression `hcl:"volume_size,optional"`
+	Body       hcl.Body       `hcl:",body"`
+}
+
+type resourcesHCL struct {
+	CPU    hcl.Expression `hcl:"cpu,optional"`
+	Memory hcl.Expression `hcl:"memory,optional"`
+}
+
+type jobserviceHCL struct {
+	Workers hcl.Expression `hcl:"workers,optional"`
+}
+
+type logHCL struct {
+	Level hcl.Expression `hcl:"level,optional"`
+}
+
+// Load reads and validates the configuration file at path
+func Load(path string) (*Config, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	return Parse(src, path)
+}
+
+// Parse decodes configuration source; filename is used in error positions
+// and relative store paths are resolved against its directory
+func Parse(src []byte, filename string) (*Config, error) {
+	file, diags := hclparse.NewParser().ParseHCL(src, filename)
+	if diags.HasErrors() {
+		return nil, &Error{Diagnostics: diags}
+	}
+
+	ctx := evalContext()
+
+	var raw fileHCL
+	if diags := gohcl.DecodeBody(file.Body, ctx, &raw); diags.HasErrors() {
+		return nil, &Error{Diagnostics: diags}
+	}
+
+	cfg := &Config{Path: filename}
+	seen := make(map[string]hcl.Range)
+	for _, r := range raw.Registries {
+		reg, regDiags := decodeRegistry(r, ctx, filepath.Dir(filename))
+		diags = append(diags, regDiags...)
+
+		rng := r.Body.MissingItemRange()
+		if prev, ok := seen[r.Name]; ok {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Duplicate registry block",
+				Detail:   fmt.Sprintf("registry %q was already defined at %s", r.Name, prev),
+				Subject:  &rng,
+			})
+			continue
+		}
+		seen[r.Name] = rng
+		cfg.Registries = append(cfg.Registries, reg)
+	}
+
+	seen = make(map[string]hcl.Range)
+	for _, h := range raw.Harbors {
+		harbor, harborDiags := decodeHarbor(h, ctx, filepath.Dir(filename))
+		diags = append(diags, harborDiags...)
+
+		rng := h.Body.MissingItemRange()
+		if prev, ok := seen[h.Name]; ok {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Duplicate harbor block",
+				Detail:   fmt.Sprintf("harbor %q was already defined at %s", h.Name, prev),
+				Subject:  &rng,
+			})
+			continue
+		}
+		seen[h.Name] = rng
+		cfg.Harbors = append(cfg.Harbors, harbor)
+	}
+
+	if diags.HasErrors() {
+		return nil, &Error{Diagnostics: diags}
+	}
+	return cfg, nil
+}
+
+// evalContext exposes env("NAME") so secrets can stay out of the file
+func evalContext() *hcl.EvalContext {
+	return &hcl.EvalContext{
+		Functions: map[string]function.Function{
+			"env": function.New(&function.Spec{
+				Params: []function.Parameter{{Name: "name", Type: cty.String}},
+				Type:   function.StaticReturnType(cty.String),
+				Impl: func(args []cty.Value, _ cty.Type) (cty.Value, error) {
+					return cty.StringVal(os.Getenv(args[0].AsString())), nil
+				},
+			}),
+		},
+	}
+}
+
+func decodeRegistry(r *registryHCL, ctx *hcl.EvalContext, baseDir string) (*RegistryConfig, hcl.Diagnostics) {
+	var diags hcl.Diagnostics
+
+	reg := &RegistryConfig{
+		Name:     r.Name,
+		Address:  r.Address,
+		Username: r.Username,
+		Password: r.Password,
+		Batch: BatchConfig{
+			Workers:    DefaultWorkers,
+			Attempts:   DefaultAttempts,
+			Backoff:    DefaultBackoff,
+			MaxBackoff: DefaultMaxBackoff,
+		},
+		Health: HealthConfig{
+			Threshold:  DefaultThreshold,
+			RetryDelay: DefaultRetryDelay,
+			Timeout:    DefaultHealthTimeout,
+			Interval:   DefaultHealthInterval,
+
+			MaxRetryDelay:    DefaultMaxRetryDelay,
+			SuccessThreshold: DefaultSuccessThreshold,
+		},
+	}
+
+	if p := r.Protection; p != nil {
+		reg.Protection.Store = p.Store
+		if p.Store != "" && !filepath.IsAbs(p.Store) {
+			reg.Protection.Store = filepath.Join(baseDir, p.Store)
+		}
+
+		seen := make(map[string]hcl.Range)
+		for _, raw := range p.Policies {
+			rng := raw.Body.MissingItemRange()
+			if prev, ok := seen[raw.Name]; ok {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Duplicate policy",
+					Detail:   fmt.Sprintf("policy %q was already defined at %s", raw.Name, prev),
+					Subject:  &rng,
+				})
+				continue
+			}
+			seen[raw.Name] = rng
+
+			policy := PolicyConfig{
+				Name:        raw.Name,
+				Immutable:   raw.Immutable,
+				AllowDelete: raw.AllowDelete,
+			}
+			if isSet(raw.Pattern, ctx) {
+				policy.Pattern = decodeRegexp(raw.Pattern, ctx, &diags)
+				if policy.Pattern != nil && policy.Pattern.String() == "" {
+					diags = append(diags, &hcl.Diagnostic{
+						Severity: hcl.DiagError,
+						Summary:  "Empty pattern",
+						Detail:   fmt.Sprintf("policy %q would protect every tag; use \".*\" to mean that", raw.Name),
+						Subject:  raw.Pattern.Range().Ptr(),
+					})
+				}
+			} else {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Missing required argument",
+					Detail:   fmt.Sprintf("policy %q requires a pattern", raw.Name),
+					Subject:  &rng,
+				})
+			}
+			policy.MaxAge = decodeDuration(raw.MaxAge, ctx, 0, &diags)
+			policy.Priority = decodeInt(raw.Priority, ctx, DefaultPolicyPriority, 0, &diags)
+			reg.Protection.Policies = append(reg.Protection.Policies, policy)
+		}
+	}
+
+	if b := r.Batch; b != nil {
+		reg.Batch.Workers = decodeInt(b.Workers, ctx, DefaultWorkers, 1, &diags)
+		reg.Batch.Timeout = decodeDuration(b.Timeout, ctx, 0, &diags)
+		reg.Batch.Attempts = decodeInt(b.Attempts, ctx, DefaultAttempts, 1, &diags)
+		reg.Batch.Backoff = decodeDuration(b.Backoff, ctx, DefaultBackoff, &diags)
+		reg.Batch.MaxBackoff = decodeDuration(b.MaxBackoff, ctx, DefaultMaxBackoff, &diags)
+	}
+
+	if h := r.Health; h != nil {
+		reg.Health.Endpoints = h.Endpoints
+		reg.Health.Threshold = decodeInt(h.Threshold, ctx, DefaultThreshold, 1, &diags)
+		reg.Health.RetryDelay = decodeDuration(h.RetryDelay, ctx, DefaultRetryDelay, &diags)
+		reg.Health.Timeout = decodeDuration(h.Timeout, ctx, DefaultHealthTimeout, &diags)
+		reg.Health.Interval = decodeDuration(h.Interval, ctx, DefaultHealthInterval, &diags)
+		reg.Health.MaxRetryDelay = decodeDuration(h.MaxRetryDelay, ctx, DefaultMaxRetryDelay, &diags)
+		reg.Health.SuccessThreshold = decodeInt(h.SuccessThreshold, ctx, DefaultSuccessThreshold, 1, &diags)
+		reg.Health.SlowThreshold = decodeDuration(h.SlowThreshold, ctx, 0, &diags)
+		if h.Notify != nil {
+			reg.Health.Notify = decodeNotify(h.Notify, ctx, &diags)
+		}
+	}
+
+	return reg, diags
+}
+
+func decodeHarbor(h *harborHCL, ctx *hcl.EvalContext, baseDir string) (*HarborConfig, hcl.Diagnostics) {
+	var diags hcl.Diagnostics
+	rng := h.Body.MissingItemRange()
+
+	harbor := &HarborConfig{
+		Name:          h.Name,
+		Hostname:      h.Hostname,
+		ExternalURL:   h.ExternalURL,
+		Version:       h.Version,
+		AdminPassword: h.AdminPassword,
+		DataDir:       h.DataDir,
+		HTTP:          HTTPConfig{Port: DefaultHTTPPort},
+		Database: DatabaseConfig{
+			Port:         DefaultDatabasePort,
+			Username:     DefaultDatabaseUsername,
+			Name:         DefaultDatabaseName,
+			SSLMode:      DefaultDatabaseSSLMode,
+			MaxIdleConns: DefaultDBMaxIdleConns,
+			MaxOpenConns: DefaultDBMaxOpenConns,
+		},
+		Storage:    StorageConfig{Type: StorageFilesystem},
+		Jobservice: JobserviceConfig{Workers: DefaultJobserviceWorkers},
+		Log:        LogConfig{Level: DefaultLogLevel},
+	}
+	if harbor.Version == "" {
+		harbor.Version = DefaultHarborVersion
+	}
+	if harbor.DataDir == "" {
+		harbor.DataDir = DefaultDataDir
+	}
+
+	missing := func(what string) {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Missing required argument",
+			Detail:   fmt.Sprintf("harbor %q requires %s", h.Name, what),
+			Subject:  &rng,
+		})
+	}
+	invalid := func(summary, detail string) {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  summary,
+			Detail:   detail,
+			Subject:  &rng,
+		})
+	}
+
+	switch {
+	case harbor.Hostname == "":
+		missing("a hostname")
+	case strings.ContainsAny(harbor.Hostname, ":/ "):
+		invalid("Invalid hostname", fmt.Sprintf("%q must be a bare host name, without scheme or port", harbor.Hostname))
+	}
+	if harbor.AdminPassword == "" {
+		missing("an admin_password")
+	}
+	if !filepath.IsAbs(harbor.DataDir) {
+		invalid("Invalid data directory", fmt.Sprintf("data_dir %q must be an absolute path", harbor.DataDir))
+	}
+
+	if b := h.HTTP; b != nil {
+		harbor.HTTP.Port = decodePort(b.Port, ctx, DefaultHTTPPort, &diags)
+	}
+	if b := h.HTTPS; b != nil {
+		harbor.HTTPS = &HTTPSConfig{
+			Port:        decodePort(b.Port, ctx, DefaultHTTPSPort, &diags),
+			Certificate: b.Certificate,
+			PrivateKey:  b.PrivateKey,
+		}
+		if b.Certificate != "" && !filepath.IsAbs(b.Certificate) {
+			harbor.HTTPS.Certificate = filepath.Join(baseDir, b.Certificate)
+		}
+		if b.PrivateKey != "" && !filepath.IsAbs(b.PrivateKey) {
+			harbor.HTTPS.PrivateKey = filepath.Join(baseDir, b.PrivateKey)
+		}
+	}
+
+	if b := h.Database; b != nil {
+		harbor.Database.Host = b.Host
+		harbor.Database.Port = decodePort(b.Port, ctx, DefaultDatabasePort, &diags)
+		harbor.Database.Password = b.Password
+		harbor.Database.MaxIdleConns = decodeInt(b.MaxIdleConns, ctx, DefaultDBMaxIdleConns, 1, &diags)
+		harbor.Database.MaxOpenConns = decodeInt(b.MaxOpenConns, ctx, DefaultDBMaxOpenConns, 1, &diags)
+		if b.Username != "" {
+			harbor.Database.Username = b.Username
+		}
+		if b.Name != "" {
+			harbor.Database.Name = b.Name
+		}
+		if mode, ok := evalString(b.SSLMode, ctx, &diags); ok {
+			if slices.Contains(SSLModes, mode) {
+				harbor.Database.SSLMode = mode
+			} else {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid SSL mode",
+					Detail:   fmt.Sprintf("%q is not one of %s", mode, strings.Join(SSLModes, ", ")),
+					Subject:  b.SSLMode.Range().Ptr(),
+				})
+			}
+		}
+
+		// The bundled database only has the postgres user and the
+		// registry database, reached without TLS
+		if b.Host == "" && (isSet(b.Port, ctx) || b.Username != "" || b.Name != "" || isSet(b.SSLMode, ctx)) {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Missing required argument",
+				Detail:   "port, username, name and ssl_mode configure an external database and require a host",
+				Subject:  b.Body.MissingItemRange().Ptr(),
+			})
+		}
+	}
+	if harbor.Database.Password == "" {
+		missing("a database password")
+	}
+	if b := h.Redis; b != nil {
+		harbor.Redis.Password = b.Password
+		if addr, ok := evalString(b.Address, ctx, &diags); ok {
+			if _, port, err := net.SplitHostPort(addr); err != nil || port == "" {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid address",
+					Detail:   fmt.Sprintf("%q must be a host:port address", addr),
+					Subject:  b.Address.Range().Ptr(),
+				})
+			} else {
+				harbor.Redis.Address = addr
+			}
+		}
+	}
+	if b := h.Storage; b != nil {
+		harbor.Storage = decodeStorage(b, &diags)
+	}
+	if b := h.Jobservice; b != nil {
+		harbor.Jobservice.Workers = decodeInt(b.Workers, ctx, DefaultJobserviceWorkers, 1, &diags)
+	}
+	if b := h.Log; b != nil {
+		if level, ok := evalString(b.Level, ctx, &diags); ok {
+			if slices.Contains(LogLevels, level) {
+				harbor.Log.Level = level
+			} else {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid log level",
+					Detail:   fmt.Sprintf("%q is not one of %s", level, strings.Join(LogLevels, ", ")),
+					Subject:  b.Level.Range().Ptr(),
+				})
+			}
+		}
+	}
+
+	harbor.Kubernetes = decodeKubernetes(h.Kubernetes, ctx, &diags)
+
+	// Secrets end up in env files, one variable per line
+	secrets := []struct{ name, value string }{
+		{"admin_password", harbor.AdminPassword},
+		{"database password", harbor.Database.Password},
+		{"redis password", harbor.Redis.Password},
+	}
+	if s3 := harbor.Storage.S3; s3 != nil {
+		secrets = append(secrets, struct{ name, value string }{"s3 secret_key", s3.SecretKey})
+	}
+	if azure := harbor.Storage.Azure; azure != nil {
+		secrets = append(secrets, struct{ name, value string }{"azure account_key", azure.AccountKey})
+	}
+	for _, secret := range secrets {
+		if strings.ContainsAny(secret.value, "\r\n") {
+			invalid("Invalid password", fmt.Sprintf("%s must be a single line", secret.name))
+		}
+	}
+
+	return harbor, diags
+}
+
+// decodeNotify decodes a notify block, which needs at least one sink
+func decodeNotify(b *notifyHCL, ctx *hcl.EvalContext, diags *hcl.Diagnostics) *NotifyConfig {
+	n := &NotifyConfig{
+		RenotifyInterval: decodeDuration(b.RenotifyInterval, ctx, DefaultRenotifyInterval, diags),
+		FlapWindow:       decodeDuration(b.FlapWindow, ctx, DefaultFlapWindow, diags),
+		FlapThreshold:    decodeInt(b.FlapThreshold, ctx, DefaultFlapThreshold, 0, diags),
+	}
+
+	seen := make(map[string]bool)
+	duplicate := func(kind, name string, rng hcl.Range) bool {
+		key := kind + " " + name
+		if seen[key] {
+			*diags = append(*diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Duplicate notification sink",
+				Detail:   fmt.Sprintf("%s %q is defined more than once", kind, name),
+				Subject:  &rng,
+			})
+			return true
+		}
+		seen[key] = true
+		return false
+	}
+
+	for _, w := range b.Webhooks {
+		target, ok := decodeURL(w.URL, ctx, diags)
+		if ok && !duplicate("webhook", w.Name, w.URL.Range()) {
+			n.Webhooks = append(n.Webhooks, WebhookConfig{Name: w.Name, URL: target, Headers: w.Headers})
+		}
+	}
+	for _, s := range b.Slack {
+		target, ok := decodeURL(s.URL, ctx, diags)
+		if ok && !duplicate("slack", s.Name, s.URL.Range()) {
+			n.Slack = append(n.Slack, WebhookConfig{Name: s.Name, URL: target})
+		}
+	}
+	for _, e := range b.Email {
+		rng := e.Body.MissingItemRange()
+		addr, ok := evalString(e.SMTP, ctx, diags)
+		if _, port, err := net.SplitHostPort(addr); ok && (err != nil || port == "") {
+			*diags = append(*diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid address",
+				Detail:   fmt.Sprintf("%q must be a host:port address", addr),
+				Subject:  e.SMTP.Range().Ptr(),
+			})
+			ok = false
+		}
+		if len(e.To) == 0 {
+			*diags = append(*diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Missing required argument",
+				Detail:   fmt.Sprintf("email %q requires at least one to address", e.Name),
+				Subject:  &rng,
+			})
+			ok = false
+		}
+		if ok && !duplicate("email", e.Name, rng) {
+			n.Email = append(n.Email, EmailConfig{
+				Name:     e.Name,
+				SMTP:     addr,
+				From:     e.From,
+				To:       e.To,
+				Username: e.Username,
+				Password: e.Password,
+			})
+		}
+	}
+	for _, x := range b.Exec {
+		rng := x.Body.MissingItemRange()
+		if len(x.Command) == 0 || x.Command[0] == "" {
+			*diags = append(*diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Missing required argument",
+				Detail:   fmt.Sprintf("exec %q requires a command", x.Name),
+				Subject:  &rng,
+			})
+			continue
+		}
+		if !duplicate("exec", x.Name, rng) {
+			n.Exec = append(n.Exec, ExecConfig{Name: x.Name, Command: x.Command})
+		}
+	}
+
+	if len(b.Webhooks)+len(b.Slack)+len(b.Email)+len(b.Exec) == 0 {
+		*diags = append(*diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Missing notification sink",
+			Detail:   "a notify block needs a webhook, slack, email or exec block",
+			Subject:  b.Body.MissingItemRange().Ptr(),
+		})
+	}
+	return n
+}
+
+// decodeURL evaluates a required http or https URL attribute
+func decodeURL(expr hcl.Expression, ctx *hcl.EvalContext, diags *hcl.Diagnostics) (string, bool) {
+	s, ok := evalString(expr, ctx, diags)
+	if !ok {
+		return "", false
+	}
+	if u, err := url.Parse(s); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		*diags = append(*diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid URL",
+			Detail:   fmt.Sprintf("%q must be an http or https URL", s),
+			Subject:  expr.Range().Ptr(),
+		})
+		return "", false
+	}
+	return s, true
+}
+
+// decodeStorage decodes a storage block, which holds one backend block
+func decodeStorage(b *storageHCL, diags *hcl.Diagnostics) StorageConfig {
+	storage := StorageConfig{Type: StorageFilesystem}
+	var backends []string
+	if b.Filesystem != nil {
+		backends = append(backends, StorageFilesystem)
+	}
+	if s3 := b.S3; s3 != nil {
+		backends = append(backends, StorageS3)
+		storage.Type = StorageS3
+		storage.S3 = &S3Config{
+			Bucket:        s3.Bucket,
+			Region:        s3.Region,
+			Endpoint:      s3.Endpoint,
+			AccessKey:     s3.AccessKey,
+			SecretKey:     s3.SecretKey,
+			RootDirectory: s3.RootDirectory,
+		}
+		if (s3.AccessKey == "") != (s3.SecretKey == "") {
+			*diags = append(*diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Missing required argument",
+				Detail:   "access_key and secret_key must be set together",
+				Subject:  b.Body.MissingItemRange().Ptr(),
+			})
+		}
+	}
+	if azure := b.Azure; azure != nil {
+		backends = append(backends, StorageAzure)
+		storage.Type = StorageAzure
+		storage.Azure = &AzureConfig{
+			AccountName: azure.AccountName,
+			AccountKey:  azure.AccountKey,
+			Container:   azure.Container,
+		}
+	}
+
+	if len(backends) > 1 {
+		*diags = append(*diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Conflicting storage backends",
+			Detail:   fmt.Sprintf("a storage block holds one backend, got %s", strings.Join(backends, " and ")),
+			Subject:  b.Body.MissingItemRange().Ptr(),
+		})
+	}
+	return storage
+}
+
+// dnsLabel is a valid Kubernetes resource name or namespace
+var dnsLabel = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+// quantity is a CPU or memory quantity such as "500m", "1.5" or "512Mi"
+var quantity = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?(m|k|M|G|T|P|E|Ki|Mi|Gi|Ti|Pi|Ei)?$`)
+
+// decodeKubernetes decodes an optional kubernetes block; every component
+// gets a configuration, with defaults when it has no block
+func decodeKubernetes(b *kubernetesHCL, ctx *hcl.EvalContext, diags *hcl.Diagnostics) KubernetesConfig {
+	k := KubernetesConfig{
+		Name:       DefaultKubernetesName,
+		Namespace:  DefaultKubernetesNamespace,
+		Components: make(map[string]ComponentConfig, len(Components)),
+	}
+	for _, name := range Components {
+		c := ComponentConfig{Replicas: DefaultReplicas, VolumeSize: DefaultVolumeSize}
+		if name == ComponentRegistry {
+			c.VolumeSize = DefaultRegistryVolumeSize
+		}
+		k.Components[name] = c
+	}
+	if b == nil {
+		return k
+	}
+
+	rng := b.Body.MissingItemRange()
+	k.IngressClass = b.IngressClass
+	k.IngressAnnotations = b.IngressAnnotations
+	k.TLSSecret = b.TLSSecret
+	k.StorageClass = b.StorageClass
+	for _, name := range []struct {
+		attr  string
+		value string
+		field *string
+	}{
+		{"name", b.Name, &k.Name},
+		{"namespace", b.Namespace, &k.Namespace},
+	} {
+		if name.value == "" {
+			continue
+		}
+		if len(name.value) > 40 || !dnsLabel.MatchString(name.value) {
+			*diags = append(*diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid name",
+				Detail:   fmt.Sprintf("%s %q must be at most 40 lowercase letters, digits and dashes", name.attr, name.value),
+				Subject:  &rng,
+			})
+			continue
+		}
+		*name.field = name.value
+	}
+
+	seen := make(map[string]hcl.Range)
+	for _, c := range b.Components {
+		crng := c.Body.MissingItemRange()
+		if !slices.Contains(Components, c.Name) {
+			*diags = append(*diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Unsupported component",
+				Detail:   fmt.Sprintf("%q is not one of %s", c.Name, strings.Join(Components, ", ")),
+				Subject:  &crng,
+			})
+			continue
+		}
+		if prev, ok := seen[c.Name]; ok {
+			*diags = append(*diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Duplicate component block",
+				Detail:   fmt.Sprintf("component %q was already defined at %s", c.Name, prev),
+				Subject:  &crng,
+			})
+			continue
+		}
+		seen[c.Name] = crng
+
+		component := k.Components[c.Name]
+		component.Replicas = decodeInt(c.Replicas, ctx, DefaultReplicas, 1, diags)
+		component.VolumeSize = decodeQuantity(c.VolumeSize, ctx, component.VolumeSize, diags)
+		if r := c.Requests; r != nil {
+			component.Requests = decodeResources(r, ctx, diags)
+		}
+		if r := c.Limits; r != nil {
+			component.Limits = decodeResources(r, ctx, diags)
+		}
+
+		// The bundled database and Redis are single instances
+		if (c.Name == ComponentDatabase || c.Name == ComponentRedis) && component.Replicas > 1 {
+			*diags = append(*diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Value out of range",
+				Detail:   fmt.Sprintf("the bundled %s runs a single replica; configure an external one for high availability", c.Name),
+				Subject:  c.Replicas.Range().Ptr(),
+			})
+			component.Replicas = DefaultReplicas
+		}
+		k.Components[c.Name] = component
+	}
+	return k
+}
+
+// decodeResources decodes a requests or limits block
+func decodeResources(b *resourcesHCL, ctx *hcl.EvalContext, diags *hcl.Diagnostics) Resources {
+	return Resources{
+		CPU:    decodeQuantity(b.CPU, ctx, "", diags),
+		Memory: decodeQuantity(b.Memory, ctx, "", diags),
+	}
+}
+
+// decodeQuantity decodes an optional Kubernetes quantity
+func decodeQuantity(expr hcl.Expression, ctx *hcl.EvalContext, def string, diags *hcl.Diagnostics) string {
+	s, ok := evalString(expr, ctx, diags)
+	if !ok {
+		return def
+	}
+	if !quantity.MatchString(s) {
+		*diags = append(*diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid quantity",
+			Detail:   fmt.Sprintf("%q is not a valid quantity (e.g. \"500m\", \"2\", \"512Mi\")", s),
+			Subject:  expr.Range().Ptr(),
+		})
+		return def
+	}
+	return s
+}
+
+// isSet reports whether an expression attribute was given a value
+func isSet(expr hcl.Expression, ctx *hcl.EvalContext) bool {
+	v, _ := expr.Value(ctx)
+	return !v.IsNull()
+}
+
+// evalString evaluates an optional string attribute; ok is false when the
+// attribute is absent or could not be converted
+func evalString(expr hcl.Expression, ctx *hcl.EvalContext, diags *hcl.Diagnostics) (string, bool) {
+	var s *string
+	if d := gohcl.DecodeExpression(expr, ctx, &s); d.HasErrors() {
+		*diags = append(*diags, d...)
+		return "", false
+	}
+	if s == nil {
+		return "", false
+	}
+	return *s, true
+}
+
+// decodeDuration parses a duration string such as "30s" or "168h"
+func decodeDuration(expr hcl.Expression, ctx *hcl.EvalContext, def time.Duration, diags *hcl.Diagnostics) time.Duration {
+	s, ok := evalString(expr, ctx, diags)
+	if !ok {
+		return def
+	}
+
+	d, err := time.ParseDuration(s)
+	if err == nil && d < 0 {
+		err = fmt.Errorf("duration must not be negative")
+	}
+	if err != nil {
+		*diags = append(*diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid duration",
+			Detail:   fmt.Sprintf("%q is not a valid duration (e.g. \"30s\", \"168h\"): %s", s, err),
+			Subject:  expr.Range().Ptr(),
+		})
+		return def
+	}
+	return d
+}
+
+// decodeRegexp compiles a pattern attribute
+func decodeRegexp(expr hcl.Expression, ctx *hcl.EvalContext, diags *hcl.Diagnostics) *regexp.Regexp {
+	s, ok := evalString(expr, ctx, diags)
+	if !ok {
+		return nil
+	}
+
+	re, err := regexp.Compile(s)
+	if err != nil {
+		*diags = append(*diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid pattern",
+			Detail:   fmt.Sprintf("%q is not a valid regular expression: %s", s, err),
+			Subject:  expr.Range().Ptr(),
+		})
+		return nil
+	}
+	return re
+}
+
+// decodePort decodes an optional TCP port number
+func decodePort(expr hcl.Expression, ctx *hcl.EvalContext, def int, diags *hcl.Diagnostics) int {
+	port := decodeInt(expr, ctx, def, 1, diags)
+	if port > 65535 {
+		*diags = append(*diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Value out of range",
+			Detail:   fmt.Sprintf("port must be at most 65535, got %d", port),
+			Subject:  expr.Range().Ptr(),
+		})
+		return def
+	}
+	return port
+}
+
+// decodeInt decodes an optional whole number no smaller than minimum
+func decodeInt(expr hcl.Expression, ctx *hcl.EvalContext, def, minimum int, diags *hcl.Diagnostics) int {
+	var n *int
+	if d := gohcl.DecodeExpression(expr, ctx, &n); d.HasErrors() {
+		*diags = append(*diags, d...)
+		return def
+	}
+	if n == nil {
+		return def
+	}
+
+	if *n < minimum {
+		*diags = append(*diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Value out of range",
+			Detail:   fmt.Sprintf("must be at least %d, got %d", minimum, *n),
+			Subject:  expr.Range().Ptr(),
+		})
+		return def
+	}
+	return *n
+}
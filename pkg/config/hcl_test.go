@@ -0,0 +1,986 @@
+// Copyright 2021 vjranagit
+//
+// HCL configuration loader tests
+
+package config
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// documented is the example from FEATURES.md
+const documented = `registry "production" {
+  # Tag protection policies
+  protection {
+    policy "prod-immutable" {
+      pattern   = ".*:v\\d+\\.\\d+\\.\\d+$"
+      immutable = true
+      priority  = 10
+    }
+
+    policy "recent-protection" {
+      pattern = ".*:.*"
+      max_age = "168h"  // 7 days
+      priority = 5
+    }
+  }
+
+  # Batch operations
+  batch {
+    workers  = 10
+    timeout  = "5m"
+    attempts = 5
+    backoff  = "1s"
+  }
+
+  # Health monitoring
+  health {
+    endpoints = [
+      "https://registry1.example.com",
+      "https://registry2.example.com"
+    ]
+
+    threshold   = 3
+    retry_delay = "30s"
+    timeout     = "5s"
+    interval    = "10s"
+
+    # Close a circuit after 3 good retries, backing off up to 10m, and
+    # fail checks slower than 2s
+    success_threshold = 3
+    max_retry_delay   = "10m"
+    slow_threshold    = "2s"
+  }
+}
+`
+
+func TestParse_DocumentedExample(t *testing.T) {
+	cfg, err := Parse([]byte(documented), "harbor.hcl")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	reg, err := cfg.Registry("")
+	if err != nil {
+		t.Fatalf("Registry failed: %v", err)
+	}
+	if reg.Name != "production" {
+		t.Errorf("expected registry production, got %s", reg.Name)
+	}
+
+	policies := reg.Protection.Policies
+	if len(policies) != 2 {
+		t.Fatalf("expected 2 policies, got %d", len(policies))
+	}
+	if !policies[0].Immutable || policies[0].Priority != 10 {
+		t.Errorf("unexpected prod-immutable policy: %+v", policies[0])
+	}
+	if !policies[0].Pattern.MatchString("library/nginx:v1.2.3") {
+		t.Errorf("expected pattern %s to match a release tag", policies[0].Pattern)
+	}
+	if policies[1].MaxAge != 168*time.Hour || policies[1].Priority != 5 {
+		t.Errorf("unexpected recent-protection policy: %+v", policies[1])
+	}
+
+	if reg.Batch.Workers != 10 || reg.Batch.Timeout != 5*time.Minute ||
+		reg.Batch.Attempts != 5 || reg.Batch.Backoff != time.Second || reg.Batch.MaxBackoff != DefaultMaxBackoff {
+		t.Errorf("unexpected batch config: %+v", reg.Batch)
+	}
+
+	health := reg.Health
+	if len(health.Endpoints) != 2 || health.Threshold != 3 ||
+		health.RetryDelay != 30*time.Second || health.Timeout != 5*time.Second ||
+		health.Interval != 10*time.Second || health.SuccessThreshold != 3 ||
+		health.MaxRetryDelay != 10*time.Minute || health.SlowThreshold != 2*time.Second {
+		t.Errorf("unexpected health config: %+v", health)
+	}
+}
+
+func TestParse_Defaults(t *testing.T) {
+	src := `registry "default" {
+  address = "harbor.example.com"
+
+  protection {
+    store = "policies.db"
+
+    policy "all" {
+      pattern = ".*"
+    }
+  }
+}
+`
+	cfg, err := Parse([]byte(src), filepath.Join("etc", "harbor.hcl"))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	reg := cfg.Registries[0]
+
+	if reg.Protection.Store != filepath.Join("etc", "policies.db") {
+		t.Errorf("expected store relative to config file, got %s", reg.Protection.Store)
+	}
+	if reg.Protection.Policies[0].Priority != DefaultPolicyPriority {
+		t.Errorf("expected default priority %d, got %d", DefaultPolicyPriority, reg.Protection.Policies[0].Priority)
+	}
+	if reg.Batch.Workers != DefaultWorkers || reg.Batch.Attempts != DefaultAttempts {
+		t.Errorf("expected default workers %d and attempts %d, got %+v", DefaultWorkers, DefaultAttempts, reg.Batch)
+	}
+	if reg.Health.Threshold != DefaultThreshold || reg.Health.Interval != DefaultHealthInterval ||
+		reg.Health.SuccessThreshold != DefaultSuccessThreshold || reg.Health.MaxRetryDelay != DefaultMaxRetryDelay {
+		t.Errorf("expected default health config, got %+v", reg.Health)
+	}
+}
+
+func TestParse_ZeroDurations(t *testing.T) {
+	src := `registry "default" {
+  batch {
+    max_backoff = "0s"
+  }
+  health {
+    max_retry_delay = "0s"
+  }
+}
+`
+	cfg, err := Parse([]byte(src), "harbor.hcl")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	reg := cfg.Registries[0]
+	if reg.Batch.MaxBackoff != 0 || reg.Health.MaxRetryDelay != 0 {
+		t.Errorf("expected explicit zeros to replace the defaults, got %s and %s", reg.Batch.MaxBackoff, reg.Health.MaxRetryDelay)
+	}
+}
+
+func TestParse_Notify(t *testing.T) {
+	t.Setenv("HARBOR_TEST_SLACK", "https://hooks.slack.com/services/T0/B0/x")
+
+	src := `registry "default" {
+  health {
+    endpoints = ["https://harbor.example.com"]
+
+    notify {
+      renotify_interval = "30m"
+      flap_threshold    = 0
+
+      webhook "ops" {
+        url     = "https://alerts.example.com/harbor"
+        headers = { Authorization = "Bearer token" }
+      }
+      slack "alerts" {
+        url = env("HARBOR_TEST_SLACK")
+      }
+      email "oncall" {
+        smtp     = "smtp.example.com:587"
+        from     = "harbor@example.com"
+        to       = ["ops@example.com", "lead@example.com"]
+        username = "harbor"
+      }
+      exec "pager" {
+        command = ["/usr/local/bin/page", "--severity", "2"]
+      }
+    }
+  }
+}
+`
+	cfg, err := Parse([]byte(src), "harbor.hcl")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	n := cfg.Registries[0].Health.Notify
+	if n == nil {
+		t.Fatal("expected a notify config")
+	}
+	if n.RenotifyInterval != 30*time.Minute || n.FlapThreshold != 0 || n.FlapWindow != DefaultFlapWindow {
+		t.Errorf("unexpected notify settings: %+v", n)
+	}
+	if len(n.Webhooks) != 1 || n.Webhooks[0].Headers["Authorization"] != "Bearer token" {
+		t.Errorf("unexpected webhooks: %+v", n.Webhooks)
+	}
+	if len(n.Slack) != 1 || n.Slack[0].URL != "https://hooks.slack.com/services/T0/B0/x" {
+		t.Errorf("unexpected slack sinks: %+v", n.Slack)
+	}
+	if len(n.Email) != 1 || n.Email[0].SMTP != "smtp.example.com:587" || len(n.Email[0].To) != 2 {
+		t.Errorf("unexpected email sinks: %+v", n.Email)
+	}
+	if len(n.Exec) != 1 || n.Exec[0].Command[2] != "2" {
+		t.Errorf("unexpected exec sinks: %+v", n.Exec)
+	}
+
+	// Without a notify block there is nothing to send
+	cfg, _ = Parse([]byte(documented), "harbor.hcl")
+	if cfg.Registries[0].Health.Notify != nil {
+		t.Error("expected no notify config without a notify block")
+	}
+}
+
+func TestParse_Env(t *testing.T) {
+	t.Setenv("HARBOR_TEST_PASSWORD", "s3cret")
+
+	src := `registry "default" {
+  username = "admin"
+  password = env("HARBOR_TEST_PASSWORD")
+}
+`
+	cfg, err := Parse([]byte(src), "harbor.hcl")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if cfg.Registries[0].Password != "s3cret" {
+		t.Errorf("expected password from environment, got %q", cfg.Registries[0].Password)
+	}
+}
+
+func TestParse_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{
+			name: "invalid duration",
+			src: `registry "a" {
+  batch {
+    timeout = "5 minutes"
+  }
+}
+`,
+			want: "harbor.hcl:3,15-26: Invalid duration",
+		},
+		{
+			name: "invalid pattern",
+			src: `registry "a" {
+  protection {
+    policy "p" {
+      pattern = "([a-z"
+    }
+  }
+}
+`,
+			want: "harbor.hcl:4,17-24: Invalid pattern",
+		},
+		{
+			name: "workers out of range",
+			src: `registry "a" {
+  batch {
+    workers = 0
+  }
+}
+`,
+			want: "harbor.hcl:3,15-16: Value out of range",
+		},
+		{
+			name: "attempts out of range",
+			src: `registry "a" {
+  batch {
+    attempts = 0
+  }
+}
+`,
+			want: "harbor.hcl:3,16-17: Value out of range",
+		},
+		{
+			name: "wrong type",
+			src: `registry "a" {
+  health {
+    threshold = "three"
+  }
+}
+`,
+			want: "harbor.hcl:3,18-23: Unsuitable value type",
+		},
+		{
+			name: "missing pattern",
+			src: `registry "a" {
+  protection {
+    policy "p" {
+      immutable = true
+    }
+  }
+}
+`,
+			want: "harbor.hcl:3,16-16: Missing required argument",
+		},
+		{
+			name: "empty pattern",
+			src: `registry "a" {
+  protection {
+    policy "p" {
+      pattern = ""
+    }
+  }
+}
+`,
+			want: "harbor.hcl:4,17-19: Empty pattern",
+		},
+		{
+			name: "unknown attribute",
+			src: `registry "a" {
+  workers = 5
+}
+`,
+			want: "harbor.hcl:2,3-10: Unsupported argument",
+		},
+		{
+			name: "duplicate policy",
+			src: `registry "a" {
+  protection {
+    policy "p" {
+      pattern = ".*"
+    }
+    policy "p" {
+      pattern = ".*"
+    }
+  }
+}
+`,
+			want: "harbor.hcl:6,16-16: Duplicate policy",
+		},
+		{
+			name: "duplicate registry",
+			src: `registry "a" {}
+registry "a" {}
+`,
+			want: "harbor.hcl:2,14-14: Duplicate registry block",
+		},
+		{
+			name: "notify without sinks",
+			src: `registry "a" {
+  health {
+    notify {
+      renotify_interval = "30m"
+    }
+  }
+}
+`,
+			want: "harbor.hcl:3,12-12: Missing notification sink",
+		},
+		{
+			name: "invalid webhook url",
+			src: `registry "a" {
+  health {
+    notify {
+      webhook "ops" {
+        url = "hooks.example.com/alert"
+      }
+    }
+  }
+}
+`,
+			want: "harbor.hcl:5,15-40: Invalid URL",
+		},
+		{
+			name: "invalid smtp address",
+			src: `registry "a" {
+  health {
+    notify {
+      email "oncall" {
+        smtp = "smtp.example.com"
+        from = "harbor@example.com"
+        to   = ["ops@example.com"]
+      }
+    }
+  }
+}
+`,
+			want: "harbor.hcl:5,16-34: Invalid address",
+		},
+		{
+			name: "duplicate sink",
+			src: `registry "a" {
+  health {
+    notify {
+      exec "page" {
+        command = ["page"]
+      }
+      exec "page" {
+        command = ["page", "--again"]
+      }
+    }
+  }
+}
+`,
+			want: "Duplicate notification sink",
+		},
+		{
+			name: "missing hostname",
+			src: `harbor "a" {
+  admin_password = "x"
+  database {
+    password = "y"
+  }
+}
+`,
+			want: "harbor.hcl:1,12-12: Missing required argument; harbor \"a\" requires a hostname",
+		},
+		{
+			name: "missing database password",
+			src: `harbor "a" {
+  hostname       = "harbor.example.com"
+  admin_password = "x"
+}
+`,
+			want: "requires a database password",
+		},
+		{
+			name: "hostname with scheme",
+			src: `harbor "a" {
+  hostname       = "https://harbor.example.com"
+  admin_password = "x"
+  database {
+    password = "y"
+  }
+}
+`,
+			want: "Invalid hostname",
+		},
+		{
+			name: "invalid log level",
+			src: `harbor "a" {
+  hostname       = "harbor.example.com"
+  admin_password = "x"
+  database {
+    password = "y"
+  }
+  log {
+    level = "verbose"
+  }
+}
+`,
+			want: "harbor.hcl:8,13-22: Invalid log level",
+		},
+		{
+			name: "port out of range",
+			src: `harbor "a" {
+  hostname       = "harbor.example.com"
+  admin_password = "x"
+  database {
+    password = "y"
+  }
+  http {
+    port = 80000
+  }
+}
+`,
+			want: "harbor.hcl:8,12-17: Value out of range",
+		},
+		{
+			name: "https without certificate",
+			src: `harbor "a" {
+  hostname       = "harbor.example.com"
+  admin_password = "x"
+  database {
+    password = "y"
+  }
+  https {
+    private_key = "tls.key"
+  }
+}
+`,
+			want: "Missing required argument",
+		},
+		{
+			name: "relative data directory",
+			src: `harbor "a" {
+  hostname       = "harbor.example.com"
+  admin_password = "x"
+  data_dir       = "data"
+  database {
+    password = "y"
+  }
+}
+`,
+			want: "Invalid data directory",
+		},
+		{
+			name: "invalid ssl mode",
+			src: `harbor "a" {
+  hostname       = "harbor.example.com"
+  admin_password = "x"
+  database {
+    host     = "pg.example.com"
+    ssl_mode = "prefer"
+    password = "y"
+  }
+}
+`,
+			want: "harbor.hcl:6,16-24: Invalid SSL mode",
+		},
+		{
+			name: "external database settings without host",
+			src: `harbor "a" {
+  hostname       = "harbor.example.com"
+  admin_password = "x"
+  database {
+    username = "harbor"
+    password = "y"
+  }
+}
+`,
+			want: "require a host",
+		},
+		{
+			name: "invalid redis address",
+			src: `harbor "a" {
+  hostname       = "harbor.example.com"
+  admin_password = "x"
+  database {
+    password = "y"
+  }
+  redis {
+    address = "redis.example.com"
+  }
+}
+`,
+			want: "harbor.hcl:8,15-34: Invalid address",
+		},
+		{
+			name: "conflicting storage",
+			src: `harbor "a" {
+  hostname       = "harbor.example.com"
+  admin_password = "x"
+  database {
+    password = "y"
+  }
+  storage {
+    filesystem {}
+    azure {
+      account_name = "harbor"
+      account_key  = "key"
+      container    = "images"
+    }
+  }
+}
+`,
+			want: "Conflicting storage backends",
+		},
+		{
+			name: "s3 secret key without access key",
+			src: `harbor "a" {
+  hostname       = "harbor.example.com"
+  admin_password = "x"
+  database {
+    password = "y"
+  }
+  storage {
+    s3 {
+      bucket     = "images"
+      region     = "eu-west-1"
+      secret_key = "z"
+    }
+  }
+}
+`,
+			want: "access_key and secret_key must be set together",
+		},
+		{
+			name: "unsupported component",
+			src: `harbor "a" {
+  hostname       = "harbor.example.com"
+  admin_password = "x"
+  database {
+    password = "y"
+  }
+  kubernetes {
+    component "trivy" {}
+  }
+}
+`,
+			want: "Unsupported component",
+		},
+		{
+			name: "duplicate component",
+			src: `harbor "a" {
+  hostname       = "harbor.example.com"
+  admin_password = "x"
+  database {
+    password = "y"
+  }
+  kubernetes {
+    component "core" {}
+    component "core" {}
+  }
+}
+`,
+			want: "Duplicate component block",
+		},
+		{
+			name: "replicated bundled database",
+			src: `harbor "a" {
+  hostname       = "harbor.example.com"
+  admin_password = "x"
+  database {
+    password = "y"
+  }
+  kubernetes {
+    component "database" {
+      replicas = 2
+    }
+  }
+}
+`,
+			want: "harbor.hcl:9,18-19: Value out of range",
+		},
+		{
+			name: "invalid quantity",
+			src: `harbor "a" {
+  hostname       = "harbor.example.com"
+  admin_password = "x"
+  database {
+    password = "y"
+  }
+  kubernetes {
+    component "core" {
+      limits {
+        memory = "1 GB"
+      }
+    }
+  }
+}
+`,
+			want: "harbor.hcl:10,18-24: Invalid quantity",
+		},
+		{
+			name: "invalid namespace",
+			src: `harbor "a" {
+  hostname       = "harbor.example.com"
+  admin_password = "x"
+  database {
+    password = "y"
+  }
+  kubernetes {
+    namespace = "Harbor_Prod"
+  }
+}
+`,
+			want: "Invalid name",
+		},
+		{
+			name: "duplicate harbor",
+			src: `harbor "a" {
+  hostname       = "harbor.example.com"
+  admin_password = "x"
+  database {
+    password = "y"
+  }
+}
+harbor "a" {
+  hostname       = "harbor.example.com"
+  admin_password = "x"
+  database {
+    password = "y"
+  }
+}
+`,
+			want: "Duplicate harbor block",
+		},
+		{
+			name: "syntax error",
+			src:  "registry \"a\" {\n  address = \n}\n",
+			want: "harbor.hcl:2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.src), "harbor.hcl")
+			if err == nil {
+				t.Fatal("expected error")
+			}
+
+			var cfgErr *Error
+			if !errors.As(err, &cfgErr) {
+				t.Fatalf("expected *Error, got %T", err)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("expected error containing %q, got %q", tt.want, err.Error())
+			}
+		})
+	}
+}
+
+func TestParse_ReportsAllErrors(t *testing.T) {
+	src := `registry "a" {
+  batch {
+    timeout = "soon"
+  }
+  health {
+    interval = "often"
+  }
+}
+`
+	_, err := Parse([]byte(src), "harbor.hcl")
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if n := len(strings.Split(err.Error(), "\n")); n != 2 {
+		t.Errorf("expected 2 errors, got %d: %v", n, err)
+	}
+}
+
+func TestParse_Harbor(t *testing.T) {
+	t.Setenv("HARBOR_TEST_DB_PASSWORD", "db-secret")
+
+	src := `harbor "production" {
+  hostname       = "registry.example.com"
+  version        = "v2.10.3"
+  admin_password = "admin-secret"
+  data_dir       = "/srv/harbor"
+
+  https {
+    port        = 8443
+    certificate = "tls/tls.crt"
+    private_key = "/etc/tls/tls.key"
+  }
+
+  database {
+    password       = env("HARBOR_TEST_DB_PASSWORD")
+    max_open_conns = 300
+  }
+
+  redis {
+    password = "redis-secret"
+  }
+
+  jobservice {
+    workers = 4
+  }
+
+  log {
+    level = "debug"
+  }
+}
+`
+	cfg, err := Parse([]byte(src), filepath.Join("etc", "harbor.hcl"))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	h, err := cfg.Harbor("production")
+	if err != nil {
+		t.Fatalf("Harbor failed: %v", err)
+	}
+
+	if h.Hostname != "registry.example.com" || h.Version != "v2.10.3" || h.DataDir != "/srv/harbor" {
+		t.Errorf("unexpected harbor block: %+v", h)
+	}
+	if h.HTTPS == nil || h.HTTPS.Port != 8443 {
+		t.Fatalf("expected https on 8443, got %+v", h.HTTPS)
+	}
+	if h.HTTPS.Certificate != filepath.Join("etc", "tls", "tls.crt") || h.HTTPS.PrivateKey != "/etc/tls/tls.key" {
+		t.Errorf("expected certificate relative to config file, got %+v", h.HTTPS)
+	}
+	if h.Database.Password != "db-secret" || h.Database.MaxOpenConns != 300 || h.Database.MaxIdleConns != DefaultDBMaxIdleConns {
+		t.Errorf("unexpected database config: %+v", h.Database)
+	}
+	if h.Redis.Password != "redis-secret" || h.Jobservice.Workers != 4 || h.Log.Level != "debug" {
+		t.Errorf("unexpected component config: %+v", h)
+	}
+	if h.URL() != "https://registry.example.com:8443" {
+		t.Errorf("unexpected URL %s", h.URL())
+	}
+}
+
+func TestParse_HarborDefaults(t *testing.T) {
+	src := `harbor "default" {
+  hostname       = "harbor.example.com"
+  admin_password = "admin"
+
+  database {
+    password = "db"
+  }
+}
+`
+	cfg, err := Parse([]byte(src), "harbor.hcl")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	h := cfg.Harbors[0]
+
+	if h.Version != DefaultHarborVersion || h.DataDir != DefaultDataDir || h.HTTP.Port != DefaultHTTPPort {
+		t.Errorf("expected default install settings, got %+v", h)
+	}
+	if h.HTTPS != nil {
+		t.Errorf("expected https to be off, got %+v", h.HTTPS)
+	}
+	if h.Jobservice.Workers != DefaultJobserviceWorkers || h.Log.Level != DefaultLogLevel {
+		t.Errorf("expected default component config, got %+v", h)
+	}
+	if h.URL() != "http://harbor.example.com" {
+		t.Errorf("unexpected URL %s", h.URL())
+	}
+}
+
+func TestParse_HarborKubernetes(t *testing.T) {
+	src := `harbor "production" {
+  hostname       = "registry.example.com"
+  admin_password = "admin"
+
+  database {
+    host     = "pg.example.com"
+    username = "harbor"
+    ssl_mode = "require"
+    password = "db"
+  }
+
+  redis {
+    address = "redis.example.com:6380"
+  }
+
+  storage {
+    s3 {
+      bucket = "images"
+      region = "eu-west-1"
+    }
+  }
+
+  kubernetes {
+    namespace     = "registry"
+    ingress_class = "nginx"
+    tls_secret    = "registry-tls"
+
+    component "core" {
+      replicas = 3
+
+      requests {
+        cpu    = "250m"
+        memory = "512Mi"
+      }
+    }
+
+    component "jobservice" {
+      volume_size = "10Gi"
+    }
+  }
+}
+`
+	cfg, err := Parse([]byte(src), "harbor.hcl")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	h := cfg.Harbors[0]
+
+	db := h.Database
+	if !db.External() || db.Port != DefaultDatabasePort || db.Username != "harbor" || db.Name != DefaultDatabaseName || db.SSLMode != "require" {
+		t.Errorf("unexpected database config: %+v", db)
+	}
+	if !h.Redis.External() || h.Redis.Address != "redis.example.com:6380" {
+		t.Errorf("unexpected redis config: %+v", h.Redis)
+	}
+	if h.Storage.Type != StorageS3 || h.Storage.S3 == nil || h.Storage.S3.Bucket != "images" || h.Storage.S3.AccessKey != "" {
+		t.Errorf("unexpected storage config: %+v", h.Storage)
+	}
+
+	k := h.Kubernetes
+	if k.Name != DefaultKubernetesName || k.Namespace != "registry" || k.IngressClass != "nginx" || k.TLSSecret != "registry-tls" {
+		t.Errorf("unexpected kubernetes config: %+v", k)
+	}
+	if len(k.Components) != len(Components) {
+		t.Fatalf("expected every component to be configured, got %v", k.Components)
+	}
+	core := k.Components[ComponentCore]
+	if core.Replicas != 3 || core.Requests.CPU != "250m" || core.Requests.Memory != "512Mi" || core.Limits != (Resources{}) {
+		t.Errorf("unexpected core config: %+v", core)
+	}
+	if js := k.Components[ComponentJobservice]; js.Replicas != DefaultReplicas || js.VolumeSize != "10Gi" {
+		t.Errorf("unexpected jobservice config: %+v", js)
+	}
+	if reg := k.Components[ComponentRegistry]; reg.VolumeSize != DefaultRegistryVolumeSize {
+		t.Errorf("expected the default registry volume size, got %+v", reg)
+	}
+}
+
+func TestHarborConfig_URL(t *testing.T) {
+	tests := []struct {
+		name string
+		h    HarborConfig
+		want string
+	}{
+		{"http", HarborConfig{Hostname: "h", HTTP: HTTPConfig{Port: 80}}, "http://h"},
+		{"http port", HarborConfig{Hostname: "h", HTTP: HTTPConfig{Port: 8080}}, "http://h:8080"},
+		{"https", HarborConfig{Hostname: "h", HTTPS: &HTTPSConfig{Port: 443}}, "https://h"},
+		{"external", HarborConfig{Hostname: "h", ExternalURL: "https://proxy.example.com"}, "https://proxy.example.com"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.h.URL(); got != tt.want {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestConfig_Harbor(t *testing.T) {
+	cfg := &Config{Path: "harbor.hcl", Harbors: []*HarborConfig{{Name: "staging"}, {Name: "production"}}}
+
+	if h, err := cfg.Harbor("production"); err != nil || h.Name != "production" {
+		t.Errorf("expected production block, got %v, %v", h, err)
+	}
+	if _, err := cfg.Harbor(""); err == nil || !strings.Contains(err.Error(), "2 harbor blocks") {
+		t.Errorf("expected ambiguity error, got %v", err)
+	}
+	if h, err := (&Config{}).Harbor(""); h != nil || err != nil {
+		t.Errorf("expected no block and no error, got %v, %v", h, err)
+	}
+}
+
+func TestConfig_Registry(t *testing.T) {
+	multi := &Config{Path: "harbor.hcl", Registries: []*RegistryConfig{{Name: "staging"}, {Name: "default"}}}
+	ambiguous := &Config{Path: "harbor.hcl", Registries: []*RegistryConfig{{Name: "staging"}, {Name: "production"}}}
+
+	tests := []struct {
+		name    string
+		cfg     *Config
+		profile string
+		want    string
+		wantErr bool
+	}{
+		{"empty config", &Config{}, "", "", false},
+		{"named", multi, "staging", "staging", false},
+		{"default block", multi, "", "default", false},
+		{"ambiguous", ambiguous, "", "", true},
+		{"missing", multi, "production", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg, err := tt.cfg.Registry(tt.profile)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			got := ""
+			if reg != nil {
+				got = reg.Name
+			}
+			if got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestLoad_MinimalExample(t *testing.T) {
+	cfg, err := Load(filepath.Join("..", "..", "configs", "harbor-minimal.hcl"))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if len(cfg.Registries) == 0 {
+		t.Error("expected at least one registry block")
+	}
+}
+
+func TestLoad_DeployExamples(t *testing.T) {
+	t.Setenv("HARBOR_ADMIN_PASSWORD", "admin")
+	t.Setenv("HARBOR_DB_PASSWORD", "db")
+	t.Setenv("HARBOR_REDIS_PASSWORD", "redis")
+
+	for _, name := range []string{"harbor-compose.hcl", "harbor-k8s.hcl"} {
+		cfg, err := Load(filepath.Join("..", "..", "configs", name))
+		if err != nil {
+			t.Fatalf("%s: Load failed: %v", name, err)
+		}
+		if len(cfg.Harbors) == 0 {
+			t.Errorf("%s: expected at least one harbor block", name)
+		}
+	}
+}
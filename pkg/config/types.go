@@ -0,0 +1,395 @@
+// Copyright 2021 vjranagit
+//
+// Configuration types
+
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// Defaults applied when a block omits an attribute; they match the CLI
+// flag defaults
+const (
+	DefaultWorkers          = 5
+	DefaultAttempts         = 3
+	DefaultBackoff          = 500 * time.Millisecond
+	DefaultMaxBackoff       = 30 * time.Second
+	DefaultThreshold        = 3
+	DefaultRetryDelay       = 30 * time.Second
+	DefaultMaxRetryDelay    = 5 * time.Minute
+	DefaultSuccessThreshold = 2
+	DefaultHealthTimeout    = 5 * time.Second
+	DefaultHealthInterval   = 10 * time.Second
+	DefaultPolicyPriority   = 10
+)
+
+// Defaults for the notify block of a health block; they match the
+// notifier's defaults
+const (
+	DefaultRenotifyInterval = time.Hour
+	DefaultFlapWindow       = 10 * time.Minute
+	DefaultFlapThreshold    = 4
+)
+
+// Defaults for harbor blocks; they match a stock Harbor installer
+const (
+	DefaultHarborVersion     = "v2.11.1"
+	DefaultDataDir           = "/data"
+	DefaultHTTPPort          = 80
+	DefaultHTTPSPort         = 443
+	DefaultDBMaxIdleConns    = 100
+	DefaultDBMaxOpenConns    = 900
+	DefaultJobserviceWorkers = 10
+	DefaultLogLevel          = "info"
+	DefaultDatabasePort      = 5432
+	DefaultDatabaseUsername  = "postgres"
+	DefaultDatabaseName      = "registry"
+	DefaultDatabaseSSLMode   = "disable"
+)
+
+// Defaults for the kubernetes block of a harbor block
+const (
+	DefaultKubernetesName      = "harbor"
+	DefaultKubernetesNamespace = "harbor"
+	DefaultReplicas            = 1
+	DefaultVolumeSize          = "1Gi"
+	DefaultRegistryVolumeSize  = "5Gi"
+)
+
+// LogLevels are the levels Harbor components accept
+var LogLevels = []string{"debug", "info", "warning", "error", "fatal"}
+
+// SSLModes are the PostgreSQL sslmode values Harbor accepts
+var SSLModes = []string{"disable", "require", "verify-ca", "verify-full"}
+
+// Storage backends of the registry
+const (
+	StorageFilesystem = "filesystem"
+	StorageS3         = "s3"
+	StorageAzure      = "azure"
+)
+
+// Components of a Harbor install that a kubernetes block can size
+const (
+	ComponentCore       = "core"
+	ComponentPortal     = "portal"
+	ComponentRegistry   = "registry"
+	ComponentJobservice = "jobservice"
+	ComponentDatabase   = "database"
+	ComponentRedis      = "redis"
+)
+
+// Components lists the component names in install order
+var Components = []string{
+	ComponentCore, ComponentPortal, ComponentRegistry,
+	ComponentJobservice, ComponentDatabase, ComponentRedis,
+}
+
+// Config is a parsed harbor toolkit configuration file
+type Config struct {
+	// Path is the file the configuration was loaded from
+	Path       string
+	Registries []*RegistryConfig
+	Harbors    []*HarborConfig
+}
+
+// RegistryConfig is a `registry "<name>" { ... }` block
+type RegistryConfig struct {
+	Name       string
+	Address    string
+	Username   string
+	Password   string
+	Protection ProtectionConfig
+	Batch      BatchConfig
+	Health     HealthConfig
+}
+
+// ProtectionConfig is the `protection` block of a registry
+type ProtectionConfig struct {
+	// Store is the policy store path used by `harbor registry protect`
+	Store    string
+	Policies []PolicyConfig
+}
+
+// PolicyConfig is a `policy "<name>" { ... }` block
+type PolicyConfig struct {
+	Name        string
+	Pattern     *regexp.Regexp
+	Immutable   bool
+	MaxAge      time.Duration
+	AllowDelete bool
+	Priority    int
+}
+
+// BatchConfig is the `batch` block of a registry
+type BatchConfig struct {
+	Workers int
+	// Timeout bounds a whole batch operation; zero means no limit
+	Timeout time.Duration
+	// Attempts per target, with exponential backoff between them
+	Attempts   int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// HealthConfig is the `health` block of a registry
+type HealthConfig struct {
+	Endpoints  []string
+	Threshold  int
+	RetryDelay time.Duration
+	Timeout    time.Duration
+	Interval   time.Duration
+	// MaxRetryDelay caps the retry delay, doubled for every failed retry
+	MaxRetryDelay time.Duration
+	// SuccessThreshold is how many successful retries close a circuit
+	SuccessThreshold int
+	// SlowThreshold fails slower checks; zero disables it
+	SlowThreshold time.Duration
+	// Notify is nil without a notify block
+	Notify *NotifyConfig
+}
+
+// NotifyConfig is the `notify` block of a health block, sending alerts on
+// circuit transitions to every sink
+type NotifyConfig struct {
+	// RenotifyInterval is how often a failing endpoint's repeated
+	// transitions are notified again; zero notifies each one
+	RenotifyInterval time.Duration
+	// An endpoint going down or up FlapThreshold times within FlapWindow
+	// is flapping; zero threshold disables detection
+	FlapWindow    time.Duration
+	FlapThreshold int
+	Webhooks      []WebhookConfig
+	Slack         []WebhookConfig
+	Email         []EmailConfig
+	Exec          []ExecConfig
+}
+
+// WebhookConfig is a `webhook "<name>"` or `slack "<name>"` block
+type WebhookConfig struct {
+	Name string
+	URL  string
+	// Headers are sent with each request, e.g. an Authorization header;
+	// webhook blocks only
+	Headers map[string]string
+}
+
+// EmailConfig is an `email "<name>" { ... }` block
+type EmailConfig struct {
+	Name string
+	// SMTP is the host:port of the mail server
+	SMTP     string
+	From     string
+	To       []string
+	Username string
+	Password string
+}
+
+// ExecConfig is an `exec "<name>" { ... }` block
+type ExecConfig struct {
+	Name string
+	// Command is the program and its arguments
+	Command []string
+}
+
+// HarborConfig is a `harbor "<name>" { ... }` block describing a Harbor
+// installation for `harbor deploy`
+type HarborConfig struct {
+	Name     string
+	Hostname string
+	// ExternalURL overrides the URL derived from the hostname and ports,
+	// e.g. when Harbor sits behind another proxy
+	ExternalURL   string
+	Version       string
+	AdminPassword string
+	// DataDir is where components keep persistent data on the host
+	DataDir    string
+	HTTP       HTTPConfig
+	HTTPS      *HTTPSConfig
+	Database   DatabaseConfig
+	Redis      RedisConfig
+	Storage    StorageConfig
+	Jobservice JobserviceConfig
+	Log        LogConfig
+	Kubernetes KubernetesConfig
+}
+
+// HTTPConfig is the `http` block of a harbor block
+type HTTPConfig struct {
+	Port int
+}
+
+// HTTPSConfig is the `https` block of a harbor block; nil when HTTPS is off
+type HTTPSConfig struct {
+	Port        int
+	Certificate string
+	PrivateKey  string
+}
+
+// DatabaseConfig is the `database` block of a harbor block
+type DatabaseConfig struct {
+	// Host is an external PostgreSQL server; empty runs the bundled one
+	Host         string
+	Port         int
+	Username     string
+	Name         string
+	SSLMode      string
+	Password     string
+	MaxIdleConns int
+	MaxOpenConns int
+}
+
+// External reports whether Harbor uses a database it does not run
+func (d DatabaseConfig) External() bool {
+	return d.Host != ""
+}
+
+// RedisConfig is the `redis` block of a harbor block
+type RedisConfig struct {
+	// Address is the host:port of an external Redis; empty runs the
+	// bundled one
+	Address string
+	// Password enables Redis authentication when set
+	Password string
+}
+
+// External reports whether Harbor uses a Redis it does not run
+func (r RedisConfig) External() bool {
+	return r.Address != ""
+}
+
+// StorageConfig is the `storage` block of a harbor block, where the
+// registry keeps image layers
+type StorageConfig struct {
+	// Type is one of filesystem, s3 or azure; the matching block is set
+	Type  string
+	S3    *S3Config
+	Azure *AzureConfig
+}
+
+// S3Config is the `s3` block of a storage block. Without keys the
+// registry uses the credentials of its environment, e.g. an IAM role
+type S3Config struct {
+	Bucket    string
+	Region    string
+	Endpoint  string
+	AccessKey string
+	SecretKey string
+	// RootDirectory is a prefix for every object the registry writes
+	RootDirectory string
+}
+
+// AzureConfig is the `azure` block of a storage block
+type AzureConfig struct {
+	AccountName string
+	AccountKey  string
+	Container   string
+}
+
+// KubernetesConfig is the `kubernetes` block of a harbor block, used by
+// `harbor deploy k8s`
+type KubernetesConfig struct {
+	// Name prefixes every rendered resource
+	Name      string
+	Namespace string
+	// IngressClass selects the ingress controller; empty uses the
+	// cluster default
+	IngressClass       string
+	IngressAnnotations map[string]string
+	// TLSSecret names an existing kubernetes.io/tls secret that enables
+	// HTTPS on the ingress
+	TLSSecret string
+	// StorageClass of the persistent volumes; empty uses the cluster
+	// default
+	StorageClass string
+	// Components holds every name in Components, with defaults for the
+	// ones without a component block
+	Components map[string]ComponentConfig
+}
+
+// ComponentConfig is a `component "<name>" { ... }` block of a
+// kubernetes block
+type ComponentConfig struct {
+	Replicas int
+	Requests Resources
+	Limits   Resources
+	// VolumeSize is the size of the persistent volume of the registry,
+	// jobservice, database and Redis
+	VolumeSize string
+}
+
+// Resources are CPU and memory quantities in Kubernetes notation, e.g.
+// "500m" and "1Gi"; empty values are left unset
+type Resources struct {
+	CPU    string
+	Memory string
+}
+
+// JobserviceConfig is the `jobservice` block of a harbor block
+type JobserviceConfig struct {
+	Workers int
+}
+
+// LogConfig is the `log` block of a harbor block
+type LogConfig struct {
+	Level string
+}
+
+// URL returns the address clients use to reach Harbor
+func (h *HarborConfig) URL() string {
+	if h.ExternalURL != "" {
+		return h.ExternalURL
+	}
+	if h.HTTPS != nil {
+		if h.HTTPS.Port == DefaultHTTPSPort {
+			return "https://" + h.Hostname
+		}
+		return fmt.Sprintf("https://%s:%d", h.Hostname, h.HTTPS.Port)
+	}
+	if h.HTTP.Port == DefaultHTTPPort {
+		return "http://" + h.Hostname
+	}
+	return fmt.Sprintf("http://%s:%d", h.Hostname, h.HTTP.Port)
+}
+
+// Registry selects a registry block by name. An empty name selects the
+// only block, or the one named "default"; nil is returned when the file
+// has no registry blocks at all
+func (c *Config) Registry(name string) (*RegistryConfig, error) {
+	return selectBlock(c.Path, "registry", c.Registries, name, func(r *RegistryConfig) string { return r.Name })
+}
+
+// Harbor selects a harbor block by name, the same way Registry does
+func (c *Config) Harbor(name string) (*HarborConfig, error) {
+	return selectBlock(c.Path, "harbor", c.Harbors, name, func(h *HarborConfig) string { return h.Name })
+}
+
+// selectBlock picks the named block of a kind, or the only or "default"
+// block when name is empty
+func selectBlock[T any](path, kind string, blocks []*T, name string, nameOf func(*T) string) (*T, error) {
+	if name != "" {
+		for _, b := range blocks {
+			if nameOf(b) == name {
+				return b, nil
+			}
+		}
+		return nil, fmt.Errorf("%s: no %s block named %q", path, kind, name)
+	}
+
+	switch len(blocks) {
+	case 0:
+		return nil, nil
+	case 1:
+		return blocks[0], nil
+	}
+
+	for _, b := range blocks {
+		if nameOf(b) == "default" {
+			return b, nil
+		}
+	}
+	return nil, fmt.Errorf("%s: %d %s blocks defined, select one by name", path, len(blocks), kind)
+}
@@ -0,0 +1,226 @@
+// Copyright 2021 vjranagit
+//
+// Component configuration shared by every install method
+
+package deploy
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/vjranagit/harbor/pkg/config"
+)
+
+// Ports components listen on inside their containers
+const (
+	ComponentPort = 8080
+	RegistryPort  = 5000
+	DatabasePort  = 5432
+	RedisPort     = 6379
+)
+
+// Redis databases each component uses, as Harbor assigns them
+const (
+	redisCoreDB       = 0
+	redisRegistryDB   = 1
+	redisJobserviceDB = 2
+)
+
+//go:embed templates
+var templateFS embed.FS
+
+// Install is a harbor block with everything needed to render it
+type Install struct {
+	Config  *config.HarborConfig
+	Secrets *Secrets
+	Hosts   Hosts
+	// URL is where clients reach Harbor, which depends on how the
+	// install exposes it
+	URL string
+}
+
+// Hosts are the names components reach each other by
+type Hosts struct {
+	Core        string
+	Portal      string
+	Registry    string
+	Registryctl string
+	Jobservice  string
+	Database    string
+	Redis       string
+}
+
+// components are the shared configuration files, relative to the
+// component config root. Env files hold credentials and are only read by
+// the container runtime; the rest are mounted into containers
+var components = []struct {
+	path        string
+	mode        fs.FileMode
+	credentials bool
+}{
+	{"core/app.conf", 0o644, false},
+	{"core/env", 0o600, true},
+	{"db/env", 0o600, true},
+	{"jobservice/config.yml", 0o644, true},
+	{"jobservice/env", 0o600, true},
+	{"redis/redis.conf", 0o644, true},
+	{"registry/config.yml", 0o644, true},
+	{"registryctl/config.yml", 0o644, false},
+	{"registryctl/env", 0o600, true},
+}
+
+// Components renders the configuration of core, registry, registryctl,
+// jobservice, the database and Redis
+func Components(in *Install) ([]File, error) {
+	tmpl, err := ParseTemplates(templateFS)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]File, 0, len(components))
+	for _, c := range components {
+		data, err := Execute(tmpl, c.path, in)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, File{Path: c.path, Mode: c.mode, Data: data, Credentials: c.credentials})
+	}
+	return files, nil
+}
+
+// ParseTemplates parses the templates directory of fsys. Templates are
+// named after the file they render, with dots for slashes, e.g.
+// core/env is rendered by templates/core.env.tmpl
+func ParseTemplates(fsys fs.FS) (*template.Template, error) {
+	tmpl, err := template.New("").Funcs(template.FuncMap{
+		"quote": strconv.Quote,
+		"upper": strings.ToUpper,
+	}).ParseFS(fsys, "templates/*.tmpl")
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse templates: %w", err)
+	}
+	return tmpl, nil
+}
+
+// Execute renders the template of the file at path
+func Execute(tmpl *template.Template, path string, data any) ([]byte, error) {
+	var buf bytes.Buffer
+	name := strings.ReplaceAll(path, "/", ".") + ".tmpl"
+	if err := tmpl.ExecuteTemplate(&buf, name, data); err != nil {
+		return nil, fmt.Errorf("failed to render %s: %w", path, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// CoreURL is the internal address of core
+func (in *Install) CoreURL() string {
+	return httpURL(in.Hosts.Core, ComponentPort)
+}
+
+// PortalURL is the internal address of the portal
+func (in *Install) PortalURL() string {
+	return httpURL(in.Hosts.Portal, ComponentPort)
+}
+
+// RegistryURL is the internal address of the registry
+func (in *Install) RegistryURL() string {
+	return httpURL(in.Hosts.Registry, RegistryPort)
+}
+
+// RegistryctlURL is the internal address of the registry controller
+func (in *Install) RegistryctlURL() string {
+	return httpURL(in.Hosts.Registryctl, ComponentPort)
+}
+
+// JobserviceURL is the internal address of the job service
+func (in *Install) JobserviceURL() string {
+	return httpURL(in.Hosts.Jobservice, ComponentPort)
+}
+
+// RegistryUser is the account core and jobservice use with the registry
+func (in *Install) RegistryUser() string {
+	return RegistryUser
+}
+
+// DatabaseHost is the PostgreSQL server, external or bundled
+func (in *Install) DatabaseHost() string {
+	if in.Config.Database.External() {
+		return in.Config.Database.Host
+	}
+	return in.Hosts.Database
+}
+
+// RedisAddr is the Redis host and port, external or bundled
+func (in *Install) RedisAddr() string {
+	if in.Config.Redis.External() {
+		return in.Config.Redis.Address
+	}
+	return net.JoinHostPort(in.Hosts.Redis, strconv.Itoa(RedisPort))
+}
+
+// RedisURL returns the Redis URL of a component database
+func (in *Install) RedisURL(db int) string {
+	u := url.URL{
+		Scheme:   "redis",
+		Host:     in.RedisAddr(),
+		RawQuery: "idle_timeout_seconds=30",
+	}
+	if db != 0 {
+		u.Path = "/" + strconv.Itoa(db)
+	}
+	if in.Config.Redis.Password != "" {
+		u.User = url.UserPassword("", in.Config.Redis.Password)
+	}
+	return u.String()
+}
+
+// CoreRedisURL is the Redis URL of core's cache
+func (in *Install) CoreRedisURL() string {
+	return in.RedisURL(redisCoreDB)
+}
+
+// RegistryRedisURL is the Redis URL of the registry's blob cache
+func (in *Install) RegistryRedisURL() string {
+	return in.RedisURL(redisRegistryDB)
+}
+
+// RegistryRedisDB is the Redis database of the registry's blob cache
+func (in *Install) RegistryRedisDB() int {
+	return redisRegistryDB
+}
+
+// JobserviceRedisURL is the Redis URL of the job queue
+func (in *Install) JobserviceRedisURL() string {
+	return in.RedisURL(redisJobserviceDB)
+}
+
+// Redact lists the secret values an install renders into its files
+func (in *Install) Redact() []string {
+	redact := append(in.Secrets.Values(),
+		in.Config.AdminPassword,
+		in.Config.Database.Password,
+		in.Config.Redis.Password,
+	)
+	// Redis URLs carry the password escaped
+	if password := in.Config.Redis.Password; password != "" {
+		redact = append(redact, strings.TrimPrefix(url.UserPassword("", password).String(), ":"))
+	}
+	if s3 := in.Config.Storage.S3; s3 != nil {
+		redact = append(redact, s3.SecretKey)
+	}
+	if azure := in.Config.Storage.Azure; azure != nil {
+		redact = append(redact, azure.AccountKey)
+	}
+	return redact
+}
+
+func httpURL(host string, port int) string {
+	return "http://" + net.JoinHostPort(host, strconv.Itoa(port))
+}
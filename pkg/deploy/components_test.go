@@ -0,0 +1,155 @@
+// Copyright 2021 vjranagit
+//
+// Shared component configuration tests
+
+package deploy
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/vjranagit/harbor/pkg/config"
+)
+
+func testInstall(redisPassword string) *Install {
+	return &Install{
+		Config: &config.HarborConfig{
+			Name:          "default",
+			Hostname:      "harbor.example.com",
+			Version:       config.DefaultHarborVersion,
+			AdminPassword: "admin",
+			DataDir:       config.DefaultDataDir,
+			HTTP:          config.HTTPConfig{Port: config.DefaultHTTPPort},
+			Database: config.DatabaseConfig{
+				Port:         config.DefaultDatabasePort,
+				Username:     config.DefaultDatabaseUsername,
+				Name:         config.DefaultDatabaseName,
+				SSLMode:      config.DefaultDatabaseSSLMode,
+				Password:     "db",
+				MaxIdleConns: 1,
+				MaxOpenConns: 2,
+			},
+			Redis:      config.RedisConfig{Password: redisPassword},
+			Storage:    config.StorageConfig{Type: config.StorageFilesystem},
+			Jobservice: config.JobserviceConfig{Workers: 3},
+			Log:        config.LogConfig{Level: "debug"},
+		},
+		Secrets: &Secrets{CoreSecret: "core", RegistryPassword: "registry"},
+		Hosts: Hosts{
+			Core:        "harbor-core",
+			Portal:      "harbor-portal",
+			Registry:    "harbor-registry",
+			Registryctl: "harbor-registry",
+			Jobservice:  "harbor-jobservice",
+			Database:    "harbor-database",
+			Redis:       "harbor-redis",
+		},
+		URL: "http://harbor.example.com",
+	}
+}
+
+func TestInstall_RedisURL(t *testing.T) {
+	tests := []struct {
+		password string
+		db       int
+		want     string
+	}{
+		{"", 0, "redis://harbor-redis:6379?idle_timeout_seconds=30"},
+		{"", 2, "redis://harbor-redis:6379/2?idle_timeout_seconds=30"},
+		{"p@ss/word", 1, "redis://:p%40ss%2Fword@harbor-redis:6379/1?idle_timeout_seconds=30"},
+	}
+
+	for _, tt := range tests {
+		if got := testInstall(tt.password).RedisURL(tt.db); got != tt.want {
+			t.Errorf("expected %s, got %s", tt.want, got)
+		}
+	}
+
+	if redact := testInstall("p@ss/word").Redact(); !slices.Contains(redact, "p%40ss%2Fword") {
+		t.Errorf("expected the escaped Redis password to be redacted, got %v", redact)
+	}
+}
+
+func TestComponents(t *testing.T) {
+	files, err := Components(testInstall(""))
+	if err != nil {
+		t.Fatalf("Components failed: %v", err)
+	}
+	if len(files) != len(components) {
+		t.Fatalf("expected %d files, got %d", len(components), len(files))
+	}
+
+	rendered := make(map[string]string)
+	for _, f := range files {
+		rendered[f.Path] = string(f.Data)
+	}
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"core/env", "POSTGRESQL_HOST=harbor-database\n"},
+		{"core/env", "REGISTRY_URL=http://harbor-registry:5000\n"},
+		{"core/env", "EXT_ENDPOINT=http://harbor.example.com\n"},
+		{"core/env", "MAX_JOB_WORKERS=3\n"},
+		{"core/env", "REGISTRY_STORAGE_PROVIDER_NAME=filesystem\n"},
+		{"jobservice/config.yml", `level: "DEBUG"`},
+		{"jobservice/config.yml", "workers: 3\n"},
+		{"registry/config.yml", `addr: "harbor-redis:6379"`},
+		{"redis/redis.conf", "protected-mode no\n"},
+		{"registry/config.yml", "rootdirectory: /storage\n"},
+		{"db/env", "POSTGRES_PASSWORD=db\n"},
+	}
+	for _, tt := range tests {
+		if !strings.Contains(rendered[tt.path], tt.want) {
+			t.Errorf("expected %s to contain %q, got:\n%s", tt.path, tt.want, rendered[tt.path])
+		}
+	}
+}
+
+func TestComponents_ExternalServices(t *testing.T) {
+	in := testInstall("")
+	in.Config.Database.Host = "pg.example.com"
+	in.Config.Database.Port = 6432
+	in.Config.Database.Username = "harbor"
+	in.Config.Database.Name = "harbor_registry"
+	in.Config.Database.SSLMode = "verify-full"
+	in.Config.Redis.Address = "redis.example.com:6380"
+	in.Config.Storage = config.StorageConfig{
+		Type: config.StorageS3,
+		S3:   &config.S3Config{Bucket: "images", Region: "eu-west-1", AccessKey: "AKIA", SecretKey: "s3-secret"},
+	}
+
+	files, err := Components(in)
+	if err != nil {
+		t.Fatalf("Components failed: %v", err)
+	}
+	rendered := make(map[string]string)
+	for _, f := range files {
+		rendered[f.Path] = string(f.Data)
+	}
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"core/env", "POSTGRESQL_HOST=pg.example.com\nPOSTGRESQL_PORT=6432\nPOSTGRESQL_USERNAME=harbor\n"},
+		{"core/env", "POSTGRESQL_DATABASE=harbor_registry\nPOSTGRESQL_SSLMODE=verify-full\n"},
+		{"core/env", "_REDIS_URL_CORE=redis://redis.example.com:6380?"},
+		{"core/env", "REGISTRY_STORAGE_PROVIDER_NAME=s3\n"},
+		{"registry/config.yml", `addr: "redis.example.com:6380"`},
+		{"registry/config.yml", "  s3:\n    region: \"eu-west-1\"\n    bucket: \"images\"\n    accesskey: \"AKIA\"\n    secretkey: \"s3-secret\"\n"},
+	}
+	for _, tt := range tests {
+		if !strings.Contains(rendered[tt.path], tt.want) {
+			t.Errorf("expected %s to contain %q, got:\n%s", tt.path, tt.want, rendered[tt.path])
+		}
+	}
+	if strings.Contains(rendered["registry/config.yml"], "filesystem:") {
+		t.Errorf("expected no filesystem storage with s3, got:\n%s", rendered["registry/config.yml"])
+	}
+	if redact := in.Redact(); !slices.Contains(redact, "s3-secret") {
+		t.Errorf("expected the S3 secret key to be redacted, got %v", redact)
+	}
+}
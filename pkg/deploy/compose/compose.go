@@ -0,0 +1,101 @@
+// Copyright 2021 vjranagit
+//
+// Docker Compose rendering of a Harbor install
+
+package compose
+
+import (
+	"embed"
+	"path"
+	"sort"
+	"strconv"
+
+	"github.com/vjranagit/harbor/pkg/config"
+	"github.com/vjranagit/harbor/pkg/deploy"
+)
+
+// Paths of the rendered files, relative to the install directory
+const (
+	ComposeFile = "docker-compose.yml"
+	ConfigDir   = "common/config"
+)
+
+// Images are pulled from this repository, tagged with the Harbor version
+const imageRepository = "goharbor"
+
+//go:embed templates
+var templateFS embed.FS
+
+// Hosts are the compose service names components reach each other by
+var Hosts = deploy.Hosts{
+	Core:        "core",
+	Portal:      "portal",
+	Registry:    "registry",
+	Registryctl: "registryctl",
+	Jobservice:  "jobservice",
+	Database:    "postgresql",
+	Redis:       "redis",
+}
+
+// install adds the compose specifics templates need
+type install struct {
+	*deploy.Install
+}
+
+// Render renders a Docker Compose install of h: docker-compose.yml, the
+// component configuration under common/config and the secrets
+func Render(h *config.HarborConfig, secrets *deploy.Secrets) (*deploy.Bundle, error) {
+	in := install{&deploy.Install{Config: h, Secrets: secrets, Hosts: Hosts, URL: h.URL()}}
+
+	components, err := deploy.Components(in.Install)
+	if err != nil {
+		return nil, err
+	}
+	files := secrets.Files()
+	for _, f := range components {
+		f.Path = path.Join(ConfigDir, f.Path)
+		files = append(files, f)
+	}
+
+	tmpl, err := deploy.ParseTemplates(templateFS)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range []struct {
+		name string
+		path string
+	}{
+		{ComposeFile, ComposeFile},
+		{"nginx/nginx.conf", path.Join(ConfigDir, "nginx/nginx.conf")},
+	} {
+		data, err := deploy.Execute(tmpl, f.name, in)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, deploy.File{Path: f.path, Mode: 0o644, Data: data})
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return &deploy.Bundle{Files: files, Redact: in.Redact()}, nil
+}
+
+// Image returns the image of a component
+func (in install) Image(name string) string {
+	return imageRepository + "/" + name + ":" + in.Config.Version
+}
+
+// Data returns a directory under the data directory
+func (in install) Data(dir string) string {
+	return path.Join(in.Config.DataDir, dir)
+}
+
+// Volume formats a bind mount
+func (in install) Volume(source, target string) string {
+	return strconv.Quote(source + ":" + target + ":z")
+}
+
+// ConfigPath returns the path of a component configuration file, as mounted
+// from the install directory
+func (in install) ConfigPath(file string) string {
+	return "./" + path.Join(ConfigDir, file)
+}
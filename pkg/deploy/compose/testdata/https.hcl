@@ -0,0 +1,34 @@
+harbor "production" {
+  hostname       = "registry.example.com"
+  version        = "v2.10.3"
+  admin_password = "s3cret-admin"
+  data_dir       = "/srv/harbor"
+
+  http {
+    port = 8080
+  }
+
+  https {
+    port        = 8443
+    certificate = "/etc/harbor/tls/tls.crt"
+    private_key = "/etc/harbor/tls/tls.key"
+  }
+
+  database {
+    password       = "db-p@ss"
+    max_idle_conns = 50
+    max_open_conns = 500
+  }
+
+  redis {
+    password = "redis/p@ss word"
+  }
+
+  jobservice {
+    workers = 20
+  }
+
+  log {
+    level = "warning"
+  }
+}
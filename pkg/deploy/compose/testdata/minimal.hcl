@@ -0,0 +1,8 @@
+harbor "default" {
+  hostname       = "harbor.example.com"
+  admin_password = "Harbor12345"
+
+  database {
+    password = "root123"
+  }
+}
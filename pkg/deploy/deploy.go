@@ -0,0 +1,199 @@
+// Copyright 2021 vjranagit
+//
+// Rendered install bundles and planning them against disk
+
+package deploy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// File is a rendered file, its path relative to the install directory
+type File struct {
+	Path string
+	Mode fs.FileMode
+	Data []byte
+	// Sensitive files are reported as changed but never diffed, and
+	// their directories are only accessible by the owner
+	Sensitive bool
+	// Credentials marks component configuration holding passwords, which
+	// Kubernetes installs keep in secrets rather than config maps
+	Credentials bool
+}
+
+// Bundle is a rendered installation
+type Bundle struct {
+	Files []File
+	// Redact lists secret values masked in diffs
+	Redact []string
+}
+
+// Action is what applying a bundle does to a file
+type Action string
+
+const (
+	ActionCreate    Action = "create"
+	ActionUpdate    Action = "update"
+	ActionUnchanged Action = "unchanged"
+)
+
+// Change is the difference between a rendered file and the one on disk
+type Change struct {
+	Path      string
+	Action    Action
+	Sensitive bool
+	// Diff is a unified diff with secrets masked; empty for unchanged and
+	// sensitive files, and when only secret values changed
+	Diff string
+}
+
+// redactedValue replaces secret values in diffs
+const redactedValue = "********"
+
+// Plan compares a bundle with the files under dir. Files on disk that the
+// bundle does not render are left alone and not reported
+func Plan(dir string, b *Bundle) ([]Change, error) {
+	changes := make([]Change, 0, len(b.Files))
+	for _, f := range b.Files {
+		change := Change{Path: f.Path, Action: ActionUnchanged, Sensitive: f.Sensitive}
+
+		path := filepath.Join(dir, filepath.FromSlash(f.Path))
+		current, err := os.ReadFile(path)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			change.Action = ActionCreate
+		case err != nil:
+			return nil, fmt.Errorf("failed to read %s: %w", path, err)
+		case !bytes.Equal(current, f.Data):
+			change.Action = ActionUpdate
+		default:
+			info, err := os.Stat(path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to stat %s: %w", path, err)
+			}
+			if info.Mode().Perm() != f.Mode.Perm() {
+				change.Action = ActionUpdate
+				change.Diff = fmt.Sprintf("mode %#o => %#o\n", info.Mode().Perm(), f.Mode.Perm())
+			}
+		}
+
+		if !f.Sensitive && change.Diff == "" && change.Action != ActionUnchanged {
+			from := "a/" + f.Path
+			if change.Action == ActionCreate {
+				from = "/dev/null"
+			}
+			before, after := redact(current, f.Data, b.Redact)
+			change.Diff = unifiedDiff(from, "b/"+f.Path, before, after)
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// redact masks secrets in a rendered file, and the settings holding them in
+// the file on disk, so a diff shows neither the new nor the old value
+func redact(current, rendered []byte, secrets []string) ([]byte, []byte) {
+	var sorted []string
+	for _, secret := range secrets {
+		if secret != "" {
+			sorted = append(sorted, secret)
+		}
+	}
+	if len(sorted) == 0 {
+		return current, rendered
+	}
+	// Longer secrets first, so one containing another is masked whole
+	sort.Slice(sorted, func(i, j int) bool { return len(sorted[i]) > len(sorted[j]) })
+	pairs := make([]string, 0, 2*len(sorted))
+	for _, secret := range sorted {
+		pairs = append(pairs, secret, redactedValue)
+	}
+	replacer := strings.NewReplacer(pairs...)
+
+	// A setting is the text around a secret on its line
+	type setting struct{ prefix, suffix string }
+	var settings []setting
+	after := splitLines(rendered)
+	for i, line := range after {
+		for _, secret := range sorted {
+			if start := strings.Index(line, secret); start >= 0 {
+				settings = append(settings, setting{line[:start], line[start+len(secret):]})
+				after[i] = replacer.Replace(line)
+				break
+			}
+		}
+	}
+
+	before := splitLines(current)
+	for i, line := range before {
+		before[i] = replacer.Replace(line)
+		for _, s := range settings {
+			if len(line) >= len(s.prefix)+len(s.suffix) && strings.HasPrefix(line, s.prefix) && strings.HasSuffix(line, s.suffix) {
+				before[i] = s.prefix + redactedValue + s.suffix
+				break
+			}
+		}
+	}
+	return joinLines(before), joinLines(after)
+}
+
+// Apply writes the files of a bundle that differ from disk and returns the
+// plan it carried out
+func Apply(dir string, b *Bundle) ([]Change, error) {
+	changes, err := Plan(dir, b)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, change := range changes {
+		if change.Action == ActionUnchanged {
+			continue
+		}
+		if err := writeFile(dir, b.Files[i]); err != nil {
+			return nil, err
+		}
+	}
+	return changes, nil
+}
+
+// writeFile atomically replaces a file with the rendered content
+func writeFile(dir string, f File) error {
+	path := filepath.Join(dir, filepath.FromSlash(f.Path))
+
+	dirMode := fs.FileMode(0o755)
+	if f.Sensitive {
+		dirMode = 0o700
+	}
+	if err := os.MkdirAll(filepath.Dir(path), dirMode); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %w", f.Path, err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", f.Path, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(f.Data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", f.Path, err)
+	}
+	if err := tmp.Chmod(f.Mode.Perm()); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to set mode of %s: %w", f.Path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", f.Path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write %s: %w", f.Path, err)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+// Copyright 2021 vjranagit
+//
+// Plan and apply tests
+
+package deploy
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPlanAndApply(t *testing.T) {
+	dir := t.TempDir()
+	bundle := &Bundle{
+		Files: []File{
+			{Path: "app/config.yml", Mode: 0o644, Data: []byte("level: info\npassword: hunter2\n")},
+			{Path: "app/env", Mode: 0o600, Data: []byte("TOKEN=abc\n")},
+			{Path: "secret/key", Mode: 0o644, Data: []byte("key"), Sensitive: true},
+		},
+		Redact: []string{"hunter2", ""},
+	}
+
+	changes, err := Plan(dir, bundle)
+	if err != nil {
+		t.Fatalf("Plan failed: %v", err)
+	}
+	for _, c := range changes {
+		if c.Action != ActionCreate {
+			t.Errorf("%s: expected create, got %s", c.Path, c.Action)
+		}
+	}
+	if !strings.Contains(changes[0].Diff, "+level: info") || strings.Contains(changes[0].Diff, "hunter2") {
+		t.Errorf("expected redacted diff of the new file, got:\n%s", changes[0].Diff)
+	}
+	if changes[2].Diff != "" || !changes[2].Sensitive {
+		t.Errorf("expected sensitive file not to be diffed, got %+v", changes[2])
+	}
+	if _, err := os.Stat(filepath.Join(dir, "app")); !os.IsNotExist(err) {
+		t.Fatal("expected Plan not to write anything")
+	}
+
+	if _, err := Apply(dir, bundle); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	for _, f := range bundle.Files {
+		path := filepath.Join(dir, filepath.FromSlash(f.Path))
+		data, err := os.ReadFile(path)
+		if err != nil || string(data) != string(f.Data) {
+			t.Errorf("%s: expected rendered content, got %q (%v)", f.Path, data, err)
+			continue
+		}
+		info, _ := os.Stat(path)
+		if info.Mode().Perm() != f.Mode {
+			t.Errorf("%s: expected mode %#o, got %#o", f.Path, f.Mode, info.Mode().Perm())
+		}
+	}
+	if info, _ := os.Stat(filepath.Join(dir, "secret")); info.Mode().Perm() != 0o700 {
+		t.Errorf("expected private directory for sensitive files, got %#o", info.Mode().Perm())
+	}
+
+	changes, err = Apply(dir, bundle)
+	if err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	for _, c := range changes {
+		if c.Action != ActionUnchanged {
+			t.Errorf("%s: expected unchanged after apply, got %s", c.Path, c.Action)
+		}
+	}
+
+	bundle.Files[0].Data = []byte("level: debug\npassword: hunter2\n")
+	if err := os.Chmod(filepath.Join(dir, "app", "env"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	changes, err = Plan(dir, bundle)
+	if err != nil {
+		t.Fatalf("Plan failed: %v", err)
+	}
+	if changes[0].Action != ActionUpdate || !strings.Contains(changes[0].Diff, "-level: info\n+level: debug\n") {
+		t.Errorf("expected content update, got %+v", changes[0])
+	}
+	if changes[1].Action != ActionUpdate || !strings.Contains(changes[1].Diff, "mode 0644 => 0600") {
+		t.Errorf("expected mode update, got %+v", changes[1])
+	}
+	if changes[2].Action != ActionUnchanged {
+		t.Errorf("expected unchanged file, got %+v", changes[2])
+	}
+
+	// The previous value of a secret is masked too
+	if err := os.WriteFile(filepath.Join(dir, "app", "config.yml"), []byte("level: debug\npassword: old-secret\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	changes, err = Plan(dir, bundle)
+	if err != nil {
+		t.Fatalf("Plan failed: %v", err)
+	}
+	if changes[0].Action != ActionUpdate || changes[0].Diff != "" {
+		t.Errorf("expected an update with only secrets changed, got %+v", changes[0])
+	}
+}
+
+func TestRedact(t *testing.T) {
+	current := []byte("USER=admin\nPASSWORD=old\nURL=redis://:old@redis:6379/1\n")
+	rendered := []byte("USER=admin\nPASSWORD=new-secret\nURL=redis://:new-secret@redis:6379/1\n")
+
+	before, after := redact(current, rendered, []string{"new", "new-secret", ""})
+	want := "USER=admin\nPASSWORD=********\nURL=redis://:********@redis:6379/1\n"
+	if string(before) != want || string(after) != want {
+		t.Errorf("expected both sides masked as\n%s\ngot\n%s\nand\n%s", want, before, after)
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2021 vjranagit
+//
+// Line-based unified diffs
+
+package deploy
+
+import (
+	"fmt"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines shown around a change
+const diffContext = 3
+
+// diffLine is one line of an edit script: ' ' kept, '-' removed or '+'
+// added, with the line offsets in both texts before it
+type diffLine struct {
+	op   byte
+	text string
+	a, b int
+}
+
+// unifiedDiff returns a unified diff turning a into b, or "" when their
+// lines are equal. Rendered files are small, so a quadratic longest common
+// subsequence is fine
+func unifiedDiff(fromName, toName string, a, b []byte) string {
+	x, y := splitLines(a), splitLines(b)
+
+	// lcs[i][j] is the longest common subsequence of x[i:] and y[j:]
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var lines []diffLine
+	changed := false
+	i, j := 0, 0
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			lines = append(lines, diffLine{' ', x[i], i, j})
+			i++
+			j++
+		case i < len(x) && (j == len(y) || lcs[i+1][j] >= lcs[i][j+1]):
+			// Removals come before additions, as diff(1) shows them
+			lines = append(lines, diffLine{'-', x[i], i, j})
+			i++
+			changed = true
+		default:
+			lines = append(lines, diffLine{'+', y[j], i, j})
+			j++
+			changed = true
+		}
+	}
+	if !changed {
+		return ""
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", fromName, toName)
+	for start := 0; start < len(lines); {
+		if lines[start].op == ' ' {
+			start++
+			continue
+		}
+
+		// Grow the hunk until the unchanged run after a change is too
+		// long to bridge
+		end := start
+		for end < len(lines) {
+			if lines[end].op != ' ' {
+				end++
+				continue
+			}
+			run := end
+			for run < len(lines) && lines[run].op == ' ' {
+				run++
+			}
+			if run == len(lines) || run-end > 2*diffContext {
+				end = min(end+diffContext, len(lines))
+				break
+			}
+			end = run
+		}
+		first := max(start-diffContext, 0)
+		writeHunk(&out, lines[first:end])
+		start = end
+	}
+	return out.String()
+}
+
+// writeHunk writes one hunk with its header
+func writeHunk(out *strings.Builder, hunk []diffLine) {
+	var aCount, bCount int
+	for _, l := range hunk {
+		if l.op != '+' {
+			aCount++
+		}
+		if l.op != '-' {
+			bCount++
+		}
+	}
+	fmt.Fprintf(out, "@@ -%s +%s @@\n", hunkRange(hunk[0].a, aCount), hunkRange(hunk[0].b, bCount))
+	for _, l := range hunk {
+		out.WriteByte(l.op)
+		out.WriteString(l.text)
+		out.WriteByte('\n')
+	}
+}
+
+// hunkRange formats the 1-based line range of a hunk; an empty range
+// names the line before it
+func hunkRange(offset, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", offset)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", offset+1)
+	}
+	return fmt.Sprintf("%d,%d", offset+1, count)
+}
+
+// splitLines splits text into lines without their newlines
+func splitLines(data []byte) []string {
+	if len(data) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+// joinLines is the inverse of splitLines
+func joinLines(lines []string) []byte {
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\n") + "\n")
+}
@@ -0,0 +1,83 @@
+// Copyright 2021 vjranagit
+//
+// Unified diff tests
+
+package deploy
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	// numbered returns n lines of growing length; replaced lines are
+	// changed, or dropped when replaced with ""
+	numbered := func(n int, replace map[int]string) string {
+		var lines []string
+		for i := 1; i <= n; i++ {
+			line := strings.Repeat("x", i)
+			if r, ok := replace[i]; ok {
+				line = r
+			}
+			if line != "" {
+				lines = append(lines, line)
+			}
+		}
+		return strings.Join(lines, "\n") + "\n"
+	}
+
+	tests := []struct {
+		name string
+		a, b string
+		want string
+	}{
+		{
+			name: "equal",
+			a:    "a\nb\n",
+			b:    "a\nb\n",
+			want: "",
+		},
+		{
+			name: "create",
+			a:    "",
+			b:    "a\nb\n",
+			want: "--- a\n+++ b\n@@ -0,0 +1,2 @@\n+a\n+b\n",
+		},
+		{
+			name: "change in the middle",
+			a:    "1\n2\n3\n4\n5\n6\n7\n",
+			b:    "1\n2\n3\nfour\n5\n6\n7\n",
+			want: "--- a\n+++ b\n@@ -1,7 +1,7 @@\n 1\n 2\n 3\n-4\n+four\n 5\n 6\n 7\n",
+		},
+		{
+			name: "context is trimmed",
+			a:    numbered(10, nil),
+			b:    numbered(10, map[int]string{9: "changed"}),
+			want: "--- a\n+++ b\n@@ -6,5 +6,5 @@\n xxxxxx\n xxxxxxx\n xxxxxxxx\n-xxxxxxxxx\n+changed\n xxxxxxxxxx\n",
+		},
+		{
+			name: "separate hunks",
+			a:    numbered(20, nil),
+			b:    numbered(20, map[int]string{2: "", 18: "changed"}),
+			want: "--- a\n+++ b\n" +
+				"@@ -1,5 +1,4 @@\n x\n-xx\n xxx\n xxxx\n xxxxx\n" +
+				"@@ -15,6 +14,6 @@\n" +
+				" " + strings.Repeat("x", 15) + "\n" +
+				" " + strings.Repeat("x", 16) + "\n" +
+				" " + strings.Repeat("x", 17) + "\n" +
+				"-" + strings.Repeat("x", 18) + "\n" +
+				"+changed\n" +
+				" " + strings.Repeat("x", 19) + "\n" +
+				" " + strings.Repeat("x", 20) + "\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := unifiedDiff("a", "b", []byte(tt.a), []byte(tt.b))
+			if got != tt.want {
+				t.Errorf("expected diff:\n%s\ngot:\n%s", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,587 @@
+// Copyright 2021 vjranagit
+//
+// Kubernetes rendering of a Harbor install
+
+package k8s
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/vjranagit/harbor/pkg/config"
+	"github.com/vjranagit/harbor/pkg/deploy"
+	"gopkg.in/yaml.v3"
+)
+
+// Paths of the rendered manifests, relative to the install directory.
+// kubectl applies a directory in name order, so the namespace comes first
+const (
+	NamespaceFile = "00-namespace.yaml"
+	SecretsFile   = "secrets.yaml"
+)
+
+// Images are pulled from this repository, tagged with the Harbor version
+const imageRepository = "goharbor"
+
+// Label values shared by every rendered resource
+const (
+	appName   = "harbor"
+	managedBy = "harbor-deploy"
+)
+
+// Users the images run as; Harbor components share one, the database and
+// Redis images another
+const (
+	harborUser = 10000
+	dataUser   = 999
+)
+
+// probePeriod is the readiness probe interval in seconds
+const probePeriod = 10
+
+// Hosts returns the service names components reach each other by. The
+// registry controller runs in the registry pod and shares its service
+func Hosts(name string) deploy.Hosts {
+	return deploy.Hosts{
+		Core:        name + "-" + config.ComponentCore,
+		Portal:      name + "-" + config.ComponentPortal,
+		Registry:    name + "-" + config.ComponentRegistry,
+		Registryctl: name + "-" + config.ComponentRegistry,
+		Jobservice:  name + "-" + config.ComponentJobservice,
+		Database:    name + "-" + config.ComponentDatabase,
+		Redis:       name + "-" + config.ComponentRedis,
+	}
+}
+
+// renderer builds the resources of one install
+type renderer struct {
+	config *config.HarborConfig
+	k      config.KubernetesConfig
+	// files are the shared component files by path
+	files map[string]deploy.File
+	// Secrets generated for the install, kept apart from the component
+	// manifests so they are never diffed
+	coreKeys object
+	htpasswd object
+}
+
+// manifest is a rendered file of resources
+type manifest struct {
+	path    string
+	objects []object
+}
+
+// Render renders Kubernetes manifests of h, a file per component plus
+// the namespace, the ingress and the generated secrets
+func Render(h *config.HarborConfig, secrets *deploy.Secrets) (*deploy.Bundle, error) {
+	in := &deploy.Install{Config: h, Secrets: secrets, Hosts: Hosts(h.Kubernetes.Name), URL: externalURL(h)}
+	components, err := deploy.Components(in)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &renderer{config: h, k: h.Kubernetes, files: make(map[string]deploy.File, len(components))}
+	for _, f := range components {
+		r.files[f.Path] = f
+	}
+	r.coreKeys = r.secret(config.ComponentCore, "core-keys", map[string]string{
+		"secretkey":       secrets.SecretKey,
+		"private_key.pem": string(secrets.TokenKey),
+	})
+	r.htpasswd = r.secret(config.ComponentRegistry, "registry-htpasswd", map[string]string{
+		"passwd": string(secrets.RegistryPasswd),
+	})
+
+	manifests := []manifest{
+		{NamespaceFile, []object{r.namespace()}},
+		{SecretsFile, []object{r.coreKeys, r.htpasswd}},
+		{"core.yaml", r.core()},
+		{"portal.yaml", r.portal()},
+		{"registry.yaml", r.registry()},
+		{"jobservice.yaml", r.jobservice()},
+		{"ingress.yaml", []object{r.ingress()}},
+	}
+	if !h.Database.External() {
+		manifests = append(manifests, manifest{"database.yaml", r.database()})
+	}
+	if !h.Redis.External() {
+		manifests = append(manifests, manifest{"redis.yaml", r.redis()})
+	}
+
+	files := secrets.Files()
+	for _, m := range manifests {
+		data, err := encode(h.Name, m.objects)
+		if err != nil {
+			return nil, err
+		}
+		// Manifests holding secrets are as private as the env files
+		// they come from
+		f := deploy.File{Path: m.path, Mode: 0o644, Data: data, Sensitive: m.path == SecretsFile}
+		for _, o := range m.objects {
+			if o.Kind == "Secret" {
+				f.Mode = 0o600
+			}
+		}
+		files = append(files, f)
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return &deploy.Bundle{Files: files, Redact: in.Redact()}, nil
+}
+
+// externalURL is where clients reach Harbor through the ingress
+func externalURL(h *config.HarborConfig) string {
+	if h.ExternalURL != "" {
+		return h.ExternalURL
+	}
+	if h.Kubernetes.TLSSecret != "" {
+		return "https://" + h.Hostname
+	}
+	return "http://" + h.Hostname
+}
+
+// encode writes resources as a multi-document YAML file
+func encode(name string, objects []object) ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# Generated by harbor deploy from harbor %q; do not edit\n", name)
+
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	for _, o := range objects {
+		if err := enc.Encode(o); err != nil {
+			return nil, fmt.Errorf("failed to encode %s %s: %w", o.Kind, o.Metadata.Name, err)
+		}
+	}
+	if err := enc.Close(); err != nil {
+		return nil, fmt.Errorf("failed to encode manifests: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (r *renderer) namespace() object {
+	return object{
+		APIVersion: "v1",
+		Kind:       "Namespace",
+		Metadata: objectMeta{
+			Name:   r.k.Namespace,
+			Labels: map[string]string{"app.kubernetes.io/managed-by": managedBy},
+		},
+	}
+}
+
+func (r *renderer) core() []object {
+	env := r.envSecret(config.ComponentCore, "core-env", "core/env")
+	conf := r.configObject(config.ComponentCore, "core-config", "core/app.conf")
+
+	pod := podSpec{
+		SecurityContext: &podSecurityContext{RunAsUser: harborUser, FSGroup: harborUser},
+		Containers: []container{{
+			Name:    "core",
+			Image:   r.image("harbor-core"),
+			EnvFrom: envFrom(env),
+			Ports:   []containerPort{{Name: "http", ContainerPort: deploy.ComponentPort}},
+			VolumeMounts: []volumeMount{
+				{Name: "config", MountPath: "/etc/core/app.conf", SubPath: "app.conf"},
+				{Name: "keys", MountPath: "/etc/core/key", SubPath: "secretkey"},
+				{Name: "keys", MountPath: "/etc/core/private_key.pem", SubPath: "private_key.pem"},
+			},
+			ReadinessProbe: httpProbe("/api/v2.0/ping", deploy.ComponentPort),
+			Resources:      r.resources(config.ComponentCore),
+		}},
+		Volumes: []volume{volumeOf("config", conf), volumeOf("keys", r.coreKeys)},
+	}
+
+	return []object{
+		env,
+		conf,
+		r.deployment(config.ComponentCore, pod, env, conf, r.coreKeys),
+		r.service(config.ComponentCore, false, servicePort{Name: "http", Port: deploy.ComponentPort, TargetPort: deploy.ComponentPort}),
+	}
+}
+
+func (r *renderer) portal() []object {
+	pod := podSpec{
+		SecurityContext: &podSecurityContext{RunAsUser: harborUser, FSGroup: harborUser},
+		Containers: []container{{
+			Name:           "portal",
+			Image:          r.image("harbor-portal"),
+			Ports:          []containerPort{{Name: "http", ContainerPort: deploy.ComponentPort}},
+			ReadinessProbe: httpProbe("/", deploy.ComponentPort),
+			Resources:      r.resources(config.ComponentPortal),
+		}},
+	}
+
+	return []object{
+		r.deployment(config.ComponentPortal, pod),
+		r.service(config.ComponentPortal, false, servicePort{Name: "http", Port: deploy.ComponentPort, TargetPort: deploy.ComponentPort}),
+	}
+}
+
+// registry runs the registry and its controller in one pod, sharing the
+// registry configuration and storage
+func (r *renderer) registry() []object {
+	conf := r.configObject(config.ComponentRegistry, "registry-config", "registry/config.yml")
+	ctlEnv := r.envSecret(config.ComponentRegistry, "registryctl-env", "registryctl/env")
+	ctlConf := r.configObject(config.ComponentRegistry, "registryctl-config", "registryctl/config.yml")
+	objects := []object{conf, ctlEnv, ctlConf}
+
+	mounts := []volumeMount{{Name: "registry-config", MountPath: "/etc/registry", ReadOnly: true}}
+	volumes := []volume{
+		{
+			Name: "registry-config",
+			Projected: &projectedVolumeSource{Sources: []volumeProjection{
+				{Secret: &localObjectReference{Name: conf.Metadata.Name}},
+				{Secret: &localObjectReference{Name: r.htpasswd.Metadata.Name}},
+			}},
+		},
+		volumeOf("registryctl-config", ctlConf),
+	}
+	if r.config.Storage.Type == config.StorageFilesystem {
+		storage := r.pvc(config.ComponentRegistry, "registry")
+		objects = append(objects, storage)
+		mounts = append(mounts, volumeMount{Name: "storage", MountPath: "/storage"})
+		volumes = append(volumes, volume{Name: "storage", PersistentVolumeClaim: &pvcVolumeSource{ClaimName: storage.Metadata.Name}})
+	}
+
+	pod := podSpec{
+		SecurityContext: &podSecurityContext{RunAsUser: harborUser, FSGroup: harborUser},
+		Containers: []container{
+			{
+				Name:           "registry",
+				Image:          r.image("registry-photon"),
+				Ports:          []containerPort{{Name: "registry", ContainerPort: deploy.RegistryPort}},
+				VolumeMounts:   mounts,
+				ReadinessProbe: httpProbe("/", deploy.RegistryPort),
+				Resources:      r.resources(config.ComponentRegistry),
+			},
+			{
+				Name:    "registryctl",
+				Image:   r.image("harbor-registryctl"),
+				EnvFrom: envFrom(ctlEnv),
+				Ports:   []containerPort{{Name: "http", ContainerPort: deploy.ComponentPort}},
+				VolumeMounts: append(mounts[:len(mounts):len(mounts)],
+					volumeMount{Name: "registryctl-config", MountPath: "/etc/registryctl/config.yml", SubPath: "config.yml"}),
+				ReadinessProbe: httpProbe("/api/health", deploy.ComponentPort),
+			},
+		},
+		Volumes: volumes,
+	}
+
+	return append(objects,
+		r.deployment(config.ComponentRegistry, pod, conf, ctlEnv, ctlConf, r.htpasswd),
+		r.service(config.ComponentRegistry, false,
+			servicePort{Name: "registry", Port: deploy.RegistryPort, TargetPort: deploy.RegistryPort},
+			servicePort{Name: "controller", Port: deploy.ComponentPort, TargetPort: deploy.ComponentPort},
+		),
+	)
+}
+
+func (r *renderer) jobservice() []object {
+	env := r.envSecret(config.ComponentJobservice, "jobservice-env", "jobservice/env")
+	conf := r.configObject(config.ComponentJobservice, "jobservice-config", "jobservice/config.yml")
+	logs := r.pvc(config.ComponentJobservice, "jobservice")
+
+	pod := podSpec{
+		SecurityContext: &podSecurityContext{RunAsUser: harborUser, FSGroup: harborUser},
+		Containers: []container{{
+			Name:    "jobservice",
+			Image:   r.image("harbor-jobservice"),
+			EnvFrom: envFrom(env),
+			Ports:   []containerPort{{Name: "http", ContainerPort: deploy.ComponentPort}},
+			VolumeMounts: []volumeMount{
+				{Name: "config", MountPath: "/etc/jobservice/config.yml", SubPath: "config.yml"},
+				{Name: "job-logs", MountPath: "/var/log/jobs"},
+			},
+			ReadinessProbe: httpProbe("/api/v1/stats", deploy.ComponentPort),
+			Resources:      r.resources(config.ComponentJobservice),
+		}},
+		Volumes: []volume{
+			volumeOf("config", conf),
+			{Name: "job-logs", PersistentVolumeClaim: &pvcVolumeSource{ClaimName: logs.Metadata.Name}},
+		},
+	}
+
+	return []object{
+		env,
+		conf,
+		logs,
+		r.deployment(config.ComponentJobservice, pod, env, conf),
+		r.service(config.ComponentJobservice, false, servicePort{Name: "http", Port: deploy.ComponentPort, TargetPort: deploy.ComponentPort}),
+	}
+}
+
+func (r *renderer) database() []object {
+	env := r.envSecret(config.ComponentDatabase, "database-env", "db/env")
+
+	pod := podSpec{
+		SecurityContext: &podSecurityContext{RunAsUser: dataUser, FSGroup: dataUser},
+		Containers: []container{{
+			Name:    "database",
+			Image:   r.image("harbor-db"),
+			EnvFrom: envFrom(env),
+			Ports:   []containerPort{{Name: "postgres", ContainerPort: deploy.DatabasePort}},
+			VolumeMounts: []volumeMount{
+				{Name: "data", MountPath: "/var/lib/postgresql/data"},
+				{Name: "shm", MountPath: "/dev/shm"},
+			},
+			ReadinessProbe: tcpProbe(deploy.DatabasePort),
+			Resources:      r.resources(config.ComponentDatabase),
+		}},
+		// PostgreSQL needs more shared memory than the container default
+		Volumes: []volume{{Name: "shm", EmptyDir: &emptyDirVolumeSource{Medium: "Memory", SizeLimit: "1Gi"}}},
+	}
+
+	return []object{
+		env,
+		r.service(config.ComponentDatabase, true, servicePort{Name: "postgres", Port: deploy.DatabasePort, TargetPort: deploy.DatabasePort}),
+		r.statefulSet(config.ComponentDatabase, pod, env),
+	}
+}
+
+func (r *renderer) redis() []object {
+	conf := r.configObject(config.ComponentRedis, "redis-config", "redis/redis.conf")
+
+	pod := podSpec{
+		SecurityContext: &podSecurityContext{RunAsUser: dataUser, FSGroup: dataUser},
+		Containers: []container{{
+			Name:  "redis",
+			Image: r.image("redis-photon"),
+			Ports: []containerPort{{Name: "redis", ContainerPort: deploy.RedisPort}},
+			VolumeMounts: []volumeMount{
+				{Name: "data", MountPath: "/var/lib/redis"},
+				{Name: "config", MountPath: "/etc/redis.conf", SubPath: "redis.conf"},
+			},
+			ReadinessProbe: tcpProbe(deploy.RedisPort),
+			Resources:      r.resources(config.ComponentRedis),
+		}},
+		Volumes: []volume{volumeOf("config", conf)},
+	}
+
+	return []object{
+		conf,
+		r.service(config.ComponentRedis, true, servicePort{Name: "redis", Port: deploy.RedisPort, TargetPort: deploy.RedisPort}),
+		r.statefulSet(config.ComponentRedis, pod, conf),
+	}
+}
+
+// ingress routes the API, token service and registry to core and the
+// rest to the portal
+func (r *renderer) ingress() object {
+	backend := func(component string) ingressBackend {
+		return ingressBackend{Service: ingressServiceBackend{
+			Name: r.name(component),
+			Port: serviceBackendPort{Number: deploy.ComponentPort},
+		}}
+	}
+	var paths []httpIngressPath
+	for _, p := range []string{"/api/", "/service/", "/v2/", "/c/"} {
+		paths = append(paths, httpIngressPath{Path: p, PathType: "Prefix", Backend: backend(config.ComponentCore)})
+	}
+	paths = append(paths, httpIngressPath{Path: "/", PathType: "Prefix", Backend: backend(config.ComponentPortal)})
+
+	spec := ingressSpec{
+		IngressClassName: r.k.IngressClass,
+		Rules:            []ingressRule{{Host: r.config.Hostname, HTTP: httpIngressRuleValue{Paths: paths}}},
+	}
+	if r.k.TLSSecret != "" {
+		spec.TLS = []ingressTLS{{Hosts: []string{r.config.Hostname}, SecretName: r.k.TLSSecret}}
+	}
+
+	meta := r.meta("ingress", "ingress")
+	meta.Annotations = r.k.IngressAnnotations
+	return object{APIVersion: "networking.k8s.io/v1", Kind: "Ingress", Metadata: meta, Spec: spec}
+}
+
+// deployment runs a stateless component. The pod template carries a
+// checksum of its configuration, so changing it rolls the pods
+func (r *renderer) deployment(component string, pod podSpec, configuration ...object) object {
+	return object{
+		APIVersion: "apps/v1",
+		Kind:       "Deployment",
+		Metadata:   r.meta(component, component),
+		Spec: deploymentSpec{
+			Replicas: r.k.Components[component].Replicas,
+			Selector: labelSelector{MatchLabels: r.selector(component)},
+			Template: r.podTemplate(component, pod, configuration),
+		},
+	}
+}
+
+// statefulSet runs the bundled database or Redis with a data volume
+func (r *renderer) statefulSet(component string, pod podSpec, configuration ...object) object {
+	claim := object{
+		APIVersion: "v1",
+		Kind:       "PersistentVolumeClaim",
+		Metadata:   objectMeta{Name: "data"},
+		Spec:       r.pvcSpec(component),
+	}
+	return object{
+		APIVersion: "apps/v1",
+		Kind:       "StatefulSet",
+		Metadata:   r.meta(component, component),
+		Spec: statefulSetSpec{
+			Replicas:             r.k.Components[component].Replicas,
+			ServiceName:          r.name(component),
+			Selector:             labelSelector{MatchLabels: r.selector(component)},
+			Template:             r.podTemplate(component, pod, configuration),
+			VolumeClaimTemplates: []object{claim},
+		},
+	}
+}
+
+func (r *renderer) podTemplate(component string, pod podSpec, configuration []object) podTemplateSpec {
+	meta := objectMeta{Labels: r.labels(component)}
+	if len(configuration) > 0 {
+		meta.Annotations = map[string]string{"checksum/config": checksum(configuration)}
+	}
+	return podTemplateSpec{Metadata: meta, Spec: pod}
+}
+
+// service exposes a component; headless services give the pods of the
+// database and Redis stable names
+func (r *renderer) service(component string, headless bool, ports ...servicePort) object {
+	spec := serviceSpec{Selector: r.selector(component), Ports: ports}
+	if headless {
+		spec.ClusterIP = "None"
+	}
+	return object{APIVersion: "v1", Kind: "Service", Metadata: r.meta(component, component), Spec: spec}
+}
+
+// pvc is the persistent volume of a component. Several replicas share
+// it, which needs a storage class supporting ReadWriteMany
+func (r *renderer) pvc(component, name string) object {
+	return object{
+		APIVersion: "v1",
+		Kind:       "PersistentVolumeClaim",
+		Metadata:   r.meta(component, name),
+		Spec:       r.pvcSpec(component),
+	}
+}
+
+func (r *renderer) pvcSpec(component string) pvcSpec {
+	c := r.k.Components[component]
+	mode := "ReadWriteOnce"
+	if c.Replicas > 1 {
+		mode = "ReadWriteMany"
+	}
+	return pvcSpec{
+		AccessModes:      []string{mode},
+		StorageClassName: r.k.StorageClass,
+		Resources:        volumeResourceRequirements{Requests: map[string]string{"storage": c.VolumeSize}},
+	}
+}
+
+// envSecret turns a component env file into a secret for envFrom
+func (r *renderer) envSecret(component, name, path string) object {
+	return r.secret(component, name, deploy.ParseEnv(r.files[path].Data))
+}
+
+// configObject holds component files mounted into pods: a secret when
+// any of them holds credentials, a config map otherwise
+func (r *renderer) configObject(component, name string, paths ...string) object {
+	data := make(map[string]string, len(paths))
+	credentials := false
+	for _, p := range paths {
+		f := r.files[p]
+		data[path.Base(p)] = string(f.Data)
+		credentials = credentials || f.Credentials
+	}
+	if credentials {
+		return r.secret(component, name, data)
+	}
+	return object{APIVersion: "v1", Kind: "ConfigMap", Metadata: r.meta(component, name), Data: data}
+}
+
+func (r *renderer) secret(component, name string, data map[string]string) object {
+	return object{APIVersion: "v1", Kind: "Secret", Metadata: r.meta(component, name), Type: "Opaque", StringData: data}
+}
+
+// resources returns the requests and limits of a component, or nil when
+// it has none
+func (r *renderer) resources(component string) *resourceRequirements {
+	c := r.k.Components[component]
+	res := &resourceRequirements{Requests: quantities(c.Requests), Limits: quantities(c.Limits)}
+	if res.Requests == nil && res.Limits == nil {
+		return nil
+	}
+	return res
+}
+
+func quantities(res config.Resources) map[string]string {
+	q := make(map[string]string)
+	if res.CPU != "" {
+		q["cpu"] = res.CPU
+	}
+	if res.Memory != "" {
+		q["memory"] = res.Memory
+	}
+	if len(q) == 0 {
+		return nil
+	}
+	return q
+}
+
+// name prefixes a resource name with the install name
+func (r *renderer) name(suffix string) string {
+	return r.k.Name + "-" + suffix
+}
+
+func (r *renderer) meta(component, name string) objectMeta {
+	return objectMeta{Name: r.name(name), Namespace: r.k.Namespace, Labels: r.labels(component)}
+}
+
+func (r *renderer) labels(component string) map[string]string {
+	labels := r.selector(component)
+	labels["app.kubernetes.io/version"] = strings.TrimPrefix(r.config.Version, "v")
+	labels["app.kubernetes.io/managed-by"] = managedBy
+	return labels
+}
+
+// selector labels identify the pods of a component; unlike labels they
+// never change, as selectors are immutable
+func (r *renderer) selector(component string) map[string]string {
+	return map[string]string{
+		"app.kubernetes.io/name":      appName,
+		"app.kubernetes.io/instance":  r.k.Name,
+		"app.kubernetes.io/component": component,
+	}
+}
+
+func (r *renderer) image(name string) string {
+	return imageRepository + "/" + name + ":" + r.config.Version
+}
+
+func envFrom(secret object) []envFromSource {
+	return []envFromSource{{SecretRef: &localObjectReference{Name: secret.Metadata.Name}}}
+}
+
+// volumeOf mounts a secret or config map
+func volumeOf(name string, o object) volume {
+	if o.Kind == "Secret" {
+		return volume{Name: name, Secret: &secretVolumeSource{SecretName: o.Metadata.Name}}
+	}
+	return volume{Name: name, ConfigMap: &localObjectReference{Name: o.Metadata.Name}}
+}
+
+func httpProbe(path string, port int) *probe {
+	return &probe{HTTPGet: &httpGetAction{Path: path, Port: port}, PeriodSeconds: probePeriod}
+}
+
+func tcpProbe(port int) *probe {
+	return &probe{TCPSocket: &tcpSocketAction{Port: port}, PeriodSeconds: probePeriod}
+}
+
+// checksum hashes the content of the objects a pod is configured by
+func checksum(objects []object) string {
+	h := sha256.New()
+	for _, o := range objects {
+		data, _ := yaml.Marshal(o)
+		h.Write(data)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
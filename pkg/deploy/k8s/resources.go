@@ -0,0 +1,198 @@
+// Copyright 2021 vjranagit
+//
+// The subset of the Kubernetes API the rendered manifests use
+
+package k8s
+
+// object is a Kubernetes resource; only the fields of its kind are set
+type object struct {
+	APIVersion string            `yaml:"apiVersion"`
+	Kind       string            `yaml:"kind"`
+	Metadata   objectMeta        `yaml:"metadata"`
+	Type       string            `yaml:"type,omitempty"`
+	Data       map[string]string `yaml:"data,omitempty"`
+	StringData map[string]string `yaml:"stringData,omitempty"`
+	Spec       any               `yaml:"spec,omitempty"`
+}
+
+type objectMeta struct {
+	Name        string            `yaml:"name,omitempty"`
+	Namespace   string            `yaml:"namespace,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	Annotations map[string]string `yaml:"annotations,omitempty"`
+}
+
+type deploymentSpec struct {
+	Replicas int             `yaml:"replicas"`
+	Selector labelSelector   `yaml:"selector"`
+	Template podTemplateSpec `yaml:"template"`
+}
+
+type statefulSetSpec struct {
+	Replicas             int             `yaml:"replicas"`
+	ServiceName          string          `yaml:"serviceName"`
+	Selector             labelSelector   `yaml:"selector"`
+	Template             podTemplateSpec `yaml:"template"`
+	VolumeClaimTemplates []object        `yaml:"volumeClaimTemplates,omitempty"`
+}
+
+type labelSelector struct {
+	MatchLabels map[string]string `yaml:"matchLabels"`
+}
+
+type podTemplateSpec struct {
+	Metadata objectMeta `yaml:"metadata"`
+	Spec     podSpec    `yaml:"spec"`
+}
+
+type podSpec struct {
+	SecurityContext *podSecurityContext `yaml:"securityContext,omitempty"`
+	Containers      []container         `yaml:"containers"`
+	Volumes         []volume            `yaml:"volumes,omitempty"`
+}
+
+type podSecurityContext struct {
+	RunAsUser int `yaml:"runAsUser"`
+	FSGroup   int `yaml:"fsGroup"`
+}
+
+type container struct {
+	Name           string                `yaml:"name"`
+	Image          string                `yaml:"image"`
+	EnvFrom        []envFromSource       `yaml:"envFrom,omitempty"`
+	Ports          []containerPort       `yaml:"ports,omitempty"`
+	VolumeMounts   []volumeMount         `yaml:"volumeMounts,omitempty"`
+	ReadinessProbe *probe                `yaml:"readinessProbe,omitempty"`
+	Resources      *resourceRequirements `yaml:"resources,omitempty"`
+}
+
+type envFromSource struct {
+	SecretRef *localObjectReference `yaml:"secretRef,omitempty"`
+}
+
+type localObjectReference struct {
+	Name string `yaml:"name"`
+}
+
+type containerPort struct {
+	Name          string `yaml:"name"`
+	ContainerPort int    `yaml:"containerPort"`
+}
+
+type volumeMount struct {
+	Name      string `yaml:"name"`
+	MountPath string `yaml:"mountPath"`
+	SubPath   string `yaml:"subPath,omitempty"`
+	ReadOnly  bool   `yaml:"readOnly,omitempty"`
+}
+
+type probe struct {
+	HTTPGet       *httpGetAction   `yaml:"httpGet,omitempty"`
+	TCPSocket     *tcpSocketAction `yaml:"tcpSocket,omitempty"`
+	PeriodSeconds int              `yaml:"periodSeconds"`
+}
+
+type httpGetAction struct {
+	Path string `yaml:"path"`
+	Port int    `yaml:"port"`
+}
+
+type tcpSocketAction struct {
+	Port int `yaml:"port"`
+}
+
+type resourceRequirements struct {
+	Requests map[string]string `yaml:"requests,omitempty"`
+	Limits   map[string]string `yaml:"limits,omitempty"`
+}
+
+type volume struct {
+	Name                  string                 `yaml:"name"`
+	Secret                *secretVolumeSource    `yaml:"secret,omitempty"`
+	ConfigMap             *localObjectReference  `yaml:"configMap,omitempty"`
+	PersistentVolumeClaim *pvcVolumeSource       `yaml:"persistentVolumeClaim,omitempty"`
+	EmptyDir              *emptyDirVolumeSource  `yaml:"emptyDir,omitempty"`
+	Projected             *projectedVolumeSource `yaml:"projected,omitempty"`
+}
+
+type secretVolumeSource struct {
+	SecretName string `yaml:"secretName"`
+}
+
+type pvcVolumeSource struct {
+	ClaimName string `yaml:"claimName"`
+}
+
+type emptyDirVolumeSource struct {
+	Medium    string `yaml:"medium,omitempty"`
+	SizeLimit string `yaml:"sizeLimit,omitempty"`
+}
+
+type projectedVolumeSource struct {
+	Sources []volumeProjection `yaml:"sources"`
+}
+
+type volumeProjection struct {
+	Secret *localObjectReference `yaml:"secret,omitempty"`
+}
+
+type serviceSpec struct {
+	ClusterIP string            `yaml:"clusterIP,omitempty"`
+	Selector  map[string]string `yaml:"selector"`
+	Ports     []servicePort     `yaml:"ports"`
+}
+
+type servicePort struct {
+	Name       string `yaml:"name"`
+	Port       int    `yaml:"port"`
+	TargetPort int    `yaml:"targetPort"`
+}
+
+type pvcSpec struct {
+	AccessModes      []string                   `yaml:"accessModes"`
+	StorageClassName string                     `yaml:"storageClassName,omitempty"`
+	Resources        volumeResourceRequirements `yaml:"resources"`
+}
+
+type volumeResourceRequirements struct {
+	Requests map[string]string `yaml:"requests"`
+}
+
+type ingressSpec struct {
+	IngressClassName string        `yaml:"ingressClassName,omitempty"`
+	TLS              []ingressTLS  `yaml:"tls,omitempty"`
+	Rules            []ingressRule `yaml:"rules"`
+}
+
+type ingressTLS struct {
+	Hosts      []string `yaml:"hosts"`
+	SecretName string   `yaml:"secretName"`
+}
+
+type ingressRule struct {
+	Host string               `yaml:"host"`
+	HTTP httpIngressRuleValue `yaml:"http"`
+}
+
+type httpIngressRuleValue struct {
+	Paths []httpIngressPath `yaml:"paths"`
+}
+
+type httpIngressPath struct {
+	Path     string         `yaml:"path"`
+	PathType string         `yaml:"pathType"`
+	Backend  ingressBackend `yaml:"backend"`
+}
+
+type ingressBackend struct {
+	Service ingressServiceBackend `yaml:"service"`
+}
+
+type ingressServiceBackend struct {
+	Name string             `yaml:"name"`
+	Port serviceBackendPort `yaml:"port"`
+}
+
+type serviceBackendPort struct {
+	Number int `yaml:"number"`
+}
@@ -0,0 +1,230 @@
+// Copyright 2021 vjranagit
+//
+// Validation of rendered manifests against bundled OpenAPI schemas
+
+package k8s
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// schema is the part of an OpenAPI v2 definition the validator checks
+type schema struct {
+	Ref                  string             `json:"$ref"`
+	Type                 string             `json:"type"`
+	Format               string             `json:"format"`
+	Properties           map[string]*schema `json:"properties"`
+	AdditionalProperties *schema            `json:"additionalProperties"`
+	Items                *schema            `json:"items"`
+	Required             []string           `json:"required"`
+	Enum                 []string           `json:"enum"`
+	GroupVersionKind     []struct {
+		Group   string `json:"group"`
+		Version string `json:"version"`
+		Kind    string `json:"kind"`
+	} `json:"x-kubernetes-group-version-kind"`
+}
+
+// openAPI holds the definitions of testdata/schemas/kubernetes.json
+type openAPI struct {
+	Definitions map[string]*schema `json:"definitions"`
+}
+
+var quantityPattern = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?(m|k|M|G|T|P|E|Ki|Mi|Gi|Ti|Pi|Ei)?$`)
+
+func loadSchemas(t *testing.T) *openAPI {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join("testdata", "schemas", "kubernetes.json"))
+	if err != nil {
+		t.Fatalf("failed to read schemas: %v", err)
+	}
+	var api openAPI
+	if err := json.Unmarshal(data, &api); err != nil {
+		t.Fatalf("failed to parse schemas: %v", err)
+	}
+	return &api
+}
+
+// validate checks a decoded manifest against the definition of its kind
+// and returns every violation
+func (api *openAPI) validate(doc map[string]any) []string {
+	apiVersion, _ := doc["apiVersion"].(string)
+	kind, _ := doc["kind"].(string)
+
+	group, version, found := strings.Cut(apiVersion, "/")
+	if !found {
+		group, version = "", apiVersion
+	}
+	for _, def := range api.Definitions {
+		for _, gvk := range def.GroupVersionKind {
+			if gvk.Group == group && gvk.Version == version && gvk.Kind == kind {
+				return api.check(kind, doc, def)
+			}
+		}
+	}
+	return []string{fmt.Sprintf("no schema for %s %s", apiVersion, kind)}
+}
+
+func (api *openAPI) check(path string, value any, s *schema) []string {
+	if s.Ref != "" {
+		def, ok := api.Definitions[strings.TrimPrefix(s.Ref, "#/definitions/")]
+		if !ok {
+			return []string{fmt.Sprintf("%s: unknown reference %s", path, s.Ref)}
+		}
+		return api.check(path, value, def)
+	}
+
+	switch s.Format {
+	case "int-or-string":
+		switch value.(type) {
+		case int, string:
+			return nil
+		}
+		return []string{fmt.Sprintf("%s: expected integer or string, got %T", path, value)}
+	case "quantity":
+		if v, ok := value.(int); ok {
+			value = fmt.Sprint(v)
+		}
+		if v, ok := value.(string); !ok || !quantityPattern.MatchString(v) {
+			return []string{fmt.Sprintf("%s: invalid quantity %v", path, value)}
+		}
+		return nil
+	}
+
+	var errs []string
+	switch s.Type {
+	case "object":
+		obj, ok := value.(map[string]any)
+		if !ok {
+			return []string{fmt.Sprintf("%s: expected object, got %T", path, value)}
+		}
+		for _, name := range s.Required {
+			if _, ok := obj[name]; !ok {
+				errs = append(errs, fmt.Sprintf("%s: missing required field %s", path, name))
+			}
+		}
+		keys := make([]string, 0, len(obj))
+		for k := range obj {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			switch {
+			case s.Properties[k] != nil:
+				errs = append(errs, api.check(path+"."+k, obj[k], s.Properties[k])...)
+			case s.AdditionalProperties != nil:
+				errs = append(errs, api.check(path+"."+k, obj[k], s.AdditionalProperties)...)
+			case s.Properties != nil:
+				errs = append(errs, fmt.Sprintf("%s: unknown field %s", path, k))
+			}
+		}
+	case "array":
+		items, ok := value.([]any)
+		if !ok {
+			return []string{fmt.Sprintf("%s: expected array, got %T", path, value)}
+		}
+		for i, item := range items {
+			errs = append(errs, api.check(fmt.Sprintf("%s[%d]", path, i), item, s.Items)...)
+		}
+	case "string":
+		v, ok := value.(string)
+		if !ok {
+			return []string{fmt.Sprintf("%s: expected string, got %T", path, value)}
+		}
+		if len(s.Enum) > 0 && !slices.Contains(s.Enum, v) {
+			errs = append(errs, fmt.Sprintf("%s: %q is not one of %s", path, v, strings.Join(s.Enum, ", ")))
+		}
+	case "integer":
+		if _, ok := value.(int); !ok {
+			return []string{fmt.Sprintf("%s: expected integer, got %T", path, value)}
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return []string{fmt.Sprintf("%s: expected boolean, got %T", path, value)}
+		}
+	}
+	return errs
+}
+
+func TestSchema_RejectsInvalidManifests(t *testing.T) {
+	api := loadSchemas(t)
+
+	tests := []struct {
+		name string
+		doc  map[string]any
+		want string
+	}{
+		{
+			name: "unknown kind",
+			doc:  map[string]any{"apiVersion": "v1", "kind": "Pod"},
+			want: "no schema for v1 Pod",
+		},
+		{
+			name: "unknown field",
+			doc: map[string]any{
+				"apiVersion": "v1", "kind": "Service",
+				"metadata": map[string]any{"name": "core"},
+				"spec":     map[string]any{"ports": []any{map[string]any{"port": 80, "targetport": 8080}}},
+			},
+			want: "Service.spec.ports[0]: unknown field targetport",
+		},
+		{
+			name: "missing required field",
+			doc: map[string]any{
+				"apiVersion": "apps/v1", "kind": "Deployment",
+				"metadata": map[string]any{"name": "core"},
+				"spec":     map[string]any{"replicas": 1},
+			},
+			want: "Deployment.spec: missing required field selector",
+		},
+		{
+			name: "wrong type",
+			doc: map[string]any{
+				"apiVersion": "apps/v1", "kind": "StatefulSet",
+				"metadata": map[string]any{"name": "db"},
+				"spec": map[string]any{
+					"replicas": "1",
+					"selector": map[string]any{},
+					"template": map[string]any{"spec": map[string]any{"containers": []any{}}},
+				},
+			},
+			want: "StatefulSet.spec.replicas: expected integer, got string",
+		},
+		{
+			name: "enum",
+			doc: map[string]any{
+				"apiVersion": "v1", "kind": "PersistentVolumeClaim",
+				"metadata": map[string]any{"name": "data"},
+				"spec":     map[string]any{"accessModes": []any{"ReadWriteAll"}},
+			},
+			want: `"ReadWriteAll" is not one of`,
+		},
+		{
+			name: "quantity",
+			doc: map[string]any{
+				"apiVersion": "v1", "kind": "PersistentVolumeClaim",
+				"metadata": map[string]any{"name": "data"},
+				"spec":     map[string]any{"resources": map[string]any{"requests": map[string]any{"storage": "5 GB"}}},
+			},
+			want: "invalid quantity 5 GB",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := api.validate(tt.doc)
+			if !slices.ContainsFunc(errs, func(e string) bool { return strings.Contains(e, tt.want) }) {
+				t.Errorf("expected an error containing %q, got %v", tt.want, errs)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+harbor "production" {
+  hostname       = "registry.example.com"
+  version        = "v2.10.3"
+  admin_password = "s3cret-admin"
+
+  database {
+    host     = "pg.example.com"
+    port     = 6432
+    username = "harbor"
+    name     = "harbor_registry"
+    ssl_mode = "verify-full"
+    password = "db-p@ss"
+  }
+
+  redis {
+    address  = "redis.example.com:6379"
+    password = "redis-p@ss"
+  }
+
+  storage {
+    s3 {
+      bucket     = "harbor-images"
+      region     = "eu-west-1"
+      access_key = "AKIAEXAMPLE"
+      secret_key = "s3-s3cret"
+    }
+  }
+
+  kubernetes {
+    name          = "registry"
+    namespace     = "registry-prod"
+    ingress_class = "nginx"
+    tls_secret    = "registry-tls"
+    storage_class = "fast-rwx"
+
+    ingress_annotations = {
+      "nginx.ingress.kubernetes.io/proxy-body-size" = "0"
+    }
+
+    component "core" {
+      replicas = 3
+
+      requests {
+        cpu    = "250m"
+        memory = "512Mi"
+      }
+
+      limits {
+        cpu    = "1"
+        memory = "1Gi"
+      }
+    }
+
+    component "portal" {
+      replicas = 2
+    }
+
+    component "registry" {
+      replicas = 3
+
+      limits {
+        memory = "2Gi"
+      }
+    }
+
+    component "jobservice" {
+      replicas    = 2
+      volume_size = "10Gi"
+    }
+  }
+}
@@ -0,0 +1,214 @@
+// Copyright 2021 vjranagit
+//
+// Generated credentials shared by Harbor components
+
+package deploy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// RegistryUser is the account core authenticates to the registry with
+const RegistryUser = "harbor_registry_user"
+
+// Secret file locations, relative to the install directory
+const (
+	SecretsEnvPath     = "secret/secrets.env"
+	SecretKeyPath      = "secret/keys/secretkey"
+	TokenKeyPath       = "secret/core/private_key.pem"
+	RegistryPasswdPath = "secret/registry/passwd"
+)
+
+// tokenKeyBits is the size of the token signing key, as Harbor's installer
+// generates it
+const tokenKeyBits = 4096
+
+// ErrNoSecrets is returned by LoadSecrets when an install directory has
+// no secrets yet
+var ErrNoSecrets = errors.New("no secrets generated")
+
+// Secrets are the credentials Harbor components share. They are generated
+// once and kept in the install directory so re-rendering is stable
+type Secrets struct {
+	// SecretKey encrypts credentials Harbor stores in its database
+	SecretKey          string
+	CoreSecret         string
+	JobserviceSecret   string
+	RegistryHTTPSecret string
+	CSRFKey            string
+	// RegistryPassword is RegistryUser's password, RegistryPasswd its
+	// htpasswd entry
+	RegistryPassword string
+	RegistryPasswd   []byte
+	// TokenKey is the PEM encoded key core signs registry tokens with
+	TokenKey []byte
+}
+
+// GenerateSecrets creates a fresh set of secrets
+func GenerateSecrets() (*Secrets, error) {
+	s := &Secrets{}
+	for _, field := range []struct {
+		value *string
+		size  int
+	}{
+		{&s.SecretKey, 16},
+		{&s.CoreSecret, 16},
+		{&s.JobserviceSecret, 16},
+		{&s.RegistryHTTPSecret, 16},
+		{&s.CSRFKey, 32},
+		{&s.RegistryPassword, 32},
+	} {
+		value, err := randomString(field.size)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate secret: %w", err)
+		}
+		*field.value = value
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(s.RegistryPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash registry password: %w", err)
+	}
+	s.RegistryPasswd = []byte(RegistryUser + ":" + string(hash) + "\n")
+
+	key, err := rsa.GenerateKey(rand.Reader, tokenKeyBits)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate token key: %w", err)
+	}
+	s.TokenKey = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	return s, nil
+}
+
+// LoadSecrets reads the secrets kept in an install directory. It returns
+// ErrNoSecrets when none were generated, and an error when only some are
+// present so a partial set is never silently replaced
+func LoadSecrets(dir string) (*Secrets, error) {
+	env, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(SecretsEnvPath)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%s: %w", dir, ErrNoSecrets)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secrets: %w", err)
+	}
+
+	s := &Secrets{}
+	values := ParseEnv(env)
+	for _, field := range []struct {
+		name  string
+		value *string
+	}{
+		{"CORE_SECRET", &s.CoreSecret},
+		{"JOBSERVICE_SECRET", &s.JobserviceSecret},
+		{"REGISTRY_HTTP_SECRET", &s.RegistryHTTPSecret},
+		{"CSRF_KEY", &s.CSRFKey},
+		{"REGISTRY_PASSWORD", &s.RegistryPassword},
+	} {
+		if *field.value = values[field.name]; *field.value == "" {
+			return nil, fmt.Errorf("%s: missing %s", SecretsEnvPath, field.name)
+		}
+	}
+
+	read := func(path string) ([]byte, error) {
+		data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(path)))
+		if err != nil {
+			return nil, fmt.Errorf("incomplete secrets: %w", err)
+		}
+		return data, nil
+	}
+	key, err := read(SecretKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	s.SecretKey = string(key)
+	if s.TokenKey, err = read(TokenKeyPath); err != nil {
+		return nil, err
+	}
+	if s.RegistryPasswd, err = read(RegistryPasswdPath); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Files returns the secret files to keep in the install directory. Files
+// mounted into containers are world readable so the unprivileged component
+// users can read them; their directory is private instead
+func (s *Secrets) Files() []File {
+	var env bytes.Buffer
+	fmt.Fprintf(&env, "# Generated by harbor deploy; keep this file to re-render the install\n")
+	fmt.Fprintf(&env, "CORE_SECRET=%s\n", s.CoreSecret)
+	fmt.Fprintf(&env, "JOBSERVICE_SECRET=%s\n", s.JobserviceSecret)
+	fmt.Fprintf(&env, "REGISTRY_HTTP_SECRET=%s\n", s.RegistryHTTPSecret)
+	fmt.Fprintf(&env, "CSRF_KEY=%s\n", s.CSRFKey)
+	fmt.Fprintf(&env, "REGISTRY_PASSWORD=%s\n", s.RegistryPassword)
+
+	return []File{
+		{Path: SecretsEnvPath, Mode: 0o600, Data: env.Bytes(), Sensitive: true},
+		{Path: SecretKeyPath, Mode: 0o644, Data: []byte(s.SecretKey), Sensitive: true},
+		{Path: TokenKeyPath, Mode: 0o644, Data: s.TokenKey, Sensitive: true},
+		{Path: RegistryPasswdPath, Mode: 0o644, Data: s.RegistryPasswd, Sensitive: true},
+	}
+}
+
+// Values lists the secret strings, for redacting them from output
+func (s *Secrets) Values() []string {
+	return []string{
+		s.SecretKey,
+		s.CoreSecret,
+		s.JobserviceSecret,
+		s.RegistryHTTPSecret,
+		s.CSRFKey,
+		s.RegistryPassword,
+	}
+}
+
+// randomString returns n random alphanumeric characters
+func randomString(n int) (string, error) {
+	const alphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+	b := make([]byte, n)
+	buf := make([]byte, 1)
+	for i := 0; i < n; {
+		if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+			return "", err
+		}
+		// Reject the tail of the byte range to keep characters uniform
+		if int(buf[0]) >= 256-256%len(alphabet) {
+			continue
+		}
+		b[i] = alphabet[int(buf[0])%len(alphabet)]
+		i++
+	}
+	return string(b), nil
+}
+
+// ParseEnv reads the KEY=value lines of an env file, skipping blanks and
+// comments
+func ParseEnv(data []byte) map[string]string {
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if key, value, ok := strings.Cut(line, "="); ok {
+			values[key] = value
+		}
+	}
+	return values
+}
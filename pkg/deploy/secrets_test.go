@@ -0,0 +1,90 @@
+// Copyright 2021 vjranagit
+//
+// Secret generation tests
+
+package deploy
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestGenerateSecrets(t *testing.T) {
+	s, err := GenerateSecrets()
+	if err != nil {
+		t.Fatalf("GenerateSecrets failed: %v", err)
+	}
+
+	if len(s.SecretKey) != 16 || len(s.CSRFKey) != 32 {
+		t.Errorf("unexpected secret sizes: key %d, csrf %d", len(s.SecretKey), len(s.CSRFKey))
+	}
+	if s.CoreSecret == s.JobserviceSecret {
+		t.Error("expected independent secrets")
+	}
+
+	user, hash, ok := strings.Cut(strings.TrimSpace(string(s.RegistryPasswd)), ":")
+	if !ok || user != RegistryUser {
+		t.Fatalf("unexpected htpasswd entry %q", s.RegistryPasswd)
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(s.RegistryPassword)); err != nil {
+		t.Errorf("htpasswd entry does not match the password: %v", err)
+	}
+
+	block, _ := pem.Decode(s.TokenKey)
+	if block == nil {
+		t.Fatal("expected PEM token key")
+	}
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatalf("invalid token key: %v", err)
+	}
+	if key.N.BitLen() != tokenKeyBits {
+		t.Errorf("expected %d bit key, got %d", tokenKeyBits, key.N.BitLen())
+	}
+}
+
+func TestLoadSecrets(t *testing.T) {
+	dir := t.TempDir()
+
+	if _, err := LoadSecrets(dir); !errors.Is(err, ErrNoSecrets) {
+		t.Fatalf("expected ErrNoSecrets, got %v", err)
+	}
+
+	want := &Secrets{
+		SecretKey:          "key",
+		CoreSecret:         "core",
+		JobserviceSecret:   "jobservice",
+		RegistryHTTPSecret: "http",
+		CSRFKey:            "csrf",
+		RegistryPassword:   "password",
+		RegistryPasswd:     []byte(RegistryUser + ":hash\n"),
+		TokenKey:           []byte("pem"),
+	}
+	if _, err := Apply(dir, &Bundle{Files: want.Files()}); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+
+	got, err := LoadSecrets(dir)
+	if err != nil {
+		t.Fatalf("LoadSecrets failed: %v", err)
+	}
+	if strings.Join(got.Values(), ",") != strings.Join(want.Values(), ",") ||
+		string(got.RegistryPasswd) != string(want.RegistryPasswd) || string(got.TokenKey) != string(want.TokenKey) {
+		t.Errorf("expected %+v, got %+v", want, got)
+	}
+
+	// A partial set must not look like a fresh directory
+	if err := os.Remove(filepath.Join(dir, filepath.FromSlash(TokenKeyPath))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadSecrets(dir); err == nil || errors.Is(err, ErrNoSecrets) {
+		t.Errorf("expected incomplete secrets error, got %v", err)
+	}
+}
@@ -0,0 +1,235 @@
+// Copyright 2021 vjranagit
+//
+// Registry authentication (basic and bearer token)
+
+package distribution
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Credentials holds registry login information
+type Credentials struct {
+	Username string
+	Password string
+	// Token is a pre-issued bearer token, used as-is when set
+	Token string
+}
+
+// challenge is a parsed WWW-Authenticate header
+type challenge struct {
+	Scheme string
+	Params map[string]string
+}
+
+// parseChallenge parses a WWW-Authenticate header value such as
+// `Bearer realm="https://auth.example.com/token",service="registry"`
+func parseChallenge(header string) (challenge, bool) {
+	header = strings.TrimSpace(header)
+	scheme, rest, _ := strings.Cut(header, " ")
+	if scheme == "" {
+		return challenge{}, false
+	}
+
+	c := challenge{
+		Scheme: strings.ToLower(scheme),
+		Params: make(map[string]string),
+	}
+
+	for rest = strings.TrimSpace(rest); rest != ""; rest = strings.TrimSpace(rest) {
+		key, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		if strings.HasPrefix(value, `"`) {
+			end := strings.Index(value[1:], `"`)
+			if end < 0 {
+				return challenge{}, false
+			}
+			c.Params[key] = value[1 : end+1]
+			rest = value[end+2:]
+		} else {
+			v, remaining, _ := strings.Cut(value, ",")
+			c.Params[key] = strings.TrimSpace(v)
+			rest = remaining
+		}
+		rest = strings.TrimPrefix(strings.TrimSpace(rest), ",")
+	}
+
+	return c, true
+}
+
+// cachedToken is a bearer token with its expiry
+type cachedToken struct {
+	value     string
+	expiresAt time.Time
+}
+
+// authorizer answers registry challenges and caches issued tokens per scope
+type authorizer struct {
+	creds      Credentials
+	httpClient *http.Client
+	userAgent  string
+
+	mu        sync.Mutex
+	challenge *challenge
+	tokens    map[string]cachedToken
+}
+
+func newAuthorizer(creds Credentials, httpClient *http.Client, userAgent string) *authorizer {
+	return &authorizer{
+		creds:      creds,
+		httpClient: httpClient,
+		userAgent:  userAgent,
+		tokens:     make(map[string]cachedToken),
+	}
+}
+
+// authorize sets the Authorization header for the given scopes, using
+// whatever challenge the registry last presented
+func (a *authorizer) authorize(ctx context.Context, req *http.Request, scopes []string) error {
+	if a.creds.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.creds.Token)
+		return nil
+	}
+
+	a.mu.Lock()
+	c := a.challenge
+	a.mu.Unlock()
+
+	if c == nil {
+		return nil
+	}
+
+	switch c.Scheme {
+	case "basic":
+		if a.creds.Username != "" {
+			req.SetBasicAuth(a.creds.Username, a.creds.Password)
+		}
+	case "bearer":
+		token, err := a.token(ctx, *c, scopes)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return nil
+}
+
+// handleChallenge records the challenge of a 401 response, returning
+// false when there is nothing we could do differently on retry
+func (a *authorizer) handleChallenge(resp *http.Response, scopes []string) bool {
+	if a.creds.Token != "" {
+		return false
+	}
+
+	c, ok := parseChallenge(resp.Header.Get("WWW-Authenticate"))
+	if !ok || (c.Scheme != "basic" && c.Scheme != "bearer") {
+		return false
+	}
+	if c.Scheme == "basic" && a.creds.Username == "" {
+		return false
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.challenge = &c
+	// A rejected token for these scopes is stale, drop it
+	delete(a.tokens, strings.Join(scopes, " "))
+	return true
+}
+
+// token returns a cached or freshly issued bearer token for scopes
+func (a *authorizer) token(ctx context.Context, c challenge, scopes []string) (string, error) {
+	key := strings.Join(scopes, " ")
+
+	a.mu.Lock()
+	cached, ok := a.tokens[key]
+	a.mu.Unlock()
+	if ok && time.Now().Before(cached.expiresAt) {
+		return cached.value, nil
+	}
+
+	realm := c.Params["realm"]
+	if realm == "" {
+		return "", fmt.Errorf("bearer challenge without realm")
+	}
+	u, err := url.Parse(realm)
+	if err != nil {
+		return "", fmt.Errorf("invalid token realm %q: %w", realm, err)
+	}
+
+	q := u.Query()
+	if service := c.Params["service"]; service != "" {
+		q.Set("service", service)
+	}
+	for _, scope := range scopes {
+		q.Add("scope", scope)
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if a.creds.Username != "" {
+		req.SetBasicAuth(a.creds.Username, a.creds.Password)
+	}
+	if a.userAgent != "" {
+		req.Header.Set("User-Agent", a.userAgent)
+	}
+
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("token request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", newError(resp)
+	}
+
+	var payload struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return "", fmt.Errorf("failed to decode token response: %w", err)
+	}
+
+	value := payload.Token
+	if value == "" {
+		value = payload.AccessToken
+	}
+	if value == "" {
+		return "", fmt.Errorf("token response did not contain a token")
+	}
+
+	// Tokens without an explicit lifetime are valid for 60s per the spec
+	lifetime := 60 * time.Second
+	if payload.ExpiresIn > 0 {
+		lifetime = time.Duration(payload.ExpiresIn) * time.Second
+	}
+
+	a.mu.Lock()
+	a.tokens[key] = cachedToken{
+		value: value,
+		// Refresh a little early so in-flight requests don't race expiry
+		expiresAt: time.Now().Add(lifetime - lifetime/10),
+	}
+	a.mu.Unlock()
+
+	return value, nil
+}
@@ -0,0 +1,81 @@
+// Copyright 2021 vjranagit
+//
+// Registry authentication tests
+
+package distribution
+
+import (
+	"context"
+	"testing"
+
+	"github.com/vjranagit/harbor/pkg/distribution/registrytest"
+)
+
+func TestParseChallenge(t *testing.T) {
+	c, ok := parseChallenge(`Bearer realm="https://auth.example.com/token",service="harbor-registry",scope="repository:library/nginx:pull,push"`)
+	if !ok {
+		t.Fatal("expected challenge to parse")
+	}
+
+	if c.Scheme != "bearer" {
+		t.Errorf("expected scheme bearer, got %s", c.Scheme)
+	}
+
+	want := map[string]string{
+		"realm":   "https://auth.example.com/token",
+		"service": "harbor-registry",
+		"scope":   "repository:library/nginx:pull,push",
+	}
+	for key, value := range want {
+		if c.Params[key] != value {
+			t.Errorf("param %s = %q, want %q", key, c.Params[key], value)
+		}
+	}
+}
+
+func TestClient_Auth(t *testing.T) {
+	tests := []struct {
+		name    string
+		regOpt  registrytest.Option
+		creds   Credentials
+		wantErr bool
+	}{
+		{
+			name:   "basic auth",
+			regOpt: registrytest.WithBasicAuth("admin", "Harbor12345"),
+			creds:  Credentials{Username: "admin", Password: "Harbor12345"},
+		},
+		{
+			name:   "bearer token auth",
+			regOpt: registrytest.WithTokenAuth("admin", "Harbor12345"),
+			creds:  Credentials{Username: "admin", Password: "Harbor12345"},
+		},
+		{
+			name:    "bad credentials",
+			regOpt:  registrytest.WithTokenAuth("admin", "Harbor12345"),
+			creds:   Credentials{Username: "admin", Password: "wrong"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := registrytest.New(tt.regOpt)
+			defer reg.Close()
+
+			reg.PushImage("library/nginx", "latest", nil, []byte("layer"))
+			client := newTestClient(t, reg, WithCredentials(tt.creds))
+
+			_, err := client.HeadManifest(context.Background(), "library/nginx", "latest")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("HeadManifest() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil {
+				// A second call must reuse the cached token or basic credentials
+				if _, err := client.ListTags(context.Background(), "library/nginx"); err != nil {
+					t.Errorf("ListTags failed: %v", err)
+				}
+			}
+		})
+	}
+}
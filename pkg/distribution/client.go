@@ -0,0 +1,710 @@
+// Copyright 2021 vjranagit
+//
+// OCI Distribution v2 registry client
+
+package distribution
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/vjranagit/harbor/pkg/circuit"
+)
+
+// Docker media types still commonly served by registries
+const (
+	MediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+)
+
+// MaxManifestSize is the largest manifest GetManifest reads
+const MaxManifestSize = 4 << 20
+
+// manifestAccept lists every manifest media type we understand
+var manifestAccept = []string{
+	ocispec.MediaTypeImageManifest,
+	ocispec.MediaTypeImageIndex,
+	MediaTypeDockerManifest,
+	MediaTypeDockerManifestList,
+}
+
+// Client talks to a single OCI Distribution v2 registry
+type Client struct {
+	baseURL    *url.URL
+	httpClient *http.Client
+	creds      Credentials
+	userAgent  string
+	auth       *authorizer
+	breaker    *circuit.Breaker
+	logger     *slog.Logger
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithHTTPClient sets the underlying HTTP client
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = hc
+	}
+}
+
+// WithCredentials sets the credentials used to answer auth challenges
+func WithCredentials(creds Credentials) Option {
+	return func(c *Client) {
+		c.creds = creds
+	}
+}
+
+// WithUserAgent sets the User-Agent header sent with every request
+func WithUserAgent(ua string) Option {
+	return func(c *Client) {
+		c.userAgent = ua
+	}
+}
+
+// WithCircuitBreaker sends every registry request through b. Connection
+// errors and 5xx responses count as failures; while the circuit is open
+// requests fail with an error wrapping circuit.ErrOpen
+func WithCircuitBreaker(b *circuit.Breaker) Option {
+	return func(c *Client) {
+		c.breaker = b
+	}
+}
+
+// NewClient creates a client for the registry at addr, which is either a
+// bare host ("registry.example.com", https implied) or a full base URL
+func NewClient(addr string, opts ...Option) (*Client, error) {
+	if !strings.Contains(addr, "://") {
+		addr = "https://" + addr
+	}
+	u, err := url.Parse(strings.TrimSuffix(addr, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid registry address %q: %w", addr, err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid registry address %q: missing host", addr)
+	}
+
+	c := &Client{
+		baseURL:    u,
+		httpClient: http.DefaultClient,
+		userAgent:  "harbor-toolkit",
+		logger:     slog.Default().With("component", "distribution", "registry", u.Host),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.auth = newAuthorizer(c.creds, c.httpClient, c.userAgent)
+
+	return c, nil
+}
+
+// Registry returns the host[:port] of the registry
+func (c *Client) Registry() string {
+	return c.baseURL.Host
+}
+
+// Manifest is a raw manifest together with its descriptor
+type Manifest struct {
+	Descriptor ocispec.Descriptor
+	Payload    []byte
+}
+
+// IsIndex reports whether the manifest is an image index or manifest list
+func (m *Manifest) IsIndex() bool {
+	return m.Descriptor.MediaType == ocispec.MediaTypeImageIndex ||
+		m.Descriptor.MediaType == MediaTypeDockerManifestList
+}
+
+// References returns the descriptors the manifest points at: child
+// manifests for an index, config and layers for an image manifest
+func (m *Manifest) References() ([]ocispec.Descriptor, error) {
+	if m.IsIndex() {
+		var index ocispec.Index
+		if err := json.Unmarshal(m.Payload, &index); err != nil {
+			return nil, fmt.Errorf("failed to decode index: %w", err)
+		}
+		return index.Manifests, nil
+	}
+
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(m.Payload, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest: %w", err)
+	}
+	refs := make([]ocispec.Descriptor, 0, len(manifest.Layers)+1)
+	refs = append(refs, manifest.Config)
+	refs = append(refs, manifest.Layers...)
+	return refs, nil
+}
+
+// Ping checks that the registry speaks the v2 API
+func (c *Client) Ping(ctx context.Context) error {
+	resp, err := c.do(ctx, http.MethodGet, "/v2/", nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer drain(resp)
+
+	if resp.StatusCode != http.StatusOK {
+		return newError(resp)
+	}
+	return nil
+}
+
+// HeadManifest resolves a tag or digest to a manifest descriptor
+func (c *Client) HeadManifest(ctx context.Context, repo, reference string) (ocispec.Descriptor, error) {
+	header := http.Header{"Accept": manifestAccept}
+	resp, err := c.do(ctx, http.MethodHead, manifestPath(repo, reference), header, nil, pullScope(repo))
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	defer drain(resp)
+
+	if resp.StatusCode != http.StatusOK {
+		return ocispec.Descriptor{}, newError(resp)
+	}
+
+	desc := ocispec.Descriptor{
+		MediaType: resp.Header.Get("Content-Type"),
+		Size:      resp.ContentLength,
+	}
+	if d, err := digest.Parse(resp.Header.Get("Docker-Content-Digest")); err == nil {
+		desc.Digest = d
+	} else if d, err := digest.Parse(reference); err == nil {
+		desc.Digest = d
+	} else {
+		// Some registries omit the digest on HEAD, fall back to GET
+		m, err := c.GetManifest(ctx, repo, reference)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		return m.Descriptor, nil
+	}
+	return desc, nil
+}
+
+// GetManifest fetches a manifest by tag or digest
+func (c *Client) GetManifest(ctx context.Context, repo, reference string) (*Manifest, error) {
+	header := http.Header{"Accept": manifestAccept}
+	resp, err := c.do(ctx, http.MethodGet, manifestPath(repo, reference), header, nil, pullScope(repo))
+	if err != nil {
+		return nil, err
+	}
+	defer drain(resp)
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newError(resp)
+	}
+
+	if resp.ContentLength > MaxManifestSize {
+		return nil, fmt.Errorf("manifest %s:%s is %d bytes, exceeding %d MiB", repo, reference, resp.ContentLength, MaxManifestSize>>20)
+	}
+	payload, err := io.ReadAll(io.LimitReader(resp.Body, MaxManifestSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	if len(payload) > MaxManifestSize {
+		return nil, fmt.Errorf("manifest %s:%s exceeds %d MiB", repo, reference, MaxManifestSize>>20)
+	}
+
+	dgst := digest.FromBytes(payload)
+	if expected, err := digest.Parse(reference); err == nil && expected != dgst {
+		return nil, fmt.Errorf("manifest digest mismatch: expected %s, got %s", expected, dgst)
+	}
+
+	mediaType := resp.Header.Get("Content-Type")
+	if mediaType == "" || mediaType == "application/json" {
+		var probe struct {
+			MediaType string `json:"mediaType"`
+		}
+		_ = json.Unmarshal(payload, &probe)
+		mediaType = probe.MediaType
+	}
+
+	return &Manifest{
+		Descriptor: ocispec.Descriptor{
+			MediaType: mediaType,
+			Digest:    dgst,
+			Size:      int64(len(payload)),
+		},
+		Payload: payload,
+	}, nil
+}
+
+// PutManifest uploads a manifest under a tag or digest
+func (c *Client) PutManifest(ctx context.Context, repo, reference, mediaType string, payload []byte) (ocispec.Descriptor, error) {
+	header := http.Header{"Content-Type": {mediaType}}
+	resp, err := c.do(ctx, http.MethodPut, manifestPath(repo, reference), header, payload, pushScope(repo))
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	defer drain(resp)
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return ocispec.Descriptor{}, newError(resp)
+	}
+
+	return ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(payload),
+		Size:      int64(len(payload)),
+	}, nil
+}
+
+// DeleteManifest deletes a manifest by digest, which also removes every
+// tag pointing at it
+func (c *Client) DeleteManifest(ctx context.Context, repo string, dgst digest.Digest) error {
+	resp, err := c.do(ctx, http.MethodDelete, manifestPath(repo, dgst.String()), nil, nil, deleteScope(repo))
+	if err != nil {
+		return err
+	}
+	defer drain(resp)
+
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusOK {
+		return newError(resp)
+	}
+	return nil
+}
+
+// DeleteTag removes a single tag. Registries implementing distribution
+// spec v1.1 delete the tag directly; older ones only accept digests, in
+// which case the manifest is deleted only if no other tag references it
+func (c *Client) DeleteTag(ctx context.Context, repo, tag string) error {
+	resp, err := c.do(ctx, http.MethodDelete, manifestPath(repo, tag), nil, nil, deleteScope(repo))
+	if err != nil {
+		return err
+	}
+	defer drain(resp)
+
+	switch resp.StatusCode {
+	case http.StatusAccepted, http.StatusOK:
+		return nil
+	case http.StatusBadRequest, http.StatusMethodNotAllowed:
+		// Tag deletion unsupported, fall through to digest deletion
+	default:
+		return newError(resp)
+	}
+
+	desc, err := c.HeadManifest(ctx, repo, tag)
+	if err != nil {
+		return err
+	}
+
+	tags, err := c.ListTags(ctx, repo)
+	if err != nil {
+		return err
+	}
+	for _, other := range tags {
+		if other == tag {
+			continue
+		}
+		otherDesc, err := c.HeadManifest(ctx, repo, other)
+		if err != nil {
+			return err
+		}
+		if otherDesc.Digest == desc.Digest {
+			return fmt.Errorf("registry cannot delete tags and %s:%s shares manifest %s with tag %q", repo, tag, desc.Digest, other)
+		}
+	}
+
+	return c.DeleteManifest(ctx, repo, desc.Digest)
+}
+
+// HeadBlob reports whether a blob exists in a repository
+func (c *Client) HeadBlob(ctx context.Context, repo string, dgst digest.Digest) (bool, error) {
+	resp, err := c.do(ctx, http.MethodHead, blobPath(repo, dgst), nil, nil, pullScope(repo))
+	if err != nil {
+		return false, err
+	}
+	defer drain(resp)
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, newError(resp)
+	}
+}
+
+// GetBlob opens a blob for reading; the caller must close it
+func (c *Client) GetBlob(ctx context.Context, repo string, dgst digest.Digest) (io.ReadCloser, error) {
+	resp, err := c.do(ctx, http.MethodGet, blobPath(repo, dgst), nil, nil, pullScope(repo))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer drain(resp)
+		return nil, newError(resp)
+	}
+	return resp.Body, nil
+}
+
+// PushBlob uploads a blob unless the repository already has it
+func (c *Client) PushBlob(ctx context.Context, repo string, desc ocispec.Descriptor, r io.Reader) error {
+	exists, err := c.HeadBlob(ctx, repo, desc.Digest)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	location, err := c.startUpload(ctx, repo)
+	if err != nil {
+		return err
+	}
+	return c.finishUpload(ctx, repo, location, desc, r)
+}
+
+// MountBlob asks the registry to link a blob from another repository.
+// It returns false when the registry declined the mount
+func (c *Client) MountBlob(ctx context.Context, repo, from string, dgst digest.Digest) (bool, error) {
+	query := url.Values{"mount": {dgst.String()}, "from": {from}}
+	resp, err := c.do(ctx, http.MethodPost, "/v2/"+repo+"/blobs/uploads/?"+query.Encode(), nil, nil,
+		append(pushScope(repo), pullScope(from)...))
+	if err != nil {
+		return false, err
+	}
+	defer drain(resp)
+
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		return true, nil
+	case http.StatusAccepted:
+		// The registry opened a regular upload session instead, cancel it
+		if location := resp.Header.Get("Location"); location != "" {
+			if cancel, err := c.do(ctx, http.MethodDelete, location, nil, nil, pushScope(repo)); err == nil {
+				drain(cancel)
+			}
+		}
+		return false, nil
+	default:
+		return false, newError(resp)
+	}
+}
+
+// CopyBlob makes a blob from one repository available in another, via
+// cross-repository mount when possible and streaming otherwise
+func (c *Client) CopyBlob(ctx context.Context, from, to string, desc ocispec.Descriptor) error {
+	if from == to {
+		return nil
+	}
+
+	exists, err := c.HeadBlob(ctx, to, desc.Digest)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	mounted, err := c.MountBlob(ctx, to, from, desc.Digest)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		return nil
+	}
+
+	c.logger.DebugContext(ctx, "blob mount declined, streaming", "digest", desc.Digest, "from", from, "to", to)
+
+	rc, err := c.GetBlob(ctx, from, desc.Digest)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	location, err := c.startUpload(ctx, to)
+	if err != nil {
+		return err
+	}
+	return c.finishUpload(ctx, to, location, desc, rc)
+}
+
+// ListTags returns every tag of a repository, following pagination
+func (c *Client) ListTags(ctx context.Context, repo string) ([]string, error) {
+	var tags []string
+	next := "/v2/" + repo + "/tags/list"
+
+	for next != "" {
+		resp, err := c.do(ctx, http.MethodGet, next, nil, nil, pullScope(repo))
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			err := newError(resp)
+			drain(resp)
+			return nil, err
+		}
+
+		var page struct {
+			Tags []string `json:"tags"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		drain(resp)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode tag list: %w", err)
+		}
+
+		tags = append(tags, page.Tags...)
+		next = nextLink(resp.Header.Get("Link"))
+	}
+
+	return tags, nil
+}
+
+// Catalog returns every repository of the registry, following pagination
+func (c *Client) Catalog(ctx context.Context) ([]string, error) {
+	var repos []string
+	next := "/v2/_catalog"
+
+	for next != "" {
+		resp, err := c.do(ctx, http.MethodGet, next, nil, nil, catalogScope)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			err := newError(resp)
+			drain(resp)
+			return nil, err
+		}
+
+		var page struct {
+			Repositories []string `json:"repositories"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		drain(resp)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode catalog: %w", err)
+		}
+
+		repos = append(repos, page.Repositories...)
+		next = nextLink(resp.Header.Get("Link"))
+	}
+
+	return repos, nil
+}
+
+// CopyManifest copies a manifest, and everything it references, from
+// srcRepo:srcRef to dstRepo:dstRef within the registry
+func (c *Client) CopyManifest(ctx context.Context, srcRepo, srcRef, dstRepo, dstRef string) (ocispec.Descriptor, error) {
+	m, err := c.GetManifest(ctx, srcRepo, srcRef)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	refs, err := m.References()
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	for _, ref := range refs {
+		if m.IsIndex() {
+			// Child manifests are pushed by digest before the index
+			if _, err := c.CopyManifest(ctx, srcRepo, ref.Digest.String(), dstRepo, ref.Digest.String()); err != nil {
+				return ocispec.Descriptor{}, fmt.Errorf("failed to copy child manifest %s: %w", ref.Digest, err)
+			}
+			continue
+		}
+		if err := c.CopyBlob(ctx, srcRepo, dstRepo, ref); err != nil {
+			return ocispec.Descriptor{}, fmt.Errorf("failed to copy blob %s: %w", ref.Digest, err)
+		}
+	}
+
+	return c.PutManifest(ctx, dstRepo, dstRef, m.Descriptor.MediaType, m.Payload)
+}
+
+// startUpload opens an upload session and returns its location
+func (c *Client) startUpload(ctx context.Context, repo string) (string, error) {
+	resp, err := c.do(ctx, http.MethodPost, "/v2/"+repo+"/blobs/uploads/", nil, nil, pushScope(repo))
+	if err != nil {
+		return "", err
+	}
+	defer drain(resp)
+
+	if resp.StatusCode != http.StatusAccepted {
+		return "", newError(resp)
+	}
+
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return "", fmt.Errorf("upload session for %s has no location", repo)
+	}
+	return location, nil
+}
+
+// finishUpload completes an upload session with a single monolithic PUT
+func (c *Client) finishUpload(ctx context.Context, repo, location string, desc ocispec.Descriptor, r io.Reader) error {
+	u, err := c.resolve(location)
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	q.Set("digest", desc.Digest.String())
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = desc.Size
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := c.send(ctx, req, pushScope(repo))
+	if err != nil {
+		return err
+	}
+	defer drain(resp)
+
+	if resp.StatusCode != http.StatusCreated {
+		return newError(resp)
+	}
+	return nil
+}
+
+// do builds and sends a request against a registry path or absolute URL
+func (c *Client) do(ctx context.Context, method, path string, header http.Header, body []byte, scopes []string) (*http.Response, error) {
+	u, err := c.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), reader)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	return c.send(ctx, req, scopes)
+}
+
+// send authorizes and sends a request, answering one auth challenge
+func (c *Client) send(ctx context.Context, req *http.Request, scopes []string) (*http.Response, error) {
+	if c.userAgent != "" {
+		req.Header.Set("User-Agent", c.userAgent)
+	}
+	if err := c.auth.authorize(ctx, req, scopes); err != nil {
+		return nil, fmt.Errorf("authorization failed: %w", err)
+	}
+
+	resp, err := c.roundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusUnauthorized || !c.auth.handleChallenge(resp, scopes) {
+		return resp, nil
+	}
+
+	// Retry once with credentials, if the body can be replayed
+	if req.Body != nil && req.GetBody == nil {
+		return resp, nil
+	}
+	drain(resp)
+
+	retry := req.Clone(ctx)
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.auth.authorize(ctx, retry, scopes); err != nil {
+		return nil, fmt.Errorf("authorization failed: %w", err)
+	}
+
+	c.logger.DebugContext(ctx, "retrying with credentials", "method", req.Method, "url", req.URL.Redacted())
+	return c.roundTrip(retry)
+}
+
+// roundTrip sends a request through the circuit breaker, if any
+func (c *Client) roundTrip(req *http.Request) (*http.Response, error) {
+	if c.breaker == nil {
+		return c.httpClient.Do(req)
+	}
+
+	call, err := c.breaker.Allow()
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w", req.Method, req.URL.Redacted(), err)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	result := err
+	if err == nil && resp.StatusCode >= http.StatusInternalServerError {
+		result = fmt.Errorf("registry returned %d", resp.StatusCode)
+	}
+	// A slow response is still returned; only the breaker counts it
+	call.Done(result)
+	return resp, err
+}
+
+// resolve turns a registry path or upload location into an absolute URL
+func (c *Client) resolve(ref string) (*url.URL, error) {
+	u, err := url.Parse(ref)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url %q: %w", ref, err)
+	}
+	return c.baseURL.ResolveReference(u), nil
+}
+
+func manifestPath(repo, reference string) string {
+	return "/v2/" + repo + "/manifests/" + reference
+}
+
+func blobPath(repo string, dgst digest.Digest) string {
+	return "/v2/" + repo + "/blobs/" + dgst.String()
+}
+
+// catalogScope is the token scope of the catalog endpoint
+var catalogScope = []string{"registry:catalog:*"}
+
+func pullScope(repo string) []string {
+	return []string{"repository:" + repo + ":pull"}
+}
+
+func pushScope(repo string) []string {
+	return []string{"repository:" + repo + ":pull,push"}
+}
+
+func deleteScope(repo string) []string {
+	return []string{"repository:" + repo + ":delete"}
+}
+
+// nextLink extracts the rel="next" target from an RFC 5988 Link header
+func nextLink(header string) string {
+	for _, link := range strings.Split(header, ",") {
+		target, params, ok := strings.Cut(strings.TrimSpace(link), ";")
+		if !ok || !strings.Contains(params, `rel="next"`) {
+			continue
+		}
+		return strings.Trim(strings.TrimSpace(target), "<>")
+	}
+	return ""
+}
+
+// drain discards the rest of a response body so the connection is reused
+func drain(resp *http.Response) {
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+}
@@ -0,0 +1,303 @@
+// Copyright 2021 vjranagit
+//
+// Registry client tests
+
+package distribution
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/vjranagit/harbor/pkg/circuit"
+	"github.com/vjranagit/harbor/pkg/distribution/registrytest"
+)
+
+func newTestClient(t *testing.T, reg *registrytest.Registry, opts ...Option) *Client {
+	t.Helper()
+
+	client, err := NewClient(reg.URL(), opts...)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	return client
+}
+
+func TestClient_ManifestLifecycle(t *testing.T) {
+	reg := registrytest.New()
+	defer reg.Close()
+
+	pushed := reg.PushImage("library/nginx", "1.25", nil, []byte("layer-1"))
+	client := newTestClient(t, reg)
+	ctx := context.Background()
+
+	if err := client.Ping(ctx); err != nil {
+		t.Fatalf("Ping failed: %v", err)
+	}
+
+	desc, err := client.HeadManifest(ctx, "library/nginx", "1.25")
+	if err != nil {
+		t.Fatalf("HeadManifest failed: %v", err)
+	}
+	if desc.Digest != pushed.Digest {
+		t.Errorf("expected digest %s, got %s", pushed.Digest, desc.Digest)
+	}
+
+	m, err := client.GetManifest(ctx, "library/nginx", pushed.Digest.String())
+	if err != nil {
+		t.Fatalf("GetManifest failed: %v", err)
+	}
+	if m.Descriptor.MediaType != ocispec.MediaTypeImageManifest {
+		t.Errorf("expected media type %s, got %s", ocispec.MediaTypeImageManifest, m.Descriptor.MediaType)
+	}
+
+	refs, err := m.References()
+	if err != nil {
+		t.Fatalf("References failed: %v", err)
+	}
+	if len(refs) != 2 {
+		t.Errorf("expected config and one layer, got %d references", len(refs))
+	}
+
+	if _, err := client.PutManifest(ctx, "library/nginx", "stable", m.Descriptor.MediaType, m.Payload); err != nil {
+		t.Fatalf("PutManifest failed: %v", err)
+	}
+	if err := client.DeleteManifest(ctx, "library/nginx", pushed.Digest); err != nil {
+		t.Fatalf("DeleteManifest failed: %v", err)
+	}
+
+	_, err = client.HeadManifest(ctx, "library/nginx", "1.25")
+	if !IsNotFound(err) {
+		t.Errorf("expected not found after delete, got %v", err)
+	}
+}
+
+func TestClient_ManifestTooLarge(t *testing.T) {
+	reg := registrytest.New()
+	defer reg.Close()
+
+	client := newTestClient(t, reg)
+	tests := []struct {
+		name string
+		size int
+		ok   bool
+	}{
+		{"at the limit", MaxManifestSize, true},
+		{"over the limit", MaxManifestSize + 1, false},
+	}
+
+	for _, tt := range tests {
+		payload := append([]byte(`{"mediaType": "`+ocispec.MediaTypeImageManifest+`"}`), bytes.Repeat([]byte(" "), tt.size-len(ocispec.MediaTypeImageManifest)-17)...)
+		desc := reg.PutManifest("library/huge", tt.name, ocispec.MediaTypeImageManifest, payload)
+
+		m, err := client.GetManifest(context.Background(), "library/huge", desc.Digest.String())
+		if tt.ok && (err != nil || len(m.Payload) != tt.size) {
+			t.Errorf("%s: expected the whole manifest, got %v", tt.name, err)
+		}
+		if !tt.ok && (err == nil || !strings.Contains(err.Error(), "exceeding 4 MiB")) {
+			t.Errorf("%s: expected a size error, got %v", tt.name, err)
+		}
+	}
+
+	// Without a Content-Length the body is cut off after the limit
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", ocispec.MediaTypeImageManifest)
+		w.(http.Flusher).Flush()
+		w.Write(bytes.Repeat([]byte(" "), MaxManifestSize+1))
+	}))
+	defer srv.Close()
+
+	client, err := NewClient(srv.URL)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	if _, err := client.GetManifest(context.Background(), "library/huge", "chunked"); err == nil || !strings.Contains(err.Error(), "exceeds 4 MiB") {
+		t.Errorf("chunked: expected a size error, got %v", err)
+	}
+}
+
+func TestClient_DeleteTag(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     []registrytest.Option
+		wantErr  bool
+		wantTags int
+	}{
+		{
+			name:     "tag deletion supported",
+			wantTags: 1,
+		},
+		{
+			name:     "digest fallback refuses shared manifest",
+			opts:     []registrytest.Option{registrytest.WithoutTagDeletion()},
+			wantErr:  true,
+			wantTags: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := registrytest.New(tt.opts...)
+			defer reg.Close()
+
+			desc := reg.PushImage("library/app", "v1", nil, []byte("layer"))
+			payload, mediaType, _ := reg.Manifest("library/app", desc.Digest.String())
+			reg.PutManifest("library/app", "latest", mediaType, payload)
+
+			client := newTestClient(t, reg)
+			err := client.DeleteTag(context.Background(), "library/app", "v1")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DeleteTag() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := len(reg.Tags("library/app")); got != tt.wantTags {
+				t.Errorf("expected %d remaining tags, got %d", tt.wantTags, got)
+			}
+		})
+	}
+}
+
+func TestClient_ListTagsPagination(t *testing.T) {
+	reg := registrytest.New(registrytest.WithPageSize(2))
+	defer reg.Close()
+
+	for i := 0; i < 5; i++ {
+		reg.PushImage("library/redis", fmt.Sprintf("v%d", i), nil)
+	}
+
+	client := newTestClient(t, reg)
+	tags, err := client.ListTags(context.Background(), "library/redis")
+	if err != nil {
+		t.Fatalf("ListTags failed: %v", err)
+	}
+	if len(tags) != 5 {
+		t.Errorf("expected 5 tags, got %d: %v", len(tags), tags)
+	}
+}
+
+func TestClient_CatalogPagination(t *testing.T) {
+	reg := registrytest.New(registrytest.WithPageSize(2))
+	defer reg.Close()
+
+	for _, repo := range []string{"library/redis", "library/nginx", "team/api", "team/web", "tools/curl"} {
+		reg.PushImage(repo, "v1", nil)
+	}
+
+	client := newTestClient(t, reg)
+	repos, err := client.Catalog(context.Background())
+	if err != nil {
+		t.Fatalf("Catalog failed: %v", err)
+	}
+
+	want := []string{"library/nginx", "library/redis", "team/api", "team/web", "tools/curl"}
+	if fmt.Sprint(repos) != fmt.Sprint(want) {
+		t.Errorf("expected %v, got %v", want, repos)
+	}
+}
+
+func TestClient_CopyManifest(t *testing.T) {
+	for _, mount := range []bool{true, false} {
+		t.Run(fmt.Sprintf("mount=%v", mount), func(t *testing.T) {
+			var opts []registrytest.Option
+			if !mount {
+				opts = append(opts, registrytest.WithoutMount())
+			}
+			reg := registrytest.New(opts...)
+			defer reg.Close()
+
+			src := reg.PushImage("library/nginx", "1.21", nil, []byte("layer-a"), []byte("layer-b"))
+			client := newTestClient(t, reg)
+
+			desc, err := client.CopyManifest(context.Background(), "library/nginx", "1.21", "backup/library/nginx", "1.21")
+			if err != nil {
+				t.Fatalf("CopyManifest failed: %v", err)
+			}
+			if desc.Digest != src.Digest {
+				t.Errorf("expected copied digest %s, got %s", src.Digest, desc.Digest)
+			}
+			if _, _, ok := reg.Manifest("backup/library/nginx", "1.21"); !ok {
+				t.Error("expected manifest in destination repository")
+			}
+			if !reg.HasBlob("backup/library/nginx", digest.FromBytes([]byte("layer-b"))) {
+				t.Error("expected layer blob in destination repository")
+			}
+		})
+	}
+}
+
+func TestClient_PushAndGetBlob(t *testing.T) {
+	reg := registrytest.New()
+	defer reg.Close()
+
+	client := newTestClient(t, reg)
+	ctx := context.Background()
+	data := []byte("hello blob")
+	desc := ocispec.Descriptor{Digest: digest.FromBytes(data), Size: int64(len(data))}
+
+	if err := client.PushBlob(ctx, "library/app", desc, bytes.NewReader(data)); err != nil {
+		t.Fatalf("PushBlob failed: %v", err)
+	}
+
+	rc, err := client.GetBlob(ctx, "library/app", desc.Digest)
+	if err != nil {
+		t.Fatalf("GetBlob failed: %v", err)
+	}
+	defer rc.Close()
+
+	got, _ := io.ReadAll(rc)
+	if string(got) != string(data) {
+		t.Errorf("expected %q, got %q", data, got)
+	}
+}
+
+func TestClient_CircuitBreaker(t *testing.T) {
+	reg := registrytest.New()
+	defer reg.Close()
+
+	now := time.Now()
+	breaker := circuit.New(
+		circuit.Settings{FailureThreshold: 2, SuccessThreshold: 1, RetryDelay: time.Minute},
+		circuit.WithClock(func() time.Time { return now }),
+	)
+	client := newTestClient(t, reg, WithCircuitBreaker(breaker))
+	ctx := context.Background()
+
+	// Client errors mean the registry is up
+	for i := 0; i < 3; i++ {
+		if _, err := client.HeadManifest(ctx, "library/missing", "latest"); !IsNotFound(err) {
+			t.Fatalf("expected not found, got %v", err)
+		}
+	}
+	if breaker.State() != circuit.Closed {
+		t.Fatalf("expected 404s to keep the circuit closed, got %s", breaker.State())
+	}
+
+	reg.FailRequests(2, http.StatusServiceUnavailable, nil)
+	client.Ping(ctx)
+	client.Ping(ctx)
+	if breaker.State() != circuit.Open {
+		t.Fatalf("expected 503s to open the circuit, got %s", breaker.State())
+	}
+
+	served := len(reg.Requests())
+	if err := client.Ping(ctx); !errors.Is(err, circuit.ErrOpen) {
+		t.Errorf("expected ErrOpen, got %v", err)
+	}
+	if got := len(reg.Requests()); got != served {
+		t.Errorf("expected no request while open, got %d more", got-served)
+	}
+
+	now = now.Add(time.Minute)
+	if err := client.Ping(ctx); err != nil || breaker.State() != circuit.Closed {
+		t.Errorf("expected a successful retry to close the circuit, got %s (%v)", breaker.State(), err)
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2021 vjranagit
+//
+// Registry error responses
+
+package distribution
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrorDetail is a single entry of a distribution error response body
+type ErrorDetail struct {
+	Code    string          `json:"code"`
+	Message string          `json:"message"`
+	Detail  json.RawMessage `json:"detail,omitempty"`
+}
+
+// Error is returned when the registry answers with an unexpected status
+type Error struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Errors     []ErrorDetail
+	// RetryAfter is the delay the registry asked for with Retry-After,
+	// zero when it sent none
+	RetryAfter time.Duration
+}
+
+// Error implements the error interface
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("%s %s: %d %s", e.Method, e.URL, e.StatusCode, http.StatusText(e.StatusCode))
+	if len(e.Errors) > 0 {
+		parts := make([]string, 0, len(e.Errors))
+		for _, d := range e.Errors {
+			parts = append(parts, fmt.Sprintf("%s: %s", d.Code, d.Message))
+		}
+		msg += " (" + strings.Join(parts, "; ") + ")"
+	}
+	return msg
+}
+
+// IsNotFound reports whether err is a 404 response from the registry
+func IsNotFound(err error) bool {
+	return hasStatus(err, http.StatusNotFound)
+}
+
+// IsUnauthorized reports whether err is a 401 or 403 response from the registry
+func IsUnauthorized(err error) bool {
+	return hasStatus(err, http.StatusUnauthorized) || hasStatus(err, http.StatusForbidden)
+}
+
+func hasStatus(err error, status int) bool {
+	var e *Error
+	return errors.As(err, &e) && e.StatusCode == status
+}
+
+// newError builds an Error from a failed response, consuming its body
+func newError(resp *http.Response) error {
+	e := &Error{
+		Method:     resp.Request.Method,
+		URL:        resp.Request.URL.Redacted(),
+		StatusCode: resp.StatusCode,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	var payload struct {
+		Errors []ErrorDetail `json:"errors"`
+	}
+	if json.Unmarshal(body, &payload) == nil {
+		e.Errors = payload.Errors
+	}
+	return e
+}
+
+// parseRetryAfter reads a Retry-After value given in seconds or as an HTTP
+// date relative to now
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
@@ -0,0 +1,54 @@
+// Copyright 2021 vjranagit
+//
+// Registry error response tests
+
+package distribution
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/vjranagit/harbor/pkg/distribution/registrytest"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"0", 0},
+		{"120", 2 * time.Minute},
+		{"-5", 0},
+		{"Tue, 01 Jun 2021 12:00:30 GMT", 30 * time.Second},
+		{"Tue, 01 Jun 2021 11:59:00 GMT", 0},
+		{"soon", 0},
+	}
+
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.value, now); got != tt.want {
+			t.Errorf("%q: expected %s, got %s", tt.value, tt.want, got)
+		}
+	}
+}
+
+func TestError_RetryAfter(t *testing.T) {
+	reg := registrytest.New()
+	defer reg.Close()
+	reg.FailRequests(1, http.StatusTooManyRequests, http.Header{"Retry-After": {"7"}})
+
+	client := newTestClient(t, reg)
+	_, err := client.ListTags(context.Background(), "library/redis")
+
+	regErr, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("expected *Error, got %T: %v", err, err)
+	}
+	if regErr.StatusCode != http.StatusTooManyRequests || regErr.RetryAfter != 7*time.Second {
+		t.Errorf("expected 429 with a 7s Retry-After, got %d and %s", regErr.StatusCode, regErr.RetryAfter)
+	}
+}
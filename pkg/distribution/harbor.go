@@ -0,0 +1,94 @@
+// Copyright 2021 vjranagit
+//
+// Harbor API extensions beyond the distribution spec
+
+package distribution
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// harborAPIPrefix is the base path of Harbor's v2 REST API
+const harborAPIPrefix = "/api/v2.0"
+
+// harborPageSize is the largest page Harbor serves
+const harborPageSize = 100
+
+// UntaggedManifests returns the digests of the manifests of a repository
+// that no tag points at. The distribution API cannot list them, so this
+// uses Harbor's artifact API and fails on other registries
+func (c *Client) UntaggedManifests(ctx context.Context, repo string) ([]digest.Digest, error) {
+	project, name, ok := strings.Cut(repo, "/")
+	if !ok {
+		return nil, fmt.Errorf("repository %s has no project", repo)
+	}
+
+	// Harbor expects slashes within the repository name encoded twice
+	query := url.Values{
+		"q":         {"tags=nil"},
+		"page":      {"1"},
+		"page_size": {fmt.Sprint(harborPageSize)},
+	}
+	next := fmt.Sprintf("%s/projects/%s/repositories/%s/artifacts?%s",
+		harborAPIPrefix, url.PathEscape(project), url.PathEscape(url.PathEscape(name)), query.Encode())
+
+	var digests []digest.Digest
+	for next != "" {
+		resp, err := c.doHarbor(ctx, next)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			err := newError(resp)
+			drain(resp)
+			return nil, fmt.Errorf("harbor artifact API: %w", err)
+		}
+
+		var page []struct {
+			Digest digest.Digest `json:"digest"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		drain(resp)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode artifact list: %w", err)
+		}
+
+		for _, artifact := range page {
+			digests = append(digests, artifact.Digest)
+		}
+		next = nextLink(resp.Header.Get("Link"))
+	}
+
+	return digests, nil
+}
+
+// doHarbor sends a GET to the Harbor API, which takes basic credentials
+// up front rather than registry tokens
+func (c *Client) doHarbor(ctx context.Context, path string) (*http.Response, error) {
+	u, err := c.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.userAgent != "" {
+		req.Header.Set("User-Agent", c.userAgent)
+	}
+	if c.creds.Username != "" {
+		req.SetBasicAuth(c.creds.Username, c.creds.Password)
+	}
+
+	return c.httpClient.Do(req)
+}
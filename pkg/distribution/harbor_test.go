@@ -0,0 +1,42 @@
+// Copyright 2021 vjranagit
+//
+// Harbor API extension tests
+
+package distribution
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+
+	"github.com/vjranagit/harbor/pkg/distribution/registrytest"
+)
+
+func TestClient_UntaggedManifests(t *testing.T) {
+	reg := registrytest.New(registrytest.WithBasicAuth("admin", "secret"))
+	defer reg.Close()
+
+	reg.PushImage("library/app/web", "v1", nil, []byte("web-1"))
+	old := reg.PushImage("library/app/web", "v2", nil, []byte("web-2"))
+	reg.PushImage("library/app/web", "v2", nil, []byte("web-3")) // v2 moves on
+
+	client := newTestClient(t, reg, WithCredentials(Credentials{Username: "admin", Password: "secret"}))
+	digests, err := client.UntaggedManifests(context.Background(), "library/app/web")
+	if err != nil {
+		t.Fatalf("UntaggedManifests failed: %v", err)
+	}
+	if want := []digest.Digest{old.Digest}; fmt.Sprint(digests) != fmt.Sprint(want) {
+		t.Errorf("expected %v, got %v", want, digests)
+	}
+
+	if _, err := client.UntaggedManifests(context.Background(), "app"); err == nil {
+		t.Error("expected error for a repository without project")
+	}
+
+	anonymous := newTestClient(t, reg)
+	if _, err := anonymous.UntaggedManifests(context.Background(), "library/app/web"); !IsUnauthorized(err) {
+		t.Errorf("expected unauthorized, got %v", err)
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2021 vjranagit
+//
+// Image reference parsing
+
+package distribution
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// DefaultTag is used when a reference carries neither tag nor digest
+const DefaultTag = "latest"
+
+var (
+	repositoryPattern = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*$`)
+	tagPattern        = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+)
+
+// Reference identifies a manifest within a repository
+type Reference struct {
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     digest.Digest
+}
+
+// ParseReference parses references such as "library/nginx:1.25",
+// "registry.example.com/library/nginx@sha256:..." or "library/nginx"
+func ParseReference(s string) (Reference, error) {
+	var ref Reference
+	remainder := s
+
+	if i := strings.Index(remainder, "@"); i >= 0 {
+		d, err := digest.Parse(remainder[i+1:])
+		if err != nil {
+			return Reference{}, fmt.Errorf("invalid reference %q: %w", s, err)
+		}
+		ref.Digest = d
+		remainder = remainder[:i]
+	}
+
+	if i := strings.LastIndex(remainder, ":"); i > strings.LastIndex(remainder, "/") {
+		ref.Tag = remainder[i+1:]
+		remainder = remainder[:i]
+		if !tagPattern.MatchString(ref.Tag) {
+			return Reference{}, fmt.Errorf("invalid reference %q: bad tag %q", s, ref.Tag)
+		}
+	}
+
+	if i := strings.Index(remainder, "/"); i >= 0 {
+		host := remainder[:i]
+		if strings.ContainsAny(host, ".:") || host == "localhost" {
+			ref.Registry = host
+			remainder = remainder[i+1:]
+		}
+	}
+
+	if !repositoryPattern.MatchString(remainder) {
+		return Reference{}, fmt.Errorf("invalid reference %q: bad repository %q", s, remainder)
+	}
+	ref.Repository = remainder
+
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = DefaultTag
+	}
+
+	return ref, nil
+}
+
+// Identifier returns the digest if set, otherwise the tag
+func (r Reference) Identifier() string {
+	if r.Digest != "" {
+		return r.Digest.String()
+	}
+	return r.Tag
+}
+
+// String returns the canonical string form of the reference
+func (r Reference) String() string {
+	var b strings.Builder
+	if r.Registry != "" {
+		b.WriteString(r.Registry)
+		b.WriteByte('/')
+	}
+	b.WriteString(r.Repository)
+	if r.Tag != "" {
+		b.WriteByte(':')
+		b.WriteString(r.Tag)
+	}
+	if r.Digest != "" {
+		b.WriteByte('@')
+		b.WriteString(r.Digest.String())
+	}
+	return b.String()
+}
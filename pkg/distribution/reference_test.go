@@ -0,0 +1,51 @@
+// Copyright 2021 vjranagit
+//
+// Image reference parsing tests
+
+package distribution
+
+import "testing"
+
+func TestParseReference(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    Reference
+		wantErr bool
+	}{
+		{
+			input: "library/nginx:1.25",
+			want:  Reference{Repository: "library/nginx", Tag: "1.25"},
+		},
+		{
+			input: "library/nginx",
+			want:  Reference{Repository: "library/nginx", Tag: "latest"},
+		},
+		{
+			input: "registry.example.com:5000/team/app:v1.0.0",
+			want:  Reference{Registry: "registry.example.com:5000", Repository: "team/app", Tag: "v1.0.0"},
+		},
+		{
+			input: "localhost/app@sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+			want: Reference{
+				Registry:   "localhost",
+				Repository: "app",
+				Digest:     "sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+			},
+		},
+		{input: "Library/Nginx:latest", wantErr: true},
+		{input: "library/nginx:bad tag", wantErr: true},
+		{input: "library/nginx@sha256:nothex", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParseReference(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseReference() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("ParseReference() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
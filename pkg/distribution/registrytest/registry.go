@@ -0,0 +1,767 @@
+// Copyright 2021 vjranagit
+//
+// In-process OCI Distribution registry for tests
+
+// Package registrytest provides an in-memory OCI Distribution v2 registry
+// served over httptest, for exercising registry clients without a network.
+package registrytest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Registry is an in-memory registry behind an httptest.Server
+type Registry struct {
+	server *httptest.Server
+
+	mu       sync.Mutex
+	repos    map[string]*repository
+	blobs    map[digest.Digest][]byte
+	uploads  map[string]string // upload id -> repository
+	tokens   map[string]bool
+	requests []string
+	failures []failure
+
+	username     string
+	password     string
+	tokenAuth    bool
+	tagDeletion  bool
+	mountEnabled bool
+	pageSize     int
+}
+
+// repository holds the manifests, tags and linked blobs of one repository
+type repository struct {
+	manifests map[digest.Digest]manifest
+	tags      map[string]digest.Digest
+	blobs     map[digest.Digest]bool
+}
+
+// failure is an injected error response
+type failure struct {
+	status int
+	header http.Header
+}
+
+type manifest struct {
+	mediaType string
+	payload   []byte
+}
+
+// Option configures a Registry
+type Option func(*Registry)
+
+// WithBasicAuth requires HTTP basic authentication
+func WithBasicAuth(username, password string) Option {
+	return func(r *Registry) {
+		r.username = username
+		r.password = password
+	}
+}
+
+// WithTokenAuth requires bearer tokens issued by the registry's /token
+// endpoint, which itself checks basic credentials
+func WithTokenAuth(username, password string) Option {
+	return func(r *Registry) {
+		r.username = username
+		r.password = password
+		r.tokenAuth = true
+	}
+}
+
+// WithoutTagDeletion makes DELETE by tag fail like pre-v1.1 registries
+func WithoutTagDeletion() Option {
+	return func(r *Registry) {
+		r.tagDeletion = false
+	}
+}
+
+// WithoutMount makes cross-repository mounts fall back to uploads
+func WithoutMount() Option {
+	return func(r *Registry) {
+		r.mountEnabled = false
+	}
+}
+
+// WithPageSize caps tag list pages, forcing clients to follow Link headers
+func WithPageSize(n int) Option {
+	return func(r *Registry) {
+		r.pageSize = n
+	}
+}
+
+// New starts a registry; callers must Close it
+func New(opts ...Option) *Registry {
+	r := &Registry{
+		repos:        make(map[string]*repository),
+		blobs:        make(map[digest.Digest][]byte),
+		uploads:      make(map[string]string),
+		tokens:       make(map[string]bool),
+		tagDeletion:  true,
+		mountEnabled: true,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	r.server = httptest.NewServer(http.HandlerFunc(r.serveHTTP))
+	return r
+}
+
+// URL returns the base URL of the registry
+func (r *Registry) URL() string {
+	return r.server.URL
+}
+
+// Host returns the host:port of the registry
+func (r *Registry) Host() string {
+	return strings.TrimPrefix(r.server.URL, "http://")
+}
+
+// Close shuts the registry down
+func (r *Registry) Close() {
+	r.server.Close()
+}
+
+// Requests returns "METHOD path" for every request served so far
+func (r *Registry) Requests() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]string(nil), r.requests...)
+}
+
+// PutBlob stores a blob in a repository and returns its descriptor
+func (r *Registry) PutBlob(repo, mediaType string, data []byte) ocispec.Descriptor {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	dgst := digest.FromBytes(data)
+	r.blobs[dgst] = append([]byte(nil), data...)
+	r.repo(repo).blobs[dgst] = true
+
+	return ocispec.Descriptor{MediaType: mediaType, Digest: dgst, Size: int64(len(data))}
+}
+
+// PutManifest stores a manifest under a tag (or only by digest when tag
+// is empty) and returns its descriptor
+func (r *Registry) PutManifest(repo, tag, mediaType string, payload []byte) ocispec.Descriptor {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	dgst := digest.FromBytes(payload)
+	rp := r.repo(repo)
+	rp.manifests[dgst] = manifest{mediaType: mediaType, payload: append([]byte(nil), payload...)}
+	if tag != "" {
+		rp.tags[tag] = dgst
+	}
+
+	return ocispec.Descriptor{MediaType: mediaType, Digest: dgst, Size: int64(len(payload))}
+}
+
+// PushImage stores a single-platform image built from the given layer
+// contents and config, tagging it repo:tag
+func (r *Registry) PushImage(repo, tag string, config []byte, layers ...[]byte) ocispec.Descriptor {
+	if config == nil {
+		config = []byte(`{"architecture":"amd64","os":"linux","rootfs":{"type":"layers","diff_ids":[]}}`)
+	}
+
+	m := ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    r.PutBlob(repo, ocispec.MediaTypeImageConfig, config),
+	}
+	m.SchemaVersion = 2
+	for _, layer := range layers {
+		m.Layers = append(m.Layers, r.PutBlob(repo, ocispec.MediaTypeImageLayerGzip, layer))
+	}
+
+	payload, err := json.Marshal(m)
+	if err != nil {
+		panic(err)
+	}
+	return r.PutManifest(repo, tag, ocispec.MediaTypeImageManifest, payload)
+}
+
+// Tags returns the sorted tags of a repository
+func (r *Registry) Tags(repo string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rp, ok := r.repos[repo]
+	if !ok {
+		return nil
+	}
+	return sortedTags(rp)
+}
+
+// Manifest returns a manifest by tag or digest
+func (r *Registry) Manifest(repo, reference string) ([]byte, string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rp, ok := r.repos[repo]
+	if !ok {
+		return nil, "", false
+	}
+	m, _, ok := rp.lookup(reference)
+	return m.payload, m.mediaType, ok
+}
+
+// HasBlob reports whether a blob is linked into a repository
+func (r *Registry) HasBlob(repo string, dgst digest.Digest) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rp, ok := r.repos[repo]
+	return ok && rp.blobs[dgst]
+}
+
+// Blob returns the content of a blob regardless of repository
+func (r *Registry) Blob(dgst digest.Digest) ([]byte, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data, ok := r.blobs[dgst]
+	return data, ok
+}
+
+// FailRequests answers the next n registry API requests with status and
+// the given headers, e.g. a 503 with Retry-After
+func (r *Registry) FailRequests(n, status int, header http.Header) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := 0; i < n; i++ {
+		r.failures = append(r.failures, failure{status: status, header: header})
+	}
+}
+
+func (r *Registry) nextFailure() (failure, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.failures) == 0 {
+		return failure{}, false
+	}
+	f := r.failures[0]
+	r.failures = r.failures[1:]
+	return f, true
+}
+
+// repo returns a repository, creating it on demand; r.mu must be held
+func (r *Registry) repo(name string) *repository {
+	rp, ok := r.repos[name]
+	if !ok {
+		rp = &repository{
+			manifests: make(map[digest.Digest]manifest),
+			tags:      make(map[string]digest.Digest),
+			blobs:     make(map[digest.Digest]bool),
+		}
+		r.repos[name] = rp
+	}
+	return rp
+}
+
+// lookup resolves a tag or digest to a manifest
+func (rp *repository) lookup(reference string) (manifest, digest.Digest, bool) {
+	dgst, err := digest.Parse(reference)
+	if err != nil {
+		var ok bool
+		if dgst, ok = rp.tags[reference]; !ok {
+			return manifest{}, "", false
+		}
+	}
+	m, ok := rp.manifests[dgst]
+	return m, dgst, ok
+}
+
+func sortedTags(rp *repository) []string {
+	tags := make([]string, 0, len(rp.tags))
+	for tag := range rp.tags {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+func (r *Registry) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	r.requests = append(r.requests, req.Method+" "+req.URL.Path)
+	r.mu.Unlock()
+
+	if req.URL.Path == "/token" {
+		r.serveToken(w, req)
+		return
+	}
+
+	if strings.HasPrefix(req.URL.Path, "/api/v2.0/projects/") {
+		r.serveArtifacts(w, req)
+		return
+	}
+
+	if !strings.HasPrefix(req.URL.Path, "/v2/") {
+		http.NotFound(w, req)
+		return
+	}
+
+	if f, ok := r.nextFailure(); ok {
+		for key, values := range f.header {
+			w.Header()[key] = values
+		}
+		writeError(w, f.status, "UNAVAILABLE", "injected failure")
+		return
+	}
+
+	if req.URL.Path == "/v2/_catalog" {
+		if r.authorized(w, req, "") {
+			r.serveCatalog(w, req)
+		}
+		return
+	}
+
+	name, kind, ref := splitPath(strings.TrimPrefix(req.URL.Path, "/v2/"))
+	if !r.authorized(w, req, name) {
+		return
+	}
+
+	switch kind {
+	case "":
+		if name != "" {
+			writeError(w, http.StatusNotFound, "NAME_UNKNOWN", "unknown route")
+			return
+		}
+		w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+		w.WriteHeader(http.StatusOK)
+	case "tags":
+		r.serveTags(w, req, name)
+	case "manifests":
+		r.serveManifest(w, req, name, ref)
+	case "blobs":
+		r.serveBlob(w, req, name, ref)
+	case "uploads":
+		r.serveUpload(w, req, name, ref)
+	}
+}
+
+// splitPath splits "<name>/manifests/<ref>" style paths
+func splitPath(path string) (name, kind, ref string) {
+	routes := []struct{ marker, kind string }{
+		{"/blobs/uploads/", "uploads"},
+		{"/manifests/", "manifests"},
+		{"/blobs/", "blobs"},
+		{"/tags/list", "tags"},
+	}
+	for _, route := range routes {
+		if i := strings.LastIndex(path, route.marker); i >= 0 {
+			return path[:i], route.kind, path[i+len(route.marker):]
+		}
+	}
+	return strings.TrimSuffix(path, "/"), "", ""
+}
+
+func (r *Registry) authorized(w http.ResponseWriter, req *http.Request, name string) bool {
+	if r.username == "" {
+		return true
+	}
+
+	if !r.tokenAuth {
+		user, pass, ok := req.BasicAuth()
+		if ok && user == r.username && pass == r.password {
+			return true
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="registrytest"`)
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "authentication required")
+		return false
+	}
+
+	if token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer "); ok {
+		r.mu.Lock()
+		valid := r.tokens[token]
+		r.mu.Unlock()
+		if valid {
+			return true
+		}
+	}
+
+	challenge := fmt.Sprintf(`Bearer realm="%s/token",service="registrytest"`, r.server.URL)
+	if name != "" {
+		challenge += fmt.Sprintf(`,scope="repository:%s:pull"`, name)
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "authentication required")
+	return false
+}
+
+func (r *Registry) serveToken(w http.ResponseWriter, req *http.Request) {
+	user, pass, ok := req.BasicAuth()
+	if !ok || user != r.username || pass != r.password {
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "bad credentials")
+		return
+	}
+
+	token := randomID()
+	r.mu.Lock()
+	r.tokens[token] = true
+	r.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"token": token, "expires_in": 300})
+}
+
+func (r *Registry) serveCatalog(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	repos := make([]string, 0, len(r.repos))
+	for name, rp := range r.repos {
+		if len(rp.manifests) > 0 {
+			repos = append(repos, name)
+		}
+	}
+	r.mu.Unlock()
+	sort.Strings(repos)
+
+	repos, next := r.paginate(req, repos)
+	if next != "" {
+		w.Header().Set("Link", fmt.Sprintf(`</v2/_catalog?%s>; rel="next"`, next))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"repositories": repos})
+}
+
+func (r *Registry) serveTags(w http.ResponseWriter, req *http.Request, name string) {
+	r.mu.Lock()
+	rp, ok := r.repos[name]
+	var tags []string
+	if ok {
+		tags = sortedTags(rp)
+	}
+	r.mu.Unlock()
+
+	if !ok {
+		writeError(w, http.StatusNotFound, "NAME_UNKNOWN", "repository not found")
+		return
+	}
+
+	tags, next := r.paginate(req, tags)
+	if next != "" {
+		w.Header().Set("Link", fmt.Sprintf(`</v2/%s/tags/list?%s>; rel="next"`, name, next))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"name": name, "tags": tags})
+}
+
+// serveArtifacts answers Harbor's artifact listing, supporting only the
+// q=tags=nil filter for untagged manifests. Index children are part of
+// their index and not listed, as in Harbor
+func (r *Registry) serveArtifacts(w http.ResponseWriter, req *http.Request) {
+	if r.username != "" {
+		user, pass, ok := req.BasicAuth()
+		if !ok || user != r.username || pass != r.password {
+			writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "authentication required")
+			return
+		}
+	}
+
+	parts := strings.Split(strings.TrimPrefix(req.URL.EscapedPath(), "/api/v2.0/projects/"), "/")
+	if len(parts) != 4 || parts[1] != "repositories" || parts[3] != "artifacts" {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "unknown route")
+		return
+	}
+	project, _ := url.PathUnescape(parts[0])
+	name, _ := url.PathUnescape(parts[2])
+	name, _ = url.PathUnescape(name)
+
+	r.mu.Lock()
+	rp, ok := r.repos[project+"/"+name]
+	var untagged []string
+	if ok {
+		referenced := make(map[digest.Digest]bool)
+		for _, dgst := range rp.tags {
+			referenced[dgst] = true
+		}
+		for _, m := range rp.manifests {
+			var index ocispec.Index
+			if json.Unmarshal(m.payload, &index) == nil {
+				for _, child := range index.Manifests {
+					referenced[child.Digest] = true
+				}
+			}
+		}
+		for dgst := range rp.manifests {
+			if !referenced[dgst] {
+				untagged = append(untagged, dgst.String())
+			}
+		}
+	}
+	r.mu.Unlock()
+
+	if !ok {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "repository not found")
+		return
+	}
+	if req.URL.Query().Get("q") != "tags=nil" {
+		writeError(w, http.StatusBadRequest, "BAD_REQUEST", "only q=tags=nil is supported")
+		return
+	}
+	sort.Strings(untagged)
+
+	artifacts := make([]map[string]any, 0, len(untagged))
+	for _, dgst := range untagged {
+		artifacts = append(artifacts, map[string]any{"digest": dgst, "tags": nil})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(artifacts)
+}
+
+// paginate applies the n and last query parameters to a sorted list and
+// returns the page with the query of the next one, if any
+func (r *Registry) paginate(req *http.Request, items []string) ([]string, string) {
+	if last := req.URL.Query().Get("last"); last != "" {
+		i := sort.SearchStrings(items, last)
+		if i < len(items) && items[i] == last {
+			i++
+		}
+		items = items[i:]
+	}
+	n, err := strconv.Atoi(req.URL.Query().Get("n"))
+	if err != nil || n <= 0 || (r.pageSize > 0 && n > r.pageSize) {
+		n = r.pageSize
+	}
+	if n > 0 && n < len(items) {
+		items = items[:n]
+		next := url.Values{"n": {strconv.Itoa(n)}, "last": {items[len(items)-1]}}
+		return items, next.Encode()
+	}
+	return items, ""
+}
+
+func (r *Registry) serveManifest(w http.ResponseWriter, req *http.Request, name, ref string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		rp, ok := r.repos[name]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NAME_UNKNOWN", "repository not found")
+			return
+		}
+		m, dgst, ok := rp.lookup(ref)
+		if !ok {
+			writeError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest unknown")
+			return
+		}
+		w.Header().Set("Content-Type", m.mediaType)
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		w.Header().Set("Content-Length", strconv.Itoa(len(m.payload)))
+		w.WriteHeader(http.StatusOK)
+		if req.Method == http.MethodGet {
+			w.Write(m.payload)
+		}
+
+	case http.MethodPut:
+		payload, err := io.ReadAll(req.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "MANIFEST_INVALID", err.Error())
+			return
+		}
+		var refs struct {
+			Config    *ocispec.Descriptor  `json:"config"`
+			Layers    []ocispec.Descriptor `json:"layers"`
+			Manifests []ocispec.Descriptor `json:"manifests"`
+		}
+		if err := json.Unmarshal(payload, &refs); err != nil {
+			writeError(w, http.StatusBadRequest, "MANIFEST_INVALID", err.Error())
+			return
+		}
+
+		rp := r.repo(name)
+		blobs := refs.Layers
+		if refs.Config != nil {
+			blobs = append(blobs, *refs.Config)
+		}
+		for _, b := range blobs {
+			if !rp.blobs[b.Digest] {
+				writeError(w, http.StatusBadRequest, "MANIFEST_BLOB_UNKNOWN", b.Digest.String())
+				return
+			}
+		}
+		for _, child := range refs.Manifests {
+			if _, ok := rp.manifests[child.Digest]; !ok {
+				writeError(w, http.StatusBadRequest, "MANIFEST_UNKNOWN", child.Digest.String())
+				return
+			}
+		}
+
+		dgst := digest.FromBytes(payload)
+		rp.manifests[dgst] = manifest{mediaType: req.Header.Get("Content-Type"), payload: payload}
+		if _, err := digest.Parse(ref); err != nil {
+			rp.tags[ref] = dgst
+		}
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/manifests/%s", name, dgst))
+		w.WriteHeader(http.StatusCreated)
+
+	case http.MethodDelete:
+		rp, ok := r.repos[name]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NAME_UNKNOWN", "repository not found")
+			return
+		}
+		dgst, err := digest.Parse(ref)
+		if err != nil {
+			if !r.tagDeletion {
+				writeError(w, http.StatusBadRequest, "DIGEST_INVALID", "deletion by tag unsupported")
+				return
+			}
+			if _, ok := rp.tags[ref]; !ok {
+				writeError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "tag unknown")
+				return
+			}
+			delete(rp.tags, ref)
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		if _, ok := rp.manifests[dgst]; !ok {
+			writeError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest unknown")
+			return
+		}
+		delete(rp.manifests, dgst)
+		for tag, d := range rp.tags {
+			if d == dgst {
+				delete(rp.tags, tag)
+			}
+		}
+		w.WriteHeader(http.StatusAccepted)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", req.Method)
+	}
+}
+
+func (r *Registry) serveBlob(w http.ResponseWriter, req *http.Request, name, ref string) {
+	dgst, err := digest.Parse(ref)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "DIGEST_INVALID", err.Error())
+		return
+	}
+
+	r.mu.Lock()
+	rp, ok := r.repos[name]
+	linked := ok && rp.blobs[dgst]
+	data := r.blobs[dgst]
+	r.mu.Unlock()
+
+	if !linked {
+		writeError(w, http.StatusNotFound, "BLOB_UNKNOWN", "blob unknown")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Docker-Content-Digest", dgst.String())
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(http.StatusOK)
+	if req.Method == http.MethodGet {
+		w.Write(data)
+	}
+}
+
+func (r *Registry) serveUpload(w http.ResponseWriter, req *http.Request, name, id string) {
+	switch req.Method {
+	case http.MethodPost:
+		query := req.URL.Query()
+		if mount, from := query.Get("mount"), query.Get("from"); mount != "" && from != "" && r.mountEnabled {
+			r.mu.Lock()
+			src, ok := r.repos[from]
+			dgst := digest.Digest(mount)
+			if ok && src.blobs[dgst] {
+				r.repo(name).blobs[dgst] = true
+				r.mu.Unlock()
+				w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", name, dgst))
+				w.Header().Set("Docker-Content-Digest", dgst.String())
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+			r.mu.Unlock()
+		}
+
+		id := randomID()
+		r.mu.Lock()
+		r.uploads[id] = name
+		r.mu.Unlock()
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s", name, id))
+		w.Header().Set("Docker-Upload-UUID", id)
+		w.WriteHeader(http.StatusAccepted)
+
+	case http.MethodPut:
+		r.mu.Lock()
+		repo, ok := r.uploads[id]
+		r.mu.Unlock()
+		if !ok || repo != name {
+			writeError(w, http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN", "upload unknown")
+			return
+		}
+
+		expected, err := digest.Parse(req.URL.Query().Get("digest"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "DIGEST_INVALID", err.Error())
+			return
+		}
+		data, err := io.ReadAll(req.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "BLOB_UPLOAD_INVALID", err.Error())
+			return
+		}
+		if digest.FromBytes(data) != expected {
+			writeError(w, http.StatusBadRequest, "DIGEST_INVALID", "digest mismatch")
+			return
+		}
+
+		r.mu.Lock()
+		delete(r.uploads, id)
+		r.blobs[expected] = data
+		r.repo(name).blobs[expected] = true
+		r.mu.Unlock()
+
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", name, expected))
+		w.Header().Set("Docker-Content-Digest", expected.String())
+		w.WriteHeader(http.StatusCreated)
+
+	case http.MethodDelete:
+		r.mu.Lock()
+		delete(r.uploads, id)
+		r.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", req.Method)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"errors": []map[string]string{{"code": code, "message": message}},
+	})
+}
+
+func randomID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
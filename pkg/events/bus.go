@@ -0,0 +1,309 @@
+// Copyright 2021 vjranagit
+//
+// In-process publish/subscribe event bus
+
+package events
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultBuffer is the queue length of asynchronous subscribers
+const DefaultBuffer = 64
+
+// Overflow decides what happens when an asynchronous subscriber's buffer
+// is full
+type Overflow int
+
+const (
+	// DropNewest discards the event being published
+	DropNewest Overflow = iota
+	// DropOldest discards the oldest buffered event to make room
+	DropOldest
+	// Block makes the publisher wait for room, or until its context is done
+	Block
+)
+
+// Handler receives events
+type Handler func(ctx context.Context, e Event)
+
+// Bus delivers published events to matching subscribers. Synchronous
+// subscribers run in the publisher's goroutine; asynchronous ones get a
+// bounded queue and their own goroutine. A nil *Bus discards events, so
+// components can publish unconditionally
+type Bus struct {
+	subs   []*Subscription
+	closed bool
+	mu     sync.RWMutex
+	logger *slog.Logger
+}
+
+// NewBus creates an event bus
+func NewBus() *Bus {
+	return &Bus{
+		logger: slog.Default().With("component", "events"),
+	}
+}
+
+// Subscription is a registered handler
+type Subscription struct {
+	bus      *Bus
+	handler  Handler
+	topics   []Topic
+	buffer   int
+	overflow Overflow
+	sync     bool
+
+	queue   chan delivery
+	quit    chan struct{}
+	done    chan struct{}
+	stop    sync.Once
+	drain   atomic.Bool
+	dropped atomic.Uint64
+}
+
+// delivery is a queued event with the publisher's context values
+type delivery struct {
+	ctx   context.Context
+	event Event
+}
+
+// SubscribeOption configures a Subscription
+type SubscribeOption func(*Subscription)
+
+// WithTopics limits a subscription to the given topics. A topic ending in
+// ".*" matches every topic with that prefix
+func WithTopics(topics ...Topic) SubscribeOption {
+	return func(s *Subscription) {
+		s.topics = append(s.topics, topics...)
+	}
+}
+
+// WithBuffer sets the queue length of an asynchronous subscription
+func WithBuffer(n int) SubscribeOption {
+	return func(s *Subscription) {
+		s.buffer = n
+	}
+}
+
+// WithOverflow sets what happens when the queue is full
+func WithOverflow(o Overflow) SubscribeOption {
+	return func(s *Subscription) {
+		s.overflow = o
+	}
+}
+
+// Synchronous delivers events in the publisher's goroutine, before
+// Publish returns
+func Synchronous() SubscribeOption {
+	return func(s *Subscription) {
+		s.sync = true
+	}
+}
+
+// Subscribe registers handler for matching events
+func (b *Bus) Subscribe(handler Handler, opts ...SubscribeOption) *Subscription {
+	s := &Subscription{
+		bus:      b,
+		handler:  handler,
+		buffer:   DefaultBuffer,
+		overflow: DropNewest,
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if s.sync {
+		close(s.done)
+	} else {
+		if s.buffer < 1 {
+			s.buffer = 1
+		}
+		s.queue = make(chan delivery, s.buffer)
+		go s.run()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		s.stop.Do(func() { close(s.quit) })
+		return s
+	}
+	b.subs = append(b.subs, s)
+	return s
+}
+
+// SubscribeTo subscribes handler to events carrying a T payload, where T
+// is one of the payload struct types
+func SubscribeTo[T Payload](b *Bus, handler func(ctx context.Context, payload T), opts ...SubscribeOption) *Subscription {
+	var zero T
+	opts = append(opts, WithTopics(zero.Topic()))
+	return b.Subscribe(func(ctx context.Context, e Event) {
+		if payload, ok := e.Payload.(T); ok {
+			handler(ctx, payload)
+		}
+	}, opts...)
+}
+
+// Publish delivers payload to every matching subscriber
+func (b *Bus) Publish(ctx context.Context, payload Payload) {
+	if b == nil || payload == nil {
+		return
+	}
+	e := Event{Topic: payload.Topic(), Time: time.Now(), Payload: payload}
+
+	b.mu.RLock()
+	if b.closed {
+		b.mu.RUnlock()
+		return
+	}
+	var subs []*Subscription
+	for _, s := range b.subs {
+		if s.matches(e.Topic) {
+			subs = append(subs, s)
+		}
+	}
+	b.mu.RUnlock()
+
+	for _, s := range subs {
+		s.deliver(ctx, e)
+	}
+}
+
+// Close stops every subscription after asynchronous subscribers have
+// handled the events already queued. It must not be called from a handler
+func (b *Bus) Close() {
+	b.mu.Lock()
+	subs := b.subs
+	b.subs = nil
+	b.closed = true
+	b.mu.Unlock()
+
+	for _, s := range subs {
+		s.drain.Store(true)
+		s.stop.Do(func() { close(s.quit) })
+	}
+	for _, s := range subs {
+		<-s.done
+	}
+}
+
+// Unsubscribe stops delivery to the subscription; events still queued are
+// discarded
+func (s *Subscription) Unsubscribe() {
+	b := s.bus
+	b.mu.Lock()
+	for i, sub := range b.subs {
+		if sub == s {
+			b.subs = append(b.subs[:i:i], b.subs[i+1:]...)
+			break
+		}
+	}
+	b.mu.Unlock()
+
+	s.stop.Do(func() { close(s.quit) })
+}
+
+// Dropped returns how many events overflowed the subscription's queue
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// matches reports whether the subscription wants topic
+func (s *Subscription) matches(topic Topic) bool {
+	if len(s.topics) == 0 {
+		return true
+	}
+	for _, t := range s.topics {
+		if t == topic || t == "*" {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(string(t), "*"); ok && strings.HasPrefix(string(topic), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// deliver runs or queues one event according to the overflow policy
+func (s *Subscription) deliver(ctx context.Context, e Event) {
+	if s.sync {
+		s.invoke(ctx, e)
+		return
+	}
+
+	d := delivery{ctx: context.WithoutCancel(ctx), event: e}
+	switch s.overflow {
+	case Block:
+		select {
+		case s.queue <- d:
+		case <-s.quit:
+		case <-ctx.Done():
+			s.dropped.Add(1)
+		}
+	case DropOldest:
+		for {
+			select {
+			case s.queue <- d:
+				return
+			case <-s.quit:
+				return
+			default:
+			}
+			select {
+			case <-s.queue:
+				s.dropped.Add(1)
+			default:
+			}
+		}
+	default:
+		select {
+		case s.queue <- d:
+		case <-s.quit:
+		default:
+			s.dropped.Add(1)
+		}
+	}
+}
+
+// run handles queued events until the subscription stops
+func (s *Subscription) run() {
+	defer close(s.done)
+
+	for {
+		select {
+		case d := <-s.queue:
+			s.invoke(d.ctx, d.event)
+		case <-s.quit:
+			if !s.drain.Load() {
+				return
+			}
+			for {
+				select {
+				case d := <-s.queue:
+					s.invoke(d.ctx, d.event)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// invoke calls the handler, containing panics
+func (s *Subscription) invoke(ctx context.Context, e Event) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.bus.logger.Error("event handler panicked", "topic", e.Topic, "panic", r)
+		}
+	}()
+	s.handler(ctx, e)
+}
@@ -0,0 +1,274 @@
+// Copyright 2021 vjranagit
+//
+// Event bus tests
+
+package events
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// collector records the events a handler receives
+type collector struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (c *collector) handle(ctx context.Context, e Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.events = append(c.events, e)
+}
+
+func (c *collector) topics() []Topic {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	topics := make([]Topic, len(c.events))
+	for i, e := range c.events {
+		topics[i] = e.Topic
+	}
+	return topics
+}
+
+func TestBus_TopicFilter(t *testing.T) {
+	tests := []struct {
+		name   string
+		topics []Topic
+		want   int
+	}{
+		{"all", nil, 4},
+		{"exact", []Topic{TopicBatchCompleted}, 1},
+		{"prefix", []Topic{"health.*"}, 2},
+		{"several", []Topic{TopicBatchStarted, TopicCircuitChanged}, 2},
+		{"wildcard", []Topic{"*"}, 4},
+		{"none matching", []Topic{TopicConversionCompleted}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bus := NewBus()
+			c := &collector{}
+			bus.Subscribe(c.handle, Synchronous(), WithTopics(tt.topics...))
+
+			ctx := context.Background()
+			bus.Publish(ctx, BatchStarted{ID: "batch-1"})
+			bus.Publish(ctx, BatchCompleted{ID: "batch-1"})
+			bus.Publish(ctx, HealthChanged{Endpoint: "https://a", From: "unknown", To: "healthy"})
+			bus.Publish(ctx, CircuitChanged{Endpoint: "https://a", From: "closed", To: "open"})
+
+			if got := len(c.topics()); got != tt.want {
+				t.Errorf("expected %d events, got %d: %v", tt.want, got, c.topics())
+			}
+		})
+	}
+}
+
+func TestBus_SynchronousOrder(t *testing.T) {
+	bus := NewBus()
+
+	var order []string
+	bus.Subscribe(func(ctx context.Context, e Event) { order = append(order, "first") }, Synchronous())
+	bus.Subscribe(func(ctx context.Context, e Event) { order = append(order, "second") }, Synchronous())
+
+	bus.Publish(context.Background(), PolicyChanged{Name: "p"})
+	if len(order) != 2 || order[0] != "first" || order[1] != "second" {
+		t.Errorf("expected delivery in subscription order before Publish returns, got %v", order)
+	}
+}
+
+func TestBus_Typed(t *testing.T) {
+	bus := NewBus()
+
+	var got []ProtectionViolation
+	SubscribeTo(bus, func(ctx context.Context, v ProtectionViolation) {
+		got = append(got, v)
+	}, Synchronous())
+
+	bus.Publish(context.Background(), PolicyChanged{Name: "p"})
+	bus.Publish(context.Background(), ProtectionViolation{Repository: "library/app", Tag: "v1", Action: "delete", Policy: "p"})
+
+	if len(got) != 1 || got[0].Tag != "v1" || got[0].Action != "delete" {
+		t.Errorf("expected one typed violation, got %+v", got)
+	}
+}
+
+func TestBus_Async(t *testing.T) {
+	bus := NewBus()
+
+	type ctxKey struct{}
+	received := make(chan Event, 1)
+	var value interface{}
+	bus.Subscribe(func(ctx context.Context, e Event) {
+		value = ctx.Value(ctxKey{})
+		received <- e
+	})
+
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), ctxKey{}, "request-1"))
+	bus.Publish(ctx, BatchStarted{ID: "batch-1", Targets: 3})
+	cancel()
+
+	select {
+	case e := <-received:
+		if e.Payload.(BatchStarted).Targets != 3 || e.Time.IsZero() {
+			t.Errorf("unexpected event %+v", e)
+		}
+		if value != "request-1" {
+			t.Errorf("expected publisher context values, got %v", value)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event not delivered")
+	}
+}
+
+func TestBus_Overflow(t *testing.T) {
+	tests := []struct {
+		name     string
+		overflow Overflow
+		want     []string
+	}{
+		{"drop newest", DropNewest, []string{"0", "1"}},
+		{"drop oldest", DropOldest, []string{"2", "3"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bus := NewBus()
+
+			// The handler holds the first event until released, so the
+			// remaining ones pile up in a queue of two
+			release := make(chan struct{})
+			started := make(chan struct{})
+			var mu sync.Mutex
+			var got []string
+			sub := bus.Subscribe(func(ctx context.Context, e Event) {
+				id := e.Payload.(BatchStarted).ID
+				if id == "blocker" {
+					close(started)
+					<-release
+					return
+				}
+				mu.Lock()
+				got = append(got, id)
+				mu.Unlock()
+			}, WithBuffer(2), WithOverflow(tt.overflow))
+
+			ctx := context.Background()
+			bus.Publish(ctx, BatchStarted{ID: "blocker"})
+			<-started
+			for _, id := range []string{"0", "1", "2", "3"} {
+				bus.Publish(ctx, BatchStarted{ID: id})
+			}
+			close(release)
+			bus.Close()
+
+			if sub.Dropped() != 2 {
+				t.Errorf("expected 2 dropped events, got %d", sub.Dropped())
+			}
+			if len(got) != 2 || got[0] != tt.want[0] || got[1] != tt.want[1] {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestBus_Block(t *testing.T) {
+	bus := NewBus()
+	defer bus.Close()
+
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	sub := bus.Subscribe(func(ctx context.Context, e Event) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release
+	}, WithBuffer(1), WithOverflow(Block))
+
+	ctx := context.Background()
+	bus.Publish(ctx, BatchStarted{ID: "handled"})
+	<-started
+	bus.Publish(ctx, BatchStarted{ID: "queued"})
+
+	// A full queue blocks until the publisher gives up
+	timeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	bus.Publish(timeout, BatchStarted{ID: "blocked"})
+	if time.Since(start) < 40*time.Millisecond {
+		t.Error("expected Publish to block while the queue is full")
+	}
+	if sub.Dropped() != 1 {
+		t.Errorf("expected the timed out event to count as dropped, got %d", sub.Dropped())
+	}
+
+	// Room frees up once the handler proceeds
+	close(release)
+	done := make(chan struct{})
+	go func() {
+		bus.Publish(ctx, BatchStarted{ID: "later"})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Publish stayed blocked after the handler drained the queue")
+	}
+}
+
+func TestBus_CloseDrains(t *testing.T) {
+	bus := NewBus()
+	c := &collector{}
+	bus.Subscribe(c.handle, WithBuffer(10))
+
+	for i := 0; i < 5; i++ {
+		bus.Publish(context.Background(), BatchCompleted{ID: "batch"})
+	}
+	bus.Close()
+
+	if got := len(c.topics()); got != 5 {
+		t.Errorf("expected queued events to be handled before Close returns, got %d", got)
+	}
+
+	// Publishing after Close is a no-op
+	bus.Publish(context.Background(), BatchCompleted{ID: "late"})
+	if got := len(c.topics()); got != 5 {
+		t.Errorf("expected no delivery after Close, got %d events", got)
+	}
+}
+
+func TestBus_Unsubscribe(t *testing.T) {
+	bus := NewBus()
+	c := &collector{}
+	sub := bus.Subscribe(c.handle, Synchronous())
+
+	bus.Publish(context.Background(), PolicyChanged{Name: "a"})
+	sub.Unsubscribe()
+	sub.Unsubscribe()
+	bus.Publish(context.Background(), PolicyChanged{Name: "b"})
+
+	if got := len(c.topics()); got != 1 {
+		t.Errorf("expected 1 event before unsubscribing, got %d", got)
+	}
+}
+
+func TestBus_HandlerPanic(t *testing.T) {
+	bus := NewBus()
+	c := &collector{}
+	bus.Subscribe(func(ctx context.Context, e Event) { panic("boom") }, Synchronous())
+	bus.Subscribe(c.handle, Synchronous())
+
+	bus.Publish(context.Background(), PolicyChanged{Name: "p"})
+	if got := len(c.topics()); got != 1 {
+		t.Errorf("expected other subscribers to still receive the event, got %d", got)
+	}
+}
+
+func TestBus_Nil(t *testing.T) {
+	var bus *Bus
+	bus.Publish(context.Background(), PolicyChanged{Name: "p"})
+}
@@ -0,0 +1,138 @@
+// Copyright 2021 vjranagit
+//
+// Event types published by toolkit components
+
+package events
+
+import "time"
+
+// Topic names a kind of event. Topics are dot separated so subscribers can
+// filter on a prefix such as "health.*"
+type Topic string
+
+const (
+	TopicProtectionViolation  Topic = "protection.violation"
+	TopicPolicyChanged        Topic = "protection.policy"
+	TopicProtectionOverridden Topic = "protection.override"
+	TopicBatchStarted         Topic = "batch.started"
+	TopicBatchCompleted       Topic = "batch.completed"
+	TopicHealthChanged        Topic = "health.status"
+	TopicCircuitChanged       Topic = "health.circuit"
+	TopicHealthChecked        Topic = "health.check"
+	TopicConversionCompleted  Topic = "conversion.completed"
+)
+
+// Payload is the typed content of an event
+type Payload interface {
+	Topic() Topic
+}
+
+// Event is a published payload with its topic and publication time
+type Event struct {
+	Topic   Topic
+	Time    time.Time
+	Payload Payload
+}
+
+// ProtectionViolation is published when a policy blocks a tag change
+type ProtectionViolation struct {
+	Repository string
+	Tag        string
+	// Action is "modify" or "delete"
+	Action string
+	Policy string
+	Reason string
+}
+
+func (ProtectionViolation) Topic() Topic { return TopicProtectionViolation }
+
+// ProtectionOverridden is published when a forced batch operation acts on
+// a target protection would have blocked
+type ProtectionOverridden struct {
+	Operation  string
+	Repository string
+	Tag        string
+	// Action is "modify" or "delete"
+	Action string
+	Reason string
+}
+
+func (ProtectionOverridden) Topic() Topic { return TopicProtectionOverridden }
+
+// PolicyChanged is published when a protection policy is added or removed
+type PolicyChanged struct {
+	Name    string
+	Removed bool
+}
+
+func (PolicyChanged) Topic() Topic { return TopicPolicyChanged }
+
+// BatchStarted is published when a batch operation starts running
+type BatchStarted struct {
+	ID      string
+	Type    string
+	Targets int
+}
+
+func (BatchStarted) Topic() Topic { return TopicBatchStarted }
+
+// BatchCompleted is published when every target of a batch operation has
+// been processed
+type BatchCompleted struct {
+	ID        string
+	Type      string
+	Status    string
+	Succeeded int
+	Failed    int
+	// Skipped counts targets protection blocked
+	Skipped  int
+	Duration time.Duration
+}
+
+func (BatchCompleted) Topic() Topic { return TopicBatchCompleted }
+
+// HealthChanged is published when an endpoint's health status changes
+type HealthChanged struct {
+	Endpoint string
+	From     string
+	To       string
+	Error    string
+}
+
+func (HealthChanged) Topic() Topic { return TopicHealthChanged }
+
+// CircuitChanged is published when an endpoint's circuit breaker changes
+// state
+type CircuitChanged struct {
+	Endpoint string
+	From     string
+	To       string
+}
+
+func (CircuitChanged) Topic() Topic { return TopicCircuitChanged }
+
+// HealthChecked is published after every check of an endpoint, whether or
+// not its status changed
+type HealthChecked struct {
+	Endpoint    string
+	Status      string
+	Circuit     string
+	Latency     time.Duration
+	Consecutive int
+	Error       string
+}
+
+func (HealthChecked) Topic() Topic { return TopicHealthChecked }
+
+// ConversionCompleted is published when an image conversion finishes,
+// successfully or not
+type ConversionCompleted struct {
+	Source  string
+	Target  string
+	Driver  string
+	Digest  string
+	Error   string
+	Elapsed time.Duration
+}
+
+func (ConversionCompleted) Topic() Topic { return TopicConversionCompleted }
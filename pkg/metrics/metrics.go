@@ -0,0 +1,356 @@
+// Copyright 2021 vjranagit
+//
+// Prometheus metrics for registry, batch and acceleration components
+
+package metrics
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/vjranagit/harbor/pkg/accelerator/cache"
+	"github.com/vjranagit/harbor/pkg/accelerator/queue"
+	"github.com/vjranagit/harbor/pkg/events"
+	"github.com/vjranagit/harbor/pkg/registry"
+)
+
+// Namespace prefixes every metric name
+const Namespace = "harbor"
+
+// HealthSource reports the endpoints being monitored;
+// *registry.HealthMonitor implements it
+type HealthSource interface {
+	Snapshot() []registry.HealthCheck
+}
+
+// QueueSource reports conversion jobs per state; *queue.Queue implements it
+type QueueSource interface {
+	Stats() (map[queue.State]int, error)
+}
+
+// CacheSource reports layer cache counters; *cache.Cache implements it
+type CacheSource interface {
+	Stats() cache.Stats
+}
+
+// Metrics exports toolkit metrics in the Prometheus format. Durations and
+// outcomes are recorded from bus events as they happen; endpoint state,
+// queue depth and cache counters are read from their sources on every
+// scrape
+type Metrics struct {
+	registry *prometheus.Registry
+	health   HealthSource
+	queue    QueueSource
+	cache    CacheSource
+	logger   *slog.Logger
+
+	checkDuration      *prometheus.HistogramVec
+	batchDuration      *prometheus.HistogramVec
+	batchTargets       *prometheus.CounterVec
+	protectionBlocks   *prometheus.CounterVec
+	protectionOverride *prometheus.CounterVec
+	conversionDuration *prometheus.HistogramVec
+
+	circuitState        *prometheus.Desc
+	healthStatus        *prometheus.Desc
+	consecutiveFailures *prometheus.Desc
+	queueJobs           *prometheus.Desc
+	cacheHits           *prometheus.Desc
+	cacheMisses         *prometheus.Desc
+	cacheEvictions      *prometheus.Desc
+	cacheHitRatio       *prometheus.Desc
+	cacheEntries        *prometheus.Desc
+	cacheSize           *prometheus.Desc
+}
+
+// Option configures Metrics
+type Option func(*Metrics)
+
+// WithHealthSource exports the status, circuit state and consecutive
+// failures of monitored endpoints
+func WithHealthSource(src HealthSource) Option {
+	return func(m *Metrics) {
+		m.health = src
+	}
+}
+
+// WithQueueSource exports the conversion queue depth
+func WithQueueSource(src QueueSource) Option {
+	return func(m *Metrics) {
+		m.queue = src
+	}
+}
+
+// WithCacheSource exports layer cache counters and hit ratio
+func WithCacheSource(src CacheSource) Option {
+	return func(m *Metrics) {
+		m.cache = src
+	}
+}
+
+// WithProcessMetrics also exports Go runtime and process metrics
+func WithProcessMetrics() Option {
+	return func(m *Metrics) {
+		m.registry.MustRegister(
+			collectors.NewGoCollector(),
+			collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		)
+	}
+}
+
+// New creates the toolkit metrics
+func New(opts ...Option) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		logger:   slog.Default().With("component", "metrics"),
+
+		checkDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: Namespace,
+			Subsystem: "health",
+			Name:      "check_duration_seconds",
+			Help:      "Latency of endpoint health checks.",
+			Buckets:   []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+		}, []string{"endpoint", "result"}),
+		batchDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: Namespace,
+			Subsystem: "batch",
+			Name:      "duration_seconds",
+			Help:      "Duration of finished batch operations.",
+			Buckets:   prometheus.ExponentialBuckets(0.1, 4, 8),
+		}, []string{"type", "status"}),
+		batchTargets: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Subsystem: "batch",
+			Name:      "targets_total",
+			Help:      "Targets processed by finished batch operations.",
+		}, []string{"type", "outcome"}),
+		protectionBlocks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Subsystem: "protection",
+			Name:      "blocks_total",
+			Help:      "Tag changes blocked by protection policies.",
+		}, []string{"policy", "action"}),
+		protectionOverride: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Subsystem: "protection",
+			Name:      "overrides_total",
+			Help:      "Protected targets forced through by batch operations.",
+		}, []string{"action"}),
+		conversionDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: Namespace,
+			Subsystem: "conversion",
+			Name:      "duration_seconds",
+			Help:      "Duration of image conversions.",
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 10),
+		}, []string{"driver", "result"}),
+
+		circuitState: prometheus.NewDesc(
+			prometheus.BuildFQName(Namespace, "health", "circuit_state"),
+			"Circuit breaker state of monitored endpoints; 1 for the current state.",
+			[]string{"endpoint", "state"}, nil),
+		healthStatus: prometheus.NewDesc(
+			prometheus.BuildFQName(Namespace, "health", "status"),
+			"Health status of monitored endpoints; 1 for the current status.",
+			[]string{"endpoint", "status"}, nil),
+		consecutiveFailures: prometheus.NewDesc(
+			prometheus.BuildFQName(Namespace, "health", "consecutive_failures"),
+			"Failed checks of monitored endpoints since the last success.",
+			[]string{"endpoint"}, nil),
+		queueJobs: prometheus.NewDesc(
+			prometheus.BuildFQName(Namespace, "conversion", "queue_jobs"),
+			"Conversion jobs in the queue by state.",
+			[]string{"state"}, nil),
+		cacheHits: prometheus.NewDesc(
+			prometheus.BuildFQName(Namespace, "layer_cache", "hits_total"),
+			"Layer cache lookups that found a converted layer.",
+			nil, nil),
+		cacheMisses: prometheus.NewDesc(
+			prometheus.BuildFQName(Namespace, "layer_cache", "misses_total"),
+			"Layer cache lookups that found nothing usable.",
+			nil, nil),
+		cacheEvictions: prometheus.NewDesc(
+			prometheus.BuildFQName(Namespace, "layer_cache", "evictions_total"),
+			"Layers evicted to keep the cache within its size limit.",
+			nil, nil),
+		cacheHitRatio: prometheus.NewDesc(
+			prometheus.BuildFQName(Namespace, "layer_cache", "hit_ratio"),
+			"Layer cache hits over lookups.",
+			nil, nil),
+		cacheEntries: prometheus.NewDesc(
+			prometheus.BuildFQName(Namespace, "layer_cache", "entries"),
+			"Converted layers in the cache.",
+			nil, nil),
+		cacheSize: prometheus.NewDesc(
+			prometheus.BuildFQName(Namespace, "layer_cache", "size_bytes"),
+			"Total size of cached layers.",
+			nil, nil),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	m.registry.MustRegister(
+		m.checkDuration,
+		m.batchDuration,
+		m.batchTargets,
+		m.protectionBlocks,
+		m.protectionOverride,
+		m.conversionDuration,
+		m,
+	)
+	return m
+}
+
+// Subscribe records the events of bus. Handlers only update in-memory
+// metrics, so they run synchronously and no event is dropped
+func (m *Metrics) Subscribe(bus *events.Bus) *events.Subscription {
+	return bus.Subscribe(m.Handle, events.Synchronous(), events.WithTopics(
+		events.TopicHealthChecked,
+		events.TopicBatchCompleted,
+		events.TopicProtectionViolation,
+		events.TopicProtectionOverridden,
+		events.TopicConversionCompleted,
+	))
+}
+
+// Handle records one event; it is an events.Handler
+func (m *Metrics) Handle(ctx context.Context, e events.Event) {
+	switch p := e.Payload.(type) {
+	case events.HealthChecked:
+		m.checkDuration.WithLabelValues(p.Endpoint, result(p.Error)).Observe(p.Latency.Seconds())
+	case events.BatchCompleted:
+		m.batchDuration.WithLabelValues(p.Type, p.Status).Observe(p.Duration.Seconds())
+		m.batchTargets.WithLabelValues(p.Type, "succeeded").Add(float64(p.Succeeded))
+		m.batchTargets.WithLabelValues(p.Type, "failed").Add(float64(p.Failed))
+		m.batchTargets.WithLabelValues(p.Type, "skipped").Add(float64(p.Skipped))
+	case events.ProtectionViolation:
+		m.protectionBlocks.WithLabelValues(p.Policy, p.Action).Inc()
+	case events.ProtectionOverridden:
+		// Operation IDs are unbounded; they stay in logs and events
+		m.protectionOverride.WithLabelValues(p.Action).Inc()
+	case events.ConversionCompleted:
+		m.conversionDuration.WithLabelValues(p.Driver, result(p.Error)).Observe(p.Elapsed.Seconds())
+	}
+}
+
+// result labels an outcome by its error
+func result(err string) string {
+	if err != "" {
+		return "failure"
+	}
+	return "success"
+}
+
+// Handler serves the metrics in the Prometheus exposition format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{
+		ErrorLog: slog.NewLogLogger(m.logger.Handler(), slog.LevelError),
+	})
+}
+
+// Describe implements prometheus.Collector for the metrics read on scrape
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	ch <- m.circuitState
+	ch <- m.healthStatus
+	ch <- m.consecutiveFailures
+	ch <- m.queueJobs
+	ch <- m.cacheHits
+	ch <- m.cacheMisses
+	ch <- m.cacheEvictions
+	ch <- m.cacheHitRatio
+	ch <- m.cacheEntries
+	ch <- m.cacheSize
+}
+
+// circuitStates and healthStatuses are exported for every endpoint, so
+// queries need not handle missing series
+var (
+	circuitStates  = []registry.CircuitState{registry.CircuitClosed, registry.CircuitHalfOpen, registry.CircuitOpen}
+	healthStatuses = []registry.HealthStatus{
+		registry.HealthStatusHealthy,
+		registry.HealthStatusDegraded,
+		registry.HealthStatusUnhealthy,
+		registry.HealthStatusUnknown,
+	}
+	queueStates = []queue.State{queue.StatePending, queue.StateRunning, queue.StateSucceeded, queue.StateDead}
+)
+
+// Collect implements prometheus.Collector, reading the configured sources
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	if m.health != nil {
+		for _, check := range m.health.Snapshot() {
+			for _, state := range circuitStates {
+				ch <- prometheus.MustNewConstMetric(m.circuitState, prometheus.GaugeValue,
+					flag(check.Circuit == state), check.Endpoint, string(state))
+			}
+			for _, status := range healthStatuses {
+				ch <- prometheus.MustNewConstMetric(m.healthStatus, prometheus.GaugeValue,
+					flag(check.Status == status), check.Endpoint, string(status))
+			}
+			ch <- prometheus.MustNewConstMetric(m.consecutiveFailures, prometheus.GaugeValue,
+				float64(check.Consecutive), check.Endpoint)
+		}
+	}
+
+	if m.queue != nil {
+		stats, err := m.queue.Stats()
+		if err != nil {
+			m.logger.Error("failed to read queue stats", "error", err)
+			ch <- prometheus.NewInvalidMetric(m.queueJobs, err)
+		} else {
+			for _, state := range queueStates {
+				ch <- prometheus.MustNewConstMetric(m.queueJobs, prometheus.GaugeValue,
+					float64(stats[state]), string(state))
+			}
+		}
+	}
+
+	if m.cache != nil {
+		stats := m.cache.Stats()
+		ch <- prometheus.MustNewConstMetric(m.cacheHits, prometheus.CounterValue, float64(stats.Hits))
+		ch <- prometheus.MustNewConstMetric(m.cacheMisses, prometheus.CounterValue, float64(stats.Misses))
+		ch <- prometheus.MustNewConstMetric(m.cacheEvictions, prometheus.CounterValue, float64(stats.Evictions))
+		ch <- prometheus.MustNewConstMetric(m.cacheHitRatio, prometheus.GaugeValue, stats.HitRatio())
+		ch <- prometheus.MustNewConstMetric(m.cacheEntries, prometheus.GaugeValue, float64(stats.Entries))
+		ch <- prometheus.MustNewConstMetric(m.cacheSize, prometheus.GaugeValue, float64(stats.Size))
+	}
+}
+
+// flag is 1 for true and 0 for false
+func flag(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Serve serves the metrics at /metrics on l until ctx is done, for
+// commands that do not run the API server
+func (m *Metrics) Serve(ctx context.Context, l net.Listener) error {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", m.Handler())
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.Serve(l)
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return srv.Shutdown(shutdownCtx)
+	}
+}
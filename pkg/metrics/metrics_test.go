@@ -0,0 +1,157 @@
+// Copyright 2021 vjranagit
+//
+// Prometheus metrics tests
+
+package metrics
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vjranagit/harbor/pkg/accelerator/cache"
+	"github.com/vjranagit/harbor/pkg/accelerator/queue"
+	"github.com/vjranagit/harbor/pkg/events"
+	"github.com/vjranagit/harbor/pkg/registry"
+)
+
+type fakeHealth []registry.HealthCheck
+
+func (f fakeHealth) Snapshot() []registry.HealthCheck { return f }
+
+type fakeQueue struct {
+	stats map[queue.State]int
+	err   error
+}
+
+func (f fakeQueue) Stats() (map[queue.State]int, error) { return f.stats, f.err }
+
+type fakeCache cache.Stats
+
+func (f fakeCache) Stats() cache.Stats { return cache.Stats(f) }
+
+// scrape returns the exposition text served by m
+func scrape(t *testing.T, m *Metrics) string {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body)
+	}
+	return rec.Body.String()
+}
+
+// expectLines fails for each line missing from the exposition text
+func expectLines(t *testing.T, text string, lines ...string) {
+	t.Helper()
+
+	for _, line := range lines {
+		if !strings.Contains(text, line+"\n") {
+			t.Errorf("expected %q in:\n%s", line, text)
+		}
+	}
+}
+
+func TestMetrics_Events(t *testing.T) {
+	m := New()
+	bus := events.NewBus()
+	defer bus.Close()
+	m.Subscribe(bus)
+
+	ctx := context.Background()
+	endpoint := "https://registry.example.com"
+	bus.Publish(ctx, events.HealthChecked{Endpoint: endpoint, Status: "healthy", Circuit: "closed", Latency: 20 * time.Millisecond})
+	bus.Publish(ctx, events.HealthChecked{Endpoint: endpoint, Status: "degraded", Circuit: "closed", Latency: 3 * time.Second, Error: "timeout"})
+	bus.Publish(ctx, events.BatchCompleted{Type: "delete", Status: "completed", Succeeded: 5, Failed: 1, Skipped: 2, Duration: 3 * time.Second})
+	bus.Publish(ctx, events.ProtectionViolation{Repository: "library/nginx", Tag: "v1.0.0", Action: "delete", Policy: "prod-immutable"})
+	bus.Publish(ctx, events.ProtectionViolation{Repository: "library/nginx", Tag: "v1.1.0", Action: "delete", Policy: "prod-immutable"})
+	bus.Publish(ctx, events.ProtectionOverridden{Operation: "batch-1", Action: "delete"})
+	bus.Publish(ctx, events.ProtectionOverridden{Operation: "batch-2", Action: "delete"})
+	bus.Publish(ctx, events.ConversionCompleted{Driver: "estargz", Elapsed: 12 * time.Second})
+	bus.Publish(ctx, events.BatchStarted{ID: "batch-2"})
+
+	expectLines(t, scrape(t, m),
+		`harbor_health_check_duration_seconds_bucket{endpoint="https://registry.example.com",result="success",le="0.025"} 1`,
+		`harbor_health_check_duration_seconds_bucket{endpoint="https://registry.example.com",result="failure",le="2.5"} 0`,
+		`harbor_health_check_duration_seconds_count{endpoint="https://registry.example.com",result="failure"} 1`,
+		`harbor_batch_duration_seconds_count{status="completed",type="delete"} 1`,
+		`harbor_batch_targets_total{outcome="succeeded",type="delete"} 5`,
+		`harbor_batch_targets_total{outcome="failed",type="delete"} 1`,
+		`harbor_batch_targets_total{outcome="skipped",type="delete"} 2`,
+		`harbor_protection_blocks_total{action="delete",policy="prod-immutable"} 2`,
+		`harbor_protection_overrides_total{action="delete"} 2`,
+		`harbor_conversion_duration_seconds_sum{driver="estargz",result="success"} 12`,
+	)
+}
+
+func TestMetrics_Sources(t *testing.T) {
+	m := New(
+		WithHealthSource(fakeHealth{
+			{Endpoint: "https://a.example.com", Status: registry.HealthStatusHealthy, Circuit: registry.CircuitClosed},
+			{Endpoint: "https://b.example.com", Status: registry.HealthStatusUnhealthy, Circuit: registry.CircuitOpen, Consecutive: 4},
+		}),
+		WithQueueSource(fakeQueue{stats: map[queue.State]int{queue.StatePending: 3, queue.StateDead: 1}}),
+		WithCacheSource(fakeCache{Hits: 3, Misses: 1, Entries: 2, Size: 2048}),
+	)
+
+	expectLines(t, scrape(t, m),
+		`harbor_health_circuit_state{endpoint="https://a.example.com",state="closed"} 1`,
+		`harbor_health_circuit_state{endpoint="https://a.example.com",state="open"} 0`,
+		`harbor_health_circuit_state{endpoint="https://b.example.com",state="open"} 1`,
+		`harbor_health_status{endpoint="https://b.example.com",status="unhealthy"} 1`,
+		`harbor_health_status{endpoint="https://b.example.com",status="healthy"} 0`,
+		`harbor_health_consecutive_failures{endpoint="https://b.example.com"} 4`,
+		`harbor_conversion_queue_jobs{state="pending"} 3`,
+		`harbor_conversion_queue_jobs{state="running"} 0`,
+		`harbor_conversion_queue_jobs{state="dead"} 1`,
+		`harbor_layer_cache_hits_total 3`,
+		`harbor_layer_cache_misses_total 1`,
+		`harbor_layer_cache_hit_ratio 0.75`,
+		`harbor_layer_cache_entries 2`,
+		`harbor_layer_cache_size_bytes 2048`,
+	)
+}
+
+func TestMetrics_QueueError(t *testing.T) {
+	m := New(WithQueueSource(fakeQueue{err: errors.New("database closed")}))
+
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusInternalServerError || !strings.Contains(rec.Body.String(), "database closed") {
+		t.Errorf("expected the queue error to fail the scrape, got %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestMetrics_Serve(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+
+	m := New(WithCacheSource(fakeCache{Hits: 1}))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- m.Serve(ctx, l)
+	}()
+
+	resp, err := http.Get("http://" + l.Addr().String() + "/metrics")
+	if err != nil {
+		t.Fatalf("scrape failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	expectLines(t, string(body), `harbor_layer_cache_hits_total 1`)
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("expected a clean shutdown, got %v", err)
+	}
+}
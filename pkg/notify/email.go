@@ -0,0 +1,123 @@
+// Copyright 2021 vjranagit
+//
+// SMTP email notification sink
+
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Email sends notifications through an SMTP server, upgrading to TLS when
+// the server offers STARTTLS
+type Email struct {
+	name     string
+	addr     string
+	from     string
+	to       []string
+	username string
+	password string
+}
+
+// NewEmail creates a sink mailing from the from address to the to
+// addresses through the SMTP server at addr (host:port). The server is
+// authenticated against when username is set, which net/smtp only allows
+// over TLS or to localhost
+func NewEmail(name, addr, from string, to []string, username, password string) *Email {
+	return &Email{
+		name:     name,
+		addr:     addr,
+		from:     from,
+		to:       to,
+		username: username,
+		password: password,
+	}
+}
+
+func (e *Email) Name() string { return "email " + e.name }
+
+func (e *Email) Send(ctx context.Context, n Notification) error {
+	host, _, err := net.SplitHostPort(e.addr)
+	if err != nil {
+		return fmt.Errorf("invalid SMTP address %q: %w", e.addr, err)
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", e.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return fmt.Errorf("SMTP %s: %w", e.addr, err)
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return fmt.Errorf("SMTP %s: STARTTLS: %w", e.addr, err)
+		}
+	}
+	if e.username != "" {
+		if err := c.Auth(smtp.PlainAuth("", e.username, e.password, host)); err != nil {
+			return fmt.Errorf("SMTP %s: %w", e.addr, err)
+		}
+	}
+
+	if err := c.Mail(e.from); err != nil {
+		return fmt.Errorf("SMTP %s: MAIL FROM: %w", e.addr, err)
+	}
+	for _, to := range e.to {
+		if err := c.Rcpt(to); err != nil {
+			return fmt.Errorf("SMTP %s: RCPT TO %s: %w", e.addr, to, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("SMTP %s: DATA: %w", e.addr, err)
+	}
+	if _, err := w.Write(e.message(n)); err != nil {
+		return fmt.Errorf("SMTP %s: %w", e.addr, err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("SMTP %s: %w", e.addr, err)
+	}
+	return c.Quit()
+}
+
+// message renders the notification as a plain text email
+func (e *Email) message(n Notification) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", e.from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(e.to, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", "[harbor] "+n.Summary()))
+	fmt.Fprintf(&b, "Date: %s\r\n", n.Time.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+
+	fmt.Fprintf(&b, "%s\r\n\r\n", n.Summary())
+	fmt.Fprintf(&b, "Endpoint: %s\r\n", n.Endpoint)
+	fmt.Fprintf(&b, "Circuit:  %s\r\n", n.Circuit)
+	fmt.Fprintf(&b, "Time:     %s\r\n", n.Time.Format(time.RFC3339))
+	if n.Since != nil {
+		fmt.Fprintf(&b, "Failing:  since %s\r\n", n.Since.Format(time.RFC3339))
+	}
+	if n.Error != "" {
+		fmt.Fprintf(&b, "Error:    %s\r\n", n.Error)
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,140 @@
+// Copyright 2021 vjranagit
+//
+// SMTP email sink tests
+
+package notify
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// smtpSession is what a fake SMTP server received
+type smtpSession struct {
+	auth string
+	from string
+	to   []string
+	data string
+}
+
+// fakeSMTP accepts one session and sends it on the returned channel.
+// rejectRcpt makes it refuse that recipient
+func fakeSMTP(t *testing.T, rejectRcpt string) (string, <-chan smtpSession) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	sessions := make(chan smtpSession, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		var s smtpSession
+		defer func() { sessions <- s }()
+
+		r := bufio.NewReader(conn)
+		reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+		reply("220 localhost ESMTP fake")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+
+			switch {
+			case verb == "EHLO":
+				reply("250-localhost")
+				reply("250 AUTH PLAIN")
+			case verb == "AUTH":
+				s.auth = line
+				reply("235 2.7.0 Authentication successful")
+			case strings.HasPrefix(strings.ToUpper(line), "MAIL FROM:"):
+				s.from = strings.Trim(line[len("MAIL FROM:"):], "<>")
+				reply("250 OK")
+			case strings.HasPrefix(strings.ToUpper(line), "RCPT TO:"):
+				to := strings.Trim(line[len("RCPT TO:"):], "<>")
+				if to == rejectRcpt {
+					reply("550 5.1.1 No such user")
+					continue
+				}
+				s.to = append(s.to, to)
+				reply("250 OK")
+			case verb == "DATA":
+				reply("354 End data with <CR><LF>.<CR><LF>")
+				var data strings.Builder
+				for {
+					l, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if l == ".\r\n" {
+						break
+					}
+					data.WriteString(l)
+				}
+				s.data = data.String()
+				reply("250 OK queued")
+			case verb == "QUIT":
+				reply("221 Bye")
+				return
+			default:
+				reply("502 Command not implemented")
+			}
+		}
+	}()
+	return ln.Addr().String(), sessions
+}
+
+func TestEmail_Send(t *testing.T) {
+	addr, sessions := fakeSMTP(t, "")
+
+	sink := NewEmail("oncall", addr, "harbor@example.com",
+		[]string{"ops@example.com", "lead@example.com"}, "harbor", "secret")
+	if err := sink.Send(context.Background(), testNotification()); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	s := <-sessions
+	wantAuth := "AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00harbor\x00secret"))
+	if s.auth != wantAuth {
+		t.Errorf("expected %q, got %q", wantAuth, s.auth)
+	}
+	if s.from != "harbor@example.com" || len(s.to) != 2 || s.to[1] != "lead@example.com" {
+		t.Errorf("unexpected envelope from %q to %v", s.from, s.to)
+	}
+	for _, want := range []string{
+		"Subject: [harbor] https://registry.example.com is still unhealthy\r\n",
+		"To: ops@example.com, lead@example.com\r\n",
+		"Error:    connection refused\r\n",
+		"Failing:  since 2024-03-01T11:55:00Z\r\n",
+	} {
+		if !strings.Contains(s.data, want) {
+			t.Errorf("expected message to contain %q, got:\n%s", want, s.data)
+		}
+	}
+}
+
+func TestEmail_RejectedRecipient(t *testing.T) {
+	addr, _ := fakeSMTP(t, "nobody@example.com")
+
+	sink := NewEmail("oncall", addr, "harbor@example.com", []string{"nobody@example.com"}, "", "")
+	err := sink.Send(context.Background(), testNotification())
+	if err == nil || !strings.Contains(err.Error(), "No such user") {
+		t.Errorf("expected the rejection in the error, got %v", err)
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2021 vjranagit
+//
+// Local command notification sink
+
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Exec runs a local command for each notification. The notification is
+// written to its stdin as JSON and described by HARBOR_NOTIFY_*
+// environment variables
+type Exec struct {
+	name    string
+	command []string
+}
+
+// NewExec creates a sink running command, a program and its arguments
+func NewExec(name string, command []string) *Exec {
+	return &Exec{name: name, command: command}
+}
+
+func (e *Exec) Name() string { return "exec " + e.name }
+
+func (e *Exec) Send(ctx context.Context, n Notification) error {
+	if len(e.command) == 0 {
+		return fmt.Errorf("no command configured")
+	}
+
+	input, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.CommandContext(ctx, e.command[0], e.command[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Env = append(os.Environ(),
+		"HARBOR_NOTIFY_ENDPOINT="+n.Endpoint,
+		"HARBOR_NOTIFY_KIND="+string(n.Kind),
+		"HARBOR_NOTIFY_CIRCUIT="+n.Circuit,
+		"HARBOR_NOTIFY_ERROR="+n.Error,
+		"HARBOR_NOTIFY_SUMMARY="+n.Summary(),
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %w: %s", filepath.Base(e.command[0]), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+// Copyright 2021 vjranagit
+//
+// Exec sink tests
+
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExec_Send(t *testing.T) {
+	dir := t.TempDir()
+	script := `cat > "$1/stdin.json"; printf '%s|%s|%s' "$HARBOR_NOTIFY_KIND" "$HARBOR_NOTIFY_ENDPOINT" "$HARBOR_NOTIFY_ERROR" > "$1/env"`
+
+	sink := NewExec("pager", []string{"sh", "-c", script, "sh", dir})
+	if err := sink.Send(context.Background(), testNotification()); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	env, err := os.ReadFile(filepath.Join(dir, "env"))
+	if err != nil {
+		t.Fatalf("command did not run: %v", err)
+	}
+	if want := "opened|https://registry.example.com|connection refused"; string(env) != want {
+		t.Errorf("expected environment %q, got %q", want, env)
+	}
+
+	stdin, _ := os.ReadFile(filepath.Join(dir, "stdin.json"))
+	var got Notification
+	if err := json.Unmarshal(stdin, &got); err != nil || got.Endpoint != "https://registry.example.com" {
+		t.Errorf("expected the notification on stdin, got %s (%v)", stdin, err)
+	}
+}
+
+func TestExec_Failure(t *testing.T) {
+	sink := NewExec("pager", []string{"sh", "-c", "echo pager down >&2; exit 3"})
+	err := sink.Send(context.Background(), testNotification())
+	if err == nil || !strings.Contains(err.Error(), "pager down") || !strings.Contains(err.Error(), "exit status 3") {
+		t.Errorf("expected the exit status and output in the error, got %v", err)
+	}
+
+	if err := NewExec("empty", nil).Send(context.Background(), testNotification()); err == nil {
+		t.Error("expected an error without a command")
+	}
+}
@@ -0,0 +1,376 @@
+// Copyright 2021 vjranagit
+//
+// Alert notifications for endpoint circuit transitions
+
+package notify
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/vjranagit/harbor/pkg/events"
+)
+
+// Defaults applied by New
+const (
+	DefaultRenotifyInterval = time.Hour
+	DefaultFlapWindow       = 10 * time.Minute
+	DefaultFlapThreshold    = 4
+	DefaultSendTimeout      = 10 * time.Second
+)
+
+// Kind is what a notification reports
+type Kind string
+
+const (
+	// KindOpened reports a circuit opening: the endpoint is failing
+	KindOpened Kind = "opened"
+	// KindHalfOpen reports a failing endpoint being retried
+	KindHalfOpen Kind = "half_open"
+	// KindRecovered reports a circuit closing again
+	KindRecovered Kind = "recovered"
+	// KindFlapping reports an endpoint going up and down too often;
+	// transitions are not notified until it settles
+	KindFlapping Kind = "flapping"
+	// KindStable reports a flapping endpoint that has settled
+	KindStable Kind = "stable"
+)
+
+// Notification is one alert sent to every sink
+type Notification struct {
+	Endpoint string `json:"endpoint"`
+	Kind     Kind   `json:"kind"`
+	// From and Circuit are the circuit states before and after the
+	// transition; From is empty for flapping and stable notifications
+	From    string `json:"from,omitempty"`
+	Circuit string `json:"circuit"`
+	// Error is the last check error of a failing endpoint
+	Error string    `json:"error,omitempty"`
+	Time  time.Time `json:"time"`
+	// Since is when the endpoint started failing, while it is failing
+	Since *time.Time `json:"since,omitempty"`
+	// Repeat is set when a notification of the same kind was already sent
+	// for this outage
+	Repeat bool `json:"repeat,omitempty"`
+}
+
+// Summary is a one-line description of the notification
+func (n Notification) Summary() string {
+	switch n.Kind {
+	case KindOpened:
+		if n.Repeat {
+			return fmt.Sprintf("%s is still unhealthy", n.Endpoint)
+		}
+		return fmt.Sprintf("%s is unhealthy, circuit opened", n.Endpoint)
+	case KindHalfOpen:
+		return fmt.Sprintf("%s is unhealthy, retrying", n.Endpoint)
+	case KindRecovered:
+		return fmt.Sprintf("%s recovered, circuit closed", n.Endpoint)
+	case KindFlapping:
+		return fmt.Sprintf("%s is flapping, alerts suppressed", n.Endpoint)
+	case KindStable:
+		return fmt.Sprintf("%s stopped flapping, circuit %s", n.Endpoint, n.Circuit)
+	}
+	return fmt.Sprintf("%s: %s", n.Endpoint, n.Kind)
+}
+
+// Sink delivers notifications somewhere
+type Sink interface {
+	// Name identifies the sink in logs
+	Name() string
+	Send(ctx context.Context, n Notification) error
+}
+
+// Notifier turns health monitor events into notifications, suppressing
+// repeats and flapping endpoints
+type Notifier struct {
+	sinks         []Sink
+	renotify      time.Duration
+	flapWindow    time.Duration
+	flapThreshold int
+	sendTimeout   time.Duration
+	endpoints     map[string]*endpointState
+	mu            sync.Mutex
+	logger        *slog.Logger
+	ctx           context.Context
+	cancel        context.CancelFunc
+	wg            sync.WaitGroup
+}
+
+// endpointState is what the notifier remembers about an endpoint
+type endpointState struct {
+	circuit string
+	err     string
+	// since is when the current outage started; zero while healthy
+	since time.Time
+	// sent is when each kind was last sent during the current outage
+	sent map[Kind]time.Time
+	// changes are the times the endpoint went down or up within the flap
+	// window
+	changes  []time.Time
+	flapping bool
+	settle   *time.Timer
+}
+
+// Option configures a Notifier
+type Option func(*Notifier)
+
+// WithRenotifyInterval sets how often repeated transitions of a failing
+// endpoint, such as each failed retry, are notified again; zero notifies
+// every transition
+func WithRenotifyInterval(d time.Duration) Option {
+	return func(n *Notifier) {
+		n.renotify = d
+	}
+}
+
+// WithFlapDetection marks an endpoint flapping once it goes down or up
+// threshold times within window; zero threshold disables detection
+func WithFlapDetection(window time.Duration, threshold int) Option {
+	return func(n *Notifier) {
+		n.flapWindow = window
+		n.flapThreshold = threshold
+	}
+}
+
+// WithSendTimeout bounds each delivery to a sink
+func WithSendTimeout(d time.Duration) Option {
+	return func(n *Notifier) {
+		n.sendTimeout = d
+	}
+}
+
+// New creates a notifier delivering to sinks
+func New(sinks []Sink, opts ...Option) *Notifier {
+	ctx, cancel := context.WithCancel(context.Background())
+	n := &Notifier{
+		sinks:         sinks,
+		renotify:      DefaultRenotifyInterval,
+		flapWindow:    DefaultFlapWindow,
+		flapThreshold: DefaultFlapThreshold,
+		sendTimeout:   DefaultSendTimeout,
+		endpoints:     make(map[string]*endpointState),
+		logger:        slog.Default().With("component", "notify"),
+		ctx:           ctx,
+		cancel:        cancel,
+	}
+	for _, opt := range opts {
+		opt(n)
+	}
+	return n
+}
+
+// subscriptionBuffer absorbs bursts of transitions while sinks are slow
+const subscriptionBuffer = 1024
+
+// Subscribe feeds the health events of bus to the notifier. Deliveries
+// can take up to the send timeout, so publishers wait for room rather
+// than losing transitions once the buffer is full
+func (n *Notifier) Subscribe(bus *events.Bus) *events.Subscription {
+	return bus.Subscribe(n.Handle,
+		events.WithTopics(events.TopicHealthChanged, events.TopicCircuitChanged),
+		events.WithBuffer(subscriptionBuffer),
+		events.WithOverflow(events.Block),
+	)
+}
+
+// Handle processes one health event; it is an events.Handler
+func (n *Notifier) Handle(ctx context.Context, e events.Event) {
+	switch p := e.Payload.(type) {
+	case events.HealthChanged:
+		n.mu.Lock()
+		n.state(p.Endpoint).err = p.Error
+		n.mu.Unlock()
+	case events.CircuitChanged:
+		now := e.Time
+		if now.IsZero() {
+			now = time.Now()
+		}
+		if note, ok := n.transition(p, now); ok {
+			n.send(note)
+		}
+	}
+}
+
+// Close stops pending settle timers and cancels deliveries in flight
+func (n *Notifier) Close() {
+	n.mu.Lock()
+	for _, st := range n.endpoints {
+		if st.settle != nil {
+			st.settle.Stop()
+		}
+	}
+	n.mu.Unlock()
+
+	n.cancel()
+	n.wg.Wait()
+}
+
+// state returns the state of an endpoint. Callers hold n.mu
+func (n *Notifier) state(endpoint string) *endpointState {
+	st, ok := n.endpoints[endpoint]
+	if !ok {
+		st = &endpointState{circuit: "closed", sent: make(map[Kind]time.Time)}
+		n.endpoints[endpoint] = st
+	}
+	return st
+}
+
+// transition updates an endpoint's state and returns the notification to
+// send, if any
+func (n *Notifier) transition(c events.CircuitChanged, now time.Time) (Notification, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	st := n.state(c.Endpoint)
+	st.circuit = c.To
+
+	var kind Kind
+	switch {
+	case c.To == "open":
+		kind = KindOpened
+	case c.To == "half_open":
+		kind = KindHalfOpen
+	case c.To == "closed" && c.From != "closed":
+		kind = KindRecovered
+	default:
+		return Notification{}, false
+	}
+
+	// Going down or coming back up starts a new outage or ends it
+	changed := (kind == KindOpened && c.From == "closed") || kind == KindRecovered
+	if changed {
+		clear(st.sent)
+		st.since = time.Time{}
+	}
+	if kind != KindRecovered && st.since.IsZero() {
+		st.since = now
+	}
+
+	note := Notification{
+		Endpoint: c.Endpoint,
+		Kind:     kind,
+		From:     c.From,
+		Circuit:  c.To,
+		Time:     now,
+	}
+	if kind != KindRecovered {
+		since := st.since
+		note.Error, note.Since = st.err, &since
+	}
+
+	if changed && n.flapThreshold > 0 {
+		if flap, ok := n.detectFlap(c.Endpoint, st, now); ok {
+			return flap, true
+		}
+	}
+	if st.flapping {
+		n.logger.Debug("notification suppressed, endpoint flapping", "endpoint", c.Endpoint, "kind", kind)
+		return Notification{}, false
+	}
+
+	if last, ok := st.sent[kind]; ok {
+		if n.renotify > 0 && now.Sub(last) < n.renotify {
+			return Notification{}, false
+		}
+		note.Repeat = true
+	}
+	st.sent[kind] = now
+	return note, true
+}
+
+// detectFlap records a down or up change and returns a flapping
+// notification when it makes the endpoint start flapping. Callers hold n.mu
+func (n *Notifier) detectFlap(endpoint string, st *endpointState, now time.Time) (Notification, bool) {
+	st.changes = append(st.changes, now)
+	for len(st.changes) > 0 && now.Sub(st.changes[0]) > n.flapWindow {
+		st.changes = st.changes[1:]
+	}
+
+	if st.flapping {
+		st.settle.Reset(n.flapWindow)
+		return Notification{}, false
+	}
+	if len(st.changes) < n.flapThreshold {
+		return Notification{}, false
+	}
+
+	st.flapping = true
+	st.settle = time.AfterFunc(n.flapWindow, func() { n.settle(endpoint) })
+	n.logger.Warn("endpoint flapping", "endpoint", endpoint, "changes", len(st.changes), "window", n.flapWindow)
+	return Notification{
+		Endpoint: endpoint,
+		Kind:     KindFlapping,
+		Circuit:  st.circuit,
+		Error:    st.err,
+		Time:     now,
+	}, true
+}
+
+// settle ends flapping once an endpoint has not gone down or up for a
+// whole flap window, notifying the state it settled in
+func (n *Notifier) settle(endpoint string) {
+	n.mu.Lock()
+	st, ok := n.endpoints[endpoint]
+	if !ok || !st.flapping || n.ctx.Err() != nil {
+		n.mu.Unlock()
+		return
+	}
+	st.flapping = false
+	st.changes = nil
+	clear(st.sent)
+
+	now := time.Now()
+	note := Notification{
+		Endpoint: endpoint,
+		Kind:     KindStable,
+		Circuit:  st.circuit,
+		Time:     now,
+	}
+	if st.circuit != "closed" {
+		since := st.since
+		note.Error, note.Since = st.err, &since
+		// The outage is notified afresh; reminders count from here
+		st.sent[KindOpened] = now
+		st.sent[KindHalfOpen] = now
+	}
+	n.mu.Unlock()
+
+	n.logger.Info("endpoint stopped flapping", "endpoint", endpoint, "circuit", note.Circuit)
+	n.send(note)
+}
+
+// send delivers a notification to every sink concurrently and waits for
+// them; failures are logged
+func (n *Notifier) send(note Notification) {
+	if n.ctx.Err() != nil {
+		return
+	}
+	n.wg.Add(1)
+	defer n.wg.Done()
+
+	var wg sync.WaitGroup
+	for _, sink := range n.sinks {
+		wg.Add(1)
+		go func(sink Sink) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(n.ctx, n.sendTimeout)
+			defer cancel()
+			if err := sink.Send(ctx, note); err != nil {
+				n.logger.Error("notification failed",
+					"sink", sink.Name(),
+					"endpoint", note.Endpoint,
+					"kind", note.Kind,
+					"error", err,
+				)
+				return
+			}
+			n.logger.Debug("notification sent", "sink", sink.Name(), "endpoint", note.Endpoint, "kind", note.Kind)
+		}(sink)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,266 @@
+// Copyright 2021 vjranagit
+//
+// Notifier tests
+
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vjranagit/harbor/pkg/events"
+)
+
+// recordingSink keeps the notifications it is sent
+type recordingSink struct {
+	mu    sync.Mutex
+	notes []Notification
+	err   error
+}
+
+func (s *recordingSink) Name() string { return "recording" }
+
+func (s *recordingSink) Send(ctx context.Context, n Notification) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.notes = append(s.notes, n)
+	return s.err
+}
+
+func (s *recordingSink) kinds() []Kind {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kinds := make([]Kind, 0, len(s.notes))
+	for _, n := range s.notes {
+		kinds = append(kinds, n.Kind)
+	}
+	return kinds
+}
+
+func (s *recordingSink) last() Notification {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.notes[len(s.notes)-1]
+}
+
+// step is a circuit transition some time after the start of a test
+type step struct {
+	after    time.Duration
+	from, to string
+}
+
+// replay hands the transitions of one endpoint to the notifier
+func replay(n *Notifier, start time.Time, steps []step) {
+	for _, s := range steps {
+		n.Handle(context.Background(), events.Event{
+			Time:    start.Add(s.after),
+			Payload: events.CircuitChanged{Endpoint: "https://registry.example.com", From: s.from, To: s.to},
+		})
+	}
+}
+
+func equalKinds(a, b []Kind) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// outage is an endpoint failing, being retried twice and recovering
+var outage = []step{
+	{0, "closed", "open"},
+	{time.Minute, "open", "half_open"},
+	{time.Minute, "half_open", "open"},
+	{2 * time.Minute, "open", "half_open"},
+	{2 * time.Minute, "half_open", "open"},
+	{20 * time.Minute, "open", "half_open"},
+	{20 * time.Minute, "half_open", "closed"},
+}
+
+func TestNotifier_Transitions(t *testing.T) {
+	tests := []struct {
+		name     string
+		renotify time.Duration
+		want     []Kind
+	}{
+		{
+			name:     "every transition",
+			renotify: 0,
+			want:     []Kind{KindOpened, KindHalfOpen, KindOpened, KindHalfOpen, KindOpened, KindHalfOpen, KindRecovered},
+		},
+		{
+			name:     "retries within the interval suppressed",
+			renotify: 10 * time.Minute,
+			want:     []Kind{KindOpened, KindHalfOpen, KindHalfOpen, KindRecovered},
+		},
+		{
+			name:     "retries suppressed for the whole outage",
+			renotify: time.Hour,
+			want:     []Kind{KindOpened, KindHalfOpen, KindRecovered},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &recordingSink{}
+			n := New([]Sink{sink}, WithRenotifyInterval(tt.renotify))
+			defer n.Close()
+
+			replay(n, time.Now(), outage)
+			if got := sink.kinds(); !equalKinds(got, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestNotifier_Details(t *testing.T) {
+	sink := &recordingSink{}
+	n := New([]Sink{sink}, WithRenotifyInterval(10*time.Minute))
+	defer n.Close()
+
+	start := time.Now()
+	n.Handle(context.Background(), events.Event{
+		Payload: events.HealthChanged{Endpoint: "https://registry.example.com", From: "degraded", To: "unhealthy", Error: "connection refused"},
+	})
+	replay(n, start, outage)
+
+	opened := sink.notes[0]
+	if opened.Error != "connection refused" || opened.Since == nil || !opened.Since.Equal(start) || opened.Repeat {
+		t.Errorf("expected the first failure with its error, got %+v", opened)
+	}
+	reminder := sink.notes[2]
+	if reminder.Kind != KindHalfOpen || !reminder.Repeat || !reminder.Since.Equal(start) {
+		t.Errorf("expected a repeated half_open since the start of the outage, got %+v", reminder)
+	}
+	if recovered := sink.last(); recovered.Error != "" || recovered.Since != nil || recovered.From != "half_open" {
+		t.Errorf("expected a recovery without error, got %+v", recovered)
+	}
+
+	// A new outage is notified even within the re-notify interval
+	replay(n, start.Add(21*time.Minute), []step{{0, "closed", "open"}})
+	if got := sink.last(); got.Kind != KindOpened || got.Repeat {
+		t.Errorf("expected a new outage to be notified, got %+v", got)
+	}
+}
+
+func TestNotifier_Flapping(t *testing.T) {
+	sink := &recordingSink{}
+	n := New([]Sink{sink}, WithRenotifyInterval(0), WithFlapDetection(200*time.Millisecond, 4))
+	defer n.Close()
+
+	replay(n, time.Now(), []step{
+		{0, "closed", "open"},
+		{time.Millisecond, "open", "closed"},
+		{2 * time.Millisecond, "closed", "open"},
+		{3 * time.Millisecond, "open", "closed"},
+		{4 * time.Millisecond, "closed", "open"},
+		{5 * time.Millisecond, "open", "half_open"},
+		{6 * time.Millisecond, "half_open", "open"},
+	})
+	want := []Kind{KindOpened, KindRecovered, KindOpened, KindFlapping}
+	if got := sink.kinds(); !equalKinds(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+
+	// Once quiet for the window, the state it settled in is notified
+	deadline := time.Now().Add(5 * time.Second)
+	for len(sink.kinds()) == len(want) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected a stable notification")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := sink.last(); got.Kind != KindStable || got.Circuit != "open" || got.Since == nil {
+		t.Errorf("expected stable while open, got %+v", got)
+	}
+
+	// Retries of the settled outage count as repeats
+	replay(n, time.Now(), []step{{0, "open", "half_open"}})
+	if got := sink.last(); got.Kind != KindHalfOpen || !got.Repeat {
+		t.Errorf("expected the retry after settling to be a repeat, got %+v", got)
+	}
+	replay(n, time.Now(), []step{{0, "half_open", "closed"}})
+	if got := sink.last(); got.Kind != KindRecovered {
+		t.Errorf("expected recovery to be notified, got %+v", got)
+	}
+}
+
+func TestNotifier_FailingSink(t *testing.T) {
+	failing := &recordingSink{err: errors.New("unreachable")}
+	sink := &recordingSink{}
+	n := New([]Sink{failing, sink}, WithRenotifyInterval(0))
+	defer n.Close()
+
+	replay(n, time.Now(), outage[:2])
+	if got := sink.kinds(); len(got) != 2 {
+		t.Errorf("expected a failing sink not to stop others, got %v", got)
+	}
+}
+
+func TestNotifier_Subscribe(t *testing.T) {
+	sink := &recordingSink{}
+	n := New([]Sink{sink})
+
+	bus := events.NewBus()
+	n.Subscribe(bus)
+	bus.Publish(context.Background(), events.HealthChanged{Endpoint: "https://a.example.com", From: "degraded", To: "unhealthy", Error: "timeout"})
+	bus.Publish(context.Background(), events.CircuitChanged{Endpoint: "https://a.example.com", From: "closed", To: "open"})
+	bus.Publish(context.Background(), events.BatchStarted{ID: "batch-1"})
+	bus.Close()
+	n.Close()
+
+	if got := sink.kinds(); !equalKinds(got, []Kind{KindOpened}) {
+		t.Fatalf("expected one opened notification, got %v", got)
+	}
+	if got := sink.last(); got.Endpoint != "https://a.example.com" || got.Error != "timeout" {
+		t.Errorf("unexpected notification %+v", got)
+	}
+}
+
+// gatedSink holds every send until it is opened
+type gatedSink struct {
+	recordingSink
+	gate chan struct{}
+}
+
+func (s *gatedSink) Send(ctx context.Context, n Notification) error {
+	<-s.gate
+	return s.recordingSink.Send(ctx, n)
+}
+
+func TestNotifier_SubscribeStorm(t *testing.T) {
+	sink := &gatedSink{gate: make(chan struct{})}
+	n := New([]Sink{sink})
+
+	bus := events.NewBus()
+	n.Subscribe(bus)
+
+	// Far more transitions than the buffer holds while the sink is stuck
+	const endpoints = 2 * subscriptionBuffer
+	published := make(chan struct{})
+	go func() {
+		for i := 0; i < endpoints; i++ {
+			bus.Publish(context.Background(), events.CircuitChanged{Endpoint: fmt.Sprintf("https://%d.example.com", i), From: "closed", To: "open"})
+		}
+		close(published)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(sink.gate)
+	<-published
+	bus.Close()
+	n.Close()
+
+	if got := len(sink.kinds()); got != endpoints {
+		t.Errorf("expected %d notifications, got %d", endpoints, got)
+	}
+}
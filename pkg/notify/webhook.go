@@ -0,0 +1,145 @@
+// Copyright 2021 vjranagit
+//
+// Webhook and Slack notification sinks
+
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Webhook posts each notification as JSON
+type Webhook struct {
+	name    string
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+// NewWebhook creates a webhook sink posting to url with the extra headers
+func NewWebhook(name, url string, headers map[string]string) *Webhook {
+	return &Webhook{
+		name:    name,
+		url:     url,
+		headers: headers,
+		client:  &http.Client{},
+	}
+}
+
+func (w *Webhook) Name() string { return "webhook " + w.name }
+
+func (w *Webhook) Send(ctx context.Context, n Notification) error {
+	return postJSON(ctx, w.client, w.url, w.headers, n)
+}
+
+// Slack posts notifications to a Slack-compatible incoming webhook, which
+// Mattermost and Rocket.Chat also accept
+type Slack struct {
+	name   string
+	url    string
+	client *http.Client
+}
+
+// NewSlack creates a sink posting to a Slack incoming webhook URL
+func NewSlack(name, url string) *Slack {
+	return &Slack{
+		name:   name,
+		url:    url,
+		client: &http.Client{},
+	}
+}
+
+func (s *Slack) Name() string { return "slack " + s.name }
+
+// slackMessage is an incoming webhook payload
+type slackMessage struct {
+	Text        string            `json:"text"`
+	Attachments []slackAttachment `json:"attachments,omitempty"`
+}
+
+type slackAttachment struct {
+	Color  string       `json:"color"`
+	Fields []slackField `json:"fields"`
+	Footer string       `json:"footer,omitempty"`
+	// Ts is the notification time in Unix seconds
+	Ts int64 `json:"ts"`
+}
+
+type slackField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+	Short bool   `json:"short,omitempty"`
+}
+
+func (s *Slack) Send(ctx context.Context, n Notification) error {
+	color := "danger"
+	switch n.Kind {
+	case KindRecovered:
+		color = "good"
+	case KindHalfOpen, KindFlapping:
+		color = "warning"
+	case KindStable:
+		if n.Circuit == "closed" {
+			color = "good"
+		}
+	}
+
+	fields := []slackField{
+		{Title: "Endpoint", Value: n.Endpoint, Short: true},
+		{Title: "Circuit", Value: n.Circuit, Short: true},
+	}
+	if n.Since != nil {
+		if down := n.Time.Sub(*n.Since).Round(time.Second); down > 0 {
+			fields = append(fields, slackField{Title: "Failing for", Value: down.String(), Short: true})
+		}
+	}
+	if n.Error != "" {
+		fields = append(fields, slackField{Title: "Error", Value: n.Error})
+	}
+
+	return postJSON(ctx, s.client, s.url, nil, slackMessage{
+		Text: n.Summary(),
+		Attachments: []slackAttachment{{
+			Color:  color,
+			Fields: fields,
+			Footer: "harbor health monitor",
+			Ts:     n.Time.Unix(),
+		}},
+	})
+}
+
+// postJSON posts v and fails on any status but 2xx
+func postJSON(ctx context.Context, client *http.Client, url string, headers map[string]string, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("POST %s: %s: %s", url, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+// Copyright 2021 vjranagit
+//
+// Webhook and Slack sink tests
+
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// capture serves status and keeps the last request body and headers
+func capture(t *testing.T, status int) (*httptest.Server, *[]byte, *http.Header) {
+	t.Helper()
+
+	var body []byte
+	var header http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Clone()
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(status)
+		if status >= 300 {
+			w.Write([]byte("no such hook"))
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &body, &header
+}
+
+func testNotification() Notification {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	since := now.Add(-5 * time.Minute)
+	return Notification{
+		Endpoint: "https://registry.example.com",
+		Kind:     KindOpened,
+		From:     "half_open",
+		Circuit:  "open",
+		Error:    "connection refused",
+		Time:     now,
+		Since:    &since,
+		Repeat:   true,
+	}
+}
+
+func TestWebhook_Send(t *testing.T) {
+	srv, body, header := capture(t, http.StatusNoContent)
+
+	sink := NewWebhook("ops", srv.URL, map[string]string{"Authorization": "Bearer secret"})
+	if err := sink.Send(context.Background(), testNotification()); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	var got Notification
+	if err := json.Unmarshal(*body, &got); err != nil {
+		t.Fatalf("invalid payload %s: %v", *body, err)
+	}
+	if want := testNotification(); got.Endpoint != want.Endpoint || got.Kind != want.Kind || !got.Since.Equal(*want.Since) || !got.Repeat {
+		t.Errorf("expected %+v, got %+v", want, got)
+	}
+	if got := header.Get("Authorization"); got != "Bearer secret" {
+		t.Errorf("expected the configured header, got %q", got)
+	}
+	if got := header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("expected a JSON content type, got %q", got)
+	}
+}
+
+func TestWebhook_Error(t *testing.T) {
+	srv, _, _ := capture(t, http.StatusNotFound)
+
+	err := NewWebhook("ops", srv.URL, nil).Send(context.Background(), testNotification())
+	if err == nil || !strings.Contains(err.Error(), "404") || !strings.Contains(err.Error(), "no such hook") {
+		t.Errorf("expected the status and body in the error, got %v", err)
+	}
+}
+
+func TestSlack_Send(t *testing.T) {
+	tests := []struct {
+		kind      Kind
+		circuit   string
+		wantColor string
+	}{
+		{KindOpened, "open", "danger"},
+		{KindHalfOpen, "half_open", "warning"},
+		{KindRecovered, "closed", "good"},
+		{KindFlapping, "open", "warning"},
+		{KindStable, "closed", "good"},
+		{KindStable, "open", "danger"},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.kind)+"/"+tt.circuit, func(t *testing.T) {
+			srv, body, _ := capture(t, http.StatusOK)
+
+			n := testNotification()
+			n.Kind, n.Circuit = tt.kind, tt.circuit
+			if err := NewSlack("alerts", srv.URL).Send(context.Background(), n); err != nil {
+				t.Fatalf("Send failed: %v", err)
+			}
+
+			var msg slackMessage
+			if err := json.Unmarshal(*body, &msg); err != nil {
+				t.Fatalf("invalid payload %s: %v", *body, err)
+			}
+			if msg.Text != n.Summary() {
+				t.Errorf("expected text %q, got %q", n.Summary(), msg.Text)
+			}
+			if len(msg.Attachments) != 1 || msg.Attachments[0].Color != tt.wantColor {
+				t.Fatalf("expected one %s attachment, got %+v", tt.wantColor, msg.Attachments)
+			}
+			fields := map[string]string{}
+			for _, f := range msg.Attachments[0].Fields {
+				fields[f.Title] = f.Value
+			}
+			if fields["Endpoint"] != n.Endpoint || fields["Error"] != n.Error || fields["Failing for"] != "5m0s" {
+				t.Errorf("unexpected fields %v", fields)
+			}
+		})
+	}
+}
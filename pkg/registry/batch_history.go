@@ -0,0 +1,376 @@
+// Copyright 2021 vjranagit
+//
+// Batch operation history
+
+package registry
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultHistoryCount is how many finished operations are kept by default
+const DefaultHistoryCount = 1000
+
+// HistoryStore persists finished batch operations with their results
+type HistoryStore interface {
+	// Save records an operation, replacing one with the same ID
+	Save(op BatchOperation) error
+	// Get returns an operation by ID, or ErrOperationNotFound
+	Get(id string) (BatchOperation, error)
+	// Query returns the matching operations, oldest first
+	Query(q HistoryQuery) ([]BatchOperation, error)
+	// Prune removes the operations r does not retain and returns how many
+	Prune(r HistoryRetention) (int, error)
+	// Close releases the store
+	Close() error
+}
+
+// HistoryQuery filters operations; zero fields match everything
+type HistoryQuery struct {
+	Type   BatchOpType
+	Status BatchOpStatus
+	// Since and Until bound the creation time, inclusive
+	Since time.Time
+	Until time.Time
+	// Limit keeps only the newest matches
+	Limit int
+}
+
+// Match reports whether op passes the query filters, ignoring Limit
+func (q HistoryQuery) Match(op BatchOperation) bool {
+	switch {
+	case q.Type != "" && op.Type != q.Type:
+		return false
+	case q.Status != "" && op.Status != q.Status:
+		return false
+	case !q.Since.IsZero() && op.CreatedAt.Before(q.Since):
+		return false
+	case !q.Until.IsZero() && op.CreatedAt.After(q.Until):
+		return false
+	}
+	return true
+}
+
+// limit sorts ops oldest first and keeps the newest q.Limit
+func (q HistoryQuery) limit(ops []BatchOperation) []BatchOperation {
+	sort.Slice(ops, func(i, j int) bool {
+		return ops[i].CreatedAt.Before(ops[j].CreatedAt)
+	})
+	if q.Limit > 0 && len(ops) > q.Limit {
+		ops = ops[len(ops)-q.Limit:]
+	}
+	return ops
+}
+
+// HistoryRetention bounds the history; zero fields do not limit it
+type HistoryRetention struct {
+	// MaxAge drops operations created longer ago
+	MaxAge time.Duration
+	// MaxCount keeps only the newest operations
+	MaxCount int
+}
+
+// DefaultHistoryRetention keeps the newest DefaultHistoryCount operations
+func DefaultHistoryRetention() HistoryRetention {
+	return HistoryRetention{MaxCount: DefaultHistoryCount}
+}
+
+// expired returns the IDs of ops, sorted oldest first, that r drops
+func (r HistoryRetention) expired(ops []BatchOperation, now time.Time) []string {
+	var ids []string
+	for i, op := range ops {
+		tooMany := r.MaxCount > 0 && len(ops)-i > r.MaxCount
+		tooOld := r.MaxAge > 0 && now.Sub(op.CreatedAt) > r.MaxAge
+		if tooMany || tooOld {
+			ids = append(ids, op.ID)
+		}
+	}
+	return ids
+}
+
+// WithHistory saves every finished operation to store and prunes it to
+// the operator's retention. Operations no longer held in memory are still
+// found through Snapshot, Wait and History
+func WithHistory(store HistoryStore) BatchOption {
+	return func(bo *BatchOperator) {
+		bo.history = store
+	}
+}
+
+// WithHistoryRetention bounds the finished operations kept in memory and
+// in the history store; DefaultHistoryRetention applies otherwise
+func WithHistoryRetention(r HistoryRetention) BatchOption {
+	return func(bo *BatchOperator) {
+		bo.retention = r
+	}
+}
+
+// History returns the operations matching q, oldest first: those in the
+// history store along with the ones still held in memory
+func (bo *BatchOperator) History(q HistoryQuery) ([]BatchOperation, error) {
+	var ops []BatchOperation
+	seen := make(map[string]bool)
+	if bo.history != nil {
+		saved, err := bo.history.Query(HistoryQuery{
+			Type:   q.Type,
+			Status: q.Status,
+			Since:  q.Since,
+			Until:  q.Until,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to query history: %w", err)
+		}
+		for _, op := range saved {
+			seen[op.ID] = true
+		}
+		ops = saved
+	}
+
+	for _, op := range bo.Snapshots() {
+		if !seen[op.ID] && q.Match(op) {
+			ops = append(ops, op)
+		}
+	}
+	return q.limit(ops), nil
+}
+
+// record saves a finished operation to the history store and applies the
+// retention to the store and to the operations held in memory. Failures
+// are logged; they never fail the operation
+func (bo *BatchOperator) record(ctx context.Context, op *BatchOperation) {
+	if bo.history != nil {
+		bo.mu.RLock()
+		snapshot := *op
+		bo.mu.RUnlock()
+
+		if err := bo.history.Save(snapshot); err != nil {
+			bo.logger.ErrorContext(ctx, "failed to save batch history", "id", op.ID, "error", err)
+		} else if pruned, err := bo.history.Prune(bo.retention); err != nil {
+			bo.logger.ErrorContext(ctx, "failed to prune batch history", "error", err)
+		} else if pruned > 0 {
+			bo.logger.DebugContext(ctx, "batch history pruned", "count", pruned)
+		}
+	}
+
+	bo.mu.Lock()
+	defer bo.mu.Unlock()
+
+	var finished []BatchOperation
+	for _, o := range bo.operations {
+		if o.Status.Finished() {
+			finished = append(finished, BatchOperation{ID: o.ID, CreatedAt: o.CreatedAt})
+		}
+	}
+	for _, id := range bo.retention.expired(HistoryQuery{}.limit(finished), time.Now()) {
+		delete(bo.operations, id)
+	}
+}
+
+// operationRecord is the serialized form of a BatchOperation
+type operationRecord struct {
+	ID        string         `json:"id"`
+	Type      BatchOpType    `json:"type"`
+	Status    BatchOpStatus  `json:"status"`
+	Targets   []string       `json:"targets"`
+	Force     bool           `json:"force,omitempty"`
+	Results   []resultRecord `json:"results,omitempty"`
+	CreatedAt time.Time      `json:"created_at"`
+	StartedAt time.Time      `json:"started_at"`
+	EndedAt   time.Time      `json:"ended_at"`
+}
+
+type resultRecord struct {
+	Target   string `json:"target"`
+	Output   string `json:"output,omitempty"`
+	Success  bool   `json:"success"`
+	Skipped  bool   `json:"skipped,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+	Attempts int    `json:"attempts"`
+	Elapsed  string `json:"elapsed"`
+}
+
+func newOperationRecord(op BatchOperation) operationRecord {
+	rec := operationRecord{
+		ID:        op.ID,
+		Type:      op.Type,
+		Status:    op.Status,
+		Targets:   op.Targets,
+		Force:     op.Force,
+		CreatedAt: op.CreatedAt,
+		StartedAt: op.StartedAt,
+		EndedAt:   op.EndedAt,
+	}
+	for _, r := range op.Results {
+		rec.Results = append(rec.Results, resultRecord{
+			Target:   r.Target,
+			Output:   r.Output,
+			Success:  r.Success,
+			Skipped:  r.Skipped,
+			Error:    r.Error,
+			Reason:   r.Reason,
+			Attempts: r.Attempts,
+			Elapsed:  r.Elapsed.String(),
+		})
+	}
+	return rec
+}
+
+func (rec operationRecord) operation() (BatchOperation, error) {
+	op := BatchOperation{
+		ID:        rec.ID,
+		Type:      rec.Type,
+		Status:    rec.Status,
+		Targets:   rec.Targets,
+		Force:     rec.Force,
+		CreatedAt: rec.CreatedAt,
+		StartedAt: rec.StartedAt,
+		EndedAt:   rec.EndedAt,
+	}
+	for _, r := range rec.Results {
+		elapsed, err := time.ParseDuration(r.Elapsed)
+		if err != nil {
+			return BatchOperation{}, fmt.Errorf("operation %s: invalid elapsed %q", rec.ID, r.Elapsed)
+		}
+		op.Results = append(op.Results, BatchOpResult{
+			Target:   r.Target,
+			Output:   r.Output,
+			Success:  r.Success,
+			Skipped:  r.Skipped,
+			Error:    r.Error,
+			Reason:   r.Reason,
+			Attempts: r.Attempts,
+			Elapsed:  elapsed,
+		})
+	}
+	return op, nil
+}
+
+// HistoryFormat is an export format for operation history
+type HistoryFormat string
+
+const (
+	// HistoryFormatJSON writes an array of operations with their results
+	HistoryFormatJSON HistoryFormat = "json"
+	// HistoryFormatCSV writes one row per target result
+	HistoryFormatCSV HistoryFormat = "csv"
+)
+
+// historyColumns is the CSV header
+var historyColumns = []string{
+	"operation", "type", "status", "created_at", "ended_at",
+	"target", "success", "skipped", "output", "error", "reason", "attempts", "elapsed",
+}
+
+// EncodeHistory writes ops in the given format
+func EncodeHistory(w io.Writer, format HistoryFormat, ops []BatchOperation) error {
+	switch format {
+	case HistoryFormatJSON:
+		records := make([]operationRecord, 0, len(ops))
+		for _, op := range ops {
+			records = append(records, newOperationRecord(op))
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(records)
+
+	case HistoryFormatCSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write(historyColumns); err != nil {
+			return err
+		}
+		for _, op := range ops {
+			for _, r := range op.Results {
+				err := cw.Write([]string{
+					op.ID, string(op.Type), string(op.Status),
+					op.CreatedAt.Format(time.RFC3339), op.EndedAt.Format(time.RFC3339),
+					r.Target, strconv.FormatBool(r.Success), strconv.FormatBool(r.Skipped),
+					r.Output, r.Error, r.Reason, strconv.Itoa(r.Attempts), r.Elapsed.String(),
+				})
+				if err != nil {
+					return err
+				}
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+
+	default:
+		return fmt.Errorf("unsupported history format %q (want json or csv)", format)
+	}
+}
+
+// MemoryHistoryStore keeps history in memory, for tests and embedding
+type MemoryHistoryStore struct {
+	mu  sync.Mutex
+	ops map[string]BatchOperation
+}
+
+// NewMemoryHistoryStore creates an empty in-memory store
+func NewMemoryHistoryStore() *MemoryHistoryStore {
+	return &MemoryHistoryStore{ops: make(map[string]BatchOperation)}
+}
+
+// Save records an operation, replacing one with the same ID
+func (s *MemoryHistoryStore) Save(op BatchOperation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ops[op.ID] = op
+	return nil
+}
+
+// Get returns an operation by ID
+func (s *MemoryHistoryStore) Get(id string) (BatchOperation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	op, ok := s.ops[id]
+	if !ok {
+		return BatchOperation{}, fmt.Errorf("%w: %s", ErrOperationNotFound, id)
+	}
+	return op, nil
+}
+
+// Query returns the matching operations, oldest first
+func (s *MemoryHistoryStore) Query(q HistoryQuery) ([]BatchOperation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ops []BatchOperation
+	for _, op := range s.ops {
+		if q.Match(op) {
+			ops = append(ops, op)
+		}
+	}
+	return q.limit(ops), nil
+}
+
+// Prune removes the operations r does not retain
+func (s *MemoryHistoryStore) Prune(r HistoryRetention) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ops := make([]BatchOperation, 0, len(s.ops))
+	for _, op := range s.ops {
+		ops = append(ops, op)
+	}
+	ids := r.expired(HistoryQuery{}.limit(ops), time.Now())
+	for _, id := range ids {
+		delete(s.ops, id)
+	}
+	return len(ids), nil
+}
+
+// Close is a no-op for memory stores
+func (s *MemoryHistoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,179 @@
+// Copyright 2021 vjranagit
+//
+// Embedded database storage for batch operation history
+
+package registry
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// historyBucket holds operation records keyed by creation time and ID
+	historyBucket = []byte("operations")
+	// historyIDBucket maps operation IDs to their historyBucket key
+	historyIDBucket = []byte("ids")
+)
+
+// BoltHistoryStore keeps history in an embedded bbolt database, ordered by
+// creation time so queries and pruning walk it oldest first
+type BoltHistoryStore struct {
+	db *bolt.DB
+}
+
+// OpenBoltHistoryStore opens or creates the database at path
+func OpenBoltHistoryStore(path string) (*BoltHistoryStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open history database %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{historyBucket, historyIDBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltHistoryStore{db: db}, nil
+}
+
+// historyKey orders records by creation time, with the ID breaking ties
+func historyKey(op BatchOperation) []byte {
+	key := make([]byte, 8, 8+len(op.ID))
+	binary.BigEndian.PutUint64(key, uint64(op.CreatedAt.UnixNano()))
+	return append(key, op.ID...)
+}
+
+// Save records an operation, replacing one with the same ID
+func (s *BoltHistoryStore) Save(op BatchOperation) error {
+	data, err := json.Marshal(newOperationRecord(op))
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		ops, ids := tx.Bucket(historyBucket), tx.Bucket(historyIDBucket)
+		if old := ids.Get([]byte(op.ID)); old != nil {
+			if err := ops.Delete(old); err != nil {
+				return err
+			}
+		}
+		key := historyKey(op)
+		if err := ops.Put(key, data); err != nil {
+			return err
+		}
+		return ids.Put([]byte(op.ID), key)
+	})
+}
+
+// Get returns an operation by ID
+func (s *BoltHistoryStore) Get(id string) (BatchOperation, error) {
+	var op BatchOperation
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		key := tx.Bucket(historyIDBucket).Get([]byte(id))
+		if key == nil {
+			return fmt.Errorf("%w: %s", ErrOperationNotFound, id)
+		}
+		var err error
+		op, err = decodeHistory(tx.Bucket(historyBucket).Get(key))
+		return err
+	})
+	return op, err
+}
+
+// Query returns the matching operations, oldest first
+func (s *BoltHistoryStore) Query(q HistoryQuery) ([]BatchOperation, error) {
+	var ops []BatchOperation
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(historyBucket).Cursor()
+		k, v := c.First()
+		if !q.Since.IsZero() {
+			k, v = c.Seek(historyKey(BatchOperation{CreatedAt: q.Since}))
+		}
+		for ; k != nil; k, v = c.Next() {
+			op, err := decodeHistory(v)
+			if err != nil {
+				return fmt.Errorf("history record %x: %w", k, err)
+			}
+			if !q.Until.IsZero() && op.CreatedAt.After(q.Until) {
+				break
+			}
+			if q.Match(op) {
+				ops = append(ops, op)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return q.limit(ops), nil
+}
+
+// Prune removes the operations r does not retain
+func (s *BoltHistoryStore) Prune(r HistoryRetention) (int, error) {
+	pruned := 0
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		ops, ids := tx.Bucket(historyBucket), tx.Bucket(historyIDBucket)
+		excess := ops.Stats().KeyN - r.MaxCount
+		cutoff := historyKey(BatchOperation{CreatedAt: time.Now().Add(-r.MaxAge)})
+
+		var keys [][]byte
+		c := ops.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			tooMany := r.MaxCount > 0 && len(keys) < excess
+			tooOld := r.MaxAge > 0 && bytes.Compare(k[:8], cutoff) < 0
+			if !tooMany && !tooOld {
+				break
+			}
+			keys = append(keys, append([]byte(nil), k...))
+		}
+
+		for _, k := range keys {
+			if err := ops.Delete(k); err != nil {
+				return err
+			}
+			if err := ids.Delete(k[8:]); err != nil {
+				return err
+			}
+		}
+		pruned = len(keys)
+		return nil
+	})
+	return pruned, err
+}
+
+// Close closes the database
+func (s *BoltHistoryStore) Close() error {
+	return s.db.Close()
+}
+
+func decodeHistory(data []byte) (BatchOperation, error) {
+	var rec operationRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return BatchOperation{}, err
+	}
+	return rec.operation()
+}
@@ -0,0 +1,298 @@
+// Copyright 2021 vjranagit
+//
+// Batch history tests
+
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// historyOp returns a finished operation created age ago
+func historyOp(id string, opType BatchOpType, status BatchOpStatus, age time.Duration) BatchOperation {
+	created := time.Now().Add(-age).Truncate(time.Millisecond)
+	return BatchOperation{
+		ID:        id,
+		Type:      opType,
+		Status:    status,
+		Targets:   []string{"library/app:" + id},
+		CreatedAt: created,
+		StartedAt: created,
+		EndedAt:   created.Add(time.Second),
+		Results: []BatchOpResult{{
+			Target:   "library/app:" + id,
+			Success:  status == BatchOpCompleted,
+			Attempts: 2,
+			Elapsed:  1500 * time.Millisecond,
+		}},
+	}
+}
+
+// historyStores opens one store of each kind
+func historyStores(t *testing.T) map[string]HistoryStore {
+	t.Helper()
+
+	bolt, err := OpenBoltHistoryStore(filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatalf("OpenBoltHistoryStore failed: %v", err)
+	}
+	t.Cleanup(func() { bolt.Close() })
+
+	return map[string]HistoryStore{
+		"memory": NewMemoryHistoryStore(),
+		"bolt":   bolt,
+	}
+}
+
+func ids(ops []BatchOperation) []string {
+	out := make([]string, 0, len(ops))
+	for _, op := range ops {
+		out = append(out, op.ID)
+	}
+	return out
+}
+
+func TestHistoryStore_Query(t *testing.T) {
+	ops := []BatchOperation{
+		historyOp("a", BatchOpDelete, BatchOpCompleted, 72*time.Hour),
+		historyOp("b", BatchOpCopy, BatchOpFailed, 48*time.Hour),
+		historyOp("c", BatchOpDelete, BatchOpFailed, 24*time.Hour),
+		historyOp("d", BatchOpDelete, BatchOpCompleted, time.Hour),
+	}
+	now := time.Now()
+
+	tests := []struct {
+		name  string
+		query HistoryQuery
+		want  []string
+	}{
+		{"all", HistoryQuery{}, []string{"a", "b", "c", "d"}},
+		{"type", HistoryQuery{Type: BatchOpDelete}, []string{"a", "c", "d"}},
+		{"status", HistoryQuery{Status: BatchOpFailed}, []string{"b", "c"}},
+		{"since", HistoryQuery{Since: now.Add(-36 * time.Hour)}, []string{"c", "d"}},
+		{"until", HistoryQuery{Until: now.Add(-36 * time.Hour)}, []string{"a", "b"}},
+		{"range", HistoryQuery{Since: now.Add(-60 * time.Hour), Until: now.Add(-12 * time.Hour)}, []string{"b", "c"}},
+		{"limit keeps newest", HistoryQuery{Type: BatchOpDelete, Limit: 2}, []string{"c", "d"}},
+	}
+
+	for name, store := range historyStores(t) {
+		// Save out of order, and one twice, to check ordering and replacement
+		for _, i := range []int{2, 0, 3, 1, 2} {
+			if err := store.Save(ops[i]); err != nil {
+				t.Fatalf("%s: Save failed: %v", name, err)
+			}
+		}
+
+		for _, tt := range tests {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				got, err := store.Query(tt.query)
+				if err != nil {
+					t.Fatalf("Query failed: %v", err)
+				}
+				if g := ids(got); len(g) != len(tt.want) || !equalStrings(g, tt.want) {
+					t.Errorf("expected %v, got %v", tt.want, g)
+				}
+			})
+		}
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return len(a) == len(b)
+}
+
+func TestHistoryStore_Get(t *testing.T) {
+	for name, store := range historyStores(t) {
+		t.Run(name, func(t *testing.T) {
+			want := historyOp("a", BatchOpCopy, BatchOpCompleted, time.Hour)
+			want.Force = true
+			want.Results[0].Output = "mirror/library/app:a"
+			want.Results[0].Reason = "immutable"
+			if err := store.Save(want); err != nil {
+				t.Fatalf("Save failed: %v", err)
+			}
+
+			got, err := store.Get("a")
+			if err != nil {
+				t.Fatalf("Get failed: %v", err)
+			}
+			if got.Type != want.Type || got.Status != want.Status || !got.Force {
+				t.Errorf("expected %s %s forced, got %s %s force=%v", want.Type, want.Status, got.Type, got.Status, got.Force)
+			}
+			if !got.CreatedAt.Equal(want.CreatedAt) {
+				t.Errorf("expected created %v, got %v", want.CreatedAt, got.CreatedAt)
+			}
+			if len(got.Results) != 1 || got.Results[0] != want.Results[0] {
+				t.Errorf("expected results %+v, got %+v", want.Results, got.Results)
+			}
+
+			if _, err := store.Get("missing"); !errors.Is(err, ErrOperationNotFound) {
+				t.Errorf("expected ErrOperationNotFound, got %v", err)
+			}
+		})
+	}
+}
+
+func TestHistoryStore_Prune(t *testing.T) {
+	tests := []struct {
+		name      string
+		retention HistoryRetention
+		pruned    int
+		want      []string
+	}{
+		{"count", HistoryRetention{MaxCount: 2}, 2, []string{"c", "d"}},
+		{"age", HistoryRetention{MaxAge: 36 * time.Hour}, 2, []string{"c", "d"}},
+		{"both", HistoryRetention{MaxAge: 60 * time.Hour, MaxCount: 1}, 3, []string{"d"}},
+		{"unlimited", HistoryRetention{}, 0, []string{"a", "b", "c", "d"}},
+	}
+
+	for _, tt := range tests {
+		for name, store := range historyStores(t) {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				for i, id := range []string{"a", "b", "c", "d"} {
+					age := time.Duration(3-i) * 24 * time.Hour
+					store.Save(historyOp(id, BatchOpDelete, BatchOpCompleted, age+time.Hour))
+				}
+
+				pruned, err := store.Prune(tt.retention)
+				if err != nil {
+					t.Fatalf("Prune failed: %v", err)
+				}
+				if pruned != tt.pruned {
+					t.Errorf("expected %d pruned, got %d", tt.pruned, pruned)
+				}
+
+				got, _ := store.Query(HistoryQuery{})
+				if g := ids(got); !equalStrings(g, tt.want) {
+					t.Errorf("expected %v to remain, got %v", tt.want, g)
+				}
+				if len(tt.want) < 4 {
+					if _, err := store.Get("a"); !errors.Is(err, ErrOperationNotFound) {
+						t.Errorf("expected pruned operation to be gone, got %v", err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestBoltHistoryStore_Reopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+
+	store, err := OpenBoltHistoryStore(path)
+	if err != nil {
+		t.Fatalf("OpenBoltHistoryStore failed: %v", err)
+	}
+	store.Save(historyOp("a", BatchOpDelete, BatchOpCompleted, time.Hour))
+	store.Close()
+
+	store, err = OpenBoltHistoryStore(path)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer store.Close()
+
+	if _, err := store.Get("a"); err != nil {
+		t.Errorf("expected operation to survive reopen, got %v", err)
+	}
+}
+
+func TestEncodeHistory(t *testing.T) {
+	ops := []BatchOperation{historyOp("a", BatchOpDelete, BatchOpFailed, time.Hour)}
+	ops[0].Results[0].Error = "manifest unknown"
+
+	var buf bytes.Buffer
+	if err := EncodeHistory(&buf, HistoryFormatJSON, ops); err != nil {
+		t.Fatalf("EncodeHistory json failed: %v", err)
+	}
+	var records []map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &records); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if len(records) != 1 || records[0]["id"] != "a" || records[0]["status"] != "failed" {
+		t.Errorf("expected failed operation a, got %v", records)
+	}
+
+	buf.Reset()
+	if err := EncodeHistory(&buf, HistoryFormatCSV, ops); err != nil {
+		t.Fatalf("EncodeHistory csv failed: %v", err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("invalid CSV: %v", err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("expected header and 1 row, got %d rows", len(rows))
+	}
+	row := map[string]string{}
+	for i, col := range rows[0] {
+		row[col] = rows[1][i]
+	}
+	if row["target"] != "library/app:a" || row["error"] != "manifest unknown" || row["elapsed"] != "1.5s" {
+		t.Errorf("unexpected CSV row %v", row)
+	}
+
+	if err := EncodeHistory(&buf, "xml", ops); err == nil {
+		t.Error("expected error for unsupported format")
+	}
+}
+
+func TestBatchOperator_History(t *testing.T) {
+	store := NewMemoryHistoryStore()
+	store.Save(historyOp("old", BatchOpDelete, BatchOpCompleted, 24*time.Hour))
+
+	converter := &fakeConverter{}
+	bo := NewBatchOperator(2,
+		WithImageConverter(converter),
+		WithHistory(store),
+		WithHistoryRetention(HistoryRetention{MaxCount: 2}),
+	)
+
+	var last string
+	for i := 0; i < 3; i++ {
+		op, err := bo.ConvertImages(context.Background(), []string{"library/app:v1"}, "nydus")
+		if err != nil {
+			t.Fatalf("ConvertImages failed: %v", err)
+		}
+		waitOperation(t, bo, op.ID)
+		last = op.ID
+	}
+
+	// The store and memory both keep only the two newest
+	saved, _ := store.Query(HistoryQuery{})
+	if len(saved) != 2 || saved[1].ID != last {
+		t.Errorf("expected the 2 newest operations saved, got %v", ids(saved))
+	}
+	if got := len(bo.Snapshots()); got != 2 {
+		t.Errorf("expected 2 operations in memory, got %d", got)
+	}
+
+	got, err := bo.History(HistoryQuery{Type: BatchOpConvert})
+	if err != nil {
+		t.Fatalf("History failed: %v", err)
+	}
+	if len(got) != 2 || got[1].ID != last || len(got[1].Results) != 1 {
+		t.Errorf("expected the 2 newest conversions, got %v", ids(got))
+	}
+
+	// Operations evicted from memory are still found in the store
+	store.Save(historyOp("archived", BatchOpDelete, BatchOpCompleted, time.Minute))
+	if op, ok := bo.Snapshot("archived"); !ok || op.Status != BatchOpCompleted {
+		t.Errorf("expected Snapshot to fall back to the store, got %v %+v", ok, op)
+	}
+	if _, err := bo.Wait(context.Background(), "archived"); err != nil {
+		t.Errorf("expected Wait to fall back to the store, got %v", err)
+	}
+}
@@ -6,22 +6,40 @@ package registry
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"sort"
 	"sync"
 	"time"
+
+	"github.com/vjranagit/harbor/pkg/distribution"
+	"github.com/vjranagit/harbor/pkg/events"
 )
 
 // BatchOperation represents a batch operation request
 type BatchOperation struct {
-	ID        string
-	Type      BatchOpType
-	Targets   []string
-	Status    BatchOpStatus
-	Results   []BatchOpResult
+	ID      string
+	Type    BatchOpType
+	Targets []string
+	Status  BatchOpStatus
+	// Results grow in completion order while the operation runs and are
+	// in target order once it has finished
+	Results []BatchOpResult
+	// Retry is the policy applied to each target
+	Retry RetryPolicy
+	// Force acts on targets the protection guard blocks
+	Force     bool
 	CreatedAt time.Time
 	StartedAt time.Time
 	EndedAt   time.Time
+
+	done   chan struct{}
+	cancel context.CancelFunc
+	// overrides holds the protection reasons Force overrode, by target
+	overrides map[string]string
+	// subscribers receive progress updates until the operation finishes
+	subscribers []chan BatchProgress
 }
 
 // BatchOpType defines the type of batch operation
@@ -42,75 +60,153 @@ const (
 	BatchOpRunning   BatchOpStatus = "running"
 	BatchOpCompleted BatchOpStatus = "completed"
 	BatchOpFailed    BatchOpStatus = "failed"
+	BatchOpCancelled BatchOpStatus = "cancelled"
+)
+
+// Finished reports whether an operation with this status has ended
+func (s BatchOpStatus) Finished() bool {
+	return s == BatchOpCompleted || s == BatchOpFailed || s == BatchOpCancelled
+}
+
+var (
+	// ErrOperationNotFound is returned for unknown operation IDs
+	ErrOperationNotFound = errors.New("operation not found")
+	// ErrOperationFinished is returned when cancelling an operation that
+	// has already ended
+	ErrOperationFinished = errors.New("operation already finished")
 )
 
 // BatchOpResult represents the result of a single operation
 type BatchOpResult struct {
-	Target  string
+	Target string
+	// Output is the reference the operation produced, if any
+	Output  string
 	Success bool
 	Error   string
-	Elapsed time.Duration
+	// Skipped is set when the protection guard blocked the target
+	Skipped bool
+	// Reason is why the guard blocked the target, whether it was skipped
+	// or acted on by a forced operation
+	Reason string
+	// Attempts is how many times the target was tried; zero when it was
+	// never started
+	Attempts int
+	Elapsed  time.Duration
+}
+
+// ImageConverter converts an image into an accelerated format and returns
+// the reference it was pushed under
+type ImageConverter interface {
+	ConvertImage(ctx context.Context, source, driver string) (string, error)
+	// TargetTag derives the tag a conversion of ref with driver pushes
+	TargetTag(ref distribution.Reference, driver string) string
 }
 
+// batchHandler processes one target and returns the reference it produced
+type batchHandler func(ctx context.Context, target string) (string, error)
+
 // BatchOperator manages batch operations
 type BatchOperator struct {
 	operations map[string]*BatchOperation
 	mu         sync.RWMutex
 	workers    int
+	client     *distribution.Client
+	converter  ImageConverter
+	retry      RetryPolicy
+	guard      ProtectionGuard
+	history    HistoryStore
+	retention  HistoryRetention
+	events     *events.Bus
 	logger     *slog.Logger
 }
 
-// NewBatchOperator creates a new batch operator
-func NewBatchOperator(workers int) *BatchOperator {
-	return &BatchOperator{
+// BatchOption configures a BatchOperator
+type BatchOption func(*BatchOperator)
+
+// WithRegistryClient sets the registry client batch handlers act through
+func WithRegistryClient(client *distribution.Client) BatchOption {
+	return func(bo *BatchOperator) {
+		bo.client = client
+	}
+}
+
+// WithImageConverter sets the converter used by ConvertImages
+func WithImageConverter(converter ImageConverter) BatchOption {
+	return func(bo *BatchOperator) {
+		bo.converter = converter
+	}
+}
+
+// WithRetryPolicy sets the retry policy of operations that do not set
+// their own
+func WithRetryPolicy(p RetryPolicy) BatchOption {
+	return func(bo *BatchOperator) {
+		bo.retry = p
+	}
+}
+
+// OperationOption configures a single batch operation
+type OperationOption func(*BatchOperation)
+
+// WithOperationRetry overrides the operator's retry policy for one operation
+func WithOperationRetry(p RetryPolicy) OperationOption {
+	return func(op *BatchOperation) {
+		op.Retry = p
+	}
+}
+
+// WithBatchEvents publishes operation start and completion on bus
+func WithBatchEvents(bus *events.Bus) BatchOption {
+	return func(bo *BatchOperator) {
+		bo.events = bus
+	}
+}
+
+// NewBatchOperator creates a new batch operator. Fewer than 1 worker is
+// raised to 1
+func NewBatchOperator(workers int, opts ...BatchOption) *BatchOperator {
+	bo := &BatchOperator{
 		operations: make(map[string]*BatchOperation),
-		workers:    workers,
+		workers:    max(workers, 1),
+		retry:      DefaultRetryPolicy(),
+		retention:  DefaultHistoryRetention(),
 		logger:     slog.Default().With("component", "batch_operator"),
 	}
+	for _, opt := range opts {
+		opt(bo)
+	}
+	return bo
 }
 
 // DeleteTags performs batch deletion of tags
-func (bo *BatchOperator) DeleteTags(ctx context.Context, tags []string) (*BatchOperation, error) {
-	op := &BatchOperation{
-		ID:        generateID(),
-		Type:      BatchOpDelete,
-		Targets:   tags,
-		Status:    BatchOpPending,
-		CreatedAt: time.Now(),
-	}
-
-	bo.mu.Lock()
-	bo.operations[op.ID] = op
-	bo.mu.Unlock()
+func (bo *BatchOperator) DeleteTags(ctx context.Context, tags []string, opts ...OperationOption) (*BatchOperation, error) {
+	op := bo.newOperation(BatchOpDelete, tags, opts)
 
 	bo.logger.InfoContext(ctx, "batch delete initiated",
 		"id", op.ID,
 		"count", len(tags),
 	)
 
-	// Execute batch operation
-	go bo.executeBatch(ctx, op, func(ctx context.Context, target string) error {
-		// Simulate tag deletion (would call actual registry API)
-		time.Sleep(100 * time.Millisecond)
-		return nil
+	bo.launch(ctx, op, func(ctx context.Context, target string) (string, error) {
+		ref, err := bo.parseTarget(target)
+		if err != nil {
+			return "", err
+		}
+		if err := bo.checkDelete(ctx, op, target, ref); err != nil {
+			return "", err
+		}
+		if ref.Digest != "" {
+			return "", bo.client.DeleteManifest(ctx, ref.Repository, ref.Digest)
+		}
+		return "", bo.client.DeleteTag(ctx, ref.Repository, ref.Tag)
 	})
 
 	return op, nil
 }
 
 // CopyTags performs batch copying of tags
-func (bo *BatchOperator) CopyTags(ctx context.Context, sources []string, destPrefix string) (*BatchOperation, error) {
-	op := &BatchOperation{
-		ID:        generateID(),
-		Type:      BatchOpCopy,
-		Targets:   sources,
-		Status:    BatchOpPending,
-		CreatedAt: time.Now(),
-	}
-
-	bo.mu.Lock()
-	bo.operations[op.ID] = op
-	bo.mu.Unlock()
+func (bo *BatchOperator) CopyTags(ctx context.Context, sources []string, destPrefix string, opts ...OperationOption) (*BatchOperation, error) {
+	op := bo.newOperation(BatchOpCopy, sources, opts)
 
 	bo.logger.InfoContext(ctx, "batch copy initiated",
 		"id", op.ID,
@@ -118,45 +214,83 @@ func (bo *BatchOperator) CopyTags(ctx context.Context, sources []string, destPre
 		"dest_prefix", destPrefix,
 	)
 
-	go bo.executeBatch(ctx, op, func(ctx context.Context, source string) error {
-		// Simulate tag copy (would call actual registry API)
-		time.Sleep(200 * time.Millisecond)
-		return nil
+	bo.launch(ctx, op, func(ctx context.Context, source string) (string, error) {
+		src, err := bo.parseTarget(source)
+		if err != nil {
+			return "", err
+		}
+		dst := src
+		dst.Repository = destPrefix + src.Repository
+		if err := bo.checkModify(ctx, op, source, dst); err != nil {
+			return "", err
+		}
+		if _, err := bo.client.CopyManifest(ctx, src.Repository, src.Identifier(), dst.Repository, dst.Identifier()); err != nil {
+			return "", err
+		}
+		return dst.String(), nil
 	})
 
 	return op, nil
 }
 
 // RetagBatch performs batch retagging operations
-func (bo *BatchOperator) RetagBatch(ctx context.Context, mappings map[string]string) (*BatchOperation, error) {
+func (bo *BatchOperator) RetagBatch(ctx context.Context, mappings map[string]string, opts ...OperationOption) (*BatchOperation, error) {
 	targets := make([]string, 0, len(mappings))
 	for source := range mappings {
 		targets = append(targets, source)
 	}
 
-	op := &BatchOperation{
-		ID:        generateID(),
-		Type:      BatchOpTag,
-		Targets:   targets,
-		Status:    BatchOpPending,
-		CreatedAt: time.Now(),
-	}
-
-	bo.mu.Lock()
-	bo.operations[op.ID] = op
-	bo.mu.Unlock()
+	op := bo.newOperation(BatchOpTag, targets, opts)
 
 	bo.logger.InfoContext(ctx, "batch retag initiated",
 		"id", op.ID,
 		"count", len(mappings),
 	)
 
-	go bo.executeBatch(ctx, op, func(ctx context.Context, source string) error {
-		dest := mappings[source]
-		// Simulate retagging (would call actual registry API)
-		_ = dest
-		time.Sleep(150 * time.Millisecond)
-		return nil
+	bo.launch(ctx, op, func(ctx context.Context, source string) (string, error) {
+		src, err := bo.parseTarget(source)
+		if err != nil {
+			return "", err
+		}
+		dst, err := bo.parseTarget(mappings[source])
+		if err != nil {
+			return "", err
+		}
+		if dst.Digest != "" {
+			return "", fmt.Errorf("retag destination %s must be a tag", dst)
+		}
+		if err := bo.checkModify(ctx, op, source, dst); err != nil {
+			return "", err
+		}
+		if _, err := bo.client.CopyManifest(ctx, src.Repository, src.Identifier(), dst.Repository, dst.Tag); err != nil {
+			return "", err
+		}
+		return dst.String(), nil
+	})
+
+	return op, nil
+}
+
+// ConvertImages converts images into an accelerated format with the named
+// driver, e.g. "nydus" or "estargz"
+func (bo *BatchOperator) ConvertImages(ctx context.Context, sources []string, driver string, opts ...OperationOption) (*BatchOperation, error) {
+	if bo.converter == nil {
+		return nil, fmt.Errorf("no image converter configured")
+	}
+
+	op := bo.newOperation(BatchOpConvert, sources, opts)
+
+	bo.logger.InfoContext(ctx, "batch convert initiated",
+		"id", op.ID,
+		"count", len(sources),
+		"driver", driver,
+	)
+
+	bo.launch(ctx, op, func(ctx context.Context, source string) (string, error) {
+		if err := bo.checkConvert(ctx, op, source, driver); err != nil {
+			return "", err
+		}
+		return bo.converter.ConvertImage(ctx, source, driver)
 	})
 
 	return op, nil
@@ -171,6 +305,101 @@ func (bo *BatchOperator) GetOperation(id string) (*BatchOperation, bool) {
 	return op, ok
 }
 
+// Snapshot returns a copy of an operation that is safe to read while the
+// operation is still running. Operations no longer held in memory are
+// looked up in the history store
+func (bo *BatchOperator) Snapshot(id string) (BatchOperation, bool) {
+	bo.mu.RLock()
+	op, ok := bo.operations[id]
+	var snapshot BatchOperation
+	if ok {
+		snapshot = *op
+	}
+	bo.mu.RUnlock()
+
+	if ok || bo.history == nil {
+		return snapshot, ok
+	}
+	snapshot, err := bo.history.Get(id)
+	return snapshot, err == nil
+}
+
+// Snapshots returns copies of all operations, oldest first
+func (bo *BatchOperator) Snapshots() []BatchOperation {
+	bo.mu.RLock()
+	ops := make([]BatchOperation, 0, len(bo.operations))
+	for _, op := range bo.operations {
+		ops = append(ops, *op)
+	}
+	bo.mu.RUnlock()
+
+	sort.Slice(ops, func(i, j int) bool {
+		return ops[i].CreatedAt.Before(ops[j].CreatedAt)
+	})
+	return ops
+}
+
+// Wait blocks until the operation finishes or ctx is done
+func (bo *BatchOperator) Wait(ctx context.Context, id string) (*BatchOperation, error) {
+	op, ok := bo.GetOperation(id)
+	if !ok && bo.history != nil {
+		// Finished operations evicted from memory are in the history
+		if saved, err := bo.history.Get(id); err == nil {
+			return &saved, nil
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("operation %s not found", id)
+	}
+
+	select {
+	case <-op.done:
+		return op, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Cancel stops a pending or running operation. Targets already processed
+// keep their results; the others are recorded as not started
+func (bo *BatchOperator) Cancel(id string) (BatchOperation, error) {
+	bo.mu.RLock()
+	defer bo.mu.RUnlock()
+
+	op, ok := bo.operations[id]
+	if !ok {
+		return BatchOperation{}, fmt.Errorf("%w: %s", ErrOperationNotFound, id)
+	}
+	if op.Status.Finished() {
+		return BatchOperation{}, fmt.Errorf("%w: %s is %s", ErrOperationFinished, id, op.Status)
+	}
+
+	op.cancel()
+	bo.logger.Info("batch operation cancelled", "id", id)
+	return *op, nil
+}
+
+// CancelAll stops every pending or running operation and returns their IDs
+func (bo *BatchOperator) CancelAll() []string {
+	bo.mu.RLock()
+	defer bo.mu.RUnlock()
+
+	var ids []string
+	for id, op := range bo.operations {
+		if op.Status.Finished() {
+			continue
+		}
+		op.cancel()
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	if len(ids) > 0 {
+		bo.logger.Info("batch operations cancelled", "count", len(ids))
+	}
+	return ids
+}
+
 // ListOperations returns all batch operations
 func (bo *BatchOperator) ListOperations() []*BatchOperation {
 	bo.mu.RLock()
@@ -183,14 +412,53 @@ func (bo *BatchOperator) ListOperations() []*BatchOperation {
 	return ops
 }
 
+// newOperation creates a pending operation with the operator's retry policy
+// and opts applied
+func (bo *BatchOperator) newOperation(opType BatchOpType, targets []string, opts []OperationOption) *BatchOperation {
+	op := &BatchOperation{
+		ID:        generateID(),
+		Type:      opType,
+		Targets:   targets,
+		Status:    BatchOpPending,
+		Retry:     bo.retry,
+		CreatedAt: time.Now(),
+		done:      make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(op)
+	}
+	return op
+}
+
+// launch registers op and runs it in the background on a context that
+// Cancel can stop
+func (bo *BatchOperator) launch(ctx context.Context, op *BatchOperation, handler batchHandler) {
+	ctx, op.cancel = context.WithCancel(ctx)
+
+	bo.mu.Lock()
+	bo.operations[op.ID] = op
+	bo.mu.Unlock()
+
+	go func() {
+		defer op.cancel()
+		bo.executeBatch(ctx, op, handler)
+	}()
+}
+
 // executeBatch runs a batch operation with worker pool
-func (bo *BatchOperator) executeBatch(ctx context.Context, op *BatchOperation, handler func(context.Context, string) error) {
+func (bo *BatchOperator) executeBatch(ctx context.Context, op *BatchOperation, handler batchHandler) {
 	// Update status to running
 	bo.mu.Lock()
 	op.Status = BatchOpRunning
 	op.StartedAt = time.Now()
 	bo.mu.Unlock()
 
+	bo.events.Publish(ctx, events.BatchStarted{
+		ID:      op.ID,
+		Type:    string(op.Type),
+		Targets: len(op.Targets),
+	})
+
 	results := make([]BatchOpResult, len(op.Targets))
 	var wg sync.WaitGroup
 	semaphore := make(chan struct{}, bo.workers)
@@ -200,21 +468,34 @@ func (bo *BatchOperator) executeBatch(ctx context.Context, op *BatchOperation, h
 		go func(idx int, tgt string) {
 			defer wg.Done()
 
-			semaphore <- struct{}{}
-			defer func() { <-semaphore }()
+			select {
+			case semaphore <- struct{}{}:
+				defer func() { <-semaphore }()
+			case <-ctx.Done():
+			}
+			if err := ctx.Err(); err != nil {
+				bo.finishTarget(op, results, idx, BatchOpResult{Target: tgt, Error: "not started: " + err.Error()})
+				return
+			}
 
 			start := time.Now()
-			err := handler(ctx, tgt)
+			output, attempts, err := bo.runWithRetry(ctx, op, handler, tgt)
 			elapsed := time.Since(start)
 
-			results[idx] = BatchOpResult{
-				Target:  tgt,
-				Success: err == nil,
-				Elapsed: elapsed,
+			result := BatchOpResult{
+				Target:   tgt,
+				Output:   output,
+				Success:  err == nil,
+				Attempts: attempts,
+				Elapsed:  elapsed,
 			}
-			if err != nil {
-				results[idx].Error = err.Error()
+			if protected, ok := isProtected(err); ok {
+				result.Skipped = true
+				result.Reason = protected.Reason
+			} else if err != nil {
+				result.Error = err.Error()
 			}
+			bo.finishTarget(op, results, idx, result)
 		}(i, target)
 	}
 
@@ -226,14 +507,34 @@ func (bo *BatchOperator) executeBatch(ctx context.Context, op *BatchOperation, h
 	op.EndedAt = time.Now()
 	op.Status = BatchOpCompleted
 
-	// Check if any failed
+	// Check if any failed; skipped targets were refused on purpose
+	failed, skipped := 0, 0
 	for _, result := range results {
-		if !result.Success {
+		switch {
+		case result.Skipped:
+			skipped++
+		case !result.Success:
 			op.Status = BatchOpFailed
-			break
+			failed++
 		}
 	}
+	if failed > 0 && ctx.Err() != nil {
+		op.Status = BatchOpCancelled
+	}
+	op.notify(nil)
 	bo.mu.Unlock()
+	bo.record(ctx, op)
+	close(op.done)
+
+	bo.events.Publish(ctx, events.BatchCompleted{
+		ID:        op.ID,
+		Type:      string(op.Type),
+		Status:    string(op.Status),
+		Succeeded: len(results) - failed - skipped,
+		Failed:    failed,
+		Skipped:   skipped,
+		Duration:  op.EndedAt.Sub(op.StartedAt),
+	})
 
 	bo.logger.InfoContext(ctx, "batch operation completed",
 		"id", op.ID,
@@ -242,6 +543,22 @@ func (bo *BatchOperator) executeBatch(ctx context.Context, op *BatchOperation, h
 	)
 }
 
+// parseTarget parses a batch target into a reference on the configured registry
+func (bo *BatchOperator) parseTarget(target string) (distribution.Reference, error) {
+	if bo.client == nil {
+		return distribution.Reference{}, fmt.Errorf("no registry client configured")
+	}
+
+	ref, err := distribution.ParseReference(target)
+	if err != nil {
+		return distribution.Reference{}, err
+	}
+	if ref.Registry != "" && ref.Registry != bo.client.Registry() {
+		return distribution.Reference{}, fmt.Errorf("target %s is not on registry %s", target, bo.client.Registry())
+	}
+	return ref, nil
+}
+
 // generateID generates a unique operation ID
 func generateID() string {
 	return fmt.Sprintf("batch-%d", time.Now().UnixNano())
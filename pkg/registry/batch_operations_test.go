@@ -6,12 +6,53 @@ package registry
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/vjranagit/harbor/pkg/distribution"
+	"github.com/vjranagit/harbor/pkg/distribution/registrytest"
+	"github.com/vjranagit/harbor/pkg/events"
 )
 
+// newTestBatchOperator returns a batch operator wired to an in-process registry
+func newTestBatchOperator(t *testing.T, workers int, reg *registrytest.Registry) *BatchOperator {
+	t.Helper()
+
+	client, err := distribution.NewClient(reg.URL())
+	if err != nil {
+		t.Fatalf("failed to create registry client: %v", err)
+	}
+	return NewBatchOperator(workers, WithRegistryClient(client))
+}
+
+// waitOperation waits for an operation to finish
+func waitOperation(t *testing.T, bo *BatchOperator, id string) *BatchOperation {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	op, err := bo.Wait(ctx, id)
+	if err != nil {
+		t.Fatalf("operation %s did not finish: %v", id, err)
+	}
+	return op
+}
+
 func TestBatchOperator_DeleteTags(t *testing.T) {
-	bo := NewBatchOperator(5)
+	reg := registrytest.New()
+	defer reg.Close()
+
+	reg.PushImage("library/nginx", "old-1", nil, []byte("nginx-1"))
+	reg.PushImage("library/nginx", "old-2", nil, []byte("nginx-2"))
+	reg.PushImage("library/nginx", "stable", nil, []byte("nginx-3"))
+	reg.PushImage("library/redis", "deprecated", nil, []byte("redis"))
+
+	bo := newTestBatchOperator(t, 5, reg)
 	tags := []string{
 		"library/nginx:old-1",
 		"library/nginx:old-2",
@@ -31,13 +72,7 @@ func TestBatchOperator_DeleteTags(t *testing.T) {
 		t.Errorf("expected %d targets, got %d", len(tags), len(op.Targets))
 	}
 
-	// Wait for completion
-	time.Sleep(1 * time.Second)
-
-	retrieved, ok := bo.GetOperation(op.ID)
-	if !ok {
-		t.Fatal("operation not found")
-	}
+	retrieved := waitOperation(t, bo, op.ID)
 
 	if retrieved.Status != BatchOpCompleted {
 		t.Errorf("expected status %s, got %s", BatchOpCompleted, retrieved.Status)
@@ -46,10 +81,48 @@ func TestBatchOperator_DeleteTags(t *testing.T) {
 	if len(retrieved.Results) != len(tags) {
 		t.Errorf("expected %d results, got %d", len(tags), len(retrieved.Results))
 	}
+
+	if got := reg.Tags("library/nginx"); len(got) != 1 || got[0] != "stable" {
+		t.Errorf("expected only stable tag to remain, got %v", got)
+	}
+	if got := reg.Tags("library/redis"); len(got) != 0 {
+		t.Errorf("expected redis tags to be deleted, got %v", got)
+	}
+}
+
+func TestBatchOperator_DeleteMissingTag(t *testing.T) {
+	reg := registrytest.New()
+	defer reg.Close()
+
+	reg.PushImage("library/nginx", "old-1", nil, []byte("nginx-1"))
+
+	bo := newTestBatchOperator(t, 2, reg)
+	op, err := bo.DeleteTags(context.Background(), []string{"library/nginx:old-1", "library/nginx:missing"})
+	if err != nil {
+		t.Fatalf("DeleteTags failed: %v", err)
+	}
+
+	retrieved := waitOperation(t, bo, op.ID)
+	if retrieved.Status != BatchOpFailed {
+		t.Errorf("expected status %s, got %s", BatchOpFailed, retrieved.Status)
+	}
+
+	for _, result := range retrieved.Results {
+		wantSuccess := result.Target == "library/nginx:old-1"
+		if result.Success != wantSuccess {
+			t.Errorf("target %s: success = %v, want %v (error: %s)", result.Target, result.Success, wantSuccess, result.Error)
+		}
+	}
 }
 
 func TestBatchOperator_CopyTags(t *testing.T) {
-	bo := NewBatchOperator(3)
+	reg := registrytest.New()
+	defer reg.Close()
+
+	reg.PushImage("library/nginx", "1.20", nil, []byte("nginx-1.20"))
+	reg.PushImage("library/nginx", "1.21", nil, []byte("nginx-1.21"))
+
+	bo := newTestBatchOperator(t, 3, reg)
 	sources := []string{
 		"library/nginx:1.20",
 		"library/nginx:1.21",
@@ -64,21 +137,26 @@ func TestBatchOperator_CopyTags(t *testing.T) {
 		t.Errorf("expected type %s, got %s", BatchOpCopy, op.Type)
 	}
 
-	// Wait for completion
-	time.Sleep(1 * time.Second)
-
-	retrieved, ok := bo.GetOperation(op.ID)
-	if !ok {
-		t.Fatal("operation not found")
-	}
+	retrieved := waitOperation(t, bo, op.ID)
 
 	if retrieved.Status != BatchOpCompleted {
 		t.Errorf("expected status %s, got %s", BatchOpCompleted, retrieved.Status)
 	}
+
+	if got := reg.Tags("backup/library/nginx"); len(got) != 2 {
+		t.Errorf("expected 2 tags in backup repository, got %v", got)
+	}
 }
 
 func TestBatchOperator_RetagBatch(t *testing.T) {
-	bo := NewBatchOperator(4)
+	reg := registrytest.New()
+	defer reg.Close()
+
+	reg.PushImage("library/app", "latest", nil, []byte("app-latest"))
+	reg.PushImage("library/app", "nightly", nil, []byte("app-nightly"))
+	reg.PushImage("library/app", "unstable", nil, []byte("app-unstable"))
+
+	bo := newTestBatchOperator(t, 4, reg)
 	mappings := map[string]string{
 		"library/app:latest":   "library/app:v1.0.0",
 		"library/app:nightly":  "library/app:v1.1.0-beta",
@@ -94,13 +172,7 @@ func TestBatchOperator_RetagBatch(t *testing.T) {
 		t.Errorf("expected type %s, got %s", BatchOpTag, op.Type)
 	}
 
-	// Wait for completion
-	time.Sleep(1 * time.Second)
-
-	retrieved, ok := bo.GetOperation(op.ID)
-	if !ok {
-		t.Fatal("operation not found")
-	}
+	retrieved := waitOperation(t, bo, op.ID)
 
 	if retrieved.Status != BatchOpCompleted {
 		t.Errorf("expected status %s, got %s", BatchOpCompleted, retrieved.Status)
@@ -116,19 +188,282 @@ func TestBatchOperator_RetagBatch(t *testing.T) {
 			t.Errorf("operation failed for %s: %s", result.Target, result.Error)
 		}
 	}
+
+	for source, dest := range mappings {
+		srcPayload, _, _ := reg.Manifest("library/app", source[len("library/app:"):])
+		dstPayload, _, ok := reg.Manifest("library/app", dest[len("library/app:"):])
+		if !ok || string(srcPayload) != string(dstPayload) {
+			t.Errorf("expected %s to point at the manifest of %s", dest, source)
+		}
+	}
 }
 
 func TestBatchOperator_ListOperations(t *testing.T) {
-	bo := NewBatchOperator(2)
+	reg := registrytest.New()
+	defer reg.Close()
+
+	reg.PushImage("test", "1", nil)
+	reg.PushImage("test", "2", nil)
+
+	bo := newTestBatchOperator(t, 2, reg)
 
 	// Create multiple operations
-	bo.DeleteTags(context.Background(), []string{"test:1"})
-	bo.CopyTags(context.Background(), []string{"test:2"}, "backup/")
+	del, _ := bo.DeleteTags(context.Background(), []string{"test:1"})
+	cp, _ := bo.CopyTags(context.Background(), []string{"test:2"}, "backup/")
 
-	time.Sleep(500 * time.Millisecond)
+	waitOperation(t, bo, del.ID)
+	waitOperation(t, bo, cp.ID)
 
 	ops := bo.ListOperations()
 	if len(ops) != 2 {
 		t.Errorf("expected 2 operations, got %d", len(ops))
 	}
 }
+
+func TestBatchOperator_Snapshots(t *testing.T) {
+	reg := registrytest.New()
+	defer reg.Close()
+
+	reg.PushImage("test", "1", nil)
+
+	bo := newTestBatchOperator(t, 2, reg)
+
+	first, _ := bo.CopyTags(context.Background(), []string{"test:1"}, "backup/")
+	waitOperation(t, bo, first.ID)
+	second, _ := bo.DeleteTags(context.Background(), []string{"test:1"})
+	waitOperation(t, bo, second.ID)
+
+	ops := bo.Snapshots()
+	if len(ops) != 2 || ops[0].ID != first.ID || ops[1].ID != second.ID {
+		t.Fatalf("expected operations oldest first, got %+v", ops)
+	}
+
+	op, ok := bo.Snapshot(first.ID)
+	if !ok || op.Status != BatchOpCompleted || len(op.Results) != 1 {
+		t.Errorf("expected completed snapshot with 1 result, got %+v", op)
+	}
+	if _, ok := bo.Snapshot("batch-missing"); ok {
+		t.Error("expected unknown operation to be reported missing")
+	}
+}
+
+func TestBatchOperator_NoClient(t *testing.T) {
+	bo := NewBatchOperator(1)
+
+	op, err := bo.DeleteTags(context.Background(), []string{"library/nginx:old-1"})
+	if err != nil {
+		t.Fatalf("DeleteTags failed: %v", err)
+	}
+
+	retrieved := waitOperation(t, bo, op.ID)
+	if retrieved.Status != BatchOpFailed {
+		t.Errorf("expected status %s without a registry client, got %s", BatchOpFailed, retrieved.Status)
+	}
+}
+
+// fakeConverter records conversions, fails sources containing "broken" and
+// blocks on sources containing "slow" until cancelled
+type fakeConverter struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (f *fakeConverter) ConvertImage(ctx context.Context, source, driver string) (string, error) {
+	f.mu.Lock()
+	f.calls = append(f.calls, source+"/"+driver)
+	f.mu.Unlock()
+
+	if strings.Contains(source, "broken") {
+		return "", fmt.Errorf("conversion failed")
+	}
+	if strings.Contains(source, "slow") {
+		<-ctx.Done()
+		return "", ctx.Err()
+	}
+	return source + "-" + driver, nil
+}
+
+func (f *fakeConverter) TargetTag(ref distribution.Reference, driver string) string {
+	return ref.Tag + "-" + driver
+}
+
+// started returns how many conversions have started
+func (f *fakeConverter) started() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.calls)
+}
+
+// waitStarted waits until n conversions have started
+func waitStarted(t *testing.T, f *fakeConverter, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for f.started() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d conversions to start, got %d", n, f.started())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestBatchOperator_ConvertImages(t *testing.T) {
+	converter := &fakeConverter{}
+	bo := NewBatchOperator(2, WithImageConverter(converter))
+
+	sources := []string{"library/app:v1", "library/app:v2", "library/broken:v1"}
+	op, err := bo.ConvertImages(context.Background(), sources, "nydus")
+	if err != nil {
+		t.Fatalf("ConvertImages failed: %v", err)
+	}
+	if op.Type != BatchOpConvert {
+		t.Errorf("expected type %s, got %s", BatchOpConvert, op.Type)
+	}
+
+	op = waitOperation(t, bo, op.ID)
+	if op.Status != BatchOpFailed {
+		t.Errorf("expected status %s, got %s", BatchOpFailed, op.Status)
+	}
+	if len(converter.calls) != len(sources) {
+		t.Errorf("expected %d conversions, got %d", len(sources), len(converter.calls))
+	}
+
+	for _, result := range op.Results {
+		switch result.Target {
+		case "library/broken:v1":
+			if result.Success || result.Error == "" {
+				t.Errorf("expected %s to fail", result.Target)
+			}
+		default:
+			if !result.Success || result.Output != result.Target+"-nydus" {
+				t.Errorf("unexpected result for %s: %+v", result.Target, result)
+			}
+		}
+	}
+}
+
+func TestBatchOperator_Cancel(t *testing.T) {
+	converter := &fakeConverter{}
+	bo := NewBatchOperator(2, WithImageConverter(converter))
+
+	sources := []string{"library/app:v1", "library/app:v2", "library/slow:v1"}
+	op, err := bo.ConvertImages(context.Background(), sources, "nydus")
+	if err != nil {
+		t.Fatalf("ConvertImages failed: %v", err)
+	}
+	waitStarted(t, converter, len(sources))
+
+	if _, err := bo.Cancel(op.ID); err != nil {
+		t.Fatalf("Cancel failed: %v", err)
+	}
+	op = waitOperation(t, bo, op.ID)
+	if op.Status != BatchOpCancelled {
+		t.Errorf("expected status %s, got %s", BatchOpCancelled, op.Status)
+	}
+
+	// Targets finished before the cancel keep their results
+	for _, result := range op.Results {
+		switch result.Target {
+		case "library/slow:v1":
+			if result.Success || !strings.Contains(result.Error, "canceled") {
+				t.Errorf("expected %s to be cancelled, got %+v", result.Target, result)
+			}
+		default:
+			if !result.Success || result.Output != result.Target+"-nydus" {
+				t.Errorf("expected %s to be converted, got %+v", result.Target, result)
+			}
+		}
+	}
+
+	if _, err := bo.Cancel(op.ID); !errors.Is(err, ErrOperationFinished) {
+		t.Errorf("expected ErrOperationFinished, got %v", err)
+	}
+	if _, err := bo.Cancel("batch-missing"); !errors.Is(err, ErrOperationNotFound) {
+		t.Errorf("expected ErrOperationNotFound, got %v", err)
+	}
+}
+
+func TestBatchOperator_CancelAll(t *testing.T) {
+	converter := &fakeConverter{}
+	bo := NewBatchOperator(1, WithImageConverter(converter))
+
+	first, _ := bo.ConvertImages(context.Background(), []string{"library/slow:v1", "library/slow:v2"}, "nydus")
+	second, _ := bo.ConvertImages(context.Background(), []string{"library/slow:v3"}, "estargz")
+	done, _ := bo.ConvertImages(context.Background(), []string{"library/app:v1"}, "nydus")
+	waitOperation(t, bo, done.ID)
+	waitStarted(t, converter, 3)
+
+	ids := bo.CancelAll()
+	if len(ids) != 2 {
+		t.Fatalf("expected 2 operations cancelled, got %v", ids)
+	}
+
+	op := waitOperation(t, bo, first.ID)
+	if op.Status != BatchOpCancelled {
+		t.Errorf("expected status %s, got %s", BatchOpCancelled, op.Status)
+	}
+	notStarted := 0
+	for _, result := range op.Results {
+		if strings.HasPrefix(result.Error, "not started") {
+			notStarted++
+		}
+	}
+	if notStarted != 1 {
+		t.Errorf("expected 1 target not started with one worker, got %d: %+v", notStarted, op.Results)
+	}
+
+	if op := waitOperation(t, bo, second.ID); op.Status != BatchOpCancelled {
+		t.Errorf("expected status %s, got %s", BatchOpCancelled, op.Status)
+	}
+	if op, _ := bo.Snapshot(done.ID); op.Status != BatchOpCompleted {
+		t.Errorf("expected finished operation to stay %s, got %s", BatchOpCompleted, op.Status)
+	}
+}
+
+func TestBatchOperator_ConvertWithoutConverter(t *testing.T) {
+	bo := NewBatchOperator(2)
+	if _, err := bo.ConvertImages(context.Background(), []string{"library/app:v1"}, "nydus"); err == nil {
+		t.Error("expected error without a converter")
+	}
+}
+
+func TestBatchOperator_Events(t *testing.T) {
+	reg := registrytest.New()
+	defer reg.Close()
+	reg.PushImage("library/app", "old", nil, []byte("app"))
+
+	client, err := distribution.NewClient(reg.URL())
+	if err != nil {
+		t.Fatalf("failed to create registry client: %v", err)
+	}
+	bus := events.NewBus()
+	bo := NewBatchOperator(2, WithRegistryClient(client), WithBatchEvents(bus))
+
+	received := make(chan events.Event, 2)
+	bus.Subscribe(func(ctx context.Context, e events.Event) { received <- e }, events.WithTopics("batch.*"))
+
+	op, err := bo.DeleteTags(context.Background(), []string{"library/app:old", "library/app:missing"})
+	if err != nil {
+		t.Fatalf("DeleteTags failed: %v", err)
+	}
+
+	var got []events.Event
+	for len(got) < 2 {
+		select {
+		case e := <-received:
+			got = append(got, e)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected 2 events, got %d", len(got))
+		}
+	}
+
+	started, ok := got[0].Payload.(events.BatchStarted)
+	if !ok || started.ID != op.ID || started.Type != "delete" || started.Targets != 2 {
+		t.Errorf("unexpected start event: %+v", got[0].Payload)
+	}
+	completed, ok := got[1].Payload.(events.BatchCompleted)
+	if !ok || completed.ID != op.ID || completed.Status != string(BatchOpFailed) ||
+		completed.Succeeded != 1 || completed.Failed != 1 {
+		t.Errorf("unexpected completion event: %+v", got[1].Payload)
+	}
+}
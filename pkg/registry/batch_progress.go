@@ -0,0 +1,162 @@
+// Copyright 2021 vjranagit
+//
+// Incremental progress of batch operations
+
+package registry
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// BatchProgress is the state of an operation when a target finishes
+type BatchProgress struct {
+	ID     string
+	Status BatchOpStatus
+	Total  int
+	// Succeeded, Failed, Skipped and Pending add up to Total
+	Succeeded int
+	Failed    int
+	Skipped   int
+	Pending   int
+	// Result is the target that just finished; nil in the first update
+	// and the final one
+	Result  *BatchOpResult
+	Elapsed time.Duration
+	// ETA extrapolates the remaining time from the targets finished so
+	// far; zero until the first one finishes and once none are pending
+	ETA time.Duration
+}
+
+// Done returns how many targets have finished
+func (p BatchProgress) Done() int {
+	return p.Total - p.Pending
+}
+
+// Subscribe streams the progress of operation id: its current state, an
+// update as each target finishes and a final update once the operation
+// has ended, after which the channel is closed. The channel holds every
+// update the operation can produce, so none are dropped for a slow reader.
+// unsubscribe stops delivery early and closes the channel
+func (bo *BatchOperator) Subscribe(id string) (<-chan BatchProgress, func(), error) {
+	bo.mu.Lock()
+	op, ok := bo.operations[id]
+	if ok {
+		defer bo.mu.Unlock()
+
+		ch := make(chan BatchProgress, len(op.Targets)+2)
+		ch <- op.progress(nil)
+		if op.Status.Finished() {
+			close(ch)
+			return ch, func() {}, nil
+		}
+		op.subscribers = append(op.subscribers, ch)
+
+		var once sync.Once
+		return ch, func() {
+			once.Do(func() { bo.unsubscribe(op, ch) })
+		}, nil
+	}
+	bo.mu.Unlock()
+
+	// Finished operations evicted from memory are in the history
+	if bo.history != nil {
+		if saved, err := bo.history.Get(id); err == nil {
+			ch := make(chan BatchProgress, 1)
+			ch <- saved.progress(nil)
+			close(ch)
+			return ch, func() {}, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("%w: %s", ErrOperationNotFound, id)
+}
+
+// unsubscribe closes ch unless the operation has finished and closed it
+func (bo *BatchOperator) unsubscribe(op *BatchOperation, ch chan BatchProgress) {
+	bo.mu.Lock()
+	defer bo.mu.Unlock()
+
+	if i := slices.Index(op.subscribers, ch); i >= 0 {
+		op.subscribers = slices.Delete(op.subscribers, i, i+1)
+		close(ch)
+	}
+}
+
+// Progress returns the current progress of an operation
+func (bo *BatchOperator) Progress(id string) (BatchProgress, bool) {
+	bo.mu.RLock()
+	defer bo.mu.RUnlock()
+
+	op, ok := bo.operations[id]
+	if !ok {
+		return BatchProgress{}, false
+	}
+	return op.progress(nil), true
+}
+
+// finishTarget stores the result of target idx and publishes the progress
+func (bo *BatchOperator) finishTarget(op *BatchOperation, results []BatchOpResult, idx int, result BatchOpResult) {
+	bo.mu.Lock()
+	defer bo.mu.Unlock()
+
+	if reason, ok := op.overrides[result.Target]; ok && result.Success {
+		result.Reason = reason
+	}
+	results[idx] = result
+	op.Results = append(op.Results, result)
+	op.notify(&result)
+}
+
+// notify sends the progress to the subscribers, closing their channels
+// once the operation has finished. Callers hold bo.mu
+func (op *BatchOperation) notify(result *BatchOpResult) {
+	if len(op.subscribers) == 0 {
+		return
+	}
+
+	p := op.progress(result)
+	for _, ch := range op.subscribers {
+		ch <- p
+		if op.Status.Finished() {
+			close(ch)
+		}
+	}
+	if op.Status.Finished() {
+		op.subscribers = nil
+	}
+}
+
+// progress summarizes the results so far. Callers hold bo.mu
+func (op *BatchOperation) progress(result *BatchOpResult) BatchProgress {
+	p := BatchProgress{
+		ID:     op.ID,
+		Status: op.Status,
+		Total:  len(op.Targets),
+		Result: result,
+	}
+	for _, r := range op.Results {
+		switch {
+		case r.Skipped:
+			p.Skipped++
+		case r.Success:
+			p.Succeeded++
+		default:
+			p.Failed++
+		}
+	}
+	p.Pending = p.Total - p.Succeeded - p.Failed - p.Skipped
+
+	if !op.StartedAt.IsZero() {
+		end := op.EndedAt
+		if end.IsZero() {
+			end = time.Now()
+		}
+		p.Elapsed = end.Sub(op.StartedAt)
+	}
+	if done := p.Done(); done > 0 && p.Pending > 0 {
+		p.ETA = p.Elapsed / time.Duration(done) * time.Duration(p.Pending)
+	}
+	return p
+}
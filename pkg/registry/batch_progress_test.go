@@ -0,0 +1,124 @@
+// Copyright 2021 vjranagit
+//
+// Batch progress tests
+
+package registry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// nextProgress receives one update or fails after a timeout
+func nextProgress(t *testing.T, ch <-chan BatchProgress) (BatchProgress, bool) {
+	t.Helper()
+
+	select {
+	case p, ok := <-ch:
+		return p, ok
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for progress")
+		return BatchProgress{}, false
+	}
+}
+
+func TestBatchOperator_Subscribe(t *testing.T) {
+	converter := &fakeConverter{}
+	bo := NewBatchOperator(3, WithImageConverter(converter))
+
+	op, err := bo.ConvertImages(context.Background(),
+		[]string{"library/a:slow", "library/b:v1", "library/c:broken"}, "nydus")
+	if err != nil {
+		t.Fatalf("ConvertImages failed: %v", err)
+	}
+
+	updates, unsubscribe, err := bo.Subscribe(op.ID)
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	defer unsubscribe()
+
+	first, _ := nextProgress(t, updates)
+	if first.Result != nil || first.Total != 3 {
+		t.Errorf("expected an initial update of 3 targets, got %+v", first)
+	}
+
+	// Two targets finish while the slow one blocks until cancelled
+	p := first
+	seen := 0
+	for p.Pending > 1 {
+		p, _ = nextProgress(t, updates)
+		if p.Result == nil {
+			t.Fatalf("expected a target result, got %+v", p)
+		}
+		seen++
+	}
+	if seen != 2-first.Done() {
+		t.Errorf("expected an update per finished target, got %d", seen)
+	}
+	if p.Succeeded != 1 || p.Failed != 1 || p.Status != BatchOpRunning {
+		t.Errorf("expected 1 succeeded and 1 failed while running, got %+v", p)
+	}
+	if p.ETA <= 0 {
+		t.Errorf("expected an ETA while targets are pending, got %v", p.ETA)
+	}
+	if snapshot, _ := bo.Snapshot(op.ID); len(snapshot.Results) != 2 {
+		t.Errorf("expected 2 results before the operation finished, got %d", len(snapshot.Results))
+	}
+
+	if _, err := bo.Cancel(op.ID); err != nil {
+		t.Fatalf("Cancel failed: %v", err)
+	}
+	p, _ = nextProgress(t, updates)
+	if p.Result == nil || p.Result.Target != "library/a:slow" {
+		t.Errorf("expected the slow target's result, got %+v", p)
+	}
+	final, _ := nextProgress(t, updates)
+	if final.Result != nil || final.Status != BatchOpCancelled || final.Pending != 0 || final.ETA != 0 {
+		t.Errorf("expected a final cancelled update, got %+v", final)
+	}
+	if _, ok := nextProgress(t, updates); ok {
+		t.Error("expected the channel to close after the final update")
+	}
+
+	// Finished operations report their final state once
+	done, _, err := bo.Subscribe(op.ID)
+	if err != nil {
+		t.Fatalf("Subscribe to finished operation failed: %v", err)
+	}
+	if p, _ := nextProgress(t, done); p.Status != BatchOpCancelled || p.Failed != 2 {
+		t.Errorf("expected the final state, got %+v", p)
+	}
+	if _, ok := nextProgress(t, done); ok {
+		t.Error("expected the channel of a finished operation to be closed")
+	}
+}
+
+func TestBatchOperator_Unsubscribe(t *testing.T) {
+	converter := &fakeConverter{}
+	bo := NewBatchOperator(1, WithImageConverter(converter))
+
+	op, _ := bo.ConvertImages(context.Background(), []string{"library/a:slow"}, "nydus")
+	updates, unsubscribe, err := bo.Subscribe(op.ID)
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	nextProgress(t, updates)
+
+	unsubscribe()
+	unsubscribe()
+	if _, ok := nextProgress(t, updates); ok {
+		t.Error("expected unsubscribe to close the channel")
+	}
+
+	bo.Cancel(op.ID)
+	if got := waitOperation(t, bo, op.ID); got.Status != BatchOpCancelled {
+		t.Errorf("expected the operation to keep running until cancelled, got %s", got.Status)
+	}
+
+	if _, _, err := bo.Subscribe("batch-missing"); !errors.Is(err, ErrOperationNotFound) {
+		t.Errorf("expected ErrOperationNotFound, got %v", err)
+	}
+}
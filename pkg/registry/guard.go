@@ -0,0 +1,184 @@
+// Copyright 2021 vjranagit
+//
+// Tag protection checks for batch operations
+
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/vjranagit/harbor/pkg/distribution"
+	"github.com/vjranagit/harbor/pkg/events"
+)
+
+// ProtectionGuard decides whether batch operations may change a tag.
+// TagProtection implements it
+type ProtectionGuard interface {
+	CanModify(ctx context.Context, repository, tag string, age time.Duration) (bool, string)
+	CanDelete(ctx context.Context, repository, tag string) (bool, string)
+}
+
+// ProtectedError is returned by batch handlers when the guard blocks a
+// target; the target is reported as skipped rather than failed
+type ProtectedError struct {
+	Reason string
+}
+
+func (e *ProtectedError) Error() string {
+	return "protected: " + e.Reason
+}
+
+// WithProtectionGuard checks every delete, copy, retag and convert target
+// against guard before acting
+func WithProtectionGuard(guard ProtectionGuard) BatchOption {
+	return func(bo *BatchOperator) {
+		bo.guard = guard
+	}
+}
+
+// WithForce makes an operation act on protected targets anyway. Every
+// override is logged and published as a ProtectionOverridden event
+func WithForce() OperationOption {
+	return func(op *BatchOperation) {
+		op.Force = true
+	}
+}
+
+// checkDelete guards deleting ref. A digest is checked through every tag
+// that currently points at it, since deleting the manifest removes them
+func (bo *BatchOperator) checkDelete(ctx context.Context, op *BatchOperation, target string, ref distribution.Reference) error {
+	if bo.guard == nil {
+		return nil
+	}
+
+	tags := []string{ref.Tag}
+	if ref.Digest != "" {
+		var err error
+		if tags, err = bo.tagsOf(ctx, ref.Repository, ref.Digest); err != nil {
+			return err
+		}
+	}
+
+	for _, tag := range tags {
+		if ok, reason := bo.guard.CanDelete(ctx, ref.Repository, tag); !ok {
+			return bo.override(ctx, op, target, ref.Repository, tag, "delete", reason)
+		}
+	}
+	return nil
+}
+
+// checkModify guards overwriting dst. Only existing tags are checked, with
+// their age taken from the image config creation date
+func (bo *BatchOperator) checkModify(ctx context.Context, op *BatchOperation, target string, dst distribution.Reference) error {
+	if bo.guard == nil || dst.Tag == "" || dst.Digest != "" {
+		return nil
+	}
+
+	m, err := bo.client.GetManifest(ctx, dst.Repository, dst.Tag)
+	if distribution.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %w", dst, err)
+	}
+
+	var age time.Duration
+	config, err := bo.imageConfig(ctx, dst.Repository, m)
+	if err != nil {
+		return fmt.Errorf("failed to read config of %s: %w", dst, err)
+	}
+	// Without a creation date the tag counts as new, the safe side of
+	// age based policies
+	if config.Created != nil {
+		age = time.Since(*config.Created)
+	}
+
+	if ok, reason := bo.guard.CanModify(ctx, dst.Repository, dst.Tag, age); !ok {
+		return bo.override(ctx, op, target, dst.Repository, dst.Tag, "modify", reason)
+	}
+	return nil
+}
+
+// checkConvert guards the tag a conversion of source with driver pushes
+func (bo *BatchOperator) checkConvert(ctx context.Context, op *BatchOperation, source, driver string) error {
+	if bo.guard == nil {
+		return nil
+	}
+
+	ref, err := bo.parseTarget(source)
+	if err != nil {
+		return err
+	}
+	dst := distribution.Reference{
+		Registry:   ref.Registry,
+		Repository: ref.Repository,
+		Tag:        bo.converter.TargetTag(ref, driver),
+	}
+	return bo.checkModify(ctx, op, source, dst)
+}
+
+// override returns a ProtectedError for a blocked change, unless op is
+// forced, in which case the override is audited, recorded against target
+// and nil returned
+func (bo *BatchOperator) override(ctx context.Context, op *BatchOperation, target, repository, tag, action, reason string) error {
+	if !op.Force {
+		return &ProtectedError{Reason: reason}
+	}
+
+	bo.mu.Lock()
+	if op.overrides == nil {
+		op.overrides = make(map[string]string)
+	}
+	op.overrides[target] = reason
+	bo.mu.Unlock()
+
+	bo.logger.WarnContext(ctx, "protection overridden",
+		"id", op.ID,
+		"repository", repository,
+		"tag", tag,
+		"action", action,
+		"reason", reason,
+	)
+	bo.events.Publish(ctx, events.ProtectionOverridden{
+		Operation:  op.ID,
+		Repository: repository,
+		Tag:        tag,
+		Action:     action,
+		Reason:     reason,
+	})
+	return nil
+}
+
+// tagsOf returns the tags of repo that point at dgst
+func (bo *BatchOperator) tagsOf(ctx context.Context, repo string, dgst digest.Digest) ([]string, error) {
+	tags, err := bo.client.ListTags(ctx, repo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tags of %s: %w", repo, err)
+	}
+
+	var matched []string
+	for _, tag := range tags {
+		desc, err := bo.client.HeadManifest(ctx, repo, tag)
+		if distribution.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve %s:%s: %w", repo, tag, err)
+		}
+		if desc.Digest == dgst {
+			matched = append(matched, tag)
+		}
+	}
+	return matched, nil
+}
+
+// isProtected reports whether err is a guard block
+func isProtected(err error) (*ProtectedError, bool) {
+	var protected *ProtectedError
+	ok := errors.As(err, &protected)
+	return protected, ok
+}
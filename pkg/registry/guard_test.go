@@ -0,0 +1,211 @@
+// Copyright 2021 vjranagit
+//
+// Protection guard tests
+
+package registry
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vjranagit/harbor/pkg/distribution"
+	"github.com/vjranagit/harbor/pkg/distribution/registrytest"
+	"github.com/vjranagit/harbor/pkg/events"
+)
+
+// newGuardedOperator returns a batch operator guarded by an immutability
+// policy on v* tags and a 7 day age policy on release-* tags
+func newGuardedOperator(t *testing.T, reg *registrytest.Registry, bus *events.Bus) *BatchOperator {
+	t.Helper()
+
+	tp := NewTagProtection()
+	policies := []*ProtectionPolicy{
+		{Name: "versions", Pattern: regexp.MustCompile(`:v\d+$`), Immutable: true},
+		{Name: "releases", Pattern: regexp.MustCompile(`:release-`), MaxAge: 7 * 24 * time.Hour, AllowDelete: true},
+	}
+	for _, p := range policies {
+		if err := tp.AddPolicy(p); err != nil {
+			t.Fatalf("failed to add policy: %v", err)
+		}
+	}
+
+	client, err := distribution.NewClient(reg.URL())
+	if err != nil {
+		t.Fatalf("failed to create registry client: %v", err)
+	}
+	return NewBatchOperator(2, WithRegistryClient(client), WithProtectionGuard(tp), WithBatchEvents(bus))
+}
+
+func TestBatchOperator_GuardDelete(t *testing.T) {
+	reg := registrytest.New()
+	defer reg.Close()
+	v1 := reg.PushImage("library/app", "v1", nil, []byte("v1"))
+	reg.PushImage("library/app", "dev", nil, []byte("dev"))
+	shared := reg.PushImage("library/app", "v2", nil, []byte("v2"))
+	reg.PushImage("library/app", "candidate", nil, []byte("v2"))
+
+	bo := newGuardedOperator(t, reg, nil)
+	op, _ := bo.DeleteTags(context.Background(), []string{
+		"library/app:v1",
+		"library/app:dev",
+		"library/app@" + shared.Digest.String(),
+	})
+	op = waitOperation(t, bo, op.ID)
+
+	if op.Status != BatchOpCompleted {
+		t.Errorf("expected skipped targets not to fail the operation, got %s", op.Status)
+	}
+	for i, want := range []struct {
+		skipped bool
+		reason  string
+	}{
+		{true, "tag deletion not allowed (policy: versions)"},
+		{false, ""},
+		{true, "tag deletion not allowed (policy: versions)"},
+	} {
+		result := op.Results[i]
+		if result.Skipped != want.skipped || result.Reason != want.reason || result.Success == want.skipped {
+			t.Errorf("%s: expected skipped=%v %q, got %+v", result.Target, want.skipped, want.reason, result)
+		}
+		if result.Skipped && result.Attempts != 1 {
+			t.Errorf("%s: expected no retries of a protected target, got %d attempts", result.Target, result.Attempts)
+		}
+	}
+	if _, _, ok := reg.Manifest("library/app", v1.Digest.String()); !ok {
+		t.Error("expected immutable tag to survive")
+	}
+	if _, _, ok := reg.Manifest("library/app", "dev"); ok {
+		t.Error("expected unprotected tag to be deleted")
+	}
+}
+
+func TestBatchOperator_GuardModify(t *testing.T) {
+	reg := registrytest.New()
+	defer reg.Close()
+	pushAged(t, reg, "library/app", "v1", 90*24*time.Hour, nil)
+	pushAged(t, reg, "library/app", "release-2", 24*time.Hour, nil)
+	pushAged(t, reg, "library/app", "release-1", 30*24*time.Hour, nil)
+	pushAged(t, reg, "backup/library/app", "v1", time.Hour, nil)
+	pushAged(t, reg, "backup/library/app", "release-2", time.Hour, nil)
+
+	bo := newGuardedOperator(t, reg, nil)
+
+	// Copy onto existing protected destinations, and a new one
+	op, _ := bo.CopyTags(context.Background(), []string{"library/app:v1", "library/app:release-2", "library/app:release-1"}, "backup/")
+	op = waitOperation(t, bo, op.ID)
+	want := []bool{true, true, false}
+	for i, result := range op.Results {
+		if result.Skipped != want[i] {
+			t.Errorf("copy %s: expected skipped=%v, got %+v", result.Target, want[i], result)
+		}
+	}
+	if !strings.Contains(op.Results[1].Reason, "protected for 168h0m0s") {
+		t.Errorf("expected the age policy reason, got %q", op.Results[1].Reason)
+	}
+
+	// Retag onto an old release, which the age policy no longer protects
+	op, _ = bo.RetagBatch(context.Background(), map[string]string{"library/app:release-2": "library/app:release-1"})
+	op = waitOperation(t, bo, op.ID)
+	if result := op.Results[0]; !result.Success || result.Skipped {
+		t.Errorf("expected retag over an expired release to succeed, got %+v", result)
+	}
+}
+
+func TestBatchOperator_GuardConvert(t *testing.T) {
+	reg := registrytest.New()
+	defer reg.Close()
+	for _, tag := range []string{"release-1", "release-2", "release-3"} {
+		pushAged(t, reg, "library/app", tag, 30*24*time.Hour, nil)
+	}
+	pushAged(t, reg, "library/app", "release-1-nydus", 30*24*time.Hour, nil)
+	pushAged(t, reg, "library/app", "release-2-nydus", 24*time.Hour, nil)
+
+	converter := &fakeConverter{}
+	bo := newGuardedOperator(t, reg, nil)
+	WithImageConverter(converter)(bo)
+
+	// Only the recent converted tag is protected; release-3 has none yet
+	sources := []string{"library/app:release-1", "library/app:release-2", "library/app:release-3"}
+	op, _ := bo.ConvertImages(context.Background(), sources, "nydus")
+	op = waitOperation(t, bo, op.ID)
+	want := []bool{false, true, false}
+	for i, result := range op.Results {
+		if result.Skipped != want[i] || result.Success == want[i] {
+			t.Errorf("convert %s: expected skipped=%v, got %+v", result.Target, want[i], result)
+		}
+	}
+	if converter.started() != 2 {
+		t.Errorf("expected the protected conversion not to run, got %v", converter.calls)
+	}
+
+	op, _ = bo.ConvertImages(context.Background(), sources[1:2], "nydus", WithForce())
+	op = waitOperation(t, bo, op.ID)
+	if result := op.Results[0]; !result.Success || result.Reason == "" {
+		t.Errorf("expected forced conversion to succeed and record the override, got %+v", result)
+	}
+}
+
+func TestBatchOperator_GuardForce(t *testing.T) {
+	reg := registrytest.New()
+	defer reg.Close()
+	reg.PushImage("library/app", "v1", nil, []byte("v1"))
+
+	bus := events.NewBus()
+	received := make(chan events.Event, 4)
+	bus.Subscribe(func(ctx context.Context, e events.Event) { received <- e },
+		events.WithTopics(events.TopicProtectionOverridden, events.TopicBatchCompleted))
+
+	bo := newGuardedOperator(t, reg, bus)
+	op, _ := bo.DeleteTags(context.Background(), []string{"library/app:v1"}, WithForce())
+	op = waitOperation(t, bo, op.ID)
+
+	if result := op.Results[0]; !result.Success || result.Skipped || result.Reason == "" {
+		t.Errorf("expected forced delete to succeed and record the override, got %+v", result)
+	}
+	if _, _, ok := reg.Manifest("library/app", "v1"); ok {
+		t.Error("expected forced delete to remove the tag")
+	}
+
+	select {
+	case e := <-received:
+		want := events.ProtectionOverridden{
+			Operation:  op.ID,
+			Repository: "library/app",
+			Tag:        "v1",
+			Action:     "delete",
+			Reason:     "tag deletion not allowed (policy: versions)",
+		}
+		if e.Payload != want {
+			t.Errorf("expected %+v, got %+v", want, e.Payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected an override event")
+	}
+}
+
+func TestBatchOperator_GuardSkippedEvent(t *testing.T) {
+	reg := registrytest.New()
+	defer reg.Close()
+	reg.PushImage("library/app", "v1", nil, []byte("v1"))
+	reg.PushImage("library/app", "dev", nil, []byte("dev"))
+
+	bus := events.NewBus()
+	received := make(chan events.Event, 1)
+	bus.Subscribe(func(ctx context.Context, e events.Event) { received <- e }, events.WithTopics(events.TopicBatchCompleted))
+
+	bo := newGuardedOperator(t, reg, bus)
+	op, _ := bo.DeleteTags(context.Background(), []string{"library/app:v1", "library/app:dev"})
+
+	select {
+	case e := <-received:
+		completed := e.Payload.(events.BatchCompleted)
+		if completed.ID != op.ID || completed.Succeeded != 1 || completed.Skipped != 1 || completed.Failed != 0 {
+			t.Errorf("unexpected completion event: %+v", completed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a completion event")
+	}
+}
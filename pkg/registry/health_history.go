@@ -0,0 +1,234 @@
+// Copyright 2021 vjranagit
+//
+// Health check history
+
+package registry
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Defaults for check history
+const (
+	// DefaultCheckHistoryAge is how long recorded checks are kept
+	DefaultCheckHistoryAge = 30 * 24 * time.Hour
+	// DefaultCheckHistorySize is how many checks per endpoint the memory
+	// store keeps: a day of checks every 10s
+	DefaultCheckHistorySize = 8640
+)
+
+// checkHistoryPruneInterval is the least time between two prunes by a
+// monitor
+const checkHistoryPruneInterval = time.Minute
+
+// CheckResult is one recorded health check
+type CheckResult struct {
+	Endpoint string
+	Time     time.Time
+	Status   HealthStatus
+	// Up is set when the endpoint answered; unhealthy Harbor components
+	// degrade its status but leave it up
+	Up      bool
+	Latency time.Duration
+	Error   string
+}
+
+// CheckHistoryQuery filters check results; zero fields match everything
+type CheckHistoryQuery struct {
+	Endpoint string
+	// Since and Until bound the check time, inclusive
+	Since time.Time
+	Until time.Time
+}
+
+// Match reports whether r passes the query filters
+func (q CheckHistoryQuery) Match(r CheckResult) bool {
+	switch {
+	case q.Endpoint != "" && r.Endpoint != q.Endpoint:
+		return false
+	case !q.Since.IsZero() && r.Time.Before(q.Since):
+		return false
+	case !q.Until.IsZero() && r.Time.After(q.Until):
+		return false
+	}
+	return true
+}
+
+// CheckHistoryStore records health check results as a time series per
+// endpoint
+type CheckHistoryStore interface {
+	// Append records a result; results of an endpoint arrive in time order
+	Append(r CheckResult) error
+	// Query returns the matching results ordered by endpoint, then time
+	Query(q CheckHistoryQuery) ([]CheckResult, error)
+	// Prune removes results older than maxAge and returns how many
+	Prune(maxAge time.Duration) (int, error)
+	// Close releases the store
+	Close() error
+}
+
+// WithCheckHistory records the result of every check in store, pruning
+// it to DefaultCheckHistoryAge unless WithCheckHistoryRetention says
+// otherwise
+func WithCheckHistory(store CheckHistoryStore) HealthOption {
+	return func(hm *HealthMonitor) {
+		hm.history = store
+	}
+}
+
+// WithCheckHistoryRetention sets how long recorded checks are kept; zero
+// keeps them forever
+func WithCheckHistoryRetention(maxAge time.Duration) HealthOption {
+	return func(hm *HealthMonitor) {
+		hm.historyAge = maxAge
+	}
+}
+
+// History returns the store checks are recorded in, nil without one
+func (hm *HealthMonitor) History() CheckHistoryStore {
+	return hm.history
+}
+
+// recordCheck appends a result to the check history and prunes it at
+// most once per checkHistoryPruneInterval. Failures are logged; they
+// never fail the check
+func (hm *HealthMonitor) recordCheck(result CheckResult) {
+	if hm.history == nil {
+		return
+	}
+	if err := hm.history.Append(result); err != nil {
+		hm.logger.Error("failed to record health check", "endpoint", result.Endpoint, "error", err)
+		return
+	}
+	if hm.historyAge <= 0 {
+		return
+	}
+
+	hm.mu.Lock()
+	due := result.Time.Sub(hm.lastPrune) >= checkHistoryPruneInterval
+	if due {
+		hm.lastPrune = result.Time
+	}
+	hm.mu.Unlock()
+	if !due {
+		return
+	}
+
+	if pruned, err := hm.history.Prune(hm.historyAge); err != nil {
+		hm.logger.Error("failed to prune health check history", "error", err)
+	} else if pruned > 0 {
+		hm.logger.Debug("health check history pruned", "count", pruned)
+	}
+}
+
+// MemoryCheckHistory keeps the latest results of each endpoint in a ring
+// buffer, for tests and monitors without a database
+type MemoryCheckHistory struct {
+	mu    sync.Mutex
+	size  int
+	rings map[string]*checkRing
+}
+
+// checkRing is a fixed-size buffer of one endpoint's results
+type checkRing struct {
+	buf   []CheckResult
+	start int
+	n     int
+}
+
+func (r *checkRing) push(result CheckResult) {
+	if r.n < len(r.buf) {
+		r.buf[(r.start+r.n)%len(r.buf)] = result
+		r.n++
+		return
+	}
+	r.buf[r.start] = result
+	r.start = (r.start + 1) % len(r.buf)
+}
+
+func (r *checkRing) at(i int) CheckResult {
+	return r.buf[(r.start+i)%len(r.buf)]
+}
+
+// dropOlder removes results checked before cutoff and returns how many
+func (r *checkRing) dropOlder(cutoff time.Time) int {
+	dropped := 0
+	for r.n > 0 && r.at(0).Time.Before(cutoff) {
+		r.buf[r.start] = CheckResult{}
+		r.start = (r.start + 1) % len(r.buf)
+		r.n--
+		dropped++
+	}
+	return dropped
+}
+
+// NewMemoryCheckHistory creates a store keeping the latest size results
+// per endpoint; DefaultCheckHistorySize applies when size is not positive
+func NewMemoryCheckHistory(size int) *MemoryCheckHistory {
+	if size <= 0 {
+		size = DefaultCheckHistorySize
+	}
+	return &MemoryCheckHistory{size: size, rings: make(map[string]*checkRing)}
+}
+
+// Append records a result, overwriting the endpoint's oldest once full
+func (s *MemoryCheckHistory) Append(result CheckResult) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ring, ok := s.rings[result.Endpoint]
+	if !ok {
+		ring = &checkRing{buf: make([]CheckResult, s.size)}
+		s.rings[result.Endpoint] = ring
+	}
+	ring.push(result)
+	return nil
+}
+
+// Query returns the matching results ordered by endpoint, then time
+func (s *MemoryCheckHistory) Query(q CheckHistoryQuery) ([]CheckResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	endpoints := make([]string, 0, len(s.rings))
+	for endpoint := range s.rings {
+		if q.Endpoint == "" || endpoint == q.Endpoint {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	sort.Strings(endpoints)
+
+	var results []CheckResult
+	for _, endpoint := range endpoints {
+		ring := s.rings[endpoint]
+		for i := 0; i < ring.n; i++ {
+			if r := ring.at(i); q.Match(r) {
+				results = append(results, r)
+			}
+		}
+	}
+	return results, nil
+}
+
+// Prune removes results older than maxAge
+func (s *MemoryCheckHistory) Prune(maxAge time.Duration) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cutoff := time.Now().Add(-maxAge)
+	pruned := 0
+	for endpoint, ring := range s.rings {
+		pruned += ring.dropOlder(cutoff)
+		if ring.n == 0 {
+			delete(s.rings, endpoint)
+		}
+	}
+	return pruned, nil
+}
+
+// Close is a no-op for memory stores
+func (s *MemoryCheckHistory) Close() error {
+	return nil
+}
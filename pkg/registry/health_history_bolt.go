@@ -0,0 +1,184 @@
+// Copyright 2021 vjranagit
+//
+// Embedded database storage for health check history
+
+package registry
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// checksBucket holds a nested bucket of check records per endpoint
+var checksBucket = []byte("checks")
+
+// BoltCheckHistory keeps check results in an embedded bbolt database, one
+// bucket per endpoint keyed by check time
+type BoltCheckHistory struct {
+	db *bolt.DB
+}
+
+// OpenBoltCheckHistory opens or creates the database at path
+func OpenBoltCheckHistory(path string) (*BoltCheckHistory, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open health history database %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(checksBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltCheckHistory{db: db}, nil
+}
+
+// checkKey orders an endpoint's records by check time
+func checkKey(t time.Time) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	return key
+}
+
+// checkRecord is the serialized form of a CheckResult; the endpoint and
+// time are its bucket and key
+type checkRecord struct {
+	Status  HealthStatus `json:"status"`
+	Up      bool         `json:"up"`
+	Latency string       `json:"latency"`
+	Error   string       `json:"error,omitempty"`
+}
+
+// Append records a result
+func (s *BoltCheckHistory) Append(result CheckResult) error {
+	data, err := json.Marshal(checkRecord{
+		Status:  result.Status,
+		Up:      result.Up,
+		Latency: result.Latency.String(),
+		Error:   result.Error,
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(checksBucket).CreateBucketIfNotExists([]byte(result.Endpoint))
+		if err != nil {
+			return err
+		}
+		return b.Put(checkKey(result.Time), data)
+	})
+}
+
+// Query returns the matching results ordered by endpoint, then time
+func (s *BoltCheckHistory) Query(q CheckHistoryQuery) ([]CheckResult, error) {
+	var results []CheckResult
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(checksBucket).ForEachBucket(func(name []byte) error {
+			endpoint := string(name)
+			if q.Endpoint != "" && endpoint != q.Endpoint {
+				return nil
+			}
+
+			c := tx.Bucket(checksBucket).Bucket(name).Cursor()
+			k, v := c.First()
+			if !q.Since.IsZero() {
+				k, v = c.Seek(checkKey(q.Since))
+			}
+			for ; k != nil; k, v = c.Next() {
+				result, err := decodeCheck(endpoint, k, v)
+				if err != nil {
+					return fmt.Errorf("check record %s/%x: %w", endpoint, k, err)
+				}
+				if !q.Until.IsZero() && result.Time.After(q.Until) {
+					break
+				}
+				results = append(results, result)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// Prune removes results older than maxAge, dropping endpoints left
+// without any
+func (s *BoltCheckHistory) Prune(maxAge time.Duration) (int, error) {
+	pruned := 0
+	cutoff := checkKey(time.Now().Add(-maxAge))
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(checksBucket)
+
+		// Buckets are collected first; they must not change while iterated
+		var names [][]byte
+		err := root.ForEachBucket(func(name []byte) error {
+			names = append(names, append([]byte(nil), name...))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			c := root.Bucket(name).Cursor()
+			k, _ := c.First()
+			for ; k != nil && bytes.Compare(k, cutoff) < 0; k, _ = c.First() {
+				if err := c.Delete(); err != nil {
+					return err
+				}
+				pruned++
+			}
+			if k == nil {
+				if err := root.DeleteBucket(name); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	return pruned, err
+}
+
+// Close closes the database
+func (s *BoltCheckHistory) Close() error {
+	return s.db.Close()
+}
+
+func decodeCheck(endpoint string, key, data []byte) (CheckResult, error) {
+	var rec checkRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return CheckResult{}, err
+	}
+	latency, err := time.ParseDuration(rec.Latency)
+	if err != nil {
+		return CheckResult{}, fmt.Errorf("invalid latency %q", rec.Latency)
+	}
+	return CheckResult{
+		Endpoint: endpoint,
+		Time:     time.Unix(0, int64(binary.BigEndian.Uint64(key))),
+		Status:   rec.Status,
+		Up:       rec.Up,
+		Latency:  latency,
+		Error:    rec.Error,
+	}, nil
+}
@@ -0,0 +1,185 @@
+// Copyright 2021 vjranagit
+//
+// Health check history tests
+
+package registry
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// checkStores opens one store of each kind
+func checkStores(t *testing.T) map[string]CheckHistoryStore {
+	t.Helper()
+
+	bolt, err := OpenBoltCheckHistory(filepath.Join(t.TempDir(), "health.db"))
+	if err != nil {
+		t.Fatalf("OpenBoltCheckHistory failed: %v", err)
+	}
+	t.Cleanup(func() { bolt.Close() })
+
+	return map[string]CheckHistoryStore{
+		"memory": NewMemoryCheckHistory(0),
+		"bolt":   bolt,
+	}
+}
+
+// checkAt returns a result of endpoint checked age ago
+func checkAt(endpoint string, age time.Duration, up bool) CheckResult {
+	r := CheckResult{
+		Endpoint: endpoint,
+		Time:     time.Now().Add(-age).Truncate(time.Millisecond),
+		Status:   HealthStatusHealthy,
+		Up:       up,
+		Latency:  25 * time.Millisecond,
+	}
+	if !up {
+		r.Status, r.Error = HealthStatusUnhealthy, "connection refused"
+	}
+	return r
+}
+
+func TestCheckHistoryStore_Query(t *testing.T) {
+	for name, store := range checkStores(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, r := range []CheckResult{
+				checkAt("https://b.example.com", 3*time.Hour, true),
+				checkAt("https://a.example.com", 3*time.Hour, true),
+				checkAt("https://a.example.com", 2*time.Hour, false),
+				checkAt("https://a.example.com", time.Hour, true),
+			} {
+				if err := store.Append(r); err != nil {
+					t.Fatalf("Append failed: %v", err)
+				}
+			}
+
+			tests := []struct {
+				name  string
+				query CheckHistoryQuery
+				want  []string
+			}{
+				{"all, by endpoint then time", CheckHistoryQuery{}, []string{"a:up", "a:down", "a:up", "b:up"}},
+				{"one endpoint", CheckHistoryQuery{Endpoint: "https://b.example.com"}, []string{"b:up"}},
+				{"since", CheckHistoryQuery{Since: time.Now().Add(-150 * time.Minute)}, []string{"a:down", "a:up"}},
+				{"until", CheckHistoryQuery{Until: time.Now().Add(-150 * time.Minute)}, []string{"a:up", "b:up"}},
+			}
+			for _, tt := range tests {
+				results, err := store.Query(tt.query)
+				if err != nil {
+					t.Fatalf("%s: Query failed: %v", tt.name, err)
+				}
+				var got []string
+				for _, r := range results {
+					state := "down"
+					if r.Up {
+						state = "up"
+					}
+					got = append(got, r.Endpoint[8:9]+":"+state)
+				}
+				if !equalStrings(got, tt.want) {
+					t.Errorf("%s: expected %v, got %v", tt.name, tt.want, got)
+				}
+			}
+
+			results, _ := store.Query(CheckHistoryQuery{Endpoint: "https://a.example.com"})
+			if r := results[1]; r.Error != "connection refused" || r.Status != HealthStatusUnhealthy || r.Latency != 25*time.Millisecond {
+				t.Errorf("expected the failed check to round-trip, got %+v", r)
+			}
+		})
+	}
+}
+
+func TestCheckHistoryStore_Prune(t *testing.T) {
+	for name, store := range checkStores(t) {
+		t.Run(name, func(t *testing.T) {
+			store.Append(checkAt("https://a.example.com", 48*time.Hour, true))
+			store.Append(checkAt("https://a.example.com", time.Hour, true))
+			store.Append(checkAt("https://b.example.com", 72*time.Hour, true))
+
+			pruned, err := store.Prune(24 * time.Hour)
+			if err != nil || pruned != 2 {
+				t.Fatalf("expected 2 pruned, got %d (%v)", pruned, err)
+			}
+			results, _ := store.Query(CheckHistoryQuery{})
+			if len(results) != 1 || results[0].Endpoint != "https://a.example.com" {
+				t.Errorf("expected only the recent check to remain, got %+v", results)
+			}
+
+			// Endpoints left without checks can be recorded again
+			if err := store.Append(checkAt("https://b.example.com", 0, true)); err != nil {
+				t.Errorf("Append after prune failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestMemoryCheckHistory_Ring(t *testing.T) {
+	store := NewMemoryCheckHistory(3)
+	for i := 5; i > 0; i-- {
+		store.Append(checkAt("https://a.example.com", time.Duration(i)*time.Minute, i%2 == 0))
+	}
+
+	results, _ := store.Query(CheckHistoryQuery{})
+	if len(results) != 3 {
+		t.Fatalf("expected the ring to keep 3 results, got %d", len(results))
+	}
+	for i := 1; i < len(results); i++ {
+		if !results[i-1].Time.Before(results[i].Time) {
+			t.Errorf("expected results oldest first, got %v before %v", results[i-1].Time, results[i].Time)
+		}
+	}
+	if results[0].Time.Before(time.Now().Add(-3*time.Minute - time.Second)) {
+		t.Errorf("expected the oldest results to be overwritten, got %v", results[0].Time)
+	}
+}
+
+func TestBoltCheckHistory_Reopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "health.db")
+	store, err := OpenBoltCheckHistory(path)
+	if err != nil {
+		t.Fatalf("OpenBoltCheckHistory failed: %v", err)
+	}
+	want := checkAt("https://a.example.com", time.Minute, false)
+	store.Append(want)
+	store.Close()
+
+	store, err = OpenBoltCheckHistory(path)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer store.Close()
+
+	results, err := store.Query(CheckHistoryQuery{})
+	if err != nil || len(results) != 1 || !results[0].Time.Equal(want.Time) || results[0].Up {
+		t.Errorf("expected %+v after reopening, got %+v (%v)", want, results, err)
+	}
+}
+
+func TestHealthMonitor_RecordsChecks(t *testing.T) {
+	up := newHarborServer(t, http.StatusOK, map[string]string{"core": "healthy", "redis": "unhealthy"}).URL
+	down := newHarborServer(t, http.StatusBadGateway, nil).URL
+
+	history := NewMemoryCheckHistory(0)
+	hm := NewHealthMonitor(3, time.Hour, time.Second, time.Hour, WithCheckHistory(history))
+	hm.Register(up)
+	hm.Register(down)
+	if hm.History() != history {
+		t.Fatal("expected History to return the configured store")
+	}
+
+	hm.performCheck(up)
+	hm.performCheck(down)
+	hm.performCheck(down)
+
+	upResults, _ := history.Query(CheckHistoryQuery{Endpoint: up})
+	if len(upResults) != 1 || !upResults[0].Up || upResults[0].Status != HealthStatusDegraded || upResults[0].Latency <= 0 {
+		t.Errorf("expected one degraded check that answered, got %+v", upResults)
+	}
+	downResults, _ := history.Query(CheckHistoryQuery{Endpoint: down})
+	if len(downResults) != 2 || downResults[1].Up || downResults[1].Error == "" {
+		t.Errorf("expected two failed checks with errors, got %+v", downResults)
+	}
+}
@@ -6,12 +6,24 @@ package registry
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/vjranagit/harbor/pkg/circuit"
+	"github.com/vjranagit/harbor/pkg/events"
 )
 
+// harborHealthPath is Harbor's aggregated component health API
+const harborHealthPath = "/api/v2.0/health"
+
 // HealthStatus represents endpoint health status
 type HealthStatus string
 
@@ -26,11 +38,19 @@ const (
 type CircuitState string
 
 const (
-	CircuitClosed    CircuitState = "closed"
-	CircuitHalfOpen  CircuitState = "half_open"
-	CircuitOpen      CircuitState = "open"
+	CircuitClosed   = CircuitState(circuit.Closed)
+	CircuitHalfOpen = CircuitState(circuit.HalfOpen)
+	CircuitOpen     = CircuitState(circuit.Open)
 )
 
+// ComponentHealth is the status of one Harbor component (core,
+// jobservice, registry, database, redis, trivy, ...)
+type ComponentHealth struct {
+	Name   string
+	Status HealthStatus
+	Error  string
+}
+
 // HealthCheck represents a health check result
 type HealthCheck struct {
 	Endpoint    string
@@ -41,69 +61,338 @@ type HealthCheck struct {
 	LastCheck   time.Time
 	Consecutive int
 	Attempts    int
+	// RetryAt is when an open circuit lets the next check through
+	RetryAt time.Time
+	// Components is empty for plain registries without Harbor's health API
+	Components []ComponentHealth
+	// Config is how the endpoint is checked, with the monitor's defaults
+	// filled in
+	Config EndpointConfig
+
+	// ctx ends when the endpoint is unregistered or the monitor stops
+	ctx    context.Context
+	cancel context.CancelFunc
+	// reset tells the endpoint's goroutine its interval changed
+	reset chan struct{}
+	// breaker decides which checks run
+	breaker *circuit.Breaker
+}
+
+// EndpointConfig is how an endpoint is checked
+type EndpointConfig struct {
+	// Interval is the time between checks
+	Interval time.Duration
+	// Timeout bounds each check
+	Timeout time.Duration
+	// Threshold is how many consecutive failures open the circuit
+	Threshold int
+	// RetryDelay is how long an open circuit waits before a retry,
+	// doubled for every failed retry up to MaxRetryDelay
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+	// SuccessThreshold is how many successful retries in a row close the
+	// circuit
+	SuccessThreshold int
+	// SlowThreshold fails checks that answer slower than it; zero disables
+	// it
+	SlowThreshold time.Duration
+}
+
+func (c EndpointConfig) validate() error {
+	switch {
+	case c.Interval <= 0:
+		return fmt.Errorf("check interval must be positive")
+	case c.Timeout <= 0:
+		return fmt.Errorf("check timeout must be positive")
+	}
+	return c.breakerSettings().Validate()
+}
+
+// breakerSettings returns the circuit breaker settings of the endpoint
+func (c EndpointConfig) breakerSettings() circuit.Settings {
+	return circuit.Settings{
+		FailureThreshold: c.Threshold,
+		SuccessThreshold: c.SuccessThreshold,
+		RetryDelay:       c.RetryDelay,
+		MaxRetryDelay:    c.MaxRetryDelay,
+		SlowThreshold:    c.SlowThreshold,
+	}
+}
+
+// EndpointOption overrides the monitor's defaults for one endpoint
+type EndpointOption func(*EndpointConfig)
+
+// WithCheckInterval sets the time between checks of an endpoint
+func WithCheckInterval(d time.Duration) EndpointOption {
+	return func(c *EndpointConfig) {
+		c.Interval = d
+	}
 }
 
+// WithCheckTimeout bounds each check of an endpoint
+func WithCheckTimeout(d time.Duration) EndpointOption {
+	return func(c *EndpointConfig) {
+		c.Timeout = d
+	}
+}
+
+// WithFailureThreshold sets how many consecutive failures open the circuit
+func WithFailureThreshold(n int) EndpointOption {
+	return func(c *EndpointConfig) {
+		c.Threshold = n
+	}
+}
+
+// WithCircuitRetryDelay sets how long an open circuit waits before a retry
+func WithCircuitRetryDelay(d time.Duration) EndpointOption {
+	return func(c *EndpointConfig) {
+		c.RetryDelay = d
+	}
+}
+
+// WithMaxRetryDelay caps the retry delay, which doubles with every failed
+// retry; a cap below the retry delay keeps it fixed
+func WithMaxRetryDelay(d time.Duration) EndpointOption {
+	return func(c *EndpointConfig) {
+		c.MaxRetryDelay = d
+	}
+}
+
+// WithSuccessThreshold sets how many successful retries in a row close the
+// circuit
+func WithSuccessThreshold(n int) EndpointOption {
+	return func(c *EndpointConfig) {
+		c.SuccessThreshold = n
+	}
+}
+
+// WithSlowThreshold fails checks slower than d, so a sluggish endpoint
+// opens the circuit like a failing one; zero disables it
+func WithSlowThreshold(d time.Duration) EndpointOption {
+	return func(c *EndpointConfig) {
+		c.SlowThreshold = d
+	}
+}
+
+var (
+	// ErrEndpointNotFound is returned for endpoints that are not monitored
+	ErrEndpointNotFound = errors.New("endpoint not monitored")
+	// ErrEndpointExists is returned when registering an endpoint twice
+	ErrEndpointExists = errors.New("endpoint already monitored")
+)
+
 // HealthMonitor monitors registry endpoint health with circuit breaker
 type HealthMonitor struct {
-	checks          map[string]*HealthCheck
-	mu              sync.RWMutex
-	threshold       int
-	retryDelay      time.Duration
-	timeout         time.Duration
-	checkInterval   time.Duration
-	logger          *slog.Logger
-	ctx             context.Context
-	cancel          context.CancelFunc
-	wg              sync.WaitGroup
-}
-
-// NewHealthMonitor creates a new health monitor
-func NewHealthMonitor(threshold int, retryDelay, timeout, checkInterval time.Duration) *HealthMonitor {
+	checks        map[string]*HealthCheck
+	mu            sync.RWMutex
+	threshold     int
+	retryDelay    time.Duration
+	timeout       time.Duration
+	checkInterval time.Duration
+	client        *http.Client
+	events        *events.Bus
+	logger        *slog.Logger
+	ctx           context.Context
+	cancel        context.CancelFunc
+	wg            sync.WaitGroup
+	// started is set by Start; endpoints registered later are checked
+	// right away
+	started bool
+	// endpointDefaults apply to every endpoint before its own options
+	endpointDefaults []EndpointOption
+
+	history    CheckHistoryStore
+	historyAge time.Duration
+	lastPrune  time.Time
+}
+
+// HealthOption configures a HealthMonitor
+type HealthOption func(*HealthMonitor)
+
+// WithProbeClient sets the HTTP client used to probe endpoints
+func WithProbeClient(client *http.Client) HealthOption {
+	return func(hm *HealthMonitor) {
+		hm.client = client
+	}
+}
+
+// WithHealthEvents publishes status and circuit changes on bus
+func WithHealthEvents(bus *events.Bus) HealthOption {
+	return func(hm *HealthMonitor) {
+		hm.events = bus
+	}
+}
+
+// WithEndpointDefaults changes the settings every endpoint starts from,
+// e.g. WithSuccessThreshold or WithSlowThreshold
+func WithEndpointDefaults(opts ...EndpointOption) HealthOption {
+	return func(hm *HealthMonitor) {
+		hm.endpointDefaults = append(hm.endpointDefaults, opts...)
+	}
+}
+
+// NewHealthMonitor creates a new health monitor. A circuit opened after
+// threshold failures is retried after retryDelay, doubled up to
+// circuit.DefaultMaxRetryDelay while retries fail, and closes after
+// circuit.DefaultSuccessThreshold successful retries
+func NewHealthMonitor(threshold int, retryDelay, timeout, checkInterval time.Duration, opts ...HealthOption) *HealthMonitor {
 	ctx, cancel := context.WithCancel(context.Background())
 
-	return &HealthMonitor{
+	hm := &HealthMonitor{
 		checks:        make(map[string]*HealthCheck),
 		threshold:     threshold,
 		retryDelay:    retryDelay,
 		timeout:       timeout,
 		checkInterval: checkInterval,
+		client:        http.DefaultClient,
+		historyAge:    DefaultCheckHistoryAge,
 		logger:        slog.Default().With("component", "health_monitor"),
 		ctx:           ctx,
 		cancel:        cancel,
 	}
+	for _, opt := range opts {
+		opt(hm)
+	}
+	return hm
 }
 
-// Register adds an endpoint for monitoring
-func (hm *HealthMonitor) Register(endpoint string) {
+// defaults returns the monitor-wide endpoint configuration
+func (hm *HealthMonitor) defaults() EndpointConfig {
+	config := EndpointConfig{
+		Interval:         hm.checkInterval,
+		Timeout:          hm.timeout,
+		Threshold:        hm.threshold,
+		RetryDelay:       hm.retryDelay,
+		MaxRetryDelay:    circuit.DefaultMaxRetryDelay,
+		SuccessThreshold: circuit.DefaultSuccessThreshold,
+	}
+	for _, opt := range hm.endpointDefaults {
+		opt(&config)
+	}
+	return config
+}
+
+// Register adds an endpoint for monitoring, with opts overriding the
+// monitor's defaults. Once the monitor has started, the endpoint is
+// checked right away
+func (hm *HealthMonitor) Register(endpoint string, opts ...EndpointOption) error {
+	config := hm.defaults()
+	for _, opt := range opts {
+		opt(&config)
+	}
+	if err := config.validate(); err != nil {
+		return fmt.Errorf("endpoint %s: %w", endpoint, err)
+	}
+
 	hm.mu.Lock()
 	defer hm.mu.Unlock()
 
 	if _, exists := hm.checks[endpoint]; exists {
-		return
+		return fmt.Errorf("%w: %s", ErrEndpointExists, endpoint)
 	}
 
-	hm.checks[endpoint] = &HealthCheck{
+	ctx, cancel := context.WithCancel(hm.ctx)
+	check := &HealthCheck{
 		Endpoint: endpoint,
 		Status:   HealthStatusUnknown,
 		Circuit:  CircuitClosed,
+		Config:   config,
+		ctx:      ctx,
+		cancel:   cancel,
+		reset:    make(chan struct{}, 1),
+		breaker:  circuit.New(config.breakerSettings()),
+	}
+	hm.checks[endpoint] = check
+	if hm.started {
+		hm.wg.Add(1)
+		go hm.monitorEndpoint(check)
+	}
+
+	hm.logger.Info("endpoint registered", "endpoint", endpoint, "interval", config.Interval)
+	return nil
+}
+
+// Unregister stops monitoring an endpoint and drops its state. A check in
+// flight is cancelled and its result discarded
+func (hm *HealthMonitor) Unregister(endpoint string) error {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+
+	check, ok := hm.checks[endpoint]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrEndpointNotFound, endpoint)
 	}
+	check.cancel()
+	delete(hm.checks, endpoint)
 
-	hm.logger.Info("endpoint registered", "endpoint", endpoint)
+	hm.logger.Info("endpoint unregistered", "endpoint", endpoint)
+	return nil
+}
+
+// Reconfigure applies opts to a monitored endpoint's configuration. A new
+// interval takes effect from the next tick; status and circuit are kept
+func (hm *HealthMonitor) Reconfigure(endpoint string, opts ...EndpointOption) (EndpointConfig, error) {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+
+	check, ok := hm.checks[endpoint]
+	if !ok {
+		return EndpointConfig{}, fmt.Errorf("%w: %s", ErrEndpointNotFound, endpoint)
+	}
+
+	config := check.Config
+	for _, opt := range opts {
+		opt(&config)
+	}
+	if err := config.validate(); err != nil {
+		return EndpointConfig{}, fmt.Errorf("endpoint %s: %w", endpoint, err)
+	}
+
+	if config.Interval != check.Config.Interval {
+		select {
+		case check.reset <- struct{}{}:
+		default:
+		}
+	}
+	check.Config = config
+	check.breaker.Configure(config.breakerSettings())
+
+	hm.logger.Info("endpoint reconfigured",
+		"endpoint", endpoint,
+		"interval", config.Interval,
+		"timeout", config.Timeout,
+		"threshold", config.Threshold,
+		"retry_delay", config.RetryDelay,
+		"max_retry_delay", config.MaxRetryDelay,
+		"success_threshold", config.SuccessThreshold,
+		"slow_threshold", config.SlowThreshold,
+	)
+	return config, nil
 }
 
 // Start begins health monitoring
 func (hm *HealthMonitor) Start() {
 	hm.logger.Info("starting health monitor", "interval", hm.checkInterval)
 
-	for endpoint := range hm.checks {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+
+	if hm.started || hm.ctx.Err() != nil {
+		return
+	}
+	hm.started = true
+	for _, check := range hm.checks {
 		hm.wg.Add(1)
-		go hm.monitorEndpoint(endpoint)
+		go hm.monitorEndpoint(check)
 	}
 }
 
 // Stop gracefully stops health monitoring
 func (hm *HealthMonitor) Stop() {
 	hm.logger.Info("stopping health monitor")
+	hm.mu.Lock()
+	hm.started = false
+	hm.mu.Unlock()
 	hm.cancel()
 	hm.wg.Wait()
 	hm.logger.Info("health monitor stopped")
@@ -130,19 +419,46 @@ func (hm *HealthMonitor) GetAllStatuses() map[string]*HealthCheck {
 	return statuses
 }
 
-// monitorEndpoint continuously monitors an endpoint
-func (hm *HealthMonitor) monitorEndpoint(endpoint string) {
+// Snapshot returns copies of all health checks ordered by endpoint, safe
+// to read while monitoring runs
+func (hm *HealthMonitor) Snapshot() []HealthCheck {
+	hm.mu.RLock()
+	checks := make([]HealthCheck, 0, len(hm.checks))
+	for _, check := range hm.checks {
+		checks = append(checks, *check)
+	}
+	hm.mu.RUnlock()
+
+	sort.Slice(checks, func(i, j int) bool {
+		return checks[i].Endpoint < checks[j].Endpoint
+	})
+	return checks
+}
+
+// monitorEndpoint continuously monitors an endpoint until it is
+// unregistered or the monitor stops
+func (hm *HealthMonitor) monitorEndpoint(check *HealthCheck) {
 	defer hm.wg.Done()
 
-	ticker := time.NewTicker(hm.checkInterval)
+	hm.mu.RLock()
+	interval := check.Config.Interval
+	hm.mu.RUnlock()
+
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ticker.C:
-			hm.performCheck(endpoint)
+			hm.performCheck(check.Endpoint)
 
-		case <-hm.ctx.Done():
+		case <-check.reset:
+			hm.mu.RLock()
+			interval = check.Config.Interval
+			hm.mu.RUnlock()
+			ticker.Reset(interval)
+
+		case <-check.ctx.Done():
 			return
 		}
 	}
@@ -151,95 +467,246 @@ func (hm *HealthMonitor) monitorEndpoint(endpoint string) {
 // performCheck executes a health check with circuit breaker logic
 func (hm *HealthMonitor) performCheck(endpoint string) {
 	hm.mu.RLock()
-	check := hm.checks[endpoint]
+	check, ok := hm.checks[endpoint]
+	var config EndpointConfig
+	if ok {
+		config = check.Config
+	}
 	hm.mu.RUnlock()
+	if !ok {
+		return
+	}
 
-	// Circuit breaker: skip check if open and not ready for retry
-	if check.Circuit == CircuitOpen {
-		if time.Since(check.LastCheck) < hm.retryDelay {
-			return
-		}
-		// Move to half-open for retry
-		hm.updateCircuit(endpoint, CircuitHalfOpen)
+	// Circuit breaker: skip the check while open, or while another retry
+	// of a half-open circuit is in flight
+	call, err := check.breaker.Allow()
+	if err != nil {
+		return
 	}
+	hm.updateCircuit(check)
 
 	// Perform health check with timeout
-	ctx, cancel := context.WithTimeout(hm.ctx, hm.timeout)
+	ctx, cancel := context.WithTimeout(check.ctx, config.Timeout)
 	defer cancel()
 
 	start := time.Now()
-	err := hm.checkEndpoint(ctx, endpoint)
+	components, err := hm.checkEndpoint(ctx, endpoint, config.Timeout)
 	latency := time.Since(start)
 
-	hm.updateHealth(endpoint, err, latency)
+	// Slow answers count as failures
+	err = call.Done(err)
+	hm.updateHealth(check, components, err, latency)
+}
+
+// checkEndpoint probes the registry API and, when the endpoint is a
+// Harbor instance, its per-component health API
+func (hm *HealthMonitor) checkEndpoint(ctx context.Context, endpoint string, timeout time.Duration) ([]ComponentHealth, error) {
+	base := strings.TrimSuffix(endpoint, "/")
+
+	resp, err := hm.probe(ctx, base+"/v2/", timeout)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	// 401 means the registry is up and merely wants credentials
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusUnauthorized {
+		return nil, fmt.Errorf("registry API returned %d", resp.StatusCode)
+	}
+
+	resp, err = hm.probe(ctx, base+harborHealthPath, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// Plain distribution registries have no Harbor health API
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+
+	var payload struct {
+		Status     string `json:"status"`
+		Components []struct {
+			Name   string `json:"name"`
+			Status string `json:"status"`
+			Error  string `json:"error"`
+		} `json:"components"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&payload); err != nil {
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("harbor health API returned %d", resp.StatusCode)
+		}
+		return nil, fmt.Errorf("failed to decode harbor health: %w", err)
+	}
+
+	components := make([]ComponentHealth, 0, len(payload.Components))
+	for _, c := range payload.Components {
+		components = append(components, ComponentHealth{
+			Name:   c.Name,
+			Status: HealthStatus(c.Status),
+			Error:  c.Error,
+		})
+	}
+	return components, nil
+}
+
+// probe issues a GET request against an endpoint URL
+func (hm *HealthMonitor) probe(ctx context.Context, url string, timeout time.Duration) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := hm.client.Do(req)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("health check timeout after %s", timeout)
+		}
+		return nil, err
+	}
+	return resp, nil
 }
 
-// checkEndpoint performs the actual health check
-func (hm *HealthMonitor) checkEndpoint(ctx context.Context, endpoint string) error {
-	// Simulate health check (would call actual registry API)
-	select {
-	case <-ctx.Done():
-		return fmt.Errorf("health check timeout")
-	case <-time.After(50 * time.Millisecond):
-		// Simulate 10% failure rate for testing
-		if time.Now().UnixNano()%10 == 0 {
-			return fmt.Errorf("simulated failure")
+// unhealthyComponents returns the names of components not reporting healthy
+func unhealthyComponents(components []ComponentHealth) []string {
+	var names []string
+	for _, c := range components {
+		if c.Status != HealthStatusHealthy {
+			names = append(names, c.Name)
 		}
-		return nil
 	}
+	return names
 }
 
-// updateHealth updates health status based on check result
-func (hm *HealthMonitor) updateHealth(endpoint string, err error, latency time.Duration) {
+// updateHealth updates health status based on check result. Results of
+// an endpoint unregistered during the check are discarded
+func (hm *HealthMonitor) updateHealth(check *HealthCheck, components []ComponentHealth, err error, latency time.Duration) {
 	hm.mu.Lock()
-	defer hm.mu.Unlock()
 
-	check := hm.checks[endpoint]
+	endpoint := check.Endpoint
+	if hm.checks[endpoint] != check {
+		hm.mu.Unlock()
+		return
+	}
+	fromStatus, fromCircuit := check.Status, check.Circuit
+	breaker := check.breaker.Status()
 	check.LastCheck = time.Now()
 	check.Latency = latency
 	check.Attempts++
+	check.Circuit = CircuitState(breaker.State)
+	check.RetryAt = breaker.RetryAt
 
 	if err != nil {
 		check.Error = err.Error()
 		check.Consecutive++
+		check.Components = nil
 
-		// Update status based on consecutive failures
-		if check.Consecutive >= hm.threshold {
+		// An open circuit makes the endpoint unhealthy, fewer failures
+		// degrade it
+		if check.Circuit == CircuitOpen {
 			check.Status = HealthStatusUnhealthy
-			check.Circuit = CircuitOpen
-			hm.logger.Error("endpoint unhealthy, circuit opened",
-				"endpoint", endpoint,
-				"consecutive_failures", check.Consecutive,
-			)
-		} else if check.Consecutive > 0 {
+			if fromCircuit != CircuitOpen {
+				hm.logger.Error("endpoint unhealthy, circuit opened",
+					"endpoint", endpoint,
+					"consecutive_failures", check.Consecutive,
+					"retry_delay", breaker.RetryDelay,
+				)
+			}
+		} else {
 			check.Status = HealthStatusDegraded
 		}
 	} else {
-		// Successful check
-		check.Error = ""
+		// Successful check; unhealthy Harbor components still degrade it
 		check.Consecutive = 0
-		check.Status = HealthStatusHealthy
+		check.Components = components
+
+		if degraded := unhealthyComponents(components); len(degraded) > 0 {
+			if check.Status != HealthStatusDegraded {
+				hm.logger.Warn("endpoint degraded by unhealthy components",
+					"endpoint", endpoint,
+					"components", degraded,
+				)
+			}
+			check.Status = HealthStatusDegraded
+			check.Error = "unhealthy components: " + strings.Join(degraded, ", ")
+		} else {
+			check.Status = HealthStatusHealthy
+			check.Error = ""
+		}
 
-		// Close circuit if it was open/half-open
-		if check.Circuit != CircuitClosed {
-			check.Circuit = CircuitClosed
+		// The circuit closes after enough successful retries
+		if check.Circuit == CircuitClosed && fromCircuit != CircuitClosed {
 			hm.logger.Info("endpoint recovered, circuit closed",
 				"endpoint", endpoint,
 				"latency_ms", latency.Milliseconds(),
 			)
 		}
 	}
+
+	toStatus, toCircuit, checkErr := check.Status, check.Circuit, check.Error
+	consecutive, checkedAt := check.Consecutive, check.LastCheck
+	hm.mu.Unlock()
+
+	hm.recordCheck(CheckResult{
+		Endpoint: endpoint,
+		Time:     checkedAt,
+		Status:   toStatus,
+		Up:       err == nil,
+		Latency:  latency,
+		Error:    checkErr,
+	})
+
+	// Publish outside the lock so subscribers can query the monitor
+	if toStatus != fromStatus {
+		hm.events.Publish(hm.ctx, events.HealthChanged{
+			Endpoint: endpoint,
+			From:     string(fromStatus),
+			To:       string(toStatus),
+			Error:    checkErr,
+		})
+	}
+	if toCircuit != fromCircuit {
+		hm.events.Publish(hm.ctx, events.CircuitChanged{
+			Endpoint: endpoint,
+			From:     string(fromCircuit),
+			To:       string(toCircuit),
+		})
+	}
+	hm.events.Publish(hm.ctx, events.HealthChecked{
+		Endpoint:    endpoint,
+		Status:      string(toStatus),
+		Circuit:     string(toCircuit),
+		Latency:     latency,
+		Consecutive: consecutive,
+		Error:       checkErr,
+	})
 }
 
-// updateCircuit updates circuit breaker state
-func (hm *HealthMonitor) updateCircuit(endpoint string, state CircuitState) {
+// updateCircuit copies the breaker's state to the check, which changes
+// outside checks when an open circuit lets a retry through
+func (hm *HealthMonitor) updateCircuit(check *HealthCheck) {
 	hm.mu.Lock()
-	defer hm.mu.Unlock()
-
-	check := hm.checks[endpoint]
+	endpoint := check.Endpoint
+	if hm.checks[endpoint] != check {
+		hm.mu.Unlock()
+		return
+	}
+	breaker := check.breaker.Status()
+	from, state := check.Circuit, CircuitState(breaker.State)
 	check.Circuit = state
-	hm.logger.Info("circuit state changed",
-		"endpoint", endpoint,
-		"state", state,
-	)
+	check.RetryAt = breaker.RetryAt
+	hm.mu.Unlock()
+
+	if from != state {
+		hm.logger.Info("circuit state changed",
+			"endpoint", endpoint,
+			"state", state,
+		)
+		hm.events.Publish(hm.ctx, events.CircuitChanged{
+			Endpoint: endpoint,
+			From:     string(from),
+			To:       string(state),
+		})
+	}
 }
@@ -5,15 +5,61 @@
 package registry
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/vjranagit/harbor/pkg/events"
 )
 
+// newHarborServer serves /v2/ and a Harbor health document with the
+// given component statuses; nil components means a plain registry
+func newHarborServer(t *testing.T, registryStatus int, components map[string]string) *httptest.Server {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(registryStatus)
+	})
+	if components != nil {
+		mux.HandleFunc("/api/v2.0/health", func(w http.ResponseWriter, r *http.Request) {
+			type component struct {
+				Name   string `json:"name"`
+				Status string `json:"status"`
+			}
+			doc := struct {
+				Status     string      `json:"status"`
+				Components []component `json:"components"`
+			}{Status: "healthy"}
+
+			for name, status := range components {
+				if status != "healthy" {
+					doc.Status = "unhealthy"
+				}
+				doc.Components = append(doc.Components, component{Name: name, Status: status})
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(doc)
+		})
+	}
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
 func TestHealthMonitor_CircuitBreaker(t *testing.T) {
 	hm := NewHealthMonitor(
-		3,                   // threshold
-		5*time.Second,       // retry delay
-		2*time.Second,       // timeout
+		3,                    // threshold
+		5*time.Second,        // retry delay
+		2*time.Second,        // timeout
 		100*time.Millisecond, // check interval
 	)
 
@@ -60,10 +106,33 @@ func TestHealthMonitor_MultipleEndpoints(t *testing.T) {
 	}
 }
 
+func TestHealthMonitor_Snapshot(t *testing.T) {
+	endpoint := newHarborServer(t, http.StatusBadGateway, nil).URL
+
+	hm := NewHealthMonitor(3, time.Hour, time.Second, time.Hour)
+	hm.Register(endpoint)
+	hm.Register("https://a.example.com")
+
+	checks := hm.Snapshot()
+	if len(checks) != 2 || checks[0].Endpoint != endpoint || checks[1].Endpoint != "https://a.example.com" {
+		t.Fatalf("expected 2 checks ordered by endpoint, got %+v", checks)
+	}
+
+	// Snapshots are copies that later checks do not change
+	before := checks[0]
+	hm.performCheck(endpoint)
+	if before.Status != HealthStatusUnknown || before.Consecutive != 0 {
+		t.Errorf("expected snapshot to keep its values, got %s/%d", before.Status, before.Consecutive)
+	}
+	if after := hm.Snapshot()[0]; after.Status != HealthStatusDegraded {
+		t.Errorf("expected new snapshot to be %s, got %s", HealthStatusDegraded, after.Status)
+	}
+}
+
 func TestHealthMonitor_StatusTransitions(t *testing.T) {
 	hm := NewHealthMonitor(3, 2*time.Second, 1*time.Second, 50*time.Millisecond)
 
-	endpoint := "https://test.example.com"
+	endpoint := newHarborServer(t, http.StatusOK, nil).URL
 	hm.Register(endpoint)
 	hm.Start()
 
@@ -111,3 +180,367 @@ func TestHealthMonitor_GracefulShutdown(t *testing.T) {
 		t.Fatal("Stop() did not complete within timeout")
 	}
 }
+
+func TestHealthMonitor_HarborComponents(t *testing.T) {
+	tests := []struct {
+		name           string
+		registryStatus int
+		components     map[string]string
+		wantStatus     HealthStatus
+		wantComponents int
+	}{
+		{
+			name:           "plain registry",
+			registryStatus: http.StatusOK,
+			wantStatus:     HealthStatusHealthy,
+		},
+		{
+			name:           "registry requiring auth",
+			registryStatus: http.StatusUnauthorized,
+			wantStatus:     HealthStatusHealthy,
+		},
+		{
+			name:           "all harbor components healthy",
+			registryStatus: http.StatusUnauthorized,
+			components: map[string]string{
+				"core": "healthy", "jobservice": "healthy", "registry": "healthy",
+				"database": "healthy", "redis": "healthy", "trivy": "healthy",
+			},
+			wantStatus:     HealthStatusHealthy,
+			wantComponents: 6,
+		},
+		{
+			name:           "unhealthy database degrades endpoint",
+			registryStatus: http.StatusOK,
+			components: map[string]string{
+				"core": "healthy", "database": "unhealthy", "redis": "healthy",
+			},
+			wantStatus:     HealthStatusDegraded,
+			wantComponents: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			endpoint := newHarborServer(t, tt.registryStatus, tt.components).URL
+
+			hm := NewHealthMonitor(3, time.Second, time.Second, time.Hour)
+			hm.Register(endpoint)
+			hm.performCheck(endpoint)
+
+			status, _ := hm.GetStatus(endpoint)
+			if status.Status != tt.wantStatus {
+				t.Errorf("expected status %s, got %s (error: %s)", tt.wantStatus, status.Status, status.Error)
+			}
+			if len(status.Components) != tt.wantComponents {
+				t.Errorf("expected %d components, got %d", tt.wantComponents, len(status.Components))
+			}
+			if status.Circuit != CircuitClosed {
+				t.Errorf("expected circuit %s, got %s", CircuitClosed, status.Circuit)
+			}
+		})
+	}
+}
+
+func TestHealthMonitor_ProbeFailuresOpenCircuit(t *testing.T) {
+	endpoint := newHarborServer(t, http.StatusBadGateway, nil).URL
+
+	hm := NewHealthMonitor(2, time.Hour, time.Second, time.Hour)
+	hm.Register(endpoint)
+
+	hm.performCheck(endpoint)
+	status, _ := hm.GetStatus(endpoint)
+	if status.Status != HealthStatusDegraded {
+		t.Errorf("expected status %s after one failure, got %s", HealthStatusDegraded, status.Status)
+	}
+
+	hm.performCheck(endpoint)
+	if status.Status != HealthStatusUnhealthy || status.Circuit != CircuitOpen {
+		t.Errorf("expected unhealthy with open circuit, got %s/%s", status.Status, status.Circuit)
+	}
+}
+
+func TestHealthMonitor_Events(t *testing.T) {
+	endpoint := newHarborServer(t, http.StatusBadGateway, nil).URL
+
+	bus := events.NewBus()
+	hm := NewHealthMonitor(2, time.Hour, time.Second, time.Hour, WithHealthEvents(bus))
+	hm.Register(endpoint)
+
+	var got []events.Payload
+	bus.Subscribe(func(ctx context.Context, e events.Event) {
+		// Handlers may query the monitor that published the event
+		hm.GetStatus(endpoint)
+		got = append(got, e.Payload)
+	}, events.Synchronous(), events.WithTopics("health.*"))
+
+	hm.performCheck(endpoint)
+	hm.performCheck(endpoint)
+	hm.performCheck(endpoint) // circuit open: skipped, no event
+
+	want := []events.Payload{
+		events.HealthChanged{Endpoint: endpoint, From: "unknown", To: "degraded"},
+		events.HealthChecked{Endpoint: endpoint, Status: "degraded", Circuit: "closed", Consecutive: 1},
+		events.HealthChanged{Endpoint: endpoint, From: "degraded", To: "unhealthy"},
+		events.CircuitChanged{Endpoint: endpoint, From: "closed", To: "open"},
+		events.HealthChecked{Endpoint: endpoint, Status: "unhealthy", Circuit: "open", Consecutive: 2},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d events, got %d: %+v", len(want), len(got), got)
+	}
+	for i := range want {
+		// Errors carry probe details, so compare the transition only
+		switch p := got[i].(type) {
+		case events.HealthChanged:
+			if p.Error == "" {
+				t.Errorf("event %d: expected probe error", i)
+			}
+			p.Error = ""
+			got[i] = p
+		case events.HealthChecked:
+			if p.Error == "" || p.Latency <= 0 {
+				t.Errorf("event %d: expected probe error and latency, got %+v", i, p)
+			}
+			p.Error, p.Latency = "", 0
+			got[i] = p
+		}
+		if got[i] != want[i] {
+			t.Errorf("event %d: expected %+v, got %+v", i, want[i], got[i])
+		}
+	}
+}
+
+// newSwitchServer serves /v2/ of a plain registry with the status held in
+// the returned value
+func newSwitchServer(t *testing.T, status int) (*httptest.Server, *atomic.Int64) {
+	t.Helper()
+
+	var current atomic.Int64
+	current.Store(int64(status))
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(current.Load()))
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv, &current
+}
+
+func TestHealthMonitor_HalfOpenQuota(t *testing.T) {
+	srv, status := newSwitchServer(t, http.StatusBadGateway)
+
+	hm := NewHealthMonitor(1, 0, time.Second, time.Hour, WithEndpointDefaults(WithSuccessThreshold(3)))
+	hm.Register(srv.URL)
+
+	hm.performCheck(srv.URL)
+	if check := hm.Snapshot()[0]; check.Circuit != CircuitOpen || check.Status != HealthStatusUnhealthy {
+		t.Fatalf("expected an open circuit, got %s/%s", check.Circuit, check.Status)
+	}
+
+	status.Store(http.StatusOK)
+	for i := 1; i <= 3; i++ {
+		hm.performCheck(srv.URL)
+		check := hm.Snapshot()[0]
+		want := CircuitHalfOpen
+		if i == 3 {
+			want = CircuitClosed
+		}
+		if check.Circuit != want || check.Status != HealthStatusHealthy {
+			t.Errorf("retry %d: expected %s and healthy, got %s/%s", i, want, check.Circuit, check.Status)
+		}
+	}
+
+	// A failed retry opens the circuit again
+	status.Store(http.StatusBadGateway)
+	hm.performCheck(srv.URL)
+	status.Store(http.StatusOK)
+	hm.performCheck(srv.URL)
+	status.Store(http.StatusBadGateway)
+	hm.performCheck(srv.URL)
+	if check := hm.Snapshot()[0]; check.Circuit != CircuitOpen || check.Status != HealthStatusUnhealthy {
+		t.Errorf("expected a failed retry to reopen the circuit, got %s/%s", check.Circuit, check.Status)
+	}
+}
+
+func TestHealthMonitor_RetryBackoff(t *testing.T) {
+	srv, _ := newSwitchServer(t, http.StatusBadGateway)
+
+	hm := NewHealthMonitor(1, 50*time.Millisecond, time.Second, time.Hour,
+		WithEndpointDefaults(WithMaxRetryDelay(100*time.Millisecond)))
+	hm.Register(srv.URL)
+
+	for _, want := range []time.Duration{50 * time.Millisecond, 100 * time.Millisecond, 100 * time.Millisecond} {
+		hm.performCheck(srv.URL)
+		check := hm.Snapshot()[0]
+		if wait := check.RetryAt.Sub(check.LastCheck); check.Circuit != CircuitOpen || wait > want || wait < want-20*time.Millisecond {
+			t.Fatalf("expected a %s retry delay, got %s (%s)", want, wait, check.Circuit)
+		}
+
+		// Checks before the retry are skipped
+		attempts := check.Attempts
+		hm.performCheck(srv.URL)
+		if got := hm.Snapshot()[0].Attempts; got != attempts {
+			t.Errorf("expected no check while open, got %d attempts", got)
+		}
+		time.Sleep(time.Until(check.RetryAt))
+	}
+}
+
+func TestHealthMonitor_SlowThreshold(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(30 * time.Millisecond)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	hm := NewHealthMonitor(2, time.Hour, time.Second, time.Hour)
+	hm.Register(srv.URL, WithSlowThreshold(10*time.Millisecond))
+
+	hm.performCheck(srv.URL)
+	check := hm.Snapshot()[0]
+	if check.Status != HealthStatusDegraded || !strings.Contains(check.Error, "slow response") {
+		t.Errorf("expected a slow check to degrade the endpoint, got %s: %s", check.Status, check.Error)
+	}
+	hm.performCheck(srv.URL)
+	if check := hm.Snapshot()[0]; check.Circuit != CircuitOpen {
+		t.Errorf("expected slow checks to open the circuit, got %s", check.Circuit)
+	}
+
+	if _, err := hm.Reconfigure(srv.URL, WithSuccessThreshold(0)); err == nil {
+		t.Error("expected a success threshold of 0 to be rejected")
+	}
+}
+
+// newCountingServer serves /v2/ with status and counts the requests
+func newCountingServer(t *testing.T, status int) (*httptest.Server, *atomic.Int64) {
+	t.Helper()
+
+	var hits atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &hits
+}
+
+// waitHits waits until a server has seen at least n requests
+func waitHits(t *testing.T, hits *atomic.Int64, n int64) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for hits.Load() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected at least %d requests, got %d", n, hits.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHealthMonitor_RegisterWhileRunning(t *testing.T) {
+	srv, hits := newCountingServer(t, http.StatusOK)
+
+	hm := NewHealthMonitor(3, time.Second, time.Second, time.Hour)
+	hm.Start()
+	defer hm.Stop()
+
+	if err := hm.Register(srv.URL, WithCheckInterval(20*time.Millisecond)); err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	waitHits(t, hits, 2)
+
+	checks := hm.Snapshot()
+	if len(checks) != 1 || checks[0].Config.Interval != 20*time.Millisecond || checks[0].Config.Threshold != 3 {
+		t.Fatalf("expected the interval override and default threshold, got %+v", checks)
+	}
+
+	if err := hm.Register(srv.URL); !errors.Is(err, ErrEndpointExists) {
+		t.Errorf("expected ErrEndpointExists, got %v", err)
+	}
+	if err := hm.Register("https://b.example.com", WithFailureThreshold(0)); err == nil {
+		t.Error("expected an invalid threshold to be rejected")
+	}
+	if _, ok := hm.GetStatus("https://b.example.com"); ok {
+		t.Error("expected a rejected endpoint not to be registered")
+	}
+}
+
+func TestHealthMonitor_Unregister(t *testing.T) {
+	srv, hits := newCountingServer(t, http.StatusOK)
+
+	hm := NewHealthMonitor(3, time.Second, time.Second, 20*time.Millisecond)
+	hm.Register(srv.URL)
+	hm.Start()
+	defer hm.Stop()
+	waitHits(t, hits, 1)
+
+	if err := hm.Unregister(srv.URL); err != nil {
+		t.Fatalf("Unregister failed: %v", err)
+	}
+	if _, ok := hm.GetStatus(srv.URL); ok {
+		t.Error("expected the endpoint to be gone")
+	}
+
+	// Allow a check that was in flight to finish
+	time.Sleep(50 * time.Millisecond)
+	before := hits.Load()
+	time.Sleep(100 * time.Millisecond)
+	if after := hits.Load(); after != before {
+		t.Errorf("expected no checks after Unregister, got %d more", after-before)
+	}
+
+	if err := hm.Unregister(srv.URL); !errors.Is(err, ErrEndpointNotFound) {
+		t.Errorf("expected ErrEndpointNotFound, got %v", err)
+	}
+
+	// The endpoint can come back
+	if err := hm.Register(srv.URL); err != nil {
+		t.Fatalf("Register after Unregister failed: %v", err)
+	}
+	waitHits(t, hits, before+1)
+}
+
+func TestHealthMonitor_Reconfigure(t *testing.T) {
+	srv, hits := newCountingServer(t, http.StatusBadGateway)
+
+	hm := NewHealthMonitor(3, time.Hour, time.Second, time.Hour)
+	hm.Register(srv.URL)
+	hm.Start()
+	defer hm.Stop()
+
+	config, err := hm.Reconfigure(srv.URL, WithFailureThreshold(1), WithCheckInterval(20*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Reconfigure failed: %v", err)
+	}
+	if config.Threshold != 1 || config.Interval != 20*time.Millisecond || config.Timeout != time.Second {
+		t.Errorf("expected threshold 1 and a 20ms interval with the default timeout, got %+v", config)
+	}
+
+	// The shorter interval applies without waiting out the hour
+	waitHits(t, hits, 1)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		checks := hm.Snapshot()
+		if checks[0].Circuit == CircuitOpen {
+			if checks[0].Consecutive != 1 {
+				t.Errorf("expected the circuit to open after 1 failure, got %d", checks[0].Consecutive)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the circuit to open, got %+v", checks[0])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := hm.Reconfigure(srv.URL, WithCheckTimeout(-time.Second)); err == nil {
+		t.Error("expected a negative timeout to be rejected")
+	}
+	if got := hm.Snapshot()[0].Config.Timeout; got != time.Second {
+		t.Errorf("expected a rejected change to keep the timeout, got %s", got)
+	}
+	if _, err := hm.Reconfigure("https://missing.example.com"); !errors.Is(err, ErrEndpointNotFound) {
+		t.Errorf("expected ErrEndpointNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,573 @@
+// Copyright 2021 vjranagit
+//
+// Availability, latency and SLO reporting over health check history
+
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+)
+
+// DefaultMaxCheckGap is how long one check result counts for when no
+// later check follows it
+const DefaultMaxCheckGap = 5 * time.Minute
+
+// HealthReportOptions selects the checks a report covers
+type HealthReportOptions struct {
+	// Endpoint limits the report to one endpoint
+	Endpoint string
+	// Since and Until bound the reported period; a zero Since starts at
+	// the oldest check and a zero Until ends now
+	Since time.Time
+	Until time.Time
+	// Objective is the availability objective in percent, e.g. 99.9. Zero
+	// leaves out the error budget and burn rates
+	Objective float64
+	// MaxGap bounds how long a check result counts for, so periods nothing
+	// was monitoring are left out; DefaultMaxCheckGap applies when zero
+	MaxGap time.Duration
+	// BurnRates are evaluated at Until; DefaultBurnRateWindows apply when
+	// nil
+	BurnRates []BurnRateWindow
+}
+
+// BurnRateWindow is a multi-window burn rate alert: it fires when the
+// error budget burns at Threshold times the sustainable rate over both the
+// long and the short window
+type BurnRateWindow struct {
+	Name      string
+	Long      time.Duration
+	Short     time.Duration
+	Threshold float64
+}
+
+// DefaultBurnRateWindows are the usual page and ticket alerts: 2% of a
+// 30 day budget spent in an hour, 5% in six hours, and 10% in three days
+func DefaultBurnRateWindows() []BurnRateWindow {
+	return []BurnRateWindow{
+		{Name: "page", Long: time.Hour, Short: 5 * time.Minute, Threshold: 14.4},
+		{Name: "page", Long: 6 * time.Hour, Short: 30 * time.Minute, Threshold: 6},
+		{Name: "ticket", Long: 3 * 24 * time.Hour, Short: 6 * time.Hour, Threshold: 1},
+	}
+}
+
+// HealthReport summarizes the recorded checks of each endpoint over a
+// period
+type HealthReport struct {
+	Since     time.Time
+	Until     time.Time
+	Objective float64
+	Endpoints []EndpointReport
+}
+
+// EndpointReport is one endpoint's availability and latency over a period
+type EndpointReport struct {
+	Endpoint string
+	Checks   int
+	Failures int
+	// Incidents counts the times the endpoint went down
+	Incidents int
+	// Monitored is how much of the period check results cover, and
+	// Downtime how much of that the endpoint was down
+	Monitored time.Duration
+	Downtime  time.Duration
+	// Availability is the percentage of monitored time the endpoint was up
+	Availability float64
+	// Latency summarizes the checks the endpoint answered
+	Latency LatencySummary
+	// Budget and BurnRates are set when the report has an objective
+	Budget    *ErrorBudget
+	BurnRates []BurnRate
+}
+
+// LatencySummary holds latency percentiles
+type LatencySummary struct {
+	P50  time.Duration
+	P95  time.Duration
+	P99  time.Duration
+	Max  time.Duration
+	Mean time.Duration
+}
+
+// ErrorBudget is how much downtime the objective allows over the
+// monitored time, and how much of it was used
+type ErrorBudget struct {
+	Allowed time.Duration
+	// Consumed is the percentage of the allowed downtime used; above 100
+	// the objective was missed
+	Consumed float64
+	Met      bool
+}
+
+// BurnRate is a burn rate alert evaluated at the end of the period
+type BurnRate struct {
+	BurnRateWindow
+	// LongRate and ShortRate are how many times faster than sustainable
+	// the budget burned over each window
+	LongRate  float64
+	ShortRate float64
+	Firing    bool
+}
+
+// NewHealthReport builds a report from the checks recorded in store
+func NewHealthReport(store CheckHistoryStore, opts HealthReportOptions) (HealthReport, error) {
+	opts = opts.withDefaults()
+
+	// Burn rate windows and the check before the period reach back further
+	// than the period itself
+	q := CheckHistoryQuery{Endpoint: opts.Endpoint, Until: opts.Until}
+	if !opts.Since.IsZero() {
+		from := opts.Since
+		if opts.Objective > 0 {
+			for _, w := range opts.BurnRates {
+				if start := opts.Until.Add(-w.Long); start.Before(from) {
+					from = start
+				}
+			}
+		}
+		q.Since = from.Add(-opts.MaxGap)
+	}
+
+	results, err := store.Query(q)
+	if err != nil {
+		return HealthReport{}, fmt.Errorf("failed to query health history: %w", err)
+	}
+	return BuildHealthReport(results, opts), nil
+}
+
+func (opts HealthReportOptions) withDefaults() HealthReportOptions {
+	if opts.Until.IsZero() {
+		opts.Until = time.Now()
+	}
+	if opts.MaxGap <= 0 {
+		opts.MaxGap = DefaultMaxCheckGap
+	}
+	if opts.BurnRates == nil {
+		opts.BurnRates = DefaultBurnRateWindows()
+	}
+	return opts
+}
+
+// BuildHealthReport summarizes results, ordered by endpoint then time as
+// CheckHistoryStore.Query returns them
+func BuildHealthReport(results []CheckResult, opts HealthReportOptions) HealthReport {
+	opts = opts.withDefaults()
+	report := HealthReport{
+		Since:     opts.Since,
+		Until:     opts.Until,
+		Objective: opts.Objective,
+		Endpoints: []EndpointReport{},
+	}
+
+	for start := 0; start < len(results); {
+		end := start + 1
+		for end < len(results) && results[end].Endpoint == results[start].Endpoint {
+			end++
+		}
+		series := results[start:end]
+		start = end
+
+		if opts.Endpoint != "" && series[0].Endpoint != opts.Endpoint {
+			continue
+		}
+		if er, ok := endpointReport(series, opts); ok {
+			report.Endpoints = append(report.Endpoints, er)
+		}
+	}
+	if report.Since.IsZero() && len(results) > 0 {
+		report.Since = results[0].Time
+		for _, r := range results {
+			if r.Time.Before(report.Since) {
+				report.Since = r.Time
+			}
+		}
+	}
+	return report
+}
+
+// endpointReport summarizes the time-ordered results of one endpoint; ok
+// is false when none of them falls in the period
+func endpointReport(series []CheckResult, opts HealthReportOptions) (EndpointReport, bool) {
+	er := EndpointReport{Endpoint: series[0].Endpoint}
+	er.Monitored, er.Downtime = coverage(series, opts.Since, opts.Until, opts.MaxGap)
+
+	var latencies []time.Duration
+	wasUp := true
+	for _, r := range series {
+		if r.Time.Before(opts.Since) || r.Time.After(opts.Until) {
+			continue
+		}
+		er.Checks++
+		if r.Up {
+			latencies = append(latencies, r.Latency)
+		} else {
+			er.Failures++
+			if wasUp {
+				er.Incidents++
+			}
+		}
+		wasUp = r.Up
+	}
+	if er.Checks == 0 && er.Monitored == 0 {
+		return er, false
+	}
+
+	switch {
+	case er.Monitored > 0:
+		er.Availability = 100 * float64(er.Monitored-er.Downtime) / float64(er.Monitored)
+	case er.Checks > 0:
+		// Checks at the very end of the period cover no time
+		er.Availability = 100 * float64(er.Checks-er.Failures) / float64(er.Checks)
+	}
+	er.Latency = summarizeLatency(latencies)
+
+	if opts.Objective > 0 {
+		allowedRatio := 1 - opts.Objective/100
+		budget := &ErrorBudget{
+			Allowed: time.Duration(allowedRatio * float64(er.Monitored)),
+			Met:     er.Availability >= opts.Objective,
+		}
+		if budget.Allowed > 0 {
+			budget.Consumed = 100 * float64(er.Downtime) / float64(budget.Allowed)
+		}
+		er.Budget = budget
+
+		for _, w := range opts.BurnRates {
+			br := BurnRate{
+				BurnRateWindow: w,
+				LongRate:       burnRate(series, opts.Until.Add(-w.Long), opts.Until, opts.MaxGap, allowedRatio),
+				ShortRate:      burnRate(series, opts.Until.Add(-w.Short), opts.Until, opts.MaxGap, allowedRatio),
+			}
+			br.Firing = br.LongRate >= w.Threshold && br.ShortRate >= w.Threshold
+			er.BurnRates = append(er.BurnRates, br)
+		}
+	}
+	return er, true
+}
+
+// coverage returns how much of [from, to] the results cover and how much
+// of that the endpoint was down. Each result holds until the next one,
+// but for at most maxGap
+func coverage(series []CheckResult, from, to time.Time, maxGap time.Duration) (monitored, down time.Duration) {
+	for i, r := range series {
+		start, end := r.Time, r.Time.Add(maxGap)
+		if i+1 < len(series) && series[i+1].Time.Before(end) {
+			end = series[i+1].Time
+		}
+		if !from.IsZero() && start.Before(from) {
+			start = from
+		}
+		if end.After(to) {
+			end = to
+		}
+		if !end.After(start) {
+			continue
+		}
+		monitored += end.Sub(start)
+		if !r.Up {
+			down += end.Sub(start)
+		}
+	}
+	return monitored, down
+}
+
+// burnRate is the error rate over [from, to] relative to the rate the
+// objective allows
+func burnRate(series []CheckResult, from, to time.Time, maxGap time.Duration, allowedRatio float64) float64 {
+	monitored, down := coverage(series, from, to, maxGap)
+	if monitored == 0 || allowedRatio <= 0 {
+		return 0
+	}
+	return float64(down) / float64(monitored) / allowedRatio
+}
+
+// summarizeLatency computes nearest-rank percentiles
+func summarizeLatency(latencies []time.Duration) LatencySummary {
+	if len(latencies) == 0 {
+		return LatencySummary{}
+	}
+	slices.Sort(latencies)
+
+	var total time.Duration
+	for _, l := range latencies {
+		total += l
+	}
+	rank := func(p float64) time.Duration {
+		i := int(p*float64(len(latencies))+0.999999) - 1
+		return latencies[max(0, min(i, len(latencies)-1))]
+	}
+	return LatencySummary{
+		P50:  rank(0.50),
+		P95:  rank(0.95),
+		P99:  rank(0.99),
+		Max:  latencies[len(latencies)-1],
+		Mean: total / time.Duration(len(latencies)),
+	}
+}
+
+// HealthReportFormat is an export format for health reports
+type HealthReportFormat string
+
+const (
+	// HealthReportFormatJSON writes the report as a JSON document
+	HealthReportFormatJSON HealthReportFormat = "json"
+	// HealthReportFormatMarkdown writes tables for status pages and
+	// tickets
+	HealthReportFormatMarkdown HealthReportFormat = "markdown"
+)
+
+// reportRecord is the serialized form of a HealthReport
+type reportRecord struct {
+	Since     time.Time              `json:"since"`
+	Until     time.Time              `json:"until"`
+	Objective float64                `json:"objective,omitempty"`
+	Endpoints []endpointReportRecord `json:"endpoints"`
+}
+
+type endpointReportRecord struct {
+	Endpoint     string           `json:"endpoint"`
+	Checks       int              `json:"checks"`
+	Failures     int              `json:"failures"`
+	Incidents    int              `json:"incidents"`
+	Monitored    string           `json:"monitored"`
+	Downtime     string           `json:"downtime"`
+	Availability float64          `json:"availability"`
+	Latency      latencyRecord    `json:"latency"`
+	Budget       *budgetRecord    `json:"budget,omitempty"`
+	BurnRates    []burnRateRecord `json:"burn_rates,omitempty"`
+}
+
+type latencyRecord struct {
+	P50  string `json:"p50"`
+	P95  string `json:"p95"`
+	P99  string `json:"p99"`
+	Max  string `json:"max"`
+	Mean string `json:"mean"`
+}
+
+type budgetRecord struct {
+	Allowed  string  `json:"allowed"`
+	Consumed float64 `json:"consumed"`
+	Met      bool    `json:"met"`
+}
+
+type burnRateRecord struct {
+	Name      string  `json:"name"`
+	Long      string  `json:"long"`
+	Short     string  `json:"short"`
+	Threshold float64 `json:"threshold"`
+	LongRate  float64 `json:"long_rate"`
+	ShortRate float64 `json:"short_rate"`
+	Firing    bool    `json:"firing"`
+}
+
+func newReportRecord(report HealthReport) reportRecord {
+	rec := reportRecord{
+		Since:     report.Since,
+		Until:     report.Until,
+		Objective: report.Objective,
+		Endpoints: make([]endpointReportRecord, 0, len(report.Endpoints)),
+	}
+	for _, er := range report.Endpoints {
+		e := endpointReportRecord{
+			Endpoint:     er.Endpoint,
+			Checks:       er.Checks,
+			Failures:     er.Failures,
+			Incidents:    er.Incidents,
+			Monitored:    er.Monitored.String(),
+			Downtime:     er.Downtime.String(),
+			Availability: er.Availability,
+			Latency: latencyRecord{
+				P50:  er.Latency.P50.String(),
+				P95:  er.Latency.P95.String(),
+				P99:  er.Latency.P99.String(),
+				Max:  er.Latency.Max.String(),
+				Mean: er.Latency.Mean.String(),
+			},
+		}
+		if b := er.Budget; b != nil {
+			e.Budget = &budgetRecord{Allowed: b.Allowed.String(), Consumed: b.Consumed, Met: b.Met}
+		}
+		for _, br := range er.BurnRates {
+			e.BurnRates = append(e.BurnRates, burnRateRecord{
+				Name:      br.Name,
+				Long:      br.Long.String(),
+				Short:     br.Short.String(),
+				Threshold: br.Threshold,
+				LongRate:  br.LongRate,
+				ShortRate: br.ShortRate,
+				Firing:    br.Firing,
+			})
+		}
+		rec.Endpoints = append(rec.Endpoints, e)
+	}
+	return rec
+}
+
+func (rec reportRecord) report() (HealthReport, error) {
+	report := HealthReport{Since: rec.Since, Until: rec.Until, Objective: rec.Objective}
+
+	var err error
+	duration := func(field, s string) time.Duration {
+		d, perr := time.ParseDuration(s)
+		if perr != nil && err == nil {
+			err = fmt.Errorf("invalid %s %q", field, s)
+		}
+		return d
+	}
+	for _, e := range rec.Endpoints {
+		er := EndpointReport{
+			Endpoint:     e.Endpoint,
+			Checks:       e.Checks,
+			Failures:     e.Failures,
+			Incidents:    e.Incidents,
+			Monitored:    duration("monitored", e.Monitored),
+			Downtime:     duration("downtime", e.Downtime),
+			Availability: e.Availability,
+			Latency: LatencySummary{
+				P50:  duration("latency", e.Latency.P50),
+				P95:  duration("latency", e.Latency.P95),
+				P99:  duration("latency", e.Latency.P99),
+				Max:  duration("latency", e.Latency.Max),
+				Mean: duration("latency", e.Latency.Mean),
+			},
+		}
+		if b := e.Budget; b != nil {
+			er.Budget = &ErrorBudget{Allowed: duration("allowed", b.Allowed), Consumed: b.Consumed, Met: b.Met}
+		}
+		for _, br := range e.BurnRates {
+			er.BurnRates = append(er.BurnRates, BurnRate{
+				BurnRateWindow: BurnRateWindow{
+					Name:      br.Name,
+					Long:      duration("window", br.Long),
+					Short:     duration("window", br.Short),
+					Threshold: br.Threshold,
+				},
+				LongRate:  br.LongRate,
+				ShortRate: br.ShortRate,
+				Firing:    br.Firing,
+			})
+		}
+		report.Endpoints = append(report.Endpoints, er)
+	}
+	return report, err
+}
+
+// EncodeHealthReport writes report in the given format
+func EncodeHealthReport(w io.Writer, format HealthReportFormat, report HealthReport) error {
+	switch format {
+	case HealthReportFormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(newReportRecord(report))
+
+	case HealthReportFormatMarkdown:
+		return writeMarkdownReport(w, report)
+
+	default:
+		return fmt.Errorf("unsupported report format %q (want json or markdown)", format)
+	}
+}
+
+// DecodeHealthReport reads a report written by EncodeHealthReport as JSON,
+// or served by the API
+func DecodeHealthReport(r io.Reader) (HealthReport, error) {
+	var rec reportRecord
+	if err := json.NewDecoder(r).Decode(&rec); err != nil {
+		return HealthReport{}, fmt.Errorf("invalid health report: %w", err)
+	}
+	return rec.report()
+}
+
+func writeMarkdownReport(w io.Writer, report HealthReport) error {
+	var b strings.Builder
+
+	b.WriteString("# Health report\n\n")
+	fmt.Fprintf(&b, "%s to %s", report.Since.Format(time.RFC3339), report.Until.Format(time.RFC3339))
+	if report.Objective > 0 {
+		fmt.Fprintf(&b, ", objective %s", FormatPercent(report.Objective))
+	}
+	b.WriteString("\n\n")
+
+	if len(report.Endpoints) == 0 {
+		b.WriteString("No health checks recorded.\n")
+		_, err := io.WriteString(w, b.String())
+		return err
+	}
+
+	b.WriteString("| Endpoint | Availability | Downtime | Incidents | Checks | p50 | p95 | p99 |")
+	if report.Objective > 0 {
+		b.WriteString(" Budget used | Objective |")
+	}
+	b.WriteString("\n|---|---:|---:|---:|---:|---:|---:|---:|")
+	if report.Objective > 0 {
+		b.WriteString("---:|---|")
+	}
+	b.WriteString("\n")
+	for _, er := range report.Endpoints {
+		fmt.Fprintf(&b, "| %s | %s | %s | %d | %d | %s | %s | %s |",
+			er.Endpoint, FormatPercent(er.Availability), er.Downtime.Round(time.Second),
+			er.Incidents, er.Checks, RoundLatency(er.Latency.P50), RoundLatency(er.Latency.P95), RoundLatency(er.Latency.P99))
+		if budget := er.Budget; budget != nil {
+			met := "met"
+			if !budget.Met {
+				met = "**missed**"
+			}
+			fmt.Fprintf(&b, " %.1f%% | %s |", budget.Consumed, met)
+		}
+		b.WriteString("\n")
+	}
+
+	if report.Objective > 0 {
+		b.WriteString("\n## Burn rates\n\n")
+		b.WriteString("| Endpoint | Alert | Windows | Burn rate | Threshold | Firing |\n")
+		b.WriteString("|---|---|---|---:|---:|---|\n")
+		for _, er := range report.Endpoints {
+			for _, br := range er.BurnRates {
+				firing := "no"
+				if br.Firing {
+					firing = "**yes**"
+				}
+				fmt.Fprintf(&b, "| %s | %s | %s / %s | %.2f / %.2f | %g | %s |\n",
+					er.Endpoint, br.Name, FormatWindow(br.Long), FormatWindow(br.Short),
+					br.LongRate, br.ShortRate, br.Threshold, firing)
+			}
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// FormatPercent formats an availability percentage with enough digits to
+// tell nines apart
+func FormatPercent(p float64) string {
+	return fmt.Sprintf("%.3f%%", p)
+}
+
+// FormatWindow formats a burn rate window in the largest whole unit, e.g.
+// 3d, 6h or 30m
+func FormatWindow(d time.Duration) string {
+	switch {
+	case d >= 24*time.Hour && d%(24*time.Hour) == 0:
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	case d >= time.Hour && d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d >= time.Minute && d%time.Minute == 0:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	}
+	return d.String()
+}
+
+// RoundLatency rounds a latency for display
+func RoundLatency(d time.Duration) time.Duration {
+	if d >= time.Second {
+		return d.Round(10 * time.Millisecond)
+	}
+	return d.Round(100 * time.Microsecond)
+}
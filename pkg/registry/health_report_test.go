@@ -0,0 +1,209 @@
+// Copyright 2021 vjranagit
+//
+// Health report tests
+
+package registry
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+var reportStart = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// minuteChecks returns an hour of checks of endpoint, one a minute from
+// reportStart, with latency i ms for minute i. Minutes in down fail
+func minuteChecks(endpoint string, down ...int) []CheckResult {
+	failing := make(map[int]bool)
+	for _, m := range down {
+		failing[m] = true
+	}
+
+	var results []CheckResult
+	for i := 0; i < 60; i++ {
+		r := CheckResult{
+			Endpoint: endpoint,
+			Time:     reportStart.Add(time.Duration(i) * time.Minute),
+			Status:   HealthStatusHealthy,
+			Up:       !failing[i],
+			Latency:  time.Duration(i) * time.Millisecond,
+		}
+		if failing[i] {
+			r.Status, r.Error = HealthStatusUnhealthy, "connection refused"
+		}
+		results = append(results, r)
+	}
+	return results
+}
+
+func TestBuildHealthReport(t *testing.T) {
+	results := minuteChecks("https://a.example.com", 10, 11, 12, 13, 14, 40)
+	report := BuildHealthReport(results, HealthReportOptions{
+		Since:     reportStart,
+		Until:     reportStart.Add(time.Hour),
+		Objective: 99,
+		BurnRates: []BurnRateWindow{
+			{Name: "fast", Long: 30 * time.Minute, Short: 5 * time.Minute, Threshold: 2},
+			{Name: "slow", Long: time.Hour, Short: 50 * time.Minute, Threshold: 5},
+		},
+	})
+
+	if len(report.Endpoints) != 1 {
+		t.Fatalf("expected one endpoint, got %+v", report.Endpoints)
+	}
+	er := report.Endpoints[0]
+	if er.Checks != 60 || er.Failures != 6 || er.Incidents != 2 {
+		t.Errorf("expected 60 checks, 6 failures and 2 incidents, got %d/%d/%d", er.Checks, er.Failures, er.Incidents)
+	}
+	if er.Monitored != time.Hour || er.Downtime != 6*time.Minute || er.Availability != 90 {
+		t.Errorf("expected 6m down in an hour (90%%), got %s/%s (%v%%)", er.Downtime, er.Monitored, er.Availability)
+	}
+
+	wantLatency := LatencySummary{P50: 31 * time.Millisecond, P95: 57 * time.Millisecond, P99: 59 * time.Millisecond, Max: 59 * time.Millisecond}
+	got := er.Latency
+	got.Mean = 0
+	if got != wantLatency {
+		t.Errorf("expected latency %+v, got %+v", wantLatency, er.Latency)
+	}
+
+	if b := er.Budget; b == nil || b.Allowed != 36*time.Second || math.Abs(b.Consumed-1000) > 0.001 || b.Met {
+		t.Errorf("expected 36s allowed, 1000%% consumed and missed, got %+v", b)
+	}
+
+	tests := []struct {
+		name        string
+		long, short float64
+		firing      bool
+	}{
+		{"fast", 1.0 / 30 / 0.01, 0, false},
+		{"slow", 0.1 / 0.01, 0.12 / 0.01, true},
+	}
+	for i, tt := range tests {
+		br := er.BurnRates[i]
+		if br.Name != tt.name || math.Abs(br.LongRate-tt.long) > 0.001 || math.Abs(br.ShortRate-tt.short) > 0.001 || br.Firing != tt.firing {
+			t.Errorf("%s: expected rates %.2f/%.2f firing %v, got %+v", tt.name, tt.long, tt.short, tt.firing, br)
+		}
+	}
+}
+
+func TestBuildHealthReport_Gaps(t *testing.T) {
+	results := []CheckResult{
+		{Endpoint: "https://a.example.com", Time: reportStart, Up: true},
+		{Endpoint: "https://a.example.com", Time: reportStart.Add(30 * time.Minute), Up: false},
+	}
+
+	report := BuildHealthReport(results, HealthReportOptions{
+		Since:  reportStart,
+		Until:  reportStart.Add(time.Hour),
+		MaxGap: 5 * time.Minute,
+	})
+	er := report.Endpoints[0]
+	if er.Monitored != 10*time.Minute || er.Downtime != 5*time.Minute || er.Availability != 50 {
+		t.Errorf("expected unmonitored time left out, got %s down of %s (%v%%)", er.Downtime, er.Monitored, er.Availability)
+	}
+	if er.Budget != nil || er.BurnRates != nil {
+		t.Errorf("expected no budget without an objective, got %+v", er)
+	}
+}
+
+func TestBuildHealthReport_Period(t *testing.T) {
+	results := append(minuteChecks("https://a.example.com", 5), minuteChecks("https://b.example.com")...)
+
+	tests := []struct {
+		name      string
+		opts      HealthReportOptions
+		endpoints int
+		checks    int
+	}{
+		{"whole hour", HealthReportOptions{Until: reportStart.Add(time.Hour)}, 2, 60},
+		{"last half", HealthReportOptions{Since: reportStart.Add(30 * time.Minute), Until: reportStart.Add(time.Hour)}, 2, 30},
+		{"one endpoint", HealthReportOptions{Endpoint: "https://b.example.com", Until: reportStart.Add(time.Hour)}, 1, 60},
+		{"before any check", HealthReportOptions{Since: reportStart.Add(-2 * time.Hour), Until: reportStart.Add(-time.Hour)}, 0, 0},
+	}
+
+	for _, tt := range tests {
+		report := BuildHealthReport(results, tt.opts)
+		if len(report.Endpoints) != tt.endpoints {
+			t.Errorf("%s: expected %d endpoints, got %d", tt.name, tt.endpoints, len(report.Endpoints))
+			continue
+		}
+		if tt.endpoints > 0 && report.Endpoints[0].Checks != tt.checks {
+			t.Errorf("%s: expected %d checks, got %d", tt.name, tt.checks, report.Endpoints[0].Checks)
+		}
+	}
+
+	if report := BuildHealthReport(results, HealthReportOptions{Until: reportStart.Add(time.Hour)}); !report.Since.Equal(reportStart) {
+		t.Errorf("expected the period to start at the oldest check, got %v", report.Since)
+	}
+}
+
+func TestNewHealthReport(t *testing.T) {
+	store := NewMemoryCheckHistory(0)
+	for _, r := range minuteChecks("https://a.example.com", 50, 51, 52, 53, 54, 55, 56, 57, 58, 59) {
+		store.Append(r)
+	}
+
+	// The burn rate windows reach back before the reported period
+	report, err := NewHealthReport(store, HealthReportOptions{
+		Since:     reportStart.Add(55 * time.Minute),
+		Until:     reportStart.Add(time.Hour),
+		Objective: 99.9,
+		BurnRates: []BurnRateWindow{{Name: "page", Long: time.Hour, Short: 5 * time.Minute, Threshold: 14.4}},
+	})
+	if err != nil {
+		t.Fatalf("NewHealthReport failed: %v", err)
+	}
+	er := report.Endpoints[0]
+	if er.Checks != 5 || er.Availability != 0 {
+		t.Errorf("expected 5 failed checks in the period, got %+v", er)
+	}
+	if br := er.BurnRates[0]; math.Abs(br.LongRate-1.0/6/0.001) > 0.01 || !br.Firing {
+		t.Errorf("expected the hour window to burn at %.1f and fire, got %+v", 1.0/6/0.001, br)
+	}
+}
+
+func TestEncodeHealthReport(t *testing.T) {
+	report := BuildHealthReport(minuteChecks("https://a.example.com", 10), HealthReportOptions{
+		Since:     reportStart,
+		Until:     reportStart.Add(time.Hour),
+		Objective: 99.9,
+	})
+
+	var buf bytes.Buffer
+	if err := EncodeHealthReport(&buf, HealthReportFormatJSON, report); err != nil {
+		t.Fatalf("json: %v", err)
+	}
+	decoded, err := DecodeHealthReport(&buf)
+	if err != nil {
+		t.Fatalf("DecodeHealthReport failed: %v", err)
+	}
+	want, got := report.Endpoints[0], decoded.Endpoints[0]
+	if got.Downtime != want.Downtime || got.Latency != want.Latency || got.Availability != want.Availability ||
+		*got.Budget != *want.Budget || len(got.BurnRates) != 3 || got.BurnRates[2] != want.BurnRates[2] {
+		t.Errorf("expected %+v after a round trip, got %+v", want, got)
+	}
+	if !decoded.Until.Equal(report.Until) || decoded.Objective != 99.9 {
+		t.Errorf("expected the period and objective to round-trip, got %+v", decoded)
+	}
+
+	buf.Reset()
+	if err := EncodeHealthReport(&buf, HealthReportFormatMarkdown, report); err != nil {
+		t.Fatalf("markdown: %v", err)
+	}
+	for _, line := range []string{
+		"2024-03-01T12:00:00Z to 2024-03-01T13:00:00Z, objective 99.900%",
+		"| https://a.example.com | 98.333% | 1m0s | 1 | 60 | 30ms | 57ms | 59ms | 1666.7% | **missed** |",
+		"| https://a.example.com | ticket | 3d / 6h | 16.67 / 16.67 | 1 | **yes** |",
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("expected %q in:\n%s", line, buf.String())
+		}
+	}
+
+	if err := EncodeHealthReport(&buf, "xml", report); err == nil {
+		t.Error("expected an error for an unsupported format")
+	}
+}
@@ -0,0 +1,339 @@
+// Copyright 2021 vjranagit
+//
+// Persistent storage for tag protection policies
+
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/hcl/v2/hclsimple"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// PolicyFormat is a serialization format for policy files
+type PolicyFormat string
+
+const (
+	PolicyFormatJSON PolicyFormat = "json"
+	PolicyFormatHCL  PolicyFormat = "hcl"
+)
+
+// PolicyStore persists tag protection policies
+type PolicyStore interface {
+	// Load returns every stored policy
+	Load() ([]*ProtectionPolicy, error)
+	// Put creates or replaces a policy by name
+	Put(policy *ProtectionPolicy) error
+	// Delete removes a policy by name
+	Delete(name string) error
+	// Close releases the store
+	Close() error
+}
+
+// OpenPolicyStore opens a store chosen by file extension: .json and .hcl
+// are plain files, .db and .bolt use the embedded database
+func OpenPolicyStore(path string) (PolicyStore, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return NewFilePolicyStore(path, PolicyFormatJSON), nil
+	case ".hcl":
+		return NewFilePolicyStore(path, PolicyFormatHCL), nil
+	case ".db", ".bolt":
+		return OpenBoltPolicyStore(path)
+	default:
+		return nil, fmt.Errorf("unsupported policy store %q (want .json, .hcl, .db or .bolt)", path)
+	}
+}
+
+// PolicyFormatFromPath infers a policy file format from its extension
+func PolicyFormatFromPath(path string) (PolicyFormat, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return PolicyFormatJSON, nil
+	case ".hcl":
+		return PolicyFormatHCL, nil
+	default:
+		return "", fmt.Errorf("cannot infer policy format from %q", path)
+	}
+}
+
+// FilePolicyStore keeps policies in a single JSON or HCL file, rewritten
+// atomically on every change
+type FilePolicyStore struct {
+	path   string
+	format PolicyFormat
+	mu     sync.Mutex
+}
+
+// NewFilePolicyStore creates a file-backed store; the file is created on
+// the first write
+func NewFilePolicyStore(path string, format PolicyFormat) *FilePolicyStore {
+	return &FilePolicyStore{path: path, format: format}
+}
+
+// Load returns every stored policy
+func (s *FilePolicyStore) Load() ([]*ProtectionPolicy, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.load()
+}
+
+// Put creates or replaces a policy by name
+func (s *FilePolicyStore) Put(policy *ProtectionPolicy) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	policies, err := s.load()
+	if err != nil {
+		return err
+	}
+
+	replaced := false
+	for i, existing := range policies {
+		if existing.Name == policy.Name {
+			policies[i] = policy
+			replaced = true
+		}
+	}
+	if !replaced {
+		policies = append(policies, policy)
+	}
+
+	return s.save(policies)
+}
+
+// Delete removes a policy by name
+func (s *FilePolicyStore) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	policies, err := s.load()
+	if err != nil {
+		return err
+	}
+
+	for i, existing := range policies {
+		if existing.Name == name {
+			return s.save(append(policies[:i], policies[i+1:]...))
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrPolicyNotFound, name)
+}
+
+// Close is a no-op for file stores
+func (s *FilePolicyStore) Close() error {
+	return nil
+}
+
+func (s *FilePolicyStore) load() ([]*ProtectionPolicy, error) {
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return DecodePolicies(bytes.NewReader(data), s.path, s.format)
+}
+
+// save writes the policies to a temporary file and renames it into place
+func (s *FilePolicyStore) save(policies []*ProtectionPolicy) error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), "."+filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := EncodePolicies(tmp, s.format, policies); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// LayeredPolicyStore serves a fixed set of policies, such as those declared
+// in a configuration file, on top of a writable store. The fixed policies
+// cannot be replaced or removed through the store
+type LayeredPolicyStore struct {
+	base  PolicyStore
+	fixed map[string]*ProtectionPolicy
+}
+
+// NewLayeredPolicyStore layers fixed policies over base
+func NewLayeredPolicyStore(base PolicyStore, fixed []*ProtectionPolicy) *LayeredPolicyStore {
+	s := &LayeredPolicyStore{base: base, fixed: make(map[string]*ProtectionPolicy)}
+	for _, p := range fixed {
+		s.fixed[p.Name] = p
+	}
+	return s
+}
+
+// Load returns the fixed policies followed by the stored ones; a stored
+// policy shadowed by a fixed one is skipped
+func (s *LayeredPolicyStore) Load() ([]*ProtectionPolicy, error) {
+	stored, err := s.base.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	policies := make([]*ProtectionPolicy, 0, len(s.fixed)+len(stored))
+	for _, p := range s.fixed {
+		policies = append(policies, p)
+	}
+	sort.Slice(policies, func(i, j int) bool { return policies[i].Name < policies[j].Name })
+
+	for _, p := range stored {
+		if _, ok := s.fixed[p.Name]; !ok {
+			policies = append(policies, p)
+		}
+	}
+	return policies, nil
+}
+
+// Put writes to the underlying store unless the name is fixed
+func (s *LayeredPolicyStore) Put(policy *ProtectionPolicy) error {
+	if _, ok := s.fixed[policy.Name]; ok {
+		return fmt.Errorf("%w: %s is defined in configuration", ErrPolicyReadOnly, policy.Name)
+	}
+	return s.base.Put(policy)
+}
+
+// Delete removes from the underlying store unless the name is fixed
+func (s *LayeredPolicyStore) Delete(name string) error {
+	if _, ok := s.fixed[name]; ok {
+		return fmt.Errorf("%w: %s is defined in configuration", ErrPolicyReadOnly, name)
+	}
+	return s.base.Delete(name)
+}
+
+// Close closes the underlying store
+func (s *LayeredPolicyStore) Close() error {
+	return s.base.Close()
+}
+
+// policyDocument is the JSON policy file layout
+type policyDocument struct {
+	Version  int                 `json:"version"`
+	Policies []*ProtectionPolicy `json:"policies"`
+}
+
+// policyHCLFile is the HCL policy file layout
+type policyHCLFile struct {
+	Policies []policyHCLBlock `hcl:"policy,block"`
+}
+
+type policyHCLBlock struct {
+	Name        string `hcl:"name,label"`
+	Pattern     string `hcl:"pattern"`
+	Immutable   bool   `hcl:"immutable,optional"`
+	MaxAge      string `hcl:"max_age,optional"`
+	AllowDelete bool   `hcl:"allow_delete,optional"`
+	Priority    int    `hcl:"priority,optional"`
+}
+
+// EncodePolicies writes policies in the given format, sorted by name
+func EncodePolicies(w io.Writer, format PolicyFormat, policies []*ProtectionPolicy) error {
+	sorted := append([]*ProtectionPolicy(nil), policies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+	switch format {
+	case PolicyFormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(policyDocument{Version: 1, Policies: sorted})
+
+	case PolicyFormatHCL:
+		f := hclwrite.NewEmptyFile()
+		body := f.Body()
+		for i, p := range sorted {
+			if i > 0 {
+				body.AppendNewline()
+			}
+			block := body.AppendNewBlock("policy", []string{p.Name}).Body()
+			block.SetAttributeValue("pattern", cty.StringVal(p.Pattern.String()))
+			if p.Immutable {
+				block.SetAttributeValue("immutable", cty.True)
+			}
+			if p.MaxAge > 0 {
+				block.SetAttributeValue("max_age", cty.StringVal(p.MaxAge.String()))
+			}
+			if p.AllowDelete {
+				block.SetAttributeValue("allow_delete", cty.True)
+			}
+			block.SetAttributeValue("priority", cty.NumberIntVal(int64(p.Priority)))
+		}
+		_, err := f.WriteTo(w)
+		return err
+
+	default:
+		return fmt.Errorf("unsupported policy format %q", format)
+	}
+}
+
+// DecodePolicies reads policies in the given format; filename is only
+// used in error messages
+func DecodePolicies(r io.Reader, filename string, format PolicyFormat) ([]*ProtectionPolicy, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case PolicyFormatJSON:
+		var doc policyDocument
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+		return doc.Policies, nil
+
+	case PolicyFormatHCL:
+		// hclsimple picks the syntax from the extension
+		name := strings.TrimSuffix(filename, filepath.Ext(filename)) + ".hcl"
+		var file policyHCLFile
+		if err := hclsimple.Decode(name, data, nil, &file); err != nil {
+			return nil, err
+		}
+
+		policies := make([]*ProtectionPolicy, 0, len(file.Policies))
+		for _, b := range file.Policies {
+			p, err := newPolicy(policyJSON{
+				Name:        b.Name,
+				Pattern:     b.Pattern,
+				Immutable:   b.Immutable,
+				MaxAge:      b.MaxAge,
+				AllowDelete: b.AllowDelete,
+				Priority:    b.Priority,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", filename, err)
+			}
+			policies = append(policies, p)
+		}
+		return policies, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported policy format %q", format)
+	}
+}
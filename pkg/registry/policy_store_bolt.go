@@ -0,0 +1,91 @@
+// Copyright 2021 vjranagit
+//
+// Embedded database storage for tag protection policies
+
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var policyBucket = []byte("policies")
+
+// BoltPolicyStore keeps policies in an embedded bbolt database, one key
+// per policy name
+type BoltPolicyStore struct {
+	db *bolt.DB
+}
+
+// OpenBoltPolicyStore opens or creates the database at path
+func OpenBoltPolicyStore(path string) (*BoltPolicyStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open policy database %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(policyBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltPolicyStore{db: db}, nil
+}
+
+// Load returns every stored policy, ordered by name
+func (s *BoltPolicyStore) Load() ([]*ProtectionPolicy, error) {
+	var policies []*ProtectionPolicy
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(policyBucket).ForEach(func(k, v []byte) error {
+			var p ProtectionPolicy
+			if err := json.Unmarshal(v, &p); err != nil {
+				return fmt.Errorf("policy %q: %w", k, err)
+			}
+			policies = append(policies, &p)
+			return nil
+		})
+	})
+	return policies, err
+}
+
+// Put creates or replaces a policy by name
+func (s *BoltPolicyStore) Put(policy *ProtectionPolicy) error {
+	data, err := json.Marshal(policy)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(policyBucket).Put([]byte(policy.Name), data)
+	})
+}
+
+// Delete removes a policy by name
+func (s *BoltPolicyStore) Delete(name string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(policyBucket)
+		if b.Get([]byte(name)) == nil {
+			return fmt.Errorf("%w: %s", ErrPolicyNotFound, name)
+		}
+		return b.Delete([]byte(name))
+	})
+}
+
+// Close closes the database
+func (s *BoltPolicyStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,242 @@
+// Copyright 2021 vjranagit
+//
+// Policy store tests
+
+package registry
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPolicyStore_WriteThrough(t *testing.T) {
+	for _, name := range []string{"policies.json", "policies.hcl", "policies.db"} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), name)
+
+			store, err := OpenPolicyStore(path)
+			if err != nil {
+				t.Fatalf("OpenPolicyStore failed: %v", err)
+			}
+
+			tp, err := LoadTagProtection(store)
+			if err != nil {
+				t.Fatalf("LoadTagProtection failed: %v", err)
+			}
+
+			policies := []*ProtectionPolicy{
+				{
+					Name:      "prod-immutable",
+					Pattern:   regexp.MustCompile(`.*:v\d+\.\d+\.\d+$`),
+					Immutable: true,
+					Priority:  10,
+				},
+				{
+					Name:        "recent-protection",
+					Pattern:     regexp.MustCompile(`.*:.*`),
+					MaxAge:      168 * time.Hour,
+					AllowDelete: true,
+					Priority:    5,
+				},
+				{
+					Name:     "scratch",
+					Pattern:  regexp.MustCompile(`scratch/.*`),
+					Priority: 1,
+				},
+			}
+			for _, p := range policies {
+				if err := tp.AddPolicy(p); err != nil {
+					t.Fatalf("AddPolicy(%s) failed: %v", p.Name, err)
+				}
+			}
+			if err := tp.RemovePolicy("scratch"); err != nil {
+				t.Fatalf("RemovePolicy failed: %v", err)
+			}
+			store.Close()
+
+			// Reopen and verify the policies survived
+			store, err = OpenPolicyStore(path)
+			if err != nil {
+				t.Fatalf("reopen failed: %v", err)
+			}
+			defer store.Close()
+
+			reloaded, err := LoadTagProtection(store)
+			if err != nil {
+				t.Fatalf("LoadTagProtection after reopen failed: %v", err)
+			}
+
+			got := reloaded.ListPolicies()
+			if len(got) != 2 {
+				t.Fatalf("expected 2 policies after reopen, got %d", len(got))
+			}
+
+			canModify, _ := reloaded.CanModify(context.Background(), "library/nginx", "v1.2.3", 30*24*time.Hour)
+			if canModify {
+				t.Error("expected immutable policy to survive reload")
+			}
+			canModify, _ = reloaded.CanModify(context.Background(), "library/nginx", "latest", time.Hour)
+			if canModify {
+				t.Error("expected max age policy to survive reload")
+			}
+			canDelete, _ := reloaded.CanDelete(context.Background(), "library/nginx", "latest")
+			if !canDelete {
+				t.Error("expected allow_delete to survive reload")
+			}
+		})
+	}
+}
+
+func TestPolicyStore_RemoveMissing(t *testing.T) {
+	store := NewFilePolicyStore(filepath.Join(t.TempDir(), "policies.json"), PolicyFormatJSON)
+	tp, err := LoadTagProtection(store)
+	if err != nil {
+		t.Fatalf("LoadTagProtection failed: %v", err)
+	}
+
+	if err := tp.RemovePolicy("missing"); !errors.Is(err, ErrPolicyNotFound) {
+		t.Errorf("expected ErrPolicyNotFound, got %v", err)
+	}
+}
+
+func TestPolicyStore_Put(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policies.json")
+	store := NewFilePolicyStore(path, PolicyFormatJSON)
+	tp, err := LoadTagProtection(store)
+	if err != nil {
+		t.Fatalf("LoadTagProtection failed: %v", err)
+	}
+
+	if err := tp.PutPolicy(&ProtectionPolicy{Name: "prod", Pattern: regexp.MustCompile(`:v\d+$`), Immutable: true}); err != nil {
+		t.Fatalf("PutPolicy create failed: %v", err)
+	}
+	if err := tp.PutPolicy(&ProtectionPolicy{Name: "prod", Pattern: regexp.MustCompile(`:release-.*`), Immutable: true}); err != nil {
+		t.Fatalf("PutPolicy replace failed: %v", err)
+	}
+	if err := tp.PutPolicy(&ProtectionPolicy{Name: "prod", Pattern: regexp.MustCompile(``)}); err == nil {
+		t.Error("expected an empty pattern to be rejected")
+	}
+
+	reloaded, err := LoadTagProtection(NewFilePolicyStore(path, PolicyFormatJSON))
+	if err != nil {
+		t.Fatalf("LoadTagProtection after put failed: %v", err)
+	}
+	got := reloaded.ListPolicies()
+	if len(got) != 1 || got[0].Pattern.String() != ":release-.*" {
+		t.Fatalf("expected the replaced policy only, got %+v", got)
+	}
+	if ok, _ := reloaded.CanModify(context.Background(), "library/app", "v1", 0); !ok {
+		t.Error("expected the old pattern to be gone")
+	}
+}
+
+func TestEncodeDecodePolicies(t *testing.T) {
+	policies := []*ProtectionPolicy{
+		{
+			Name:      "prod-immutable",
+			Pattern:   regexp.MustCompile(`.*:v\d+\.\d+\.\d+$`),
+			Immutable: true,
+			Priority:  10,
+		},
+		{
+			Name:     "recent-protection",
+			Pattern:  regexp.MustCompile(`.*:.*`),
+			MaxAge:   168 * time.Hour,
+			Priority: 5,
+		},
+	}
+
+	for _, format := range []PolicyFormat{PolicyFormatJSON, PolicyFormatHCL} {
+		t.Run(string(format), func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := EncodePolicies(&buf, format, policies); err != nil {
+				t.Fatalf("EncodePolicies failed: %v", err)
+			}
+
+			decoded, err := DecodePolicies(&buf, "policies."+string(format), format)
+			if err != nil {
+				t.Fatalf("DecodePolicies failed: %v", err)
+			}
+			if len(decoded) != len(policies) {
+				t.Fatalf("expected %d policies, got %d", len(policies), len(decoded))
+			}
+
+			byName := make(map[string]*ProtectionPolicy)
+			for _, p := range decoded {
+				byName[p.Name] = p
+			}
+			for _, want := range policies {
+				got, ok := byName[want.Name]
+				if !ok {
+					t.Fatalf("policy %s missing after round trip", want.Name)
+				}
+				if got.Pattern.String() != want.Pattern.String() || got.Immutable != want.Immutable ||
+					got.MaxAge != want.MaxAge || got.Priority != want.Priority {
+					t.Errorf("policy %s changed in round trip: %+v", want.Name, got)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodePolicies_InvalidPattern(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		format PolicyFormat
+	}{
+		{"invalid", "policy \"broken\" {\n  pattern = \"([a-z\"\n}\n", PolicyFormatHCL},
+		{"empty hcl", "policy \"all\" {\n  pattern = \"\"\n}\n", PolicyFormatHCL},
+		{"empty json", `{"version": 1, "policies": [{"name": "all", "priority": 1}]}`, PolicyFormatJSON},
+	}
+
+	for _, tt := range tests {
+		if _, err := DecodePolicies(bytes.NewBufferString(tt.src), "policies", tt.format); err == nil || !strings.Contains(err.Error(), "pattern") {
+			t.Errorf("%s: expected the pattern to be rejected, got %v", tt.name, err)
+		}
+	}
+}
+
+func TestLayeredPolicyStore(t *testing.T) {
+	base := NewFilePolicyStore(filepath.Join(t.TempDir(), "policies.json"), PolicyFormatJSON)
+	if err := base.Put(&ProtectionPolicy{Name: "releases", Pattern: regexp.MustCompile(`.*`), Priority: 1}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := base.Put(&ProtectionPolicy{Name: "scratch", Pattern: regexp.MustCompile(`scratch/.*`), Priority: 1}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	fixed := []*ProtectionPolicy{
+		{Name: "releases", Pattern: regexp.MustCompile(`.*:v\d+$`), Immutable: true, Priority: 10},
+	}
+	tp, err := LoadTagProtection(NewLayeredPolicyStore(base, fixed))
+	if err != nil {
+		t.Fatalf("LoadTagProtection failed: %v", err)
+	}
+
+	policies := tp.ListPolicies()
+	if len(policies) != 2 {
+		t.Fatalf("expected 2 policies, got %d", len(policies))
+	}
+	for _, p := range policies {
+		if p.Name == "releases" && !p.Immutable {
+			t.Error("expected configured policy to shadow the stored one")
+		}
+	}
+
+	if err := tp.RemovePolicy("releases"); !errors.Is(err, ErrPolicyReadOnly) {
+		t.Errorf("expected ErrPolicyReadOnly, got %v", err)
+	}
+	if err := tp.RemovePolicy("scratch"); err != nil {
+		t.Errorf("expected stored policy to be removable, got %v", err)
+	}
+	if len(tp.ListPolicies()) != 1 {
+		t.Errorf("expected 1 policy after remove, got %d", len(tp.ListPolicies()))
+	}
+}
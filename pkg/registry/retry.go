@@ -0,0 +1,160 @@
+// Copyright 2021 vjranagit
+//
+// Retry policies for batch targets
+
+package registry
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/vjranagit/harbor/pkg/distribution"
+)
+
+// Retry defaults used by DefaultRetryPolicy
+const (
+	DefaultMaxAttempts = 3
+	DefaultBackoff     = 500 * time.Millisecond
+	DefaultMaxBackoff  = 30 * time.Second
+	DefaultJitter      = 0.2
+
+	// RetryCeiling bounds delays of policies without a MaxBackoff
+	RetryCeiling = 24 * time.Hour
+)
+
+// RetryPolicy decides whether and when a failed batch target is retried
+type RetryPolicy struct {
+	// MaxAttempts counts the first attempt; 1 or less disables retries
+	MaxAttempts int
+	// Backoff is the delay before the first retry, doubled for every
+	// further attempt up to MaxBackoff, or RetryCeiling when MaxBackoff is
+	// zero
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Jitter is the fraction of each delay that is randomized, from 0 to 1
+	Jitter float64
+	// Retryable classifies errors; nil uses IsRetryable
+	Retryable func(error) bool
+}
+
+// DefaultRetryPolicy retries transient failures three times in total
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: DefaultMaxAttempts,
+		Backoff:     DefaultBackoff,
+		MaxBackoff:  DefaultMaxBackoff,
+		Jitter:      DefaultJitter,
+	}
+}
+
+// NoRetry makes a single attempt per target
+func NoRetry() RetryPolicy {
+	return RetryPolicy{MaxAttempts: 1}
+}
+
+// retryable reports whether err is worth another attempt
+func (p RetryPolicy) retryable(err error) bool {
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return IsRetryable(err)
+}
+
+// delay returns how long to wait before attempt+1. A Retry-After from the
+// registry takes precedence over the backoff, capped at MaxBackoff
+func (p RetryPolicy) delay(attempt int, err error) time.Duration {
+	var regErr *distribution.Error
+	if errors.As(err, &regErr) && regErr.RetryAfter > 0 {
+		return p.cap(regErr.RetryAfter)
+	}
+
+	d := p.Backoff
+	for i := 1; i < attempt && d > 0 && d < p.maxBackoff(); i++ {
+		d *= 2
+	}
+	d = p.cap(d)
+
+	if p.Jitter > 0 {
+		d -= time.Duration(p.Jitter * rand.Float64() * float64(d))
+	}
+	return d
+}
+
+func (p RetryPolicy) cap(d time.Duration) time.Duration {
+	return min(d, p.maxBackoff())
+}
+
+// maxBackoff returns MaxBackoff, or RetryCeiling when it is zero
+func (p RetryPolicy) maxBackoff() time.Duration {
+	if p.MaxBackoff > 0 {
+		return p.MaxBackoff
+	}
+	return RetryCeiling
+}
+
+// IsRetryable reports whether err is transient: a registry answer of 408,
+// 429, 500, 502, 503 or 504, a timeout, or a dropped connection.
+// Cancellation is never retried
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var regErr *distribution.Error
+	if errors.As(err, &regErr) {
+		switch regErr.StatusCode {
+		case http.StatusRequestTimeout, http.StatusTooManyRequests,
+			http.StatusInternalServerError, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// runWithRetry runs handler on target until it succeeds, fails with an
+// error the policy does not retry, runs out of attempts or ctx is done.
+// Protection blocks are never retried
+func (bo *BatchOperator) runWithRetry(ctx context.Context, op *BatchOperation, handler batchHandler, target string) (string, int, error) {
+	policy := op.Retry
+	for attempt := 1; ; attempt++ {
+		output, err := handler(ctx, target)
+		if err == nil || attempt >= policy.MaxAttempts || !policy.retryable(err) || ctx.Err() != nil {
+			return output, attempt, err
+		}
+		if _, protected := isProtected(err); protected {
+			return output, attempt, err
+		}
+
+		delay := policy.delay(attempt, err)
+		bo.logger.WarnContext(ctx, "batch target failed, retrying",
+			"id", op.ID,
+			"target", target,
+			"attempt", attempt,
+			"delay", delay,
+			"error", err,
+		)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return output, attempt, err
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright 2021 vjranagit
+//
+// Retry policy tests
+
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/vjranagit/harbor/pkg/distribution"
+	"github.com/vjranagit/harbor/pkg/distribution/registrytest"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"bad gateway", &distribution.Error{StatusCode: http.StatusBadGateway}, true},
+		{"too many requests", &distribution.Error{StatusCode: http.StatusTooManyRequests}, true},
+		{"wrapped unavailable", fmt.Errorf("copy failed: %w", &distribution.Error{StatusCode: http.StatusServiceUnavailable}), true},
+		{"not found", &distribution.Error{StatusCode: http.StatusNotFound}, false},
+		{"unauthorized", &distribution.Error{StatusCode: http.StatusUnauthorized}, false},
+		{"connection reset", &os.SyscallError{Syscall: "read", Err: syscall.ECONNRESET}, true},
+		{"timeout", os.ErrDeadlineExceeded, true},
+		{"cancelled", context.Canceled, false},
+		{"deadline", fmt.Errorf("batch: %w", context.DeadlineExceeded), false},
+		{"other", errors.New("bad reference"), false},
+		{"nil", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsRetryable(tt.err); got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestRetryPolicy_Delay(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 10, Backoff: time.Second, MaxBackoff: 10 * time.Second}
+
+	tests := []struct {
+		attempt int
+		err     error
+		want    time.Duration
+	}{
+		{1, errors.New("x"), time.Second},
+		{2, errors.New("x"), 2 * time.Second},
+		{4, errors.New("x"), 8 * time.Second},
+		{5, errors.New("x"), 10 * time.Second},
+		{1, &distribution.Error{StatusCode: 429, RetryAfter: 3 * time.Second}, 3 * time.Second},
+		{1, &distribution.Error{StatusCode: 503, RetryAfter: time.Hour}, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := p.delay(tt.attempt, tt.err); got != tt.want {
+			t.Errorf("attempt %d, %v: expected %s, got %s", tt.attempt, tt.err, tt.want, got)
+		}
+	}
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if got := p.delay(2, errors.New("x")); got < time.Second || got > 2*time.Second {
+			t.Fatalf("expected jittered delay within [1s, 2s], got %s", got)
+		}
+	}
+}
+
+func TestRetryPolicy_DelayCeiling(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 100, Backoff: time.Second}
+
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{6, 32 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := p.delay(tt.attempt, errors.New("x")); got != tt.want {
+			t.Errorf("attempt %d: expected %s, got %s", tt.attempt, tt.want, got)
+		}
+	}
+	if got := p.delay(100, errors.New("x")); got != RetryCeiling {
+		t.Errorf("expected the delay capped at %s, got %s", RetryCeiling, got)
+	}
+	if got := p.delay(1, &distribution.Error{StatusCode: 429, RetryAfter: time.Hour}); got != time.Hour {
+		t.Errorf("expected Retry-After below the ceiling, got %s", got)
+	}
+}
+
+// fastRetry retries quickly enough for tests
+func fastRetry(attempts int) OperationOption {
+	return WithOperationRetry(RetryPolicy{MaxAttempts: attempts, Backoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond})
+}
+
+func TestBatchOperator_Retry(t *testing.T) {
+	tests := []struct {
+		name         string
+		failures     int
+		status       int
+		attempts     int
+		wantAttempts int
+		wantSuccess  bool
+	}{
+		{"transient failures", 2, http.StatusBadGateway, 3, 3, true},
+		{"attempts exhausted", 5, http.StatusServiceUnavailable, 2, 2, false},
+		{"not retryable", 1, http.StatusForbidden, 3, 1, false},
+		{"retries disabled", 1, http.StatusBadGateway, 1, 1, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := registrytest.New()
+			defer reg.Close()
+			reg.PushImage("library/app", "old", nil, []byte("app"))
+			reg.FailRequests(tt.failures, tt.status, nil)
+
+			bo := newTestBatchOperator(t, 1, reg)
+			op, err := bo.DeleteTags(context.Background(), []string{"library/app:old"}, fastRetry(tt.attempts))
+			if err != nil {
+				t.Fatalf("DeleteTags failed: %v", err)
+			}
+			op = waitOperation(t, bo, op.ID)
+
+			result := op.Results[0]
+			if result.Success != tt.wantSuccess || result.Attempts != tt.wantAttempts {
+				t.Errorf("expected success=%v after %d attempts, got %+v", tt.wantSuccess, tt.wantAttempts, result)
+			}
+			wantStatus := BatchOpCompleted
+			if !tt.wantSuccess {
+				wantStatus = BatchOpFailed
+			}
+			if op.Status != wantStatus {
+				t.Errorf("expected status %s, got %s", wantStatus, op.Status)
+			}
+		})
+	}
+}
+
+func TestBatchOperator_RetryPolicyDefault(t *testing.T) {
+	reg := registrytest.New()
+	defer reg.Close()
+	reg.PushImage("library/app", "old", nil, []byte("app"))
+	reg.FailRequests(1, http.StatusBadGateway, nil)
+
+	client, err := distribution.NewClient(reg.URL())
+	if err != nil {
+		t.Fatalf("failed to create registry client: %v", err)
+	}
+	bo := NewBatchOperator(1, WithRegistryClient(client), WithRetryPolicy(NoRetry()))
+
+	op, _ := bo.DeleteTags(context.Background(), []string{"library/app:old"})
+	if op.Retry.MaxAttempts != 1 {
+		t.Errorf("expected the operator policy, got %+v", op.Retry)
+	}
+	op = waitOperation(t, bo, op.ID)
+	if op.Status != BatchOpFailed || op.Results[0].Attempts != 1 {
+		t.Errorf("expected a single failed attempt, got %s %+v", op.Status, op.Results[0])
+	}
+}
+
+func TestBatchOperator_CancelDuringBackoff(t *testing.T) {
+	reg := registrytest.New()
+	defer reg.Close()
+	reg.PushImage("library/app", "old", nil, []byte("app"))
+	reg.FailRequests(1, http.StatusServiceUnavailable, http.Header{"Retry-After": {"3600"}})
+
+	bo := newTestBatchOperator(t, 1, reg)
+	op, _ := bo.DeleteTags(context.Background(), []string{"library/app:old"},
+		WithOperationRetry(RetryPolicy{MaxAttempts: 3, Backoff: time.Hour, MaxBackoff: time.Hour}))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(reg.Requests()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, err := bo.Cancel(op.ID); err != nil {
+		t.Fatalf("Cancel failed: %v", err)
+	}
+
+	op = waitOperation(t, bo, op.ID)
+	if op.Status != BatchOpCancelled || op.Results[0].Attempts != 1 {
+		t.Errorf("expected cancellation after one attempt, got %s %+v", op.Status, op.Results[0])
+	}
+}
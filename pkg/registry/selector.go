@@ -0,0 +1,366 @@
+// Copyright 2021 vjranagit
+//
+// Tag selectors resolving batch targets from the registry
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/vjranagit/harbor/pkg/distribution"
+)
+
+// Selector chooses batch targets from the registry instead of an
+// explicit list. Every clause that is set must match
+type Selector struct {
+	// Repositories is a path.Match pattern over the catalog, e.g.
+	// "library/*"; * does not cross a /
+	Repositories string
+	// Tags matches tag names
+	Tags *regexp.Regexp
+	// Versions matches tags that are semantic versions
+	Versions *VersionRange
+	// OlderThan matches images whose config was created longer ago
+	OlderThan time.Duration
+	// KeepLast spares the most recently created images of each
+	// repository among those the other clauses match
+	KeepLast int
+	// Untagged selects manifests no tag points at instead of tags
+	Untagged bool
+	// Labels must all be set on the image config; an empty value only
+	// requires the label to exist
+	Labels map[string]string
+}
+
+// Selected is a target resolved by a Selector
+type Selected struct {
+	// Target is repo:tag, or repo@digest for untagged manifests
+	Target string
+	Digest digest.Digest
+	// Created is the image config creation date, zero when unknown
+	Created time.Time
+}
+
+// ParseSelector parses clauses separated by semicolons:
+//
+//	repo=library/*; tag=^v; semver=>=1.2 <2; older-than=30d; keep-last=5; label=team=web
+//
+// "untagged" selects manifests without tags and cannot be combined with
+// tag or semver
+func ParseSelector(s string) (Selector, error) {
+	var sel Selector
+	seen := make(map[string]bool)
+
+	for _, clause := range strings.Split(s, ";") {
+		clause = strings.TrimSpace(clause)
+		if clause == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(clause, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if seen[key] && key != "label" {
+			return Selector{}, fmt.Errorf("duplicate selector clause %q", key)
+		}
+		seen[key] = true
+
+		var err error
+		switch key {
+		case "repo":
+			if _, err = path.Match(value, ""); err == nil {
+				sel.Repositories = value
+			}
+		case "tag":
+			sel.Tags, err = regexp.Compile(value)
+		case "semver":
+			sel.Versions, err = ParseVersionRange(value)
+		case "older-than":
+			sel.OlderThan, err = ParseAge(value)
+		case "keep-last":
+			sel.KeepLast, err = strconv.Atoi(value)
+			if err == nil && sel.KeepLast < 0 {
+				err = fmt.Errorf("must not be negative")
+			}
+		case "untagged":
+			if value != "" {
+				err = fmt.Errorf("takes no value")
+			}
+			sel.Untagged = true
+		case "label":
+			name, want, _ := strings.Cut(value, "=")
+			if name == "" {
+				err = fmt.Errorf("label name required")
+				break
+			}
+			if sel.Labels == nil {
+				sel.Labels = make(map[string]string)
+			}
+			sel.Labels[name] = want
+		default:
+			return Selector{}, fmt.Errorf("unknown selector clause %q", key)
+		}
+		if err != nil {
+			return Selector{}, fmt.Errorf("invalid selector clause %q: %w", clause, err)
+		}
+	}
+
+	if err := sel.validate(); err != nil {
+		return Selector{}, err
+	}
+	return sel, nil
+}
+
+func (s Selector) validate() error {
+	if s.Repositories == "" {
+		return fmt.Errorf("selector needs a repo clause")
+	}
+	if s.Untagged && (s.Tags != nil || s.Versions != nil) {
+		return fmt.Errorf("untagged cannot be combined with tag or semver")
+	}
+	return nil
+}
+
+// needsConfig reports whether matching reads image configs
+func (s Selector) needsConfig() bool {
+	return s.OlderThan > 0 || s.KeepLast > 0 || len(s.Labels) > 0
+}
+
+// matchesTag applies the clauses that only look at the tag name
+func (s Selector) matchesTag(tag string) bool {
+	if s.Tags != nil && !s.Tags.MatchString(tag) {
+		return false
+	}
+	return s.Versions == nil || s.Versions.Match(tag)
+}
+
+// matchesLabels reports whether labels carries every selected label
+func (s Selector) matchesLabels(labels map[string]string) bool {
+	for name, want := range s.Labels {
+		got, ok := labels[name]
+		if !ok || (want != "" && got != want) {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseAge parses a duration that may also be given in days or weeks,
+// e.g. "30d", "2w" or "36h"
+func ParseAge(s string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if n, ok := strings.CutSuffix(s, suffix); ok {
+			days, err := strconv.ParseFloat(n, 64)
+			if err != nil || days < 0 {
+				return 0, fmt.Errorf("invalid duration %q", s)
+			}
+			return time.Duration(days * float64(unit)), nil
+		}
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
+
+// Select resolves sel against the registry catalog, tag lists and image
+// configs, returning targets sorted by repository and tag. KeepLast is
+// applied before OlderThan, so the newest images are kept however old
+// they are
+func (bo *BatchOperator) Select(ctx context.Context, sel Selector) ([]Selected, error) {
+	if bo.client == nil {
+		return nil, fmt.Errorf("no registry client configured")
+	}
+	if err := sel.validate(); err != nil {
+		return nil, err
+	}
+
+	repos, err := bo.client.Catalog(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list repositories: %w", err)
+	}
+
+	var selected []Selected
+	for _, repo := range repos {
+		if ok, _ := path.Match(sel.Repositories, repo); !ok {
+			continue
+		}
+		matches, err := bo.selectRepository(ctx, sel, repo)
+		if err != nil {
+			return nil, err
+		}
+		selected = append(selected, matches...)
+	}
+
+	bo.logger.DebugContext(ctx, "batch targets selected",
+		"repositories", sel.Repositories,
+		"count", len(selected),
+	)
+	return selected, nil
+}
+
+// selectRepository resolves sel within one repository
+func (bo *BatchOperator) selectRepository(ctx context.Context, sel Selector, repo string) ([]Selected, error) {
+	var refs []string
+	if sel.Untagged {
+		digests, err := bo.client.UntaggedManifests(ctx, repo)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list untagged manifests of %s: %w", repo, err)
+		}
+		for _, dgst := range digests {
+			refs = append(refs, dgst.String())
+		}
+	} else {
+		tags, err := bo.client.ListTags(ctx, repo)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list tags of %s: %w", repo, err)
+		}
+		for _, tag := range tags {
+			if sel.matchesTag(tag) {
+				refs = append(refs, tag)
+			}
+		}
+	}
+
+	candidates, err := bo.describe(ctx, repo, refs, sel.needsConfig())
+	if err != nil {
+		return nil, err
+	}
+
+	matched := candidates[:0]
+	for _, c := range candidates {
+		if sel.matchesLabels(c.labels) {
+			matched = append(matched, c)
+		}
+	}
+
+	if sel.KeepLast > 0 {
+		// Newest first; images without a creation date count as oldest
+		sort.SliceStable(matched, func(i, j int) bool {
+			return matched[i].Created.After(matched[j].Created)
+		})
+		matched = matched[min(sel.KeepLast, len(matched)):]
+	}
+
+	var selected []Selected
+	now := time.Now()
+	for _, c := range matched {
+		if sel.OlderThan > 0 && (c.Created.IsZero() || now.Sub(c.Created) < sel.OlderThan) {
+			continue
+		}
+		selected = append(selected, c.Selected)
+	}
+	sort.Slice(selected, func(i, j int) bool {
+		return selected[i].Target < selected[j].Target
+	})
+	return selected, nil
+}
+
+// candidate is a selector match before the config based clauses
+type candidate struct {
+	Selected
+	labels map[string]string
+}
+
+// describe resolves refs in repo to digests and, with withConfig, their
+// creation dates and labels, using the operator's workers
+func (bo *BatchOperator) describe(ctx context.Context, repo string, refs []string, withConfig bool) ([]candidate, error) {
+	candidates := make([]candidate, len(refs))
+	errs := make([]error, len(refs))
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, bo.workers)
+
+	for i, ref := range refs {
+		wg.Add(1)
+		go func(idx int, ref string) {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			target := repo + ":" + ref
+			if strings.Contains(ref, ":") {
+				target = repo + "@" + ref
+			}
+
+			m, err := bo.client.GetManifest(ctx, repo, ref)
+			if err != nil {
+				errs[idx] = fmt.Errorf("failed to resolve %s: %w", target, err)
+				return
+			}
+			candidates[idx].Selected = Selected{Target: target, Digest: m.Descriptor.Digest}
+			if !withConfig {
+				return
+			}
+
+			config, err := bo.imageConfig(ctx, repo, m)
+			if err != nil {
+				errs[idx] = fmt.Errorf("failed to read config of %s: %w", target, err)
+				return
+			}
+			if config.Created != nil {
+				candidates[idx].Created = *config.Created
+			}
+			candidates[idx].labels = config.Config.Labels
+		}(i, ref)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return candidates, nil
+}
+
+// imageConfig reads the config of an image manifest, or of the first
+// platform manifest of an index
+func (bo *BatchOperator) imageConfig(ctx context.Context, repo string, m *distribution.Manifest) (ocispec.Image, error) {
+	if m.IsIndex() {
+		children, err := m.References()
+		if err != nil {
+			return ocispec.Image{}, err
+		}
+		for _, child := range children {
+			// Skip attestation manifests, which have no platform
+			if child.Platform != nil && child.Platform.OS == "unknown" {
+				continue
+			}
+			cm, err := bo.client.GetManifest(ctx, repo, child.Digest.String())
+			if err != nil {
+				return ocispec.Image{}, err
+			}
+			return bo.imageConfig(ctx, repo, cm)
+		}
+		return ocispec.Image{}, fmt.Errorf("index has no platform manifests")
+	}
+
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(m.Payload, &manifest); err != nil {
+		return ocispec.Image{}, fmt.Errorf("failed to decode manifest: %w", err)
+	}
+
+	rc, err := bo.client.GetBlob(ctx, repo, manifest.Config.Digest)
+	if err != nil {
+		return ocispec.Image{}, err
+	}
+	defer rc.Close()
+
+	var config ocispec.Image
+	if err := json.NewDecoder(io.LimitReader(rc, 4<<20)).Decode(&config); err != nil {
+		return ocispec.Image{}, fmt.Errorf("failed to decode image config: %w", err)
+	}
+	return config, nil
+}
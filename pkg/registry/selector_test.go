@@ -0,0 +1,218 @@
+// Copyright 2021 vjranagit
+//
+// Tag selector tests
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/vjranagit/harbor/pkg/distribution/registrytest"
+)
+
+// pushAged pushes repo:tag with a config created age ago and labels
+func pushAged(t *testing.T, reg *registrytest.Registry, repo, tag string, age time.Duration, labels map[string]string) ocispec.Descriptor {
+	t.Helper()
+
+	created := time.Now().Add(-age)
+	config, err := json.Marshal(ocispec.Image{
+		Created:  &created,
+		Platform: ocispec.Platform{Architecture: "amd64", OS: "linux"},
+		Config:   ocispec.ImageConfig{Labels: labels},
+		RootFS:   ocispec.RootFS{Type: "layers"},
+	})
+	if err != nil {
+		t.Fatalf("failed to encode config: %v", err)
+	}
+	return reg.PushImage(repo, tag, config, []byte(repo+":"+tag))
+}
+
+func TestParseSelector(t *testing.T) {
+	sel, err := ParseSelector("repo=library/*; tag=^v; semver=>=1.2 <2; older-than=30d; keep-last=5; label=team=web; label=tier")
+	if err != nil {
+		t.Fatalf("ParseSelector failed: %v", err)
+	}
+	if sel.Repositories != "library/*" || sel.Tags.String() != "^v" || sel.Versions.String() != ">=1.2 <2" {
+		t.Errorf("unexpected patterns: %+v", sel)
+	}
+	if sel.OlderThan != 30*24*time.Hour || sel.KeepLast != 5 {
+		t.Errorf("expected 720h and keep 5, got %s and %d", sel.OlderThan, sel.KeepLast)
+	}
+	if fmt.Sprint(sel.Labels) != "map[team:web tier:]" {
+		t.Errorf("unexpected labels: %v", sel.Labels)
+	}
+
+	for _, s := range []string{
+		"",
+		"tag=^v",
+		"repo=library/[",
+		"repo=a/*; tag=(",
+		"repo=a/*; semver=>=x",
+		"repo=a/*; older-than=soon",
+		"repo=a/*; keep-last=-1",
+		"repo=a/*; untagged=yes",
+		"repo=a/*; untagged; tag=^v",
+		"repo=a/*; label==web",
+		"repo=a/*; repo=b/*",
+		"repo=a/*; newest=3",
+	} {
+		if _, err := ParseSelector(s); err == nil {
+			t.Errorf("expected error for %q", s)
+		}
+	}
+}
+
+func TestParseAge(t *testing.T) {
+	tests := map[string]time.Duration{
+		"30d":  30 * 24 * time.Hour,
+		"2w":   14 * 24 * time.Hour,
+		"36h":  36 * time.Hour,
+		"1.5d": 36 * time.Hour,
+	}
+	for s, want := range tests {
+		got, err := ParseAge(s)
+		if err != nil || got != want {
+			t.Errorf("%s: expected %s, got %s (%v)", s, want, got, err)
+		}
+	}
+	for _, s := range []string{"", "d", "-1d", "-5m", "week"} {
+		if _, err := ParseAge(s); err == nil {
+			t.Errorf("expected error for %q", s)
+		}
+	}
+}
+
+func TestBatchOperator_Select(t *testing.T) {
+	reg := registrytest.New(registrytest.WithPageSize(2))
+	defer reg.Close()
+
+	day := 24 * time.Hour
+	pushAged(t, reg, "library/app", "v1.0.0", 90*day, map[string]string{"team": "web"})
+	pushAged(t, reg, "library/app", "v1.1.0", 60*day, map[string]string{"team": "web"})
+	pushAged(t, reg, "library/app", "v1.2.0", 40*day, map[string]string{"team": "api"})
+	pushAged(t, reg, "library/app", "v2.0.0", 10*day, map[string]string{"team": "web"})
+	pushAged(t, reg, "library/app", "nightly-1", 45*day, nil)
+	pushAged(t, reg, "library/app", "nightly-2", day, nil)
+	pushAged(t, reg, "library/web", "v1.0.0", 100*day, nil)
+	pushAged(t, reg, "team/api", "v1.0.0", 100*day, nil)
+
+	bo := newTestBatchOperator(t, 3, reg)
+	tests := []struct {
+		selector string
+		want     []string
+	}{
+		{"repo=library/*; tag=^v1", []string{"library/app:v1.0.0", "library/app:v1.1.0", "library/app:v1.2.0", "library/web:v1.0.0"}},
+		{"repo=library/app; semver=^1.1", []string{"library/app:v1.1.0", "library/app:v1.2.0"}},
+		{"repo=library/app; tag=^nightly-; older-than=30d", []string{"library/app:nightly-1"}},
+		{"repo=library/app; semver=*; keep-last=2", []string{"library/app:v1.0.0", "library/app:v1.1.0"}},
+		{"repo=*/*; older-than=50d; keep-last=1", []string{"library/app:v1.0.0", "library/app:v1.1.0"}},
+		{"repo=library/app; label=team=web", []string{"library/app:v1.0.0", "library/app:v1.1.0", "library/app:v2.0.0"}},
+		{"repo=library/app; label=team", []string{"library/app:v1.0.0", "library/app:v1.1.0", "library/app:v1.2.0", "library/app:v2.0.0"}},
+		{"repo=library/app; keep-last=10", nil},
+		{"repo=other/*", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.selector, func(t *testing.T) {
+			sel, err := ParseSelector(tt.selector)
+			if err != nil {
+				t.Fatalf("ParseSelector failed: %v", err)
+			}
+			selected, err := bo.Select(context.Background(), sel)
+			if err != nil {
+				t.Fatalf("Select failed: %v", err)
+			}
+
+			var targets []string
+			for _, s := range selected {
+				targets = append(targets, s.Target)
+				if s.Digest == "" {
+					t.Errorf("%s: missing digest", s.Target)
+				}
+				if sel.needsConfig() && s.Created.IsZero() {
+					t.Errorf("%s: missing creation date", s.Target)
+				}
+			}
+			if fmt.Sprint(targets) != fmt.Sprint(tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, targets)
+			}
+		})
+	}
+}
+
+func TestBatchOperator_SelectNoWorkers(t *testing.T) {
+	reg := registrytest.New()
+	defer reg.Close()
+	pushAged(t, reg, "library/app", "v1.0.0", time.Hour, nil)
+
+	// Zero workers are raised to one rather than blocking forever
+	bo := newTestBatchOperator(t, 0, reg)
+	sel, err := ParseSelector("repo=library/app; older-than=1m")
+	if err != nil {
+		t.Fatalf("ParseSelector failed: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	selected, err := bo.Select(ctx, sel)
+	if err != nil || len(selected) != 1 {
+		t.Errorf("expected one selected image, got %v (%v)", selected, err)
+	}
+}
+
+func TestBatchOperator_SelectUntagged(t *testing.T) {
+	reg := registrytest.New()
+	defer reg.Close()
+
+	old := pushAged(t, reg, "library/app", "latest", 40*24*time.Hour, nil)
+	pushAged(t, reg, "library/app", "latest", time.Hour, nil)
+
+	bo := newTestBatchOperator(t, 2, reg)
+	sel, _ := ParseSelector("repo=library/app; untagged; older-than=7d")
+	selected, err := bo.Select(context.Background(), sel)
+	if err != nil {
+		t.Fatalf("Select failed: %v", err)
+	}
+	want := "library/app@" + old.Digest.String()
+	if len(selected) != 1 || selected[0].Target != want {
+		t.Fatalf("expected %s, got %+v", want, selected)
+	}
+
+	// The selected targets feed straight into a batch delete
+	op, _ := bo.DeleteTags(context.Background(), []string{selected[0].Target})
+	if op = waitOperation(t, bo, op.ID); op.Status != BatchOpCompleted {
+		t.Errorf("expected completed, got %s: %+v", op.Status, op.Results)
+	}
+	if _, _, ok := reg.Manifest("library/app", old.Digest.String()); ok {
+		t.Error("expected untagged manifest to be deleted")
+	}
+}
+
+func TestBatchOperator_SelectIndex(t *testing.T) {
+	reg := registrytest.New()
+	defer reg.Close()
+
+	child := pushAged(t, reg, "library/app", "", 20*24*time.Hour, map[string]string{"team": "web"})
+	child.Platform = &ocispec.Platform{Architecture: "amd64", OS: "linux"}
+	index, _ := json.Marshal(ocispec.Index{
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{child},
+	})
+	reg.PutManifest("library/app", "v1", ocispec.MediaTypeImageIndex, index)
+
+	bo := newTestBatchOperator(t, 2, reg)
+	sel, _ := ParseSelector("repo=library/app; older-than=7d; label=team=web")
+	selected, err := bo.Select(context.Background(), sel)
+	if err != nil {
+		t.Fatalf("Select failed: %v", err)
+	}
+	if len(selected) != 1 || selected[0].Target != "library/app:v1" {
+		t.Errorf("expected the index to match through its platform manifest, got %+v", selected)
+	}
+}
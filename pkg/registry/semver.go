@@ -0,0 +1,299 @@
+// Copyright 2021 vjranagit
+//
+// Semantic version ranges for tag selectors
+
+package registry
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// version is a parsed semantic version; tags such as "v1.2" or "1.25"
+// are accepted with the missing parts set to zero
+type version struct {
+	major, minor, patch int
+	prerelease          []string
+}
+
+// parseVersion parses a tag as a semantic version, ignoring a leading v
+// and any build metadata
+func parseVersion(s string) (version, bool) {
+	s = strings.TrimPrefix(s, "v")
+	s, _, _ = strings.Cut(s, "+")
+
+	var v version
+	core, pre, hasPre := strings.Cut(s, "-")
+	if hasPre {
+		if pre == "" {
+			return version{}, false
+		}
+		v.prerelease = strings.Split(pre, ".")
+	}
+
+	parts := strings.Split(core, ".")
+	if len(parts) > 3 {
+		return version{}, false
+	}
+	nums := []*int{&v.major, &v.minor, &v.patch}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 || part[0] == '+' {
+			return version{}, false
+		}
+		*nums[i] = n
+	}
+	return v, true
+}
+
+// compare orders versions by semver precedence
+func (v version) compare(o version) int {
+	for _, d := range []int{v.major - o.major, v.minor - o.minor, v.patch - o.patch} {
+		if d != 0 {
+			return sign(d)
+		}
+	}
+
+	// A release ranks above its prereleases
+	switch {
+	case len(v.prerelease) == 0 && len(o.prerelease) == 0:
+		return 0
+	case len(v.prerelease) == 0:
+		return 1
+	case len(o.prerelease) == 0:
+		return -1
+	}
+
+	for i := 0; i < len(v.prerelease) && i < len(o.prerelease); i++ {
+		if c := comparePrerelease(v.prerelease[i], o.prerelease[i]); c != 0 {
+			return c
+		}
+	}
+	return sign(len(v.prerelease) - len(o.prerelease))
+}
+
+// comparePrerelease orders identifiers: numeric ones numerically and
+// below alphanumeric ones, which compare lexically
+func comparePrerelease(a, b string) int {
+	an, aErr := strconv.Atoi(a)
+	bn, bErr := strconv.Atoi(b)
+	switch {
+	case aErr == nil && bErr == nil:
+		return sign(an - bn)
+	case aErr == nil:
+		return -1
+	case bErr == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
+
+// comparator is a single constraint such as ">=1.2.0"
+type comparator struct {
+	op string
+	v  version
+}
+
+func (c comparator) matches(v version) bool {
+	cmp := v.compare(c.v)
+	switch c.op {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	}
+	return false
+}
+
+// VersionRange matches tags that are semantic versions, e.g.
+// ">=1.2.0 <2.0.0", "^1.4", "~2.1.3", "1.x" or "<1.0 || >=3.0"
+type VersionRange struct {
+	raw string
+	// sets are alternatives; every comparator of a set must match
+	sets [][]comparator
+}
+
+// ParseVersionRange parses a range of space separated comparators (=, !=,
+// >, >=, <, <=), caret and tilde ranges and x-ranges, with || between
+// alternatives
+func ParseVersionRange(s string) (*VersionRange, error) {
+	r := &VersionRange{raw: s}
+	for _, alt := range strings.Split(s, "||") {
+		fields := strings.Fields(alt)
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("invalid version range %q: empty alternative", s)
+		}
+
+		var set []comparator
+		for _, field := range fields {
+			cs, err := parseComparator(field)
+			if err != nil {
+				return nil, fmt.Errorf("invalid version range %q: %w", s, err)
+			}
+			set = append(set, cs...)
+		}
+		r.sets = append(r.sets, set)
+	}
+	return r, nil
+}
+
+// parseComparator expands one range term into plain comparators
+func parseComparator(term string) ([]comparator, error) {
+	op := ""
+	for _, prefix := range []string{">=", "<=", "!=", ">", "<", "=", "^", "~"} {
+		if rest, ok := strings.CutPrefix(term, prefix); ok {
+			op, term = prefix, rest
+			break
+		}
+	}
+
+	v, parts, err := parsePartial(term)
+	if err != nil {
+		return nil, err
+	}
+
+	// Upper bound of a partial version, e.g. 1.2 -> <1.3.0-0
+	next := func(level int) comparator {
+		u := version{major: v.major, minor: v.minor, prerelease: []string{"0"}}
+		switch level {
+		case 1:
+			u = version{major: v.major + 1, prerelease: []string{"0"}}
+		case 2:
+			u.minor++
+		case 3:
+			u.patch = v.patch + 1
+		}
+		return comparator{"<", u}
+	}
+	lower := comparator{">=", v}
+
+	switch op {
+	case "^":
+		// Changes that do not modify the left-most non-zero part
+		switch {
+		case v.major > 0 || parts == 1:
+			return []comparator{lower, next(1)}, nil
+		case v.minor > 0 || parts == 2:
+			return []comparator{lower, next(2)}, nil
+		default:
+			return []comparator{lower, next(3)}, nil
+		}
+	case "~":
+		if parts == 1 {
+			return []comparator{lower, next(1)}, nil
+		}
+		return []comparator{lower, next(2)}, nil
+	case "", "=":
+		if parts == 0 {
+			return []comparator{{">=", version{}}}, nil
+		}
+		if parts < 3 {
+			return []comparator{lower, next(parts)}, nil
+		}
+		return []comparator{{"=", v}}, nil
+	}
+
+	if parts == 0 {
+		return nil, fmt.Errorf("%q needs a version", op)
+	}
+	if parts < 3 {
+		switch op {
+		case ">":
+			return []comparator{{">=", next(parts).v}}, nil
+		case "<=":
+			return []comparator{next(parts)}, nil
+		case "!=":
+			return nil, fmt.Errorf("%q needs a full version", op)
+		}
+	}
+	return []comparator{{op, v}}, nil
+}
+
+// parsePartial parses a version that may stop early or end in x or *,
+// returning how many parts were given
+func parsePartial(s string) (version, int, error) {
+	if s == "" || s == "*" || s == "x" || s == "X" {
+		return version{}, 0, nil
+	}
+
+	trimmed := strings.TrimPrefix(s, "v")
+	core, pre, hasPre := strings.Cut(trimmed, "-")
+	fields := strings.Split(core, ".")
+	parts := 0
+	for _, field := range fields {
+		if field == "x" || field == "X" || field == "*" {
+			break
+		}
+		parts++
+	}
+	if parts > 3 || (hasPre && parts < 3) {
+		return version{}, 0, fmt.Errorf("bad version %q", s)
+	}
+
+	v, ok := parseVersion(strings.Join(fields[:parts], "."))
+	if !ok {
+		return version{}, 0, fmt.Errorf("bad version %q", s)
+	}
+	if hasPre {
+		v.prerelease = strings.Split(pre, ".")
+	}
+	return v, parts, nil
+}
+
+// Match reports whether tag is a version within the range. Prereleases
+// only match a set that names a prerelease of the same major.minor.patch
+func (r *VersionRange) Match(tag string) bool {
+	v, ok := parseVersion(tag)
+	if !ok {
+		return false
+	}
+
+	for _, set := range r.sets {
+		if matchesSet(set, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesSet(set []comparator, v version) bool {
+	for _, c := range set {
+		if !c.matches(v) {
+			return false
+		}
+	}
+	if len(v.prerelease) == 0 {
+		return true
+	}
+	for _, c := range set {
+		if len(c.v.prerelease) > 0 && c.v.prerelease[0] != "0" &&
+			c.v.major == v.major && c.v.minor == v.minor && c.v.patch == v.patch {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the range as written
+func (r *VersionRange) String() string {
+	return r.raw
+}
@@ -0,0 +1,78 @@
+// Copyright 2021 vjranagit
+//
+// Version range tests
+
+package registry
+
+import "testing"
+
+func TestVersionRange_Match(t *testing.T) {
+	tests := []struct {
+		rng  string
+		tag  string
+		want bool
+	}{
+		{">=1.2.0 <2.0.0", "1.2.0", true},
+		{">=1.2.0 <2.0.0", "v1.9.3", true},
+		{">=1.2.0 <2.0.0", "2.0.0", false},
+		{">=1.2.0 <2.0.0", "1.1.9", false},
+		{">=1.2", "1.25", true},
+		{"^1.4", "1.9.0", true},
+		{"^1.4", "2.0.0", false},
+		{"^0.3.1", "0.3.9", true},
+		{"^0.3.1", "0.4.0", false},
+		{"~2.1.3", "2.1.9", true},
+		{"~2.1.3", "2.2.0", false},
+		{"1.x", "1.7.2", true},
+		{"1.x", "2.0.0", false},
+		{"1.2", "1.2.7", true},
+		{"*", "0.0.1", true},
+		{">1.2", "1.2.9", false},
+		{">1.2", "1.3.0", true},
+		{"<=1.2", "1.2.9", true},
+		{"!=1.2.3", "1.2.3", false},
+		{"<1.0 || >=3.0", "0.9.0", true},
+		{"<1.0 || >=3.0", "2.0.0", false},
+		{"<1.0 || >=3.0", "3.1.0", true},
+		{">=1.0.0", "1.1.0-rc.1", false},
+		{"<2.0.0", "2.0.0-rc.1", false},
+		{">=1.1.0-rc.1", "1.1.0-rc.2", true},
+		{">=1.1.0-rc.1", "1.2.0-rc.1", false},
+		{">=1.0.0", "1.0.0+build.5", true},
+		{">=1.0.0", "latest", false},
+		{">=1.0.0", "1.2.3.4", false},
+	}
+
+	for _, tt := range tests {
+		r, err := ParseVersionRange(tt.rng)
+		if err != nil {
+			t.Fatalf("ParseVersionRange(%q) failed: %v", tt.rng, err)
+		}
+		if got := r.Match(tt.tag); got != tt.want {
+			t.Errorf("%q matching %q: expected %v, got %v", tt.rng, tt.tag, tt.want, got)
+		}
+	}
+}
+
+func TestVersion_Compare(t *testing.T) {
+	// Ascending per the semver precedence example
+	ordered := []string{
+		"1.0.0-alpha", "1.0.0-alpha.1", "1.0.0-alpha.beta", "1.0.0-beta",
+		"1.0.0-beta.2", "1.0.0-beta.11", "1.0.0-rc.1", "1.0.0", "1.0.1", "1.1.0", "2.0.0",
+	}
+	for i := 1; i < len(ordered); i++ {
+		a, _ := parseVersion(ordered[i-1])
+		b, _ := parseVersion(ordered[i])
+		if a.compare(b) != -1 || b.compare(a) != 1 {
+			t.Errorf("expected %s < %s", ordered[i-1], ordered[i])
+		}
+	}
+}
+
+func TestParseVersionRange_Invalid(t *testing.T) {
+	for _, rng := range []string{"", ">=1.0 ||", ">=a.b", ">=", "!=1.2", "1.2-rc.1", "1.2.3.4"} {
+		if _, err := ParseVersionRange(rng); err == nil {
+			t.Errorf("expected error for %q", rng)
+		}
+	}
+}
@@ -6,13 +6,26 @@ package registry
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"regexp"
 	"sync"
 	"time"
+
+	"github.com/vjranagit/harbor/pkg/events"
 )
 
+// ErrPolicyNotFound is returned when a named policy does not exist
+var ErrPolicyNotFound = errors.New("policy not found")
+
+// ErrPolicyExists is returned when adding a policy whose name is taken
+var ErrPolicyExists = errors.New("policy already exists")
+
+// ErrPolicyReadOnly is returned when changing a policy the store does not own
+var ErrPolicyReadOnly = errors.New("policy is read-only")
+
 // ProtectionPolicy defines tag protection rules
 type ProtectionPolicy struct {
 	Name        string
@@ -23,29 +36,150 @@ type ProtectionPolicy struct {
 	Priority    int
 }
 
+// policyJSON is the serialized form of a ProtectionPolicy
+type policyJSON struct {
+	Name        string `json:"name"`
+	Pattern     string `json:"pattern"`
+	Immutable   bool   `json:"immutable,omitempty"`
+	MaxAge      string `json:"max_age,omitempty"`
+	AllowDelete bool   `json:"allow_delete,omitempty"`
+	Priority    int    `json:"priority"`
+}
+
+// MarshalJSON encodes the policy with its pattern and max age as strings
+func (p *ProtectionPolicy) MarshalJSON() ([]byte, error) {
+	out := policyJSON{
+		Name:        p.Name,
+		Immutable:   p.Immutable,
+		AllowDelete: p.AllowDelete,
+		Priority:    p.Priority,
+	}
+	if p.Pattern != nil {
+		out.Pattern = p.Pattern.String()
+	}
+	if p.MaxAge > 0 {
+		out.MaxAge = p.MaxAge.String()
+	}
+	return json.Marshal(out)
+}
+
+// UnmarshalJSON decodes a policy, compiling its pattern
+func (p *ProtectionPolicy) UnmarshalJSON(data []byte) error {
+	var in policyJSON
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+
+	policy, err := newPolicy(in)
+	if err != nil {
+		return err
+	}
+	*p = *policy
+	return nil
+}
+
+// newPolicy builds a policy from its serialized fields. An empty pattern
+// would match every tag, so it is rejected
+func newPolicy(in policyJSON) (*ProtectionPolicy, error) {
+	if in.Pattern == "" {
+		return nil, fmt.Errorf("policy %q: pattern is required", in.Name)
+	}
+	pattern, err := regexp.Compile(in.Pattern)
+	if err != nil {
+		return nil, fmt.Errorf("policy %q: invalid pattern: %w", in.Name, err)
+	}
+
+	var maxAge time.Duration
+	if in.MaxAge != "" {
+		if maxAge, err = time.ParseDuration(in.MaxAge); err != nil {
+			return nil, fmt.Errorf("policy %q: invalid max_age: %w", in.Name, err)
+		}
+	}
+
+	return &ProtectionPolicy{
+		Name:        in.Name,
+		Pattern:     pattern,
+		Immutable:   in.Immutable,
+		MaxAge:      maxAge,
+		AllowDelete: in.AllowDelete,
+		Priority:    in.Priority,
+	}, nil
+}
+
 // TagProtection manages tag protection policies
 type TagProtection struct {
 	policies []*ProtectionPolicy
+	store    PolicyStore
+	events   *events.Bus
 	mu       sync.RWMutex
 	logger   *slog.Logger
 }
 
+// ProtectionOption configures a TagProtection
+type ProtectionOption func(*TagProtection)
+
+// WithProtectionEvents publishes violations and policy changes on bus
+func WithProtectionEvents(bus *events.Bus) ProtectionOption {
+	return func(tp *TagProtection) {
+		tp.events = bus
+	}
+}
+
 // NewTagProtection creates a new tag protection manager
-func NewTagProtection() *TagProtection {
-	return &TagProtection{
+func NewTagProtection(opts ...ProtectionOption) *TagProtection {
+	tp := &TagProtection{
 		policies: make([]*ProtectionPolicy, 0),
 		logger:   slog.Default().With("component", "tag_protection"),
 	}
+	for _, opt := range opts {
+		opt(tp)
+	}
+	return tp
+}
+
+// LoadTagProtection creates a tag protection manager backed by store: the
+// stored policies are loaded and every change is written through
+func LoadTagProtection(store PolicyStore, opts ...ProtectionOption) (*TagProtection, error) {
+	policies, err := store.Load()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load policies: %w", err)
+	}
+
+	tp := NewTagProtection(opts...)
+	tp.store = store
+	tp.policies = append(tp.policies, policies...)
+	tp.logger.Info("policies loaded", "count", len(policies))
+	return tp, nil
 }
 
 // AddPolicy adds a new protection policy
 func (tp *TagProtection) AddPolicy(policy *ProtectionPolicy) error {
+	if err := tp.addPolicy(policy); err != nil {
+		return err
+	}
+	tp.events.Publish(context.Background(), events.PolicyChanged{Name: policy.Name})
+	return nil
+}
+
+func (tp *TagProtection) addPolicy(policy *ProtectionPolicy) error {
 	tp.mu.Lock()
 	defer tp.mu.Unlock()
 
 	// Validate pattern
-	if policy.Pattern == nil {
-		return fmt.Errorf("policy pattern cannot be nil")
+	if policy.Pattern == nil || policy.Pattern.String() == "" {
+		return fmt.Errorf("policy pattern cannot be empty")
+	}
+
+	for _, existing := range tp.policies {
+		if existing.Name == policy.Name {
+			return fmt.Errorf("%w: %s", ErrPolicyExists, policy.Name)
+		}
+	}
+
+	if tp.store != nil {
+		if err := tp.store.Put(policy); err != nil {
+			return fmt.Errorf("failed to persist policy: %w", err)
+		}
 	}
 
 	tp.policies = append(tp.policies, policy)
@@ -53,23 +187,48 @@ func (tp *TagProtection) AddPolicy(policy *ProtectionPolicy) error {
 	return nil
 }
 
-// CanModify checks if a tag can be modified based on policies
-func (tp *TagProtection) CanModify(ctx context.Context, repository, tag string, age time.Duration) (bool, string) {
-	tp.mu.RLock()
-	defer tp.mu.RUnlock()
+// PutPolicy adds a policy or replaces the one with the same name in a
+// single step, so checks never see the name without a policy
+func (tp *TagProtection) PutPolicy(policy *ProtectionPolicy) error {
+	if err := tp.putPolicy(policy); err != nil {
+		return err
+	}
+	tp.events.Publish(context.Background(), events.PolicyChanged{Name: policy.Name})
+	return nil
+}
 
-	tagRef := fmt.Sprintf("%s:%s", repository, tag)
+func (tp *TagProtection) putPolicy(policy *ProtectionPolicy) error {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
 
-	// Find matching policies (highest priority first)
-	var matchedPolicy *ProtectionPolicy
-	for _, policy := range tp.policies {
-		if policy.Pattern.MatchString(tagRef) {
-			if matchedPolicy == nil || policy.Priority > matchedPolicy.Priority {
-				matchedPolicy = policy
-			}
+	if policy.Pattern == nil || policy.Pattern.String() == "" {
+		return fmt.Errorf("policy pattern cannot be empty")
+	}
+
+	if tp.store != nil {
+		if err := tp.store.Put(policy); err != nil {
+			return fmt.Errorf("failed to persist policy: %w", err)
+		}
+	}
+
+	for i, existing := range tp.policies {
+		if existing.Name == policy.Name {
+			tp.policies[i] = policy
+			tp.logger.Info("policy replaced", "name", policy.Name, "pattern", policy.Pattern.String())
+			return nil
 		}
 	}
+	tp.policies = append(tp.policies, policy)
+	tp.logger.Info("policy added", "name", policy.Name, "pattern", policy.Pattern.String())
+	return nil
+}
 
+// CanModify checks if a tag can be modified based on policies
+func (tp *TagProtection) CanModify(ctx context.Context, repository, tag string, age time.Duration) (bool, string) {
+	tagRef := fmt.Sprintf("%s:%s", repository, tag)
+
+	// Find matching policies (highest priority first)
+	matchedPolicy := tp.matchPolicy(tagRef)
 	if matchedPolicy == nil {
 		return true, ""
 	}
@@ -80,7 +239,9 @@ func (tp *TagProtection) CanModify(ctx context.Context, repository, tag string,
 			"tag", tagRef,
 			"policy", matchedPolicy.Name,
 		)
-		return false, fmt.Sprintf("tag is immutable (policy: %s)", matchedPolicy.Name)
+		reason := fmt.Sprintf("tag is immutable (policy: %s)", matchedPolicy.Name)
+		tp.violation(ctx, repository, tag, "modify", matchedPolicy.Name, reason)
+		return false, reason
 	}
 
 	// Check age-based protection
@@ -91,7 +252,9 @@ func (tp *TagProtection) CanModify(ctx context.Context, repository, tag string,
 			"max_age", matchedPolicy.MaxAge,
 			"policy", matchedPolicy.Name,
 		)
-		return false, fmt.Sprintf("tag protected for %s (policy: %s)", matchedPolicy.MaxAge, matchedPolicy.Name)
+		reason := fmt.Sprintf("tag protected for %s (policy: %s)", matchedPolicy.MaxAge, matchedPolicy.Name)
+		tp.violation(ctx, repository, tag, "modify", matchedPolicy.Name, reason)
+		return false, reason
 	}
 
 	return true, ""
@@ -99,22 +262,60 @@ func (tp *TagProtection) CanModify(ctx context.Context, repository, tag string,
 
 // CanDelete checks if a tag can be deleted based on policies
 func (tp *TagProtection) CanDelete(ctx context.Context, repository, tag string) (bool, string) {
+	tagRef := fmt.Sprintf("%s:%s", repository, tag)
+
+	policy := tp.deleteBlocker(tagRef)
+	if policy == nil {
+		return true, ""
+	}
+
+	tp.logger.WarnContext(ctx, "tag deletion blocked",
+		"tag", tagRef,
+		"policy", policy.Name,
+	)
+	reason := fmt.Sprintf("tag deletion not allowed (policy: %s)", policy.Name)
+	tp.violation(ctx, repository, tag, "delete", policy.Name, reason)
+	return false, reason
+}
+
+// matchPolicy returns the highest priority policy matching tagRef
+func (tp *TagProtection) matchPolicy(tagRef string) *ProtectionPolicy {
 	tp.mu.RLock()
 	defer tp.mu.RUnlock()
 
-	tagRef := fmt.Sprintf("%s:%s", repository, tag)
+	var matchedPolicy *ProtectionPolicy
+	for _, policy := range tp.policies {
+		if policy.Pattern.MatchString(tagRef) {
+			if matchedPolicy == nil || policy.Priority > matchedPolicy.Priority {
+				matchedPolicy = policy
+			}
+		}
+	}
+	return matchedPolicy
+}
+
+// deleteBlocker returns the first matching policy that forbids deletion
+func (tp *TagProtection) deleteBlocker(tagRef string) *ProtectionPolicy {
+	tp.mu.RLock()
+	defer tp.mu.RUnlock()
 
 	for _, policy := range tp.policies {
 		if policy.Pattern.MatchString(tagRef) && !policy.AllowDelete {
-			tp.logger.WarnContext(ctx, "tag deletion blocked",
-				"tag", tagRef,
-				"policy", policy.Name,
-			)
-			return false, fmt.Sprintf("tag deletion not allowed (policy: %s)", policy.Name)
+			return policy
 		}
 	}
+	return nil
+}
 
-	return true, ""
+// violation publishes a blocked change
+func (tp *TagProtection) violation(ctx context.Context, repository, tag, action, policy, reason string) {
+	tp.events.Publish(ctx, events.ProtectionViolation{
+		Repository: repository,
+		Tag:        tag,
+		Action:     action,
+		Policy:     policy,
+		Reason:     reason,
+	})
 }
 
 // ListPolicies returns all configured policies
@@ -128,16 +329,29 @@ func (tp *TagProtection) ListPolicies() []*ProtectionPolicy {
 }
 
 // RemovePolicy removes a policy by name
-func (tp *TagProtection) RemovePolicy(name string) bool {
+func (tp *TagProtection) RemovePolicy(name string) error {
+	if err := tp.removePolicy(name); err != nil {
+		return err
+	}
+	tp.events.Publish(context.Background(), events.PolicyChanged{Name: name, Removed: true})
+	return nil
+}
+
+func (tp *TagProtection) removePolicy(name string) error {
 	tp.mu.Lock()
 	defer tp.mu.Unlock()
 
 	for i, policy := range tp.policies {
 		if policy.Name == name {
+			if tp.store != nil {
+				if err := tp.store.Delete(name); err != nil {
+					return fmt.Errorf("failed to delete stored policy: %w", err)
+				}
+			}
 			tp.policies = append(tp.policies[:i], tp.policies[i+1:]...)
 			tp.logger.Info("policy removed", "name", name)
-			return true
+			return nil
 		}
 	}
-	return false
+	return fmt.Errorf("%w: %s", ErrPolicyNotFound, name)
 }
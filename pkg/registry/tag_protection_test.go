@@ -6,9 +6,12 @@ package registry
 
 import (
 	"context"
+	"errors"
 	"regexp"
 	"testing"
 	"time"
+
+	"github.com/vjranagit/harbor/pkg/events"
 )
 
 func TestTagProtection_Immutability(t *testing.T) {
@@ -143,3 +146,71 @@ func TestTagProtection_Priority(t *testing.T) {
 		t.Error("expected staging tag to be allowed by lower priority policy")
 	}
 }
+
+func TestTagProtection_DuplicatePolicy(t *testing.T) {
+	tp := NewTagProtection()
+
+	policy := &ProtectionPolicy{
+		Name:     "prod",
+		Pattern:  regexp.MustCompile(`production/.*:.*`),
+		Priority: 10,
+	}
+	if err := tp.AddPolicy(policy); err != nil {
+		t.Fatalf("failed to add policy: %v", err)
+	}
+
+	if err := tp.AddPolicy(policy); !errors.Is(err, ErrPolicyExists) {
+		t.Errorf("expected duplicate policy name to be rejected with ErrPolicyExists, got %v", err)
+	}
+
+	if len(tp.ListPolicies()) != 1 {
+		t.Errorf("expected 1 policy, got %d", len(tp.ListPolicies()))
+	}
+
+	if err := tp.AddPolicy(&ProtectionPolicy{Name: "all", Pattern: regexp.MustCompile("")}); err == nil {
+		t.Error("expected an empty pattern to be rejected")
+	}
+}
+
+func TestTagProtection_Events(t *testing.T) {
+	bus := events.NewBus()
+	tp := NewTagProtection(WithProtectionEvents(bus))
+
+	var got []events.Payload
+	bus.Subscribe(func(ctx context.Context, e events.Event) {
+		// Handlers may query the manager that published the event
+		tp.ListPolicies()
+		got = append(got, e.Payload)
+	}, events.Synchronous())
+
+	ctx := context.Background()
+	err := tp.AddPolicy(&ProtectionPolicy{
+		Name:      "releases",
+		Pattern:   regexp.MustCompile(`.*:v\d+$`),
+		Immutable: true,
+	})
+	if err != nil {
+		t.Fatalf("failed to add policy: %v", err)
+	}
+	tp.CanModify(ctx, "library/app", "v1", time.Hour)
+	tp.CanModify(ctx, "library/app", "latest", time.Hour)
+	tp.CanDelete(ctx, "library/app", "v2")
+	if err := tp.RemovePolicy("releases"); err != nil {
+		t.Fatalf("failed to remove policy: %v", err)
+	}
+
+	want := []events.Payload{
+		events.PolicyChanged{Name: "releases"},
+		events.ProtectionViolation{Repository: "library/app", Tag: "v1", Action: "modify", Policy: "releases", Reason: "tag is immutable (policy: releases)"},
+		events.ProtectionViolation{Repository: "library/app", Tag: "v2", Action: "delete", Policy: "releases", Reason: "tag deletion not allowed (policy: releases)"},
+		events.PolicyChanged{Name: "releases", Removed: true},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d events, got %d: %+v", len(want), len(got), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("event %d: expected %+v, got %+v", i, want[i], got[i])
+		}
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2021 vjranagit
+//
+// Route table and JSON helpers for the REST API
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// maxBodySize bounds request bodies
+const maxBodySize = 1 << 20
+
+// route is one API operation. The same table registers the handlers and
+// generates the OpenAPI document, so the two cannot drift apart
+type route struct {
+	method  string
+	path    string
+	summary string
+	tag     string
+	query   []param
+	// request and response are zero values of the JSON body types, nil for
+	// no body
+	request  any
+	response any
+	// status is the success status code
+	status int
+	// stream marks responses sent as Server-Sent Events, each carrying a
+	// response value
+	stream  bool
+	handler http.HandlerFunc
+}
+
+// param documents a query parameter
+type param struct {
+	name        string
+	description string
+}
+
+// routes returns the operations of every configured component
+func (s *Server) routes() []route {
+	routes := []route{{
+		method:   http.MethodGet,
+		path:     "/openapi.json",
+		summary:  "OpenAPI document describing this API",
+		tag:      "meta",
+		response: map[string]any{},
+		status:   http.StatusOK,
+		handler:  s.getOpenAPI,
+	}}
+	if s.batch != nil {
+		routes = append(routes, s.batchRoutes()...)
+	}
+	if s.protection != nil {
+		routes = append(routes, s.policyRoutes()...)
+	}
+	if s.health != nil {
+		routes = append(routes, s.healthRoutes()...)
+	}
+	if s.queue != nil {
+		routes = append(routes, s.conversionRoutes()...)
+	}
+	return routes
+}
+
+// errorResponse is the body of every error response
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// writeJSON writes v with the given status
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// writeError writes an error response
+func writeError(w http.ResponseWriter, status int, format string, args ...any) {
+	writeJSON(w, status, errorResponse{Error: fmt.Sprintf(format, args...)})
+}
+
+// decodeJSON reads a JSON request body into v, rejecting unknown fields
+func decodeJSON(w http.ResponseWriter, r *http.Request, v any) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		if errors.Is(err, io.EOF) {
+			return fmt.Errorf("request body is empty")
+		}
+		return fmt.Errorf("invalid request body: %w", err)
+	}
+	return nil
+}
+
+// optionalTime omits zero times from responses
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
@@ -0,0 +1,482 @@
+// Copyright 2021 vjranagit
+//
+// Batch operation endpoints
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/vjranagit/harbor/pkg/registry"
+)
+
+// batchRequest submits a batch operation
+type batchRequest struct {
+	// Type is delete, copy, tag or convert
+	Type    string   `json:"type"`
+	Targets []string `json:"targets,omitempty"`
+	// Destination is the repository prefix copies are written under
+	Destination string `json:"destination,omitempty"`
+	// Mappings maps source to destination references for tag operations
+	Mappings map[string]string `json:"mappings,omitempty"`
+	// Driver is the conversion driver for convert operations
+	Driver string `json:"driver,omitempty"`
+	// Retry overrides the server's retry policy for this operation
+	Retry *retryRequest `json:"retry,omitempty"`
+	// Force acts on targets tag protection blocks; every override is
+	// logged and published as an event
+	Force bool `json:"force,omitempty"`
+}
+
+// retryRequest is the retry policy of one operation; unset fields keep
+// the defaults
+type retryRequest struct {
+	// MaxAttempts counts the first attempt; 1 disables retries
+	MaxAttempts int `json:"max_attempts,omitempty"`
+	// Backoff and MaxBackoff are durations such as "500ms" or "30s"; a
+	// MaxBackoff of "0s" doubles delays up to a day
+	Backoff    string   `json:"backoff,omitempty"`
+	MaxBackoff string   `json:"max_backoff,omitempty"`
+	Jitter     *float64 `json:"jitter,omitempty"`
+}
+
+// policy converts the request into a retry policy
+func (r *retryRequest) policy() (registry.RetryPolicy, error) {
+	p := registry.DefaultRetryPolicy()
+	if r.MaxAttempts < 0 {
+		return p, fmt.Errorf("retry.max_attempts must be at least 1")
+	}
+	if r.MaxAttempts > 0 {
+		p.MaxAttempts = r.MaxAttempts
+	}
+	for _, d := range []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{
+		{"backoff", r.Backoff, &p.Backoff},
+		{"max_backoff", r.MaxBackoff, &p.MaxBackoff},
+	} {
+		if d.value == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.value)
+		if err != nil || v < 0 {
+			return p, fmt.Errorf("invalid retry.%s %q", d.name, d.value)
+		}
+		*d.dst = v
+	}
+	if r.Jitter != nil {
+		if *r.Jitter < 0 || *r.Jitter > 1 {
+			return p, fmt.Errorf("retry.jitter must be between 0 and 1")
+		}
+		p.Jitter = *r.Jitter
+	}
+	return p, nil
+}
+
+// operationResource is a batch operation as served by the API
+type operationResource struct {
+	ID        string           `json:"id"`
+	Type      string           `json:"type"`
+	Status    string           `json:"status"`
+	Targets   []string         `json:"targets"`
+	Force     bool             `json:"force,omitempty"`
+	Results   []resultResource `json:"results,omitempty"`
+	CreatedAt time.Time        `json:"created_at"`
+	StartedAt *time.Time       `json:"started_at,omitempty"`
+	EndedAt   *time.Time       `json:"ended_at,omitempty"`
+}
+
+// resultResource is the outcome of one batch target
+type resultResource struct {
+	Target  string `json:"target"`
+	Output  string `json:"output,omitempty"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+	// Skipped targets were blocked by tag protection for Reason
+	Skipped  bool   `json:"skipped,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+	Attempts int    `json:"attempts"`
+	Elapsed  string `json:"elapsed"`
+}
+
+func newOperationResource(op registry.BatchOperation) operationResource {
+	res := operationResource{
+		ID:        op.ID,
+		Type:      string(op.Type),
+		Status:    string(op.Status),
+		Targets:   op.Targets,
+		Force:     op.Force,
+		CreatedAt: op.CreatedAt,
+		StartedAt: optionalTime(op.StartedAt),
+		EndedAt:   optionalTime(op.EndedAt),
+	}
+	for _, result := range op.Results {
+		res.Results = append(res.Results, newResultResource(result))
+	}
+	return res
+}
+
+func newResultResource(result registry.BatchOpResult) resultResource {
+	return resultResource{
+		Target:   result.Target,
+		Output:   result.Output,
+		Success:  result.Success,
+		Error:    result.Error,
+		Skipped:  result.Skipped,
+		Reason:   result.Reason,
+		Attempts: result.Attempts,
+		Elapsed:  result.Elapsed.String(),
+	}
+}
+
+// progressResource is a progress event of a running batch operation
+type progressResource struct {
+	ID        string `json:"id"`
+	Status    string `json:"status"`
+	Total     int    `json:"total"`
+	Succeeded int    `json:"succeeded"`
+	Failed    int    `json:"failed"`
+	Skipped   int    `json:"skipped"`
+	Pending   int    `json:"pending"`
+	Elapsed   string `json:"elapsed"`
+	// ETA is empty until a target has finished
+	ETA string `json:"eta,omitempty"`
+	// Result is the target that just finished
+	Result *resultResource `json:"result,omitempty"`
+}
+
+func newProgressResource(p registry.BatchProgress) progressResource {
+	res := progressResource{
+		ID:        p.ID,
+		Status:    string(p.Status),
+		Total:     p.Total,
+		Succeeded: p.Succeeded,
+		Failed:    p.Failed,
+		Skipped:   p.Skipped,
+		Pending:   p.Pending,
+		Elapsed:   p.Elapsed.Round(time.Millisecond).String(),
+	}
+	if p.ETA > 0 {
+		res.ETA = p.ETA.Round(time.Second).String()
+	}
+	if p.Result != nil {
+		result := newResultResource(*p.Result)
+		res.Result = &result
+	}
+	return res
+}
+
+func (s *Server) batchRoutes() []route {
+	return []route{
+		{
+			method:   http.MethodPost,
+			path:     "/batch",
+			summary:  "Submit a batch operation",
+			tag:      "batch",
+			request:  batchRequest{},
+			response: operationResource{},
+			status:   http.StatusAccepted,
+			handler:  s.submitBatch,
+		},
+		{
+			method:  http.MethodGet,
+			path:    "/batch",
+			summary: "List batch operations, oldest first, including the history of finished ones",
+			tag:     "batch",
+			query: []param{
+				{"status", "Only operations with this status"},
+				{"type", "Only operations of this type"},
+				{"since", "Only operations created after this RFC 3339 time or age, e.g. 7d"},
+				{"until", "Only operations created before this RFC 3339 time or age"},
+				{"limit", "Only the newest operations, at most this many"},
+			},
+			response: []operationResource{},
+			status:   http.StatusOK,
+			handler:  s.listBatches,
+		},
+		{
+			method:   http.MethodDelete,
+			path:     "/batch",
+			summary:  "Cancel every pending or running batch operation",
+			tag:      "batch",
+			response: cancelBatches{},
+			status:   http.StatusAccepted,
+			handler:  s.cancelAllBatches,
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/batch/{id}",
+			summary:  "Get a batch operation and its results",
+			tag:      "batch",
+			response: operationResource{},
+			status:   http.StatusOK,
+			handler:  s.getBatch,
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/batch/{id}/events",
+			summary:  "Stream the progress of a batch operation as Server-Sent Events",
+			tag:      "batch",
+			response: progressResource{},
+			status:   http.StatusOK,
+			stream:   true,
+			handler:  s.streamBatch,
+		},
+		{
+			method:   http.MethodDelete,
+			path:     "/batch/{id}",
+			summary:  "Cancel a running batch operation",
+			tag:      "batch",
+			response: operationResource{},
+			status:   http.StatusAccepted,
+			handler:  s.cancelBatch,
+		},
+	}
+}
+
+func (s *Server) submitBatch(w http.ResponseWriter, r *http.Request) {
+	var req batchRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	if err := s.validateBatch(req); err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+
+	// Operations outlive the request; the server cancels them on shutdown
+	op, err := s.startBatch(s.ctx, req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	s.track(op.ID)
+
+	snapshot, _ := s.batch.Snapshot(op.ID)
+	w.Header().Set("Location", APIPrefix+"/batch/"+op.ID)
+	writeJSON(w, http.StatusAccepted, newOperationResource(snapshot))
+}
+
+// validateBatch checks a request has what its operation type needs
+func (s *Server) validateBatch(req batchRequest) error {
+	switch registry.BatchOpType(req.Type) {
+	case registry.BatchOpDelete, registry.BatchOpCopy, registry.BatchOpConvert, registry.BatchOpTag:
+	default:
+		return fmt.Errorf("unknown operation type %q (want delete, copy, tag or convert)", req.Type)
+	}
+
+	if req.Retry != nil {
+		if _, err := req.Retry.policy(); err != nil {
+			return err
+		}
+	}
+	if req.Type == string(registry.BatchOpTag) {
+		if len(req.Mappings) == 0 {
+			return fmt.Errorf("tag operations need mappings")
+		}
+		if len(req.Targets) > 0 {
+			return fmt.Errorf("tag operations take mappings, not targets")
+		}
+		return nil
+	}
+
+	if len(req.Targets) == 0 {
+		return fmt.Errorf("%s operations need targets", req.Type)
+	}
+	if req.Type == string(registry.BatchOpCopy) && req.Destination == "" {
+		return fmt.Errorf("copy operations need a destination")
+	}
+	if req.Type == string(registry.BatchOpConvert) {
+		return s.validateDriver(req.Driver)
+	}
+	return nil
+}
+
+// startBatch starts the operation a request describes
+func (s *Server) startBatch(ctx context.Context, req batchRequest) (*registry.BatchOperation, error) {
+	var opts []registry.OperationOption
+	if req.Retry != nil {
+		policy, err := req.Retry.policy()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, registry.WithOperationRetry(policy))
+	}
+	if req.Force {
+		opts = append(opts, registry.WithForce())
+	}
+
+	switch registry.BatchOpType(req.Type) {
+	case registry.BatchOpDelete:
+		return s.batch.DeleteTags(ctx, req.Targets, opts...)
+	case registry.BatchOpCopy:
+		return s.batch.CopyTags(ctx, req.Targets, req.Destination, opts...)
+	case registry.BatchOpTag:
+		return s.batch.RetagBatch(ctx, req.Mappings, opts...)
+	default:
+		return s.batch.ConvertImages(ctx, req.Targets, req.Driver, opts...)
+	}
+}
+
+// track makes shutdown wait for an operation to finish
+func (s *Server) track(id string) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.batch.Wait(context.Background(), id)
+	}()
+}
+
+func (s *Server) listBatches(w http.ResponseWriter, r *http.Request) {
+	query, err := historyQuery(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+
+	history, err := s.batch.History(query)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+
+	ops := make([]operationResource, 0, len(history))
+	for _, op := range history {
+		ops = append(ops, newOperationResource(op))
+	}
+	writeJSON(w, http.StatusOK, ops)
+}
+
+// historyQuery parses the list filters of a batch listing
+func historyQuery(values url.Values) (registry.HistoryQuery, error) {
+	q := registry.HistoryQuery{
+		Type:   registry.BatchOpType(values.Get("type")),
+		Status: registry.BatchOpStatus(values.Get("status")),
+	}
+
+	var err error
+	if q.Since, err = parseTimeParam("since", values.Get("since")); err != nil {
+		return q, err
+	}
+	if q.Until, err = parseTimeParam("until", values.Get("until")); err != nil {
+		return q, err
+	}
+	if limit := values.Get("limit"); limit != "" {
+		if q.Limit, err = strconv.Atoi(limit); err != nil || q.Limit < 0 {
+			return q, fmt.Errorf("invalid limit %q", limit)
+		}
+	}
+	return q, nil
+}
+
+// parseTimeParam parses an RFC 3339 time or an age such as "7d" or "12h"
+// counted back from now
+func parseTimeParam(name, value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	age, err := registry.ParseAge(value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s %q (want an RFC 3339 time or an age such as 7d)", name, value)
+	}
+	return time.Now().Add(-age), nil
+}
+
+func (s *Server) getBatch(w http.ResponseWriter, r *http.Request) {
+	op, ok := s.batch.Snapshot(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "operation %s not found", r.PathValue("id"))
+		return
+	}
+	writeJSON(w, http.StatusOK, newOperationResource(op))
+}
+
+// streamBatch sends a "progress" event with the current state and one as
+// each target finishes, then a "done" event once the operation has ended
+func (s *Server) streamBatch(w http.ResponseWriter, r *http.Request) {
+	updates, unsubscribe, err := s.batch.Subscribe(r.PathValue("id"))
+	if err != nil {
+		writeBatchError(w, err)
+		return
+	}
+	defer unsubscribe()
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	for {
+		select {
+		case p, ok := <-updates:
+			if !ok {
+				return
+			}
+			event := "progress"
+			if p.Status.Finished() {
+				event = "done"
+			}
+			data, err := json.Marshal(newProgressResource(p))
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		case <-s.streams.Done():
+			return
+		}
+	}
+}
+
+func (s *Server) cancelBatch(w http.ResponseWriter, r *http.Request) {
+	op, err := s.batch.Cancel(r.PathValue("id"))
+	if err != nil {
+		writeBatchError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, newOperationResource(op))
+}
+
+// cancelBatches is the response of cancelling every running operation
+type cancelBatches struct {
+	Cancelled []string `json:"cancelled"`
+}
+
+func (s *Server) cancelAllBatches(w http.ResponseWriter, r *http.Request) {
+	ids := s.batch.CancelAll()
+	if ids == nil {
+		ids = []string{}
+	}
+	writeJSON(w, http.StatusAccepted, cancelBatches{Cancelled: ids})
+}
+
+// writeBatchError maps batch operator errors to status codes
+func writeBatchError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, registry.ErrOperationNotFound):
+		writeError(w, http.StatusNotFound, "%v", err)
+	case errors.Is(err, registry.ErrOperationFinished):
+		writeError(w, http.StatusConflict, "%v", err)
+	default:
+		writeError(w, http.StatusInternalServerError, "%v", err)
+	}
+}
@@ -0,0 +1,437 @@
+// Copyright 2021 vjranagit
+//
+// Batch operation endpoint tests
+
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vjranagit/harbor/pkg/distribution"
+	"github.com/vjranagit/harbor/pkg/distribution/registrytest"
+	"github.com/vjranagit/harbor/pkg/registry"
+)
+
+// waitBatch waits for an operation to finish
+func waitBatch(t *testing.T, bo *registry.BatchOperator, id string) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := bo.Wait(ctx, id); err != nil {
+		t.Fatalf("operation %s did not finish: %v", id, err)
+	}
+}
+
+func TestBatch_SubmitAndGet(t *testing.T) {
+	reg := registrytest.New()
+	defer reg.Close()
+	reg.PushImage("library/nginx", "old-1", nil, []byte("nginx-1"))
+	reg.PushImage("library/nginx", "stable", nil, []byte("nginx-2"))
+
+	client, err := distribution.NewClient(reg.URL())
+	if err != nil {
+		t.Fatalf("failed to create registry client: %v", err)
+	}
+	bo := registry.NewBatchOperator(2, registry.WithRegistryClient(client))
+	h := New(WithBatchOperator(bo)).Handler()
+
+	var op operationResource
+	rec := do(t, h, http.MethodPost, "/batch", batchRequest{
+		Type:        "copy",
+		Targets:     []string{"library/nginx:stable"},
+		Destination: "backup/",
+	}, &op)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusAccepted, rec.Code, rec.Body)
+	}
+	if loc := rec.Header().Get("Location"); loc != APIPrefix+"/batch/"+op.ID {
+		t.Errorf("expected Location of the operation, got %q", loc)
+	}
+	waitBatch(t, bo, op.ID)
+
+	var got operationResource
+	if rec := do(t, h, http.MethodGet, "/batch/"+op.ID, nil, &got); rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+	if got.Status != "completed" || len(got.Results) != 1 || got.EndedAt == nil {
+		t.Fatalf("expected completed operation with 1 result, got %+v", got)
+	}
+	if got.Results[0].Output != "backup/library/nginx:stable" {
+		t.Errorf("unexpected output %q", got.Results[0].Output)
+	}
+
+	del := do(t, h, http.MethodPost, "/batch", batchRequest{Type: "delete", Targets: []string{"library/nginx:missing"}}, &op)
+	if del.Code != http.StatusAccepted {
+		t.Fatalf("expected status %d, got %d", http.StatusAccepted, del.Code)
+	}
+	waitBatch(t, bo, op.ID)
+
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"", 2},
+		{"?status=completed", 1},
+		{"?status=failed", 1},
+		{"?type=delete", 1},
+		{"?type=tag", 0},
+	}
+	for _, tt := range tests {
+		var ops []operationResource
+		do(t, h, http.MethodGet, "/batch"+tt.query, nil, &ops)
+		if len(ops) != tt.want {
+			t.Errorf("%q: expected %d operations, got %d", tt.query, tt.want, len(ops))
+		}
+	}
+
+	if rec := do(t, h, http.MethodGet, "/batch/batch-missing", nil, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("expected status %d for unknown operation, got %d", http.StatusNotFound, rec.Code)
+	}
+}
+
+func TestBatch_Validation(t *testing.T) {
+	jitter := 1.5
+	converter := &fakeConverter{}
+	bo := registry.NewBatchOperator(1, registry.WithImageConverter(converter))
+	h := New(WithBatchOperator(bo), WithConverter(converter)).Handler()
+
+	tests := []struct {
+		name string
+		body any
+		want string
+	}{
+		{"empty body", nil, "empty"},
+		{"unknown field", map[string]any{"type": "delete", "tags": []string{"a:1"}}, "unknown field"},
+		{"unknown type", batchRequest{Type: "move", Targets: []string{"a:1"}}, "unknown operation type"},
+		{"no targets", batchRequest{Type: "delete"}, "need targets"},
+		{"copy without destination", batchRequest{Type: "copy", Targets: []string{"a:1"}}, "destination"},
+		{"tag without mappings", batchRequest{Type: "tag"}, "mappings"},
+		{"tag with targets", batchRequest{Type: "tag", Targets: []string{"a:1"}, Mappings: map[string]string{"a:1": "a:2"}}, "not targets"},
+		{"convert without driver", batchRequest{Type: "convert", Targets: []string{"a:1"}}, "driver is required"},
+		{"convert with unknown driver", batchRequest{Type: "convert", Targets: []string{"a:1"}, Driver: "zstd"}, "unknown driver"},
+		{"negative attempts", batchRequest{Type: "delete", Targets: []string{"a:1"}, Retry: &retryRequest{MaxAttempts: -1}}, "max_attempts"},
+		{"bad backoff", batchRequest{Type: "delete", Targets: []string{"a:1"}, Retry: &retryRequest{Backoff: "soon"}}, "retry.backoff"},
+		{"bad jitter", batchRequest{Type: "tag", Mappings: map[string]string{"a:1": "a:2"}, Retry: &retryRequest{Jitter: &jitter}}, "jitter"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := do(t, h, http.MethodPost, "/batch", tt.body, nil)
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("expected status %d, got %d", http.StatusBadRequest, rec.Code)
+			}
+			if !strings.Contains(rec.Body.String(), tt.want) {
+				t.Errorf("expected error mentioning %q, got %s", tt.want, rec.Body)
+			}
+		})
+	}
+
+	if ops := bo.Snapshots(); len(ops) != 0 {
+		t.Errorf("expected no operations to start, got %d", len(ops))
+	}
+}
+
+func TestBatch_Retry(t *testing.T) {
+	reg := registrytest.New()
+	defer reg.Close()
+	reg.PushImage("library/nginx", "old-1", nil, []byte("nginx-1"))
+	reg.FailRequests(2, http.StatusBadGateway, nil)
+
+	client, err := distribution.NewClient(reg.URL())
+	if err != nil {
+		t.Fatalf("failed to create registry client: %v", err)
+	}
+	bo := registry.NewBatchOperator(1, registry.WithRegistryClient(client))
+	h := New(WithBatchOperator(bo)).Handler()
+
+	var op operationResource
+	do(t, h, http.MethodPost, "/batch", batchRequest{
+		Type:    "delete",
+		Targets: []string{"library/nginx:old-1"},
+		Retry:   &retryRequest{MaxAttempts: 3, Backoff: "1ms"},
+	}, &op)
+	waitBatch(t, bo, op.ID)
+
+	var got operationResource
+	do(t, h, http.MethodGet, "/batch/"+op.ID, nil, &got)
+	if got.Status != "completed" || got.Results[0].Attempts != 3 {
+		t.Errorf("expected completion after 3 attempts, got %+v", got)
+	}
+}
+
+func TestBatch_Protection(t *testing.T) {
+	reg := registrytest.New()
+	defer reg.Close()
+	reg.PushImage("library/nginx", "v1", nil, []byte("nginx-1"))
+
+	tp := registry.NewTagProtection()
+	tp.AddPolicy(&registry.ProtectionPolicy{Name: "versions", Pattern: regexp.MustCompile(`:v\d+$`), Immutable: true})
+	client, err := distribution.NewClient(reg.URL())
+	if err != nil {
+		t.Fatalf("failed to create registry client: %v", err)
+	}
+	bo := registry.NewBatchOperator(1, registry.WithRegistryClient(client), registry.WithProtectionGuard(tp))
+	h := New(WithBatchOperator(bo)).Handler()
+
+	for _, force := range []bool{false, true} {
+		var op operationResource
+		do(t, h, http.MethodPost, "/batch", batchRequest{
+			Type:    "delete",
+			Targets: []string{"library/nginx:v1"},
+			Force:   force,
+		}, &op)
+		waitBatch(t, bo, op.ID)
+
+		var got operationResource
+		do(t, h, http.MethodGet, "/batch/"+op.ID, nil, &got)
+		result := got.Results[0]
+		if got.Status != "completed" || got.Force != force || result.Skipped == force || result.Success != force {
+			t.Errorf("force=%v: unexpected operation %+v", force, got)
+		}
+		if !force && result.Reason != "tag deletion not allowed (policy: versions)" {
+			t.Errorf("expected the policy reason, got %q", result.Reason)
+		}
+	}
+}
+
+func TestBatch_Cancel(t *testing.T) {
+	converter := &fakeConverter{block: true}
+	bo := registry.NewBatchOperator(1, registry.WithImageConverter(converter))
+	h := New(WithBatchOperator(bo)).Handler()
+
+	var op operationResource
+	do(t, h, http.MethodPost, "/batch", batchRequest{
+		Type:    "convert",
+		Targets: []string{"library/app:v1", "library/web:v1"},
+		Driver:  "nydus",
+	}, &op)
+
+	if rec := do(t, h, http.MethodDelete, "/batch/"+op.ID, nil, nil); rec.Code != http.StatusAccepted {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusAccepted, rec.Code, rec.Body)
+	}
+	waitBatch(t, bo, op.ID)
+
+	var got operationResource
+	do(t, h, http.MethodGet, "/batch/"+op.ID, nil, &got)
+	if got.Status != "cancelled" || len(got.Results) != 2 {
+		t.Fatalf("expected cancelled operation with 2 results, got %+v", got)
+	}
+	for _, result := range got.Results {
+		if !strings.Contains(result.Error, "canceled") {
+			t.Errorf("expected %s to be cancelled, got %q", result.Target, result.Error)
+		}
+	}
+
+	if rec := do(t, h, http.MethodDelete, "/batch/"+op.ID, nil, nil); rec.Code != http.StatusConflict {
+		t.Errorf("expected status %d for finished operation, got %d", http.StatusConflict, rec.Code)
+	}
+
+	if rec := do(t, h, http.MethodDelete, "/batch/batch-missing", nil, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("expected status %d for unknown operation, got %d", http.StatusNotFound, rec.Code)
+	}
+}
+
+func TestBatch_CancelAll(t *testing.T) {
+	converter := &fakeConverter{block: true}
+	bo := registry.NewBatchOperator(1, registry.WithImageConverter(converter))
+	h := New(WithBatchOperator(bo)).Handler()
+
+	var ids []string
+	for _, target := range []string{"library/app:v1", "library/web:v1"} {
+		var op operationResource
+		do(t, h, http.MethodPost, "/batch", batchRequest{Type: "convert", Targets: []string{target}, Driver: "nydus"}, &op)
+		ids = append(ids, op.ID)
+	}
+
+	var got cancelBatches
+	if rec := do(t, h, http.MethodDelete, "/batch", nil, &got); rec.Code != http.StatusAccepted {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusAccepted, rec.Code, rec.Body)
+	}
+	if len(got.Cancelled) != len(ids) {
+		t.Errorf("expected %d operations cancelled, got %v", len(ids), got.Cancelled)
+	}
+	for _, id := range ids {
+		waitBatch(t, bo, id)
+		if op, _ := bo.Snapshot(id); op.Status != registry.BatchOpCancelled {
+			t.Errorf("expected %s to be cancelled, got %s", id, op.Status)
+		}
+	}
+
+	if rec := do(t, h, http.MethodDelete, "/batch", nil, &got); rec.Code != http.StatusAccepted || len(got.Cancelled) != 0 {
+		t.Errorf("expected nothing left to cancel, got %d %v", rec.Code, got.Cancelled)
+	}
+}
+
+func TestBatch_History(t *testing.T) {
+	store := registry.NewMemoryHistoryStore()
+	archived := time.Now().Add(-48 * time.Hour)
+	store.Save(registry.BatchOperation{
+		ID:        "batch-archived",
+		Type:      registry.BatchOpDelete,
+		Status:    registry.BatchOpCompleted,
+		Targets:   []string{"library/nginx:old"},
+		CreatedAt: archived,
+		StartedAt: archived,
+		EndedAt:   archived.Add(time.Second),
+	})
+
+	converter := &fakeConverter{}
+	bo := registry.NewBatchOperator(1, registry.WithImageConverter(converter), registry.WithHistory(store))
+	h := New(WithBatchOperator(bo)).Handler()
+
+	var op operationResource
+	do(t, h, http.MethodPost, "/batch", batchRequest{Type: "convert", Targets: []string{"library/nginx:v1"}, Driver: "nydus"}, &op)
+	waitBatch(t, bo, op.ID)
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"batch-archived", op.ID}},
+		{"?since=1d", []string{op.ID}},
+		{"?until=" + time.Now().Add(-time.Hour).Format(time.RFC3339), []string{"batch-archived"}},
+		{"?limit=1", []string{op.ID}},
+		{"?type=delete&status=completed", []string{"batch-archived"}},
+	}
+	for _, tt := range tests {
+		var ops []operationResource
+		do(t, h, http.MethodGet, "/batch"+tt.query, nil, &ops)
+		var got []string
+		for _, o := range ops {
+			got = append(got, o.ID)
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%q: expected %v, got %v", tt.query, tt.want, got)
+		}
+	}
+
+	if rec := do(t, h, http.MethodGet, "/batch?since=yesterday", nil, nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d for invalid since, got %d", http.StatusBadRequest, rec.Code)
+	}
+
+	var got operationResource
+	if rec := do(t, h, http.MethodGet, "/batch/batch-archived", nil, &got); rec.Code != http.StatusOK || got.Targets[0] != "library/nginx:old" {
+		t.Errorf("expected archived operation from history, got %d %+v", rec.Code, got)
+	}
+}
+
+// sseEvent is one Server-Sent Event
+type sseEvent struct {
+	name string
+	data progressResource
+}
+
+// readEvent reads the next event of a stream
+func readEvent(t *testing.T, r *bufio.Reader) (sseEvent, bool) {
+	t.Helper()
+
+	var e sseEvent
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return e, false
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			return e, true
+		case strings.HasPrefix(line, "event: "):
+			e.name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e.data); err != nil {
+				t.Fatalf("invalid event data %q: %v", line, err)
+			}
+		}
+	}
+}
+
+func TestBatch_Events(t *testing.T) {
+	converter := &fakeConverter{block: true}
+	bo := registry.NewBatchOperator(1, registry.WithImageConverter(converter))
+	srv := httptest.NewServer(New(WithBatchOperator(bo)).Handler())
+	defer srv.Close()
+	h := srv.Config.Handler
+
+	var op operationResource
+	do(t, h, http.MethodPost, "/batch", batchRequest{Type: "convert", Targets: []string{"library/app:v1"}, Driver: "nydus"}, &op)
+
+	resp, err := http.Get(srv.URL + APIPrefix + "/batch/" + op.ID + "/events")
+	if err != nil {
+		t.Fatalf("GET events failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected an event stream, got %q", ct)
+	}
+	r := bufio.NewReader(resp.Body)
+
+	e, _ := readEvent(t, r)
+	if e.name != "progress" || e.data.Total != 1 || e.data.Pending != 1 || e.data.Result != nil {
+		t.Errorf("expected the initial progress, got %+v", e)
+	}
+
+	do(t, h, http.MethodDelete, "/batch/"+op.ID, nil, nil)
+
+	e, _ = readEvent(t, r)
+	if e.name != "progress" || e.data.Result == nil || e.data.Result.Target != "library/app:v1" {
+		t.Errorf("expected the target's result, got %+v", e)
+	}
+	e, _ = readEvent(t, r)
+	if e.name != "done" || e.data.Status != "cancelled" || e.data.Failed != 1 {
+		t.Errorf("expected a done event for the cancelled operation, got %+v", e)
+	}
+	if _, ok := readEvent(t, r); ok {
+		t.Error("expected the stream to end after the done event")
+	}
+
+	if rec := do(t, h, http.MethodGet, "/batch/batch-missing/events", nil, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("expected status %d for unknown operation, got %d", http.StatusNotFound, rec.Code)
+	}
+}
+
+func TestBatch_EventsShutdown(t *testing.T) {
+	converter := &fakeConverter{block: true}
+	bo := registry.NewBatchOperator(1, registry.WithImageConverter(converter))
+	s := New(WithBatchOperator(bo), WithShutdownTimeout(5*time.Second))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(ctx, l) }()
+
+	var op operationResource
+	do(t, s.Handler(), http.MethodPost, "/batch", batchRequest{Type: "convert", Targets: []string{"library/app:v1"}, Driver: "nydus"}, &op)
+
+	resp, err := http.Get("http://" + l.Addr().String() + APIPrefix + "/batch/" + op.ID + "/events")
+	if err != nil {
+		t.Fatalf("GET events failed: %v", err)
+	}
+	defer resp.Body.Close()
+	r := bufio.NewReader(resp.Body)
+	readEvent(t, r)
+
+	// Shutdown must not wait on the open stream of a running operation
+	start := time.Now()
+	cancel()
+	select {
+	case <-served:
+	case <-time.After(4 * time.Second):
+		t.Fatal("shutdown waited for the event stream")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected a prompt shutdown, took %v", elapsed)
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright 2021 vjranagit
+//
+// Conversion queue endpoints
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/vjranagit/harbor/pkg/accelerator/queue"
+	"github.com/vjranagit/harbor/pkg/distribution"
+)
+
+// conversionRequest enqueues an image conversion
+type conversionRequest struct {
+	Source string `json:"source"`
+	Driver string `json:"driver"`
+	// Priority orders pending jobs, higher first
+	Priority int `json:"priority,omitempty"`
+}
+
+func (s *Server) conversionRoutes() []route {
+	return []route{
+		{
+			method:   http.MethodPost,
+			path:     "/conversions",
+			summary:  "Enqueue an image conversion",
+			tag:      "conversions",
+			request:  conversionRequest{},
+			response: queue.Job{},
+			status:   http.StatusAccepted,
+			handler:  s.enqueueConversion,
+		},
+		{
+			method:  http.MethodGet,
+			path:    "/conversions",
+			summary: "List conversion jobs in enqueue order",
+			tag:     "conversions",
+			query: []param{
+				{"state", "Only jobs in this state (pending, running, succeeded or dead)"},
+			},
+			response: []queue.Job{},
+			status:   http.StatusOK,
+			handler:  s.listConversions,
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/conversions/{id}",
+			summary:  "Get a conversion job",
+			tag:      "conversions",
+			response: queue.Job{},
+			status:   http.StatusOK,
+			handler:  s.getConversion,
+		},
+		{
+			method:   http.MethodPost,
+			path:     "/conversions/{id}/retry",
+			summary:  "Move a dead-lettered conversion job back to pending",
+			tag:      "conversions",
+			response: queue.Job{},
+			status:   http.StatusOK,
+			handler:  s.retryConversion,
+		},
+	}
+}
+
+func (s *Server) enqueueConversion(w http.ResponseWriter, r *http.Request) {
+	var req conversionRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	ref, err := distribution.ParseReference(req.Source)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid source: %v", err)
+		return
+	}
+	if err := s.validateDriver(req.Driver); err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+
+	dgst := ref.Digest
+	if s.client != nil {
+		desc, err := s.client.HeadManifest(r.Context(), ref.Repository, ref.Identifier())
+		if distribution.IsNotFound(err) {
+			writeError(w, http.StatusBadRequest, "source %s not found", req.Source)
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusBadGateway, "failed to resolve %s: %v", req.Source, err)
+			return
+		}
+		dgst = desc.Digest
+	}
+
+	job, created, err := s.queue.Enqueue(queue.Job{
+		Source:       req.Source,
+		Driver:       req.Driver,
+		SourceDigest: dgst,
+		Priority:     req.Priority,
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+
+	status := http.StatusAccepted
+	if !created {
+		// An equivalent job already exists
+		status = http.StatusOK
+	}
+	w.Header().Set("Location", APIPrefix+"/conversions/"+job.ID)
+	writeJSON(w, status, job)
+}
+
+func (s *Server) listConversions(w http.ResponseWriter, r *http.Request) {
+	var states []queue.State
+	if state := r.URL.Query().Get("state"); state != "" {
+		states = append(states, queue.State(state))
+	}
+
+	jobs, err := s.queue.List(states...)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	if jobs == nil {
+		jobs = []*queue.Job{}
+	}
+	writeJSON(w, http.StatusOK, jobs)
+}
+
+func (s *Server) getConversion(w http.ResponseWriter, r *http.Request) {
+	job, err := s.queue.Get(r.PathValue("id"))
+	if err != nil {
+		writeQueueError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+func (s *Server) retryConversion(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	job, err := s.queue.Get(id)
+	if err != nil {
+		writeQueueError(w, err)
+		return
+	}
+	if job.State != queue.StateDead {
+		writeError(w, http.StatusConflict, "job %s is %s, not dead", id, job.State)
+		return
+	}
+
+	if err := s.queue.Retry(id); err != nil {
+		writeQueueError(w, err)
+		return
+	}
+	if job, err = s.queue.Get(id); err != nil {
+		writeQueueError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+// validateDriver checks driver is one the converter can run
+func (s *Server) validateDriver(driver string) error {
+	if driver == "" {
+		return fmt.Errorf("driver is required")
+	}
+	if s.converter == nil {
+		return nil
+	}
+	if drivers := s.converter.Drivers(); !slices.Contains(drivers, driver) {
+		return fmt.Errorf("unknown driver %q (available: %s)", driver, strings.Join(drivers, ", "))
+	}
+	return nil
+}
+
+// writeQueueError maps queue errors to status codes
+func writeQueueError(w http.ResponseWriter, err error) {
+	if errors.Is(err, queue.ErrJobNotFound) {
+		writeError(w, http.StatusNotFound, "%v", err)
+		return
+	}
+	writeError(w, http.StatusInternalServerError, "%v", err)
+}
@@ -0,0 +1,150 @@
+// Copyright 2021 vjranagit
+//
+// Conversion queue endpoint tests
+
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/vjranagit/harbor/pkg/accelerator/queue"
+	"github.com/vjranagit/harbor/pkg/distribution"
+	"github.com/vjranagit/harbor/pkg/distribution/registrytest"
+)
+
+func TestConversions_Enqueue(t *testing.T) {
+	q := openTestQueue(t)
+	h := New(WithConversionQueue(q), WithConverter(&fakeConverter{})).Handler()
+
+	var job queue.Job
+	rec := do(t, h, http.MethodPost, "/conversions", conversionRequest{Source: "library/app:v1", Driver: "nydus", Priority: 5}, &job)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusAccepted, rec.Code, rec.Body)
+	}
+	if job.ID == "" || job.State != queue.StatePending || job.Priority != 5 {
+		t.Errorf("unexpected job %+v", job)
+	}
+	if loc := rec.Header().Get("Location"); loc != APIPrefix+"/conversions/"+job.ID {
+		t.Errorf("expected Location of the job, got %q", loc)
+	}
+
+	// Digest references are deduplicated
+	source := "library/app@sha256:" + strings.Repeat("a", 64)
+	var first, second queue.Job
+	if rec := do(t, h, http.MethodPost, "/conversions", conversionRequest{Source: source, Driver: "estargz"}, &first); rec.Code != http.StatusAccepted {
+		t.Fatalf("expected status %d, got %d", http.StatusAccepted, rec.Code)
+	}
+	if rec := do(t, h, http.MethodPost, "/conversions", conversionRequest{Source: source, Driver: "estargz"}, &second); rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d for duplicate, got %d", http.StatusOK, rec.Code)
+	}
+	if first.ID != second.ID {
+		t.Errorf("expected duplicate to return job %s, got %s", first.ID, second.ID)
+	}
+
+	var got queue.Job
+	if rec := do(t, h, http.MethodGet, "/conversions/"+job.ID, nil, &got); rec.Code != http.StatusOK || got.Source != "library/app:v1" {
+		t.Errorf("expected job %s, got %d %+v", job.ID, rec.Code, got)
+	}
+	if rec := do(t, h, http.MethodGet, "/conversions/job-999", nil, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("expected status %d for unknown job, got %d", http.StatusNotFound, rec.Code)
+	}
+
+	var jobs []queue.Job
+	do(t, h, http.MethodGet, "/conversions", nil, &jobs)
+	if len(jobs) != 2 {
+		t.Errorf("expected 2 jobs, got %d", len(jobs))
+	}
+	do(t, h, http.MethodGet, "/conversions?state=dead", nil, &jobs)
+	if len(jobs) != 0 {
+		t.Errorf("expected no dead jobs, got %d", len(jobs))
+	}
+}
+
+func TestConversions_ResolveTag(t *testing.T) {
+	reg := registrytest.New()
+	defer reg.Close()
+	desc := reg.PushImage("library/app", "v1", nil, []byte("app-1"))
+
+	client, err := distribution.NewClient(reg.URL())
+	if err != nil {
+		t.Fatalf("failed to create registry client: %v", err)
+	}
+	h := New(WithConversionQueue(openTestQueue(t)), WithConverter(&fakeConverter{}), WithRegistryClient(client)).Handler()
+
+	var job queue.Job
+	if rec := do(t, h, http.MethodPost, "/conversions", conversionRequest{Source: "library/app:v1", Driver: "nydus"}, &job); rec.Code != http.StatusAccepted {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusAccepted, rec.Code, rec.Body)
+	}
+	if job.SourceDigest != desc.Digest {
+		t.Errorf("expected source digest %s, got %q", desc.Digest, job.SourceDigest)
+	}
+
+	// The same tag again is the same job
+	var again queue.Job
+	if rec := do(t, h, http.MethodPost, "/conversions", conversionRequest{Source: "library/app:v1", Driver: "nydus"}, &again); rec.Code != http.StatusOK || again.ID != job.ID {
+		t.Errorf("expected job %s again, got %d %+v", job.ID, rec.Code, again)
+	}
+
+	rec := do(t, h, http.MethodPost, "/conversions", conversionRequest{Source: "library/app:missing", Driver: "nydus"}, nil)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "not found") {
+		t.Errorf("expected status %d for a missing source, got %d: %s", http.StatusBadRequest, rec.Code, rec.Body)
+	}
+}
+
+func TestConversions_Invalid(t *testing.T) {
+	h := New(WithConversionQueue(openTestQueue(t)), WithConverter(&fakeConverter{})).Handler()
+
+	tests := []struct {
+		name string
+		req  conversionRequest
+		want string
+	}{
+		{"no source", conversionRequest{Driver: "nydus"}, "invalid source"},
+		{"no driver", conversionRequest{Source: "library/app:v1"}, "driver is required"},
+		{"unknown driver", conversionRequest{Source: "library/app:v1", Driver: "zstd"}, "available: estargz, nydus"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := do(t, h, http.MethodPost, "/conversions", tt.req, nil)
+			if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), tt.want) {
+				t.Errorf("expected status %d mentioning %q, got %d: %s", http.StatusBadRequest, tt.want, rec.Code, rec.Body)
+			}
+		})
+	}
+}
+
+func TestConversions_Retry(t *testing.T) {
+	q := openTestQueue(t)
+	h := New(WithConversionQueue(q)).Handler()
+
+	job, _, err := q.Enqueue(queue.Job{Source: "library/app:v1", Driver: "nydus", MaxAttempts: 1})
+	if err != nil {
+		t.Fatalf("Enqueue failed: %v", err)
+	}
+	if rec := do(t, h, http.MethodPost, "/conversions/"+job.ID+"/retry", nil, nil); rec.Code != http.StatusConflict {
+		t.Errorf("expected status %d retrying a pending job, got %d", http.StatusConflict, rec.Code)
+	}
+
+	leased, err := q.Dequeue()
+	if err != nil || leased == nil {
+		t.Fatalf("Dequeue failed: %v", err)
+	}
+	if err := q.Fail(leased.ID, errors.New("registry unavailable")); err != nil {
+		t.Fatalf("Fail failed: %v", err)
+	}
+
+	var got queue.Job
+	if rec := do(t, h, http.MethodPost, "/conversions/"+job.ID+"/retry", nil, &got); rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body)
+	}
+	if got.State != queue.StatePending || got.Attempts != 0 {
+		t.Errorf("expected pending job with fresh attempts, got %+v", got)
+	}
+	if rec := do(t, h, http.MethodPost, "/conversions/job-999/retry", nil, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("expected status %d for unknown job, got %d", http.StatusNotFound, rec.Code)
+	}
+}
@@ -0,0 +1,272 @@
+// Copyright 2021 vjranagit
+//
+// Endpoint health endpoints
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/vjranagit/harbor/pkg/registry"
+)
+
+// healthResource is an endpoint's health as served by the API
+type healthResource struct {
+	Endpoint string `json:"endpoint"`
+	Status   string `json:"status"`
+	Circuit  string `json:"circuit"`
+	Latency  string `json:"latency,omitempty"`
+	Error    string `json:"error,omitempty"`
+	// ConsecutiveFailures counts failed checks since the last success
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	Attempts            int        `json:"attempts"`
+	LastCheck           *time.Time `json:"last_check,omitempty"`
+	// RetryAt is when an open circuit lets the next check through
+	RetryAt    *time.Time          `json:"retry_at,omitempty"`
+	Components []componentResource `json:"components,omitempty"`
+	// The remaining fields are how the endpoint is checked
+	Interval         string `json:"interval"`
+	Timeout          string `json:"timeout"`
+	Threshold        int    `json:"threshold"`
+	RetryDelay       string `json:"retry_delay"`
+	MaxRetryDelay    string `json:"max_retry_delay"`
+	SuccessThreshold int    `json:"success_threshold"`
+	SlowThreshold    string `json:"slow_threshold,omitempty"`
+}
+
+// endpointRequest adds or reconfigures a monitored endpoint; settings left
+// out keep their current value, or the monitor's default for new endpoints
+type endpointRequest struct {
+	Endpoint         string `json:"endpoint"`
+	Interval         string `json:"interval,omitempty"`
+	Timeout          string `json:"timeout,omitempty"`
+	Threshold        int    `json:"threshold,omitempty"`
+	RetryDelay       string `json:"retry_delay,omitempty"`
+	MaxRetryDelay    string `json:"max_retry_delay,omitempty"`
+	SuccessThreshold int    `json:"success_threshold,omitempty"`
+	// SlowThreshold "0s" stops failing slow checks
+	SlowThreshold string `json:"slow_threshold,omitempty"`
+}
+
+// options converts the request's settings to endpoint options
+func (req endpointRequest) options() ([]registry.EndpointOption, error) {
+	if req.Endpoint == "" {
+		return nil, fmt.Errorf("endpoint is required")
+	}
+
+	var opts []registry.EndpointOption
+	durations := []struct {
+		name  string
+		value string
+		opt   func(time.Duration) registry.EndpointOption
+	}{
+		{"interval", req.Interval, registry.WithCheckInterval},
+		{"timeout", req.Timeout, registry.WithCheckTimeout},
+		{"retry_delay", req.RetryDelay, registry.WithCircuitRetryDelay},
+		{"max_retry_delay", req.MaxRetryDelay, registry.WithMaxRetryDelay},
+		{"slow_threshold", req.SlowThreshold, registry.WithSlowThreshold},
+	}
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", d.name, err)
+		}
+		opts = append(opts, d.opt(v))
+	}
+	if req.Threshold != 0 {
+		opts = append(opts, registry.WithFailureThreshold(req.Threshold))
+	}
+	if req.SuccessThreshold != 0 {
+		opts = append(opts, registry.WithSuccessThreshold(req.SuccessThreshold))
+	}
+	return opts, nil
+}
+
+// componentResource is the status of one Harbor component
+type componentResource struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+func newHealthResource(check registry.HealthCheck) healthResource {
+	res := healthResource{
+		Endpoint:            check.Endpoint,
+		Status:              string(check.Status),
+		Circuit:             string(check.Circuit),
+		Error:               check.Error,
+		ConsecutiveFailures: check.Consecutive,
+		Attempts:            check.Attempts,
+		LastCheck:           optionalTime(check.LastCheck),
+		RetryAt:             optionalTime(check.RetryAt),
+		Interval:            check.Config.Interval.String(),
+		Timeout:             check.Config.Timeout.String(),
+		Threshold:           check.Config.Threshold,
+		RetryDelay:          check.Config.RetryDelay.String(),
+		MaxRetryDelay:       check.Config.MaxRetryDelay.String(),
+		SuccessThreshold:    check.Config.SuccessThreshold,
+	}
+	if check.Latency > 0 {
+		res.Latency = check.Latency.String()
+	}
+	if check.Config.SlowThreshold > 0 {
+		res.SlowThreshold = check.Config.SlowThreshold.String()
+	}
+	for _, c := range check.Components {
+		res.Components = append(res.Components, componentResource{
+			Name:   c.Name,
+			Status: string(c.Status),
+			Error:  c.Error,
+		})
+	}
+	return res
+}
+
+func (s *Server) healthRoutes() []route {
+	routes := []route{
+		{
+			method:  http.MethodGet,
+			path:    "/health",
+			summary: "Health and circuit state of monitored endpoints",
+			tag:     "health",
+			query: []param{
+				{"endpoint", "Only this endpoint"},
+				{"status", "Only endpoints with this status"},
+			},
+			response: []healthResource{},
+			status:   http.StatusOK,
+			handler:  s.listHealth,
+		},
+		{
+			method:   http.MethodPost,
+			path:     "/health/endpoints",
+			summary:  "Start monitoring an endpoint",
+			tag:      "health",
+			request:  endpointRequest{},
+			response: healthResource{},
+			status:   http.StatusCreated,
+			handler:  s.registerEndpoint,
+		},
+		{
+			method:   http.MethodPut,
+			path:     "/health/endpoints",
+			summary:  "Change how a monitored endpoint is checked",
+			tag:      "health",
+			request:  endpointRequest{},
+			response: healthResource{},
+			status:   http.StatusOK,
+			handler:  s.reconfigureEndpoint,
+		},
+		{
+			method:  http.MethodDelete,
+			path:    "/health/endpoints",
+			summary: "Stop monitoring an endpoint",
+			tag:     "health",
+			query: []param{
+				{"endpoint", "The endpoint to stop monitoring"},
+			},
+			status:  http.StatusNoContent,
+			handler: s.unregisterEndpoint,
+		},
+	}
+	if s.health.History() != nil {
+		routes = append(routes, s.healthReportRoute())
+	}
+	return routes
+}
+
+func (s *Server) listHealth(w http.ResponseWriter, r *http.Request) {
+	endpoint := r.URL.Query().Get("endpoint")
+	status := r.URL.Query().Get("status")
+
+	checks := make([]healthResource, 0)
+	for _, check := range s.health.Snapshot() {
+		if endpoint != "" && check.Endpoint != endpoint {
+			continue
+		}
+		if status != "" && string(check.Status) != status {
+			continue
+		}
+		checks = append(checks, newHealthResource(check))
+	}
+	writeJSON(w, http.StatusOK, checks)
+}
+
+func (s *Server) registerEndpoint(w http.ResponseWriter, r *http.Request) {
+	var req endpointRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	opts, err := req.options()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+
+	if err := s.health.Register(req.Endpoint, opts...); err != nil {
+		writeEndpointError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, newHealthResource(s.healthSnapshot(req.Endpoint)))
+}
+
+func (s *Server) reconfigureEndpoint(w http.ResponseWriter, r *http.Request) {
+	var req endpointRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	opts, err := req.options()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+
+	if _, err := s.health.Reconfigure(req.Endpoint, opts...); err != nil {
+		writeEndpointError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newHealthResource(s.healthSnapshot(req.Endpoint)))
+}
+
+func (s *Server) unregisterEndpoint(w http.ResponseWriter, r *http.Request) {
+	endpoint := r.URL.Query().Get("endpoint")
+	if endpoint == "" {
+		writeError(w, http.StatusBadRequest, "endpoint query parameter is required")
+		return
+	}
+	if err := s.health.Unregister(endpoint); err != nil {
+		writeEndpointError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// healthSnapshot copies an endpoint's state, which checks keep updating
+func (s *Server) healthSnapshot(endpoint string) registry.HealthCheck {
+	for _, check := range s.health.Snapshot() {
+		if check.Endpoint == endpoint {
+			return check
+		}
+	}
+	return registry.HealthCheck{Endpoint: endpoint}
+}
+
+// writeEndpointError maps health monitor errors to status codes
+func writeEndpointError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, registry.ErrEndpointNotFound):
+		writeError(w, http.StatusNotFound, "%v", err)
+	case errors.Is(err, registry.ErrEndpointExists):
+		writeError(w, http.StatusConflict, "%v", err)
+	default:
+		writeError(w, http.StatusBadRequest, "%v", err)
+	}
+}
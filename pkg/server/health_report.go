@@ -0,0 +1,179 @@
+// Copyright 2021 vjranagit
+//
+// Health report endpoint
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/vjranagit/harbor/pkg/registry"
+)
+
+// defaultReportPeriod is how far back reports go without a since parameter
+const defaultReportPeriod = 7 * 24 * time.Hour
+
+// healthReportResource is an availability report as served by the API;
+// registry.DecodeHealthReport reads it back
+type healthReportResource struct {
+	Since time.Time `json:"since"`
+	Until time.Time `json:"until"`
+	// Objective is the availability SLO in percent, if one was given
+	Objective float64                  `json:"objective,omitempty"`
+	Endpoints []endpointReportResource `json:"endpoints"`
+}
+
+// endpointReportResource is one endpoint's share of a report
+type endpointReportResource struct {
+	Endpoint  string `json:"endpoint"`
+	Checks    int    `json:"checks"`
+	Failures  int    `json:"failures"`
+	Incidents int    `json:"incidents"`
+	// Monitored is the time covered by checks, Downtime the part of it the
+	// endpoint was down
+	Monitored    string             `json:"monitored"`
+	Downtime     string             `json:"downtime"`
+	Availability float64            `json:"availability"`
+	Latency      latencyResource    `json:"latency"`
+	Budget       *budgetResource    `json:"budget,omitempty"`
+	BurnRates    []burnRateResource `json:"burn_rates,omitempty"`
+}
+
+// latencyResource holds latency percentiles of successful checks
+type latencyResource struct {
+	P50  string `json:"p50"`
+	P95  string `json:"p95"`
+	P99  string `json:"p99"`
+	Max  string `json:"max"`
+	Mean string `json:"mean"`
+}
+
+// budgetResource is the error budget of the period
+type budgetResource struct {
+	Allowed string `json:"allowed"`
+	// Consumed is the percentage of the budget spent
+	Consumed float64 `json:"consumed"`
+	Met      bool    `json:"met"`
+}
+
+// burnRateResource is one multiwindow burn rate alert
+type burnRateResource struct {
+	Name      string  `json:"name"`
+	Long      string  `json:"long"`
+	Short     string  `json:"short"`
+	Threshold float64 `json:"threshold"`
+	LongRate  float64 `json:"long_rate"`
+	ShortRate float64 `json:"short_rate"`
+	Firing    bool    `json:"firing"`
+}
+
+func newHealthReportResource(report registry.HealthReport) healthReportResource {
+	res := healthReportResource{
+		Since:     report.Since,
+		Until:     report.Until,
+		Objective: report.Objective,
+		Endpoints: make([]endpointReportResource, 0, len(report.Endpoints)),
+	}
+	for _, er := range report.Endpoints {
+		e := endpointReportResource{
+			Endpoint:     er.Endpoint,
+			Checks:       er.Checks,
+			Failures:     er.Failures,
+			Incidents:    er.Incidents,
+			Monitored:    er.Monitored.String(),
+			Downtime:     er.Downtime.String(),
+			Availability: er.Availability,
+			Latency: latencyResource{
+				P50:  er.Latency.P50.String(),
+				P95:  er.Latency.P95.String(),
+				P99:  er.Latency.P99.String(),
+				Max:  er.Latency.Max.String(),
+				Mean: er.Latency.Mean.String(),
+			},
+		}
+		if b := er.Budget; b != nil {
+			e.Budget = &budgetResource{Allowed: b.Allowed.String(), Consumed: b.Consumed, Met: b.Met}
+		}
+		for _, br := range er.BurnRates {
+			e.BurnRates = append(e.BurnRates, burnRateResource{
+				Name:      br.Name,
+				Long:      br.Long.String(),
+				Short:     br.Short.String(),
+				Threshold: br.Threshold,
+				LongRate:  br.LongRate,
+				ShortRate: br.ShortRate,
+				Firing:    br.Firing,
+			})
+		}
+		res.Endpoints = append(res.Endpoints, e)
+	}
+	return res
+}
+
+// healthReportRoute serves reports over the monitor's check history
+func (s *Server) healthReportRoute() route {
+	return route{
+		method:  http.MethodGet,
+		path:    "/health/report",
+		summary: "Availability, latency and SLO burn rates from recorded checks",
+		tag:     "health",
+		query: []param{
+			{"endpoint", "Only this endpoint"},
+			{"since", "Start of the period, RFC 3339 or an age such as 7d (default 7d)"},
+			{"until", "End of the period, RFC 3339 or an age (default now)"},
+			{"objective", "Availability objective in percent, such as 99.9"},
+			{"max_gap", "Longest time one check counts for (default 5m)"},
+		},
+		response: healthReportResource{},
+		status:   http.StatusOK,
+		handler:  s.getHealthReport,
+	}
+}
+
+func (s *Server) getHealthReport(w http.ResponseWriter, r *http.Request) {
+	opts, err := healthReportOptions(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+
+	report, err := registry.NewHealthReport(s.health.History(), opts)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newHealthReportResource(report))
+}
+
+// healthReportOptions parses the query parameters of a report request
+func healthReportOptions(r *http.Request) (registry.HealthReportOptions, error) {
+	values := r.URL.Query()
+	opts := registry.HealthReportOptions{Endpoint: values.Get("endpoint")}
+
+	var err error
+	if opts.Since, err = parseTimeParam("since", values.Get("since")); err != nil {
+		return opts, err
+	}
+	if opts.Since.IsZero() {
+		opts.Since = time.Now().Add(-defaultReportPeriod)
+	}
+	if opts.Until, err = parseTimeParam("until", values.Get("until")); err != nil {
+		return opts, err
+	}
+	if objective := values.Get("objective"); objective != "" {
+		opts.Objective, err = strconv.ParseFloat(objective, 64)
+		if err != nil || opts.Objective <= 0 || opts.Objective >= 100 {
+			return opts, fmt.Errorf("invalid objective %q (want a percentage such as 99.9)", objective)
+		}
+	}
+	if maxGap := values.Get("max_gap"); maxGap != "" {
+		opts.MaxGap, err = time.ParseDuration(maxGap)
+		if err != nil || opts.MaxGap <= 0 {
+			return opts, fmt.Errorf("invalid max_gap %q", maxGap)
+		}
+	}
+	return opts, nil
+}
@@ -0,0 +1,153 @@
+// Copyright 2021 vjranagit
+//
+// Endpoint health endpoint tests
+
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/vjranagit/harbor/pkg/registry"
+)
+
+func TestHealth_List(t *testing.T) {
+	hm := registry.NewHealthMonitor(3, time.Second, time.Second, time.Hour)
+	hm.Register("https://registry2.example.com")
+	hm.Register("https://registry1.example.com")
+	h := New(WithHealthMonitor(hm)).Handler()
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"https://registry1.example.com", "https://registry2.example.com"}},
+		{"?endpoint=https://registry2.example.com", []string{"https://registry2.example.com"}},
+		{"?status=unknown", []string{"https://registry1.example.com", "https://registry2.example.com"}},
+		{"?status=healthy", nil},
+	}
+
+	for _, tt := range tests {
+		var checks []healthResource
+		if rec := do(t, h, http.MethodGet, "/health"+tt.query, nil, &checks); rec.Code != http.StatusOK {
+			t.Fatalf("%q: expected status %d, got %d", tt.query, http.StatusOK, rec.Code)
+		}
+		if len(checks) != len(tt.want) {
+			t.Errorf("%q: expected %d endpoints, got %+v", tt.query, len(tt.want), checks)
+			continue
+		}
+		for i, check := range checks {
+			if check.Endpoint != tt.want[i] || check.Circuit != "closed" || check.LastCheck != nil {
+				t.Errorf("%q: unexpected check %+v", tt.query, check)
+			}
+		}
+	}
+}
+
+func TestHealth_Endpoints(t *testing.T) {
+	hm := registry.NewHealthMonitor(3, time.Second, time.Second, time.Hour)
+	hm.Register("https://registry1.example.com")
+	h := New(WithHealthMonitor(hm)).Handler()
+
+	var created healthResource
+	rec := do(t, h, http.MethodPost, "/health/endpoints",
+		endpointRequest{Endpoint: "https://registry2.example.com", Interval: "30s"}, &created)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body)
+	}
+	if created.Interval != "30s" || created.Timeout != "1s" || created.Threshold != 3 || created.Status != "unknown" ||
+		created.SuccessThreshold != 2 || created.MaxRetryDelay != "5m0s" || created.SlowThreshold != "" {
+		t.Errorf("expected a 30s interval with default settings, got %+v", created)
+	}
+
+	var updated healthResource
+	rec = do(t, h, http.MethodPut, "/health/endpoints",
+		endpointRequest{Endpoint: "https://registry2.example.com", Threshold: 5, RetryDelay: "1m", SuccessThreshold: 3, SlowThreshold: "2s"}, &updated)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body)
+	}
+	if updated.Interval != "30s" || updated.Threshold != 5 || updated.RetryDelay != "1m0s" ||
+		updated.SuccessThreshold != 3 || updated.SlowThreshold != "2s" {
+		t.Errorf("expected threshold and retry delay changed, interval kept, got %+v", updated)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   any
+		want   int
+	}{
+		{"duplicate", http.MethodPost, "/health/endpoints", endpointRequest{Endpoint: "https://registry1.example.com"}, http.StatusConflict},
+		{"missing endpoint", http.MethodPost, "/health/endpoints", endpointRequest{Interval: "1s"}, http.StatusBadRequest},
+		{"bad duration", http.MethodPost, "/health/endpoints", endpointRequest{Endpoint: "https://x.example.com", Timeout: "soon"}, http.StatusBadRequest},
+		{"bad threshold", http.MethodPut, "/health/endpoints", endpointRequest{Endpoint: "https://registry1.example.com", Threshold: -1}, http.StatusBadRequest},
+		{"bad success threshold", http.MethodPut, "/health/endpoints", endpointRequest{Endpoint: "https://registry1.example.com", SuccessThreshold: -1}, http.StatusBadRequest},
+		{"bad slow threshold", http.MethodPut, "/health/endpoints", endpointRequest{Endpoint: "https://registry1.example.com", SlowThreshold: "-1s"}, http.StatusBadRequest},
+		{"reconfigure unknown", http.MethodPut, "/health/endpoints", endpointRequest{Endpoint: "https://x.example.com"}, http.StatusNotFound},
+		{"delete", http.MethodDelete, "/health/endpoints?endpoint=https://registry1.example.com", nil, http.StatusNoContent},
+		{"delete again", http.MethodDelete, "/health/endpoints?endpoint=https://registry1.example.com", nil, http.StatusNotFound},
+		{"delete without endpoint", http.MethodDelete, "/health/endpoints", nil, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if rec := do(t, h, tt.method, tt.path, tt.body, nil); rec.Code != tt.want {
+			t.Errorf("%s: expected status %d, got %d: %s", tt.name, tt.want, rec.Code, rec.Body)
+		}
+	}
+
+	var checks []healthResource
+	do(t, h, http.MethodGet, "/health", nil, &checks)
+	if len(checks) != 1 || checks[0].Endpoint != "https://registry2.example.com" {
+		t.Errorf("expected only registry2 to remain, got %+v", checks)
+	}
+}
+
+func TestHealth_Report(t *testing.T) {
+	history := registry.NewMemoryCheckHistory(0)
+	now := time.Now()
+	for i := 60; i > 0; i-- {
+		history.Append(registry.CheckResult{
+			Endpoint: "https://registry1.example.com",
+			Time:     now.Add(-time.Duration(i) * time.Minute),
+			Status:   registry.HealthStatusHealthy,
+			Up:       i > 6,
+			Latency:  20 * time.Millisecond,
+		})
+	}
+	history.Append(registry.CheckResult{Endpoint: "https://registry2.example.com", Time: now.Add(-time.Minute), Up: true})
+
+	hm := registry.NewHealthMonitor(3, time.Second, time.Second, time.Hour, registry.WithCheckHistory(history))
+	h := New(WithHealthMonitor(hm)).Handler()
+
+	rec := do(t, h, http.MethodGet, "/health/report?since=2h&objective=99.9&endpoint=https://registry1.example.com", nil, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body)
+	}
+	report, err := registry.DecodeHealthReport(rec.Body)
+	if err != nil {
+		t.Fatalf("DecodeHealthReport failed: %v", err)
+	}
+	if len(report.Endpoints) != 1 || report.Objective != 99.9 {
+		t.Fatalf("expected registry1 against a 99.9%% objective, got %+v", report)
+	}
+	er := report.Endpoints[0]
+	if er.Checks != 60 || er.Incidents != 1 || er.Latency.P50 != 20*time.Millisecond || er.Budget == nil || er.Budget.Met {
+		t.Errorf("expected one incident that missed the objective, got %+v", er)
+	}
+	if len(er.BurnRates) != 3 || !er.BurnRates[0].Firing {
+		t.Errorf("expected the fast page window to fire, got %+v", er.BurnRates)
+	}
+
+	for _, query := range []string{"?since=yesterday", "?until=soon", "?objective=100", "?objective=high", "?max_gap=0s"} {
+		if rec := do(t, h, http.MethodGet, "/health/report"+query, nil, nil); rec.Code != http.StatusBadRequest {
+			t.Errorf("%q: expected status %d, got %d", query, http.StatusBadRequest, rec.Code)
+		}
+	}
+
+	// Without a history there is nothing to report on
+	h = New(WithHealthMonitor(registry.NewHealthMonitor(3, time.Second, time.Second, time.Hour))).Handler()
+	if rec := do(t, h, http.MethodGet, "/health/report", nil, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("expected status %d without a history, got %d", http.StatusNotFound, rec.Code)
+	}
+}
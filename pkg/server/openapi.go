@@ -0,0 +1,220 @@
+// Copyright 2021 vjranagit
+//
+// OpenAPI document generated from the route table
+
+package server
+
+import (
+	"net/http"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// openAPIVersion is the OpenAPI specification version of the document
+const openAPIVersion = "3.0.3"
+
+// newOpenAPI describes routes as an OpenAPI document. Schemas are derived
+// from the request and response types by reflection, following their JSON
+// tags, and operation IDs are the handler method names
+func newOpenAPI(routes []route) map[string]any {
+	g := &schemaGenerator{schemas: make(map[string]any)}
+	errorSchema := g.schema(reflect.TypeOf(errorResponse{}))
+
+	paths := make(map[string]any)
+	for _, rt := range routes {
+		item, ok := paths[rt.path].(map[string]any)
+		if !ok {
+			item = make(map[string]any)
+			paths[rt.path] = item
+		}
+
+		success := map[string]any{"description": http.StatusText(rt.status)}
+		if rt.response != nil && rt.stream {
+			success["content"] = map[string]any{
+				"text/event-stream": map[string]any{"schema": g.schema(reflect.TypeOf(rt.response))},
+			}
+		} else if rt.response != nil {
+			success["content"] = jsonContent(g.schema(reflect.TypeOf(rt.response)))
+		}
+
+		op := map[string]any{
+			"operationId": handlerName(rt.handler),
+			"summary":     rt.summary,
+			"tags":        []string{rt.tag},
+			"responses": map[string]any{
+				strconv.Itoa(rt.status): success,
+				"default": map[string]any{
+					"description": "Error",
+					"content":     jsonContent(errorSchema),
+				},
+			},
+		}
+		if params := parameters(rt); len(params) > 0 {
+			op["parameters"] = params
+		}
+		if rt.request != nil {
+			op["requestBody"] = map[string]any{
+				"required": true,
+				"content":  jsonContent(g.schema(reflect.TypeOf(rt.request))),
+			}
+		}
+		item[strings.ToLower(rt.method)] = op
+	}
+
+	return map[string]any{
+		"openapi": openAPIVersion,
+		"info": map[string]any{
+			"title":   "Harbor Toolkit API",
+			"version": strings.TrimPrefix(APIPrefix, "/api/"),
+		},
+		"servers":    []any{map[string]any{"url": APIPrefix}},
+		"paths":      paths,
+		"components": map[string]any{"schemas": g.schemas},
+	}
+}
+
+func (s *Server) getOpenAPI(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.openapi)
+}
+
+// parameters lists the path wildcards and query parameters of a route
+func parameters(rt route) []any {
+	var params []any
+	for _, segment := range strings.Split(rt.path, "/") {
+		name, ok := strings.CutPrefix(segment, "{")
+		if !ok {
+			continue
+		}
+		name = strings.TrimSuffix(strings.TrimSuffix(name, "}"), "...")
+		params = append(params, map[string]any{
+			"name":     name,
+			"in":       "path",
+			"required": true,
+			"schema":   map[string]any{"type": "string"},
+		})
+	}
+	for _, p := range rt.query {
+		params = append(params, map[string]any{
+			"name":        p.name,
+			"in":          "query",
+			"description": p.description,
+			"schema":      map[string]any{"type": "string"},
+		})
+	}
+	return params
+}
+
+func jsonContent(schema map[string]any) map[string]any {
+	return map[string]any{"application/json": map[string]any{"schema": schema}}
+}
+
+// handlerName returns the method name of a handler, e.g. "submitBatch"
+func handlerName(h http.HandlerFunc) string {
+	name := runtime.FuncForPC(reflect.ValueOf(h).Pointer()).Name()
+	name = strings.TrimSuffix(name, "-fm")
+	return name[strings.LastIndex(name, ".")+1:]
+}
+
+// schemaGenerator builds JSON schemas, collecting named struct types as
+// reusable components
+type schemaGenerator struct {
+	schemas map[string]any
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schema returns the schema of t, a reference for struct types
+func (g *schemaGenerator) schema(t reflect.Type) map[string]any {
+	if t == timeType {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return g.schema(t.Elem())
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.object(t)
+		}
+		name := schemaName(t)
+		if _, ok := g.schemas[name]; !ok {
+			// Reserve the name first so recursive types terminate
+			g.schemas[name] = nil
+			g.schemas[name] = g.object(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		return map[string]any{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	default:
+		return map[string]any{}
+	}
+}
+
+// object describes the JSON encoding of a struct type
+func (g *schemaGenerator) object(t reflect.Type) map[string]any {
+	properties := make(map[string]any)
+	var required []string
+	g.fields(t, properties, &required)
+
+	obj := map[string]any{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		obj["required"] = required
+	}
+	return obj
+}
+
+// fields adds the JSON fields of t, flattening embedded structs the way
+// encoding/json does
+func (g *schemaGenerator) fields(t reflect.Type, properties map[string]any, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			g.fields(f.Type, properties, required)
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+
+		properties[name] = g.schema(f.Type)
+		if !strings.Contains(opts, "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
+
+// schemaName names a struct type's component, e.g. operationResource
+// becomes "Operation"
+func schemaName(t reflect.Type) string {
+	name := strings.TrimSuffix(t.Name(), "Resource")
+	r := []rune(name)
+	r[0] = unicode.ToUpper(r[0])
+	return string(r)
+}
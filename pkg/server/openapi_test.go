@@ -0,0 +1,129 @@
+// Copyright 2021 vjranagit
+//
+// OpenAPI generation tests
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vjranagit/harbor/pkg/registry"
+)
+
+func TestOpenAPI_CoversRoutes(t *testing.T) {
+	srv := New(
+		WithTagProtection(registry.NewTagProtection()),
+		WithBatchOperator(registry.NewBatchOperator(1)),
+		WithHealthMonitor(registry.NewHealthMonitor(3, time.Second, time.Second, time.Hour)),
+		WithConversionQueue(openTestQueue(t)),
+	)
+
+	var doc struct {
+		OpenAPI    string                               `json:"openapi"`
+		Paths      map[string]map[string]map[string]any `json:"paths"`
+		Components struct {
+			Schemas map[string]map[string]any `json:"schemas"`
+		} `json:"components"`
+	}
+	if rec := do(t, srv.Handler(), http.MethodGet, "/openapi.json", nil, &doc); rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+	if doc.OpenAPI != openAPIVersion {
+		t.Errorf("expected openapi %s, got %s", openAPIVersion, doc.OpenAPI)
+	}
+
+	routes := srv.routes()
+	ids := make(map[string]bool)
+	for _, rt := range routes {
+		op, ok := doc.Paths[rt.path][strings.ToLower(rt.method)]
+		if !ok {
+			t.Errorf("%s %s missing from document", rt.method, rt.path)
+			continue
+		}
+		id := op["operationId"].(string)
+		if ids[id] {
+			t.Errorf("duplicate operationId %s", id)
+		}
+		ids[id] = true
+	}
+	if !ids["submitBatch"] || !ids["enqueueConversion"] {
+		t.Errorf("expected operation IDs from handler names, got %v", ids)
+	}
+
+	params := doc.Paths["/batch/{id}"]["get"]["parameters"].([]any)
+	if len(params) != 1 || params[0].(map[string]any)["name"] != "id" {
+		t.Errorf("expected id path parameter, got %v", params)
+	}
+
+	for _, name := range []string{"Operation", "Result", "BatchRequest", "Policy", "Health", "Component", "Job", "ErrorResponse"} {
+		if _, ok := doc.Components.Schemas[name]; !ok {
+			t.Errorf("expected schema %s, got %v", name, reflect.ValueOf(doc.Components.Schemas).MapKeys())
+		}
+	}
+}
+
+func TestOpenAPI_Schema(t *testing.T) {
+	type inner struct {
+		Value string `json:"value"`
+	}
+	type Embedded struct {
+		Shared string `json:"shared"`
+	}
+	type sample struct {
+		Embedded
+		Name     string            `json:"name"`
+		Count    int               `json:"count,omitempty"`
+		Ratio    float64           `json:"ratio"`
+		When     *time.Time        `json:"when,omitempty"`
+		Labels   map[string]string `json:"labels"`
+		Items    []inner           `json:"items"`
+		Data     []byte            `json:"data"`
+		Ignored  string            `json:"-"`
+		internal string
+	}
+
+	g := &schemaGenerator{schemas: make(map[string]any)}
+	ref := g.schema(reflect.TypeOf(sample{}))
+	if ref["$ref"] != "#/components/schemas/Sample" {
+		t.Fatalf("expected reference to Sample, got %v", ref)
+	}
+
+	obj := g.schemas["Sample"].(map[string]any)
+	props := obj["properties"].(map[string]any)
+
+	tests := []struct {
+		field string
+		want  map[string]any
+	}{
+		{"shared", map[string]any{"type": "string"}},
+		{"count", map[string]any{"type": "integer"}},
+		{"ratio", map[string]any{"type": "number"}},
+		{"when", map[string]any{"type": "string", "format": "date-time"}},
+		{"labels", map[string]any{"type": "object", "additionalProperties": map[string]any{"type": "string"}}},
+		{"items", map[string]any{"type": "array", "items": map[string]any{"$ref": "#/components/schemas/Inner"}}},
+		{"data", map[string]any{"type": "string", "format": "byte"}},
+	}
+	for _, tt := range tests {
+		if !reflect.DeepEqual(props[tt.field], tt.want) {
+			t.Errorf("%s: expected %v, got %v", tt.field, tt.want, props[tt.field])
+		}
+	}
+	if len(props) != 8 {
+		t.Errorf("expected 8 properties, got %v", props)
+	}
+
+	required := obj["required"].([]string)
+	want := []string{"shared", "name", "ratio", "labels", "items", "data"}
+	if !reflect.DeepEqual(required, want) {
+		t.Errorf("expected required %v, got %v", want, required)
+	}
+
+	if _, err := json.Marshal(g.schemas); err != nil {
+		t.Errorf("schemas do not encode: %v", err)
+	}
+}
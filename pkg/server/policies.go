@@ -0,0 +1,269 @@
+// Copyright 2021 vjranagit
+//
+// Tag protection policy endpoints
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/vjranagit/harbor/pkg/registry"
+)
+
+// policyResource is a protection policy as served by the API; it matches
+// the JSON policy store format
+type policyResource struct {
+	Name        string `json:"name"`
+	Pattern     string `json:"pattern"`
+	Immutable   bool   `json:"immutable,omitempty"`
+	MaxAge      string `json:"max_age,omitempty"`
+	AllowDelete bool   `json:"allow_delete,omitempty"`
+	Priority    int    `json:"priority"`
+}
+
+// checkRequest asks whether an action on a tag is allowed
+type checkRequest struct {
+	Repository string `json:"repository"`
+	Tag        string `json:"tag"`
+	// Action is modify or delete
+	Action string `json:"action"`
+	// Age is the tag's current age, e.g. "48h"; modify checks only
+	Age string `json:"age,omitempty"`
+}
+
+// checkResponse is the verdict of a policy check
+type checkResponse struct {
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+func newPolicyResource(p *registry.ProtectionPolicy) policyResource {
+	res := policyResource{
+		Name:        p.Name,
+		Immutable:   p.Immutable,
+		AllowDelete: p.AllowDelete,
+		Priority:    p.Priority,
+	}
+	if p.Pattern != nil {
+		res.Pattern = p.Pattern.String()
+	}
+	if p.MaxAge > 0 {
+		res.MaxAge = p.MaxAge.String()
+	}
+	return res
+}
+
+// policy compiles the resource, reusing the policy's JSON decoding
+func (res policyResource) policy() (*registry.ProtectionPolicy, error) {
+	if res.Name == "" {
+		return nil, fmt.Errorf("policy name is required")
+	}
+	if res.Pattern == "" {
+		return nil, fmt.Errorf("policy pattern is required")
+	}
+
+	data, err := json.Marshal(res)
+	if err != nil {
+		return nil, err
+	}
+	var p registry.ProtectionPolicy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (s *Server) policyRoutes() []route {
+	return []route{
+		{
+			method:   http.MethodGet,
+			path:     "/policies",
+			summary:  "List protection policies",
+			tag:      "policies",
+			response: []policyResource{},
+			status:   http.StatusOK,
+			handler:  s.listPolicies,
+		},
+		{
+			method:   http.MethodPost,
+			path:     "/policies",
+			summary:  "Create a protection policy",
+			tag:      "policies",
+			request:  policyResource{},
+			response: policyResource{},
+			status:   http.StatusCreated,
+			handler:  s.createPolicy,
+		},
+		{
+			method:   http.MethodPost,
+			path:     "/policies/check",
+			summary:  "Check whether policies allow modifying or deleting a tag",
+			tag:      "policies",
+			request:  checkRequest{},
+			response: checkResponse{},
+			status:   http.StatusOK,
+			handler:  s.checkPolicy,
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/policies/{name}",
+			summary:  "Get a protection policy",
+			tag:      "policies",
+			response: policyResource{},
+			status:   http.StatusOK,
+			handler:  s.getPolicy,
+		},
+		{
+			method:   http.MethodPut,
+			path:     "/policies/{name}",
+			summary:  "Create or replace a protection policy",
+			tag:      "policies",
+			request:  policyResource{},
+			response: policyResource{},
+			status:   http.StatusOK,
+			handler:  s.putPolicy,
+		},
+		{
+			method:  http.MethodDelete,
+			path:    "/policies/{name}",
+			summary: "Delete a protection policy",
+			tag:     "policies",
+			status:  http.StatusNoContent,
+			handler: s.deletePolicy,
+		},
+	}
+}
+
+func (s *Server) listPolicies(w http.ResponseWriter, r *http.Request) {
+	policies := make([]policyResource, 0)
+	for _, p := range s.protection.ListPolicies() {
+		policies = append(policies, newPolicyResource(p))
+	}
+	writeJSON(w, http.StatusOK, policies)
+}
+
+func (s *Server) createPolicy(w http.ResponseWriter, r *http.Request) {
+	var res policyResource
+	if err := decodeJSON(w, r, &res); err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	p, err := res.policy()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+
+	if err := s.protection.AddPolicy(p); err != nil {
+		writePolicyError(w, err)
+		return
+	}
+	w.Header().Set("Location", APIPrefix+"/policies/"+p.Name)
+	writeJSON(w, http.StatusCreated, newPolicyResource(p))
+}
+
+func (s *Server) getPolicy(w http.ResponseWriter, r *http.Request) {
+	p := s.findPolicy(r.PathValue("name"))
+	if p == nil {
+		writeError(w, http.StatusNotFound, "policy %s not found", r.PathValue("name"))
+		return
+	}
+	writeJSON(w, http.StatusOK, newPolicyResource(p))
+}
+
+func (s *Server) putPolicy(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	var res policyResource
+	if err := decodeJSON(w, r, &res); err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	if res.Name == "" {
+		res.Name = name
+	}
+	if res.Name != name {
+		writeError(w, http.StatusBadRequest, "policy name %q does not match path %q", res.Name, name)
+		return
+	}
+	p, err := res.policy()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+
+	if err := s.protection.PutPolicy(p); err != nil {
+		writePolicyError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newPolicyResource(p))
+}
+
+func (s *Server) deletePolicy(w http.ResponseWriter, r *http.Request) {
+	if err := s.protection.RemovePolicy(r.PathValue("name")); err != nil {
+		writePolicyError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) checkPolicy(w http.ResponseWriter, r *http.Request) {
+	var req checkRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	if req.Repository == "" || req.Tag == "" {
+		writeError(w, http.StatusBadRequest, "repository and tag are required")
+		return
+	}
+
+	var allowed bool
+	var reason string
+	switch req.Action {
+	case "modify":
+		var age time.Duration
+		if req.Age != "" {
+			var err error
+			if age, err = time.ParseDuration(req.Age); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid age: %v", err)
+				return
+			}
+		}
+		allowed, reason = s.protection.CanModify(r.Context(), req.Repository, req.Tag, age)
+	case "delete":
+		allowed, reason = s.protection.CanDelete(r.Context(), req.Repository, req.Tag)
+	default:
+		writeError(w, http.StatusBadRequest, "unknown action %q (want modify or delete)", req.Action)
+		return
+	}
+	writeJSON(w, http.StatusOK, checkResponse{Allowed: allowed, Reason: reason})
+}
+
+// findPolicy returns the named policy, or nil
+func (s *Server) findPolicy(name string) *registry.ProtectionPolicy {
+	for _, p := range s.protection.ListPolicies() {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// writePolicyError maps tag protection errors to status codes
+func writePolicyError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, registry.ErrPolicyNotFound):
+		writeError(w, http.StatusNotFound, "%v", err)
+	case errors.Is(err, registry.ErrPolicyExists):
+		writeError(w, http.StatusConflict, "%v", err)
+	case errors.Is(err, registry.ErrPolicyReadOnly):
+		writeError(w, http.StatusForbidden, "%v", err)
+	default:
+		writeError(w, http.StatusInternalServerError, "%v", err)
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2021 vjranagit
+//
+// Tag protection policy endpoint tests
+
+package server
+
+import (
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/vjranagit/harbor/pkg/registry"
+)
+
+func TestPolicies_CRUD(t *testing.T) {
+	tp := registry.NewTagProtection()
+	h := New(WithTagProtection(tp)).Handler()
+
+	prod := policyResource{Name: "prod", Pattern: `.*:v\d+`, Immutable: true, Priority: 10}
+
+	var created policyResource
+	rec := do(t, h, http.MethodPost, "/policies", prod, &created)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body)
+	}
+	if created != prod {
+		t.Errorf("expected %+v, got %+v", prod, created)
+	}
+	if rec := do(t, h, http.MethodPost, "/policies", prod, nil); rec.Code != http.StatusConflict {
+		t.Errorf("expected status %d for duplicate, got %d", http.StatusConflict, rec.Code)
+	}
+
+	var got policyResource
+	if rec := do(t, h, http.MethodGet, "/policies/prod", nil, &got); rec.Code != http.StatusOK || got != prod {
+		t.Errorf("expected %+v, got %d %+v", prod, rec.Code, got)
+	}
+
+	// Replace with a path-named body
+	replaced := policyResource{Pattern: `.*:.*`, MaxAge: "168h0m0s", Priority: 5}
+	if rec := do(t, h, http.MethodPut, "/policies/prod", replaced, &got); rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body)
+	}
+	policies := tp.ListPolicies()
+	if len(policies) != 1 || policies[0].Immutable || policies[0].MaxAge.Hours() != 168 {
+		t.Errorf("expected replaced policy, got %+v", policies)
+	}
+
+	// Put creates missing policies too
+	if rec := do(t, h, http.MethodPut, "/policies/dev", policyResource{Pattern: "dev/.*", AllowDelete: true}, nil); rec.Code != http.StatusOK {
+		t.Errorf("expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body)
+	}
+	if rec := do(t, h, http.MethodPut, "/policies/dev", policyResource{Name: "other", Pattern: "dev/.*"}, nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d for mismatched name, got %d", http.StatusBadRequest, rec.Code)
+	}
+
+	var list []policyResource
+	do(t, h, http.MethodGet, "/policies", nil, &list)
+	if len(list) != 2 {
+		t.Errorf("expected 2 policies, got %d", len(list))
+	}
+
+	if rec := do(t, h, http.MethodDelete, "/policies/prod", nil, nil); rec.Code != http.StatusNoContent {
+		t.Errorf("expected status %d, got %d", http.StatusNoContent, rec.Code)
+	}
+	if rec := do(t, h, http.MethodGet, "/policies/prod", nil, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("expected status %d after delete, got %d", http.StatusNotFound, rec.Code)
+	}
+	if rec := do(t, h, http.MethodDelete, "/policies/prod", nil, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("expected status %d deleting twice, got %d", http.StatusNotFound, rec.Code)
+	}
+}
+
+func TestPolicies_Invalid(t *testing.T) {
+	h := New(WithTagProtection(registry.NewTagProtection())).Handler()
+
+	tests := []struct {
+		name string
+		body policyResource
+		want string
+	}{
+		{"no name", policyResource{Pattern: ".*"}, "name is required"},
+		{"no pattern", policyResource{Name: "p", Immutable: true}, "pattern is required"},
+		{"bad pattern", policyResource{Name: "p", Pattern: "(["}, "invalid pattern"},
+		{"bad max age", policyResource{Name: "p", Pattern: ".*", MaxAge: "a week"}, "invalid max_age"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := do(t, h, http.MethodPost, "/policies", tt.body, nil)
+			if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), tt.want) {
+				t.Errorf("expected status %d mentioning %q, got %d: %s", http.StatusBadRequest, tt.want, rec.Code, rec.Body)
+			}
+		})
+	}
+}
+
+func TestPolicies_ReadOnly(t *testing.T) {
+	base, err := registry.OpenPolicyStore(filepath.Join(t.TempDir(), "policies.json"))
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	store := registry.NewLayeredPolicyStore(base, []*registry.ProtectionPolicy{
+		{Name: "releases", Pattern: regexp.MustCompile(`.*:v.*`), Immutable: true},
+	})
+	tp, err := registry.LoadTagProtection(store)
+	if err != nil {
+		t.Fatalf("failed to load policies: %v", err)
+	}
+	h := New(WithTagProtection(tp)).Handler()
+
+	if rec := do(t, h, http.MethodDelete, "/policies/releases", nil, nil); rec.Code != http.StatusForbidden {
+		t.Errorf("expected status %d for config policy, got %d", http.StatusForbidden, rec.Code)
+	}
+	if rec := do(t, h, http.MethodPut, "/policies/releases", policyResource{Pattern: ".*"}, nil); rec.Code != http.StatusForbidden {
+		t.Errorf("expected status %d replacing config policy, got %d", http.StatusForbidden, rec.Code)
+	}
+	if len(tp.ListPolicies()) != 1 {
+		t.Errorf("expected config policy to remain, got %d policies", len(tp.ListPolicies()))
+	}
+}
+
+func TestPolicies_Check(t *testing.T) {
+	tp := registry.NewTagProtection()
+	tp.AddPolicy(&registry.ProtectionPolicy{Name: "prod", Pattern: regexp.MustCompile(`.*:v\d+`), Immutable: true})
+	tp.AddPolicy(&registry.ProtectionPolicy{Name: "recent", Pattern: regexp.MustCompile(`.*:latest`), MaxAge: 168 * 60 * 60 * 1e9, AllowDelete: true})
+	h := New(WithTagProtection(tp)).Handler()
+
+	tests := []struct {
+		name    string
+		req     checkRequest
+		allowed bool
+		reason  string
+	}{
+		{"immutable", checkRequest{Repository: "library/app", Tag: "v1", Action: "modify"}, false, "immutable"},
+		{"young", checkRequest{Repository: "library/app", Tag: "latest", Action: "modify", Age: "1h"}, false, "protected for"},
+		{"old", checkRequest{Repository: "library/app", Tag: "latest", Action: "modify", Age: "200h"}, true, ""},
+		{"delete blocked", checkRequest{Repository: "library/app", Tag: "v1", Action: "delete"}, false, "deletion not allowed"},
+		{"delete allowed", checkRequest{Repository: "library/app", Tag: "latest", Action: "delete"}, true, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got checkResponse
+			if rec := do(t, h, http.MethodPost, "/policies/check", tt.req, &got); rec.Code != http.StatusOK {
+				t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body)
+			}
+			if got.Allowed != tt.allowed || !strings.Contains(got.Reason, tt.reason) {
+				t.Errorf("expected allowed=%t reason %q, got %+v", tt.allowed, tt.reason, got)
+			}
+		})
+	}
+
+	for _, req := range []checkRequest{
+		{Repository: "library/app", Tag: "v1", Action: "rename"},
+		{Repository: "library/app", Action: "delete"},
+		{Repository: "library/app", Tag: "v1", Action: "modify", Age: "old"},
+	} {
+		if rec := do(t, h, http.MethodPost, "/policies/check", req, nil); rec.Code != http.StatusBadRequest {
+			t.Errorf("%+v: expected status %d, got %d", req, http.StatusBadRequest, rec.Code)
+		}
+	}
+}
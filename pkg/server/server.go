@@ -0,0 +1,294 @@
+// Copyright 2021 vjranagit
+//
+// Long-running daemon hosting registry and acceleration components
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/vjranagit/harbor/pkg/accelerator/queue"
+	"github.com/vjranagit/harbor/pkg/distribution"
+	"github.com/vjranagit/harbor/pkg/registry"
+)
+
+// APIPrefix is the path prefix of the versioned REST API
+const APIPrefix = "/api/v1"
+
+// MetricsPath is where WithMetrics serves its handler
+const MetricsPath = "/metrics"
+
+// Defaults for optional settings
+const (
+	DefaultShutdownTimeout = 30 * time.Second
+	DefaultQueueWorkers    = 2
+	DefaultQueuePoll       = 2 * time.Second
+)
+
+// Converter runs queued conversion jobs; *accelerator.Converter
+// implements it
+type Converter interface {
+	registry.ImageConverter
+	Drivers() []string
+}
+
+// Server exposes shared toolkit components over HTTP. Components are
+// optional; the API and its OpenAPI document only cover the configured ones
+type Server struct {
+	protection *registry.TagProtection
+	batch      *registry.BatchOperator
+	health     *registry.HealthMonitor
+	queue      *queue.Queue
+	converter  Converter
+	client     *distribution.Client
+
+	metrics http.Handler
+
+	queueWorkers    int
+	queuePoll       time.Duration
+	shutdownTimeout time.Duration
+
+	handler http.Handler
+	openapi map[string]any
+	logger  *slog.Logger
+
+	// ctx outlives requests: batch operations and queue workers run on it
+	ctx    context.Context
+	cancel context.CancelFunc
+	// streams ends event streams when shutdown starts, since they would
+	// otherwise keep their connections busy until operations finish
+	streams     context.Context
+	stopStreams context.CancelFunc
+
+	wg sync.WaitGroup
+}
+
+// Option configures a Server
+type Option func(*Server)
+
+// WithTagProtection serves protection policy management
+func WithTagProtection(tp *registry.TagProtection) Option {
+	return func(s *Server) {
+		s.protection = tp
+	}
+}
+
+// WithBatchOperator serves batch operations
+func WithBatchOperator(bo *registry.BatchOperator) Option {
+	return func(s *Server) {
+		s.batch = bo
+	}
+}
+
+// WithHealthMonitor serves endpoint health; the monitor is started and
+// stopped with the server
+func WithHealthMonitor(hm *registry.HealthMonitor) Option {
+	return func(s *Server) {
+		s.health = hm
+	}
+}
+
+// WithConversionQueue serves conversion job submission and status
+func WithConversionQueue(q *queue.Queue) Option {
+	return func(s *Server) {
+		s.queue = q
+	}
+}
+
+// WithConverter processes queued conversion jobs while the server runs
+func WithConverter(c Converter) Option {
+	return func(s *Server) {
+		s.converter = c
+	}
+}
+
+// WithRegistryClient resolves conversion sources given by tag to the
+// manifest digest they point at when they are enqueued
+func WithRegistryClient(c *distribution.Client) Option {
+	return func(s *Server) {
+		s.client = c
+	}
+}
+
+// WithMetrics serves h at /metrics, outside the versioned API
+func WithMetrics(h http.Handler) Option {
+	return func(s *Server) {
+		s.metrics = h
+	}
+}
+
+// WithQueueWorkers sets how many conversion jobs run concurrently
+func WithQueueWorkers(n int) Option {
+	return func(s *Server) {
+		s.queueWorkers = n
+	}
+}
+
+// WithShutdownTimeout bounds how long shutdown waits for in-flight
+// requests and running work
+func WithShutdownTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.shutdownTimeout = d
+	}
+}
+
+// New creates a server for the configured components
+func New(opts ...Option) *Server {
+	ctx, cancel := context.WithCancel(context.Background())
+	streams, stopStreams := context.WithCancel(context.Background())
+
+	s := &Server{
+		queueWorkers:    DefaultQueueWorkers,
+		queuePoll:       DefaultQueuePoll,
+		shutdownTimeout: DefaultShutdownTimeout,
+		logger:          slog.Default().With("component", "server"),
+		ctx:             ctx,
+		cancel:          cancel,
+		streams:         streams,
+		stopStreams:     stopStreams,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	routes := s.routes()
+	mux := http.NewServeMux()
+	for _, rt := range routes {
+		mux.Handle(rt.method+" "+APIPrefix+rt.path, rt.handler)
+	}
+	if s.metrics != nil {
+		mux.Handle("GET "+MetricsPath, s.metrics)
+	}
+	s.handler = s.logRequests(mux)
+	s.openapi = newOpenAPI(routes)
+	return s
+}
+
+// Handler returns the HTTP handler serving the API
+func (s *Server) Handler() http.Handler {
+	return s.handler
+}
+
+// ListenAndServe listens on addr and serves until ctx is done
+func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	return s.Serve(ctx, l)
+}
+
+// Serve runs background work and serves the API on l until ctx is done,
+// then shuts down gracefully: in-flight requests finish, running batch
+// operations are cancelled and queue workers stop. Conversion jobs that
+// were interrupted keep their lease and are retried when it expires
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	srv := &http.Server{
+		Handler:           s.handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	srv.RegisterOnShutdown(s.stopStreams)
+
+	if s.health != nil {
+		s.health.Start()
+	}
+	if s.queue != nil && s.converter != nil {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.queue.Process(s.ctx, s.queueWorkers, s.queuePoll, s.convertJob)
+		}()
+	}
+
+	s.logger.Info("server listening", "addr", l.Addr().String())
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.Serve(l)
+	}()
+
+	var serveErr error
+	select {
+	case err := <-errCh:
+		serveErr = err
+	case <-ctx.Done():
+	}
+
+	s.logger.Info("shutting down", "timeout", s.shutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		s.logger.Warn("http shutdown incomplete", "error", err)
+	}
+	s.shutdown(shutdownCtx)
+
+	if errors.Is(serveErr, http.ErrServerClosed) {
+		serveErr = nil
+	}
+	return serveErr
+}
+
+// shutdown stops background work, waiting at most until ctx is done
+func (s *Server) shutdown(ctx context.Context) {
+	s.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		s.logger.Warn("background work still running at shutdown")
+	}
+
+	if s.health != nil {
+		s.health.Stop()
+	}
+	s.logger.Info("server stopped")
+}
+
+// convertJob runs a queued conversion job
+func (s *Server) convertJob(ctx context.Context, job *queue.Job) (string, error) {
+	return s.converter.ConvertImage(ctx, job.Source, job.Driver)
+}
+
+// logRequests logs every request at debug level
+func (s *Server) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		s.logger.DebugContext(r.Context(), "request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"duration", time.Since(start),
+		)
+	})
+}
+
+// statusRecorder captures the response status for logging
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,212 @@
+// Copyright 2021 vjranagit
+//
+// Server lifecycle tests
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vjranagit/harbor/pkg/accelerator/queue"
+	"github.com/vjranagit/harbor/pkg/distribution"
+	"github.com/vjranagit/harbor/pkg/registry"
+)
+
+// fakeConverter records conversions; with block set, conversions wait
+// until their context is done
+type fakeConverter struct {
+	mu    sync.Mutex
+	calls []string
+	block bool
+}
+
+func (f *fakeConverter) ConvertImage(ctx context.Context, source, driver string) (string, error) {
+	f.mu.Lock()
+	f.calls = append(f.calls, source)
+	f.mu.Unlock()
+
+	if f.block {
+		<-ctx.Done()
+		return "", ctx.Err()
+	}
+	return source + "-" + driver, nil
+}
+
+func (f *fakeConverter) TargetTag(ref distribution.Reference, driver string) string {
+	return ref.Tag + "-" + driver
+}
+
+func (f *fakeConverter) Drivers() []string {
+	return []string{"estargz", "nydus"}
+}
+
+// do sends a request to h and decodes the JSON response into out, if given
+func do(t *testing.T, h http.Handler, method, path string, body, out any) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			t.Fatalf("failed to encode body: %v", err)
+		}
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, APIPrefix+path, &buf))
+
+	if out != nil && rec.Code < 300 {
+		if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s %s: failed to decode response %q: %v", method, path, rec.Body.String(), err)
+		}
+	}
+	return rec
+}
+
+// openTestQueue opens a conversion queue in a temporary directory
+func openTestQueue(t *testing.T) *queue.Queue {
+	t.Helper()
+
+	q, err := queue.Open(filepath.Join(t.TempDir(), "queue.db"))
+	if err != nil {
+		t.Fatalf("failed to open queue: %v", err)
+	}
+	t.Cleanup(func() { q.Close() })
+	return q
+}
+
+func TestServer_ServeProcessesQueue(t *testing.T) {
+	q := openTestQueue(t)
+	converter := &fakeConverter{}
+	srv := New(WithConversionQueue(q), WithConverter(converter), WithQueueWorkers(1))
+	srv.queuePoll = 10 * time.Millisecond
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ctx, l) }()
+
+	body := bytes.NewBufferString(`{"source": "library/app:v1", "driver": "estargz"}`)
+	resp, err := http.Post("http://"+l.Addr().String()+APIPrefix+"/conversions", "application/json", body)
+	if err != nil {
+		t.Fatalf("POST failed: %v", err)
+	}
+	var job queue.Job
+	json.NewDecoder(resp.Body).Decode(&job)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected status %d, got %d", http.StatusAccepted, resp.StatusCode)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got, err := q.Get(job.ID)
+		if err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+		if got.State == queue.StateSucceeded {
+			if got.Result != "library/app:v1-estargz" {
+				t.Errorf("expected converter result, got %q", got.Result)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job not processed, state %s", got.State)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("expected clean shutdown, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after shutdown")
+	}
+}
+
+func TestServer_ShutdownCancelsBatches(t *testing.T) {
+	converter := &fakeConverter{block: true}
+	bo := registry.NewBatchOperator(2, registry.WithImageConverter(converter))
+	srv := New(WithBatchOperator(bo), WithConverter(converter), WithShutdownTimeout(5*time.Second))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ctx, l) }()
+
+	var op operationResource
+	rec := do(t, srv.Handler(), http.MethodPost, "/batch", batchRequest{
+		Type:    "convert",
+		Targets: []string{"library/app:v1"},
+		Driver:  "nydus",
+	}, &op)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusAccepted, rec.Code, rec.Body)
+	}
+
+	cancel()
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after shutdown")
+	}
+
+	finished, ok := bo.Snapshot(op.ID)
+	if !ok || finished.Status != registry.BatchOpCancelled {
+		t.Errorf("expected the running operation to be cancelled, got %+v", finished)
+	}
+}
+
+func TestServer_UnconfiguredComponents(t *testing.T) {
+	srv := New(WithTagProtection(registry.NewTagProtection()))
+
+	if rec := do(t, srv.Handler(), http.MethodGet, "/policies", nil, nil); rec.Code != http.StatusOK {
+		t.Errorf("expected configured component to be served, got %d", rec.Code)
+	}
+	for _, path := range []string{"/batch", "/health", "/conversions"} {
+		if rec := do(t, srv.Handler(), http.MethodGet, path, nil, nil); rec.Code != http.StatusNotFound {
+			t.Errorf("expected %s to be absent, got %d", path, rec.Code)
+		}
+	}
+}
+
+func TestServer_Metrics(t *testing.T) {
+	metrics := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("harbor_up 1\n"))
+	})
+
+	tests := []struct {
+		name string
+		opts []Option
+		want int
+	}{
+		{"served outside the API", []Option{WithMetrics(metrics)}, http.StatusOK},
+		{"absent without a handler", nil, http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			New(tt.opts...).Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, MetricsPath, nil))
+			if rec.Code != tt.want {
+				t.Errorf("expected status %d, got %d", tt.want, rec.Code)
+			}
+		})
+	}
+}